@@ -23,6 +23,7 @@ import (
 	"errors"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -59,6 +60,8 @@ type UserIDExistsRequestAccessToken struct {
 // whether a user ID exists
 type UserIDExistsResponse struct {
 	UserIDExists bool `json:"exists"`
+	// The application service which owns the user ID, if it exists
+	AppServiceID string `json:"appservice_id,omitempty"`
 }
 
 // AppServiceQueryAPI is used to query user and room alias data from application
@@ -114,6 +117,14 @@ func RetrieveUserProfile(
 
 	// Try to query the user from the local database again
 	profile, err = accountDB.GetProfileByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		// The application service didn't register the user, so create it on
+		// their behalf, in the same way as when they masquerade as the user.
+		if _, err = accountDB.CreateAccount(ctx, localpart, "", userResp.AppServiceID); err != nil && !errors.Is(err, sqlutil.ErrUserExists) {
+			return nil, err
+		}
+		profile, err = accountDB.GetProfileByLocalpart(ctx, localpart)
+	}
 	if err != nil {
 		return nil, err
 	}
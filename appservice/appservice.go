@@ -76,6 +76,14 @@ func NewInternalAPI(
 		}
 	}
 
+	webhookStates := make([]*types.WebhookWorkerState, len(base.Cfg.AppServiceAPI.Webhooks))
+	for i, webhook := range base.Cfg.AppServiceAPI.Webhooks {
+		webhookStates[i] = &types.WebhookWorkerState{
+			Webhook: webhook,
+			Cond:    sync.NewCond(&sync.Mutex{}),
+		}
+	}
+
 	// Create appserivce query API with an HTTP client that will be used for all
 	// outbound and inbound requests (inbound only for the internal API)
 	appserviceQueryAPI := &query.AppServiceQueryAPI{
@@ -85,12 +93,12 @@ func NewInternalAPI(
 		Cfg: base.Cfg,
 	}
 
-	// Only consume if we actually have ASes to track, else we'll just chew cycles needlessly.
-	// We can't add ASes at runtime so this is safe to do.
-	if len(workerStates) > 0 {
+	// Only consume if we actually have ASes or webhooks to track, else we'll just chew
+	// cycles needlessly. We can't add either at runtime so this is safe to do.
+	if len(workerStates) > 0 || len(webhookStates) > 0 {
 		consumer := consumers.NewOutputRoomEventConsumer(
 			base.Cfg, consumer, appserviceDB,
-			rsAPI, workerStates,
+			rsAPI, workerStates, webhookStates,
 		)
 		if err := consumer.Start(); err != nil {
 			logrus.WithError(err).Panicf("failed to start appservice roomserver consumer")
@@ -101,6 +109,9 @@ func NewInternalAPI(
 	if err := workers.SetupTransactionWorkers(appserviceDB, workerStates); err != nil {
 		logrus.WithError(err).Panicf("failed to start app service transaction workers")
 	}
+	if err := workers.SetupWebhookWorkers(appserviceDB, webhookStates); err != nil {
+		logrus.WithError(err).Panicf("failed to start webhook workers")
+	}
 	return appserviceQueryAPI
 }
 
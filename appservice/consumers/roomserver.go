@@ -17,6 +17,7 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/storage"
 	"github.com/matrix-org/dendrite/appservice/types"
@@ -29,6 +30,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The maximum exponent when backing off from storing an event, which is 2^6 or
+// 64 seconds.
+const maxStoreEventBackoff = 6
+
 // OutputRoomEventConsumer consumes events that originated in the room server.
 type OutputRoomEventConsumer struct {
 	roomServerConsumer *internal.ContinualConsumer
@@ -36,6 +41,7 @@ type OutputRoomEventConsumer struct {
 	rsAPI              api.RoomserverInternalAPI
 	serverName         string
 	workerStates       []types.ApplicationServiceWorkerState
+	webhookStates      []*types.WebhookWorkerState
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call
@@ -46,6 +52,7 @@ func NewOutputRoomEventConsumer(
 	appserviceDB storage.Database,
 	rsAPI api.RoomserverInternalAPI,
 	workerStates []types.ApplicationServiceWorkerState,
+	webhookStates []*types.WebhookWorkerState,
 ) *OutputRoomEventConsumer {
 	consumer := internal.ContinualConsumer{
 		ComponentName:  "appservice/roomserver",
@@ -59,6 +66,7 @@ func NewOutputRoomEventConsumer(
 		rsAPI:              rsAPI,
 		serverName:         string(cfg.Global.ServerName),
 		workerStates:       workerStates,
+		webhookStates:      webhookStates,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -91,10 +99,28 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 	events := []*gomatrixserverlib.HeaderedEvent{output.NewRoomEvent.Event}
 	events = append(events, output.NewRoomEvent.AddStateEvents...)
 
-	// Send event to any relevant application services
+	// Send event to any relevant application services and webhooks
+	s.filterWebhookEvents(context.TODO(), events)
 	return s.filterRoomserverEvents(context.TODO(), events)
 }
 
+// filterWebhookEvents queues up events to be sent to any webhooks that are
+// interested in them.
+func (s *OutputRoomEventConsumer) filterWebhookEvents(
+	ctx context.Context,
+	events []*gomatrixserverlib.HeaderedEvent,
+) {
+	for _, ws := range s.webhookStates {
+		for _, event := range events {
+			if !ws.Webhook.IsInterestedInEvent(event.RoomID(), event.Type()) {
+				continue
+			}
+			s.storeEvent(ctx, ws.QueueID(), event)
+			ws.NotifyNewEvents()
+		}
+	}
+}
+
 // filterRoomserverEvents takes in events and decides whether any of them need
 // to be passed on to an external application service. It does this by checking
 // each namespace of each registered application service, and if there is a
@@ -109,13 +135,10 @@ func (s *OutputRoomEventConsumer) filterRoomserverEvents(
 			// Check if this event is interesting to this application service
 			if s.appserviceIsInterestedInEvent(ctx, event, ws.AppService) {
 				// Queue this event to be sent off to the application service
-				if err := s.asDB.StoreEvent(ctx, ws.AppService.ID, event); err != nil {
-					log.WithError(err).Warn("failed to insert incoming event into appservices database")
-				} else {
-					// Tell our worker to send out new messages by updating remaining message
-					// count and waking them up with a broadcast
-					ws.NotifyNewEvents()
-				}
+				s.storeEvent(ctx, ws.AppService.ID, event)
+				// Tell our worker to send out new messages by updating remaining message
+				// count and waking them up with a broadcast
+				ws.NotifyNewEvents()
 			}
 		}
 	}
@@ -123,6 +146,32 @@ func (s *OutputRoomEventConsumer) filterRoomserverEvents(
 	return nil
 }
 
+// storeEvent queues an event to be sent to an application service or webhook.
+// Our position in the roomserver output log is saved as soon as onMessage
+// returns, so if the event can't be stored then we keep trying rather than
+// dropping it.
+func (s *OutputRoomEventConsumer) storeEvent(
+	ctx context.Context,
+	queueID string,
+	event *gomatrixserverlib.HeaderedEvent,
+) {
+	for attempt := 0; ; attempt++ {
+		err := s.asDB.StoreEvent(ctx, queueID, event)
+		if err == nil {
+			return
+		}
+		if attempt > maxStoreEventBackoff {
+			attempt = maxStoreEventBackoff
+		}
+		backoffDuration := time.Second << attempt
+		log.WithFields(log.Fields{
+			"queue_id": queueID,
+			"event_id": event.EventID(),
+		}).WithError(err).Warnf("failed to queue event for application service, retrying in %s", backoffDuration)
+		time.Sleep(backoffDuration)
+	}
+}
+
 // appserviceIsInterestedInEvent returns a boolean depending on whether a given
 // event falls within one of a given application service's namespaces.
 func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, appservice config.ApplicationService) bool {
@@ -18,8 +18,10 @@ package query
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/appservice/api"
@@ -28,8 +30,12 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const roomAliasExistsPath = "/rooms/"
-const userIDExistsPath = "/users/"
+const (
+	roomAliasExistsPath       = "/_matrix/app/v1/rooms/"
+	userIDExistsPath          = "/_matrix/app/v1/users/"
+	legacyRoomAliasExistsPath = "/rooms/"
+	legacyUserIDExistsPath    = "/users/"
+)
 
 // AppServiceQueryAPI is an implementation of api.AppServiceQueryAPI
 type AppServiceQueryAPI struct {
@@ -37,8 +43,9 @@ type AppServiceQueryAPI struct {
 	Cfg        *config.Dendrite
 }
 
-// RoomAliasExists performs a request to '/room/{roomAlias}' on all known
-// handling application services until one admits to owning the room
+// RoomAliasExists performs a request to '/rooms/{roomAlias}' on all
+// application services whose namespaces cover the alias until one admits to
+// owning the room
 func (a *AppServiceQueryAPI) RoomAliasExists(
 	ctx context.Context,
 	request *api.RoomAliasExistsRequest,
@@ -53,51 +60,21 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 	}
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
-		if appservice.URL != "" && appservice.IsInterestedInRoomAlias(request.Alias) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + roomAliasExistsPath)
-			URL.Path += request.Alias
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
-			// Send a request to each application service. If one responds that it has
-			// created the room, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			req = req.WithContext(ctx)
-
-			resp, err := a.HTTPClient.Do(req)
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).WithError(err).Error("Unable to close application service response body")
-					}
-				}()
-			}
-			if err != nil {
-				log.WithError(err).Errorf("Issue querying room alias on application service %s", appservice.ID)
-				return err
-			}
-			switch resp.StatusCode {
-			case http.StatusOK:
-				// OK received from appservice. Room exists
-				response.AliasExists = true
-				return nil
-			case http.StatusNotFound:
-				// Room does not exist
-			default:
-				// Application service reported an error. Warn
-				log.WithFields(log.Fields{
-					"appservice_id": appservice.ID,
-					"status_code":   resp.StatusCode,
-				}).Warn("Application service responded with non-OK status code")
-			}
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !appservice.IsInterestedInRoomAlias(request.Alias) {
+			continue
+		}
+		// Send a request to each application service. If one responds that it has
+		// created the room, immediately return.
+		exists, err := a.queryApplicationService(ctx, appservice, roomAliasExistsPath, legacyRoomAliasExistsPath, request.Alias)
+		if err != nil {
+			log.WithField("appservice_id", appservice.ID).WithError(err).Error("Issue querying room alias on application service")
+			continue
+		}
+		if exists {
+			response.AliasExists = true
+			return nil
 		}
 	}
 
@@ -105,8 +82,9 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 	return nil
 }
 
-// UserIDExists performs a request to '/users/{userID}' on all known
-// handling application services until one admits to owning the user ID
+// UserIDExists performs a request to '/users/{userID}' on all application
+// services whose namespaces cover the user ID until one admits to owning the
+// user ID
 func (a *AppServiceQueryAPI) UserIDExists(
 	ctx context.Context,
 	request *api.UserIDExistsRequest,
@@ -121,48 +99,22 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	}
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
-		if appservice.URL != "" && appservice.IsInterestedInUserID(request.UserID) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + userIDExistsPath)
-			URL.Path += request.UserID
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
-			// Send a request to each application service. If one responds that it has
-			// created the user, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			resp, err := a.HTTPClient.Do(req.WithContext(ctx))
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).Error("Unable to close application service response body")
-					}
-				}()
-			}
-			if err != nil {
-				log.WithFields(log.Fields{
-					"appservice_id": appservice.ID,
-				}).WithError(err).Error("issue querying user ID on application service")
-				return err
-			}
-			if resp.StatusCode == http.StatusOK {
-				// StatusOK received from appservice. User ID exists
-				response.UserIDExists = true
-				return nil
-			}
-
-			// Log non OK
-			log.WithFields(log.Fields{
-				"appservice_id": appservice.ID,
-				"status_code":   resp.StatusCode,
-			}).Warn("application service responded with non-OK status code")
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !appservice.IsInterestedInUserID(request.UserID) {
+			continue
+		}
+		// Send a request to each application service. If one responds that it has
+		// created the user, immediately return.
+		exists, err := a.queryApplicationService(ctx, appservice, userIDExistsPath, legacyUserIDExistsPath, request.UserID)
+		if err != nil {
+			log.WithField("appservice_id", appservice.ID).WithError(err).Error("Issue querying user ID on application service")
+			continue
+		}
+		if exists {
+			response.UserIDExists = true
+			response.AppServiceID = appservice.ID
+			return nil
 		}
 	}
 
@@ -170,6 +122,66 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	return nil
 }
 
+// queryApplicationService asks the application service whether the user ID
+// or room alias exists. Application services which don't recognise the path
+// from the spec are asked again using the legacy path.
+func (a *AppServiceQueryAPI) queryApplicationService(
+	ctx context.Context, appservice *config.ApplicationService, path, legacyPath, id string,
+) (bool, error) {
+	exists, recognised, err := a.queryApplicationServicePath(ctx, appservice, path, id)
+	if err != nil || recognised {
+		return exists, err
+	}
+	exists, _, err = a.queryApplicationServicePath(ctx, appservice, legacyPath, id)
+	return exists, err
+}
+
+func (a *AppServiceQueryAPI) queryApplicationServicePath(
+	ctx context.Context, appservice *config.ApplicationService, path, id string,
+) (exists, recognised bool, err error) {
+	// The hs token is sent both ways, as older application services only
+	// look for it in the query string.
+	apiURL := strings.TrimSuffix(appservice.URL, "/") + path + url.PathEscape(id) +
+		"?access_token=" + url.QueryEscape(appservice.HSToken)
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return false, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+appservice.HSToken)
+	resp, err := a.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, false, err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"status_code":   resp.StatusCode,
+			}).WithError(err).Error("Unable to close application service response body")
+		}
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// OK received from appservice. The user ID or room alias exists
+		return true, true, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// Either the user ID or room alias doesn't exist, or the application
+		// service doesn't know about the path
+		var body struct {
+			ErrCode string `json:"errcode"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return false, body.ErrCode != "M_UNRECOGNIZED", nil
+	default:
+		// Application service reported an error. Warn
+		log.WithFields(log.Fields{
+			"appservice_id": appservice.ID,
+			"status_code":   resp.StatusCode,
+		}).Warn("Application service responded with non-OK status code")
+		return false, true, nil
+	}
+}
+
 // makeHTTPClient creates an HTTP client with certain options that will be used for all query requests to application services
 func makeHTTPClient() *http.Client {
 	return &http.Client{
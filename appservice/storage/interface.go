@@ -26,7 +26,8 @@ type Database interface {
 	StoreEvent(ctx context.Context, appServiceID string, event *gomatrixserverlib.HeaderedEvent) error
 	GetEventsWithAppServiceID(ctx context.Context, appServiceID string, limit int) (int, int, []gomatrixserverlib.HeaderedEvent, bool, error)
 	CountEventsWithAppServiceID(ctx context.Context, appServiceID string) (int, error)
-	UpdateTxnIDForEvents(ctx context.Context, appserviceID string, maxID, txnID int) error
-	RemoveEventsBeforeAndIncludingID(ctx context.Context, appserviceID string, eventTableID int) error
+	StoreTransaction(ctx context.Context, appServiceID string, txnID int, txnJSON []byte, maxEventID int) error
+	GetOldestTransaction(ctx context.Context, appServiceID string) (int, []byte, error)
+	RemoveTransaction(ctx context.Context, appServiceID string, txnID int) error
 	GetLatestTxnID(ctx context.Context) (int, error)
 }
@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const appserviceTransactionsSchema = `
+-- Stores transactions which have been built for application services but
+-- haven't been acknowledged by them yet, so that they are retried with the
+-- same transaction ID and events.
+CREATE TABLE IF NOT EXISTS appservice_transactions (
+	-- The ID of the application service the transaction will be sent to
+	as_id TEXT NOT NULL,
+	-- The ID of the transaction
+	txn_id BIGINT NOT NULL,
+	-- The JSON body of the transaction
+	txn_json TEXT NOT NULL,
+	PRIMARY KEY (as_id, txn_id)
+);
+`
+
+const selectOldestTransactionSQL = "" +
+	"SELECT txn_id, txn_json FROM appservice_transactions WHERE as_id = $1" +
+	" ORDER BY txn_id ASC LIMIT 1"
+
+const insertTransactionSQL = "" +
+	"INSERT INTO appservice_transactions(as_id, txn_id, txn_json) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+
+const deleteTransactionSQL = "" +
+	"DELETE FROM appservice_transactions WHERE as_id = $1 AND txn_id = $2"
+
+type transactionsStatements struct {
+	selectOldestTransactionStmt *sql.Stmt
+	insertTransactionStmt       *sql.Stmt
+	deleteTransactionStmt       *sql.Stmt
+}
+
+func (s *transactionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(appserviceTransactionsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.selectOldestTransactionStmt, err = db.Prepare(selectOldestTransactionSQL); err != nil {
+		return
+	}
+	if s.insertTransactionStmt, err = db.Prepare(insertTransactionSQL); err != nil {
+		return
+	}
+	if s.deleteTransactionStmt, err = db.Prepare(deleteTransactionSQL); err != nil {
+		return
+	}
+	return
+}
+
+// selectOldestTransaction returns the oldest transaction which is waiting to
+// be sent to an application service, or a nil body if there isn't one.
+func (s *transactionsStatements) selectOldestTransaction(
+	ctx context.Context, appServiceID string,
+) (txnID int, txnJSON []byte, err error) {
+	err = s.selectOldestTransactionStmt.QueryRowContext(ctx, appServiceID).Scan(&txnID, &txnJSON)
+	if err == sql.ErrNoRows {
+		return 0, nil, nil
+	}
+	return
+}
+
+func (s *transactionsStatements) insertTransaction(
+	ctx context.Context, txn *sql.Tx, appServiceID string, txnID int, txnJSON []byte,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertTransactionStmt).ExecContext(ctx, appServiceID, txnID, txnJSON)
+	return err
+}
+
+func (s *transactionsStatements) deleteTransaction(
+	ctx context.Context, txn *sql.Tx, appServiceID string, txnID int,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteTransactionStmt).ExecContext(ctx, appServiceID, txnID)
+	return err
+}
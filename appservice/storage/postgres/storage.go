@@ -29,10 +29,11 @@ import (
 // Database stores events intended to be later sent to application services
 type Database struct {
 	sqlutil.PartitionOffsetStatements
-	events eventsStatements
-	txnID  txnStatements
-	db     *sql.DB
-	writer sqlutil.Writer
+	events       eventsStatements
+	transactions transactionsStatements
+	txnID        txnStatements
+	db           *sql.DB
+	writer       sqlutil.Writer
 }
 
 // NewDatabase opens a new database
@@ -56,6 +57,9 @@ func (d *Database) prepare() error {
 	if err := d.events.prepare(d.db); err != nil {
 		return err
 	}
+	if err := d.transactions.prepare(d.db); err != nil {
+		return err
+	}
 
 	return d.txnID.prepare(d.db)
 }
@@ -89,26 +93,46 @@ func (d *Database) CountEventsWithAppServiceID(
 	return d.events.countEventsByApplicationServiceID(ctx, appServiceID)
 }
 
-// UpdateTxnIDForEvents takes in an application service ID and a
-// and stores them in the DB, unless the pair already exists, in
-// which case it updates them.
-func (d *Database) UpdateTxnIDForEvents(
+// StoreTransaction stores a transaction which is about to be sent to an
+// application service, and removes the events in it from the queue of events
+// waiting to be sent, which are those up to and including maxEventID. The
+// transaction is kept until RemoveTransaction is called, so that it can be
+// retried with the same ID if the application service doesn't acknowledge it.
+func (d *Database) StoreTransaction(
 	ctx context.Context,
-	appserviceID string,
-	maxID, txnID int,
+	appServiceID string,
+	txnID int,
+	txnJSON []byte,
+	maxEventID int,
 ) error {
-	return d.events.updateTxnIDForEvents(ctx, appserviceID, maxID, txnID)
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err := d.transactions.insertTransaction(ctx, txn, appServiceID, txnID, txnJSON); err != nil {
+			return err
+		}
+		return d.events.deleteEventsBeforeAndIncludingID(ctx, txn, appServiceID, maxEventID)
+	})
+}
+
+// GetOldestTransaction returns the oldest transaction which hasn't been
+// acknowledged by an application service yet, or a nil body if there isn't
+// one.
+func (d *Database) GetOldestTransaction(
+	ctx context.Context,
+	appServiceID string,
+) (int, []byte, error) {
+	return d.transactions.selectOldestTransaction(ctx, appServiceID)
 }
 
-// RemoveEventsBeforeAndIncludingID removes all events from the database that
-// are less than or equal to a given maximum ID. IDs here are implemented as a
-// serial, thus this should always delete events in chronological order.
-func (d *Database) RemoveEventsBeforeAndIncludingID(
+// RemoveTransaction removes a transaction once the application service has
+// acknowledged it.
+func (d *Database) RemoveTransaction(
 	ctx context.Context,
-	appserviceID string,
-	eventTableID int,
+	appServiceID string,
+	txnID int,
 ) error {
-	return d.events.deleteEventsBeforeAndIncludingID(ctx, appserviceID, eventTableID)
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.transactions.deleteTransaction(ctx, txn, appServiceID, txnID)
+	})
 }
 
 // GetLatestTxnID returns the latest available transaction id
@@ -31,15 +31,19 @@ CREATE TABLE IF NOT EXISTS appservice_counters (
 INSERT OR IGNORE INTO appservice_counters (name, last_id) VALUES('txn_id', 1);
 `
 
-const selectTxnIDSQL = `
-  SELECT last_id FROM appservice_counters WHERE name='txn_id';
-  UPDATE appservice_counters SET last_id=last_id+1 WHERE name='txn_id';
-`
+// Only the first statement of a prepared statement is run, so the select and
+// the update have to be separate.
+const selectTxnIDSQL = "" +
+	"SELECT last_id FROM appservice_counters WHERE name='txn_id'"
+
+const updateTxnIDSQL = "" +
+	"UPDATE appservice_counters SET last_id=last_id+1 WHERE name='txn_id'"
 
 type txnStatements struct {
 	db              *sql.DB
 	writer          sqlutil.Writer
 	selectTxnIDStmt *sql.Stmt
+	updateTxnIDStmt *sql.Stmt
 }
 
 func (s *txnStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -53,6 +57,9 @@ func (s *txnStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
 	if s.selectTxnIDStmt, err = db.Prepare(selectTxnIDSQL); err != nil {
 		return
 	}
+	if s.updateTxnIDStmt, err = db.Prepare(updateTxnIDSQL); err != nil {
+		return
+	}
 
 	return
 }
@@ -62,7 +69,10 @@ func (s *txnStatements) selectTxnID(
 	ctx context.Context,
 ) (txnID int, err error) {
 	err = s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
-		err := s.selectTxnIDStmt.QueryRowContext(ctx).Scan(&txnID)
+		if err := sqlutil.TxStmt(txn, s.selectTxnIDStmt).QueryRowContext(ctx).Scan(&txnID); err != nil {
+			return err
+		}
+		_, err := sqlutil.TxStmt(txn, s.updateTxnIDStmt).ExecContext(ctx)
 		return err
 	})
 	return
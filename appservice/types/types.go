@@ -62,3 +62,48 @@ func (a *ApplicationServiceWorkerState) WaitForNewEvents() {
 	}
 	a.Cond.L.Unlock()
 }
+
+// WebhookWorkerState is a type that couples a webhook with a lockable condition
+// and backoff state, allowing the roomserver consumer to notify the webhook
+// worker when there are events ready to send.
+type WebhookWorkerState struct {
+	Webhook config.Webhook
+	Cond    *sync.Cond
+	// Events ready to be sent
+	EventsReady bool
+	// Backoff exponent (2^x secs). Max 6, aka 64s.
+	Backoff int
+}
+
+// QueueID returns the ID that events for this webhook are queued under in the
+// appservice database, which is kept apart from application service IDs.
+func (w *WebhookWorkerState) QueueID() string {
+	return "webhook:" + w.Webhook.ID
+}
+
+// NotifyNewEvents wakes up the worker, notifying that events remain in the
+// event queue for this webhook.
+func (w *WebhookWorkerState) NotifyNewEvents() {
+	w.Cond.L.Lock()
+	w.EventsReady = true
+	w.Cond.Broadcast()
+	w.Cond.L.Unlock()
+}
+
+// FinishEventProcessing marks all events of this worker as being sent to the
+// webhook.
+func (w *WebhookWorkerState) FinishEventProcessing() {
+	w.Cond.L.Lock()
+	w.EventsReady = false
+	w.Cond.L.Unlock()
+}
+
+// WaitForNewEvents causes the calling goroutine to wait on the worker state's
+// condition for a broadcast or similar wakeup, if there are no events ready.
+func (w *WebhookWorkerState) WaitForNewEvents() {
+	w.Cond.L.Lock()
+	if !w.EventsReady {
+		w.Cond.Wait()
+	}
+	w.Cond.L.Unlock()
+}
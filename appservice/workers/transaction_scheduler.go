@@ -43,6 +43,8 @@ var (
 // app service, batch them up into a single transaction (up to a max transaction
 // size), then send that off to the AS's /transactions/{txnID} endpoint. It also
 // handles exponentially backing off in case the AS isn't currently available.
+// Transactions are stored until the AS acknowledges them, so that nothing is
+// lost if the AS is down or we restart.
 func SetupTransactionWorkers(
 	appserviceDB storage.Database,
 	workerStates []types.ApplicationServiceWorkerState,
@@ -70,61 +72,30 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 		Timeout: transactionTimeout,
 	}
 
-	// Initial check for any leftover events to send from last time
-	eventCount, err := db.CountEventsWithAppServiceID(ctx, ws.AppService.ID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"appservice": ws.AppService.ID,
-		}).WithError(err).Fatal("appservice worker unable to read queued events from DB")
-		return
-	}
-	if eventCount > 0 {
-		ws.NotifyNewEvents()
-	}
+	// Start by sending anything that was left over from last time
+	ws.NotifyNewEvents()
 
 	// Loop forever and keep waiting for more events to send
 	for {
-		// Wait for more events if we've sent all the events in the database
 		ws.WaitForNewEvents()
-
-		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
-			}).WithError(err).Fatal("appservice worker unable to create transaction")
-
-			return
-		}
-
-		// Send the events off to the application service
-		// Backoff if the application service does not respond
-		err = send(client, ws.AppService, txnID, transactionJSON)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
-			}).WithError(err).Error("unable to send event")
-			// Backoff
-			backoff(&ws, err)
-			continue
-		}
-
-		// We sent successfully, hooray!
-		ws.Backoff = 0
-
-		// Transactions have a maximum event size, so there may still be some events
-		// left over to send. Keep sending until none are left
-		if !eventsRemaining {
-			ws.FinishEventProcessing()
-		}
-
-		// Remove sent events from the DB
-		err = db.RemoveEventsBeforeAndIncludingID(ctx, ws.AppService.ID, maxEventID)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
-			}).WithError(err).Fatal("unable to remove appservice events from the database")
-			return
+		// Any events queued from now on will wake us up again
+		ws.FinishEventProcessing()
+
+		// Keep sending transactions until there are none left. If the
+		// application service does not respond then the same transaction is
+		// retried after backing off.
+		for {
+			sent, err := sendNextTransaction(ctx, db, ws.AppService.ID, func(txnID int, txnJSON []byte) error {
+				return send(client, ws.AppService, txnID, txnJSON)
+			})
+			if err != nil {
+				backoff(&ws, err)
+				continue
+			}
+			ws.Backoff = 0
+			if !sent {
+				break
+			}
 		}
 	}
 }
@@ -149,26 +120,60 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 	time.Sleep(backoffSeconds)
 }
 
-// createTransaction takes in a slice of AS events, stores them in an AS
-// transaction, and JSON-encodes the results.
+// sendNextTransaction sends the oldest transaction in the queue which hasn't
+// been acknowledged yet, creating a new one from the queued events if there
+// isn't one. The transaction is only removed once it has been sent
+// successfully, so if sending fails then it is retried later with the same ID
+// and events. Returns false if there was nothing to send.
+func sendNextTransaction(
+	ctx context.Context,
+	db storage.Database,
+	queueID string,
+	send func(txnID int, txnJSON []byte) error,
+) (bool, error) {
+	txnID, transactionJSON, err := db.GetOldestTransaction(ctx, queueID)
+	if err != nil {
+		return false, fmt.Errorf("db.GetOldestTransaction: %w", err)
+	}
+	if transactionJSON == nil {
+		txnID, transactionJSON, err = createTransaction(ctx, db, queueID)
+		if err != nil {
+			return false, fmt.Errorf("createTransaction: %w", err)
+		}
+		if transactionJSON == nil {
+			return false, nil
+		}
+	}
+
+	if err = send(txnID, transactionJSON); err != nil {
+		return false, err
+	}
+	if err = db.RemoveTransaction(ctx, queueID, txnID); err != nil {
+		return false, fmt.Errorf("db.RemoveTransaction: %w", err)
+	}
+	return true, nil
+}
+
+// createTransaction takes the next batch of queued events, stores them in an
+// AS transaction, and JSON-encodes the results. Returns a nil transaction if
+// there are no events queued.
 func createTransaction(
 	ctx context.Context,
 	db storage.Database,
 	appserviceID string,
 ) (
+	txnID int,
 	transactionJSON []byte,
-	txnID, maxID int,
-	eventsRemaining bool,
 	err error,
 ) {
-	// Retrieve the latest events from the DB (will return old events if they weren't successfully sent)
-	txnID, maxID, events, eventsRemaining, err := db.GetEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
+	// Retrieve the latest events from the DB. Events which were given a
+	// transaction ID by an older version are returned first, along with it.
+	txnID, maxID, events, _, err := db.GetEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"appservice": appserviceID,
-		}).WithError(err).Fatalf("appservice worker unable to read queued events from DB")
-
-		return
+		return 0, nil, err
+	}
+	if len(events) == 0 {
+		return 0, nil, nil
 	}
 
 	// Check if these events do not already have a transaction ID
@@ -176,12 +181,7 @@ func createTransaction(
 		// If not, grab next available ID from the DB
 		txnID, err = db.GetLatestTxnID(ctx)
 		if err != nil {
-			return nil, 0, 0, false, err
-		}
-
-		// Mark new events with current transactionID
-		if err = db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, txnID); err != nil {
-			return nil, 0, 0, false, err
+			return 0, nil, err
 		}
 	}
 
@@ -197,10 +197,15 @@ func createTransaction(
 
 	transactionJSON, err = json.Marshal(transaction)
 	if err != nil {
-		return
+		return 0, nil, err
 	}
 
-	return
+	// Store the transaction before sending it, so that it's sent again with
+	// the same ID and events if we don't get a response.
+	if err = db.StoreTransaction(ctx, appserviceID, txnID, transactionJSON, maxID); err != nil {
+		return 0, nil, err
+	}
+	return txnID, transactionJSON, nil
 }
 
 // send sends events to an application service. Returns an error if an OK was not
@@ -0,0 +1,104 @@
+package workers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+func TestTransactionsAreRetried(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "appservice")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "appservice.db")),
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	const asID = "bridge"
+	for i := 0; i < 3; i++ {
+		if err = db.StoreEvent(ctx, asID, mustCreateEvent(t, i)); err != nil {
+			t.Fatalf("failed to store event: %s", err)
+		}
+	}
+
+	type attempt struct {
+		txnID int
+		body  string
+	}
+	var attempts []attempt
+	sendFails := func(txnID int, txnJSON []byte) error {
+		attempts = append(attempts, attempt{txnID, string(txnJSON)})
+		return fmt.Errorf("application service is down")
+	}
+	sendSucceeds := func(txnID int, txnJSON []byte) error {
+		attempts = append(attempts, attempt{txnID, string(txnJSON)})
+		return nil
+	}
+
+	if _, err = sendNextTransaction(ctx, db, asID, sendFails); err == nil {
+		t.Fatalf("expected sending to fail")
+	}
+	// Events queued after the transaction was created go into the next one.
+	if err = db.StoreEvent(ctx, asID, mustCreateEvent(t, 3)); err != nil {
+		t.Fatalf("failed to store event: %s", err)
+	}
+	sent, err := sendNextTransaction(ctx, db, asID, sendSucceeds)
+	if err != nil || !sent {
+		t.Fatalf("expected transaction to be sent, got sent=%v err=%v", sent, err)
+	}
+	if len(attempts) != 2 || attempts[0] != attempts[1] {
+		t.Fatalf("transaction was not retried with the same ID and events: %+v", attempts)
+	}
+	if got := gjson.Get(attempts[0].body, "events.#").Int(); got != 3 {
+		t.Errorf("first transaction has %d events, want 3", got)
+	}
+
+	sent, err = sendNextTransaction(ctx, db, asID, sendSucceeds)
+	if err != nil || !sent {
+		t.Fatalf("expected second transaction to be sent, got sent=%v err=%v", sent, err)
+	}
+	if attempts[2].txnID == attempts[0].txnID {
+		t.Errorf("second transaction reused transaction ID %d", attempts[2].txnID)
+	}
+	if got := gjson.Get(attempts[2].body, "events.#").Int(); got != 1 {
+		t.Errorf("second transaction has %d events, want 1", got)
+	}
+
+	if sent, err = sendNextTransaction(ctx, db, asID, sendSucceeds); err != nil || sent {
+		t.Fatalf("expected nothing left to send, got sent=%v err=%v", sent, err)
+	}
+}
+
+func mustCreateEvent(t *testing.T, i int) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender: "@alice:localhost",
+		Type:   "m.room.message",
+		RoomID: "!room:localhost",
+		Depth:  int64(i + 1),
+	}
+	if err := eb.SetContent(map[string]interface{}{"body": fmt.Sprintf("message %d", i)}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
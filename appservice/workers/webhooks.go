@@ -0,0 +1,131 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetupWebhookWorkers spawns a separate goroutine for each webhook, which
+// batches up the events queued for it and POSTs them to the webhook URL,
+// exponentially backing off if the webhook isn't currently available.
+func SetupWebhookWorkers(
+	appserviceDB storage.Database,
+	webhookStates []*types.WebhookWorkerState,
+) error {
+	for _, webhookState := range webhookStates {
+		go webhookWorker(appserviceDB, webhookState)
+	}
+	return nil
+}
+
+// webhookWorker is a goroutine that sends any queued events to the webhook
+// it is given.
+func webhookWorker(db storage.Database, ws *types.WebhookWorkerState) {
+	logger := log.WithFields(log.Fields{
+		"webhook": ws.Webhook.ID,
+	})
+	logger.Info("starting webhook")
+	ctx := context.Background()
+
+	client := &http.Client{
+		Timeout: transactionTimeout,
+	}
+
+	// Start by sending anything that was left over from last time
+	ws.NotifyNewEvents()
+
+	for {
+		ws.WaitForNewEvents()
+		// Any events queued from now on will wake us up again
+		ws.FinishEventProcessing()
+
+		// Batch events up in the same way as we do for application services
+		for {
+			sent, err := sendNextTransaction(ctx, db, ws.QueueID(), func(txnID int, txnJSON []byte) error {
+				return sendWebhook(client, ws.Webhook, txnID, txnJSON)
+			})
+			if err != nil {
+				logger.WithError(err).Error("unable to send events to webhook")
+				backoffDuration := time.Second * time.Duration(math.Pow(2, float64(ws.Backoff)))
+				logger.Warnf("backing off webhook for %s", backoffDuration)
+				if ws.Backoff < 6 {
+					ws.Backoff++
+				}
+				time.Sleep(backoffDuration)
+				continue
+			}
+			ws.Backoff = 0
+			if !sent {
+				break
+			}
+		}
+	}
+}
+
+// webhookSignature returns the signature of a webhook request body, which is
+// sent in the X-Dendrite-Signature header so that the webhook can check that
+// the request came from us.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook POSTs a transaction of events to a webhook. Returns an error if
+// a 2xx status code was not received back or the request timed out. Retries of
+// the same transaction have the same transaction ID so that the webhook can
+// ignore duplicates.
+func sendWebhook(
+	client *http.Client,
+	webhook config.Webhook,
+	txnID int,
+	transaction []byte,
+) (err error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewBuffer(transaction))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dendrite-Webhook-ID", webhook.ID)
+	req.Header.Set("X-Dendrite-Transaction-ID", strconv.Itoa(txnID))
+	if webhook.Secret != "" {
+		req.Header.Set("X-Dendrite-Signature", webhookSignature(webhook.Secret, transaction))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer checkNamedErr(resp.Body.Close, &err)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("non-2xx status code %d returned from webhook", resp.StatusCode)
+	}
+	return nil
+}
@@ -9,5 +9,7 @@ const (
 	LoginTypeDummy              = "m.login.dummy"
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
+	LoginTypeEmail              = "m.login.email.identity"
+	LoginTypeRegistrationToken  = "m.login.registration_token"
 	LoginTypeApplicationService = "m.login.application_service"
 )
@@ -0,0 +1,120 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// loginTokenLifetime is how long login tokens can be used for after they've
+// been issued. Clients exchange them for access tokens straight away.
+const loginTokenLifetime = 2 * time.Minute
+
+type loginToken struct {
+	userID  string
+	expires time.Time
+}
+
+// LoginTokens stores the short-lived tokens which are handed to clients once
+// people have logged in through single sign-on, and which the clients then use
+// to log in with m.login.token. Each token can only be used once.
+// It shouldn't be passed by value because it contains a mutex.
+type LoginTokens struct {
+	sync.Mutex
+	tokens map[string]loginToken
+}
+
+func NewLoginTokens() *LoginTokens {
+	return &LoginTokens{
+		tokens: make(map[string]loginToken),
+	}
+}
+
+// Issue returns a new login token for the user.
+func (t *LoginTokens) Issue(userID string) (string, error) {
+	token, err := GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	for k, v := range t.tokens {
+		if now.After(v.expires) {
+			delete(t.tokens, k)
+		}
+	}
+	t.tokens[token] = loginToken{
+		userID:  userID,
+		expires: now.Add(loginTokenLifetime),
+	}
+	return token, nil
+}
+
+// consume returns the user that the login token was issued for and removes
+// the token, or returns false if the token doesn't exist or has expired.
+func (t *LoginTokens) consume(token string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	lt, ok := t.tokens[token]
+	if !ok {
+		return "", false
+	}
+	delete(t.tokens, token)
+	if time.Now().After(lt.expires) {
+		return "", false
+	}
+	return lt.userID, true
+}
+
+type TokenRequest struct {
+	Login
+	Token string `json:"token"`
+}
+
+// LoginTypeToken implements https://matrix.org/docs/spec/client_server/r0.6.1#token-based
+type LoginTypeToken struct {
+	Tokens *LoginTokens
+}
+
+func (t *LoginTypeToken) Name() string {
+	return "m.login.token"
+}
+
+func (t *LoginTypeToken) Request() interface{} {
+	return &TokenRequest{}
+}
+
+func (t *LoginTypeToken) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*TokenRequest)
+	userID, ok := t.Tokens.consume(r.Token)
+	if !ok {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token is invalid or has expired"),
+		}
+	}
+	r.Login.Identifier = LoginIdentifier{
+		Type: "m.id.user",
+		User: userID,
+	}
+	return &r.Login, nil
+}
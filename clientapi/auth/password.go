@@ -62,7 +62,7 @@ func (t *LoginTypePassword) Login(ctx context.Context, req interface{}) (*Login,
 			JSON: jsonerror.InvalidUsername(err.Error()),
 		}
 	}
-	_, err = t.GetAccountByPassword(ctx, localpart, r.Password)
+	acc, err := t.GetAccountByPassword(ctx, localpart, r.Password)
 	if err != nil {
 		// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
 		// but that would leak the existence of the user.
@@ -71,5 +71,11 @@ func (t *LoginTypePassword) Login(ctx context.Context, req interface{}) (*Login,
 			JSON: jsonerror.Forbidden("username or password was incorrect, or the account does not exist"),
 		}
 	}
+	if acc.Suspended {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.UserSuspended("This account has been suspended"),
+		}
+	}
 	return &r.Login, nil
 }
@@ -0,0 +1,217 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements logging in through OpenID Connect identity
+// providers, using the authorization code flow.
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+var defaultScopes = []string{"openid", "profile"}
+
+const (
+	defaultLocalpartClaim   = "preferred_username"
+	defaultDisplayNameClaim = "name"
+)
+
+// UserInfo is what an identity provider told us about someone who logged
+// in through it.
+type UserInfo struct {
+	// The identifier of the person at the identity provider, which never
+	// changes.
+	Subject string
+	// The localpart that the person would like, which may be empty or not
+	// be a valid localpart.
+	Localpart string
+	// The display name of the person, which may be empty.
+	DisplayName string
+}
+
+type endpoints struct {
+	AuthorizationURL string `json:"authorization_endpoint"`
+	TokenURL         string `json:"token_endpoint"`
+	UserInfoURL      string `json:"userinfo_endpoint"`
+}
+
+// Provider is an OpenID Connect identity provider.
+type Provider struct {
+	cfg    *config.IdentityProvider
+	client *http.Client
+
+	endpointsMu sync.Mutex
+	endpoints   *endpoints
+}
+
+func NewProvider(cfg *config.IdentityProvider, client *http.Client) *Provider {
+	p := &Provider{
+		cfg:    cfg,
+		client: client,
+	}
+	if cfg.AuthorizationURL != "" && cfg.TokenURL != "" && cfg.UserInfoURL != "" {
+		p.endpoints = &endpoints{
+			AuthorizationURL: cfg.AuthorizationURL,
+			TokenURL:         cfg.TokenURL,
+			UserInfoURL:      cfg.UserInfoURL,
+		}
+	}
+	return p
+}
+
+func (p *Provider) ID() string {
+	return p.cfg.ID
+}
+
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// getEndpoints returns the endpoints of the provider, using discovery if
+// they weren't configured. Discovered endpoints are remembered, but failures
+// aren't, so that providers which were unavailable are tried again.
+func (p *Provider) getEndpoints(ctx context.Context) (*endpoints, error) {
+	p.endpointsMu.Lock()
+	defer p.endpointsMu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	discoveryURL := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovered endpoints
+	if err = p.doJSON(req, &discovered); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if discovered.AuthorizationURL == "" || discovered.TokenURL == "" || discovered.UserInfoURL == "" {
+		return nil, fmt.Errorf("discovery: %s is missing endpoints", discoveryURL)
+	}
+	p.endpoints = &discovered
+	return p.endpoints, nil
+}
+
+// AuthorizationURL returns the URL to send people to so that they can log in
+// at the provider. The provider sends them back to the callback URL with the
+// state, along with a code to pass to ProcessCallback.
+func (p *Provider) AuthorizationURL(ctx context.Context, callbackURL, state string) (string, error) {
+	e, err := p.getEndpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(e.AuthorizationURL)
+	if err != nil {
+		return "", err
+	}
+	scopes := p.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", callbackURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// ProcessCallback exchanges the code that the provider sent people back with
+// for an access token, and uses that to ask the provider who they are.
+func (p *Provider) ProcessCallback(ctx context.Context, callbackURL, code string) (*UserInfo, error) {
+	e, err := p.getEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", callbackURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	var tokenRes struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err = p.doJSON(req, &tokenRes); err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	if tokenRes.AccessToken == "" || !strings.EqualFold(tokenRes.TokenType, "bearer") {
+		return nil, fmt.Errorf("token: no bearer token was returned")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, e.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenRes.AccessToken)
+	var claims map[string]interface{}
+	if err = p.doJSON(req, &claims); err != nil {
+		return nil, fmt.Errorf("userinfo: %w", err)
+	}
+	info := &UserInfo{
+		Subject:     stringClaim(claims, "sub"),
+		Localpart:   stringClaim(claims, p.cfg.LocalpartClaim, defaultLocalpartClaim),
+		DisplayName: stringClaim(claims, p.cfg.DisplayNameClaim, defaultDisplayNameClaim),
+	}
+	if info.Subject == "" {
+		return nil, fmt.Errorf("userinfo: no subject was returned")
+	}
+	return info, nil
+}
+
+// stringClaim returns the claim with the first non-empty name, or an empty
+// string if it isn't a string.
+func stringClaim(claims map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if name != "" {
+			s, _ := claims[name].(string)
+			return s
+		}
+	}
+	return ""
+}
+
+func (p *Provider) doJSON(req *http.Request, res interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d: %s", req.URL.Host, resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, res)
+}
@@ -18,9 +18,9 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
-	"unicode/utf8"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/util"
 )
 
@@ -36,11 +36,18 @@ func UnmarshalJSONRequest(req *http.Request, iface interface{}) *util.JSONRespon
 		return &resp
 	}
 
-	if !utf8.Valid(body) {
+	switch eventutil.CheckStorableJSON(body) {
+	case eventutil.ErrInvalidUTF8:
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.NotJSON("Body contains invalid UTF-8"),
 		}
+	case eventutil.ErrNullCharacter:
+		// Null characters are valid JSON, but can't be stored in the database.
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Body contains a null character"),
+		}
 	}
 
 	if err := json.Unmarshal(body, iface); err != nil {
@@ -17,15 +17,19 @@ import (
 	"net/http"
 	"strconv"
 	"time"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
-// ParseTSParam takes a req (typically from an application service) and parses a Time object
-// from the req if it exists in the query parameters. If it doesn't exist, the
-// current time is returned.
-func ParseTSParam(req *http.Request) (time.Time, error) {
+// ParseTSParam takes a req from an application service and parses a Time object
+// from the req if it exists in the query parameters, so that bridges can send
+// events with the time that they were originally sent. If it doesn't exist, or
+// the request isn't from an application service, the current time is returned.
+func ParseTSParam(req *http.Request, device *userapi.Device) (time.Time, error) {
 	// Use the ts parameter's value for event time if present
 	tsStr := req.URL.Query().Get("ts")
-	if tsStr == "" {
+	if tsStr == "" || device.AppServiceID == "" {
 		return time.Now(), nil
 	}
 
@@ -35,5 +39,5 @@ func ParseTSParam(req *http.Request) (time.Time, error) {
 		return time.Time{}, fmt.Errorf("Param 'ts' is no valid int (%s)", err.Error())
 	}
 
-	return time.Unix(ts/1000, 0), nil
+	return gomatrixserverlib.Timestamp(ts).Time(), nil
 }
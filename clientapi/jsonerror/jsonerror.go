@@ -125,6 +125,29 @@ func GuestAccessForbidden(msg string) *MatrixError {
 	return &MatrixError{"M_GUEST_ACCESS_FORBIDDEN", msg}
 }
 
+// TooLarge is an error which is returned when the request body is too large.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
+// UserSuspended is an error which is returned when a suspended user tries to
+// log in or to send events.
+func UserSuspended(msg string) *MatrixError {
+	return &MatrixError{"M_USER_SUSPENDED", msg}
+}
+
+// InvalidSignature is an error which is returned when a signature in the
+// request could not be verified.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
+// MissingParam is an error which is returned when a required parameter is
+// missing from the request.
+func MissingParam(msg string) *MatrixError {
+	return &MatrixError{"M_MISSING_PARAM", msg}
+}
+
 type IncompatibleRoomVersionError struct {
 	RoomVersion string `json:"room_version"`
 	Error       string `json:"error"`
@@ -161,6 +184,32 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// ResourceLimitExceeded is an error when the server is too busy to handle the
+// request, which can be retried later.
+func ResourceLimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
+	return &LimitExceededError{
+		MatrixError:  MatrixError{"M_RESOURCE_LIMIT_EXCEEDED", msg},
+		RetryAfterMS: retryAfterMS,
+	}
+}
+
+// WrongBackupVersionError is an error which is returned when the client
+// tries to change the keys in a room key backup version which isn't the
+// current one.
+type WrongBackupVersionError struct {
+	MatrixError
+	CurrentVersion string `json:"current_version"`
+}
+
+// WrongBackupVersion returns a WrongBackupVersionError for the given
+// current backup version.
+func WrongBackupVersion(currentVersion string) *WrongBackupVersionError {
+	return &WrongBackupVersionError{
+		MatrixError:    MatrixError{"M_WRONG_ROOM_KEYS_VERSION", "Wrong backup version."},
+		CurrentVersion: currentVersion,
+	}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
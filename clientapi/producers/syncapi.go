@@ -28,13 +28,15 @@ type SyncAPIProducer struct {
 	Producer sarama.SyncProducer
 }
 
-// SendData sends account data to the sync API server
-func (p *SyncAPIProducer) SendData(userID string, roomID string, dataType string) error {
+// SendData sends account data to the sync API server, along with its new
+// content so that the sync API doesn't need to ask the user API for it.
+func (p *SyncAPIProducer) SendData(userID string, roomID string, dataType string, content json.RawMessage) error {
 	var m sarama.ProducerMessage
 
 	data := eventutil.AccountData{
-		RoomID: roomID,
-		Type:   dataType,
+		RoomID:  roomID,
+		Type:    dataType,
+		Content: content,
 	}
 	value, err := json.Marshal(data)
 	if err != nil {
@@ -0,0 +1,130 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type dryRunEventRequest struct {
+	// The event, as it would be received over federation.
+	Event json.RawMessage `json:"event"`
+	// The room version of the event, which is only needed if we don't know
+	// about the room yet.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// One of "new", "old" or "outlier". Defaults to "new".
+	Kind string `json:"kind"`
+	// The auth events to check the event against. Defaults to the auth_events
+	// of the event.
+	AuthEventIDs []string `json:"auth_event_ids"`
+	// If set, the state before the event, rather than resolving the state at
+	// the prev events.
+	StateEventIDs *[]string `json:"state_event_ids"`
+}
+
+type dryRunEventResponse struct {
+	EventID string `json:"event_id"`
+	roomserverAPI.InputRoomEventDryRunResponse
+}
+
+var dryRunEventKinds = map[string]roomserverAPI.Kind{
+	"":        roomserverAPI.KindNew,
+	"new":     roomserverAPI.KindNew,
+	"old":     roomserverAPI.KindOld,
+	"outlier": roomserverAPI.KindOutlier,
+}
+
+// AdminDryRunEvent implements POST /_dendrite/admin/v1/dryRunEvent. The event
+// is run through the same signature, auth and state checks as events received
+// over federation, and the result of each check is returned along with what
+// would have happened to the event, without storing anything. This is useful
+// for working out why an event was rejected.
+func AdminDryRunEvent(
+	req *http.Request,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var body dryRunEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	kind, ok := dryRunEventKinds[body.Kind]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("kind must be new, old or outlier"),
+		}
+	}
+	var partial struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := json.Unmarshal(body.Event, &partial); err != nil || partial.RoomID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("event must be an event with a room_id"),
+		}
+	}
+
+	roomVersion := body.RoomVersion
+	if roomVersion == "" {
+		verRes := roomserverAPI.QueryRoomVersionForRoomResponse{}
+		if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &roomserverAPI.QueryRoomVersionForRoomRequest{
+			RoomID: partial.RoomID,
+		}, &verRes); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UnsupportedRoomVersion("room_version must be given for rooms that we don't know about"),
+			}
+		}
+		roomVersion = verRes.RoomVersion
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(body.Event, roomVersion)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Invalid event: " + err.Error()),
+		}
+	}
+
+	input := roomserverAPI.InputRoomEvent{
+		Kind:         kind,
+		Event:        event.Headered(roomVersion),
+		AuthEventIDs: body.AuthEventIDs,
+	}
+	if input.AuthEventIDs == nil {
+		input.AuthEventIDs = event.AuthEventIDs()
+	}
+	if body.StateEventIDs != nil {
+		input.HasState = true
+		input.StateEventIDs = *body.StateEventIDs
+	}
+	res := dryRunEventResponse{EventID: event.EventID()}
+	if err = rsAPI.InputRoomEventDryRun(req.Context(), &roomserverAPI.InputRoomEventDryRunRequest{
+		InputRoomEvent: input,
+	}, &res.InputRoomEventDryRunResponse); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.InputRoomEventDryRun failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
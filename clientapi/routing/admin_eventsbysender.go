@@ -0,0 +1,99 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultEventsBySenderLimit = 100
+	maxEventsBySenderLimit     = 1000
+)
+
+type eventsBySenderResponse struct {
+	Events    []gomatrixserverlib.ClientEvent `json:"events"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// AdminEventsBySender implements GET /_dendrite/admin/v1/eventsBySender/{userID}.
+// The events that the user has sent across all rooms are returned, most recent
+// first. The since parameter is a timestamp in milliseconds to stop at, and the
+// from parameter is the next_batch of a previous response.
+func AdminEventsBySender(
+	req *http.Request,
+	userID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	query := req.URL.Query()
+	limit := defaultEventsBySenderLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxEventsBySenderLimit {
+			limit = maxEventsBySenderLimit
+		}
+	}
+	var from, since int64
+	for param, value := range map[string]*int64{"from": &from, "since": &since} {
+		if v := query.Get(param); v != "" {
+			var err error
+			if *value, err = strconv.ParseInt(v, 10, 64); err != nil || *value < 0 {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(param + " must be a non-negative integer"),
+				}
+			}
+		}
+	}
+
+	var eventsRes roomserverAPI.QueryEventsBySenderResponse
+	if err := rsAPI.QueryEventsBySender(req.Context(), &roomserverAPI.QueryEventsBySenderRequest{
+		UserID: userID,
+		Since:  gomatrixserverlib.Timestamp(since),
+		From:   from,
+		Limit:  limit,
+	}, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventsBySender failed")
+		return jsonerror.InternalServerError()
+	}
+	res := eventsBySenderResponse{
+		Events: gomatrixserverlib.HeaderedToClientEvents(eventsRes.Events, gomatrixserverlib.FormatAll),
+	}
+	if eventsRes.Next != 0 {
+		res.NextBatch = strconv.FormatInt(eventsRes.Next, 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// AdminFederationPeers implements GET /_dendrite/admin/v1/federationPeers and
+// /_dendrite/admin/v1/federationPeers/{serverName}. The recent probes of the
+// servers that we share the most rooms with are returned along with those of
+// our own server, which helps to work out whether federation is slow with
+// everyone, which points at us, or only with certain servers.
+func AdminFederationPeers(
+	req *http.Request,
+	serverName gomatrixserverlib.ServerName,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+) util.JSONResponse {
+	var res federationSenderAPI.QueryPeerLatencyResponse
+	if err := fsAPI.QueryPeerLatency(req.Context(), &federationSenderAPI.QueryPeerLatencyRequest{
+		ServerName: serverName,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryPeerLatency failed")
+		return jsonerror.InternalServerError()
+	}
+	if serverName != "" && res.Local == nil && len(res.Peers) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Server is not being probed"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+// AdminPurgeRoom implements POST /_dendrite/admin/v1/purgeRoom/{roomID}. The room is
+// only purged if none of our local users are still joined to it.
+func AdminPurgeRoom(
+	req *http.Request,
+	roomID string,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var purgeRes roomserverAPI.PerformPurgeRoomResponse
+	if err := rsAPI.PerformPurgeRoom(req.Context(), &roomserverAPI.PerformPurgeRoomRequest{
+		RoomID: roomID,
+	}, &purgeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformPurgeRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if purgeRes.Error != nil {
+		return purgeRes.Error.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
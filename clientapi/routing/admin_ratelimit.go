@@ -0,0 +1,124 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// AdminRateLimitOverride implements GET, PUT and DELETE
+// /_dendrite/admin/v1/rateLimitOverride/{userID}, which report, set and
+// remove the client API rate limits for a local user. This lets bots and
+// bridges send more than the default rate limits allow without having to be
+// registered as an application service. If messages_per_second and
+// burst_count are both 0 then the user isn't rate limited at all. If the user
+// doesn't have an override then an empty object is returned.
+func AdminRateLimitOverride(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+	rateLimits *rateLimits,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only the rate limits of local users can be changed"),
+		}
+	}
+	if _, err = accountDB.GetAccountByLocalpart(req.Context(), localpart); err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var override userapi.RateLimitOverride
+		if resErr := httputil.UnmarshalJSONRequest(req, &override); resErr != nil {
+			return *resErr
+		}
+		unlimited := override.MessagesPerSecond == 0 && override.BurstCount == 0
+		if !unlimited && (override.MessagesPerSecond <= 0 || override.BurstCount <= 0) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("messages_per_second and burst_count must both be positive, or both be 0 to turn off rate limiting"),
+			}
+		}
+		if err = accountDB.SetRateLimitOverride(req.Context(), localpart, override); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetRateLimitOverride failed")
+			return jsonerror.InternalServerError()
+		}
+		rateLimits.forgetRateLimitOverride(userID)
+		util.GetLogger(req.Context()).WithFields(map[string]interface{}{
+			"user_id":             userID,
+			"messages_per_second": override.MessagesPerSecond,
+			"burst_count":         override.BurstCount,
+		}).Warn("User rate limits changed by server administrator")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: override,
+		}
+
+	case http.MethodDelete:
+		if err = accountDB.RemoveRateLimitOverride(req.Context(), localpart); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRateLimitOverride failed")
+			return jsonerror.InternalServerError()
+		}
+		rateLimits.forgetRateLimitOverride(userID)
+		util.GetLogger(req.Context()).WithField("user_id", userID).Warn("User rate limits reset by server administrator")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+
+	default:
+		override, err := accountDB.GetRateLimitOverride(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRateLimitOverride failed")
+			return jsonerror.InternalServerError()
+		}
+		if override == nil {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: struct{}{},
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: override,
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+)
+
+var validRegistrationTokenRegex = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+type createRegistrationTokenRequest struct {
+	// The token to create. If empty, a random token of the given length is
+	// created instead.
+	Token  string `json:"token"`
+	Length int    `json:"length"`
+	// The number of times the token can be used, or nil if there's no limit.
+	UsesAllowed *int64 `json:"uses_allowed"`
+	// When the token expires in milliseconds since the epoch, or nil if it
+	// doesn't.
+	ExpiryTime *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+type registrationTokensResponse struct {
+	RegistrationTokens []userapi.RegistrationToken `json:"registration_tokens"`
+}
+
+// AdminRegistrationTokens implements GET and POST
+// /_dendrite/admin/v1/registrationTokens, which list and create the tokens
+// that let people register when client_api.registration_requires_token is
+// set. If valid=true or valid=false is given then only the tokens which can
+// or can't still be used are listed.
+func AdminRegistrationTokens(
+	req *http.Request,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	if req.Method != http.MethodPost {
+		tokens, err := accountDB.GetRegistrationTokens(req.Context())
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+			return jsonerror.InternalServerError()
+		}
+		res := registrationTokensResponse{RegistrationTokens: []userapi.RegistrationToken{}}
+		valid := req.URL.Query().Get("valid")
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		for i := range tokens {
+			if valid == "" || (valid == "true") == tokens[i].IsValid(now) {
+				res.RegistrationTokens = append(res.RegistrationTokens, tokens[i])
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+
+	var body createRegistrationTokenRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.Token == "" {
+		if body.Length == 0 {
+			body.Length = defaultRegistrationTokenLength
+		}
+		if body.Length < 0 || body.Length > maxRegistrationTokenLength {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("length must be between 1 and 64"),
+			}
+		}
+		body.Token = util.RandomString(body.Length)
+	} else if !validRegistrationTokenRegex.MatchString(body.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("token must be at most 64 characters from A-Z, a-z, 0-9, ., _, ~ and -"),
+		}
+	}
+	if body.UsesAllowed != nil && *body.UsesAllowed < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("uses_allowed must not be negative"),
+		}
+	}
+	if body.ExpiryTime != nil && *body.ExpiryTime <= gomatrixserverlib.AsTimestamp(time.Now()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("expiry_time must be in the future"),
+		}
+	}
+
+	token := userapi.RegistrationToken{
+		Token:       body.Token,
+		UsesAllowed: body.UsesAllowed,
+		ExpiryTime:  body.ExpiryTime,
+	}
+	created, err := accountDB.CreateRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !created {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.InvalidArgumentValue("Registration token already exists"),
+		}
+	}
+	util.GetLogger(req.Context()).Warn("Registration token created by server administrator")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: token,
+	}
+}
+
+// AdminRegistrationToken implements GET and DELETE
+// /_dendrite/admin/v1/registrationTokens/{token}, which report on and revoke a
+// registration token. Accounts which were registered with the token aren't
+// affected by revoking it.
+func AdminRegistrationToken(
+	req *http.Request,
+	token string,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	regToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if regToken == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+
+	if req.Method == http.MethodDelete {
+		if err = accountDB.RemoveRegistrationToken(req.Context(), token); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+		util.GetLogger(req.Context()).Warn("Registration token revoked by server administrator")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: regToken,
+	}
+}
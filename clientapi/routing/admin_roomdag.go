@@ -0,0 +1,179 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRoomDAGLimit = 100
+	maxRoomDAGLimit     = 1000
+)
+
+type roomDAGResponse struct {
+	RoomID             string                        `json:"room_id"`
+	RoomVersion        gomatrixserverlib.RoomVersion `json:"room_version"`
+	Events             []roomserverAPI.RoomDAGEvent  `json:"events"`
+	ForwardExtremities []string                      `json:"forward_extremities"`
+	StateSnapshotNID   int64                         `json:"state_snapshot_nid"`
+}
+
+// AdminRoomDAG implements GET /_dendrite/admin/v1/roomDAG/{roomID}.
+// The events of the room with depths between from_depth and to_depth are
+// exported along with their prev and auth events and the state snapshots
+// that were stored for them, as JSON or, if format=dot, as a Graphviz graph.
+// If there are more than limit events in the range then the deepest are used.
+func AdminRoomDAG(
+	w http.ResponseWriter,
+	req *http.Request,
+	roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) *util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid room ID"),
+		}
+	}
+	query := req.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "dot" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("format must be json or dot"),
+		}
+	}
+	limit := defaultRoomDAGLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxRoomDAGLimit {
+			limit = maxRoomDAGLimit
+		}
+	}
+	var fromDepth, toDepth int64
+	for param, value := range map[string]*int64{"from_depth": &fromDepth, "to_depth": &toDepth} {
+		if v := query.Get(param); v != "" {
+			var err error
+			if *value, err = strconv.ParseInt(v, 10, 64); err != nil || *value < 0 {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(param + " must be a non-negative integer"),
+				}
+			}
+		}
+	}
+
+	var dagRes roomserverAPI.QueryRoomDAGResponse
+	if err := rsAPI.QueryRoomDAG(req.Context(), &roomserverAPI.QueryRoomDAGRequest{
+		RoomID:    roomID,
+		FromDepth: fromDepth,
+		ToDepth:   toDepth,
+		Limit:     limit,
+	}, &dagRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomDAG failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if !dagRes.RoomExists {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+
+	res := roomDAGResponse{
+		RoomID:             roomID,
+		RoomVersion:        dagRes.RoomVersion,
+		Events:             dagRes.Events,
+		ForwardExtremities: dagRes.ForwardExtremities,
+		StateSnapshotNID:   dagRes.StateSnapshotNID,
+	}
+	var err error
+	if format == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = writeRoomDAGDot(w, &res)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(&res)
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to write room DAG")
+	}
+	return nil
+}
+
+// writeRoomDAGDot writes the room DAG as a Graphviz graph. Edges point from
+// each event to its prev events, which are solid, and its auth events, which
+// are dotted. Outliers are dashed, rejected events are red, soft-failed events
+// are orange and the forward extremities of the room have a double border.
+func writeRoomDAGDot(w io.Writer, res *roomDAGResponse) error {
+	extremities := make(map[string]bool, len(res.ForwardExtremities))
+	for _, eventID := range res.ForwardExtremities {
+		extremities[eventID] = true
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", strconv.Quote(res.RoomID))
+	b.WriteString("\trankdir=BT;\n")
+	b.WriteString("\tnode [shape=box];\n")
+	for _, ev := range res.Events {
+		label := ev.EventID + "\n" + ev.Type
+		if ev.StateKey != nil {
+			label += " (" + *ev.StateKey + ")"
+		}
+		label += fmt.Sprintf("\ndepth %d, state snapshot %d", ev.Depth, ev.StateSnapshotNID)
+		attrs := []string{"label=" + strconv.Quote(label)}
+		if ev.Outlier {
+			attrs = append(attrs, "style=dashed")
+		}
+		switch {
+		case ev.Rejected:
+			attrs = append(attrs, "color=red")
+		case ev.SoftFailed:
+			attrs = append(attrs, "color=orange")
+		}
+		if extremities[ev.EventID] {
+			attrs = append(attrs, "peripheries=2")
+		}
+		fmt.Fprintf(&b, "\t%s [%s];\n", strconv.Quote(ev.EventID), strings.Join(attrs, ", "))
+		for _, prevEventID := range ev.PrevEvents {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", strconv.Quote(ev.EventID), strconv.Quote(prevEventID))
+		}
+		for _, authEventID := range ev.AuthEvents {
+			fmt.Fprintf(&b, "\t%s -> %s [style=dotted, color=grey];\n", strconv.Quote(ev.EventID), strconv.Quote(authEventID))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,213 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultAdminRoomsLimit = 100
+	maxAdminRoomsLimit     = 1000
+)
+
+type adminRoomsResponse struct {
+	Rooms []roomserverAPI.RoomListEntry `json:"rooms"`
+	// Passed as from to get the next page, or empty if there are no more rooms.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+type adminRoomResponse struct {
+	roomserverAPI.RoomListEntry
+	State []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+type removeLocalUsersRequest struct {
+	// Whether to block the room so that local users can't join it again.
+	// Defaults to true.
+	Block *bool `json:"block"`
+}
+
+type removeLocalUsersResponse struct {
+	RemovedUserIDs []string `json:"removed_user_ids"`
+	FailedUserIDs  []string `json:"failed_user_ids"`
+	Blocked        bool     `json:"blocked"`
+}
+
+type blockRoomRequest struct {
+	Blocked bool `json:"blocked"`
+}
+
+// AdminRooms implements GET /_dendrite/admin/v1/rooms, which lists the rooms
+// that the roomserver knows about in order of room ID, along with their room
+// versions and member counts.
+func AdminRooms(
+	req *http.Request,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	limit := defaultAdminRoomsLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxAdminRoomsLimit {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be between 1 and 1000"),
+			}
+		}
+	}
+
+	var listRes roomserverAPI.QueryRoomListResponse
+	if err := rsAPI.QueryRoomList(req.Context(), &roomserverAPI.QueryRoomListRequest{
+		From:  query.Get("from"),
+		Limit: limit,
+	}, &listRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomList failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminRoomsResponse{Rooms: listRes.Rooms}
+	if len(listRes.Rooms) == limit {
+		res.NextToken = listRes.Rooms[len(listRes.Rooms)-1].RoomID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminRoom implements GET /_dendrite/admin/v1/rooms/{roomID}, which reports
+// on a room along with all of its current state.
+func AdminRoom(
+	req *http.Request,
+	roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var listRes roomserverAPI.QueryRoomListResponse
+	if err := rsAPI.QueryRoomList(req.Context(), &roomserverAPI.QueryRoomListRequest{
+		RoomID: roomID,
+	}, &listRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomList failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(listRes.Rooms) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+
+	// Not asking for any particular state returns all of it.
+	var stateRes roomserverAPI.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(req.Context(), &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, &stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminRoomResponse{
+			RoomListEntry: listRes.Rooms[0],
+			State:         gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll),
+		},
+	}
+}
+
+// AdminRemoveLocalUsers implements POST
+// /_dendrite/admin/v1/removeLocalUsers/{roomID}, which makes all of our local
+// users leave the room and rejects their invites to it. Unless block is false,
+// the room is blocked first so that they can't join it again.
+func AdminRemoveLocalUsers(
+	req *http.Request,
+	roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var body removeLocalUsersRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+	}
+	block := body.Block == nil || *body.Block
+
+	var removeRes roomserverAPI.PerformRemoveLocalUsersResponse
+	if err := rsAPI.PerformRemoveLocalUsers(req.Context(), &roomserverAPI.PerformRemoveLocalUsersRequest{
+		RoomID: roomID,
+		Block:  block,
+	}, &removeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformRemoveLocalUsers failed")
+		return jsonerror.InternalServerError()
+	}
+	if removeRes.Error != nil {
+		return removeRes.Error.JSONResponse()
+	}
+	util.GetLogger(req.Context()).WithFields(map[string]interface{}{
+		"room_id": roomID,
+		"removed": len(removeRes.RemovedUserIDs),
+		"failed":  len(removeRes.FailedUserIDs),
+		"blocked": block,
+	}).Warn("Local users removed from room by server administrator")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: removeLocalUsersResponse{
+			RemovedUserIDs: removeRes.RemovedUserIDs,
+			FailedUserIDs:  removeRes.FailedUserIDs,
+			Blocked:        block,
+		},
+	}
+}
+
+// AdminBlockRoom implements PUT /_dendrite/admin/v1/blockRoom/{roomID}, which
+// changes whether local users can join or be invited to the room. Rooms can be
+// blocked before we know about them. Blocking a room doesn't remove the local
+// users who are already in it.
+func AdminBlockRoom(
+	req *http.Request,
+	roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid room ID"),
+		}
+	}
+	var body blockRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if err := rsAPI.PerformBlockRoom(req.Context(), &roomserverAPI.PerformBlockRoomRequest{
+		RoomID:  roomID,
+		Blocked: body.Blocked,
+	}, &roomserverAPI.PerformBlockRoomResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformBlockRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithFields(map[string]interface{}{
+		"room_id": roomID,
+		"blocked": body.Blocked,
+	}).Warn("Room block changed by server administrator")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: body,
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRoomThroughputLimit   = 10
+	maxRoomThroughputLimit       = 1000
+	defaultRoomThroughputMinutes = 5
+	maxRoomThroughputMinutes     = 60
+)
+
+type roomThroughputResponse struct {
+	Minutes int                            `json:"minutes"`
+	Rooms   []roomserverAPI.RoomThroughput `json:"rooms"`
+}
+
+// AdminRoomThroughput implements GET /_dendrite/admin/v1/roomThroughput.
+// The rooms which received the most events over the last few minutes are
+// returned, busiest first, which helps to find the room causing a load spike.
+func AdminRoomThroughput(
+	req *http.Request,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	limit := defaultRoomThroughputLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxRoomThroughputLimit {
+			limit = maxRoomThroughputLimit
+		}
+	}
+	minutes := defaultRoomThroughputMinutes
+	if m := query.Get("minutes"); m != "" {
+		var err error
+		if minutes, err = strconv.Atoi(m); err != nil || minutes <= 0 || minutes > maxRoomThroughputMinutes {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("minutes must be between 1 and 60"),
+			}
+		}
+	}
+
+	var throughputRes roomserverAPI.QueryRoomThroughputResponse
+	if err := rsAPI.QueryRoomThroughput(req.Context(), &roomserverAPI.QueryRoomThroughputRequest{
+		Minutes: minutes,
+		Limit:   limit,
+	}, &throughputRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomThroughput failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomThroughputResponse{
+			Minutes: minutes,
+			Rooms:   throughputRes.Rooms,
+		},
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRoomUsageLimit = 100
+	maxRoomUsageLimit     = 1000
+)
+
+type roomUsageResponse struct {
+	Rooms []roomserverAPI.RoomUsage `json:"rooms"`
+}
+
+// AdminRoomUsage implements GET /_dendrite/admin/v1/roomUsage and GET /_dendrite/admin/v1/roomUsage/{roomID}.
+// Without a room ID, the rooms using the most storage are returned, largest first.
+func AdminRoomUsage(
+	req *http.Request,
+	roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	limit := defaultRoomUsageLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxRoomUsageLimit {
+			limit = maxRoomUsageLimit
+		}
+	}
+
+	var usageRes roomserverAPI.QueryRoomUsageResponse
+	if err := rsAPI.QueryRoomUsage(req.Context(), &roomserverAPI.QueryRoomUsageRequest{
+		RoomID: roomID,
+		Limit:  limit,
+	}, &usageRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomUsage failed")
+		return jsonerror.InternalServerError()
+	}
+	if roomID != "" && len(usageRes.Rooms) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No usage recorded for this room"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomUsageResponse{Rooms: usageRes.Rooms},
+	}
+}
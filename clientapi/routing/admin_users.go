@@ -0,0 +1,373 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultAdminUsersLimit = 100
+	maxAdminUsersLimit     = 1000
+)
+
+type adminUser struct {
+	UserID       string `json:"user_id"`
+	Admin        bool   `json:"admin"`
+	Suspended    bool   `json:"suspended"`
+	Deactivated  bool   `json:"deactivated"`
+	AppServiceID string `json:"appservice_id,omitempty"`
+}
+
+func newAdminUser(acc *userapi.Account) adminUser {
+	return adminUser{
+		UserID:       acc.UserID,
+		Admin:        acc.IsAdmin,
+		Suspended:    acc.Suspended,
+		Deactivated:  acc.Deactivated,
+		AppServiceID: acc.AppServiceID,
+	}
+}
+
+type adminUsersResponse struct {
+	Users []adminUser `json:"users"`
+	// Passed as from to get the next page, or empty if there are no more users.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+type adminUserDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name"`
+	LastSeenTS  int64  `json:"last_seen_ts"`
+	LastSeenIP  string `json:"last_seen_ip"`
+	UserAgent   string `json:"user_agent"`
+}
+
+type adminUserResponse struct {
+	adminUser
+	DisplayName string                     `json:"display_name"`
+	AvatarURL   string                     `json:"avatar_url"`
+	Permissions userapi.AccountPermissions `json:"permissions"`
+	Devices     []adminUserDevice          `json:"devices"`
+	ThreePIDs   []authtypes.ThreePID       `json:"threepids"`
+}
+
+type resetPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Whether to log out all of the user's devices. Defaults to true.
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+type deactivateResponse struct {
+	// The rooms that the user had been invited to, whose invites were rejected.
+	RejectedInvites []string `json:"rejected_invites"`
+}
+
+type serverAdminRequest struct {
+	Admin bool `json:"admin"`
+}
+
+// getLocalAccount returns the account of a local user, or an error response if
+// the user ID is invalid, isn't local or doesn't have an account.
+func getLocalAccount(
+	req *http.Request, userID string, cfg *config.ClientAPI, accountDB accounts.Database,
+) (*userapi.Account, *util.JSONResponse) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be managed"),
+		}
+	}
+	acc, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return acc, nil
+}
+
+// AdminUsers implements GET /_dendrite/admin/v1/users, which lists the local
+// users in order of user ID. Up to limit users are returned, starting after
+// the user ID given in from, which is the next_token of the previous page.
+// If search is given then only users whose localpart or display name contains
+// it are listed.
+func AdminUsers(
+	req *http.Request,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	query := req.URL.Query()
+	limit := defaultAdminUsersLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxAdminUsersLimit {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be between 1 and 1000"),
+			}
+		}
+	}
+	from := query.Get("from")
+	if from != "" {
+		localpart, _, err := gomatrixserverlib.SplitID('@', from)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be a user ID"),
+			}
+		}
+		from = localpart
+	}
+
+	accs, err := accountDB.GetAccounts(req.Context(), from, query.Get("search"), limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccounts failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminUsersResponse{Users: make([]adminUser, len(accs))}
+	for i := range accs {
+		res.Users[i] = newAdminUser(&accs[i])
+	}
+	if len(accs) == limit {
+		res.NextToken = accs[len(accs)-1].UserID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminUser implements GET /_dendrite/admin/v1/users/{userID}, which reports
+// on a local user's account, profile, devices and third-party identifiers.
+func AdminUser(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+	userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	acc, resErr := getLocalAccount(req, userID, cfg, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	res := adminUserResponse{
+		adminUser:   newAdminUser(acc),
+		Permissions: acc.Permissions,
+		Devices:     []adminUserDevice{},
+		ThreePIDs:   []authtypes.ThreePID{},
+	}
+
+	profile, err := accountDB.GetProfileByLocalpart(ctx, acc.Localpart)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	if profile != nil {
+		res.DisplayName, res.AvatarURL = profile.DisplayName, profile.AvatarURL
+	}
+
+	var devicesRes userapi.QueryDevicesResponse
+	if err = userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{UserID: acc.UserID}, &devicesRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryDevices failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, device := range devicesRes.Devices {
+		res.Devices = append(res.Devices, adminUserDevice{
+			DeviceID:    device.ID,
+			DisplayName: device.DisplayName,
+			LastSeenTS:  device.LastSeenTS,
+			LastSeenIP:  device.LastSeenIP,
+			UserAgent:   device.UserAgent,
+		})
+	}
+
+	threePIDs, err := accountDB.GetThreePIDsForLocalpart(ctx, acc.Localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	res.ThreePIDs = append(res.ThreePIDs, threePIDs...)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminResetPassword implements POST /_dendrite/admin/v1/resetPassword/{userID},
+// which sets a new password for a local user. All of their devices are logged
+// out unless logout_devices is false.
+func AdminResetPassword(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+	userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	acc, resErr := getLocalAccount(req, userID, cfg, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	var r resetPasswordRequest
+	if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("new_password must be given"),
+		}
+	}
+	if resErr = validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	ctx := req.Context()
+	var passwordRes userapi.PerformPasswordUpdateResponse
+	if err := userAPI.PerformPasswordUpdate(ctx, &userapi.PerformPasswordUpdateRequest{
+		Localpart: acc.Localpart,
+		Password:  r.NewPassword,
+	}, &passwordRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+	if r.LogoutDevices == nil || *r.LogoutDevices {
+		if err := userAPI.PerformDeviceDeletion(ctx, &userapi.PerformDeviceDeletionRequest{
+			UserID: acc.UserID,
+		}, &userapi.PerformDeviceDeletionResponse{}); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	util.GetLogger(ctx).WithField("user_id", acc.UserID).Warn("User password reset by server administrator")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminDeactivateUser implements POST /_dendrite/admin/v1/deactivate/{userID},
+// which deactivates a local user's account. Their devices are logged out,
+// their pushers removed, their display name and avatar erased, and any
+// invites that they haven't replied to are rejected. This can't be undone.
+func AdminDeactivateUser(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	acc, resErr := getLocalAccount(req, userID, cfg, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	var deactivateRes userapi.PerformAccountDeactivationResponse
+	if err := userAPI.PerformAccountDeactivation(ctx, &userapi.PerformAccountDeactivationRequest{
+		Localpart:    acc.Localpart,
+		EraseProfile: true,
+	}, &deactivateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var roomsRes roomserverAPI.QueryRoomsForUserResponse
+	if err := rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         acc.UserID,
+		WantMembership: gomatrixserverlib.Invite,
+	}, &roomsRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	res := deactivateResponse{RejectedInvites: []string{}}
+	for _, roomID := range roomsRes.RoomIDs {
+		if err := rsAPI.PerformLeave(ctx, &roomserverAPI.PerformLeaveRequest{
+			RoomID: roomID,
+			UserID: acc.UserID,
+		}, &roomserverAPI.PerformLeaveResponse{}); err != nil {
+			// The account has been deactivated already, so carry on with
+			// the other invites.
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("rsAPI.PerformLeave failed")
+			continue
+		}
+		res.RejectedInvites = append(res.RejectedInvites, roomID)
+	}
+
+	util.GetLogger(ctx).WithField("user_id", acc.UserID).Warn("User deactivated by server administrator")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminServerAdmin implements GET and PUT /_dendrite/admin/v1/serverAdmin/{userID},
+// which report and change whether a local user is a server administrator.
+// Users listed in the config are always server administrators.
+func AdminServerAdmin(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	acc, resErr := getLocalAccount(req, userID, cfg, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	if req.Method == http.MethodPut {
+		var r serverAdminRequest
+		if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if err := accountDB.SetAccountAdmin(req.Context(), acc.Localpart, r.Admin); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAccountAdmin failed")
+			return jsonerror.InternalServerError()
+		}
+		acc.IsAdmin = r.Admin
+		util.GetLogger(req.Context()).WithFields(map[string]interface{}{
+			"user_id": userID,
+			"admin":   r.Admin,
+		}).Warn("User server administrator status changed by server administrator")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: serverAdminRequest{Admin: acc.IsAdmin || cfg.Matrix.IsAdmin(acc.UserID)},
+	}
+}
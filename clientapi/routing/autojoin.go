@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// onRegistered does any work needed for a newly registered user once
+// their account has been created.
+func onRegistered(
+	cfg *config.ClientAPI, userID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+) {
+	autoJoinRooms(cfg, userID, accountDB, rsAPI, asAPI)
+	sendWelcomeMessage(cfg, userID, accountDB, rsAPI, asAPI)
+}
+
+// autoJoinRooms joins a newly registered user to the rooms listed in the
+// auto_join_rooms config option. The joins happen in the background so
+// that registration doesn't have to wait for them, since joining rooms
+// over federation can take a while. Failures are logged but otherwise
+// ignored, as the account has already been created by this point.
+func autoJoinRooms(
+	cfg *config.ClientAPI, userID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+) {
+	if len(cfg.AutoJoinRooms) == 0 {
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		for _, room := range cfg.AutoJoinRooms {
+			if err := autoJoinRoom(ctx, cfg, userID, room, accountDB, rsAPI, asAPI); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"user_id": userID,
+					"room":    room,
+				}).Warn("Failed to auto-join room")
+			}
+		}
+	}()
+}
+
+// autoJoinRoom joins the user to the given room ID or alias. If the alias
+// is local and doesn't exist yet then the room is created instead, with the
+// user as its creator.
+func autoJoinRoom(
+	ctx context.Context, cfg *config.ClientAPI, userID, roomIDOrAlias string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+) error {
+	if localpart, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias); err == nil && domain == cfg.Matrix.ServerName {
+		var aliasRes roomserverAPI.GetRoomIDForAliasResponse
+		if err = rsAPI.GetRoomIDForAlias(ctx, &roomserverAPI.GetRoomIDForAliasRequest{
+			Alias: roomIDOrAlias,
+		}, &aliasRes); err != nil {
+			return fmt.Errorf("rsAPI.GetRoomIDForAlias: %w", err)
+		}
+		if aliasRes.RoomID == "" {
+			r := createRoomRequest{
+				RoomAliasName: localpart,
+				Preset:        presetPublicChat,
+				Visibility:    "public",
+			}
+			if resErr := r.Validate(); resErr != nil {
+				return fmt.Errorf("invalid room alias %q", roomIDOrAlias)
+			}
+			roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+			res := createRoomFromRequest(
+				ctx, &r, &api.Device{UserID: userID}, cfg, roomID,
+				accountDB, rsAPI, asAPI, time.Now(),
+			)
+			if res.Code == http.StatusOK {
+				return nil
+			}
+			// Someone else may have created the room in the meantime, so
+			// try to join it instead.
+		}
+	}
+
+	joinReq := roomserverAPI.PerformJoinRequest{
+		RoomIDOrAlias: roomIDOrAlias,
+		UserID:        userID,
+		Content:       map[string]interface{}{},
+	}
+	if localpart, _, err := gomatrixserverlib.SplitID('@', userID); err == nil {
+		if profile, err := accountDB.GetProfileByLocalpart(ctx, localpart); err == nil {
+			joinReq.Content["displayname"] = profile.DisplayName
+			joinReq.Content["avatar_url"] = profile.AvatarURL
+		}
+	}
+	var joinRes roomserverAPI.PerformJoinResponse
+	rsAPI.PerformJoin(ctx, &joinReq, &joinRes)
+	if joinRes.Error != nil {
+		return joinRes.Error
+	}
+	return nil
+}
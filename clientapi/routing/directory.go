@@ -141,8 +141,7 @@ func SetLocalAlias(
 
 	for _, appservice := range cfg.Derived.ApplicationServices {
 		// Don't prevent AS from creating aliases in its own namespace
-		// Note that Dendrite uses SenderLocalpart as UserID for AS users
-		if device.UserID != appservice.SenderLocalpart {
+		if device.AppServiceID != appservice.ID {
 			if aliasNamespaces, ok := appservice.NamespaceMap["aliases"]; ok {
 				for _, namespace := range aliasNamespaces {
 					if namespace.Exclusive && namespace.RegexpObject.MatchString(alias) {
@@ -304,6 +303,14 @@ func SetVisibility(
 	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
 		return *reqErr
 	}
+	// Anything other than "public" would otherwise unpublish the room, so
+	// make sure that a typo doesn't take a room out of the directory.
+	if v.Visibility != "public" && v.Visibility != "private" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("visibility must be public or private"),
+		}
+	}
 
 	var publishRes roomserverAPI.PerformPublishResponse
 	rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
@@ -22,6 +22,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -37,6 +38,30 @@ var (
 	publicRoomsCache []gomatrixserverlib.PublicRoom
 )
 
+// The public rooms of other servers are cached for a short time, as clients
+// tend to ask for the same pages again while browsing a directory and they
+// can be slow to fetch over federation.
+const (
+	remotePublicRoomsCacheLifetime   = time.Minute * 5
+	remotePublicRoomsCacheMaxEntries = 256
+)
+
+type remotePublicRoomsKey struct {
+	server gomatrixserverlib.ServerName
+	since  string
+	limit  int16
+}
+
+type remotePublicRooms struct {
+	res     gomatrixserverlib.RespPublicRooms
+	expires time.Time
+}
+
+var (
+	remoteCacheMu          sync.Mutex
+	remotePublicRoomsCache = make(map[remotePublicRoomsKey]remotePublicRooms)
+)
+
 type PublicRoomReq struct {
 	Since  string `json:"since,omitempty"`
 	Limit  int16  `json:"limit,omitempty"`
@@ -62,12 +87,18 @@ func GetPostPublicRooms(
 
 	serverName := gomatrixserverlib.ServerName(request.Server)
 
-	if serverName != "" && serverName != cfg.Matrix.ServerName {
-		res, err := federation.GetPublicRooms(req.Context(), serverName, int(request.Limit), request.Since, false, "")
+	if serverName != "" && !cfg.Matrix.IsLocalServerName(serverName) {
+		key := remotePublicRoomsKey{serverName, request.Since, request.Limit}
+		res, err := getRemotePublicRooms(key, func() (gomatrixserverlib.RespPublicRooms, error) {
+			return federation.GetPublicRooms(req.Context(), serverName, int(request.Limit), request.Since, false, "")
+		})
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("failed to get public rooms")
 			return jsonerror.InternalServerError()
 		}
+		// Searches can't be sent over federation with GET, so the best that
+		// we can do is to filter each page that we get back.
+		res.Chunk = filterRooms(res.Chunk, request.Filter.SearchTerms)
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: res,
@@ -107,18 +138,34 @@ func publicRooms(
 	}
 	err = nil
 
-	var rooms []gomatrixserverlib.PublicRoom
-	if request.Since == "" {
-		rooms = refreshPublicRoomCache(ctx, rsAPI, extRoomsProvider)
+	var chunk []gomatrixserverlib.PublicRoom
+	var prev, next int
+	if request.Filter.SearchTerms == "" {
+		// The rooms are already ordered by joined member count, so we only
+		// need to look up the contents of the rooms in the requested page.
+		rooms, local, oerr := orderedPublicRooms(ctx, rsAPI, extRoomsProvider)
+		if oerr != nil {
+			return nil, oerr
+		}
+		response.TotalRoomCountEstimate = len(rooms)
+		chunk, prev, next = sliceInto(rooms, offset, limit)
+		if chunk, err = populateLocalPublicRooms(ctx, chunk, local, rsAPI); err != nil {
+			return nil, err
+		}
 	} else {
-		rooms = getPublicRoomsFromCache()
+		// Searching needs the name, topic and alias of every room, so we
+		// populate them all up front and cache them for the later pages.
+		var rooms []gomatrixserverlib.PublicRoom
+		if request.Since == "" {
+			rooms = refreshPublicRoomCache(ctx, rsAPI, extRoomsProvider)
+		} else {
+			rooms = getPublicRoomsFromCache()
+		}
+		response.TotalRoomCountEstimate = len(rooms)
+		rooms = filterRooms(rooms, request.Filter.SearchTerms)
+		chunk, prev, next = sliceInto(rooms, offset, limit)
 	}
 
-	response.TotalRoomCountEstimate = len(rooms)
-
-	rooms = filterRooms(rooms, request.Filter.SearchTerms)
-
-	chunk, prev, next := sliceInto(rooms, offset, limit)
 	if prev >= 0 {
 		response.PrevBatch = "T" + strconv.Itoa(prev)
 	}
@@ -131,6 +178,46 @@ func publicRooms(
 	return &response, err
 }
 
+// getRemotePublicRooms returns a page of the public rooms of another server
+// from the cache, or fetches it if it isn't cached or has expired. Failures
+// aren't cached.
+func getRemotePublicRooms(
+	key remotePublicRoomsKey, fetch func() (gomatrixserverlib.RespPublicRooms, error),
+) (gomatrixserverlib.RespPublicRooms, error) {
+	now := time.Now()
+	remoteCacheMu.Lock()
+	cached, ok := remotePublicRoomsCache[key]
+	remoteCacheMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.res, nil
+	}
+
+	res, err := fetch()
+	if err != nil {
+		return res, err
+	}
+
+	remoteCacheMu.Lock()
+	defer remoteCacheMu.Unlock()
+	if len(remotePublicRoomsCache) >= remotePublicRoomsCacheMaxEntries {
+		for k, v := range remotePublicRoomsCache {
+			if !now.Before(v.expires) {
+				delete(remotePublicRoomsCache, k)
+			}
+		}
+		// If nothing has expired then start again rather than letting the
+		// cache grow without bound.
+		if len(remotePublicRoomsCache) >= remotePublicRoomsCacheMaxEntries {
+			remotePublicRoomsCache = make(map[remotePublicRoomsKey]remotePublicRooms)
+		}
+	}
+	remotePublicRoomsCache[key] = remotePublicRooms{
+		res:     res,
+		expires: now.Add(remotePublicRoomsCacheLifetime),
+	}
+	return res, nil
+}
+
 func filterRooms(rooms []gomatrixserverlib.PublicRoom, searchTerm string) []gomatrixserverlib.PublicRoom {
 	if searchTerm == "" {
 		return rooms
@@ -218,6 +305,9 @@ func sliceInto(slice []gomatrixserverlib.PublicRoom, since int64, limit int16) (
 	if nextIndex > len(slice) {
 		nextIndex = len(slice)
 	}
+	if since > int64(nextIndex) {
+		since = int64(nextIndex)
+	}
 
 	subset = slice[since:nextIndex]
 	return
@@ -228,32 +318,104 @@ func refreshPublicRoomCache(
 ) []gomatrixserverlib.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
-	var extraRooms []gomatrixserverlib.PublicRoom
-	if extRoomsProvider != nil {
-		extraRooms = extRoomsProvider.Rooms()
+	rooms, local, err := orderedPublicRooms(ctx, rsAPI, extRoomsProvider)
+	if err != nil {
+		return publicRoomsCache
 	}
+	rooms, err = populateLocalPublicRooms(ctx, rooms, local, rsAPI)
+	if err != nil {
+		return publicRoomsCache
+	}
+	publicRoomsCache = rooms
+	return publicRoomsCache
+}
 
+// orderedPublicRooms returns our published rooms merged with the rooms from
+// the extra public rooms provider, ordered by joined member count (big to
+// small). The roomserver returns our own rooms already in order, so only the
+// extra rooms need sorting. Our own rooms only have the room ID and joined
+// member count filled in, and their IDs are returned in the map so that they
+// can be populated with populateLocalPublicRooms.
+func orderedPublicRooms(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
+) ([]gomatrixserverlib.PublicRoom, map[string]bool, error) {
 	var queryRes roomserverAPI.QueryPublishedRoomsResponse
 	err := rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{}, &queryRes)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("QueryPublishedRooms failed")
-		return publicRoomsCache
+		return nil, nil, err
+	}
+	local := make(map[string]bool, len(queryRes.RoomIDs))
+	for _, roomID := range queryRes.RoomIDs {
+		local[roomID] = true
+	}
+
+	var extraRooms []gomatrixserverlib.PublicRoom
+	if extRoomsProvider != nil {
+		for _, room := range dedupeAndShuffle(extRoomsProvider.Rooms()) {
+			if !local[room.RoomID] {
+				extraRooms = append(extraRooms, room)
+			}
+		}
+		sort.SliceStable(extraRooms, func(i, j int) bool {
+			return extraRooms[i].JoinedMembersCount > extraRooms[j].JoinedMembersCount
+		})
 	}
-	pubRooms, err := roomserverAPI.PopulatePublicRooms(ctx, queryRes.RoomIDs, rsAPI)
+
+	rooms := make([]gomatrixserverlib.PublicRoom, 0, len(queryRes.RoomIDs)+len(extraRooms))
+	i, j := 0, 0
+	for i < len(queryRes.RoomIDs) || j < len(extraRooms) {
+		if i < len(queryRes.RoomIDs) {
+			roomID := queryRes.RoomIDs[i]
+			count := queryRes.JoinedMemberCounts[roomID]
+			if j == len(extraRooms) || count >= extraRooms[j].JoinedMembersCount {
+				rooms = append(rooms, gomatrixserverlib.PublicRoom{
+					RoomID:             roomID,
+					JoinedMembersCount: count,
+				})
+				i++
+				continue
+			}
+		}
+		rooms = append(rooms, extraRooms[j])
+		j++
+	}
+	return rooms, local, nil
+}
+
+// populateLocalPublicRooms fills in the details of any of our own rooms in
+// the given list of rooms, preserving the order of the list.
+func populateLocalPublicRooms(
+	ctx context.Context, rooms []gomatrixserverlib.PublicRoom, local map[string]bool,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) ([]gomatrixserverlib.PublicRoom, error) {
+	var roomIDs []string
+	for _, room := range rooms {
+		if local[room.RoomID] {
+			roomIDs = append(roomIDs, room.RoomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return rooms, nil
+	}
+	pubRooms, err := roomserverAPI.PopulatePublicRooms(ctx, roomIDs, rsAPI)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
-		return publicRoomsCache
+		return nil, err
 	}
-	publicRoomsCache = []gomatrixserverlib.PublicRoom{}
-	publicRoomsCache = append(publicRoomsCache, pubRooms...)
-	publicRoomsCache = append(publicRoomsCache, extraRooms...)
-	publicRoomsCache = dedupeAndShuffle(publicRoomsCache)
-
-	// sort by total joined member count (big to small)
-	sort.SliceStable(publicRoomsCache, func(i, j int) bool {
-		return publicRoomsCache[i].JoinedMembersCount > publicRoomsCache[j].JoinedMembersCount
-	})
-	return publicRoomsCache
+	populated := make(map[string]gomatrixserverlib.PublicRoom, len(pubRooms))
+	for _, pub := range pubRooms {
+		populated[pub.RoomID] = pub
+	}
+	result := make([]gomatrixserverlib.PublicRoom, len(rooms))
+	for i, room := range rooms {
+		if pub, ok := populated[room.RoomID]; ok && local[room.RoomID] {
+			result[i] = pub
+		} else {
+			result[i] = room
+		}
+	}
+	return result, nil
 }
 
 func getPublicRoomsFromCache() []gomatrixserverlib.PublicRoom {
@@ -3,6 +3,7 @@ package routing
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -56,3 +57,46 @@ func TestSliceInto(t *testing.T) {
 		}
 	}
 }
+
+func TestGetRemotePublicRooms(t *testing.T) {
+	remotePublicRoomsCache = make(map[remotePublicRoomsKey]remotePublicRooms)
+	fetches := 0
+	fetch := func() (gomatrixserverlib.RespPublicRooms, error) {
+		fetches++
+		return gomatrixserverlib.RespPublicRooms{
+			Chunk: []gomatrixserverlib.PublicRoom{pubRoom("a")},
+		}, nil
+	}
+	key := remotePublicRoomsKey{"remote", "", 10}
+	for i := 0; i < 2; i++ {
+		res, err := getRemotePublicRooms(key, fetch)
+		if err != nil {
+			t.Fatalf("getRemotePublicRooms failed: %s", err)
+		}
+		if len(res.Chunk) != 1 || res.Chunk[0].Name != "a" {
+			t.Fatalf("unexpected response: %+v", res)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected 1 fetch, got %d", fetches)
+	}
+
+	// A different page shouldn't be served from the cache.
+	if _, err := getRemotePublicRooms(remotePublicRoomsKey{"remote", "next", 10}, fetch); err != nil {
+		t.Fatalf("getRemotePublicRooms failed: %s", err)
+	}
+	if fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", fetches)
+	}
+
+	// Expired entries should be fetched again.
+	cached := remotePublicRoomsCache[key]
+	cached.expires = time.Now().Add(-time.Second)
+	remotePublicRoomsCache[key] = cached
+	if _, err := getRemotePublicRooms(key, fetch); err != nil {
+		t.Fatalf("getRemotePublicRooms failed: %s", err)
+	}
+	if fetches != 3 {
+		t.Errorf("expected 3 fetches, got %d", fetches)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+type keyBackupVersionRequest struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	// Only used when updating a version, where it must match the URL if given.
+	Version string `json:"version"`
+}
+
+type keyBackupVersionCreateResponse struct {
+	Version string `json:"version"`
+}
+
+type keyBackupVersionResponse struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int64           `json:"count"`
+	ETag      string          `json:"etag"`
+	Version   string          `json:"version"`
+}
+
+type keyBackupRoomSessions struct {
+	Sessions map[string]userapi.KeyBackupSession `json:"sessions"`
+}
+
+type keyBackupSessionsRequest struct {
+	Rooms map[string]keyBackupRoomSessions `json:"rooms"`
+}
+
+type keyBackupSessionsResponse struct {
+	Count int64  `json:"count"`
+	ETag  string `json:"etag"`
+}
+
+var errUnknownBackupVersion = util.JSONResponse{
+	Code: http.StatusNotFound,
+	JSON: jsonerror.NotFound("Unknown backup version"),
+}
+
+// CreateKeyBackupVersion implements POST /room_keys/version
+func CreateKeyBackupVersion(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+) util.JSONResponse {
+	var r keyBackupVersionRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Algorithm == "" || len(r.AuthData) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("algorithm and auth_data must be specified"),
+		}
+	}
+	version, err := accountDB.CreateKeyBackup(req.Context(), device.UserID, r.Algorithm, r.AuthData)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupVersionCreateResponse{Version: version},
+	}
+}
+
+// KeyBackupVersion implements GET /room_keys/version and
+// GET /room_keys/version/{version}. An empty version means the latest one.
+func KeyBackupVersion(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device, version string,
+) util.JSONResponse {
+	backup, err := accountDB.GetKeyBackup(req.Context(), device.UserID, version)
+	if err == sql.ErrNoRows {
+		if version == "" {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("No current backup version"),
+			}
+		}
+		return errUnknownBackupVersion
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupVersionResponse{
+			Algorithm: backup.Algorithm,
+			AuthData:  backup.AuthData,
+			Count:     backup.Count,
+			ETag:      backup.ETag,
+			Version:   backup.Version,
+		},
+	}
+}
+
+// ModifyKeyBackupVersionAuthData implements PUT /room_keys/version/{version}.
+// Only the auth data can be changed.
+func ModifyKeyBackupVersionAuthData(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device, version string,
+) util.JSONResponse {
+	var r keyBackupVersionRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Version != "" && r.Version != version {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("version in body does not match the URL"),
+		}
+	}
+	backup, err := accountDB.GetKeyBackup(req.Context(), device.UserID, version)
+	if err == sql.ErrNoRows {
+		return errUnknownBackupVersion
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if r.Algorithm != backup.Algorithm {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("algorithm does not match the backup version"),
+		}
+	}
+	if err = accountDB.UpdateKeyBackupAuthData(req.Context(), device.UserID, version, r.AuthData); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.UpdateKeyBackupAuthData failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// DeleteKeyBackupVersion implements DELETE /room_keys/version/{version}
+func DeleteKeyBackupVersion(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device, version string,
+) util.JSONResponse {
+	exists, err := accountDB.DeleteKeyBackup(req.Context(), device.UserID, version)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.DeleteKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !exists {
+		return errUnknownBackupVersion
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// RoomKeys implements GET, PUT and DELETE for /room_keys/keys,
+// /room_keys/keys/{roomID} and /room_keys/keys/{roomID}/{sessionID}. The
+// room and session IDs are empty for the routes which don't have them.
+func RoomKeys(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+	roomID, sessionID string,
+) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("version must be specified"),
+		}
+	}
+	if _, err := accountDB.GetKeyBackup(req.Context(), device.UserID, version); err == sql.ErrNoRows {
+		return errUnknownBackupVersion
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		return uploadBackupKeys(req, accountDB, device, version, roomID, sessionID)
+	case http.MethodDelete:
+		count, etag, err := accountDB.DeleteBackupKeys(req.Context(), device.UserID, version, roomID, sessionID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.DeleteBackupKeys failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: keyBackupSessionsResponse{Count: count, ETag: etag},
+		}
+	default:
+		return getBackupKeys(req, accountDB, device, version, roomID, sessionID)
+	}
+}
+
+func uploadBackupKeys(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+	version, roomID, sessionID string,
+) util.JSONResponse {
+	// Keys can only be added to the current version, so that clients which
+	// haven't noticed that the backup has been replaced don't carry on
+	// uploading to the old one.
+	current, err := accountDB.GetKeyBackup(req.Context(), device.UserID, "")
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if current == nil || current.Version != version {
+		currentVersion := ""
+		if current != nil {
+			currentVersion = current.Version
+		}
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.WrongBackupVersion(currentVersion),
+		}
+	}
+
+	var r keyBackupSessionsRequest
+	switch {
+	case sessionID != "":
+		var session userapi.KeyBackupSession
+		if resErr := httputil.UnmarshalJSONRequest(req, &session); resErr != nil {
+			return *resErr
+		}
+		r.Rooms = map[string]keyBackupRoomSessions{
+			roomID: {Sessions: map[string]userapi.KeyBackupSession{sessionID: session}},
+		}
+	case roomID != "":
+		var room keyBackupRoomSessions
+		if resErr := httputil.UnmarshalJSONRequest(req, &room); resErr != nil {
+			return *resErr
+		}
+		r.Rooms = map[string]keyBackupRoomSessions{roomID: room}
+	default:
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+
+	var uploads []userapi.InternalKeyBackupSession
+	for uploadRoomID, room := range r.Rooms {
+		for uploadSessionID, session := range room.Sessions {
+			uploads = append(uploads, userapi.InternalKeyBackupSession{
+				KeyBackupSession: session,
+				RoomID:           uploadRoomID,
+				SessionID:        uploadSessionID,
+			})
+		}
+	}
+	count, etag, err := accountDB.UpsertBackupKeys(req.Context(), device.UserID, version, uploads)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.UpsertBackupKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupSessionsResponse{Count: count, ETag: etag},
+	}
+}
+
+func getBackupKeys(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+	version, roomID, sessionID string,
+) util.JSONResponse {
+	keys, err := accountDB.GetBackupKeys(req.Context(), device.UserID, version, roomID, sessionID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetBackupKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	switch {
+	case sessionID != "":
+		session, ok := keys[roomID][sessionID]
+		if !ok {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("Key not found"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: session,
+		}
+	case roomID != "":
+		room := keyBackupRoomSessions{Sessions: keys[roomID]}
+		if room.Sessions == nil {
+			room.Sessions = map[string]userapi.KeyBackupSession{}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: room,
+		}
+	default:
+		r := keyBackupSessionsRequest{Rooms: map[string]keyBackupRoomSessions{}}
+		for keyRoomID, sessions := range keys {
+			r.Rooms[keyRoomID] = keyBackupRoomSessions{Sessions: sessions}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: r,
+		}
+	}
+}
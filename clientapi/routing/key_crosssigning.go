@@ -0,0 +1,132 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type crossSigningRequest struct {
+	MasterKey      *api.CrossSigningKey `json:"master_key"`
+	SelfSigningKey *api.CrossSigningKey `json:"self_signing_key"`
+	UserSigningKey *api.CrossSigningKey `json:"user_signing_key"`
+}
+
+// UploadCrossSigningDeviceKeys implements POST /keys/device_signing/upload
+func UploadCrossSigningDeviceKeys(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive,
+	keyAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	if _, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device); errRes != nil {
+		return *errRes
+	}
+
+	var r crossSigningRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	uploadRes := api.PerformUploadDeviceKeysResponse{}
+	keyAPI.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID:         device.UserID,
+		MasterKey:      r.MasterKey,
+		SelfSigningKey: r.SelfSigningKey,
+		UserSigningKey: r.UserSigningKey,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		switch {
+		case uploadRes.Error.IsInvalidSignature:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidSignature(uploadRes.Error.Error()),
+			}
+		case uploadRes.Error.IsMissingParam:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam(uploadRes.Error.Error()),
+			}
+		default:
+			util.GetLogger(ctx).WithError(uploadRes.Error).Error("Failed to PerformUploadDeviceKeys")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadCrossSigningDeviceSignatures implements POST /keys/signatures/upload
+func UploadCrossSigningDeviceSignatures(
+	req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	var r map[string]map[string]json.RawMessage
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	uploadRes := api.PerformUploadDeviceSignaturesResponse{}
+	keyAPI.PerformUploadDeviceSignatures(req.Context(), &api.PerformUploadDeviceSignaturesRequest{
+		UserID:     device.UserID,
+		Signatures: r,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		util.GetLogger(req.Context()).WithError(uploadRes.Error).Error("Failed to PerformUploadDeviceSignatures")
+		return jsonerror.InternalServerError()
+	}
+
+	failures := make(map[string]map[string]*jsonerror.MatrixError)
+	for userID, keys := range uploadRes.Failures {
+		failures[userID] = make(map[string]*jsonerror.MatrixError)
+		for keyID, keyErr := range keys {
+			switch {
+			case keyErr.IsInvalidSignature:
+				failures[userID][keyID] = jsonerror.InvalidSignature(keyErr.Error())
+			case keyErr.IsMissingParam:
+				failures[userID][keyID] = jsonerror.MissingParam(keyErr.Error())
+			default:
+				failures[userID][keyID] = jsonerror.Unknown(keyErr.Error())
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"failures": failures,
+		},
+	}
+}
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
@@ -27,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 type loginResponse struct {
@@ -41,40 +43,80 @@ type flows struct {
 }
 
 type flow struct {
-	Type string `json:"type"`
+	Type              string             `json:"type"`
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
 }
 
-func passwordLogin() flows {
+type identityProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// loginFlows returns the ways that people can log in, which include single
+// sign-on if it's enabled.
+func loginFlows(ssoLogin *ssoLogin) flows {
 	f := flows{}
-	s := flow{
+	f.Flows = append(f.Flows, flow{
 		Type: "m.login.password",
+	})
+	if ssoLogin != nil {
+		s := flow{
+			Type: "m.login.sso",
+		}
+		for _, p := range ssoLogin.providers {
+			s.IdentityProviders = append(s.IdentityProviders, identityProvider{
+				ID:   p.ID(),
+				Name: p.Name(),
+			})
+		}
+		f.Flows = append(f.Flows, s, flow{
+			Type: "m.login.token",
+		})
 	}
-	f.Flows = append(f.Flows, s)
 	return f
 }
 
 // Login implements GET and POST /login
 func Login(
 	req *http.Request, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
-	cfg *config.ClientAPI,
+	cfg *config.ClientAPI, ssoLogin *ssoLogin,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(ssoLogin),
 		}
 	} else if req.Method == http.MethodPost {
-		typePassword := auth.LoginTypePassword{
-			GetAccountByPassword: accountDB.GetAccountByPassword,
-			Config:               cfg,
-		}
-		r := typePassword.Request()
-		resErr := httputil.UnmarshalJSONRequest(req, r)
-		if resErr != nil {
+		var body json.RawMessage
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		var loginType auth.Type
+		switch gjson.GetBytes(body, "type").String() {
+		case "m.login.token":
+			if ssoLogin == nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.Unknown("Token login is not enabled"),
+				}
+			}
+			loginType = &auth.LoginTypeToken{
+				Tokens: ssoLogin.loginTokens,
+			}
+		default:
+			loginType = &auth.LoginTypePassword{
+				GetAccountByPassword: accountDB.GetAccountByPassword,
+				Config:               cfg,
+			}
+		}
+		r := loginType.Request()
+		if err := json.Unmarshal(body, r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+		login, authErr := loginType.Login(req.Context(), r)
 		if authErr != nil {
 			return *authErr
 		}
@@ -43,7 +43,7 @@ func SendBan(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, roomVer, reqErr := extractRequestData(req, device, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -74,13 +74,16 @@ func sendMembership(ctx context.Context, accountDB accounts.Database, device *us
 		return jsonerror.InternalServerError()
 	}
 
-	if err = roomserverAPI.SendEvents(
+	if err = roomserverAPI.SendEventsUnlessBusy(
 		ctx, rsAPI,
 		api.KindNew,
 		[]*gomatrixserverlib.HeaderedEvent{event.Event.Headered(roomVer)},
 		cfg.Matrix.ServerName,
 		nil,
 	); err != nil {
+		if res := roomserverBusyResponse(err); res != nil {
+			return *res
+		}
 		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -96,7 +99,7 @@ func SendKick(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, roomVer, reqErr := extractRequestData(req, device, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -136,7 +139,7 @@ func SendUnban(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, roomVer, reqErr := extractRequestData(req, device, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -171,7 +174,7 @@ func SendInvite(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
-	body, evTime, _, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, _, reqErr := extractRequestData(req, device, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -297,7 +300,7 @@ func loadProfile(
 	return profile, err
 }
 
-func extractRequestData(req *http.Request, roomID string, rsAPI api.RoomserverInternalAPI) (
+func extractRequestData(req *http.Request, device *userapi.Device, roomID string, rsAPI api.RoomserverInternalAPI) (
 	body *threepid.MembershipRequest, evTime time.Time, roomVer gomatrixserverlib.RoomVersion, resErr *util.JSONResponse,
 ) {
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
@@ -316,7 +319,7 @@ func extractRequestData(req *http.Request, roomID string, rsAPI api.RoomserverIn
 		return
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		resErr = &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -0,0 +1,131 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func canCreateRooms(p userapi.AccountPermissions) bool { return p.CanCreateRooms }
+func canInvite(p userapi.AccountPermissions) bool      { return p.CanInvite }
+
+// checkAccountPermission returns an error response with the given message
+// if a server administrator has taken the permission away from the account
+// that the device belongs to.
+func checkAccountPermission(
+	ctx context.Context, accountDB accounts.Database, device *userapi.Device,
+	allowed func(userapi.AccountPermissions) bool, msg string,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !allowed(acc.Permissions) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(msg),
+		}
+	}
+	return nil
+}
+
+// permissionsRequest is the body of PUT /_dendrite/admin/v1/permissions/{userID}. Any
+// permissions which are left out are not changed.
+type permissionsRequest struct {
+	CanCreateRooms *bool `json:"can_create_rooms"`
+	CanInvite      *bool `json:"can_invite"`
+	CanUploadMedia *bool `json:"can_upload_media"`
+}
+
+// AdminAccountPermissions implements GET and PUT /_dendrite/admin/v1/permissions/{userID},
+// which report and change what a local user is allowed to do.
+func AdminAccountPermissions(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only the permissions of local users can be changed"),
+		}
+	}
+	acc, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if req.Method == http.MethodPut {
+		var r permissionsRequest
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if r.CanCreateRooms != nil {
+			acc.Permissions.CanCreateRooms = *r.CanCreateRooms
+		}
+		if r.CanInvite != nil {
+			acc.Permissions.CanInvite = *r.CanInvite
+		}
+		if r.CanUploadMedia != nil {
+			acc.Permissions.CanUploadMedia = *r.CanUploadMedia
+		}
+		if err = accountDB.SetAccountPermissions(req.Context(), localpart, acc.Permissions); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAccountPermissions failed")
+			return jsonerror.InternalServerError()
+		}
+		util.GetLogger(req.Context()).WithFields(map[string]interface{}{
+			"user_id":     userID,
+			"permissions": acc.Permissions,
+		}).Warn("User permissions changed by server administrator")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: acc.Permissions,
+	}
+}
@@ -120,7 +120,7 @@ func SetAvatarURL(
 		return jsonerror.InternalServerError()
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -238,7 +238,7 @@ func SetDisplayName(
 		return jsonerror.InternalServerError()
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The maximum lengths of the app ID and push key, from the spec.
+const (
+	maxPusherAppIDLength   = 64
+	maxPusherPushKeyLength = 512
+)
+
+type pushersResponse struct {
+	Pushers []userapi.Pusher `json:"pushers"`
+}
+
+type setPusherRequest struct {
+	userapi.Pusher
+	// A null kind deletes the pusher, so the kind needs to be a pointer
+	// to tell that apart from a missing kind.
+	Kind   *string `json:"kind"`
+	Append bool    `json:"append"`
+}
+
+// GetPushers implements GET /pushers
+func GetPushers(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	pushers, err := accountDB.GetPushers(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: pushersResponse{Pushers: pushers},
+	}
+}
+
+// SetPusher implements POST /pushers/set
+func SetPusher(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	var r setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.AppID == "" || r.PushKey == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("app_id and pushkey must be specified"),
+		}
+	}
+	if len(r.AppID) > maxPusherAppIDLength || len(r.PushKey) > maxPusherPushKeyLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("app_id or pushkey is too long"),
+		}
+	}
+
+	if r.Kind == nil {
+		if err = accountDB.RemovePusher(req.Context(), localpart, r.AppID, r.PushKey); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePusher failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	switch *r.Kind {
+	case "http":
+		// The push gateway is the only place that notifications are sent
+		// to, so it has to be a URL that we can POST to.
+		gateway, _ := r.Data["url"].(string)
+		if u, err := url.Parse(gateway); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("data.url must be an HTTP or HTTPS URL for http pushers"),
+			}
+		}
+	case "email":
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("kind must be http or email"),
+		}
+	}
+	if r.AppDisplayName == "" || r.DeviceDisplayName == "" || r.Language == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("app_display_name, device_display_name and lang must be specified"),
+		}
+	}
+
+	pusher := r.Pusher
+	pusher.Kind = *r.Kind
+	pusher.PushKeyTS = gomatrixserverlib.AsTimestamp(time.Now())
+	if pusher.Data == nil {
+		pusher.Data = map[string]interface{}{}
+	}
+	if err = accountDB.UpsertPusher(req.Context(), localpart, device.ID, pusher, r.Append); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.UpsertPusher failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The only scope of push rules defined by the spec.
+const pushRulesGlobalScope = "global"
+
+type putPushRuleRequest struct {
+	Actions    []*pushrules.Action    `json:"actions"`
+	Conditions []*pushrules.Condition `json:"conditions"`
+	Pattern    string                 `json:"pattern"`
+}
+
+type pushRuleEnabledJSON struct {
+	Enabled bool `json:"enabled"`
+}
+
+type pushRuleActionsJSON struct {
+	Actions []*pushrules.Action `json:"actions"`
+}
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, scope string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	scoped, resErr := pushRuleSetsForScope(ruleSets, scope)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: scoped,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, scope, kind string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: *rules,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleId}
+func GetPushRuleByRuleID(
+	req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	rule, _, resErr := findPushRule(ruleSets, scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: rule,
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleId}
+func PutPushRuleByRuleID(
+	req *http.Request, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+	device *userapi.Device, scope, kind, ruleID string,
+) util.JSONResponse {
+	var r putPushRuleRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if strings.HasPrefix(ruleID, ".") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Rule IDs starting with '.' are reserved for the server-default rules"),
+		}
+	}
+	if r.Actions == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing actions"),
+		}
+	}
+	newRule := &pushrules.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: r.Actions,
+	}
+	switch pushrules.Kind(kind) {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		newRule.Conditions = r.Conditions
+		if newRule.Conditions == nil {
+			newRule.Conditions = []*pushrules.Condition{}
+		}
+	case pushrules.ContentKind:
+		if r.Pattern == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing pattern"),
+			}
+		}
+		newRule.Pattern = r.Pattern
+	}
+
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+
+	// Take out the existing rule, if any, so that the new one can go either
+	// where it was or where the client asked for it to go.
+	_, index := ruleSets.Global.Find(pushrules.Kind(kind), ruleID)
+	if index >= 0 {
+		*rules = append((*rules)[:index], (*rules)[index+1:]...)
+	}
+	query := req.URL.Query()
+	before, after := query.Get("before"), query.Get("after")
+	switch {
+	case before != "" || after != "":
+		relativeTo := before
+		if relativeTo == "" {
+			relativeTo = after
+		}
+		_, relIndex := ruleSets.Global.Find(pushrules.Kind(kind), relativeTo)
+		if relIndex < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Rule %q does not exist", relativeTo)),
+			}
+		}
+		if before == "" {
+			relIndex++
+		}
+		index = relIndex
+	case index < 0:
+		// New rules have a higher priority than the other rules of the
+		// same kind, apart from the master rule which always comes first.
+		index = 0
+		if len(*rules) > 0 && (*rules)[0].RuleID == ".m.rule.master" {
+			index = 1
+		}
+	}
+	*rules = append(*rules, nil)
+	copy((*rules)[index+1:], (*rules)[index:])
+	(*rules)[index] = newRule
+
+	if resErr = savePushRules(req.Context(), userAPI, syncProducer, device.UserID, ruleSets); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleId}
+func DeletePushRuleByRuleID(
+	req *http.Request, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+	device *userapi.Device, scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	rule, index, resErr := findPushRule(ruleSets, scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	if rule.Default {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Server-default rules can't be deleted"),
+		}
+	}
+	rules := ruleSets.Global.Rules(pushrules.Kind(kind))
+	*rules = append((*rules)[:index], (*rules)[index+1:]...)
+
+	if resErr = savePushRules(req.Context(), userAPI, syncProducer, device.UserID, ruleSets); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleId}/{attr}
+func GetPushRuleAttrByRuleID(
+	req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	rule, _, resErr := findPushRule(ruleSets, scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	switch attr {
+	case "enabled":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: pushRuleEnabledJSON{Enabled: rule.Enabled},
+		}
+	case "actions":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: pushRuleActionsJSON{Actions: rule.Actions},
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Unknown push rule attribute %q", attr)),
+		}
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleId}/{attr}
+func PutPushRuleAttrByRuleID(
+	req *http.Request, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+	device *userapi.Device, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req.Context(), userAPI, device.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	rule, _, resErr := findPushRule(ruleSets, scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	switch attr {
+	case "enabled":
+		var r pushRuleEnabledJSON
+		if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		rule.Enabled = r.Enabled
+	case "actions":
+		var r pushRuleActionsJSON
+		if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if r.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing actions"),
+			}
+		}
+		rule.Actions = r.Actions
+	default:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Unknown push rule attribute %q", attr)),
+		}
+	}
+
+	if resErr = savePushRules(req.Context(), userAPI, syncProducer, device.UserID, ruleSets); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// queryPushRules returns the push rules of the user, which are the default
+// rules if the user hasn't changed them yet.
+func queryPushRules(
+	ctx context.Context, userAPI userapi.UserInternalAPI, userID string,
+) (*pushrules.AccountRuleSets, *util.JSONResponse) {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: pushrules.AccountDataType,
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err = userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	ruleSets, err := pushrules.ParseAccountRuleSets(dataRes.GlobalAccountData[pushrules.AccountDataType], localpart, serverName)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("pushrules.ParseAccountRuleSets failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return ruleSets, nil
+}
+
+// savePushRules stores the push rules of the user and tells the sync API
+// about them, so that they are sent down /sync as account data.
+func savePushRules(
+	ctx context.Context, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+	userID string, ruleSets *pushrules.AccountRuleSets,
+) *util.JSONResponse {
+	data, err := json.Marshal(ruleSets)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("json.Marshal failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	dataReq := userapi.InputAccountDataRequest{
+		UserID:      userID,
+		DataType:    pushrules.AccountDataType,
+		AccountData: data,
+	}
+	dataRes := userapi.InputAccountDataResponse{}
+	if err = userAPI.InputAccountData(ctx, &dataReq, &dataRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.InputAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if err = syncProducer.SendData(userID, "", pushrules.AccountDataType, data); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncProducer.SendData failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
+
+func pushRuleSetsForScope(ruleSets *pushrules.AccountRuleSets, scope string) (*pushrules.RuleSets, *util.JSONResponse) {
+	if scope != pushRulesGlobalScope {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule scope %q", scope)),
+		}
+	}
+	return &ruleSets.Global, nil
+}
+
+func pushRulesForKind(ruleSets *pushrules.AccountRuleSets, scope, kind string) (*[]*pushrules.Rule, *util.JSONResponse) {
+	scoped, resErr := pushRuleSetsForScope(ruleSets, scope)
+	if resErr != nil {
+		return nil, resErr
+	}
+	rules := scoped.Rules(pushrules.Kind(kind))
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule kind %q", kind)),
+		}
+	}
+	return rules, nil
+}
+
+func findPushRule(ruleSets *pushrules.AccountRuleSets, scope, kind, ruleID string) (*pushrules.Rule, int, *util.JSONResponse) {
+	if _, resErr := pushRulesForKind(ruleSets, scope, kind); resErr != nil {
+		return nil, -1, resErr
+	}
+	rule, index := ruleSets.Global.Find(pushrules.Kind(kind), ruleID)
+	if rule == nil {
+		return nil, -1, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Push rule %q does not exist", ruleID)),
+		}
+	}
+	return rule, index, nil
+}
@@ -1,15 +1,23 @@
 package routing
 
 import (
+	"context"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+// rateLimitOverrideCacheTime is how long rate limit overrides are remembered
+// before they are looked up in the account database again.
+const rateLimitOverrideCacheTime = time.Minute
+
 type rateLimits struct {
 	limits           map[string]chan struct{}
 	limitsMutex      sync.RWMutex
@@ -17,14 +25,24 @@ type rateLimits struct {
 	enabled          bool
 	requestThreshold int64
 	cooloffDuration  time.Duration
+	accountDB        accounts.Database
+	overrides        map[string]cachedRateLimitOverride
+	overridesMutex   sync.Mutex
+}
+
+type cachedRateLimitOverride struct {
+	override *userapi.RateLimitOverride // nil if the user doesn't have one
+	expires  time.Time
 }
 
-func newRateLimits(cfg *config.RateLimiting) *rateLimits {
+func newRateLimits(cfg *config.RateLimiting, accountDB accounts.Database) *rateLimits {
 	l := &rateLimits{
 		limits:           make(map[string]chan struct{}),
 		enabled:          cfg.Enabled,
 		requestThreshold: cfg.Threshold,
 		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
+		accountDB:        accountDB,
+		overrides:        make(map[string]cachedRateLimitOverride),
 	}
 	if l.enabled {
 		go l.clean()
@@ -49,28 +67,103 @@ func (l *rateLimits) clean() {
 		}
 		l.limitsMutex.Unlock()
 		l.cleanMutex.Unlock()
+
+		now := time.Now()
+		l.overridesMutex.Lock()
+		for userID, cached := range l.overrides {
+			if now.After(cached.expires) {
+				delete(l.overrides, userID)
+			}
+		}
+		l.overridesMutex.Unlock()
+	}
+}
+
+// rateLimitOverride returns the rate limit override for the local user, or
+// nil if they don't have one. Overrides are cached for a while so that the
+// account database isn't hit on every request.
+func (l *rateLimits) rateLimitOverride(ctx context.Context, userID string) *userapi.RateLimitOverride {
+	if l.accountDB == nil {
+		return nil
 	}
+	l.overridesMutex.Lock()
+	cached, ok := l.overrides[userID]
+	l.overridesMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.override
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil
+	}
+	override, err := l.accountDB.GetRateLimitOverride(ctx, localpart)
+	if err != nil {
+		// Fall back to the default rate limits rather than failing the request.
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetRateLimitOverride failed")
+		return nil
+	}
+	l.overridesMutex.Lock()
+	l.overrides[userID] = cachedRateLimitOverride{
+		override: override,
+		expires:  time.Now().Add(rateLimitOverrideCacheTime),
+	}
+	l.overridesMutex.Unlock()
+	return override
+}
+
+// forgetRateLimitOverride is called when the user's rate limit override has
+// been changed, so that the new one takes effect straight away.
+func (l *rateLimits) forgetRateLimitOverride(userID string) {
+	l.overridesMutex.Lock()
+	delete(l.overrides, userID)
+	l.overridesMutex.Unlock()
+
+	// The user's channel was made for the old override, so throw it away.
+	l.cleanMutex.Lock()
+	l.limitsMutex.Lock()
+	delete(l.limits, userID)
+	l.limitsMutex.Unlock()
+	l.cleanMutex.Unlock()
 }
 
-func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
+// rateLimit returns an error response if the caller has sent too many
+// requests recently. The device is optional: if it is given and the user has
+// a rate limit override then the user is limited by that instead of by IP.
+func (l *rateLimits) rateLimit(req *http.Request, device *userapi.Device) *util.JSONResponse {
 	// If rate limiting is disabled then do nothing.
 	if !l.enabled {
 		return nil
 	}
 
-	// Take a read lock out on the cleaner mutex. The cleaner expects to
-	// be able to take a write lock, which isn't possible while there are
-	// readers, so this has the effect of blocking the cleaner goroutine
-	// from doing its work until there are no requests in flight.
-	l.cleanMutex.RLock()
-	defer l.cleanMutex.RUnlock()
-
 	// First of all, work out if X-Forwarded-For was sent to us. If not
 	// then we'll just use the IP address of the caller.
 	caller := req.RemoteAddr
 	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
 		caller = forwardedFor
 	}
+	threshold, cooloff := l.requestThreshold, l.cooloffDuration
+
+	// If the user has a rate limit override then they get their own channel,
+	// sized so that they can send burst_count requests at once and then
+	// messages_per_second requests every second after that.
+	if device != nil {
+		if override := l.rateLimitOverride(req.Context(), device.UserID); override != nil {
+			if override.MessagesPerSecond <= 0 || override.BurstCount <= 0 {
+				return nil
+			}
+			caller = device.UserID
+			threshold = override.BurstCount
+			cooloff = time.Duration(override.BurstCount) * time.Second / time.Duration(override.MessagesPerSecond)
+		}
+	}
+
+	// Take a read lock out on the cleaner mutex. The cleaner expects to
+	// be able to take a write lock, which isn't possible while there are
+	// readers, so this has the effect of blocking the cleaner goroutine
+	// from doing its work until there are no requests in flight.
+	l.cleanMutex.RLock()
+	defer l.cleanMutex.RUnlock()
 
 	// Look up the caller's channel, if they have one.
 	l.limitsMutex.RLock()
@@ -80,7 +173,7 @@ func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
 	// If the caller doesn't have a channel, create one and write it
 	// back to the map.
 	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
+		rateLimit = make(chan struct{}, threshold)
 
 		l.limitsMutex.Lock()
 		l.limits[caller] = rateLimit
@@ -95,14 +188,14 @@ func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
 		// We hit the rate limit. Tell the client to back off.
 		return &util.JSONResponse{
 			Code: http.StatusTooManyRequests,
-			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", cooloff.Milliseconds()),
 		}
 	}
 
 	// After the time interval, drain a resource from the rate limiting
 	// channel. This will free up space in the channel for new requests.
 	go func() {
-		<-time.After(l.cooloffDuration)
+		<-time.After(cooloff)
 		<-rateLimit
 	}()
 	return nil
@@ -0,0 +1,81 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+func TestRateLimitOverride(t *testing.T) {
+	passwordHashing := &config.PasswordHashing{}
+	passwordHashing.Defaults()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "example.com", passwordHashing)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(context.Background(), "bot", "", ""); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	cfg := &config.ClientAPI{Matrix: &config.Global{ServerName: "example.com"}}
+	rateLimits := newRateLimits(&config.RateLimiting{
+		Enabled:   true,
+		Threshold: 2,
+		CooloffMS: 60000,
+	}, accountDB)
+	device := &api.Device{UserID: "@bot:example.com"}
+
+	// sends returns how many of the requests got through.
+	sends := func(count int) (allowed int) {
+		for i := 0; i < count; i++ {
+			req := httptest.NewRequest(http.MethodPut, "/rooms/!room:example.com/send/m.room.message/txn", nil)
+			if rateLimits.rateLimit(req, device) == nil {
+				allowed++
+			}
+		}
+		return
+	}
+	admin := func(method, body string) int {
+		req := httptest.NewRequest(method, "/_dendrite/admin/v1/rateLimitOverride/@bot:example.com", strings.NewReader(body))
+		return AdminRateLimitOverride(req, "@bot:example.com", cfg, accountDB, rateLimits).Code
+	}
+
+	if allowed := sends(5); allowed != 2 {
+		t.Fatalf("expected the default threshold of 2 requests, got %d", allowed)
+	}
+
+	if code := admin(http.MethodPut, `{"messages_per_second":1,"burst_count":0}`); code != http.StatusBadRequest {
+		t.Fatalf("expected a burst_count of 0 to be rejected, got %d", code)
+	}
+	if code := admin(http.MethodPut, `{"messages_per_second":1,"burst_count":10}`); code != http.StatusOK {
+		t.Fatalf("failed to set override: %d", code)
+	}
+	if allowed := sends(15); allowed != 10 {
+		t.Fatalf("expected a burst of 10 requests, got %d", allowed)
+	}
+
+	if code := admin(http.MethodPut, `{"messages_per_second":0,"burst_count":0}`); code != http.StatusOK {
+		t.Fatalf("failed to set override: %d", code)
+	}
+	if allowed := sends(50); allowed != 50 {
+		t.Fatalf("expected the user not to be rate limited, got %d requests", allowed)
+	}
+
+	if code := admin(http.MethodDelete, ""); code != http.StatusOK {
+		t.Fatalf("failed to remove override: %d", code)
+	}
+	if override, err := accountDB.GetRateLimitOverride(context.Background(), "bot"); err != nil || override != nil {
+		t.Fatalf("expected the override to be removed, got %+v (%v)", override, err)
+	}
+	// The IP address of the requests has already used up its slots.
+	if allowed := sends(5); allowed != 0 {
+		t.Fatalf("expected the default rate limits to apply again, got %d requests", allowed)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+// readOnlyAllowedPaths are the endpoints which use a method other than GET
+// but don't write anything, so they still work in read-only mode. The admin
+// API, including the endpoint for switching read-only mode off, is never
+// affected by read-only mode.
+var readOnlyAllowedPaths = []string{
+	"/publicRooms",
+	"/keys/query",
+	"/validate/send/{eventType}",
+	"/validate/state/{eventType:[^/]+/?}",
+	"/validate/state/{eventType}/{stateKey}",
+}
+
+// readOnlyMode rejects client API requests which would write to the database
+// while it is enabled, e.g. during database migrations or backups. Endpoints
+// served by other components, such as /sync and /messages, are not affected.
+type readOnlyMode struct {
+	enabled int32 // accessed atomically
+}
+
+func newReadOnlyMode(cfg *config.ClientAPI) *readOnlyMode {
+	m := &readOnlyMode{}
+	m.set(cfg.ReadOnly)
+	return m
+}
+
+func (m *readOnlyMode) isEnabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+func (m *readOnlyMode) set(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&m.enabled, 1)
+	} else {
+		atomic.StoreInt32(&m.enabled, 0)
+	}
+}
+
+// middleware rejects requests to routes using methods other than GET, HEAD
+// or OPTIONS while read-only mode is enabled.
+func (m *readOnlyMode) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !m.isEnabled() || !m.rejects(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		res := util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown("This server is in read-only mode for maintenance, please try again later"),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		util.SetCORSHeaders(w)
+		w.WriteHeader(res.Code)
+		_ = json.NewEncoder(w).Encode(res.JSON)
+	})
+}
+
+func (m *readOnlyMode) rejects(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if route := mux.CurrentRoute(req); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			for _, path := range readOnlyAllowedPaths {
+				if strings.HasSuffix(template, path) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+type readOnlyRequest struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// AdminReadOnly implements GET and PUT /_dendrite/admin/v1/readOnly, which report and
+// change whether the client API is in read-only mode.
+func AdminReadOnly(
+	req *http.Request,
+	readOnly *readOnlyMode,
+) util.JSONResponse {
+	if req.Method == http.MethodPut {
+		var r readOnlyRequest
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		readOnly.set(r.ReadOnly)
+		util.GetLogger(req.Context()).WithField("read_only", r.ReadOnly).Warn("Read-only mode changed by server administrator")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: readOnlyRequest{ReadOnly: readOnly.isEnabled()},
+	}
+}
@@ -21,14 +21,20 @@ import (
 
 	"github.com/matrix-org/gomatrixserverlib"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/eduserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
 )
 
-func SetReceipt(req *http.Request, eduAPI api.EDUServerInputAPI, device *userapi.Device, roomId, receiptType, eventId string) util.JSONResponse {
+// SetReceipt implements POST /rooms/{roomId}/receipt/{receiptType}/{eventId}
+func SetReceipt(
+	req *http.Request, eduAPI api.EDUServerInputAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *userapi.Device, roomId, receiptType, eventId string,
+) util.JSONResponse {
 	timestamp := gomatrixserverlib.AsTimestamp(time.Now())
 	logrus.WithFields(logrus.Fields{
 		"roomId":      roomId,
@@ -40,11 +46,34 @@ func SetReceipt(req *http.Request, eduAPI api.EDUServerInputAPI, device *userapi
 
 	// currently only m.read is accepted
 	if receiptType != "m.read" {
-		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read not '%s'", receiptType))
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("receipt type must be m.read not '%s'", receiptType)),
+		}
+	}
+
+	// Only members of the room can send receipts to it, and only for events
+	// which are actually in the room, otherwise other servers will reject them.
+	if resErr := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomId); resErr != nil {
+		return *resErr
+	}
+	var eventsRes roomserverAPI.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(req.Context(), &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs: []string{eventId},
+	}, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomId {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found in room"),
+		}
 	}
 
 	if err := api.SendReceipt(req.Context(), eduAPI, device.UserID, roomId, eventId, receiptType, timestamp); err != nil {
-		return util.ErrorResponse(err)
+		util.GetLogger(req.Context()).WithError(err).Error("api.SendReceipt failed")
+		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
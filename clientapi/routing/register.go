@@ -32,13 +32,16 @@ import (
 	"sync"
 	"time"
 
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -76,6 +79,13 @@ func init() {
 type sessionsDict struct {
 	sync.Mutex
 	sessions map[string][]authtypes.LoginType
+	// threePIDs stores the 3PIDs that were validated by the email stage of
+	// each session, so that they can be associated with the new account.
+	threePIDs map[string]authtypes.ThreePID
+	// registrationTokens stores the registration tokens that were given in
+	// the registration token stage of each session, which are used up once
+	// the account is created.
+	registrationTokens map[string]string
 }
 
 // GetCompletedStages returns the completed stages for a session.
@@ -92,10 +102,44 @@ func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginTyp
 
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
+		sessions:           make(map[string][]authtypes.LoginType),
+		threePIDs:          make(map[string]authtypes.ThreePID),
+		registrationTokens: make(map[string]string),
 	}
 }
 
+// addSessionThreePID records the 3PID that a session validated.
+func (d *sessionsDict) addSessionThreePID(sessionID string, threePID authtypes.ThreePID) {
+	d.Lock()
+	defer d.Unlock()
+	d.threePIDs[sessionID] = threePID
+}
+
+// addSessionRegistrationToken records the registration token that a session
+// gave.
+func (d *sessionsDict) addSessionRegistrationToken(sessionID, token string) {
+	d.Lock()
+	defer d.Unlock()
+	d.registrationTokens[sessionID] = token
+}
+
+// getSessionRegistrationToken returns the registration token that a session
+// gave, if any.
+func (d *sessionsDict) getSessionRegistrationToken(sessionID string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	token, ok := d.registrationTokens[sessionID]
+	return token, ok
+}
+
+// getSessionThreePID returns the 3PID that a session validated, if any.
+func (d *sessionsDict) getSessionThreePID(sessionID string) (authtypes.ThreePID, bool) {
+	d.Lock()
+	defer d.Unlock()
+	threePID, ok := d.threePIDs[sessionID]
+	return threePID, ok
+}
+
 // AddCompletedSessionStage records that a session has completed an auth stage.
 func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
 	sessions.Lock()
@@ -150,6 +194,12 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+
+	// Email
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
+
+	// Registration token
+	Token string `json:"token"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -319,6 +369,129 @@ func validateRecaptcha(
 	return nil
 }
 
+// validateEmailStage returns an error response if the email address in the
+// given credentials hasn't been validated by the identity server, or if it's
+// already associated with an account. Otherwise the email address is stored
+// against the session so that it can be associated with the new account.
+func validateEmailStage(
+	req *http.Request,
+	creds threepid.Credentials,
+	sessionID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+) *util.JSONResponse {
+	if creds.SID == "" || creds.Secret == "" || creds.IDServer == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("threepid_creds must contain sid, client_secret and id_server"),
+		}
+	}
+
+	verified, address, medium, err := threepid.CheckAssociation(req.Context(), creds, cfg)
+	if err == threepid.ErrNotTrusted {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotTrusted(creds.IDServer),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckAssociation failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if !verified || medium != "email" {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	}
+
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), address, medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if len(localpart) > 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	}
+
+	sessions.addSessionThreePID(sessionID, authtypes.ThreePID{Address: address, Medium: medium})
+	return nil
+}
+
+// validateRegistrationToken returns an error response if the registration
+// token doesn't exist, has expired or has been used up.
+func validateRegistrationToken(
+	req *http.Request,
+	token string,
+	accountDB accounts.Database,
+) *util.JSONResponse {
+	if token == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("A registration token is required"),
+		}
+	}
+	regToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if regToken == nil || !regToken.IsValid(gomatrixserverlib.AsTimestamp(time.Now())) {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("Invalid registration token"),
+		}
+	}
+	return nil
+}
+
+// useRegistrationToken counts the registration against the registration token
+// just before the account is created, so that tokens can't be used more times
+// than they allow by sessions which completed the stage at the same time.
+func useRegistrationToken(
+	req *http.Request,
+	username, token string,
+	accountDB accounts.Database,
+) *util.JSONResponse {
+	// Don't use up the token if the account can't be created anyway.
+	available, err := accountDB.CheckAccountAvailability(req.Context(), username)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CheckAccountAvailability failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if !available {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UserInUse("Desired user ID is already taken."),
+		}
+	}
+	used, err := accountDB.UseRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.UseRegistrationToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if !used {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("Invalid registration token"),
+		}
+	}
+	return nil
+}
+
 // UserIDIsWithinApplicationServiceNamespace checks to see if a given userID
 // falls within any of the namespaces of a given Application Service. If no
 // Application Service is given, it will check to see if it matches any
@@ -461,6 +634,8 @@ func Register(
 	userAPI userapi.UserInternalAPI,
 	accountDB accounts.Database,
 	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
 	var r registerRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -513,7 +688,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accountDB, rsAPI, asAPI)
 }
 
 func handleGuestRegistration(
@@ -579,6 +754,9 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
 	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
@@ -587,7 +765,7 @@ func handleRegistrationFlow(
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
+	// TODO: msisdn auth type.
 	accessToken, accessTokenErr := auth.ExtractAccessToken(req)
 
 	// Appservices are special and are not affected by disabled
@@ -626,6 +804,27 @@ func handleRegistrationFlow(
 		// Add Recaptcha to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
+	case authtypes.LoginTypeEmail:
+		// Check that the email address was validated by the identity server
+		resErr := validateEmailStage(req, r.Auth.ThreePIDCreds, sessionID, cfg, accountDB)
+		if resErr != nil {
+			return *resErr
+		}
+
+		// Add Email to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
+	case authtypes.LoginTypeRegistrationToken:
+		// Check that the token exists and can still be used
+		resErr := validateRegistrationToken(req, r.Auth.Token, accountDB)
+		if resErr != nil {
+			return *resErr
+		}
+		sessions.addSessionRegistrationToken(sessionID, r.Auth.Token)
+
+		// Add RegistrationToken to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
 	case authtypes.LoginTypeSharedSecret:
 		// Check shared secret against config
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Auth.Mac)
@@ -660,7 +859,7 @@ func handleRegistrationFlow(
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, accountDB, rsAPI, asAPI)
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -716,13 +915,30 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
+		if token, ok := sessions.getSessionRegistrationToken(sessionID); ok {
+			if resErr := useRegistrationToken(req, r.Username, token, accountDB); resErr != nil {
+				return *resErr
+			}
+		}
+		res := completeRegistration(
 			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
 			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 		)
+		if res.Code == http.StatusOK {
+			if threePID, ok := sessions.getSessionThreePID(sessionID); ok {
+				if err := accountDB.SaveThreePIDAssociation(req.Context(), threePID.Address, r.Username, threePID.Medium); err != nil {
+					util.GetLogger(req.Context()).WithError(err).Error("Failed to save 3PID association for new account")
+				}
+			}
+			onRegistered(cfg, userutil.MakeUserID(r.Username, cfg.Matrix.ServerName), accountDB, rsAPI, asAPI)
+		}
+		return res
 	}
 
 	// There are still more stages to complete.
@@ -738,7 +954,10 @@ func checkAndCompleteFlow(
 func LegacyRegister(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
 	var r legacyRegisterRequest
 	resErr := parseAndValidateLegacyLogin(req, &r)
@@ -756,6 +975,7 @@ func LegacyRegister(
 		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
 	}
 
+	var res util.JSONResponse
 	switch r.Type {
 	case authtypes.LoginTypeSharedSecret:
 		if cfg.RegistrationSharedSecret == "" {
@@ -772,16 +992,20 @@ func LegacyRegister(
 			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
 		}
 
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
+		res = completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
+		res = completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
 			JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
 		}
 	}
+	if res.Code == http.StatusOK {
+		onRegistered(cfg, userutil.MakeUserID(r.Username, cfg.Matrix.ServerName), accountDB, rsAPI, asAPI)
+	}
+	return res
 }
 
 // parseAndValidateLegacyLogin parses the request into r and checks that the
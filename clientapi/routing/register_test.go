@@ -15,10 +15,13 @@
 package routing
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"testing"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
@@ -208,3 +211,24 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+// Email stages with untrusted identity servers should be rejected before
+// anything is stored against the session.
+func TestEmailStageUntrustedIDServer(t *testing.T) {
+	cfg := &config.ClientAPI{Matrix: &config.Global{TrustedIDServers: []string{"trusted.test"}}}
+	req := httptest.NewRequest(http.MethodPost, "/register", nil)
+	creds := threepid.Credentials{SID: "sid", Secret: "secret", IDServer: "untrusted.test"}
+
+	res := validateEmailStage(req, creds, "emailSession", cfg, nil)
+	if res == nil || res.Code != http.StatusBadRequest {
+		t.Fatalf("wanted 400 response, got %+v", res)
+	}
+	if _, ok := sessions.getSessionThreePID("emailSession"); ok {
+		t.Errorf("wanted no 3PID to be stored against the session")
+	}
+
+	creds.SID = ""
+	if res = validateEmailStage(req, creds, "emailSession", cfg, nil); res == nil || res.Code != http.StatusBadRequest {
+		t.Errorf("wanted 400 response for missing sid, got %+v", res)
+	}
+}
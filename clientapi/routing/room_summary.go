@@ -0,0 +1,297 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The maximum number of servers that we will ask, and the maximum number of
+// pages of each server's public room directory that we will walk, when
+// looking for a room summary over federation.
+const (
+	roomSummaryMaxRemoteServers = 3
+	roomSummaryMaxRemotePages   = 5
+)
+
+// roomSummaryResponse is the response body for the MSC3266 room summary.
+type roomSummaryResponse struct {
+	RoomID           string `json:"room_id"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	AvatarURL        string `json:"avatar_url,omitempty"`
+	NumJoinedMembers int    `json:"num_joined_members"`
+	JoinRule         string `json:"join_rule,omitempty"`
+	RoomType         string `json:"room_type,omitempty"`
+	WorldReadable    bool   `json:"world_readable"`
+	GuestCanJoin     bool   `json:"guest_can_join"`
+	Membership       string `json:"membership,omitempty"`
+}
+
+// GetRoomSummary implements GET /rooms/{roomIDOrAlias}/summary as per
+// MSC3266. It returns enough information about a room for a client to
+// render a preview of it before the user has joined. If we aren't in the
+// room ourselves then we'll try to find the room in the public room
+// directories of the servers that we would otherwise try to join through,
+// falling back to the server that created the room. There is no federation
+// API for the summary of an arbitrary room, so a room that we aren't in can
+// only be previewed if it is published in one of those directories.
+func GetRoomSummary(
+	req *http.Request, device *userapi.Device,
+	roomIDOrAlias string,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	ctx := req.Context()
+	var serverNames []gomatrixserverlib.ServerName
+	for _, serverName := range req.URL.Query()["server_name"] {
+		serverNames = append(serverNames, gomatrixserverlib.ServerName(serverName))
+	}
+
+	roomID, viaServers, resErr := resolveRoomIDOrAlias(ctx, roomIDOrAlias, cfg, rsAPI, federation)
+	if resErr != nil {
+		return *resErr
+	}
+	serverNames = append(serverNames, viaServers...)
+
+	var joinedRes roomserverAPI.QueryServerJoinedToRoomResponse
+	err := rsAPI.QueryServerJoinedToRoom(ctx, &roomserverAPI.QueryServerJoinedToRoomRequest{
+		RoomID:     roomID,
+		ServerName: cfg.Matrix.ServerName,
+	}, &joinedRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var summary *roomSummaryResponse
+	if joinedRes.RoomExists && joinedRes.IsInRoom {
+		summary, err = localRoomSummary(ctx, device, roomID, rsAPI)
+	} else {
+		summary = remoteRoomSummary(ctx, roomID, serverNames, cfg, federation)
+	}
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to build room summary")
+		return jsonerror.InternalServerError()
+	}
+	if summary == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found or is not previewable"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: summary,
+	}
+}
+
+// resolveRoomIDOrAlias returns the room ID for the given room ID or alias,
+// along with any servers that were suggested by the alias directory.
+func resolveRoomIDOrAlias(
+	ctx context.Context, roomIDOrAlias string,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	federation *gomatrixserverlib.FederationClient,
+) (string, []gomatrixserverlib.ServerName, *util.JSONResponse) {
+	if strings.HasPrefix(roomIDOrAlias, "!") {
+		return roomIDOrAlias, nil, nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias)
+	if err != nil {
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Expected a room ID or a room alias"),
+		}
+	}
+	queryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomIDOrAlias}
+	var queryRes roomserverAPI.GetRoomIDForAliasResponse
+	if err = rsAPI.GetRoomIDForAlias(ctx, &queryReq, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+		resErr := jsonerror.InternalServerError()
+		return "", nil, &resErr
+	}
+	if queryRes.RoomID != "" {
+		return queryRes.RoomID, nil, nil
+	}
+	if domain != cfg.Matrix.ServerName {
+		fedRes, fedErr := federation.LookupRoomAlias(ctx, domain, roomIDOrAlias)
+		if fedErr == nil && fedRes.RoomID != "" {
+			return fedRes.RoomID, fedRes.Servers, nil
+		}
+		util.GetLogger(ctx).WithError(fedErr).Warn("federation.LookupRoomAlias failed")
+	}
+	return "", nil, &util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound(fmt.Sprintf("Room alias %s not found", roomIDOrAlias)),
+	}
+}
+
+// localRoomSummary builds a room summary from our own copy of the room
+// state. It returns nil if the user isn't allowed to preview the room.
+func localRoomSummary(
+	ctx context.Context, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) (*roomSummaryResponse, error) {
+	pubRooms, err := roomserverAPI.PopulatePublicRooms(ctx, []string{roomID}, rsAPI)
+	if err != nil {
+		return nil, fmt.Errorf("roomserverAPI.PopulatePublicRooms: %w", err)
+	}
+	if len(pubRooms) != 1 || pubRooms[0].RoomID != roomID {
+		return nil, nil
+	}
+	pub := pubRooms[0]
+	summary := &roomSummaryResponse{
+		RoomID:           roomID,
+		CanonicalAlias:   pub.CanonicalAlias,
+		Name:             pub.Name,
+		Topic:            pub.Topic,
+		AvatarURL:        pub.AvatarURL,
+		NumJoinedMembers: pub.JoinedMembersCount,
+		WorldReadable:    pub.WorldReadable,
+		GuestCanJoin:     pub.GuestCanJoin,
+	}
+
+	joinRuleTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
+	memberTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: device.UserID}
+	var stateRes roomserverAPI.QueryCurrentStateResponse
+	if err = rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{joinRuleTuple, createTuple, memberTuple},
+	}, &stateRes); err != nil {
+		return nil, fmt.Errorf("rsAPI.QueryCurrentState: %w", err)
+	}
+	if ev, ok := stateRes.StateEvents[joinRuleTuple]; ok {
+		var content gomatrixserverlib.JoinRuleContent
+		if err = json.Unmarshal(ev.Content(), &content); err == nil {
+			summary.JoinRule = content.JoinRule
+		}
+	}
+	if ev, ok := stateRes.StateEvents[createTuple]; ok {
+		var content struct {
+			Type string `json:"type"`
+		}
+		if err = json.Unmarshal(ev.Content(), &content); err == nil {
+			summary.RoomType = content.Type
+		}
+	}
+	if ev, ok := stateRes.StateEvents[memberTuple]; ok {
+		summary.Membership, _ = ev.Membership()
+	}
+
+	// Only allow the room to be previewed if it is public or world
+	// readable, or if the user has some business being in the room.
+	switch {
+	case summary.JoinRule == gomatrixserverlib.Public:
+	case summary.WorldReadable:
+	case summary.Membership == gomatrixserverlib.Join:
+	case summary.Membership == gomatrixserverlib.Invite:
+	default:
+		return nil, nil
+	}
+	return summary, nil
+}
+
+// remoteRoomSummary tries to find the room in the public room directory of
+// each of the servers from roomSummaryServers in turn. Only public rooms can
+// be previewed in this way, but those are the rooms that clients are most
+// likely to want to preview anyway. It returns nil if the room wasn't found.
+func remoteRoomSummary(
+	ctx context.Context, roomID string,
+	serverNames []gomatrixserverlib.ServerName,
+	cfg *config.ClientAPI,
+	federation *gomatrixserverlib.FederationClient,
+) *roomSummaryResponse {
+	for _, serverName := range roomSummaryServers(roomID, serverNames, cfg) {
+		since := ""
+		for page := 0; page < roomSummaryMaxRemotePages; page++ {
+			key := remotePublicRoomsKey{serverName, since, 100}
+			res, err := getRemotePublicRooms(key, func() (gomatrixserverlib.RespPublicRooms, error) {
+				return federation.GetPublicRooms(ctx, key.server, int(key.limit), key.since, false, "")
+			})
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Warn("federation.GetPublicRooms failed")
+				break
+			}
+			for _, pub := range res.Chunk {
+				if pub.RoomID != roomID {
+					continue
+				}
+				return &roomSummaryResponse{
+					RoomID:           roomID,
+					CanonicalAlias:   pub.CanonicalAlias,
+					Name:             pub.Name,
+					Topic:            pub.Topic,
+					AvatarURL:        pub.AvatarURL,
+					NumJoinedMembers: pub.JoinedMembersCount,
+					JoinRule:         gomatrixserverlib.Public,
+					WorldReadable:    pub.WorldReadable,
+					GuestCanJoin:     pub.GuestCanJoin,
+				}
+			}
+			if res.NextBatch == "" {
+				break
+			}
+			since = res.NextBatch
+		}
+	}
+	return nil
+}
+
+// roomSummaryServers returns the remote servers to look for the room on, in
+// the order given, up to roomSummaryMaxRemoteServers of them. The server in
+// the room ID is always included last if it isn't already, as it is the one
+// most likely to have published the room.
+func roomSummaryServers(
+	roomID string, serverNames []gomatrixserverlib.ServerName, cfg *config.ClientAPI,
+) []gomatrixserverlib.ServerName {
+	var roomServer gomatrixserverlib.ServerName
+	if _, domain, err := gomatrixserverlib.SplitID('!', roomID); err == nil && !cfg.Matrix.IsLocalServerName(domain) {
+		roomServer = domain
+	}
+	var servers []gomatrixserverlib.ServerName
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	for _, serverName := range serverNames {
+		if len(servers) == roomSummaryMaxRemoteServers {
+			break
+		}
+		if serverName == "" || cfg.Matrix.IsLocalServerName(serverName) || seen[serverName] {
+			continue
+		}
+		seen[serverName] = true
+		servers = append(servers, serverName)
+	}
+	if roomServer != "" && !seen[roomServer] {
+		if len(servers) == roomSummaryMaxRemoteServers {
+			servers = servers[:roomSummaryMaxRemoteServers-1]
+		}
+		servers = append(servers, roomServer)
+	}
+	return servers
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// summaryRoomserverAPI pretends that we are joined to the public room
+// !local:local and to no other rooms.
+type summaryRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+}
+
+func (s *summaryRoomserverAPI) QueryServerJoinedToRoom(
+	ctx context.Context, req *roomserverAPI.QueryServerJoinedToRoomRequest, res *roomserverAPI.QueryServerJoinedToRoomResponse,
+) error {
+	res.RoomExists = req.RoomID == "!local:local"
+	res.IsInRoom = res.RoomExists
+	return nil
+}
+
+func (s *summaryRoomserverAPI) QueryBulkStateContent(
+	ctx context.Context, req *roomserverAPI.QueryBulkStateContentRequest, res *roomserverAPI.QueryBulkStateContentResponse,
+) error {
+	res.Rooms = map[string]map[gomatrixserverlib.StateKeyTuple]string{
+		"!local:local": {
+			{EventType: "m.room.name", StateKey: ""}:                           "Local room",
+			{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}:        gomatrixserverlib.Public,
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: "@bob:local"}: gomatrixserverlib.Join,
+		},
+	}
+	return nil
+}
+
+func (s *summaryRoomserverAPI) QueryCurrentState(
+	ctx context.Context, req *roomserverAPI.QueryCurrentStateRequest, res *roomserverAPI.QueryCurrentStateResponse,
+) error {
+	joinRules, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id": "$joinrules:local", "room_id": "!local:local", "sender": "@bob:local",
+		"type": "m.room.join_rules", "state_key": "", "content": {"join_rule": "public"}
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		return err
+	}
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{
+		{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}: joinRules.Headered(gomatrixserverlib.RoomVersionV1),
+	}
+	return nil
+}
+
+// directoryTripper pretends to be the remote servers. Only the server
+// "origin" publishes anything, which is the room !remote:origin.
+type directoryTripper struct {
+	servers []string
+}
+
+func (d *directoryTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.servers = append(d.servers, req.URL.Host)
+	code, body := http.StatusServiceUnavailable, `{"errcode":"M_UNKNOWN"}`
+	if req.URL.Host == "origin" && strings.HasSuffix(req.URL.Path, "/publicRooms") {
+		code, body = http.StatusOK, `{"chunk":[{"room_id":"!remote:origin","name":"Remote room","num_joined_members":2}]}`
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestGetRoomSummary(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "local"},
+	}
+	device := &userapi.Device{UserID: "@alice:local"}
+
+	tests := []struct {
+		name        string
+		roomID      string
+		query       string
+		wantCode    int
+		wantName    string
+		wantServers []string
+	}{
+		{
+			name:     "local room",
+			roomID:   "!local:local",
+			wantCode: http.StatusOK,
+			wantName: "Local room",
+		},
+		{
+			// Only the first two servers are asked before falling back to the
+			// room's own server.
+			name:        "remote room",
+			roomID:      "!remote:origin",
+			query:       "?server_name=a&server_name=local&server_name=b&server_name=a&server_name=c",
+			wantCode:    http.StatusOK,
+			wantName:    "Remote room",
+			wantServers: []string{"a", "b", "origin"},
+		},
+		{
+			name:        "room not found",
+			roomID:      "!unknown:elsewhere",
+			query:       "?server_name=origin",
+			wantCode:    http.StatusNotFound,
+			wantServers: []string{"origin", "elsewhere"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remotePublicRoomsCache = make(map[remotePublicRoomsKey]remotePublicRooms)
+			tripper := &directoryTripper{}
+			transport := &http.Transport{}
+			transport.RegisterProtocol("matrix", tripper)
+			federation := gomatrixserverlib.NewFederationClientWithTransport("local", "ed25519:test", key, true, transport)
+
+			req := httptest.NewRequest(http.MethodGet, "/rooms/"+tt.roomID+"/summary"+tt.query, nil)
+			res := GetRoomSummary(req, device, tt.roomID, cfg, &summaryRoomserverAPI{}, federation)
+			if res.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %+v", res.Code, tt.wantCode, res.JSON)
+			}
+			if tt.wantCode == http.StatusOK {
+				data, jerr := json.Marshal(res.JSON)
+				if jerr != nil {
+					t.Fatalf("failed to marshal response: %s", jerr)
+				}
+				var summary roomSummaryResponse
+				if jerr = json.Unmarshal(data, &summary); jerr != nil {
+					t.Fatalf("failed to unmarshal response: %s", jerr)
+				}
+				if summary.RoomID != tt.roomID || summary.Name != tt.wantName || summary.JoinRule != gomatrixserverlib.Public {
+					t.Errorf("unexpected summary %+v", summary)
+				}
+			}
+			if strings.Join(tripper.servers, ",") != strings.Join(tt.wantServers, ",") {
+				t.Errorf("asked servers %v, want %v", tripper.servers, tt.wantServers)
+			}
+		})
+	}
+}
@@ -93,12 +93,13 @@ func PutTag(
 	}
 	tagContent.Tags[tag] = properties
 
-	if err = saveTagData(req, userID, roomID, userAPI, tagContent); err != nil {
+	tagData, err := saveTagData(req, userID, roomID, userAPI, tagContent)
+	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if err = syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+	if err = syncProducer.SendData(userID, roomID, "m.tag", tagData); err != nil {
 		logrus.WithError(err).Error("Failed to send m.tag account data update to syncapi")
 	}
 
@@ -145,13 +146,14 @@ func DeleteTag(
 		}
 	}
 
-	if err = saveTagData(req, userID, roomID, userAPI, tagContent); err != nil {
+	tagData, err := saveTagData(req, userID, roomID, userAPI, tagContent)
+	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
 
 	// TODO: user API should do this since it's account data
-	if err := syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+	if err := syncProducer.SendData(userID, roomID, "m.tag", tagData); err != nil {
 		logrus.WithError(err).Error("Failed to send m.tag account data update to syncapi")
 	}
 
@@ -189,17 +191,18 @@ func obtainSavedTags(
 	return tags, nil
 }
 
-// saveTagData saves the provided tag data into the database
+// saveTagData saves the provided tag data into the database and returns it
+// as it was saved
 func saveTagData(
 	req *http.Request,
 	userID string,
 	roomID string,
 	userAPI api.UserInternalAPI,
 	Tag gomatrix.TagContent,
-) error {
+) (json.RawMessage, error) {
 	newTagData, err := json.Marshal(Tag)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dataReq := api.InputAccountDataRequest{
 		UserID:      userID,
@@ -208,5 +211,5 @@ func saveTagData(
 		AccountData: json.RawMessage(newTagData),
 	}
 	dataRes := api.InputAccountDataResponse{}
-	return userAPI.InputAccountData(req.Context(), &dataReq, &dataRes)
+	return newTagData, userAPI.InputAccountData(req.Context(), &dataReq, &dataRes)
 }
@@ -15,7 +15,6 @@
 package routing
 
 import (
-	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -23,7 +22,6 @@ import (
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/auth"
-	clientutil "github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
@@ -46,7 +44,7 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router, cfg *config.ClientAPI,
+	publicAPIMux, dendriteAdminMux *mux.Router, cfg *config.ClientAPI,
 	eduAPI eduServerAPI.EDUServerInputAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
@@ -59,7 +57,9 @@ func Setup(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 ) {
-	rateLimits := newRateLimits(&cfg.RateLimiting)
+	rateLimits := newRateLimits(&cfg.RateLimiting, accountDB)
+	readOnly := newReadOnlyMode(cfg)
+	ssoLogin := newSSOLogin(&cfg.SSO)
 	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg)
 
 	publicAPIMux.Handle("/versions",
@@ -84,15 +84,240 @@ func Setup(
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/api/v1").Subrouter()
 	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
+	r0mux.Use(readOnly.middleware)
+	v1mux.Use(readOnly.middleware)
+	unstableMux.Use(readOnly.middleware)
+
+	// Server administration endpoints. These aren't affected by read-only
+	// mode, so that it can always be switched off again.
+	adminMux := dendriteAdminMux.PathPrefix("/v1").Subrouter()
+
+	adminMux.Handle("/purgeRoom/{roomID}",
+		httputil.MakeAdminAPI("admin_purge_room", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminPurgeRoom(req, vars["roomID"], cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/readOnly",
+		httputil.MakeAdminAPI("admin_read_only", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminReadOnly(req, readOnly)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	adminMux.Handle("/suspend/{userID}",
+		httputil.MakeAdminAPI("admin_suspend", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminSuspendUser(req, vars["userID"], cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	adminMux.Handle("/permissions/{userID}",
+		httputil.MakeAdminAPI("admin_permissions", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminAccountPermissions(req, vars["userID"], cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	adminMux.Handle("/users",
+		httputil.MakeAdminAPI("admin_users", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminUsers(req, accountDB)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/users/{userID}",
+		httputil.MakeAdminAPI("admin_user", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminUser(req, vars["userID"], cfg, accountDB, userAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/resetPassword/{userID}",
+		httputil.MakeAdminAPI("admin_reset_password", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResetPassword(req, vars["userID"], cfg, accountDB, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/deactivate/{userID}",
+		httputil.MakeAdminAPI("admin_deactivate", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminDeactivateUser(req, vars["userID"], cfg, accountDB, userAPI, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/serverAdmin/{userID}",
+		httputil.MakeAdminAPI("admin_server_admin", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminServerAdmin(req, vars["userID"], cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	adminMux.Handle("/rateLimitOverride/{userID}",
+		httputil.MakeAdminAPI("admin_rate_limit_override", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRateLimitOverride(req, vars["userID"], cfg, accountDB, rateLimits)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	adminMux.Handle("/registrationTokens",
+		httputil.MakeAdminAPI("admin_registration_tokens", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminRegistrationTokens(req, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/registrationTokens/{token}",
+		httputil.MakeAdminAPI("admin_registration_token", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRegistrationToken(req, vars["token"], accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	adminMux.Handle("/rooms",
+		httputil.MakeAdminAPI("admin_rooms", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/rooms/{roomID}",
+		httputil.MakeAdminAPI("admin_room", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRoom(req, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/removeLocalUsers/{roomID}",
+		httputil.MakeAdminAPI("admin_remove_local_users", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRemoveLocalUsers(req, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/blockRoom/{roomID}",
+		httputil.MakeAdminAPI("admin_block_room", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminBlockRoom(req, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	adminMux.Handle("/roomUsage",
+		httputil.MakeAdminAPI("admin_room_usage", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminRoomUsage(req, "", rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/roomUsage/{roomID}",
+		httputil.MakeAdminAPI("admin_room_usage", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRoomUsage(req, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/roomThroughput",
+		httputil.MakeAdminAPI("admin_room_throughput", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminRoomThroughput(req, rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/federationPeers",
+		httputil.MakeAdminAPI("admin_federation_peers", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminFederationPeers(req, "", federationSender)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/federationPeers/{serverName}",
+		httputil.MakeAdminAPI("admin_federation_peers", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminFederationPeers(req, gomatrixserverlib.ServerName(vars["serverName"]), federationSender)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/eventsBySender/{userID}",
+		httputil.MakeAdminAPI("admin_events_by_sender", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminEventsBySender(req, vars["userID"], rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/roomDAG/{roomID}",
+		httputil.MakeAdminRawAPI("admin_room_dag", cfg.Matrix, userAPI, func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				res := util.ErrorResponse(err)
+				return &res
+			}
+			return AdminRoomDAG(w, req, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodGet)
+
+	adminMux.Handle("/dryRunEvent",
+		httputil.MakeAdminAPI("admin_dry_run_event", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminDryRunEvent(req, rsAPI)
+		}),
+	).Methods(http.MethodPost)
 
 	r0mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := checkAccountPermission(req.Context(), accountDB, device, canCreateRooms, "You are not allowed to create rooms"); r != nil {
+				return *r
+			}
 			return CreateRoom(req, device, cfg, accountDB, rsAPI, asAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -106,7 +331,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/peek/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Peek, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -118,6 +343,50 @@ func Setup(
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/im.nheko.summary/rooms/{roomIDOrAlias}/summary",
+		httputil.MakeAuthAPI("room_summary", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRoomSummary(
+				req, device, vars["roomIDOrAlias"], cfg, rsAPI, federation,
+			)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.dendrite/rooms/{roomID}/validate/send/{eventType}",
+		httputil.MakeAuthAPI("validate_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ValidateEvent(req, device, vars["roomID"], vars["eventType"], nil, cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.dendrite/rooms/{roomID}/validate/state/{eventType:[^/]+/?}",
+		httputil.MakeAuthAPI("validate_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			emptyString := ""
+			eventType := strings.TrimSuffix(vars["eventType"], "/")
+			return ValidateEvent(req, device, vars["roomID"], eventType, &emptyString, cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.dendrite/rooms/{roomID}/validate/state/{eventType}/{stateKey}",
+		httputil.MakeAuthAPI("validate_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			stateKey := vars["stateKey"]
+			return ValidateEvent(req, device, vars["roomID"], vars["eventType"], &stateKey, cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, rsAPI)
@@ -125,7 +394,10 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/join",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -139,7 +411,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/leave",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -164,6 +436,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/ban",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -173,7 +448,13 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := checkAccountPermission(req.Context(), accountDB, device, canInvite, "You are not allowed to invite users"); r != nil {
+				return *r
+			}
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -185,6 +466,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/kick",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -194,6 +478,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/unban",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -203,6 +490,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -212,6 +502,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -264,6 +557,9 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -280,6 +576,9 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -290,21 +589,21 @@ func Setup(
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil); r != nil {
 			return *r
 		}
-		return Register(req, userAPI, accountDB, cfg)
+		return Register(req, userAPI, accountDB, cfg, rsAPI, asAPI)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v1mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil); r != nil {
 			return *r
 		}
-		return LegacyRegister(req, userAPI, cfg)
+		return LegacyRegister(req, userAPI, accountDB, cfg, rsAPI, asAPI)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil); r != nil {
 			return *r
 		}
 		return RegisterAvailable(req, cfg, accountDB)
@@ -378,7 +677,7 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
 		httputil.MakeAuthAPI("rooms_typing", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -434,7 +733,7 @@ func Setup(
 
 	r0mux.Handle("/account/whoami",
 		httputil.MakeAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return Whoami(req, device)
@@ -443,7 +742,7 @@ func Setup(
 
 	r0mux.Handle("/account/password",
 		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return Password(req, userAPI, accountDB, device, cfg)
@@ -452,7 +751,7 @@ func Setup(
 
 	r0mux.Handle("/account/deactivate",
 		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return Deactivate(req, userInteractiveAuth, userAPI, device)
@@ -463,13 +762,41 @@ func Setup(
 
 	r0mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, nil); r != nil {
 				return *r
 			}
-			return Login(req, accountDB, userAPI, cfg)
+			return Login(req, accountDB, userAPI, cfg, ssoLogin)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/login/sso/redirect",
+		httputil.MakeHTMLAPI("login_sso_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return SSORedirect(w, req, "", ssoLogin)
+		}),
+	).Methods(http.MethodGet)
+
+	r0mux.Handle("/login/sso/redirect/{idpID}",
+		httputil.MakeHTMLAPI("login_sso_redirect_idp", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(err.Error()),
+				}
+			}
+			return SSORedirect(w, req, vars["idpID"], ssoLogin)
+		}),
+	).Methods(http.MethodGet)
+
+	r0mux.Handle("/login/sso/callback",
+		httputil.MakeHTMLAPI("login_sso_callback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil); r != nil {
+				return r
+			}
+			return SSOCallback(w, req, ssoLogin, cfg, accountDB, userAPI, rsAPI, asAPI)
+		}),
+	).Methods(http.MethodGet)
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
@@ -478,24 +805,81 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/pushrules/",
-		httputil.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+		httputil.MakeAuthAPI("get_push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAllPushRules(req, userAPI, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/",
+		httputil.MakeAuthAPI("get_push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByScope(req, userAPI, device, vars["scope"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/",
+		httputil.MakeAuthAPI("get_push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByKind(req, userAPI, device, vars["scope"], vars["kind"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("get_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleByRuleID(req, userAPI, device, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("put_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleByRuleID(req, userAPI, syncProducer, device, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("delete_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByRuleID(req, userAPI, syncProducer, device, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("get_push_rule_attr", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return GetPushRuleAttrByRuleID(req, userAPI, device, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("put_push_rule_attr", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttrByRuleID(req, userAPI, syncProducer, device, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
 	// Riot user settings
 
 	r0mux.Handle("/profile/{userID}",
@@ -520,7 +904,10 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/avatar_url",
 		httputil.MakeAuthAPI("profile_avatar_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -545,7 +932,10 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/displayname",
 		httputil.MakeAuthAPI("profile_displayname", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -570,9 +960,17 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/account/3pid/delete",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Forget3PID(req, accountDB, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// This was served under /unstable before it was added to r0, so keep it
+	// there for clients which still use it.
 	unstableMux.Handle("/account/3pid/delete",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Forget3PID(req, accountDB)
+			return Forget3PID(req, accountDB, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -585,7 +983,7 @@ func Setup(
 	// Riot logs get flooded unless this is handled
 	r0mux.Handle("/presence/{userID}/status",
 		httputil.MakeExternalAPI("presence", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, nil); r != nil {
 				return *r
 			}
 			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
@@ -598,7 +996,7 @@ func Setup(
 
 	r0mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return RequestTurnServer(req, device, cfg)
@@ -675,31 +1073,6 @@ func Setup(
 		}),
 	).Methods(http.MethodGet)
 
-	r0mux.Handle("/user_directory/search",
-		httputil.MakeAuthAPI("userdirectory_search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
-				return *r
-			}
-			postContent := struct {
-				SearchString string `json:"search_term"`
-				Limit        int    `json:"limit"`
-			}{}
-
-			if resErr := clientutil.UnmarshalJSONRequest(req, &postContent); resErr != nil {
-				return *resErr
-			}
-			return *SearchUserDirectory(
-				req.Context(),
-				device,
-				userAPI,
-				rsAPI,
-				cfg.Matrix.ServerName,
-				postContent.SearchString,
-				postContent.Limit,
-			)
-		}),
-	).Methods(http.MethodPost, http.MethodOptions)
-
 	r0mux.Handle("/rooms/{roomID}/members",
 		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -722,7 +1095,7 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/read_markers",
 		httputil.MakeAuthAPI("rooms_read_markers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -733,9 +1106,25 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/rooms/{roomID}/upgrade",
+		httputil.MakeAuthAPI("rooms_upgrade", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkNotSuspended(req.Context(), accountDB, device); r != nil {
+				return *r
+			}
+			if r := rateLimits.rateLimit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UpgradeRoom(req, device, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/rooms/{roomID}/forget",
 		httputil.MakeAuthAPI("rooms_forget", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -839,7 +1228,7 @@ func Setup(
 
 	r0mux.Handle("/capabilities",
 		httputil.MakeAuthAPI("capabilities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return GetCapabilities(req, rsAPI)
@@ -859,7 +1248,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/query",
 		httputil.MakeAuthAPI("keys_query", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return QueryKeys(req, keyAPI)
+			return QueryKeys(req, keyAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/claim",
@@ -867,9 +1256,85 @@ func Setup(
 			return ClaimKeys(req, keyAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/device_signing/upload",
+		httputil.MakeAuthAPI("keys_device_signing_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningDeviceKeys(req, userInteractiveAuth, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/keys/signatures/upload",
+		httputil.MakeAuthAPI("keys_signatures_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningDeviceSignatures(req, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/pushers",
+		httputil.MakeAuthAPI("get_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetPushers(req, accountDB, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/pushers/set",
+		httputil.MakeAuthAPI("set_pusher", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SetPusher(req, accountDB, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// Room key backup
+	r0mux.Handle("/room_keys/version",
+		httputil.MakeAuthAPI("create_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return CreateKeyBackupVersion(req, accountDB, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/room_keys/version",
+		httputil.MakeAuthAPI("get_latest_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return KeyBackupVersion(req, accountDB, device, "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("get_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KeyBackupVersion(req, accountDB, device, vars["version"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("modify_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ModifyKeyBackupVersionAuthData(req, accountDB, device, vars["version"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("delete_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteKeyBackupVersion(req, accountDB, device, vars["version"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+	for _, path := range []string{
+		"/room_keys/keys",
+		"/room_keys/keys/{roomID}",
+		"/room_keys/keys/{roomID}/{sessionID}",
+	} {
+		r0mux.Handle(path,
+			httputil.MakeAuthAPI("room_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return RoomKeys(req, accountDB, device, vars["roomID"], vars["sessionID"])
+			}),
+		).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+	}
 	r0mux.Handle("/rooms/{roomId}/receipt/{receiptType}/{eventId}",
-		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+		httputil.MakeAuthAPI("set_receipt", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -877,7 +1342,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 
-			return SetReceipt(req, eduAPI, device, vars["roomId"], vars["receiptType"], vars["eventId"])
+			return SetReceipt(req, eduAPI, rsAPI, device, vars["roomId"], vars["receiptType"], vars["eventId"])
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 }
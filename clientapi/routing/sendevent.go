@@ -15,7 +15,9 @@
 package routing
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -114,7 +116,7 @@ func SendEvent(
 	// pass the new event to the roomserver and receive the correct event ID
 	// event ID in case of duplicate transaction is discarded
 	startedSubmittingEvent := time.Now()
-	if err := api.SendEvents(
+	if err := api.SendEventsUnlessBusy(
 		req.Context(), rsAPI,
 		api.KindNew,
 		[]*gomatrixserverlib.HeaderedEvent{
@@ -123,6 +125,17 @@ func SendEvent(
 		cfg.Matrix.ServerName,
 		txnAndSessionID,
 	); err != nil {
+		if res := roomserverBusyResponse(err); res != nil {
+			return *res
+		}
+		var notAllowed *gomatrixserverlib.NotAllowed
+		if errors.As(err, &notAllowed) {
+			// This happens if the message was rejected by content scanning.
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(notAllowed.Message),
+			}
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -150,6 +163,26 @@ func SendEvent(
 	return res
 }
 
+// roomserverBusyResponse returns a 429 response asking the client to retry
+// later if err is because the roomserver had too many events waiting to be
+// processed, or nil otherwise.
+func roomserverBusyResponse(err error) *util.JSONResponse {
+	var busy *api.ErrRoomserverBusy
+	if !errors.As(err, &busy) {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		Headers: map[string]string{
+			"Retry-After": strconv.Itoa(int((busy.RetryAfter + time.Second - 1) / time.Second)),
+		},
+		JSON: jsonerror.ResourceLimitExceeded(
+			"The server is busy processing other events, please try again later",
+			busy.RetryAfter.Milliseconds(),
+		),
+	}
+}
+
 func generateSendEvent(
 	req *http.Request,
 	device *userapi.Device,
@@ -157,17 +190,43 @@ func generateSendEvent(
 	cfg *config.ClientAPI,
 	rsAPI api.RoomserverInternalAPI,
 ) (*gomatrixserverlib.Event, *util.JSONResponse) {
+	e, stateEvents, resErr := buildSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI)
+	if resErr != nil {
+		return nil, resErr
+	}
+
+	// check to see if this user can perform this operation
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err := gomatrixserverlib.Allowed(e, &provider); err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()), // TODO: Is this error string comprehensible to the client?
+		}
+	}
+	return e, nil
+}
+
+// buildSendEvent builds the event in the request body on top of the latest
+// events in the room, returning it along with the current state of the room
+// that it needs to be authorised against.
+func buildSendEvent(
+	req *http.Request,
+	device *userapi.Device,
+	roomID, eventType string, stateKey *string,
+	cfg *config.ClientAPI,
+	rsAPI api.RoomserverInternalAPI,
+) (*gomatrixserverlib.Event, []*gomatrixserverlib.Event, *util.JSONResponse) {
 	// parse the incoming http request
 	userID := device.UserID
 	var r map[string]interface{} // must be a JSON object
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
-		return nil, resErr
+		return nil, nil, resErr
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
-		return nil, &util.JSONResponse{
+		return nil, nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.InvalidArgumentValue(err.Error()),
 		}
@@ -184,49 +243,41 @@ func generateSendEvent(
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
 		resErr := jsonerror.InternalServerError()
-		return nil, &resErr
+		return nil, nil, &resErr
 	}
 
 	var queryRes api.QueryLatestEventsAndStateResponse
 	e, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, evTime, rsAPI, &queryRes)
 	if err == eventutil.ErrRoomNoExists {
-		return nil, &util.JSONResponse{
+		return nil, nil, &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Room does not exist"),
 		}
 	} else if e, ok := err.(gomatrixserverlib.BadJSONError); ok {
-		return nil, &util.JSONResponse{
+		return nil, nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON(e.Error()),
 		}
 	} else if e, ok := err.(gomatrixserverlib.EventValidationError); ok {
 		if e.Code == gomatrixserverlib.EventValidationTooLarge {
-			return nil, &util.JSONResponse{
+			return nil, nil, &util.JSONResponse{
 				Code: http.StatusRequestEntityTooLarge,
 				JSON: jsonerror.BadJSON(e.Error()),
 			}
 		}
-		return nil, &util.JSONResponse{
+		return nil, nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON(e.Error()),
 		}
 	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("eventutil.BuildEvent failed")
 		resErr := jsonerror.InternalServerError()
-		return nil, &resErr
+		return nil, nil, &resErr
 	}
 
-	// check to see if this user can perform this operation
 	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
 	for i := range queryRes.StateEvents {
 		stateEvents[i] = queryRes.StateEvents[i].Event
 	}
-	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
-	if err = gomatrixserverlib.Allowed(e.Event, &provider); err != nil {
-		return nil, &util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden(err.Error()), // TODO: Is this error string comprehensible to the client?
-		}
-	}
-	return e.Event, nil
+	return e.Event, stateEvents, nil
 }
@@ -0,0 +1,388 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// ssoCallbackPath is where identity providers send people back to once
+	// they've logged in, relative to client_api.sso.public_base_url.
+	ssoCallbackPath = "/_matrix/client/r0/login/sso/callback"
+	// ssoStateCookie ties logins to the browser that started them, so that
+	// people can't be tricked into finishing someone else's login.
+	ssoStateCookie     = "dendrite_sso_state"
+	ssoStateCookiePath = "/_matrix/client/r0/login/sso"
+	// ssoStateLifetime is how long people have to log in at the identity
+	// provider.
+	ssoStateLifetime = 10 * time.Minute
+	// ssoMaxLocalpartAttempts is how many localparts are tried when creating
+	// an account for someone who logged in for the first time, if the one
+	// they'd like is taken.
+	ssoMaxLocalpartAttempts = 100
+)
+
+var invalidLocalpartChars = regexp.MustCompile(`[^0-9a-z_\-=./]`)
+
+type ssoState struct {
+	idpID       string
+	redirectURL string
+	expires     time.Time
+}
+
+// ssoLogin keeps track of the identity providers, the logins that are in
+// progress and the login tokens for logins that have finished.
+// It shouldn't be passed by value because it contains a mutex.
+type ssoLogin struct {
+	sync.Mutex
+	cfg         *config.SSO
+	providers   []*sso.Provider
+	states      map[string]ssoState
+	loginTokens *auth.LoginTokens
+}
+
+// newSSOLogin returns nil if single sign-on isn't enabled.
+func newSSOLogin(cfg *config.SSO) *ssoLogin {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := &ssoLogin{
+		cfg:         cfg,
+		states:      make(map[string]ssoState),
+		loginTokens: auth.NewLoginTokens(),
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	for i := range cfg.Providers {
+		s.providers = append(s.providers, sso.NewProvider(&cfg.Providers[i], client))
+	}
+	return s
+}
+
+// provider returns the identity provider with the given ID, or the first one
+// if the ID is empty.
+func (s *ssoLogin) provider(idpID string) *sso.Provider {
+	for _, p := range s.providers {
+		if idpID == "" || p.ID() == idpID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *ssoLogin) callbackURL() string {
+	return strings.TrimSuffix(s.cfg.PublicBaseURL, "/") + ssoCallbackPath
+}
+
+func (s *ssoLogin) addState(stateID string, state ssoState) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for k, v := range s.states {
+		if now.After(v.expires) {
+			delete(s.states, k)
+		}
+	}
+	s.states[stateID] = state
+}
+
+// takeState returns and removes the login in progress, or returns false if it
+// doesn't exist or has expired.
+func (s *ssoLogin) takeState(stateID string) (ssoState, bool) {
+	s.Lock()
+	defer s.Unlock()
+	state, ok := s.states[stateID]
+	delete(s.states, stateID)
+	return state, ok && time.Now().Before(state.expires)
+}
+
+// isAllowedRedirectURL returns whether people can be sent to the URL with a
+// login token once they've logged in. URLs must have the same scheme and host
+// as one of client_redirect_urls and a path starting with its path, or the
+// same scheme and host as public_base_url if there aren't any, since anyone
+// who gets the login token can log in as the person.
+func (s *ssoLogin) isAllowedRedirectURL(redirectURL string) bool {
+	u, err := url.Parse(redirectURL)
+	if err != nil || !u.IsAbs() || u.User != nil {
+		return false
+	}
+	allowed := s.cfg.ClientRedirectURLs
+	if len(allowed) == 0 {
+		allowed = []string{strings.TrimSuffix(s.cfg.PublicBaseURL, "/") + "/"}
+	}
+	for _, a := range allowed {
+		prefix, parseErr := url.Parse(a)
+		if parseErr != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, prefix.Scheme) && strings.EqualFold(u.Host, prefix.Host) &&
+			strings.HasPrefix(u.Path, prefix.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// SSORedirect implements GET /login/sso/redirect and
+// /login/sso/redirect/{idpID}, which send people to the identity provider to
+// log in. If no identity provider is given then the first one is used.
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, idpID string, s *ssoLogin,
+) *util.JSONResponse {
+	if s == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is not enabled"),
+		}
+	}
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if !s.isAllowedRedirectURL(redirectURL) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl is missing or isn't allowed"),
+		}
+	}
+	provider := s.provider(idpID)
+	if provider == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown identity provider"),
+		}
+	}
+
+	stateID, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to start login"),
+		}
+	}
+	authURL, err := provider.AuthorizationURL(req.Context(), s.callbackURL(), stateID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("idp_id", provider.ID()).Error("Failed to reach identity provider")
+		return &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to reach the identity provider"),
+		}
+	}
+	s.addState(stateID, ssoState{
+		idpID:       provider.ID(),
+		redirectURL: redirectURL,
+		expires:     time.Now().Add(ssoStateLifetime),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    stateID,
+		Path:     ssoStateCookiePath,
+		MaxAge:   int(ssoStateLifetime / time.Second),
+		Secure:   strings.HasPrefix(s.cfg.PublicBaseURL, "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, authURL, http.StatusFound)
+	return nil
+}
+
+// SSOCallback implements GET /login/sso/callback, which identity providers
+// send people back to once they've logged in. An account is created for
+// people who haven't logged in through the identity provider before. They're
+// then sent back to the client with a login token, which the client can use
+// to log in with m.login.token.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request, s *ssoLogin,
+	cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+) *util.JSONResponse {
+	if s == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is not enabled"),
+		}
+	}
+	ctx := req.Context()
+	query := req.URL.Query()
+	stateID := query.Get("state")
+	cookie, err := req.Cookie(ssoStateCookie)
+	if err != nil || stateID == "" || cookie.Value != stateID {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Forbidden("The login wasn't started in this browser"),
+		}
+	}
+	state, ok := s.takeState(stateID)
+	if !ok {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Forbidden("The login has expired, please try again"),
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   ssoStateCookie,
+		Path:   ssoStateCookiePath,
+		MaxAge: -1,
+	})
+	if errCode := query.Get("error"); errCode != "" {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("The identity provider returned an error: %s %s", errCode, query.Get("error_description"))),
+		}
+	}
+	provider := s.provider(state.idpID)
+	if provider == nil {
+		// The provider was removed from the config while the person was
+		// logging in.
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown identity provider"),
+		}
+	}
+	info, err := provider.ProcessCallback(ctx, s.callbackURL(), query.Get("code"))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("idp_id", provider.ID()).Error("Failed to log in with identity provider")
+		return &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to log in with the identity provider"),
+		}
+	}
+
+	localpart, err := localpartForSSOIdentity(ctx, provider.ID(), info, cfg, accountDB, userAPI, rsAPI, asAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("idp_id", provider.ID()).Error("Failed to find account for single sign-on identity")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to find or create an account"),
+		}
+	}
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to find or create an account"),
+		}
+	}
+	if acc.Deactivated {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This account has been deactivated"),
+		}
+	}
+	if acc.Suspended {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.UserSuspended("This account has been suspended"),
+		}
+	}
+
+	loginToken, err := s.loginTokens.Issue(userutil.MakeUserID(localpart, cfg.Matrix.ServerName))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("loginTokens.Issue failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to issue login token"),
+		}
+	}
+	redirectURL, _ := url.Parse(state.redirectURL)
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("loginToken", loginToken)
+	redirectURL.RawQuery = redirectQuery.Encode()
+	http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+	return nil
+}
+
+// localpartForSSOIdentity returns the localpart of the account that the
+// identity is mapped to, creating an account if there isn't one yet. New
+// accounts get the localpart that the identity provider suggested, with a
+// number added to the end if it's already taken.
+func localpartForSSOIdentity(
+	ctx context.Context, idpID string, info *sso.UserInfo,
+	cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+) (string, error) {
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(ctx, idpID, info.Subject)
+	if err != nil || localpart != "" {
+		return localpart, err
+	}
+
+	base := strings.TrimLeft(invalidLocalpartChars.ReplaceAllString(strings.ToLower(info.Localpart), ""), "_")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > maxUsernameLength-10 {
+		base = base[:maxUsernameLength-10]
+	}
+	for i := 0; i < ssoMaxLocalpartAttempts; i++ {
+		candidate := base
+		if i > 0 {
+			candidate = fmt.Sprintf("%s%d", base, i)
+		}
+		if UsernameMatchesExclusiveNamespaces(cfg, candidate) {
+			continue
+		}
+		available, err := accountDB.CheckAccountAvailability(ctx, candidate)
+		if err != nil {
+			return "", fmt.Errorf("accountDB.CheckAccountAvailability: %w", err)
+		}
+		if !available {
+			continue
+		}
+		var accRes userapi.PerformAccountCreationResponse
+		err = userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+			Localpart:   candidate,
+			AccountType: userapi.AccountTypeUser,
+			OnConflict:  userapi.ConflictAbort,
+		}, &accRes)
+		if _, ok := err.(*userapi.ErrorConflict); ok || (err == nil && !accRes.AccountCreated) {
+			// Someone else took the localpart since we checked.
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("userAPI.PerformAccountCreation: %w", err)
+		}
+		amtRegUsers.Inc()
+		if err = accountDB.SaveSSOIdentity(ctx, idpID, info.Subject, candidate); err != nil {
+			return "", fmt.Errorf("accountDB.SaveSSOIdentity: %w", err)
+		}
+		if info.DisplayName != "" {
+			if err = accountDB.SetDisplayName(ctx, candidate, info.DisplayName); err != nil {
+				util.GetLogger(ctx).WithError(err).Warn("Failed to set display name of new account")
+			}
+		}
+		onRegistered(cfg, userutil.MakeUserID(candidate, cfg.Matrix.ServerName), accountDB, rsAPI, asAPI)
+		// If the same person was logging in twice at once then the other
+		// login may have mapped them to a different account first.
+		return accountDB.GetLocalpartForSSOIdentity(ctx, idpID, info.Subject)
+	}
+	return "", fmt.Errorf("no localpart based on %q is available", base)
+}
@@ -0,0 +1,213 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+// testKeyAPI accepts the device keys which are uploaded for new devices.
+type testKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *testKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+// newTestIdentityProvider returns an OpenID Connect provider which logs
+// everyone in as the given subject.
+func newTestIdentityProvider(t *testing.T, subject string) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"authorization_endpoint":"%[1]s/authorize","token_endpoint":"%[1]s/token","userinfo_endpoint":"%[1]s/userinfo"}`, srv.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if id, secret, ok := req.BasicAuth(); !ok || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.FormValue("code") != "the_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"the_access_token","token_type":"Bearer"}`)
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer the_access_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"sub":%q,"preferred_username":"Alice","name":"Alice Liddell"}`, subject)
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSSOLogin(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdentityProvider(t, "subject1")
+	passwordHashing := &config.PasswordHashing{}
+	passwordHashing.Defaults()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "example.com", passwordHashing)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{ServerName: "example.com"},
+	}, nil, &testKeyAPI{})
+	// Someone already has the localpart that the identity provider suggests.
+	if _, err = accountDB.CreateAccount(ctx, "alice", "", ""); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "example.com"},
+		Derived: &config.Derived{
+			ExclusiveApplicationServicesUsernameRegexp: regexp.MustCompile(`^$`),
+		},
+		SSO: config.SSO{
+			Enabled:            true,
+			PublicBaseURL:      "https://matrix.example.com",
+			ClientRedirectURLs: []string{"https://client.example.com/"},
+			Providers: []config.IdentityProvider{{
+				ID:           "test",
+				Name:         "Test",
+				Issuer:       idp.URL,
+				ClientID:     "client",
+				ClientSecret: "secret",
+			}},
+		},
+	}
+	s := newSSOLogin(&cfg.SSO)
+
+	res := Login(httptest.NewRequest(http.MethodGet, "/login", nil), accountDB, userAPI, cfg, s)
+	if b, _ := json.Marshal(res.JSON); !strings.Contains(string(b), `"identity_providers":[{"id":"test","name":"Test"}]`) {
+		t.Fatalf("expected the identity provider in the login flows, got %s", b)
+	}
+
+	// ssoLogin logs in through the identity provider and returns the login
+	// token that was sent back to the client.
+	ssoLogin := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/login/sso/redirect/test?redirectUrl="+url.QueryEscape("https://client.example.com/?a=b"), nil)
+		if resErr := SSORedirect(w, req, "test", s); resErr != nil {
+			t.Fatalf("redirect failed: %+v", resErr)
+		}
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(authURL.String(), idp.URL+"/authorize") {
+			t.Fatalf("expected to be sent to the identity provider, got %q", authURL)
+		}
+		if authURL.Query().Get("redirect_uri") != "https://matrix.example.com"+ssoCallbackPath {
+			t.Fatalf("wrong callback URL: %q", authURL.Query().Get("redirect_uri"))
+		}
+		cookies := w.Result().Cookies()
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/login/sso/callback?code=the_code&state="+authURL.Query().Get("state"), nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if resErr := SSOCallback(w, req, s, cfg, accountDB, userAPI, nil, nil); resErr != nil {
+			t.Fatalf("callback failed: %+v", resErr)
+		}
+		clientURL, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || clientURL.Host != "client.example.com" || clientURL.Query().Get("a") != "b" {
+			t.Fatalf("expected to be sent back to the client, got %q", clientURL)
+		}
+		return clientURL.Query().Get("loginToken")
+	}
+	tokenLogin := func(token string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"type":"m.login.token","token":"`+token+`"}`))
+		res := Login(req, accountDB, userAPI, cfg, s)
+		if res.Code != http.StatusOK {
+			return res.Code, ""
+		}
+		return res.Code, res.JSON.(loginResponse).UserID
+	}
+
+	token := ssoLogin()
+	if code, userID := tokenLogin(token); code != http.StatusOK || userID != "@alice1:example.com" {
+		t.Fatalf("expected to log in as a new account, got %d %q", code, userID)
+	}
+	if code, _ := tokenLogin(token); code != http.StatusForbidden {
+		t.Fatalf("expected login tokens to only be usable once, got %d", code)
+	}
+	profile, err := accountDB.GetProfileByLocalpart(ctx, "alice1")
+	if err != nil || profile.DisplayName != "Alice Liddell" {
+		t.Fatalf("expected the display name to be set, got %+v (%v)", profile, err)
+	}
+
+	// Logging in again uses the same account.
+	if code, userID := tokenLogin(ssoLogin()); code != http.StatusOK || userID != "@alice1:example.com" {
+		t.Fatalf("expected to log in as the same account, got %d %q", code, userID)
+	}
+
+	// Logins can't be finished in a different browser.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/login/sso/redirect/test?redirectUrl="+url.QueryEscape("https://client.example.com/"), nil)
+	if resErr := SSORedirect(w, req, "test", s); resErr != nil {
+		t.Fatalf("redirect failed: %+v", resErr)
+	}
+	authURL, _ := url.Parse(w.Header().Get("Location"))
+	req = httptest.NewRequest(http.MethodGet, "/login/sso/callback?code=the_code&state="+authURL.Query().Get("state"), nil)
+	if resErr := SSOCallback(httptest.NewRecorder(), req, s, cfg, accountDB, userAPI, nil, nil); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a callback without the cookie to fail, got %+v", resErr)
+	}
+
+	// Clients can only ask to be sent back to the allowed URLs.
+	req = httptest.NewRequest(http.MethodGet, "/login/sso/redirect?redirectUrl="+url.QueryEscape("https://evil.example.com/"), nil)
+	if resErr := SSORedirect(httptest.NewRecorder(), req, "", s); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a disallowed redirect URL to fail, got %+v", resErr)
+	}
+}
+
+func TestSSOAllowedRedirectURL(t *testing.T) {
+	testCases := []struct {
+		name        string
+		allowed     []string
+		redirectURL string
+		want        bool
+	}{
+		{"allowed", []string{"https://client.example.com/app/"}, "https://client.example.com/app/?a=b", true},
+		{"allowed host case", []string{"https://client.example.com/"}, "https://CLIENT.example.com/", true},
+		{"disallowed host", []string{"https://client.example.com/"}, "https://evil.example/", false},
+		{"disallowed host suffix", []string{"https://client.example.com"}, "https://client.example.com.evil.example/", false},
+		{"disallowed path", []string{"https://client.example.com/app/"}, "https://client.example.com/other/", false},
+		{"disallowed scheme", []string{"https://client.example.com/"}, "http://client.example.com/", false},
+		{"disallowed userinfo", []string{"https://client.example.com/"}, "https://user@client.example.com/", false},
+		{"relative", []string{"https://client.example.com/"}, "/app/", false},
+		{"empty allowlist own origin", nil, "https://matrix.example.com/client/", true},
+		{"empty allowlist other origin", nil, "https://evil.example/", false},
+	}
+	for _, tc := range testCases {
+		s := newSSOLogin(&config.SSO{
+			Enabled:            true,
+			PublicBaseURL:      "https://matrix.example.com",
+			ClientRedirectURLs: tc.allowed,
+		})
+		if got := s.isAllowedRedirectURL(tc.redirectURL); got != tc.want {
+			t.Errorf("%s: isAllowedRedirectURL(%q) = %v, want %v", tc.name, tc.redirectURL, got, tc.want)
+		}
+	}
+}
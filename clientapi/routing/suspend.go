@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// checkNotSuspended returns an error response if the device belongs to a
+// suspended account. Suspended users can still read and leave rooms and
+// redact their own events, but can't send anything else.
+func checkNotSuspended(
+	ctx context.Context, accountDB accounts.Database, device *userapi.Device,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if acc.Suspended {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.UserSuspended("This account has been suspended"),
+		}
+	}
+	return nil
+}
+
+type suspendRequest struct {
+	Suspended bool `json:"suspended"`
+}
+
+// AdminSuspendUser implements GET and PUT /_dendrite/admin/v1/suspend/{userID}, which
+// report and change whether a local user is suspended.
+func AdminSuspendUser(
+	req *http.Request,
+	userID string,
+	cfg *config.ClientAPI,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be suspended"),
+		}
+	}
+	acc, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if req.Method == http.MethodPut {
+		var r suspendRequest
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if err = accountDB.SetAccountSuspended(req.Context(), localpart, r.Suspended); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAccountSuspended failed")
+			return jsonerror.InternalServerError()
+		}
+		acc.Suspended = r.Suspended
+		util.GetLogger(req.Context()).WithFields(map[string]interface{}{
+			"user_id":   userID,
+			"suspended": r.Suspended,
+		}).Warn("User suspension changed by server administrator")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: suspendRequest{Suspended: acc.Suspended},
+	}
+}
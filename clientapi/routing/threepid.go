@@ -37,6 +37,12 @@ type threePIDsResponse struct {
 	ThreePIDs []authtypes.ThreePID `json:"threepids"`
 }
 
+type forget3PIDResponse struct {
+	// We don't unbind 3PIDs from identity servers, so this is always
+	// "no-support".
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // RequestEmailToken implements:
 //     POST /account/3pid/email/requestToken
 //     POST /register/email/requestToken
@@ -117,7 +123,7 @@ func CheckAndSave3PIDAssociation(
 
 	if body.Bind {
 		// Publish the association on the identity server if requested
-		err = threepid.PublishAssociation(body.Creds, device.UserID, cfg)
+		err = threepid.PublishAssociation(req.Context(), body.Creds, device.UserID, cfg)
 		if err == threepid.ErrNotTrusted {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
@@ -170,19 +176,37 @@ func GetAssociated3PIDs(
 }
 
 // Forget3PID implements POST /account/3pid/delete
-func Forget3PID(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+func Forget3PID(req *http.Request, accountDB accounts.Database, device *api.Device) util.JSONResponse {
 	var body authtypes.ThreePID
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
-	if err := accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
+	// Users can only remove their own 3PIDs.
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	owner, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Address, body.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if owner != localpart {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("3PID is not associated with this account"),
+		}
+	}
+
+	if err = accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: forget3PIDResponse{IDServerUnbindResult: "no-support"},
 	}
 }
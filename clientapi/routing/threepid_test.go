@@ -0,0 +1,57 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+func TestForget3PID(t *testing.T) {
+	passwordHashing := &config.PasswordHashing{}
+	passwordHashing.Defaults()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "example.com", passwordHashing)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	ctx := context.Background()
+	if err = accountDB.SaveThreePIDAssociation(ctx, "alice@example.com", "alice", "email"); err != nil {
+		t.Fatalf("failed to save 3PID: %s", err)
+	}
+
+	forget := func(userID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/account/3pid/delete", strings.NewReader(
+			`{"medium":"email","address":"alice@example.com"}`,
+		))
+		return Forget3PID(req, accountDB, &api.Device{UserID: userID}).Code
+	}
+
+	// Other users can't remove the 3PID.
+	if code := forget("@bob:example.com"); code != http.StatusNotFound {
+		t.Fatalf("expected bob to get a 404, got %d", code)
+	}
+	localpart, err := accountDB.GetLocalpartForThreePID(ctx, "alice@example.com", "email")
+	if err != nil {
+		t.Fatalf("failed to get 3PID: %s", err)
+	}
+	if localpart != "alice" {
+		t.Fatalf("expected the 3PID to still belong to alice, got %q", localpart)
+	}
+
+	if code := forget("@alice:example.com"); code != http.StatusOK {
+		t.Fatalf("expected alice to get a 200, got %d", code)
+	}
+	if localpart, err = accountDB.GetLocalpartForThreePID(ctx, "alice@example.com", "email"); err != nil {
+		t.Fatalf("failed to get 3PID: %s", err)
+	}
+	if localpart != "" {
+		t.Fatalf("expected the 3PID to be removed, got %q", localpart)
+	}
+}
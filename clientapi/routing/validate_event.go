@@ -0,0 +1,59 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type validateEventResponse struct {
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ValidateEvent implements:
+//   POST /_matrix/client/unstable/org.matrix.dendrite/rooms/{roomID}/validate/send/{eventType}
+//   POST /_matrix/client/unstable/org.matrix.dendrite/rooms/{roomID}/validate/state/{eventType}/{stateKey}
+// It builds the event with the content in the request body in the same way as
+// /send and /state would, and runs the auth checks for it against the current
+// state of the room, without sending it. This lets bridges find out whether
+// the user would be allowed to e.g. rename the room before they try to.
+func ValidateEvent(
+	req *http.Request,
+	device *userapi.Device,
+	roomID, eventType string, stateKey *string,
+	cfg *config.ClientAPI,
+	rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	e, stateEvents, resErr := buildSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	res := validateEventResponse{Allowed: true}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err := gomatrixserverlib.Allowed(e, &provider); err != nil {
+		res = validateEventResponse{Allowed: false, Error: err.Error()}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
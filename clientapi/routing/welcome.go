@@ -0,0 +1,154 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// welcomeTemplateData is the data that the welcome message template is
+// executed with.
+type welcomeTemplateData struct {
+	UserID      string
+	Localpart   string
+	DisplayName string
+	ServerName  gomatrixserverlib.ServerName
+}
+
+// sendWelcomeMessage sends a newly registered user the welcome message from
+// the config, if there is one, in a new direct message room. This happens in
+// the background in the same way as autoJoinRooms, and failures are logged
+// but otherwise ignored.
+func sendWelcomeMessage(
+	cfg *config.ClientAPI, userID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI,
+) {
+	if !cfg.WelcomeMessage.Enabled {
+		return
+	}
+	go func() {
+		if err := sendWelcomeMessageDM(
+			context.Background(), cfg, userID, accountDB, rsAPI, asAPI, time.Now(),
+		); err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Warn("Failed to send welcome message")
+		}
+	}()
+}
+
+func sendWelcomeMessageDM(
+	ctx context.Context, cfg *config.ClientAPI, userID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI, evTime time.Time,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	body, err := renderWelcomeMessage(ctx, cfg, userID, localpart, accountDB)
+	if err != nil {
+		return err
+	}
+
+	// Make sure that the sender exists, so that it has a profile and so
+	// that nobody else can register it and pretend to be us.
+	senderLocalpart := cfg.WelcomeMessage.SenderLocalpart
+	if _, err = accountDB.CreateAccount(ctx, senderLocalpart, "", ""); err != nil && !errors.Is(err, sqlutil.ErrUserExists) {
+		return fmt.Errorf("accountDB.CreateAccount: %w", err)
+	}
+	sender := &api.Device{
+		UserID: userutil.MakeUserID(senderLocalpart, cfg.Matrix.ServerName),
+	}
+	if sender.UserID == userID {
+		return nil
+	}
+
+	// Invites sent while creating a room are always marked as direct.
+	r := createRoomRequest{
+		Preset: presetTrustedPrivateChat,
+		Invite: []string{userID},
+	}
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	if res := createRoomFromRequest(
+		ctx, &r, sender, cfg, roomID, accountDB, rsAPI, asAPI, evTime,
+	); res.Code != http.StatusOK {
+		return fmt.Errorf("failed to create room: %+v", res.JSON)
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: sender.UserID,
+		RoomID: roomID,
+		Type:   "m.room.message",
+	}
+	if err = builder.SetContent(map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    body,
+	}); err != nil {
+		return fmt.Errorf("builder.SetContent: %w", err)
+	}
+	event, err := eventutil.QueryAndBuildEvent(ctx, &builder, cfg.Matrix, evTime, rsAPI, nil)
+	if err != nil {
+		return fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+	if err = roomserverAPI.SendEvents(
+		ctx, rsAPI, roomserverAPI.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{event}, cfg.Matrix.ServerName, nil,
+	); err != nil {
+		return fmt.Errorf("roomserverAPI.SendEvents: %w", err)
+	}
+	return nil
+}
+
+// renderWelcomeMessage executes the welcome message template for the user.
+func renderWelcomeMessage(
+	ctx context.Context, cfg *config.ClientAPI, userID, localpart string, accountDB accounts.Database,
+) (string, error) {
+	tmpl, err := template.New("welcome_message").Parse(cfg.WelcomeMessage.Template)
+	if err != nil {
+		return "", fmt.Errorf("template.Parse: %w", err)
+	}
+	data := welcomeTemplateData{
+		UserID:      userID,
+		Localpart:   localpart,
+		DisplayName: localpart,
+		ServerName:  cfg.Matrix.ServerName,
+	}
+	if profile, err := accountDB.GetProfileByLocalpart(ctx, localpart); err == nil && profile.DisplayName != "" {
+		data.DisplayName = profile.DisplayName
+	}
+	var body strings.Builder
+	if err = tmpl.Execute(&body, data); err != nil {
+		return "", fmt.Errorf("tmpl.Execute: %w", err)
+	}
+	return body.String(), nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The path prefixes of the two versions of the identity service API. The v2
+// API needs an access token for the identity server, which a client only has
+// once the user has agreed to the terms of that identity server, so the v2
+// API is used whenever the client sends one along with the request. Otherwise
+// we fall back to the v1 API, which identity servers are phasing out.
+const (
+	idServerV1Prefix = "/_matrix/identity/api/v1"
+	idServerV2Prefix = "/_matrix/identity/v2"
+)
+
+// idServerClient is the HTTP client used for all requests to identity servers.
+var idServerClient = &http.Client{Timeout: 30 * time.Second}
+
+// ErrNoLookupAlgorithm is the error raised if an identity server doesn't
+// support any of the algorithms we know for hashing 3PIDs before looking
+// them up.
+var ErrNoLookupAlgorithm = errors.New("identity server doesn't support a known lookup algorithm")
+
+// idServerURL returns the URL of an endpoint of the identity service API,
+// using the v2 API if there is an access token for the identity server.
+func idServerURL(idServer, accessToken, path string) string {
+	if accessToken != "" {
+		return "https://" + idServer + idServerV2Prefix + path
+	}
+	return "https://" + idServer + idServerV1Prefix + path
+}
+
+// doIDServerRequest sends a request to an endpoint of the identity service
+// API. The v2 API takes a JSON body and the access token in the headers,
+// whereas the v1 API takes a form-encoded body. The caller must close the
+// body of the response.
+func doIDServerRequest(
+	ctx context.Context, method, idServer, accessToken, path string,
+	body map[string]interface{},
+) (*http.Response, error) {
+	var reqBody io.Reader
+	var contentType string
+	switch {
+	case body == nil:
+	case accessToken != "":
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody, contentType = bytes.NewReader(content), "application/json"
+	default:
+		data := url.Values{}
+		for k, v := range body {
+			data.Add(k, fmt.Sprint(v))
+		}
+		reqBody, contentType = strings.NewReader(data.Encode()), "application/x-www-form-urlencoded"
+	}
+
+	req, err := http.NewRequest(method, idServerURL(idServer, accessToken, path), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return idServerClient.Do(req.WithContext(ctx))
+}
+
+// hashDetails are the pepper and algorithms which an identity server wants
+// 3PIDs to be hashed with before they are looked up, as described at
+// https://matrix.org/docs/spec/identity_service/r0.3.0#get-matrix-identity-v2-hash-details
+type hashDetails struct {
+	Pepper     string   `json:"lookup_pepper"`
+	Algorithms []string `json:"algorithms"`
+}
+
+// The hash details of each identity server. They are only fetched again when
+// the identity server tells us that it has rotated its pepper.
+var hashDetailsCache = struct {
+	sync.Mutex
+	servers map[string]hashDetails
+}{
+	servers: make(map[string]hashDetails),
+}
+
+// getHashDetails returns the hash details of the identity server, fetching
+// them if they aren't already known.
+func getHashDetails(ctx context.Context, idServer, accessToken string) (hashDetails, error) {
+	hashDetailsCache.Lock()
+	details, ok := hashDetailsCache.servers[idServer]
+	hashDetailsCache.Unlock()
+	if ok {
+		return details, nil
+	}
+
+	resp, err := doIDServerRequest(ctx, http.MethodGet, idServer, accessToken, "/hash_details", nil)
+	if err != nil {
+		return details, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return details, fmt.Errorf("Identity server %s responded with a %d error code to /hash_details", idServer, resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&details); err != nil {
+		return details, err
+	}
+	setHashDetails(idServer, details)
+	return details, nil
+}
+
+func setHashDetails(idServer string, details hashDetails) {
+	hashDetailsCache.Lock()
+	defer hashDetailsCache.Unlock()
+	hashDetailsCache.servers[idServer] = details
+}
+
+// hashThreePID hashes the 3PID with the best algorithm that the identity
+// server supports, returning the algorithm and the hashed 3PID. The 3PID is
+// only sent without hashing if the identity server doesn't support SHA-256.
+func hashThreePID(details hashDetails, medium, address string) (string, string, error) {
+	if medium == "email" {
+		address = strings.ToLower(address)
+	}
+	var none bool
+	for _, algorithm := range details.Algorithms {
+		switch algorithm {
+		case "sha256":
+			sum := sha256.Sum256([]byte(address + " " + medium + " " + details.Pepper))
+			return algorithm, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+		case "none":
+			none = true
+		}
+	}
+	if none {
+		return "none", address + " " + medium, nil
+	}
+	return "", "", ErrNoLookupAlgorithm
+}
+
+// queryIDServerHashedLookup looks up the Matrix ID bound to the 3PID on
+// /_matrix/identity/v2/lookup. Returns an empty Matrix ID if the 3PID isn't
+// bound to one. If the identity server has rotated its pepper since we last
+// fetched it then the lookup is retried once with the new one.
+func queryIDServerHashedLookup(
+	ctx context.Context, idServer, accessToken, medium, address string,
+) (string, error) {
+	details, err := getHashDetails(ctx, idServer, accessToken)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; ; attempt++ {
+		algorithm, hashed, err := hashThreePID(details, medium, address)
+		if err != nil {
+			return "", err
+		}
+		resp, err := doIDServerRequest(ctx, http.MethodPost, idServer, accessToken, "/lookup", map[string]interface{}{
+			"addresses": []string{hashed},
+			"algorithm": algorithm,
+			"pepper":    details.Pepper,
+		})
+		if err != nil {
+			return "", err
+		}
+		var res struct {
+			Mappings map[string]string `json:"mappings"`
+			ErrCode  string            `json:"errcode"`
+			hashDetails
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK && err == nil:
+			return res.Mappings[hashed], nil
+		case res.ErrCode == "M_INVALID_PEPPER" && attempt == 0:
+			// The identity server sends the new pepper along with the error.
+			details = res.hashDetails
+			setHashDetails(idServer, details)
+		default:
+			return "", fmt.Errorf("Identity server %s responded with a %d error code to /lookup", idServer, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package threepid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashThreePID(t *testing.T) {
+	// The example from the identity service spec.
+	algorithm, hashed, err := hashThreePID(hashDetails{
+		Pepper:     "matrixrocks",
+		Algorithms: []string{"none", "sha256"},
+	}, "email", "Alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "sha256" || hashed != "4kenr7N9drpCJ4AfalmlGQVsOn3o2RHjkADUpXJWZUc" {
+		t.Fatalf("got %s %s", algorithm, hashed)
+	}
+
+	algorithm, hashed, err = hashThreePID(hashDetails{Algorithms: []string{"none"}}, "msisdn", "15551234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "none" || hashed != "15551234567 msisdn" {
+		t.Fatalf("got %s %s", algorithm, hashed)
+	}
+
+	if _, _, err = hashThreePID(hashDetails{Algorithms: []string{"md5"}}, "email", "alice@example.com"); err != ErrNoLookupAlgorithm {
+		t.Fatalf("got error %v, want ErrNoLookupAlgorithm", err)
+	}
+}
+
+func TestHashedLookupAfterPepperRotation(t *testing.T) {
+	pepper := "new_pepper"
+	var hashDetailsRequests int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case idServerV2Prefix + "/hash_details":
+			hashDetailsRequests++
+			_ = json.NewEncoder(w).Encode(hashDetails{Pepper: "old_pepper", Algorithms: []string{"sha256"}})
+		case idServerV2Prefix + "/lookup":
+			var body struct {
+				Addresses []string `json:"addresses"`
+				Pepper    string   `json:"pepper"`
+			}
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			if body.Pepper != pepper {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"errcode":       "M_INVALID_PEPPER",
+					"error":         "Unknown or invalid pepper - has it been rotated?",
+					"lookup_pepper": pepper,
+					"algorithms":    []string{"sha256"},
+				})
+				return
+			}
+			_, hashed, _ := hashThreePID(hashDetails{Pepper: pepper, Algorithms: []string{"sha256"}}, "email", "alice@example.com")
+			mappings := map[string]string{}
+			for _, address := range body.Addresses {
+				if address == hashed {
+					mappings[address] = "@alice:example.com"
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"mappings": mappings})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := idServerClient
+	idServerClient = srv.Client()
+	defer func() { idServerClient = client }()
+	idServer := strings.TrimPrefix(srv.URL, "https://")
+
+	for i := 0; i < 2; i++ {
+		mxid, err := queryIDServerHashedLookup(context.Background(), idServer, "token", "email", "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mxid != "@alice:example.com" {
+			t.Fatalf("got Matrix ID %q", mxid)
+		}
+	}
+	mxid, err := queryIDServerHashedLookup(context.Background(), idServer, "token", "email", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mxid != "" {
+		t.Fatalf("got Matrix ID %q for an unbound 3PID", mxid)
+	}
+	if hashDetailsRequests != 1 {
+		t.Fatalf("fetched hash details %d times, want 1", hashDetailsRequests)
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -31,16 +30,18 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 )
 
 // MembershipRequest represents the body of an incoming POST request
 // on /rooms/{roomID}/(join|kick|ban|unban|leave|invite)
 type MembershipRequest struct {
-	UserID   string `json:"user_id"`
-	Reason   string `json:"reason"`
-	IDServer string `json:"id_server"`
-	Medium   string `json:"medium"`
-	Address  string `json:"address"`
+	UserID        string `json:"user_id"`
+	Reason        string `json:"reason"`
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Medium        string `json:"medium"`
+	Address       string `json:"address"`
 }
 
 // idServerLookupResponse represents the response described at https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-identity-api-v1-lookup
@@ -102,7 +103,7 @@ func CheckAndProcessInvite(
 		return
 	}
 
-	lookupRes, storeInviteRes, err := queryIDServer(ctx, db, cfg, device, body, roomID)
+	lookupRes, storeInviteRes, err := queryIDServer(ctx, db, cfg, rsAPI, device, body, roomID)
 	if err != nil {
 		return
 	}
@@ -137,13 +138,28 @@ func CheckAndProcessInvite(
 // Returns an error if a check or a request failed.
 func queryIDServer(
 	ctx context.Context,
-	db accounts.Database, cfg *config.ClientAPI, device *userapi.Device,
-	body *MembershipRequest, roomID string,
+	db accounts.Database, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, body *MembershipRequest, roomID string,
 ) (lookupRes *idServerLookupResponse, storeInviteRes *idServerStoreInviteResponse, err error) {
 	if err = isTrusted(body.IDServer, cfg); err != nil {
 		return
 	}
 
+	if body.IDAccessToken != "" {
+		// The v2 API only sends a hash of the 3PID to the identity server. Its
+		// lookups aren't signed, as they are authenticated by the access token.
+		var mxid string
+		mxid, err = queryIDServerHashedLookup(ctx, body.IDServer, body.IDAccessToken, body.Medium, body.Address)
+		if err != nil {
+			return
+		}
+		lookupRes = &idServerLookupResponse{MXID: mxid}
+		if mxid == "" {
+			storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, rsAPI, device, body, roomID)
+		}
+		return
+	}
+
 	// Lookup the 3PID
 	lookupRes, err = queryIDServerLookup(ctx, body)
 	if err != nil {
@@ -153,7 +169,7 @@ func queryIDServer(
 	if lookupRes.MXID == "" {
 		// No Matrix ID matches with the given 3PID, ask the server to store the
 		// invite and return a token
-		storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, device, body, roomID)
+		storeInviteRes, err = queryIDServerStoreInvite(ctx, db, cfg, rsAPI, device, body, roomID)
 		return
 	}
 
@@ -164,7 +180,7 @@ func queryIDServer(
 	if lookupRes.NotBefore > now || now > lookupRes.NotAfter {
 		// If the current timestamp isn't in the time frame in which the association
 		// is known to be valid, re-run the query
-		return queryIDServer(ctx, db, cfg, device, body, roomID)
+		return queryIDServer(ctx, db, cfg, rsAPI, device, body, roomID)
 	}
 
 	// Check the request signatures and send an error if one isn't valid
@@ -180,15 +196,12 @@ func queryIDServer(
 // Returns an error if the request failed to send or if the response couldn't be parsed.
 func queryIDServerLookup(ctx context.Context, body *MembershipRequest) (*idServerLookupResponse, error) {
 	address := url.QueryEscape(body.Address)
-	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/lookup?medium=%s&address=%s", body.IDServer, body.Medium, address)
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	path := fmt.Sprintf("/lookup?medium=%s&address=%s", url.QueryEscape(body.Medium), address)
+	resp, err := doIDServerRequest(ctx, http.MethodGet, body.IDServer, "", path, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	if resp.StatusCode != http.StatusOK {
 		// TODO: Log the error supplied with the identity server?
@@ -201,13 +214,13 @@ func queryIDServerLookup(ctx context.Context, body *MembershipRequest) (*idServe
 	return &res, err
 }
 
-// queryIDServerStoreInvite sends a response to the identity server on /_matrix/identity/api/v1/store-invite
+// queryIDServerStoreInvite sends a response to the identity server on /store-invite
 // and returns the response as a structure.
 // Returns an error if the request failed to send or if the response couldn't be parsed.
 func queryIDServerStoreInvite(
 	ctx context.Context,
-	db accounts.Database, cfg *config.ClientAPI, device *userapi.Device,
-	body *MembershipRequest, roomID string,
+	db accounts.Database, cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+	device *userapi.Device, body *MembershipRequest, roomID string,
 ) (*idServerStoreInviteResponse, error) {
 	// Retrieve the sender's profile to get their display name
 	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
@@ -225,32 +238,25 @@ func queryIDServerStoreInvite(
 		profile = &authtypes.Profile{}
 	}
 
-	client := http.Client{}
-
-	data := url.Values{}
-	data.Add("medium", body.Medium)
-	data.Add("address", body.Address)
-	data.Add("room_id", roomID)
-	data.Add("sender", device.UserID)
-	data.Add("sender_display_name", profile.DisplayName)
-	// TODO: Also send:
-	//      - The room name (room_name)
-	//      - The room's avatar url (room_avatar_url)
-	//      See https://github.com/matrix-org/sydent/blob/master/sydent/http/servlets/store_invite_servlet.py#L82-L91
-	//      These can be easily retrieved by requesting the public rooms API
-	//      server's database.
-
-	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/store-invite", body.IDServer)
-	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return nil, err
+	data := map[string]interface{}{
+		"medium":              body.Medium,
+		"address":             body.Address,
+		"room_id":             roomID,
+		"sender":              device.UserID,
+		"sender_display_name": profile.DisplayName,
+		"sender_avatar_url":   profile.AvatarURL,
+	}
+	// The details of the room are only used to make the invitation that the
+	// identity server sends more helpful, so we can do without them.
+	if err = addStoreInviteRoomDetails(ctx, rsAPI, roomID, data); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to get room details for third-party invite")
 	}
 
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req.WithContext(ctx))
+	resp, err := doIDServerRequest(ctx, http.MethodPost, body.IDServer, body.IDAccessToken, "/store-invite", data)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	if resp.StatusCode != http.StatusOK {
 		errMsg := fmt.Sprintf("Identity server %s responded with a %d error code", body.IDServer, resp.StatusCode)
@@ -262,21 +268,61 @@ func queryIDServerStoreInvite(
 	return &idResp, err
 }
 
+// addStoreInviteRoomDetails adds the name, avatar, canonical alias and join
+// rules of the room to the body of a /store-invite request, if the room has
+// them. See https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-store-invite
+func addStoreInviteRoomDetails(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string, data map[string]interface{},
+) error {
+	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName, StateKey: ""}
+	avatarTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.avatar", StateKey: ""}
+	aliasTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
+	joinRulesTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}
+	var stateRes api.QueryCurrentStateResponse
+	if err := rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{nameTuple, avatarTuple, aliasTuple, joinRulesTuple},
+	}, &stateRes); err != nil {
+		return fmt.Errorf("rsAPI.QueryCurrentState: %w", err)
+	}
+	if ev, ok := stateRes.StateEvents[nameTuple]; ok {
+		var content eventutil.NameContent
+		if err := json.Unmarshal(ev.Content(), &content); err == nil && content.Name != "" {
+			data["room_name"] = content.Name
+		}
+	}
+	if ev, ok := stateRes.StateEvents[avatarTuple]; ok {
+		var content eventutil.AvatarContent
+		if err := json.Unmarshal(ev.Content(), &content); err == nil && content.URL != "" {
+			data["room_avatar_url"] = content.URL
+		}
+	}
+	if ev, ok := stateRes.StateEvents[aliasTuple]; ok {
+		var content eventutil.CanonicalAliasContent
+		if err := json.Unmarshal(ev.Content(), &content); err == nil && content.Alias != "" {
+			data["room_alias"] = content.Alias
+		}
+	}
+	if ev, ok := stateRes.StateEvents[joinRulesTuple]; ok {
+		var content gomatrixserverlib.JoinRuleContent
+		if err := json.Unmarshal(ev.Content(), &content); err == nil && content.JoinRule != "" {
+			data["room_join_rules"] = content.JoinRule
+		}
+	}
+	return nil
+}
+
 // queryIDServerPubKey requests a public key identified with a given ID to the
 // a given identity server and returns the matching base64-decoded public key.
 // We assume that the ID server is trusted at this point.
 // Returns an error if the request couldn't be sent, if its body couldn't be parsed
 // or if the key couldn't be decoded from base64.
 func queryIDServerPubKey(ctx context.Context, idServerName string, keyID string) ([]byte, error) {
-	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/pubkey/%s", idServerName, keyID)
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := doIDServerRequest(ctx, http.MethodGet, idServerName, "", "/pubkey/"+url.PathEscape(keyID), nil)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	var pubKeyRes struct {
 		PublicKey gomatrixserverlib.Base64Bytes `json:"public_key"`
@@ -341,7 +387,7 @@ func emit3PIDInviteEvent(
 		StateKey: &res.Token,
 	}
 
-	validityURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/pubkey/isvalid", body.IDServer)
+	validityURL := idServerURL(body.IDServer, body.IDAccessToken, "/pubkey/isvalid")
 	content := gomatrixserverlib.ThirdPartyInviteContent{
 		DisplayName:    res.DisplayName,
 		KeyValidityURL: validityURL,
@@ -0,0 +1,70 @@
+package threepid
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type mockRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	state []*gomatrixserverlib.HeaderedEvent
+}
+
+func (s *mockRoomserverAPI) QueryCurrentState(ctx context.Context, req *api.QueryCurrentStateRequest, res *api.QueryCurrentStateResponse) error {
+	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent)
+	for _, ev := range s.state {
+		res.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+	return nil
+}
+
+func mustCreateStateEvent(t *testing.T, i int, eventType, content string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":%s,"depth":%d,"event_id":"$%d:example.com","origin":"example.com","origin_server_ts":0,"prev_events":[],"room_id":"!room:example.com","sender":"@alice:example.com","signatures":{},"state_key":"","type":%q}`,
+		content, i, i, eventType,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func TestAddStoreInviteRoomDetails(t *testing.T) {
+	rsAPI := &mockRoomserverAPI{
+		state: []*gomatrixserverlib.HeaderedEvent{
+			mustCreateStateEvent(t, 1, "m.room.name", `{"name":"Support"}`),
+			mustCreateStateEvent(t, 2, "m.room.avatar", `{"url":"mxc://example.com/avatar"}`),
+			mustCreateStateEvent(t, 3, "m.room.canonical_alias", `{"alias":"#support:example.com"}`),
+			mustCreateStateEvent(t, 4, "m.room.join_rules", `{"join_rule":"invite"}`),
+		},
+	}
+	data := map[string]interface{}{}
+	if err := addStoreInviteRoomDetails(context.Background(), rsAPI, "!room:example.com", data); err != nil {
+		t.Fatalf("addStoreInviteRoomDetails failed: %s", err)
+	}
+	want := map[string]interface{}{
+		"room_name":       "Support",
+		"room_avatar_url": "mxc://example.com/avatar",
+		"room_alias":      "#support:example.com",
+		"room_join_rules": "invite",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %v, want %v", data, want)
+	}
+
+	// Rooms without any details don't add anything.
+	data = map[string]interface{}{}
+	if err := addStoreInviteRoomDetails(context.Background(), &mockRoomserverAPI{}, "!room:example.com", data); err != nil {
+		t.Fatalf("addStoreInviteRoomDetails failed: %s", err)
+	}
+	if len(data) != 0 {
+		t.Errorf("expected no room details, got %v", data)
+	}
+}
@@ -21,18 +21,17 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"strconv"
-	"strings"
 
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
 // EmailAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register-email-requesttoken
 type EmailAssociationRequest struct {
-	IDServer    string `json:"id_server"`
-	Secret      string `json:"client_secret"`
-	Email       string `json:"email"`
-	SendAttempt int    `json:"send_attempt"`
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Secret        string `json:"client_secret"`
+	Email         string `json:"email"`
+	SendAttempt   int    `json:"send_attempt"`
 }
 
 // EmailAssociationCheckRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-3pid
@@ -43,9 +42,10 @@ type EmailAssociationCheckRequest struct {
 
 // Credentials represents the "ThreePidCredentials" structure defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-3pid
 type Credentials struct {
-	SID      string `json:"sid"`
-	IDServer string `json:"id_server"`
-	Secret   string `json:"client_secret"`
+	SID           string `json:"sid"`
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Secret        string `json:"client_secret"`
 }
 
 // CreateSession creates a session on an identity server.
@@ -60,24 +60,15 @@ func CreateSession(
 	}
 
 	// Create a session on the ID server
-	postURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/validate/email/requestToken", req.IDServer)
-
-	data := url.Values{}
-	data.Add("client_secret", req.Secret)
-	data.Add("email", req.Email)
-	data.Add("send_attempt", strconv.Itoa(req.SendAttempt))
-
-	request, err := http.NewRequest(http.MethodPost, postURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", err
-	}
-	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	client := http.Client{}
-	resp, err := client.Do(request.WithContext(ctx))
+	resp, err := doIDServerRequest(ctx, http.MethodPost, req.IDServer, req.IDAccessToken, "/validate/email/requestToken", map[string]interface{}{
+		"client_secret": req.Secret,
+		"email":         req.Email,
+		"send_attempt":  req.SendAttempt,
+	})
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	// Error if the status isn't OK
 	if resp.StatusCode != http.StatusOK {
@@ -107,15 +98,12 @@ func CheckAssociation(
 		return false, "", "", err
 	}
 
-	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/3pid/getValidated3pid?sid=%s&client_secret=%s", creds.IDServer, creds.SID, creds.Secret)
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
-	if err != nil {
-		return false, "", "", err
-	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	path := "/3pid/getValidated3pid?sid=" + url.QueryEscape(creds.SID) + "&client_secret=" + url.QueryEscape(creds.Secret)
+	resp, err := doIDServerRequest(ctx, http.MethodGet, creds.IDServer, creds.IDAccessToken, path, nil)
 	if err != nil {
 		return false, "", "", err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	var respBody struct {
 		Medium      string `json:"medium"`
@@ -142,29 +130,22 @@ func CheckAssociation(
 // identifier and a Matrix ID.
 // Returns an error if there was a problem sending the request or decoding the
 // response, or if the identity server responded with a non-OK status.
-func PublishAssociation(creds Credentials, userID string, cfg *config.ClientAPI) error {
+func PublishAssociation(
+	ctx context.Context, creds Credentials, userID string, cfg *config.ClientAPI,
+) error {
 	if err := isTrusted(creds.IDServer, cfg); err != nil {
 		return err
 	}
 
-	postURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/3pid/bind", creds.IDServer)
-
-	data := url.Values{}
-	data.Add("sid", creds.SID)
-	data.Add("client_secret", creds.Secret)
-	data.Add("mxid", userID)
-
-	request, err := http.NewRequest(http.MethodPost, postURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return err
-	}
-	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	client := http.Client{}
-	resp, err := client.Do(request)
+	resp, err := doIDServerRequest(ctx, http.MethodPost, creds.IDServer, creds.IDAccessToken, "/3pid/bind", map[string]interface{}{
+		"sid":           creds.SID,
+		"client_secret": creds.Secret,
+		"mxid":          userID,
+	})
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	// Error if the status isn't OK
 	if resp.StatusCode != http.StatusOK {
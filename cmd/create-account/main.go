@@ -57,7 +57,7 @@ func main() {
 
 	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: cfg.UserAPI.AccountDatabase.ConnectionString,
-	}, cfg.Global.ServerName)
+	}, cfg.Global.ServerName, &cfg.UserAPI.PasswordHashing)
 	if err != nil {
 		logrus.Fatalln("Failed to connect to the database:", err.Error())
 	}
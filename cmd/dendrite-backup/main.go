@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/internal/backup"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: %s
+
+Takes a backup of the databases of all components, along with a manifest of
+the media store, while the homeserver is running. The backup is written to a
+new directory within the configured backup directory. SQLite databases are
+copied using the SQLite online backup API and PostgreSQL databases are dumped
+using pg_dump. The media files themselves are not copied.
+
+Example:
+
+  ./dendrite-backup --config dendrite.yaml
+
+Arguments:
+
+`
+
+var directory = flag.String("directory", "", "The directory to write the backup to, overriding global.backup.directory in the config")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	cfg := setup.ParseFlags(true)
+	if *directory != "" {
+		cfg.Global.Backup.Directory = config.Path(*directory)
+	}
+
+	dir, manifest, err := backup.Run(context.Background(), cfg)
+	if err != nil {
+		logrus.WithError(err).Fatalln("Failed to take backup")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"databases":   len(manifest.Databases),
+		"media_files": manifest.MediaFiles,
+	}).Infoln("Backup written to", dir)
+}
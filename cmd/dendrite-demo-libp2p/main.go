@@ -193,6 +193,7 @@ func main() {
 		base.Base.PublicFederationAPIMux,
 		base.Base.PublicKeyAPIMux,
 		base.Base.PublicMediaAPIMux,
+		base.Base.DendriteAdminMux,
 	)
 	if err := mscs.Enable(&base.Base, &monolith); err != nil {
 		logrus.WithError(err).Fatalf("Failed to enable MSCs")
@@ -200,8 +201,9 @@ func main() {
 
 	httpRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	httpRouter.PathPrefix(httputil.InternalPathPrefix).Handler(base.Base.InternalAPIMux)
-	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(base.Base.PublicClientAPIMux)
-	httpRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(base.Base.PublicMediaAPIMux)
+	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(httputil.WrapHandlerInCORS(base.Base.PublicClientAPIMux, &base.Base.Cfg.Global.CORS))
+	httpRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(httputil.WrapHandlerInCORS(base.Base.PublicMediaAPIMux, &base.Base.Cfg.Global.CORS))
+	httpRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(base.Base.DendriteAdminMux)
 	embed.Embed(httpRouter, *instancePort, "Yggdrasil Demo")
 
 	libp2pRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
@@ -233,12 +233,14 @@ func main() {
 		base.PublicFederationAPIMux,
 		base.PublicKeyAPIMux,
 		base.PublicMediaAPIMux,
+		base.DendriteAdminMux,
 	)
 
 	httpRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	httpRouter.PathPrefix(httputil.InternalPathPrefix).Handler(base.InternalAPIMux)
-	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(base.PublicClientAPIMux)
-	httpRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(base.PublicMediaAPIMux)
+	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(httputil.WrapHandlerInCORS(base.PublicClientAPIMux, &base.Cfg.Global.CORS))
+	httpRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(httputil.WrapHandlerInCORS(base.PublicMediaAPIMux, &base.Cfg.Global.CORS))
+	httpRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(base.DendriteAdminMux)
 
 	libp2pRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	libp2pRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(base.PublicFederationAPIMux)
@@ -42,12 +42,12 @@ func main() {
 
 	fmt.Println("Fetching", len(snapshotNIDs), "snapshot NIDs")
 
-	cache, err := caching.NewInMemoryLRUCache(true)
+	cache, err := caching.NewInMemoryLRUCache(cfg.Global.Cache.EstimatedMaxSizeBytes, true)
 	if err != nil {
 		panic(err)
 	}
 
-	roomserverDB, err := storage.Open(&cfg.RoomServer.Database, cache)
+	roomserverDB, err := storage.Open(&cfg.RoomServer.Database, cfg.RoomServer.EventJSONCompression, cache)
 	if err != nil {
 		panic(err)
 	}
@@ -45,7 +45,7 @@ func NewInternalAPI(
 
 	_, producer := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
 
-	return &input.EDUServerInputAPI{
+	inputAPI := &input.EDUServerInputAPI{
 		Cache:                        eduCache,
 		UserAPI:                      userAPI,
 		Producer:                     producer,
@@ -54,4 +54,6 @@ func NewInternalAPI(
 		OutputReceiptEventTopic:      cfg.Matrix.Kafka.TopicFor(config.TopicOutputReceiptEvent),
 		ServerName:                   cfg.Matrix.ServerName,
 	}
+	eduCache.SetTimeoutCallback(inputAPI.OnTypingTimeout)
+	return inputAPI
 }
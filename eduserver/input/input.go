@@ -67,6 +67,24 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	return t.sendTypingEvent(ite)
 }
 
+// OnTypingTimeout is called by the cache when a user's typing notification
+// times out. Other servers are told that local users have stopped typing, as
+// they would be if the client had said so. Remote users time out on their
+// own servers, and the sync API times out typing notifications itself.
+func (t *EDUServerInputAPI) OnTypingTimeout(userID, roomID string, _ int64) {
+	if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != t.ServerName {
+		return
+	}
+	if err := t.sendTypingEvent(&api.InputTypingEvent{
+		UserID:         userID,
+		RoomID:         roomID,
+		Typing:         false,
+		OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		logrus.WithError(err).WithField("user_id", userID).Error("Failed to send typing timeout")
+	}
+}
+
 // InputTypingEvent implements api.EDUServerInputAPI
 func (t *EDUServerInputAPI) InputSendToDeviceEvent(
 	ctx context.Context,
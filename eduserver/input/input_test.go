@@ -0,0 +1,90 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+)
+
+type dummyProducer struct {
+	events chan api.OutputTypingEvent
+}
+
+func (p *dummyProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	var ote api.OutputTypingEvent
+	b, err := msg.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = json.Unmarshal(b, &ote); err != nil {
+		return 0, 0, err
+	}
+	p.events <- ote
+	return 0, 0, nil
+}
+
+func (p *dummyProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *dummyProducer) Close() error {
+	return nil
+}
+
+func TestTypingTimeout(t *testing.T) {
+	producer := &dummyProducer{events: make(chan api.OutputTypingEvent, 10)}
+	eduCache := cache.New()
+	inputAPI := &EDUServerInputAPI{
+		Cache:                  eduCache,
+		Producer:               producer,
+		OutputTypingEventTopic: "typing",
+		ServerName:             "kaer.morhen",
+	}
+	eduCache.SetTimeoutCallback(inputAPI.OnTypingTimeout)
+
+	roomID := "!room:kaer.morhen"
+	expire := time.Now().Add(time.Millisecond * 50)
+	eduCache.AddTypingUser("@bob:remote.server", roomID, &expire)
+	eduCache.AddTypingUser("@alice:kaer.morhen", roomID, &expire)
+
+	// Only the local user should be announced as having stopped typing.
+	select {
+	case ote := <-producer.events:
+		if ote.Event.UserID != "@alice:kaer.morhen" || ote.Event.RoomID != roomID || ote.Event.Typing {
+			t.Errorf("got unexpected typing event %+v", ote.Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a typing event when the typing notification timed out")
+	}
+	select {
+	case ote := <-producer.events:
+		t.Errorf("got unexpected typing event %+v", ote.Event)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if users := eduCache.GetTypingUsers(roomID); len(users) != 0 {
+		t.Errorf("expected nobody to be typing, got %v", users)
+	}
+}
@@ -29,7 +29,7 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers on the base API muxes for the FederationAPI component.
 func AddPublicRoutes(
-	fedRouter, keyRouter *mux.Router,
+	fedRouter, keyRouter, dendriteAdminRouter *mux.Router,
 	cfg *config.FederationAPI,
 	userAPI userapi.UserInternalAPI,
 	federation *gomatrixserverlib.FederationClient,
@@ -40,7 +40,7 @@ func AddPublicRoutes(
 	keyAPI keyserverAPI.KeyInternalAPI,
 ) {
 	routing.Setup(
-		fedRouter, keyRouter, cfg, rsAPI,
+		fedRouter, keyRouter, dendriteAdminRouter, cfg, rsAPI,
 		eduAPI, federationSenderAPI, keyRing,
 		federation, userAPI, keyAPI,
 	)
@@ -16,6 +16,7 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -29,15 +30,36 @@ func GetEventAuth(
 	roomID string,
 	eventID string,
 ) util.JSONResponse {
-	// TODO: Optimisation: we shouldn't be querying all the room state
-	// that is in state.StateEvents - we just ignore it.
-	state, err := getState(ctx, request, rsAPI, roomID, eventID)
+	resErr := allowedToSeeEvent(ctx, request.Origin(), rsAPI, eventID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	// Fetch the event along with its auth chain in one go, rather than
+	// loading the whole room state at the event just to throw it away.
+	var response api.QueryEventsByIDResponse
+	err := rsAPI.QueryEventsByID(
+		ctx,
+		&api.QueryEventsByIDRequest{
+			EventIDs:         []string{eventID},
+			IncludeAuthChain: true,
+		},
+		&response,
+	)
 	if err != nil {
-		return *err
+		return util.ErrorResponse(err)
+	}
+	if len(response.Events) == 0 {
+		return util.JSONResponse{Code: http.StatusNotFound, JSON: nil}
+	}
+	if response.Events[0].RoomID() != roomID {
+		return util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("event does not belong to this room")}
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: gomatrixserverlib.RespEventAuth{AuthEvents: state.AuthEvents},
+		JSON: gomatrixserverlib.RespEventAuth{
+			AuthEvents: gomatrixserverlib.UnwrapEventHeaders(response.AuthChainEvents),
+		},
 	}
 }
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -41,6 +42,14 @@ func GetEvent(
 	if err != nil {
 		return *err
 	}
+	// The room isn't in the path, so the server ACLs can only be checked
+	// once we know which room the event is in.
+	if api.IsServerBannedFromRoom(ctx, rsAPI, event.RoomID(), request.Origin()) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+		}
+	}
 
 	return util.JSONResponse{Code: http.StatusOK, JSON: gomatrixserverlib.Transaction{
 		Origin:         origin,
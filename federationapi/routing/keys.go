@@ -16,6 +16,7 @@ package routing
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -122,37 +123,47 @@ func ClaimOneTimeKeys(
 	}
 }
 
-// LocalKeys returns the local keys for the server.
+// LocalKeys returns the local keys for the given local server name, which
+// may be one of our virtual hosts.
 // See https://matrix.org/docs/spec/server_server/unstable.html#publishing-keys
-func LocalKeys(cfg *config.FederationAPI) util.JSONResponse {
-	keys, err := localKeys(cfg, time.Now().Add(cfg.Matrix.KeyValidityPeriod))
+func LocalKeys(cfg *config.FederationAPI, serverName gomatrixserverlib.ServerName) util.JSONResponse {
+	keys, err := localKeys(cfg, serverName)
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
 	return util.JSONResponse{Code: http.StatusOK, JSON: keys}
 }
 
-func localKeys(cfg *config.FederationAPI, validUntil time.Time) (*gomatrixserverlib.ServerKeys, error) {
+func localKeys(cfg *config.FederationAPI, serverName gomatrixserverlib.ServerName) (*gomatrixserverlib.ServerKeys, error) {
 	var keys gomatrixserverlib.ServerKeys
 
-	keys.ServerName = cfg.Matrix.ServerName
-	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(validUntil)
+	host := cfg.Matrix.VirtualHostFor(serverName)
+	if host == nil {
+		return nil, fmt.Errorf("server name %q is not local", serverName)
+	}
+
+	keys.ServerName = host.ServerName
+	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Now().Add(host.KeyValidityPeriod))
 
-	publicKey := cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
+	publicKey := host.PrivateKey.Public().(ed25519.PublicKey)
 
 	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
-		cfg.Matrix.KeyID: {
+		host.KeyID: {
 			Key: gomatrixserverlib.Base64Bytes(publicKey),
 		},
 	}
 
+	// Old keys are only configured for the server itself, not for the
+	// virtual hosts.
 	keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
-	for _, oldVerifyKey := range cfg.Matrix.OldVerifyKeys {
-		keys.OldVerifyKeys[oldVerifyKey.KeyID] = gomatrixserverlib.OldVerifyKey{
-			VerifyKey: gomatrixserverlib.VerifyKey{
-				Key: gomatrixserverlib.Base64Bytes(oldVerifyKey.PrivateKey.Public().(ed25519.PublicKey)),
-			},
-			ExpiredTS: oldVerifyKey.ExpiredAt,
+	if host.ServerName == cfg.Matrix.ServerName {
+		for _, oldVerifyKey := range cfg.Matrix.OldVerifyKeys {
+			keys.OldVerifyKeys[oldVerifyKey.KeyID] = gomatrixserverlib.OldVerifyKey{
+				VerifyKey: gomatrixserverlib.VerifyKey{
+					Key: gomatrixserverlib.Base64Bytes(oldVerifyKey.PrivateKey.Public().(ed25519.PublicKey)),
+				},
+				ExpiredTS: oldVerifyKey.ExpiredAt,
+			}
 		}
 	}
 
@@ -162,7 +173,7 @@ func localKeys(cfg *config.FederationAPI, validUntil time.Time) (*gomatrixserver
 	}
 
 	keys.Raw, err = gomatrixserverlib.SignJSON(
-		string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, toSign,
+		string(host.ServerName), host.KeyID, host.PrivateKey, toSign,
 	)
 	if err != nil {
 		return nil, err
@@ -190,8 +201,8 @@ func NotaryKeys(
 
 	for serverName := range req.ServerKeys {
 		var keys *gomatrixserverlib.ServerKeys
-		if serverName == cfg.Matrix.ServerName {
-			if k, err := localKeys(cfg, time.Now().Add(cfg.Matrix.KeyValidityPeriod)); err == nil {
+		if cfg.Matrix.IsLocalServerName(serverName) {
+			if k, err := localKeys(cfg, serverName); err == nil {
 				keys = k
 			} else {
 				return util.ErrorResponse(err)
@@ -0,0 +1,180 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxLagOrigins is the number of origins that federationLag keeps figures
+// for. Once it is reached the origin which was seen least recently is
+// forgotten to make room for a new one.
+const maxLagOrigins = 1000
+
+// federationLag keeps track of how far behind the events that each origin
+// sends us are. The origin lag is the time between the origin_server_ts of a
+// PDU and us receiving it, which is large when the remote server is slow to
+// send or has been catching up after an outage. The processing time is how
+// long we then took to process the transaction that it arrived in, which is
+// large when we are the ones who are slow.
+type federationLag struct {
+	mutex   sync.Mutex
+	origins map[gomatrixserverlib.ServerName]*originLag
+}
+
+type originLag struct {
+	Origin         gomatrixserverlib.ServerName `json:"origin"`
+	PDUs           int64                        `json:"pdus"`
+	Transactions   int64                        `json:"transactions"`
+	LastLagMS      int64                        `json:"last_lag_ms"`
+	MaxLagMS       int64                        `json:"max_lag_ms"`
+	AvgLagMS       int64                        `json:"avg_lag_ms"`
+	AvgProcessMS   int64                        `json:"avg_processing_ms"`
+	MaxProcessMS   int64                        `json:"max_processing_ms"`
+	LastSeenTS     gomatrixserverlib.Timestamp  `json:"last_seen_ts"`
+	totalLagMS     int64
+	totalProcessMS int64
+}
+
+func newFederationLag() *federationLag {
+	return &federationLag{
+		origins: make(map[gomatrixserverlib.ServerName]*originLag),
+	}
+}
+
+// origin returns the figures for the origin, creating them if needed. The
+// mutex must be held.
+func (l *federationLag) origin(origin gomatrixserverlib.ServerName, now time.Time) *originLag {
+	o, ok := l.origins[origin]
+	if !ok {
+		if len(l.origins) >= maxLagOrigins {
+			var oldest *originLag
+			for _, candidate := range l.origins {
+				if oldest == nil || candidate.LastSeenTS < oldest.LastSeenTS {
+					oldest = candidate
+				}
+			}
+			delete(l.origins, oldest.Origin)
+		}
+		o = &originLag{Origin: origin}
+		l.origins[origin] = o
+	}
+	o.LastSeenTS = gomatrixserverlib.AsTimestamp(now)
+	return o
+}
+
+// observePDU records the lag of a PDU from the origin which we received at
+// the given time. The lag can be negative if the clock of the origin is
+// ahead of ours.
+func (l *federationLag) observePDU(origin gomatrixserverlib.ServerName, originTS gomatrixserverlib.Timestamp, received time.Time) {
+	lag := received.Sub(originTS.Time())
+	originLagSeconds.WithLabelValues(string(origin)).Observe(lag.Seconds())
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	o := l.origin(origin, received)
+	lagMS := lag.Milliseconds()
+	o.PDUs++
+	o.LastLagMS = lagMS
+	o.totalLagMS += lagMS
+	o.AvgLagMS = o.totalLagMS / o.PDUs
+	if o.PDUs == 1 || lagMS > o.MaxLagMS {
+		o.MaxLagMS = lagMS
+	}
+}
+
+// observeTransaction records how long we took to process a transaction from
+// the origin.
+func (l *federationLag) observeTransaction(origin gomatrixserverlib.ServerName, received time.Time, took time.Duration) {
+	transactionProcessingSeconds.WithLabelValues(string(origin)).Observe(took.Seconds())
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	o := l.origin(origin, received)
+	tookMS := took.Milliseconds()
+	o.Transactions++
+	o.totalProcessMS += tookMS
+	o.AvgProcessMS = o.totalProcessMS / o.Transactions
+	if tookMS > o.MaxProcessMS {
+		o.MaxProcessMS = tookMS
+	}
+}
+
+// report returns the figures for every origin, the most lagged first.
+func (l *federationLag) report() []originLag {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	report := make([]originLag, 0, len(l.origins))
+	for _, o := range l.origins {
+		report = append(report, *o)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].AvgLagMS != report[j].AvgLagMS {
+			return report[i].AvgLagMS > report[j].AvgLagMS
+		}
+		return report[i].Origin < report[j].Origin
+	})
+	return report
+}
+
+var lagBuckets = []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+var originLagSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "origin_lag_seconds",
+		Help:      "The time between the origin_server_ts of a received PDU and us receiving it, by origin",
+		Buckets:   lagBuckets,
+	},
+	[]string{"origin"},
+)
+
+var transactionProcessingSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "transaction_processing_seconds",
+		Help:      "How long it took to process a received transaction, by origin",
+		Buckets:   lagBuckets,
+	},
+	[]string{"origin"},
+)
+
+func init() {
+	prometheus.MustRegister(originLagSeconds, transactionProcessingSeconds)
+}
+
+type federationLagResponse struct {
+	Origins []originLag `json:"origins"`
+}
+
+// AdminFederationLag implements GET /_dendrite/admin/v1/federationLag, which reports the
+// lag of the events received from each server since we started.
+func AdminFederationLag(
+	req *http.Request, lag *federationLag,
+) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationLagResponse{Origins: lag.report()},
+	}
+}
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestFederationLag(t *testing.T) {
+	lag := newFederationLag()
+	now := time.Now()
+	ts := func(ago time.Duration) gomatrixserverlib.Timestamp {
+		return gomatrixserverlib.AsTimestamp(now.Add(-ago))
+	}
+
+	lag.observePDU("slow.com", ts(10*time.Second), now)
+	lag.observePDU("slow.com", ts(30*time.Second), now)
+	lag.observeTransaction("slow.com", now, 100*time.Millisecond)
+	lag.observePDU("fast.com", ts(time.Second), now)
+	lag.observeTransaction("fast.com", now, 3*time.Second)
+
+	report := lag.report()
+	if len(report) != 2 {
+		t.Fatalf("got %d origins want 2", len(report))
+	}
+	slow, fast := report[0], report[1]
+	if slow.Origin != "slow.com" || fast.Origin != "fast.com" {
+		t.Fatalf("got origins %s, %s want the most lagged first", slow.Origin, fast.Origin)
+	}
+	if slow.PDUs != 2 || slow.AvgLagMS != 20000 || slow.MaxLagMS != 30000 || slow.LastLagMS != 30000 {
+		t.Errorf("slow.com: got %+v", slow)
+	}
+	if fast.Transactions != 1 || fast.AvgProcessMS != 3000 || fast.MaxProcessMS != 3000 {
+		t.Errorf("fast.com: got %+v", fast)
+	}
+}
+
+func TestFederationLagForgetsOldestOrigin(t *testing.T) {
+	lag := newFederationLag()
+	now := time.Now()
+	for i := 0; i < maxLagOrigins; i++ {
+		origin := gomatrixserverlib.ServerName(time.Duration(i).String())
+		lag.observeTransaction(origin, now.Add(time.Duration(i)*time.Second), time.Millisecond)
+	}
+	lag.observeTransaction("new.com", now.Add(time.Hour), time.Millisecond)
+	if len(lag.origins) != maxLagOrigins {
+		t.Fatalf("got %d origins want %d", len(lag.origins), maxLagOrigins)
+	}
+	if _, ok := lag.origins["0s"]; ok {
+		t.Fatalf("the origin seen least recently should have been forgotten")
+	}
+	if _, ok := lag.origins["new.com"]; !ok {
+		t.Fatalf("the new origin should be tracked")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// inboundLimits applies the configured limits to the transactions that
+// other servers send us. The transaction rate is tracked in the same way
+// as the client API rate limits: each origin has a channel with a slot for
+// every transaction it can send per minute, and each slot is freed a minute
+// after it was taken.
+type inboundLimits struct {
+	cfg          *config.FederationInboundLimits
+	period       time.Duration
+	origins      map[gomatrixserverlib.ServerName]chan struct{}
+	originsMutex sync.RWMutex
+	cleanMutex   sync.RWMutex
+}
+
+func newInboundLimits(cfg *config.FederationInboundLimits) *inboundLimits {
+	l := &inboundLimits{
+		cfg:     cfg,
+		period:  time.Minute,
+		origins: make(map[gomatrixserverlib.ServerName]chan struct{}),
+	}
+	if cfg.Enabled {
+		go l.clean()
+	}
+	return l
+}
+
+func (l *inboundLimits) clean() {
+	for {
+		// Every so often, delete the channels of any origins which haven't
+		// sent us a transaction in the last period so they don't build up.
+		time.Sleep(l.period * 2)
+		l.cleanMutex.Lock()
+		l.originsMutex.Lock()
+		for origin, c := range l.origins {
+			if len(c) == 0 {
+				close(c)
+				delete(l.origins, origin)
+			}
+		}
+		l.originsMutex.Unlock()
+		l.cleanMutex.Unlock()
+	}
+}
+
+// limitBody rejects request bodies that are larger than any origin is
+// allowed to send, before they are read into memory to verify the request
+// signature. The origin isn't known until the signature has been verified,
+// so checkTransaction still applies the limit for the specific origin.
+func (l *inboundLimits) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		max := l.maxTransactionBytes()
+		if max == 0 || req.Body == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, max))
+		if err != nil {
+			res := l.tooLarge(max)
+			w.Header().Set("Content-Type", "application/json")
+			util.SetCORSHeaders(w)
+			w.WriteHeader(res.Code)
+			_ = json.NewEncoder(w).Encode(res.JSON)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, req)
+	})
+}
+
+// maxTransactionBytes returns the largest transaction that any origin can
+// send, or 0 if the limits are disabled or there is an origin without a
+// size limit.
+func (l *inboundLimits) maxTransactionBytes() int64 {
+	if !l.cfg.Enabled {
+		return 0
+	}
+	max := l.cfg.MaxTransactionBytes
+	for _, limits := range l.cfg.Overrides {
+		if max == 0 || limits.MaxTransactionBytes == 0 {
+			return 0
+		}
+		if limits.MaxTransactionBytes > max {
+			max = limits.MaxTransactionBytes
+		}
+	}
+	return max
+}
+
+// checkTransaction returns an error response if the transaction from the
+// given origin goes over its limits. The size and PDU count are checked
+// first so that transactions which would be rejected anyway don't use up
+// the rate limit.
+func (l *inboundLimits) checkTransaction(
+	origin gomatrixserverlib.ServerName, content []byte,
+) *util.JSONResponse {
+	if !l.cfg.Enabled {
+		return nil
+	}
+	limits := l.cfg.ForOrigin(origin)
+	if max := limits.MaxTransactionBytes; max > 0 && int64(len(content)) > max {
+		return l.tooLarge(max)
+	}
+	if max := limits.MaxPDUsPerTransaction; max > 0 && gjson.GetBytes(content, "pdus.#").Int() > max {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(fmt.Sprintf("Transactions can contain at most %d PDUs", max)),
+		}
+	}
+	if limits.TransactionsPerMinute > 0 {
+		return l.rateLimit(origin, limits.TransactionsPerMinute)
+	}
+	return nil
+}
+
+func (l *inboundLimits) tooLarge(max int64) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusRequestEntityTooLarge,
+		JSON: jsonerror.TooLarge(fmt.Sprintf("Transactions can be at most %d bytes", max)),
+	}
+}
+
+func (l *inboundLimits) rateLimit(
+	origin gomatrixserverlib.ServerName, threshold int64,
+) *util.JSONResponse {
+	// Stop the cleaner from closing the channel while we're using it.
+	l.cleanMutex.RLock()
+	defer l.cleanMutex.RUnlock()
+
+	l.originsMutex.RLock()
+	slots, ok := l.origins[origin]
+	l.originsMutex.RUnlock()
+
+	if !ok {
+		l.originsMutex.Lock()
+		if slots, ok = l.origins[origin]; !ok {
+			slots = make(chan struct{}, threshold)
+			l.origins[origin] = slots
+		}
+		l.originsMutex.Unlock()
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded(
+				fmt.Sprintf("Servers can send at most %d transactions per minute", threshold),
+				l.period.Milliseconds(),
+			),
+		}
+	}
+
+	go func() {
+		<-time.After(l.period)
+		<-slots
+	}()
+	return nil
+}
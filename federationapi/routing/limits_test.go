@@ -0,0 +1,153 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestInboundLimits(t *testing.T) {
+	cfg := &config.FederationInboundLimits{
+		Enabled: true,
+		InboundLimits: config.InboundLimits{
+			MaxTransactionBytes:   10,
+			MaxPDUsPerTransaction: 2,
+			TransactionsPerMinute: 2,
+		},
+		Overrides: map[gomatrixserverlib.ServerName]config.InboundLimits{
+			"trusted.com": {
+				TransactionsPerMinute: 3,
+			},
+		},
+	}
+	limits := newInboundLimits(cfg)
+	small := []byte("{}")
+
+	// Both servers can send as many transactions as their limits allow, and
+	// are then rate limited.
+	for origin, allowed := range map[gomatrixserverlib.ServerName]int{
+		"other.com":   2,
+		"trusted.com": 3,
+	} {
+		for i := 0; i < allowed; i++ {
+			if res := limits.checkTransaction(origin, small); res != nil {
+				t.Fatalf("%s: transaction %d was limited: %+v", origin, i, res.JSON)
+			}
+		}
+		if res := limits.checkTransaction(origin, small); res == nil || res.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s: expected transaction %d to be rate limited, got %+v", origin, allowed, res)
+		}
+	}
+
+	large := []byte("{\"pdus\": []}")
+	if res := limits.checkTransaction("another.com", large); res == nil || res.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected large transaction to be rejected, got %+v", res)
+	}
+
+	// The override replaces all of the limits, so the trusted server isn't
+	// limited by size or PDU count, only by its rate limit.
+	if res := limits.checkTransaction("trusted.com", []byte(`{"pdus":[{},{},{}]}`)); res == nil || res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected trusted server to only be rate limited, got %+v", res)
+	}
+
+	cfg.Enabled = false
+	if res := limits.checkTransaction("other.com", large); res != nil {
+		t.Fatalf("expected no limits when disabled, got %+v", res.JSON)
+	}
+}
+
+func TestInboundLimitsPDUsBeforeRateLimit(t *testing.T) {
+	cfg := &config.FederationInboundLimits{
+		Enabled: true,
+		InboundLimits: config.InboundLimits{
+			MaxPDUsPerTransaction: 2,
+			TransactionsPerMinute: 1,
+		},
+	}
+	limits := newInboundLimits(cfg)
+
+	// Transactions with too many PDUs are rejected without using up the
+	// rate limit.
+	for i := 0; i < 3; i++ {
+		if res := limits.checkTransaction("other.com", []byte(`{"pdus":[{},{},{}]}`)); res == nil || res.Code != http.StatusBadRequest {
+			t.Fatalf("expected transaction with 3 PDUs to be rejected, got %+v", res)
+		}
+	}
+	if res := limits.checkTransaction("other.com", []byte(`{"pdus":[{},{}]}`)); res != nil {
+		t.Fatalf("expected transaction with 2 PDUs to be allowed, got %+v", res.JSON)
+	}
+	if res := limits.checkTransaction("other.com", []byte(`{"pdus":[]}`)); res == nil || res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected transaction to be rate limited, got %+v", res)
+	}
+}
+
+func TestInboundLimitsBody(t *testing.T) {
+	cfg := &config.FederationInboundLimits{
+		Enabled: true,
+		InboundLimits: config.InboundLimits{
+			MaxTransactionBytes: 10,
+		},
+		Overrides: map[gomatrixserverlib.ServerName]config.InboundLimits{
+			"trusted.com": {
+				MaxTransactionBytes: 20,
+			},
+		},
+	}
+	limits := newInboundLimits(cfg)
+	var got []byte
+	handler := limits.limitBody(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		if got, err = ioutil.ReadAll(req.Body); err != nil {
+			t.Fatalf("failed to read body: %s", err)
+		}
+	}))
+
+	// The body is limited to the largest limit of any origin, since we
+	// don't know the origin until the request has been verified.
+	for body, wantCode := range map[string]int{
+		strings.Repeat("a", 20): http.StatusOK,
+		strings.Repeat("a", 21): http.StatusRequestEntityTooLarge,
+	} {
+		got = nil
+		req := httptest.NewRequest(http.MethodPut, "/send/1", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != wantCode {
+			t.Errorf("body of %d bytes: got code %d, want %d", len(body), rec.Code, wantCode)
+		}
+		if wantCode == http.StatusOK && string(got) != body {
+			t.Errorf("body of %d bytes: handler got body %q", len(body), got)
+		}
+		if wantCode != http.StatusOK && got != nil {
+			t.Errorf("body of %d bytes: handler was called", len(body))
+		}
+	}
+
+	// An origin without a size limit means that the body can't be limited.
+	cfg.Overrides["unlimited.com"] = config.InboundLimits{}
+	req := httptest.NewRequest(http.MethodPut, "/send/1", strings.NewReader(strings.Repeat("a", 100)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || len(got) != 100 {
+		t.Errorf("expected body to be unlimited, got code %d and %d bytes", rec.Code, len(got))
+	}
+}
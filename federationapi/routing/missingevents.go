@@ -26,9 +26,16 @@ type getMissingEventRequest struct {
 	EarliestEvents []string `json:"earliest_events"`
 	LatestEvents   []string `json:"latest_events"`
 	Limit          int      `json:"limit"`
-	MinDepth       int64    `json:"min_depth"` // not used
+	MinDepth       int64    `json:"min_depth"`
 }
 
+const (
+	// The number of missing events to return if the request doesn't say.
+	defaultMissingEventsLimit = 10
+	// The most missing events that we'll return in one response.
+	maxMissingEventsLimit = 20
+)
+
 // GetMissingEvents returns missing events between earliest_events & latest_events.
 // Events are fetched from room DAG starting from latest_events until we reach earliest_events or the limit.
 func GetMissingEvents(
@@ -45,12 +52,19 @@ func GetMissingEvents(
 		}
 	}
 
+	if gme.Limit <= 0 {
+		gme.Limit = defaultMissingEventsLimit
+	} else if gme.Limit > maxMissingEventsLimit {
+		gme.Limit = maxMissingEventsLimit
+	}
+
 	var eventsResponse api.QueryMissingEventsResponse
 	if err := rsAPI.QueryMissingEvents(
 		httpReq.Context(), &api.QueryMissingEventsRequest{
 			EarliestEvents: gme.EarliestEvents,
 			LatestEvents:   gme.LatestEvents,
 			Limit:          gme.Limit,
+			MinDepth:       gme.MinDepth,
 			ServerName:     request.Origin(),
 		},
 		&eventsResponse,
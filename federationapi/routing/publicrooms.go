@@ -3,6 +3,7 @@ package routing
 import (
 	"context"
 	"net/http"
+	"sort"
 	"strconv"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -136,8 +137,13 @@ func fillInRooms(ctx context.Context, roomIDs []string, rsAPI roomserverAPI.Room
 	}
 	util.GetLogger(ctx).Infof("room IDs: %+v", roomIDs)
 	util.GetLogger(ctx).Infof("State res: %+v", stateRes.Rooms)
-	chunk := make([]gomatrixserverlib.PublicRoom, len(roomIDs))
-	i := 0
+	// Keep the rooms in the order that they were requested in, which is
+	// ordered by joined member count.
+	roomIndexes := make(map[string]int, len(roomIDs))
+	for i, roomID := range roomIDs {
+		roomIndexes[roomID] = i
+	}
+	chunk := make([]gomatrixserverlib.PublicRoom, 0, len(roomIDs))
 	for roomID, data := range stateRes.Rooms {
 		pub := gomatrixserverlib.PublicRoom{
 			RoomID: roomID,
@@ -171,8 +177,10 @@ func fillInRooms(ctx context.Context, roomIDs []string, rsAPI roomserverAPI.Room
 			pub.GuestCanJoin = true
 		}
 		pub.JoinedMembersCount = joinCount
-		chunk[i] = pub
-		i++
+		chunk = append(chunk, pub)
 	}
+	sort.SliceStable(chunk, func(i, j int) bool {
+		return roomIndexes[chunk[i].RoomID] < roomIndexes[chunk[j].RoomID]
+	})
 	return chunk, nil
 }
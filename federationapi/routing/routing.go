@@ -30,7 +30,8 @@ import (
 	"github.com/matrix-org/util"
 )
 
-// Setup registers HTTP handlers with the given ServeMux.
+// Setup registers HTTP handlers with the given ServeMux. The csMux is only used
+// for admin endpoints which report on the federation traffic that we receive.
 // The provided publicAPIMux MUST have `UseEncodedPath()` enabled or else routes will incorrectly
 // path unescape twice (once from the router, once from MakeFedAPI). We need to have this enabled
 // so we can decode paths like foo/bar%2Fbaz as [foo, bar/baz] - by default it will decode to [foo, bar, baz]
@@ -39,7 +40,7 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	fedMux, keyMux *mux.Router,
+	fedMux, keyMux, dendriteAdminMux *mux.Router,
 	cfg *config.FederationAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	eduAPI eduserverAPI.EDUServerInputAPI,
@@ -56,9 +57,11 @@ func Setup(
 	wakeup := &httputil.FederationWakeups{
 		FsAPI: fsAPI,
 	}
+	limits := newInboundLimits(&cfg.InboundLimits)
+	lag := newFederationLag()
 
 	localKeys := httputil.MakeExternalAPI("localkeys", func(req *http.Request) util.JSONResponse {
-		return LocalKeys(cfg)
+		return LocalKeys(cfg, cfg.Matrix.ServerNameForHost(req.Host))
 	})
 
 	notaryKeys := httputil.MakeExternalAPI("notarykeys", func(req *http.Request) util.JSONResponse {
@@ -91,18 +94,27 @@ func Setup(
 	v2keysmux.Handle("/query", notaryKeys).Methods(http.MethodPost)
 	v2keysmux.Handle("/query/{serverName}/{keyID}", notaryKeys).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/send/{txnID}", httputil.MakeFedAPI(
-		"federation_send", cfg.Matrix.ServerName, keys, wakeup,
+	dendriteAdminMux.PathPrefix("/v1").Subrouter().Handle("/federationLag",
+		httputil.MakeAdminAPI("admin_federation_lag", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminFederationLag(req, lag)
+		}),
+	).Methods(http.MethodGet)
+
+	v1fedmux.Handle("/send/{txnID}", limits.limitBody(httputil.MakeFedAPI(
+		"federation_send", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if r := limits.checkTransaction(request.Origin(), request.Content()); r != nil {
+				return *r
+			}
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, eduAPI, keyAPI, keys, federation,
+				cfg, rsAPI, eduAPI, keyAPI, keys, federation, lag,
 			)
 		},
-	)).Methods(http.MethodPut, http.MethodOptions)
+	))).Methods(http.MethodPut, http.MethodOptions)
 
 	v1fedmux.Handle("/invite/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_invite", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_invite", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -118,7 +130,7 @@ func Setup(
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v2fedmux.Handle("/invite/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_invite", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_invite", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -140,8 +152,14 @@ func Setup(
 	)).Methods(http.MethodPost, http.MethodOptions)
 
 	v1fedmux.Handle("/exchange_third_party_invite/{roomID}", httputil.MakeFedAPI(
-		"exchange_third_party_invite", cfg.Matrix.ServerName, keys, wakeup,
+		"exchange_third_party_invite", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+				}
+			}
 			return ExchangeThirdPartyInvite(
 				httpReq, request, vars["roomID"], rsAPI, cfg, federation,
 			)
@@ -149,7 +167,7 @@ func Setup(
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v1fedmux.Handle("/event/{eventID}", httputil.MakeFedAPI(
-		"federation_get_event", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_get_event", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetEvent(
 				httpReq.Context(), request, rsAPI, vars["eventID"], cfg.Matrix.ServerName,
@@ -158,7 +176,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/state/{roomID}", httputil.MakeFedAPI(
-		"federation_get_state", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_get_state", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -173,7 +191,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/state_ids/{roomID}", httputil.MakeFedAPI(
-		"federation_get_state_ids", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_get_state_ids", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -188,7 +206,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/event_auth/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_get_event_auth", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_get_event_auth", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -203,7 +221,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/query/directory", httputil.MakeFedAPI(
-		"federation_query_room_alias", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_query_room_alias", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return RoomAliasToID(
 				httpReq, federation, cfg, rsAPI, fsAPI,
@@ -212,7 +230,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/query/profile", httputil.MakeFedAPI(
-		"federation_query_profile", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_query_profile", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetProfile(
 				httpReq, userAPI, cfg,
@@ -221,7 +239,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/user/devices/{userID}", httputil.MakeFedAPI(
-		"federation_user_devices", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_user_devices", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetUserDevices(
 				httpReq, keyAPI, vars["userID"],
@@ -230,7 +248,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/make_join/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_make_join", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_make_join", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -261,7 +279,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/send_join/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_send_join", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_send_join", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -293,7 +311,7 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v2fedmux.Handle("/send_join/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_send_join", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_send_join", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -310,7 +328,7 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v1fedmux.Handle("/make_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_make_leave", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_make_leave", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -327,7 +345,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/send_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_send_leave", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -359,7 +377,7 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v2fedmux.Handle("/send_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_send_leave", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -383,7 +401,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/get_missing_events/{roomID}", httputil.MakeFedAPI(
-		"federation_get_missing_events", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_get_missing_events", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -396,7 +414,7 @@ func Setup(
 	)).Methods(http.MethodPost)
 
 	v1fedmux.Handle("/backfill/{roomID}", httputil.MakeFedAPI(
-		"federation_backfill", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_backfill", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -415,14 +433,14 @@ func Setup(
 	).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/user/keys/claim", httputil.MakeFedAPI(
-		"federation_keys_claim", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_keys_claim", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return ClaimOneTimeKeys(httpReq, request, keyAPI, cfg.Matrix.ServerName)
 		},
 	)).Methods(http.MethodPost)
 
 	v1fedmux.Handle("/user/keys/query", httputil.MakeFedAPI(
-		"federation_keys_query", cfg.Matrix.ServerName, keys, wakeup,
+		"federation_keys_query", cfg.Matrix, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return QueryDeviceKeys(httpReq, request, keyAPI, cfg.Matrix.ServerName)
 		},
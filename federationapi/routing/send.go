@@ -33,6 +33,11 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// remoteTypingTimeoutMS is how long a remote user is shown as typing for.
+// Typing EDUs don't say how long they last for, so servers keep sending them
+// while their users are still typing, which Synapse does every 40 seconds.
+const remoteTypingTimeoutMS = 60 * 1000
+
 // Send implements /_matrix/federation/v1/send/{txnID}
 func Send(
 	httpReq *http.Request,
@@ -44,7 +49,9 @@ func Send(
 	keyAPI keyapi.KeyInternalAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	federation *gomatrixserverlib.FederationClient,
+	lag *federationLag,
 ) util.JSONResponse {
+	received := time.Now()
 	t := txnReq{
 		rsAPI:      rsAPI,
 		eduAPI:     eduAPI,
@@ -53,6 +60,8 @@ func Send(
 		haveEvents: make(map[string]*gomatrixserverlib.HeaderedEvent),
 		newEvents:  make(map[string]bool),
 		keyAPI:     keyAPI,
+		lag:        lag,
+		received:   received,
 	}
 
 	var txnEvents struct {
@@ -85,6 +94,7 @@ func Send(
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q from %q containing %d PDUs, %d EDUs", txnID, request.Origin(), len(t.PDUs), len(t.EDUs))
 
 	resp, jsonErr := t.processTransaction(httpReq.Context())
+	lag.observeTransaction(t.Origin, received, time.Since(received))
 	if jsonErr != nil {
 		util.GetLogger(httpReq.Context()).WithField("jsonErr", jsonErr).Error("t.processTransaction failed")
 		return *jsonErr
@@ -113,6 +123,9 @@ type txnReq struct {
 	// new events which the roomserver does not know about
 	newEvents      map[string]bool
 	newEventsMutex sync.RWMutex
+	// if set, the lag of the PDUs in the transaction is recorded in it
+	lag      *federationLag
+	received time.Time
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -179,6 +192,9 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 			}
 			continue
 		}
+		if t.lag != nil {
+			t.lag.observePDU(t.Origin, event.OriginServerTS(), t.received)
+		}
 		pdus = append(pdus, event.Headered(verRes.RoomVersion))
 	}
 
@@ -301,7 +317,11 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 				util.GetLogger(ctx).Warnf("Dropping typing event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
 				continue
 			}
-			if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
+			if api.IsServerBannedFromRoom(ctx, t.rsAPI, typingPayload.RoomID, t.Origin) {
+				util.GetLogger(ctx).Debugf("Dropping typing event in room %q forbidden by server ACLs", typingPayload.RoomID)
+				continue
+			}
+			if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, remoteTypingTimeoutMS); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("Failed to send typing event to edu server")
 			}
 		case gomatrixserverlib.MDirectToDevice:
@@ -335,6 +355,10 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 			}
 
 			for roomID, receipt := range payload {
+				if api.IsServerBannedFromRoom(ctx, t.rsAPI, roomID, t.Origin) {
+					util.GetLogger(ctx).Debugf("Dropping receipt events in room %q forbidden by server ACLs", roomID)
+					continue
+				}
 				for userID, mread := range receipt.User {
 					_, domain, err := gomatrixserverlib.SplitID('@', userID)
 					if err != nil {
@@ -668,7 +692,21 @@ func (t *txnReq) processEventWithMissingState(ctx context.Context, e *gomatrixse
 		context.Background(),
 		t.rsAPI,
 		api.KindOld,
-		append(headeredNewEvents, e.Headered(roomVersion)),
+		headeredNewEvents,
+		api.DoNotSendToOtherServers,
+		nil,
+	); err != nil {
+		return fmt.Errorf("api.SendEvents: %w", err)
+	}
+
+	// Finally, now that the gap has been filled in, retry the event that we
+	// originally received. This is sent as a new event so that it updates the
+	// forward extremities of the room and is passed on to clients as usual.
+	if err = api.SendEvents(
+		context.Background(),
+		t.rsAPI,
+		api.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{e.Headered(roomVersion)},
 		api.DoNotSendToOtherServers,
 		nil,
 	); err != nil {
@@ -298,6 +298,14 @@ func (t *testRoomserverAPI) QueryCurrentState(ctx context.Context, req *api.Quer
 	return nil
 }
 
+func (t *testRoomserverAPI) QueryNotificationContext(ctx context.Context, req *api.QueryNotificationContextRequest, res *api.QueryNotificationContextResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryRoomUsage(ctx context.Context, req *api.QueryRoomUsageRequest, res *api.QueryRoomUsageResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
 func (t *testRoomserverAPI) QueryRoomsForUser(ctx context.Context, req *api.QueryRoomsForUserRequest, res *api.QueryRoomsForUserResponse) error {
 	return fmt.Errorf("not implemented")
 }
@@ -556,6 +564,9 @@ func TestTransactionFetchMissingPrevEvents(t *testing.T) {
 	txn := mustCreateTransaction(rsAPI, cli, pdus)
 	mustProcessTransaction(t, txn, nil)
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{prevEvent, inputEvent})
+	if len(rsAPI.inputRoomEvents) == 2 && rsAPI.inputRoomEvents[1].Kind != api.KindNew {
+		t.Errorf("expected the original event to be sent as a new event, got kind %d", rsAPI.inputRoomEvents[1].Kind)
+	}
 }
 
 // The purpose of this test is to check that when there are missing prev_events and we still haven't been able to fill
@@ -742,3 +753,29 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	mustProcessTransaction(t, txn, nil)
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
+
+// The purpose of this test is to check that typing EDUs are passed on to the EDU server with a timeout, as they don't
+// say how long they last for, and that typing EDUs for users on other servers are dropped.
+func TestTransactionTypingEDUs(t *testing.T) {
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.EDUs = []gomatrixserverlib.EDU{
+		{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"!room:kaer.morhen","user_id":"@alice:kaer.morhen","typing":true}`),
+		},
+		{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"!room:kaer.morhen","user_id":"@bob:other.server","typing":true}`),
+		},
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	invocations := txn.eduAPI.(*testEDUProducer).invocations
+	if len(invocations) != 1 {
+		t.Fatalf("expected one typing event to be sent to the EDU server, got %d", len(invocations))
+	}
+	ite := invocations[0].InputTypingEvent
+	if ite.UserID != "@alice:kaer.morhen" || !ite.Typing || ite.TimeoutMS != remoteTypingTimeoutMS {
+		t.Errorf("got unexpected typing event %+v", ite)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -25,6 +26,44 @@ type FederationClient interface {
 	LookupServerKeys(ctx context.Context, s gomatrixserverlib.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) ([]gomatrixserverlib.ServerKeys, error)
 }
 
+// RespMSC3030TimestampToEvent is the response to a remote server's MSC3030
+// /timestamp_to_event endpoint, which gomatrixserverlib doesn't support yet.
+type RespMSC3030TimestampToEvent struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// MSC2946StrippedEvent is a m.space.child event in the children_state of a
+// room in a space hierarchy.
+type MSC2946StrippedEvent struct {
+	Type           string                      `json:"type"`
+	StateKey       string                      `json:"state_key"`
+	Content        json.RawMessage             `json:"content"`
+	Sender         string                      `json:"sender"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// MSC2946Room is the summary of a room in a space hierarchy.
+type MSC2946Room struct {
+	gomatrixserverlib.PublicRoom
+	JoinRule string `json:"join_rule,omitempty"`
+	RoomType string `json:"room_type,omitempty"`
+	// The m.space.child events of the room. Rooms returned as children over
+	// federation may leave this out.
+	ChildrenState []MSC2946StrippedEvent `json:"children_state"`
+	// The rooms that users must be joined to in order to join a room with a
+	// restricted join rule.
+	AllowedRoomIDs []string `json:"allowed_room_ids,omitempty"`
+}
+
+// RespMSC2946Hierarchy is the response to a remote server's MSC2946
+// /hierarchy endpoint, which gomatrixserverlib doesn't support yet.
+type RespMSC2946Hierarchy struct {
+	Room                 MSC2946Room   `json:"room"`
+	Children             []MSC2946Room `json:"children"`
+	InaccessibleChildren []string      `json:"inaccessible_children"`
+}
+
 // FederationClientError is returned from FederationClient methods in the event of a problem.
 type FederationClientError struct {
 	Err         string
@@ -40,6 +79,14 @@ func (e *FederationClientError) Error() string {
 type FederationSenderInternalAPI interface {
 	FederationClient
 
+	// MSC3030TimestampToEvent asks a remote server for the nearest event in a room to a point in time,
+	// in the direction "f" or "b". This isn't part of FederationClient as gomatrixserverlib doesn't support it.
+	MSC3030TimestampToEvent(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, dir string) (res RespMSC3030TimestampToEvent, err error)
+
+	// MSC2946Hierarchy asks a remote server for the summary of a space and its children. This isn't
+	// part of FederationClient as gomatrixserverlib doesn't support it.
+	MSC2946Hierarchy(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, suggestedOnly bool) (res RespMSC2946Hierarchy, err error)
+
 	// PerformDirectoryLookup looks up a remote room ID from a room alias.
 	PerformDirectoryLookup(
 		ctx context.Context,
@@ -85,11 +132,22 @@ type FederationSenderInternalAPI interface {
 		request *PerformBroadcastEDURequest,
 		response *PerformBroadcastEDUResponse,
 	) error
+
+	// QueryPeerLatency returns the recent results of probing the servers that we federate with the most.
+	QueryPeerLatency(
+		ctx context.Context,
+		request *QueryPeerLatencyRequest,
+		response *QueryPeerLatencyResponse,
+	) error
 }
 
 type PerformDirectoryLookupRequest struct {
 	RoomAlias  string                       `json:"room_alias"`
 	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// If set, the returned room ID is validated by asking the server to
+	// prepare a join for this user and verifying the signatures on the
+	// room's create event. A room ID which fails validation is an error.
+	UserID string `json:"user_id,omitempty"`
 }
 
 type PerformDirectoryLookupResponse struct {
@@ -108,6 +166,10 @@ type PerformJoinRequest struct {
 type PerformJoinResponse struct {
 	JoinedVia gomatrixserverlib.ServerName
 	LastError *gomatrix.HTTPError
+	// The reason that each server failed to complete the join, keyed by
+	// server name, so that callers can report on all attempts and not
+	// just the last one.
+	ServerErrors map[gomatrixserverlib.ServerName]string
 }
 
 type PerformLeaveRequest struct {
@@ -146,6 +208,56 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
 
+// QueryPeerLatencyRequest is a request to QueryPeerLatency
+type QueryPeerLatencyRequest struct {
+	// Only report on this server, if given.
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// QueryPeerLatencyResponse is a response to QueryPeerLatency
+type QueryPeerLatencyResponse struct {
+	// Whether federation_sender.latency_probe is enabled.
+	Enabled bool `json:"enabled"`
+	// Our own server, probed over federation in the same way as the others,
+	// which shows how slow we are to reply compared with our peers.
+	Local *PeerLatency `json:"local,omitempty"`
+	// The servers that we share the most rooms with, most rooms first.
+	Peers []PeerLatency `json:"peers"`
+}
+
+// PeerLatency is the recent history of probing a server.
+type PeerLatency struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// The number of rooms that we share with the server.
+	RoomCount int `json:"room_count"`
+	// Whether we have given up sending to the server.
+	Blacklisted bool `json:"blacklisted"`
+	// Whether we are backing off from sending to the server.
+	BackingOff bool `json:"backing_off"`
+	// The median round trip time of the probes which succeeded, in
+	// milliseconds, or 0 if none did.
+	MedianRTTMS int64 `json:"median_rtt_ms"`
+	// The fraction of probes whose server key fetch succeeded.
+	KeyFetchSuccessRate float64 `json:"key_fetch_success_rate"`
+	// The most recent probes, oldest first.
+	Probes []PeerProbe `json:"probes"`
+}
+
+// PeerProbe is the result of probing a server once. The round trip time is
+// measured by asking for the server version, after which the server's signing
+// keys are fetched directly from it.
+type PeerProbe struct {
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+	// The round trip time in milliseconds.
+	RTTMS int64 `json:"rtt_ms"`
+	// Why asking for the server version failed, if it did.
+	Error string `json:"error,omitempty"`
+	// How long fetching the server keys took in milliseconds.
+	KeyFetchMS int64 `json:"key_fetch_ms"`
+	// Why fetching the server keys failed, if it did.
+	KeyFetchError string `json:"key_fetch_error,omitempty"`
+}
+
 type PerformBroadcastEDURequest struct {
 }
 
@@ -80,6 +80,11 @@ func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		log.WithError(err).Errorf("failed to read device message from key change topic")
 		return nil
 	}
+	if m.DeviceID == "" {
+		// Cross-signing key changes aren't tied to a device, so there is no
+		// m.device_list_update to send for them.
+		return nil
+	}
 	logger := log.WithField("user_id", m.UserID)
 
 	// only send key change events which originated from us
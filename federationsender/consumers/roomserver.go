@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -37,6 +38,7 @@ type OutputRoomEventConsumer struct {
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
 	queues     *queue.OutgoingQueues
+	aclCache   caching.ServerACLCache
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -46,6 +48,7 @@ func NewOutputRoomEventConsumer(
 	queues *queue.OutgoingQueues,
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
+	aclCache caching.ServerACLCache,
 ) *OutputRoomEventConsumer {
 	consumer := internal.ContinualConsumer{
 		ComponentName:  "federationsender/roomserver",
@@ -59,6 +62,7 @@ func NewOutputRoomEventConsumer(
 		db:         store,
 		queues:     queues,
 		rsAPI:      rsAPI,
+		aclCache:   aclCache,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -93,6 +97,13 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 			}
 		}
 
+		// Forget what we knew about the server ACLs of the room if they have
+		// changed, so that the event isn't sent to servers that the new ACLs
+		// ban, or withheld from servers that they no longer do.
+		if output.NewRoomEvent.RewritesState || changesServerACLs(output.NewRoomEvent) {
+			s.aclCache.EvictServerACLs(ev.RoomID())
+		}
+
 		if err := s.processMessage(*output.NewRoomEvent); err != nil {
 			switch err.(type) {
 			case *queue.ErrorFederationDisabled:
@@ -363,3 +374,13 @@ func missingEventsFrom(events []*gomatrixserverlib.Event, required []string) []s
 	}
 	return missing
 }
+
+// changesServerACLs returns true if the event sets new server ACLs in its room.
+func changesServerACLs(ore *api.OutputNewRoomEvent) bool {
+	for _, ev := range ore.AddsState() {
+		if ev.Type() == "m.room.server_acl" && ev.StateKeyEquals("") {
+			return true
+		}
+	}
+	return false
+}
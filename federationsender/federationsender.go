@@ -15,11 +15,14 @@
 package federationsender
 
 import (
+	"context"
+
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/consumers"
 	"github.com/matrix-org/dendrite/federationsender/internal"
 	"github.com/matrix-org/dendrite/federationsender/inthttp"
+	"github.com/matrix-org/dendrite/federationsender/probe"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/statistics"
 	"github.com/matrix-org/dendrite/federationsender/storage"
@@ -70,7 +73,7 @@ func NewInternalAPI(
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
 		cfg, consumer, queues,
-		federationSenderDB, rsAPI,
+		federationSenderDB, rsAPI, base.Caches,
 	)
 	if err = rsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start room server consumer")
@@ -89,5 +92,14 @@ func NewInternalAPI(
 		logrus.WithError(err).Panic("failed to start key server consumer")
 	}
 
-	return internal.NewFederationSenderInternalAPI(federationSenderDB, cfg, rsAPI, federation, keyRing, stats, queues)
+	prober := probe.NewProber(cfg, federationSenderDB, federation, stats)
+	prober.Start()
+
+	intAPI := internal.NewFederationSenderInternalAPI(federationSenderDB, cfg, rsAPI, federation, keyRing, stats, queues, prober)
+
+	// Resume any federated joins that were interrupted, e.g. by a crash,
+	// so that users aren't left half-joined to rooms.
+	go intAPI.ResumeInFlightJoins(context.Background())
+
+	return intAPI
 }
@@ -2,10 +2,14 @@ package internal
 
 import (
 	"context"
+	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/probe"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/statistics"
 	"github.com/matrix-org/dendrite/federationsender/storage"
@@ -24,6 +28,7 @@ type FederationSenderInternalAPI struct {
 	federation *gomatrixserverlib.FederationClient
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
+	prober     *probe.Prober
 	joins      sync.Map // joins currently in progress
 }
 
@@ -34,6 +39,7 @@ func NewFederationSenderInternalAPI(
 	keyRing *gomatrixserverlib.KeyRing,
 	statistics *statistics.Statistics,
 	queues *queue.OutgoingQueues,
+	prober *probe.Prober,
 ) *FederationSenderInternalAPI {
 	return &FederationSenderInternalAPI{
 		db:         db,
@@ -43,6 +49,7 @@ func NewFederationSenderInternalAPI(
 		keyRing:    keyRing,
 		statistics: statistics,
 		queues:     queues,
+		prober:     prober,
 	}
 }
 
@@ -244,3 +251,55 @@ func (a *FederationSenderInternalAPI) MSC2836EventRelationships(
 	}
 	return ires.(gomatrixserverlib.MSC2836EventRelationshipsResponse), nil
 }
+
+func (a *FederationSenderInternalAPI) MSC3030TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, dir string,
+) (res api.RespMSC3030TimestampToEvent, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	ires, err := a.doRequest(s, func() (interface{}, error) {
+		path := "/_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/" + url.PathEscape(roomID) +
+			"?ts=" + strconv.FormatUint(uint64(ts), 10) + "&dir=" + url.QueryEscape(dir)
+		req := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+		if err := req.Sign(a.cfg.Matrix.ServerName, a.cfg.Matrix.KeyID, a.cfg.Matrix.PrivateKey); err != nil {
+			return nil, err
+		}
+		httpReq, err := req.HTTPRequest()
+		if err != nil {
+			return nil, err
+		}
+		var res api.RespMSC3030TimestampToEvent
+		err = a.federation.DoRequestAndParseResponse(ctx, httpReq, &res)
+		return res, err
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.RespMSC3030TimestampToEvent), nil
+}
+
+func (a *FederationSenderInternalAPI) MSC2946Hierarchy(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, suggestedOnly bool,
+) (res api.RespMSC2946Hierarchy, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	ires, err := a.doRequest(s, func() (interface{}, error) {
+		path := "/_matrix/federation/unstable/org.matrix.msc2946/hierarchy/" + url.PathEscape(roomID) +
+			"?suggested_only=" + strconv.FormatBool(suggestedOnly)
+		req := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+		if err := req.Sign(a.cfg.Matrix.ServerName, a.cfg.Matrix.KeyID, a.cfg.Matrix.PrivateKey); err != nil {
+			return nil, err
+		}
+		httpReq, err := req.HTTPRequest()
+		if err != nil {
+			return nil, err
+		}
+		var res api.RespMSC2946Hierarchy
+		err = a.federation.DoRequestAndParseResponse(ctx, httpReq, &res)
+		return res, err
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.RespMSC2946Hierarchy), nil
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/internal/perform"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrix"
@@ -32,12 +33,92 @@ func (r *FederationSenderInternalAPI) PerformDirectoryLookup(
 		r.statistics.ForServer(request.ServerName).Failure()
 		return err
 	}
+	r.statistics.ForServer(request.ServerName).Success()
+	if request.UserID != "" && dir.RoomID != "" {
+		if err = r.validateDirectoryRoomID(ctx, request.ServerName, dir.RoomID, request.UserID); err != nil {
+			return fmt.Errorf("room ID %q failed validation: %w", dir.RoomID, err)
+		}
+	}
 	response.RoomID = dir.RoomID
 	response.ServerNames = dir.Servers
-	r.statistics.ForServer(request.ServerName).Success()
 	return nil
 }
 
+// validateDirectoryRoomID checks that a room ID returned from a directory
+// lookup refers to a real room, by asking the server to prepare a join and
+// then verifying the signatures on the create event in the auth events.
+// This stops a misconfigured server from sending us off to join a room
+// that doesn't exist.
+func (r *FederationSenderInternalAPI) validateDirectoryRoomID(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	roomID, userID string,
+) error {
+	var supportedVersions []gomatrixserverlib.RoomVersion
+	for version := range version.SupportedRoomVersions() {
+		supportedVersions = append(supportedVersions, version)
+	}
+	respMakeJoin, err := r.federation.MakeJoin(ctx, serverName, roomID, userID, supportedVersions)
+	if err != nil {
+		return fmt.Errorf("r.federation.MakeJoin: %w", err)
+	}
+	if respMakeJoin.RoomVersion == "" {
+		respMakeJoin.RoomVersion = gomatrixserverlib.RoomVersionV1
+	}
+	if _, err = respMakeJoin.RoomVersion.EventFormat(); err != nil {
+		return fmt.Errorf("unsupported room version %q", respMakeJoin.RoomVersion)
+	}
+	_, createDomain, err := gomatrixserverlib.SplitID('!', roomID)
+	if err != nil {
+		return err
+	}
+
+	// The auth events are either a list of event IDs or a list of event
+	// references, depending on the room version.
+	authEventsJSON, err := json.Marshal(respMakeJoin.JoinEvent.AuthEvents)
+	if err != nil {
+		return err
+	}
+	var authEventIDs []string
+	if err = json.Unmarshal(authEventsJSON, &authEventIDs); err != nil {
+		var authEventRefs []gomatrixserverlib.EventReference
+		if err = json.Unmarshal(authEventsJSON, &authEventRefs); err != nil {
+			return fmt.Errorf("failed to parse auth events: %w", err)
+		}
+		for _, ref := range authEventRefs {
+			authEventIDs = append(authEventIDs, ref.EventID)
+		}
+	}
+
+	for _, authEventID := range authEventIDs {
+		txn, err := r.federation.GetEvent(ctx, serverName, authEventID)
+		if err != nil {
+			return fmt.Errorf("r.federation.GetEvent: %w", err)
+		}
+		for _, pdu := range txn.PDUs {
+			event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, respMakeJoin.RoomVersion)
+			if err != nil || event.Type() != gomatrixserverlib.MRoomCreate || !event.StateKeyEquals("") {
+				continue
+			}
+			if event.RoomID() != roomID {
+				return fmt.Errorf("create event belongs to room %q", event.RoomID())
+			}
+			_, senderDomain, err := gomatrixserverlib.SplitID('@', event.Sender())
+			if err != nil {
+				return err
+			}
+			if senderDomain != createDomain {
+				return fmt.Errorf("create event sender %q doesn't match room ID", event.Sender())
+			}
+			if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []*gomatrixserverlib.Event{event}, r.keyRing); err != nil {
+				return fmt.Errorf("gomatrixserverlib.VerifyAllEventSignatures: %w", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no create event found in auth events")
+}
+
 type federatedJoin struct {
 	UserID string
 	RoomID string
@@ -48,9 +129,44 @@ func (r *FederationSenderInternalAPI) PerformJoin(
 	ctx context.Context,
 	request *api.PerformJoinRequest,
 	response *api.PerformJoinResponse,
+) {
+	// Deduplicate the server names we were provided but keep the ordering
+	// as this encodes useful information about which servers are most likely
+	// to respond.
+	seenSet := make(map[gomatrixserverlib.ServerName]bool)
+	var uniqueList []gomatrixserverlib.ServerName
+	for _, srv := range request.ServerNames {
+		if seenSet[srv] {
+			continue
+		}
+		seenSet[srv] = true
+		uniqueList = append(uniqueList, srv)
+	}
+	request.ServerNames = uniqueList
+
+	// Persist the join so that, if we crash or restart before it has
+	// completed, we can resume it at startup rather than leaving the
+	// user half-joined.
+	r.performJoin(ctx, &types.InFlightJoin{
+		RoomID:      request.RoomID,
+		UserID:      request.UserID,
+		ServerNames: request.ServerNames,
+		Content:     request.Content,
+		Started:     gomatrixserverlib.AsTimestamp(time.Now()),
+	}, response)
+}
+
+// performJoin tries to join through each of the servers in the in-flight
+// join in turn. The in-flight join is stored as the join progresses, and is
+// removed once the join has been fully processed by the roomserver, if it
+// can never succeed, or if the join fails through every server.
+func (r *FederationSenderInternalAPI) performJoin(
+	ctx context.Context,
+	join *types.InFlightJoin,
+	response *api.PerformJoinResponse,
 ) {
 	// Check that a join isn't already in progress for this user/room.
-	j := federatedJoin{request.UserID, request.RoomID}
+	j := federatedJoin{join.UserID, join.RoomID}
 	if _, found := r.joins.Load(j); found {
 		response.LastError = &gomatrix.HTTPError{
 			Code: 429,
@@ -70,36 +186,24 @@ func (r *FederationSenderInternalAPI) PerformJoin(
 		supportedVersions = append(supportedVersions, version)
 	}
 
-	// Deduplicate the server names we were provided but keep the ordering
-	// as this encodes useful information about which servers are most likely
-	// to respond.
-	seenSet := make(map[gomatrixserverlib.ServerName]bool)
-	var uniqueList []gomatrixserverlib.ServerName
-	for _, srv := range request.ServerNames {
-		if seenSet[srv] {
-			continue
-		}
-		seenSet[srv] = true
-		uniqueList = append(uniqueList, srv)
-	}
-	request.ServerNames = uniqueList
-
 	// Try each server that we were provided until we land on one that
 	// successfully completes the make-join send-join dance.
 	var lastErr error
-	for _, serverName := range request.ServerNames {
+	for _, serverName := range join.ServerNames {
 		if err := r.performJoinUsingServer(
 			ctx,
-			request.RoomID,
-			request.UserID,
-			request.Content,
+			join,
 			serverName,
 			supportedVersions,
 		); err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"server_name": serverName,
-				"room_id":     request.RoomID,
+				"room_id":     join.RoomID,
 			}).Warnf("Failed to join room through server")
+			if response.ServerErrors == nil {
+				response.ServerErrors = make(map[gomatrixserverlib.ServerName]string)
+			}
+			response.ServerErrors[serverName] = err.Error()
 			lastErr = err
 			continue
 		}
@@ -129,17 +233,133 @@ func (r *FederationSenderInternalAPI) PerformJoin(
 
 	logrus.Errorf(
 		"failed to join user %q to room %q through %d server(s): last error %s",
-		request.UserID, request.RoomID, len(request.ServerNames), lastErr,
+		join.UserID, join.RoomID, len(join.ServerNames), lastErr,
 	)
+
+	// The join has failed and the user has been told so, therefore there
+	// is nothing left to resume.
+	r.removeInFlightJoin(join.RoomID, join.UserID)
+}
+
+// maxInFlightJoinAttempts is how many times an interrupted join is resumed
+// before giving up on it.
+const maxInFlightJoinAttempts = 3
+
+// maxInFlightJoinAge is how long after an interrupted join was started that
+// it is given up on, as the user has most likely given up on it too.
+const maxInFlightJoinAge = 24 * time.Hour
+
+// ResumeInFlightJoins retries any federated joins which were started but
+// didn't complete, e.g. because the process was restarted mid-join.
+func (r *FederationSenderInternalAPI) ResumeInFlightJoins(ctx context.Context) {
+	joins, err := r.db.GetInFlightJoins(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get in-flight joins")
+		return
+	}
+	for i := range joins {
+		join := &joins[i]
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id":  join.RoomID,
+			"user_id":  join.UserID,
+			"progress": join.Progress,
+			"attempts": join.Attempts,
+		})
+		if join.Attempts >= maxInFlightJoinAttempts || time.Since(join.Started.Time()) > maxInFlightJoinAge {
+			logger.Warn("Giving up on interrupted federated join")
+			r.removeInFlightJoin(join.RoomID, join.UserID)
+			continue
+		}
+		if resume, rerr := r.stillWantsToJoin(ctx, join); rerr != nil {
+			// Try again at the next startup.
+			logger.WithError(rerr).Error("Failed to check membership for interrupted federated join")
+			continue
+		} else if !resume {
+			logger.Info("Not resuming interrupted federated join, as the user's membership has changed since")
+			r.removeInFlightJoin(join.RoomID, join.UserID)
+			continue
+		}
+		logger.Info("Resuming interrupted federated join")
+		join.Attempts++
+		response := api.PerformJoinResponse{}
+		r.performJoin(ctx, join, &response)
+		if response.LastError != nil {
+			logger.WithError(response.LastError).Error("Failed to resume federated join")
+		}
+	}
+}
+
+// stillWantsToJoin returns whether an interrupted join should be resumed. It
+// shouldn't be if the user is already in the room, or if their membership has
+// changed since the join was started, e.g. because they left again or were
+// banned.
+func (r *FederationSenderInternalAPI) stillWantsToJoin(ctx context.Context, join *types.InFlightJoin) (bool, error) {
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err := r.rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: join.RoomID,
+		UserID: join.UserID,
+	}, &membershipRes); err != nil {
+		return false, fmt.Errorf("r.rsAPI.QueryMembershipForUser: %w", err)
+	}
+	if membershipRes.IsInRoom {
+		return false, nil
+	}
+	if !membershipRes.HasBeenInRoom || membershipRes.EventID == "" {
+		return true, nil
+	}
+	var eventsRes roomserverAPI.QueryEventsByIDResponse
+	if err := r.rsAPI.QueryEventsByID(ctx, &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs: []string{membershipRes.EventID},
+	}, &eventsRes); err != nil {
+		return false, fmt.Errorf("r.rsAPI.QueryEventsByID: %w", err)
+	}
+	for _, ev := range eventsRes.Events {
+		if ev.OriginServerTS() > join.Started {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// updateJoinProgress persists how far through a federated join we are.
+// Failures are logged but are not fatal to the join itself.
+func (r *FederationSenderInternalAPI) updateJoinProgress(
+	join *types.InFlightJoin,
+	serverName gomatrixserverlib.ServerName,
+	progress types.JoinProgress,
+) {
+	join.ServerName = serverName
+	join.Progress = progress
+	if err := r.db.UpdateInFlightJoin(context.Background(), join); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"room_id":  join.RoomID,
+			"user_id":  join.UserID,
+			"progress": progress,
+		}).Error("Failed to update in-flight join")
+	}
+}
+
+// removeInFlightJoin forgets about a federated join once it no longer needs
+// to be resumed. Failures are logged, as the join will just be retried at
+// the next startup.
+func (r *FederationSenderInternalAPI) removeInFlightJoin(roomID, userID string) {
+	if err := r.db.RemoveInFlightJoin(context.Background(), roomID, userID); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"room_id": roomID,
+			"user_id": userID,
+		}).Error("Failed to remove in-flight join")
+	}
 }
 
 func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	ctx context.Context,
-	roomID, userID string,
-	content map[string]interface{},
+	join *types.InFlightJoin,
 	serverName gomatrixserverlib.ServerName,
 	supportedVersions []gomatrixserverlib.RoomVersion,
 ) error {
+	roomID, userID := join.RoomID, join.UserID
+	r.updateJoinProgress(join, serverName, types.JoinProgressMakeJoin)
+
 	// Try to perform a make_join using the information supplied in the
 	// request.
 	respMakeJoin, err := r.federation.MakeJoin(
@@ -163,8 +383,9 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	respMakeJoin.JoinEvent.StateKey = &userID
 	respMakeJoin.JoinEvent.RoomID = roomID
 	respMakeJoin.JoinEvent.Redacts = ""
-	if content == nil {
-		content = map[string]interface{}{}
+	content := map[string]interface{}{}
+	for k, v := range join.Content {
+		content[k] = v
 	}
 	content["membership"] = "join"
 	if err = respMakeJoin.JoinEvent.SetContent(content); err != nil {
@@ -196,6 +417,7 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	if err != nil {
 		return fmt.Errorf("respMakeJoin.JoinEvent.Build: %w", err)
 	}
+	r.updateJoinProgress(join, serverName, types.JoinProgressEventSigned)
 
 	// No longer reuse the request context from this point forward.
 	// We don't want the client timing out to interrupt the join.
@@ -203,6 +425,7 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	ctx, cancel = context.WithCancel(context.Background())
 
 	// Try to perform a send_join using the newly built event.
+	r.updateJoinProgress(join, serverName, types.JoinProgressSendJoin)
 	respSendJoin, err := r.federation.SendJoin(
 		ctx,
 		serverName,
@@ -223,6 +446,8 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 		return fmt.Errorf("sanityCheckSendJoinResponse: %w", err)
 	}
 
+	r.updateJoinProgress(join, serverName, types.JoinProgressProcessingState)
+
 	// Process the join response in a goroutine. The idea here is
 	// that we'll try and wait for as long as possible for the work
 	// to complete, but if the client does give up waiting, we'll
@@ -237,10 +462,13 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 			ctx, event, serverName, respMakeJoin, respSendJoin,
 		)
 		if err != nil {
+			// The response is invalid, e.g. the signatures don't check out,
+			// so processing it again would fail in the same way.
 			logrus.WithFields(logrus.Fields{
 				"room_id": roomID,
 				"user_id": userID,
 			}).WithError(err).Error("Failed to process room join response")
+			r.removeInFlightJoin(roomID, userID)
 			return
 		}
 
@@ -260,6 +488,11 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 			}).WithError(err).Error("Failed to send room join response to roomserver")
 			return
 		}
+
+		// Only now that the roomserver has the room state is the join
+		// complete. If the roomserver failed or we were interrupted before
+		// this point then the join will be resumed at the next startup.
+		r.removeInFlightJoin(roomID, userID)
 	}()
 
 	<-ctx.Done()
@@ -0,0 +1,309 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/statistics"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal/caching"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// joinTripper pretends to be the remote server for a federated join. The
+// make_join and send_join both succeed unless down is set, but the create
+// event isn't signed by a key that we know, so the send_join response is
+// always rejected once the join is being processed.
+type joinTripper struct {
+	t        *testing.T
+	db       storage.Database
+	create   *gomatrixserverlib.Event
+	down     bool
+	requests []string
+}
+
+func (j *joinTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	j.requests = append(j.requests, req.Method+" "+req.URL.Host+req.URL.Path)
+	// The join must be stored for as long as the join is in progress.
+	joins, err := j.db.GetInFlightJoins(req.Context())
+	if err != nil || len(joins) != 1 {
+		j.t.Errorf("expected one in-flight join during %s %s, got %v (err %v)", req.Method, req.URL.Path, joins, err)
+	}
+	var body interface{}
+	switch {
+	case j.down:
+		return j.respond(req, http.StatusServiceUnavailable, map[string]string{"errcode": "M_UNKNOWN"})
+	case strings.Contains(req.URL.Path, "/make_join/"):
+		body = map[string]interface{}{
+			"room_version": gomatrixserverlib.RoomVersionV6,
+			"event": map[string]interface{}{
+				"type":        gomatrixserverlib.MRoomMember,
+				"room_id":     j.create.RoomID(),
+				"sender":      "@alice:local",
+				"state_key":   "@alice:local",
+				"content":     map[string]string{"membership": "join"},
+				"prev_events": []string{j.create.EventID()},
+				"auth_events": []string{j.create.EventID()},
+				"depth":       2,
+			},
+		}
+	case strings.Contains(req.URL.Path, "/send_join/"):
+		body = map[string]interface{}{
+			"origin":     "remote1",
+			"state":      []json.RawMessage{j.create.JSON()},
+			"auth_chain": []json.RawMessage{j.create.JSON()},
+		}
+	default:
+		return j.respond(req, http.StatusNotFound, map[string]string{"errcode": "M_NOT_FOUND"})
+	}
+	return j.respond(req, http.StatusOK, body)
+}
+
+func (j *joinTripper) respond(req *http.Request, code int, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(string(data))),
+		Request:    req,
+	}, nil
+}
+
+// noKeys is a key database that doesn't know any keys.
+type noKeys struct{}
+
+func (noKeys) FetcherName() string { return "noKeys" }
+
+func (noKeys) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return nil, nil
+}
+
+func (noKeys) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+// membershipRoomserverAPI answers membership queries for the resumed join
+// with the given membership event, if any.
+type membershipRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	membership *gomatrixserverlib.Event
+	err        error
+}
+
+func (m *membershipRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse,
+) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.membership == nil {
+		return nil
+	}
+	membership, _ := m.membership.Membership()
+	res.HasBeenInRoom = true
+	res.IsInRoom = membership == gomatrixserverlib.Join
+	res.Membership = membership
+	res.EventID = m.membership.EventID()
+	return nil
+}
+
+func (m *membershipRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *roomserverAPI.QueryEventsByIDRequest, res *roomserverAPI.QueryEventsByIDResponse,
+) error {
+	if m.membership != nil {
+		res.Events = append(res.Events, m.membership.Headered(gomatrixserverlib.RoomVersionV6))
+	}
+	return nil
+}
+
+func mustCreateFederationSenderAPI(
+	t *testing.T, db storage.Database, rsAPI roomserverAPI.RoomserverInternalAPI, tripper *joinTripper,
+) *FederationSenderInternalAPI {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	transport := &http.Transport{}
+	transport.RegisterProtocol("matrix", tripper)
+	cfg := &config.FederationSender{
+		Matrix: &config.Global{ServerName: "local", KeyID: "ed25519:test", PrivateKey: key},
+	}
+	fedClient := gomatrixserverlib.NewFederationClientWithTransport("local", "ed25519:test", key, true, transport)
+	keyRing := &gomatrixserverlib.KeyRing{KeyDatabase: noKeys{}}
+	stats := &statistics.Statistics{DB: db, FailuresUntilBlacklist: 16}
+	return NewFederationSenderInternalAPI(db, cfg, rsAPI, fedClient, keyRing, stats, nil, nil)
+}
+
+func mustCreateDatabase(t *testing.T) storage.Database {
+	t.Helper()
+	cache, err := caching.NewInMemoryLRUCache(0, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "federationsender.db")),
+	}, cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	return db
+}
+
+func mustCreateEvent(
+	t *testing.T, eventType, sender string, stateKey *string, content interface{}, ts time.Time,
+) *gomatrixserverlib.Event {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   "!room:remote1",
+		Type:     eventType,
+		StateKey: stateKey,
+		Depth:    1,
+	}
+	if err = builder.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	event, err := builder.Build(ts, "remote1", "ed25519:remote", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build %s event: %s", eventType, err)
+	}
+	return event
+}
+
+func TestPerformJoinInvalidResponse(t *testing.T) {
+	db := mustCreateDatabase(t)
+	create := mustCreateEvent(t, gomatrixserverlib.MRoomCreate, "@bob:remote1", new(string), map[string]string{
+		"creator": "@bob:remote1", "room_version": "6",
+	}, time.Now())
+
+	// The send_join succeeds but its response can't be verified, so the
+	// join can never succeed and mustn't be resumed later.
+	tripper := &joinTripper{t: t, db: db, create: create}
+	fsAPI := mustCreateFederationSenderAPI(t, db, &membershipRoomserverAPI{}, tripper)
+	var res api.PerformJoinResponse
+	fsAPI.PerformJoin(context.Background(), &api.PerformJoinRequest{
+		RoomID:      "!room:remote1",
+		UserID:      "@alice:local",
+		ServerNames: types.ServerNames{"remote1"},
+		Content:     map[string]interface{}{"displayname": "Alice"},
+	}, &res)
+	if res.LastError != nil {
+		t.Fatalf("PerformJoin failed: %s", res.LastError)
+	}
+	joins, err := db.GetInFlightJoins(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get in-flight joins: %s", err)
+	}
+	if len(joins) != 0 {
+		t.Errorf("expected no in-flight joins after the send_join response was rejected, got %+v", joins)
+	}
+}
+
+func TestResumeInFlightJoin(t *testing.T) {
+	alice := "@alice:local"
+	started := time.Now().Add(-time.Hour)
+	membership := func(membership string, ts time.Time) *gomatrixserverlib.Event {
+		return mustCreateEvent(t, gomatrixserverlib.MRoomMember, alice, &alice, map[string]string{
+			"membership": membership,
+		}, ts)
+	}
+	wantRequest := fmt.Sprintf("GET remote1/_matrix/federation/v1/make_join/%s/%s", "!room:remote1", alice)
+
+	tests := []struct {
+		name       string
+		attempts   int
+		started    time.Time
+		membership *gomatrixserverlib.Event
+		queryErr   error
+		wantResume bool
+		wantKept   bool
+	}{
+		{name: "never in the room", started: started, wantResume: true},
+		{name: "left before the join started", started: started, membership: membership(gomatrixserverlib.Leave, started.Add(-time.Minute)), wantResume: true},
+		{name: "resumed too many times", attempts: maxInFlightJoinAttempts, started: started},
+		{name: "started too long ago", started: time.Now().Add(-maxInFlightJoinAge - time.Hour)},
+		{name: "already joined", started: started, membership: membership(gomatrixserverlib.Join, started.Add(time.Minute))},
+		{name: "left after the join started", started: started, membership: membership(gomatrixserverlib.Leave, started.Add(time.Minute))},
+		{name: "membership unknown", started: started, queryErr: fmt.Errorf("roomserver unavailable"), wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := mustCreateDatabase(t)
+			if err := db.UpdateInFlightJoin(context.Background(), &types.InFlightJoin{
+				RoomID:      "!room:remote1",
+				UserID:      alice,
+				ServerNames: types.ServerNames{"remote1"},
+				Content:     map[string]interface{}{"displayname": "Alice"},
+				ServerName:  "remote1",
+				Progress:    types.JoinProgressProcessingState,
+				Attempts:    tt.attempts,
+				Started:     gomatrixserverlib.AsTimestamp(tt.started),
+			}); err != nil {
+				t.Fatalf("failed to store in-flight join: %s", err)
+			}
+
+			// The remote server is down, so a resumed join fails altogether.
+			tripper := &joinTripper{t: t, db: db, down: true}
+			rsAPI := &membershipRoomserverAPI{membership: tt.membership, err: tt.queryErr}
+			fsAPI := mustCreateFederationSenderAPI(t, db, rsAPI, tripper)
+			fsAPI.ResumeInFlightJoins(context.Background())
+			if tt.wantResume {
+				if len(tripper.requests) != 1 || tripper.requests[0] != wantRequest {
+					t.Fatalf("resumed join made requests %v, want [%s]", tripper.requests, wantRequest)
+				}
+			} else if len(tripper.requests) != 0 {
+				t.Fatalf("join shouldn't have been resumed, but made requests %v", tripper.requests)
+			}
+
+			joins, err := db.GetInFlightJoins(context.Background())
+			if err != nil {
+				t.Fatalf("failed to get in-flight joins: %s", err)
+			}
+			if tt.wantKept {
+				if len(joins) != 1 || joins[0].Attempts != tt.attempts {
+					t.Errorf("expected the in-flight join to be kept as it was, got %+v", joins)
+				}
+			} else if len(joins) != 0 {
+				t.Errorf("expected no in-flight joins, got %+v", joins)
+			}
+		})
+	}
+}
@@ -20,3 +20,13 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 
 	return
 }
+
+// QueryPeerLatency implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryPeerLatency(
+	ctx context.Context,
+	request *api.QueryPeerLatencyRequest,
+	response *api.QueryPeerLatencyResponse,
+) error {
+	*response = f.prober.Peers(request.ServerName)
+	return nil
+}
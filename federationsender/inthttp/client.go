@@ -22,6 +22,7 @@ const (
 	FederationSenderPerformInviteRequestPath          = "/federationsender/performInviteRequest"
 	FederationSenderPerformServersAlivePath           = "/federationsender/performServersAlive"
 	FederationSenderPerformBroadcastEDUPath           = "/federationsender/performBroadcastEDU"
+	FederationSenderQueryPeerLatencyPath              = "/federationsender/queryPeerLatency"
 
 	FederationSenderGetUserDevicesPath     = "/federationsender/client/getUserDevices"
 	FederationSenderClaimKeysPath          = "/federationsender/client/claimKeys"
@@ -33,6 +34,8 @@ const (
 	FederationSenderGetServerKeysPath      = "/federationsender/client/getServerKeys"
 	FederationSenderLookupServerKeysPath   = "/federationsender/client/lookupServerKeys"
 	FederationSenderEventRelationshipsPath = "/federationsender/client/msc2836eventRelationships"
+	FederationSenderTimestampToEventPath   = "/federationsender/client/msc3030timestampToEvent"
+	FederationSenderHierarchyPath          = "/federationsender/client/msc2946hierarchy"
 )
 
 // NewFederationSenderClient creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
@@ -100,6 +103,19 @@ func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryPeerLatency implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryPeerLatency(
+	ctx context.Context,
+	request *api.QueryPeerLatencyRequest,
+	response *api.QueryPeerLatencyResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPeerLatency")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryPeerLatencyPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // Handle an instruction to make_join & send_join with a remote server.
 func (h *httpFederationSenderInternalAPI) PerformJoin(
 	ctx context.Context,
@@ -449,3 +465,67 @@ func (h *httpFederationSenderInternalAPI) MSC2836EventRelationships(
 	}
 	return response.Res, nil
 }
+
+type timestampToEvent struct {
+	S      gomatrixserverlib.ServerName
+	RoomID string
+	TS     gomatrixserverlib.Timestamp
+	Dir    string
+	Res    api.RespMSC3030TimestampToEvent
+	Err    *api.FederationClientError
+}
+
+func (h *httpFederationSenderInternalAPI) MSC3030TimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, dir string,
+) (res api.RespMSC3030TimestampToEvent, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MSC3030TimestampToEvent")
+	defer span.Finish()
+
+	request := timestampToEvent{
+		S:      s,
+		RoomID: roomID,
+		TS:     ts,
+		Dir:    dir,
+	}
+	var response timestampToEvent
+	apiURL := h.federationSenderURL + FederationSenderTimestampToEventPath
+	err = httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+	if err != nil {
+		return res, err
+	}
+	if response.Err != nil {
+		return res, response.Err
+	}
+	return response.Res, nil
+}
+
+type hierarchy struct {
+	S             gomatrixserverlib.ServerName
+	RoomID        string
+	SuggestedOnly bool
+	Res           api.RespMSC2946Hierarchy
+	Err           *api.FederationClientError
+}
+
+func (h *httpFederationSenderInternalAPI) MSC2946Hierarchy(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, suggestedOnly bool,
+) (res api.RespMSC2946Hierarchy, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MSC2946Hierarchy")
+	defer span.Finish()
+
+	request := hierarchy{
+		S:             s,
+		RoomID:        roomID,
+		SuggestedOnly: suggestedOnly,
+	}
+	var response hierarchy
+	apiURL := h.federationSenderURL + FederationSenderHierarchyPath
+	err = httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+	if err != nil {
+		return res, err
+	}
+	if response.Err != nil {
+		return res, response.Err
+	}
+	return response.Res, nil
+}
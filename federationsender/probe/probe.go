@@ -0,0 +1,290 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/statistics"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	probeVersion = "version"
+	probeKeys    = "keys"
+)
+
+var peerRTT = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "peer_rtt_seconds",
+		Help:      "The round trip time of the last successful probe of a server that we federate with",
+	},
+	[]string{"destination"},
+)
+
+var peerProbeFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "peer_probe_failures_total",
+		Help:      "The number of probes of a server that we federate with which failed, by the part of the probe that failed",
+	},
+	[]string{"destination", "probe"},
+)
+
+func init() {
+	prometheus.MustRegister(peerRTT, peerProbeFailures)
+}
+
+// Client is the part of the federation client which is used to probe servers.
+type Client interface {
+	GetVersion(ctx context.Context, s gomatrixserverlib.ServerName) (gomatrixserverlib.Version, error)
+	GetServerKeys(ctx context.Context, s gomatrixserverlib.ServerName) (gomatrixserverlib.ServerKeys, error)
+}
+
+// peer is the recent history of probing a server.
+type peer struct {
+	roomCount int
+	probes    []api.PeerProbe // oldest first
+}
+
+// Prober periodically measures the round trip time and key fetch success of
+// the servers that we share the most rooms with, along with our own server,
+// and keeps a short history of the results. The probes are made directly
+// rather than through the federation sender queues, so that they don't affect
+// backoff. Nothing is stored in the database, so the history starts again
+// when the federation sender restarts.
+type Prober struct {
+	cfg        *config.FederationSender
+	db         storage.Database
+	client     Client
+	statistics *statistics.Statistics
+	mutex      sync.Mutex // protects the below
+	local      *peer
+	peers      map[gomatrixserverlib.ServerName]*peer
+	now        func() time.Time
+}
+
+func NewProber(
+	cfg *config.FederationSender, db storage.Database, client Client,
+	statistics *statistics.Statistics,
+) *Prober {
+	return &Prober{
+		cfg:        cfg,
+		db:         db,
+		client:     client,
+		statistics: statistics,
+		peers:      make(map[gomatrixserverlib.ServerName]*peer),
+		now:        time.Now,
+	}
+}
+
+// Start probes servers in the background if the prober is enabled.
+func (p *Prober) Start() {
+	if !p.cfg.LatencyProbe.Enabled || p.cfg.Matrix.DisableFederation {
+		return
+	}
+	go func() {
+		interval := time.Duration(p.cfg.LatencyProbe.IntervalMS) * time.Millisecond
+		for {
+			if err := p.ProbeAll(context.Background()); err != nil {
+				logrus.WithError(err).Warn("Failed to probe federation peers")
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// ProbeAll probes our own server and each of the servers that we share the
+// most rooms with at the same time. Servers which are no longer among those
+// that we share the most rooms with are forgotten.
+func (p *Prober) ProbeAll(ctx context.Context) error {
+	// Ask for enough servers that there are still enough once our own
+	// server names have been taken out.
+	limit := p.cfg.LatencyProbe.Peers + 1 + len(p.cfg.Matrix.VirtualHosts)
+	hosts, err := p.db.GetTopJoinedHosts(ctx, limit)
+	if err != nil {
+		return fmt.Errorf("p.db.GetTopJoinedHosts: %w", err)
+	}
+	roomCounts := make(map[gomatrixserverlib.ServerName]int, len(hosts))
+	for _, host := range hosts {
+		if len(roomCounts) == p.cfg.LatencyProbe.Peers {
+			break
+		}
+		if !p.cfg.Matrix.IsLocalServerName(host.ServerName) {
+			roomCounts[host.ServerName] = host.RoomCount
+		}
+	}
+
+	localName := p.cfg.Matrix.ServerName
+	results := make(map[gomatrixserverlib.ServerName]api.PeerProbe, len(roomCounts)+1)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	probeServer := func(serverName gomatrixserverlib.ServerName) {
+		defer wg.Done()
+		result := p.probe(ctx, serverName)
+		resultsMutex.Lock()
+		results[serverName] = result
+		resultsMutex.Unlock()
+	}
+	wg.Add(1)
+	go probeServer(localName)
+	for serverName := range roomCounts {
+		wg.Add(1)
+		go probeServer(serverName)
+	}
+	wg.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for serverName := range p.peers {
+		if _, ok := roomCounts[serverName]; !ok {
+			delete(p.peers, serverName)
+			peerRTT.DeleteLabelValues(string(serverName))
+			peerProbeFailures.DeleteLabelValues(string(serverName), probeVersion)
+			peerProbeFailures.DeleteLabelValues(string(serverName), probeKeys)
+		}
+	}
+	if p.local == nil {
+		p.local = &peer{}
+	}
+	p.record(localName, p.local, results[localName])
+	for serverName, roomCount := range roomCounts {
+		pr, ok := p.peers[serverName]
+		if !ok {
+			pr = &peer{}
+			p.peers[serverName] = pr
+		}
+		pr.roomCount = roomCount
+		p.record(serverName, pr, results[serverName])
+	}
+	return nil
+}
+
+// probe asks the server for its version and then for its signing keys.
+func (p *Prober) probe(ctx context.Context, serverName gomatrixserverlib.ServerName) api.PeerProbe {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.cfg.LatencyProbe.TimeoutMS)*time.Millisecond)
+	defer cancel()
+	start := p.now()
+	result := api.PeerProbe{Timestamp: gomatrixserverlib.AsTimestamp(start)}
+	_, err := p.client.GetVersion(ctx, serverName)
+	result.RTTMS = p.now().Sub(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	start = p.now()
+	keys, err := p.client.GetServerKeys(ctx, serverName)
+	result.KeyFetchMS = p.now().Sub(start).Milliseconds()
+	switch {
+	case err != nil:
+		result.KeyFetchError = err.Error()
+	case keys.ServerName != serverName:
+		result.KeyFetchError = fmt.Sprintf("got keys for %q", keys.ServerName)
+	case len(keys.VerifyKeys) == 0:
+		result.KeyFetchError = "no verify keys"
+	}
+	return result
+}
+
+// record adds the result of a probe to the history of a server and updates
+// the metrics. The mutex must be held.
+func (p *Prober) record(serverName gomatrixserverlib.ServerName, pr *peer, result api.PeerProbe) {
+	pr.probes = append(pr.probes, result)
+	if over := len(pr.probes) - p.cfg.LatencyProbe.History; over > 0 {
+		pr.probes = append(pr.probes[:0], pr.probes[over:]...)
+	}
+	if result.Error == "" {
+		peerRTT.WithLabelValues(string(serverName)).Set(float64(result.RTTMS) / 1000)
+	} else {
+		peerProbeFailures.WithLabelValues(string(serverName), probeVersion).Inc()
+	}
+	if result.KeyFetchError != "" {
+		peerProbeFailures.WithLabelValues(string(serverName), probeKeys).Inc()
+	}
+}
+
+// Peers returns the recent history of probing our own server and the servers
+// that we share the most rooms with, most rooms first. If a server name is
+// given then only that server is reported on.
+func (p *Prober) Peers(serverName gomatrixserverlib.ServerName) api.QueryPeerLatencyResponse {
+	res := api.QueryPeerLatencyResponse{
+		Enabled: p.cfg.LatencyProbe.Enabled,
+		Peers:   []api.PeerLatency{},
+	}
+	p.mutex.Lock()
+	if p.local != nil && (serverName == "" || serverName == p.cfg.Matrix.ServerName) {
+		local := p.summarise(p.cfg.Matrix.ServerName, p.local)
+		res.Local = &local
+	}
+	for name, pr := range p.peers {
+		if serverName == "" || serverName == name {
+			res.Peers = append(res.Peers, p.summarise(name, pr))
+		}
+	}
+	p.mutex.Unlock()
+
+	sort.Slice(res.Peers, func(i, j int) bool {
+		if res.Peers[i].RoomCount != res.Peers[j].RoomCount {
+			return res.Peers[i].RoomCount > res.Peers[j].RoomCount
+		}
+		return res.Peers[i].ServerName < res.Peers[j].ServerName
+	})
+	return res
+}
+
+// summarise works out the median round trip time and key fetch success rate
+// of a server. The mutex must be held.
+func (p *Prober) summarise(serverName gomatrixserverlib.ServerName, pr *peer) api.PeerLatency {
+	latency := api.PeerLatency{
+		ServerName: serverName,
+		RoomCount:  pr.roomCount,
+		Probes:     append([]api.PeerProbe{}, pr.probes...),
+	}
+	var rtts []int64
+	keyFetches := 0
+	for _, probe := range pr.probes {
+		if probe.Error == "" {
+			rtts = append(rtts, probe.RTTMS)
+		}
+		if probe.KeyFetchError == "" {
+			keyFetches++
+		}
+	}
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		latency.MedianRTTMS = rtts[len(rtts)/2]
+	}
+	if len(pr.probes) > 0 {
+		latency.KeyFetchSuccessRate = float64(keyFetches) / float64(len(pr.probes))
+	}
+	if p.statistics != nil && !p.cfg.Matrix.IsLocalServerName(serverName) {
+		until, blacklisted := p.statistics.ForServer(serverName).BackoffInfo()
+		latency.Blacklisted = blacklisted
+		latency.BackingOff = until != nil && p.now().Before(*until)
+	}
+	return latency
+}
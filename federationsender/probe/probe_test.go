@@ -0,0 +1,115 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// hostsDatabase is a storage.Database that only knows about joined hosts.
+type hostsDatabase struct {
+	storage.Database
+	hosts []types.JoinedHostCount
+}
+
+func (d *hostsDatabase) GetTopJoinedHosts(ctx context.Context, limit int) ([]types.JoinedHostCount, error) {
+	if len(d.hosts) > limit {
+		return d.hosts[:limit], nil
+	}
+	return d.hosts, nil
+}
+
+// fakeClient replies to probes, failing for the servers in down.
+type fakeClient struct {
+	down map[gomatrixserverlib.ServerName]bool
+}
+
+func (c *fakeClient) GetVersion(ctx context.Context, s gomatrixserverlib.ServerName) (gomatrixserverlib.Version, error) {
+	if c.down[s] {
+		return gomatrixserverlib.Version{}, errors.New("connection refused")
+	}
+	return gomatrixserverlib.Version{}, nil
+}
+
+func (c *fakeClient) GetServerKeys(ctx context.Context, s gomatrixserverlib.ServerName) (gomatrixserverlib.ServerKeys, error) {
+	if c.down[s] {
+		return gomatrixserverlib.ServerKeys{}, errors.New("connection refused")
+	}
+	var keys gomatrixserverlib.ServerKeys
+	keys.ServerName = s
+	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+		"ed25519:1": {},
+	}
+	return keys, nil
+}
+
+func TestProbeAll(t *testing.T) {
+	cfg := &config.FederationSender{
+		Matrix: &config.Global{ServerName: "local"},
+	}
+	cfg.LatencyProbe.Defaults()
+	cfg.LatencyProbe.Enabled = true
+	cfg.LatencyProbe.Peers = 2
+	cfg.LatencyProbe.History = 2
+	db := &hostsDatabase{
+		hosts: []types.JoinedHostCount{
+			{ServerName: "local", RoomCount: 10},
+			{ServerName: "busy", RoomCount: 5},
+			{ServerName: "down", RoomCount: 3},
+			{ServerName: "quiet", RoomCount: 1},
+		},
+	}
+	client := &fakeClient{
+		down: map[gomatrixserverlib.ServerName]bool{"down": true},
+	}
+	prober := NewProber(cfg, db, client, nil)
+	for i := 0; i < 3; i++ {
+		if err := prober.ProbeAll(context.Background()); err != nil {
+			t.Fatalf("ProbeAll failed: %s", err)
+		}
+	}
+
+	res := prober.Peers("")
+	if !res.Enabled {
+		t.Errorf("expected prober to be enabled")
+	}
+	if res.Local == nil || res.Local.ServerName != "local" || len(res.Local.Probes) != 2 {
+		t.Fatalf("expected two probes of the local server, got %+v", res.Local)
+	}
+	if len(res.Peers) != 2 {
+		t.Fatalf("expected two peers, got %+v", res.Peers)
+	}
+	if busy := res.Peers[0]; busy.ServerName != "busy" || busy.RoomCount != 5 || busy.KeyFetchSuccessRate != 1 {
+		t.Errorf("unexpected result for busy server: %+v", busy)
+	}
+	down := res.Peers[1]
+	if down.ServerName != "down" || down.KeyFetchSuccessRate != 0 || down.MedianRTTMS != 0 {
+		t.Errorf("unexpected result for down server: %+v", down)
+	}
+	for _, probe := range down.Probes {
+		if probe.Error == "" || probe.KeyFetchError == "" {
+			t.Errorf("expected probes of down server to fail, got %+v", probe)
+		}
+	}
+
+	// Servers which are no longer among those that we share the most rooms
+	// with are forgotten.
+	db.hosts = []types.JoinedHostCount{
+		{ServerName: "quiet", RoomCount: 4},
+	}
+	if err := prober.ProbeAll(context.Background()); err != nil {
+		t.Fatalf("ProbeAll failed: %s", err)
+	}
+	res = prober.Peers("")
+	if len(res.Peers) != 1 || res.Peers[0].ServerName != "quiet" || len(res.Peers[0].Probes) != 1 {
+		t.Errorf("expected only the quiet server, got %+v", res.Peers)
+	}
+	if res = prober.Peers("busy"); res.Local != nil || len(res.Peers) != 0 {
+		t.Errorf("expected busy server to be forgotten, got %+v", res)
+	}
+}
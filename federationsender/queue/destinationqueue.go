@@ -38,6 +38,7 @@ const (
 	maxPDUsInMemory       = 128
 	maxEDUsInMemory       = 128
 	queueIdleTimeout      = time.Second * 30
+	catchUpAfterDowntime  = time.Minute * 5
 )
 
 // destinationQueue is a queue of events for a single destination.
@@ -62,6 +63,8 @@ type destinationQueue struct {
 	pendingEDUs        []*queuedEDU                        // EDUs waiting to be sent
 	pendingMutex       sync.RWMutex                        // protects pendingPDUs and pendingEDUs
 	interruptBackoff   chan bool                           // interrupts backoff
+	failingSince       atomic.Value                        // time.Time of the first failure since the last success
+	catchingUp         atomic.Bool                         // true if the destination has been unreachable for a long time
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -234,6 +237,32 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 	}
 }
 
+// collapsePendingPDUs throws away all of the PDUs waiting to be sent to
+// this destination except for the latest one in each room, and then
+// reloads the pending PDUs from the database.
+func (oq *destinationQueue) collapsePendingPDUs() {
+	dropped, err := oq.db.CollapsePendingPDUs(context.Background(), oq.destination)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to collapse pending PDUs for %q", oq.destination)
+		return
+	}
+	if dropped == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"destination": oq.destination,
+		"dropped":     dropped,
+	}).Info("Destination has been unreachable for a while, sending latest PDU per room to catch up")
+	destinationQueueCaughtUpPDUs.Add(float64(dropped))
+	oq.pendingMutex.Lock()
+	for i := range oq.pendingPDUs {
+		oq.pendingPDUs[i] = nil
+	}
+	oq.pendingPDUs = nil
+	oq.pendingMutex.Unlock()
+	oq.getPendingFromDatabase()
+}
+
 // backgroundSend is the worker goroutine for sending events.
 // nolint:gocyclo
 func (oq *destinationQueue) backgroundSend() {
@@ -280,6 +309,7 @@ func (oq *destinationQueue) backgroundSend() {
 			// has exceeded a maximum allowable value. Clean up the in-memory
 			// buffers at this point. The PDU clean-up is already on a defer.
 			log.Warnf("Blacklisting %q due to exceeding backoff threshold", oq.destination)
+			oq.catchingUp.Store(true)
 			oq.pendingMutex.Lock()
 			for i := range oq.pendingPDUs {
 				oq.pendingPDUs[i] = nil
@@ -299,14 +329,24 @@ func (oq *destinationQueue) backgroundSend() {
 			log.Warnf("Backing off %q for %s", oq.destination, duration)
 			oq.backingOff.Store(true)
 			destinationQueueBackingOff.Inc()
+			destinationBackingOff.WithLabelValues(string(oq.destination)).Set(1)
 			select {
 			case <-time.After(duration):
 			case <-oq.interruptBackoff:
 			}
+			destinationBackingOff.WithLabelValues(string(oq.destination)).Set(0)
 			destinationQueueBackingOff.Dec()
 			oq.backingOff.Store(false)
 		}
 
+		// If the destination has been unreachable for a long time then
+		// there's no point in replaying every PDU that was queued in the
+		// meantime. Send only the latest PDU in each room instead and let
+		// the destination fetch whatever else it is missing.
+		if oq.catchingUp.Load() {
+			oq.collapsePendingPDUs()
+		}
+
 		// Work out which PDUs/EDUs to include in the next transaction.
 		oq.pendingMutex.RLock()
 		pduCount := len(oq.pendingPDUs)
@@ -327,11 +367,22 @@ func (oq *destinationQueue) backgroundSend() {
 		if terr != nil {
 			// We failed to send the transaction. Mark it as a failure.
 			oq.statistics.Failure()
+			destinationTransactions.WithLabelValues(string(oq.destination), "failure").Inc()
+			// If the destination has been failing for long enough then
+			// we'll catch it up when it comes back instead.
+			if since, ok := oq.failingSince.Load().(time.Time); !ok || since.IsZero() {
+				oq.failingSince.Store(time.Now())
+			} else if time.Since(since) >= catchUpAfterDowntime {
+				oq.catchingUp.Store(true)
+			}
 
 		} else if transaction {
 			// If we successfully sent the transaction then clear out
 			// the pending events and EDUs, and wipe our transaction ID.
 			oq.statistics.Success()
+			destinationTransactions.WithLabelValues(string(oq.destination), "success").Inc()
+			oq.failingSince.Store(time.Time{})
+			oq.catchingUp.Store(false)
 			oq.pendingMutex.Lock()
 			for i := range oq.pendingPDUs[:pc] {
 				oq.pendingPDUs[i] = nil
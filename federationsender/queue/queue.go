@@ -49,7 +49,8 @@ type OutgoingQueues struct {
 func init() {
 	prometheus.MustRegister(
 		destinationQueueTotal, destinationQueueRunning,
-		destinationQueueBackingOff,
+		destinationQueueBackingOff, destinationQueueCaughtUpPDUs,
+		destinationBackingOff, destinationTransactions,
 	)
 }
 
@@ -77,6 +78,35 @@ var destinationQueueBackingOff = prometheus.NewGauge(
 	},
 )
 
+var destinationQueueCaughtUpPDUs = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_queues_caught_up_pdus",
+		Help:      "The number of queued PDUs that were dropped rather than sent when catching up a destination",
+	},
+)
+
+var destinationBackingOff = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_backing_off",
+		Help:      "Whether we are currently backing off from sending to a destination",
+	},
+	[]string{"destination"},
+)
+
+var destinationTransactions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_transactions_total",
+		Help:      "The number of transactions that we have tried to send to a destination",
+	},
+	[]string{"destination", "outcome"},
+)
+
 // NewOutgoingQueues makes a new OutgoingQueues
 func NewOutgoingQueues(
 	db storage.Database,
@@ -160,6 +190,9 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 			interruptBackoff: make(chan bool),
 			signing:          oqs.signing,
 		}
+		// If the destination was blacklisted before we started then it has
+		// been unreachable for some time, so catch it up when it returns.
+		oq.catchingUp.Store(oq.statistics.Blacklisted())
 		oqs.queues[destination] = oq
 	}
 	return oq
@@ -1,16 +1,33 @@
 package statistics
 
 import (
+	"context"
 	"math"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
 )
 
+func init() {
+	prometheus.MustRegister(destinationFailures)
+}
+
+var destinationFailures = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_consecutive_failures",
+		Help:      "The number of consecutive failed attempts to send to a destination",
+	},
+	[]string{"destination"},
+)
+
 // Statistics contains information about all of the remote federated
 // hosts that we have interacted with. It is basically a threadsafe
 // wrapper.
@@ -54,6 +71,17 @@ func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerS
 		} else {
 			server.blacklisted.Store(blacklisted)
 		}
+		// If we were backing off from this server before we were last
+		// restarted then pick up where we left off, otherwise we'd start
+		// hammering a server that is down with requests again.
+		backoff, err := s.DB.GetServerBackoff(context.TODO(), serverName)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get backoff entry %q", serverName)
+		} else if backoff != nil {
+			server.backoffCount.Store(backoff.FailureCount)
+			server.backoffUntil.Store(backoff.RetryAfter)
+			destinationFailures.WithLabelValues(string(serverName)).Set(float64(backoff.FailureCount))
+		}
 	}
 	return server
 }
@@ -95,11 +123,19 @@ func (s *ServerStatistics) cancel() {
 func (s *ServerStatistics) Success() {
 	s.cancel()
 	s.successCounter.Inc()
-	s.backoffCount.Store(0)
+	failures := s.backoffCount.Swap(0)
+	destinationFailures.WithLabelValues(string(s.serverName)).Set(0)
 	if s.statistics.DB != nil {
 		if err := s.statistics.DB.RemoveServerFromBlacklist(s.serverName); err != nil {
 			logrus.WithError(err).Errorf("Failed to remove %q from blacklist", s.serverName)
 		}
+		// Only touch the database if we were actually backing off, since
+		// this is called after every successful transaction.
+		if failures > 0 {
+			if err := s.statistics.DB.RemoveServerBackoff(context.TODO(), s.serverName); err != nil {
+				logrus.WithError(err).Errorf("Failed to remove backoff entry %q", s.serverName)
+			}
+		}
 	}
 }
 
@@ -154,6 +190,16 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 	count := s.backoffCount.Load()
 	until := time.Now().Add(s.duration(count))
 	s.backoffUntil.Store(until)
+	destinationFailures.WithLabelValues(string(s.serverName)).Set(float64(count))
+	if s.statistics.DB != nil {
+		if err := s.statistics.DB.UpdateServerBackoff(context.TODO(), &types.ServerBackoff{
+			ServerName:   s.serverName,
+			FailureCount: count,
+			RetryAfter:   until,
+		}); err != nil {
+			logrus.WithError(err).Errorf("Failed to update backoff entry %q", s.serverName)
+		}
+	}
 	return until, false
 }
 
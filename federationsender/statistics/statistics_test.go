@@ -1,9 +1,14 @@
 package statistics
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestBackoff(t *testing.T) {
@@ -62,3 +67,82 @@ func TestBackoff(t *testing.T) {
 		}
 	}
 }
+
+// backoffDatabase is a storage.Database that only remembers backoff state.
+type backoffDatabase struct {
+	storage.Database
+	backoffs map[gomatrixserverlib.ServerName]types.ServerBackoff
+}
+
+func (d *backoffDatabase) AddServerToBlacklist(serverName gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func (d *backoffDatabase) RemoveServerFromBlacklist(serverName gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func (d *backoffDatabase) IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error) {
+	return false, nil
+}
+
+func (d *backoffDatabase) UpdateServerBackoff(ctx context.Context, backoff *types.ServerBackoff) error {
+	d.backoffs[backoff.ServerName] = *backoff
+	return nil
+}
+
+func (d *backoffDatabase) RemoveServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	delete(d.backoffs, serverName)
+	return nil
+}
+
+func (d *backoffDatabase) GetServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) (*types.ServerBackoff, error) {
+	backoff, ok := d.backoffs[serverName]
+	if !ok {
+		return nil, nil
+	}
+	return &backoff, nil
+}
+
+func TestBackoffPersisted(t *testing.T) {
+	db := &backoffDatabase{
+		backoffs: map[gomatrixserverlib.ServerName]types.ServerBackoff{},
+	}
+	stats := Statistics{
+		DB:                     db,
+		FailuresUntilBlacklist: 7,
+	}
+
+	// Register a failure, which should be stored in the database.
+	until, _ := stats.ForServer("test.com").Failure()
+	backoff, ok := db.backoffs["test.com"]
+	if !ok {
+		t.Fatalf("Expected backoff to be stored")
+	}
+	if backoff.FailureCount != 1 || !backoff.RetryAfter.Equal(until) {
+		t.Fatalf("Expected backoff of 1 failure until %s, got %d until %s", until, backoff.FailureCount, backoff.RetryAfter)
+	}
+
+	// Simulate a restart, after which we should still be backing off.
+	restarted := Statistics{
+		DB:                     db,
+		FailuresUntilBlacklist: 7,
+	}
+	server := restarted.ForServer("test.com")
+	if count := server.backoffCount.Load(); count != 1 {
+		t.Fatalf("Expected restored backoff count 1, got %d", count)
+	}
+	restoredUntil, blacklisted := server.BackoffInfo()
+	if restoredUntil == nil || blacklisted {
+		t.Fatalf("Expected to be backing off after restart")
+	}
+	if diff := restoredUntil.Sub(until); diff < -time.Millisecond || diff > time.Millisecond {
+		t.Fatalf("Expected restored backoff until %s, got %s", until, restoredUntil)
+	}
+
+	// A success should clear the stored backoff.
+	server.Success()
+	if _, ok := db.backoffs["test.com"]; ok {
+		t.Fatalf("Expected backoff to be removed after success")
+	}
+}
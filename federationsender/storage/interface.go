@@ -30,6 +30,9 @@ type Database interface {
 
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
 	GetAllJoinedHosts(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+	// GetTopJoinedHosts returns up to limit servers, ordered by the number of
+	// rooms that they share with us, most first.
+	GetTopJoinedHosts(ctx context.Context, limit int) ([]types.JoinedHostCount, error)
 	// GetJoinedHostsForRooms returns the complete set of servers in the rooms given.
 	GetJoinedHostsForRooms(ctx context.Context, roomIDs []string) ([]gomatrixserverlib.ServerName, error)
 	PurgeRoomState(ctx context.Context, roomID string) error
@@ -43,6 +46,9 @@ type Database interface {
 	AssociateEDUWithDestination(ctx context.Context, serverName gomatrixserverlib.ServerName, receipt *shared.Receipt) error
 
 	CleanPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, receipts []*shared.Receipt) error
+	// CollapsePendingPDUs throws away all pending PDUs for the server name except
+	// for the latest PDU in each room, returning the number of PDUs thrown away.
+	CollapsePendingPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName) (int, error)
 	CleanEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, receipts []*shared.Receipt) error
 
 	GetPendingPDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
@@ -54,4 +60,22 @@ type Database interface {
 	AddServerToBlacklist(serverName gomatrixserverlib.ServerName) error
 	RemoveServerFromBlacklist(serverName gomatrixserverlib.ServerName) error
 	IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error)
+
+	// UpdateInFlightJoin records the progress of a federated join, creating
+	// it if it doesn't already exist.
+	UpdateInFlightJoin(ctx context.Context, join *types.InFlightJoin) error
+	// RemoveInFlightJoin forgets about a federated join once it has completed.
+	RemoveInFlightJoin(ctx context.Context, roomID, userID string) error
+	// GetInFlightJoins returns all federated joins that haven't completed.
+	GetInFlightJoins(ctx context.Context) ([]types.InFlightJoin, error)
+
+	// UpdateServerBackoff records that we are backing off from a server,
+	// creating or replacing any previous backoff state.
+	UpdateServerBackoff(ctx context.Context, backoff *types.ServerBackoff) error
+	// RemoveServerBackoff forgets about the backoff state for a server
+	// once we have successfully sent to it again.
+	RemoveServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) error
+	// GetServerBackoff returns the backoff state for a server, or nil
+	// if we aren't backing off from it.
+	GetServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) (*types.ServerBackoff, error)
 }
@@ -0,0 +1,121 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const backoffSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_backoff (
+    -- The server name that we are backing off from
+    server_name TEXT NOT NULL,
+    -- The number of consecutive failures sending to the server
+    failure_count BIGINT NOT NULL,
+    -- The time at which we should next try the server, in milliseconds
+    retry_after BIGINT NOT NULL,
+    UNIQUE (server_name)
+);
+`
+
+const upsertBackoffSQL = "" +
+	"INSERT INTO federationsender_backoff (server_name, failure_count, retry_after)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (server_name) DO UPDATE SET" +
+	" failure_count = $2, retry_after = $3"
+
+const deleteBackoffSQL = "" +
+	"DELETE FROM federationsender_backoff WHERE server_name = $1"
+
+const selectBackoffSQL = "" +
+	"SELECT failure_count, retry_after FROM federationsender_backoff WHERE server_name = $1"
+
+type backoffStatements struct {
+	db                *sql.DB
+	upsertBackoffStmt *sql.Stmt
+	deleteBackoffStmt *sql.Stmt
+	selectBackoffStmt *sql.Stmt
+}
+
+func NewPostgresBackoffTable(db *sql.DB) (s *backoffStatements, err error) {
+	s = &backoffStatements{
+		db: db,
+	}
+	_, err = db.Exec(backoffSchema)
+	if err != nil {
+		return
+	}
+
+	if s.upsertBackoffStmt, err = db.Prepare(upsertBackoffSQL); err != nil {
+		return
+	}
+	if s.deleteBackoffStmt, err = db.Prepare(deleteBackoffSQL); err != nil {
+		return
+	}
+	if s.selectBackoffStmt, err = db.Prepare(selectBackoffSQL); err != nil {
+		return
+	}
+	return
+}
+
+// UpsertBackoff stores the backoff state for a server, replacing any
+// backoff state previously stored for it.
+func (s *backoffStatements) UpsertBackoff(
+	ctx context.Context, txn *sql.Tx, backoff *types.ServerBackoff,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertBackoffStmt)
+	_, err := stmt.ExecContext(
+		ctx, backoff.ServerName, backoff.FailureCount,
+		backoff.RetryAfter.UnixNano()/int64(time.Millisecond),
+	)
+	return err
+}
+
+// DeleteBackoff removes the backoff state for a server.
+func (s *backoffStatements) DeleteBackoff(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteBackoffStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+// SelectBackoff returns the backoff state for a server, or nil if we
+// aren't backing off from it.
+func (s *backoffStatements) SelectBackoff(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (*types.ServerBackoff, error) {
+	var failureCount uint32
+	var retryAfter int64
+	stmt := sqlutil.TxStmt(txn, s.selectBackoffStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&failureCount, &retryAfter)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &types.ServerBackoff{
+		ServerName:   serverName,
+		FailureCount: failureCount,
+		RetryAfter:   time.Unix(0, retryAfter*int64(time.Millisecond)),
+	}, nil
+}
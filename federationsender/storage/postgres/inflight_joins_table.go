@@ -0,0 +1,150 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const inFlightJoinsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_inflight_joins (
+    -- The room ID being joined
+    room_id TEXT NOT NULL,
+    -- The local user ID that is joining
+    user_id TEXT NOT NULL,
+    -- A JSON array of the servers to try joining through, in order
+    server_names TEXT NOT NULL,
+    -- The JSON membership event content supplied by the client
+    content TEXT NOT NULL,
+    -- The server that we were last trying to join through
+    server_name TEXT NOT NULL,
+    -- How far through the join we got, e.g. "send_join"
+    progress TEXT NOT NULL,
+    -- How many times the join has been resumed after being interrupted
+    attempts INTEGER NOT NULL DEFAULT 0,
+    -- When the join was first started, in milliseconds since the epoch
+    started_ts BIGINT NOT NULL,
+    UNIQUE (room_id, user_id)
+);
+`
+
+const upsertInFlightJoinSQL = "" +
+	"INSERT INTO federationsender_inflight_joins (room_id, user_id, server_names, content, server_name, progress, attempts, started_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (room_id, user_id) DO UPDATE SET" +
+	" server_names = $3, content = $4, server_name = $5, progress = $6, attempts = $7, started_ts = $8"
+
+const deleteInFlightJoinSQL = "" +
+	"DELETE FROM federationsender_inflight_joins WHERE room_id = $1 AND user_id = $2"
+
+const selectInFlightJoinsSQL = "" +
+	"SELECT room_id, user_id, server_names, content, server_name, progress, attempts, started_ts FROM federationsender_inflight_joins"
+
+type inFlightJoinsStatements struct {
+	db                      *sql.DB
+	upsertInFlightJoinStmt  *sql.Stmt
+	deleteInFlightJoinStmt  *sql.Stmt
+	selectInFlightJoinsStmt *sql.Stmt
+}
+
+func NewPostgresInFlightJoinsTable(db *sql.DB) (s *inFlightJoinsStatements, err error) {
+	s = &inFlightJoinsStatements{
+		db: db,
+	}
+	_, err = db.Exec(inFlightJoinsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.upsertInFlightJoinStmt, err = db.Prepare(upsertInFlightJoinSQL); err != nil {
+		return
+	}
+	if s.deleteInFlightJoinStmt, err = db.Prepare(deleteInFlightJoinSQL); err != nil {
+		return
+	}
+	if s.selectInFlightJoinsStmt, err = db.Prepare(selectInFlightJoinsSQL); err != nil {
+		return
+	}
+	return
+}
+
+// UpsertInFlightJoin stores the progress of a federated join, replacing
+// any progress previously stored for the same room and user.
+func (s *inFlightJoinsStatements) UpsertInFlightJoin(
+	ctx context.Context, txn *sql.Tx, join *types.InFlightJoin,
+) error {
+	serverNames, err := json.Marshal(join.ServerNames)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(join.Content)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertInFlightJoinStmt)
+	_, err = stmt.ExecContext(
+		ctx, join.RoomID, join.UserID, string(serverNames), string(content),
+		join.ServerName, join.Progress, join.Attempts, join.Started,
+	)
+	return err
+}
+
+// DeleteInFlightJoin removes the progress of a federated join.
+func (s *inFlightJoinsStatements) DeleteInFlightJoin(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteInFlightJoinStmt)
+	_, err := stmt.ExecContext(ctx, roomID, userID)
+	return err
+}
+
+// SelectInFlightJoins returns all federated joins that have been started
+// but not yet removed.
+func (s *inFlightJoinsStatements) SelectInFlightJoins(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.InFlightJoin, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectInFlightJoinsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectInFlightJoins: rows.close() failed")
+
+	var joins []types.InFlightJoin
+	for rows.Next() {
+		var join types.InFlightJoin
+		var serverNames, content string
+		if err = rows.Scan(
+			&join.RoomID, &join.UserID, &serverNames, &content,
+			&join.ServerName, &join.Progress, &join.Attempts, &join.Started,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(serverNames), &join.ServerNames); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(content), &join.Content); err != nil {
+			return nil, err
+		}
+		joins = append(joins, join)
+	}
+	return joins, rows.Err()
+}
@@ -63,6 +63,10 @@ const selectJoinedHostsSQL = "" +
 const selectAllJoinedHostsSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_joined_hosts"
 
+const selectTopJoinedHostsSQL = "" +
+	"SELECT server_name, COUNT(DISTINCT room_id) AS room_count FROM federationsender_joined_hosts" +
+	" GROUP BY server_name ORDER BY room_count DESC, server_name ASC LIMIT $1"
+
 const selectJoinedHostsForRoomsSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_joined_hosts WHERE room_id = ANY($1)"
 
@@ -73,6 +77,7 @@ type joinedHostsStatements struct {
 	deleteJoinedHostsForRoomStmt  *sql.Stmt
 	selectJoinedHostsStmt         *sql.Stmt
 	selectAllJoinedHostsStmt      *sql.Stmt
+	selectTopJoinedHostsStmt      *sql.Stmt
 	selectJoinedHostsForRoomsStmt *sql.Stmt
 }
 
@@ -99,6 +104,9 @@ func NewPostgresJoinedHostsTable(db *sql.DB) (s *joinedHostsStatements, err erro
 	if s.selectAllJoinedHostsStmt, err = s.db.Prepare(selectAllJoinedHostsSQL); err != nil {
 		return
 	}
+	if s.selectTopJoinedHostsStmt, err = s.db.Prepare(selectTopJoinedHostsSQL); err != nil {
+		return
+	}
 	if s.selectJoinedHostsForRoomsStmt, err = s.db.Prepare(selectJoinedHostsForRoomsSQL); err != nil {
 		return
 	}
@@ -166,6 +174,27 @@ func (s *joinedHostsStatements) SelectAllJoinedHosts(
 	return result, rows.Err()
 }
 
+func (s *joinedHostsStatements) SelectTopJoinedHosts(
+	ctx context.Context, limit int,
+) ([]types.JoinedHostCount, error) {
+	rows, err := s.selectTopJoinedHostsStmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectTopJoinedHosts: rows.close() failed")
+
+	var result []types.JoinedHostCount
+	for rows.Next() {
+		var host types.JoinedHostCount
+		if err = rows.Scan(&host.ServerName, &host.RoomCount); err != nil {
+			return nil, err
+		}
+		result = append(result, host)
+	}
+
+	return result, rows.Err()
+}
+
 func (s *joinedHostsStatements) SelectJoinedHostsForRooms(
 	ctx context.Context, roomIDs []string,
 ) ([]gomatrixserverlib.ServerName, error) {
@@ -27,15 +27,17 @@ import (
 )
 
 type Database struct {
-	DB                          *sql.DB
-	Cache                       caching.FederationSenderCache
-	Writer                      sqlutil.Writer
-	FederationSenderQueuePDUs   tables.FederationSenderQueuePDUs
-	FederationSenderQueueEDUs   tables.FederationSenderQueueEDUs
-	FederationSenderQueueJSON   tables.FederationSenderQueueJSON
-	FederationSenderJoinedHosts tables.FederationSenderJoinedHosts
-	FederationSenderRooms       tables.FederationSenderRooms
-	FederationSenderBlacklist   tables.FederationSenderBlacklist
+	DB                            *sql.DB
+	Cache                         caching.FederationSenderCache
+	Writer                        sqlutil.Writer
+	FederationSenderQueuePDUs     tables.FederationSenderQueuePDUs
+	FederationSenderQueueEDUs     tables.FederationSenderQueueEDUs
+	FederationSenderQueueJSON     tables.FederationSenderQueueJSON
+	FederationSenderJoinedHosts   tables.FederationSenderJoinedHosts
+	FederationSenderRooms         tables.FederationSenderRooms
+	FederationSenderBlacklist     tables.FederationSenderBlacklist
+	FederationSenderInFlightJoins tables.FederationSenderInFlightJoins
+	FederationSenderBackoff       tables.FederationSenderBackoff
 }
 
 // An Receipt contains the NIDs of a call to GetNextTransactionPDUs/EDUs.
@@ -120,6 +122,11 @@ func (d *Database) GetAllJoinedHosts(ctx context.Context) ([]gomatrixserverlib.S
 	return d.FederationSenderJoinedHosts.SelectAllJoinedHosts(ctx)
 }
 
+// GetTopJoinedHosts returns the servers that share the most rooms with us.
+func (d *Database) GetTopJoinedHosts(ctx context.Context, limit int) ([]types.JoinedHostCount, error) {
+	return d.FederationSenderJoinedHosts.SelectTopJoinedHosts(ctx, limit)
+}
+
 func (d *Database) GetJoinedHostsForRooms(ctx context.Context, roomIDs []string) ([]gomatrixserverlib.ServerName, error) {
 	return d.FederationSenderJoinedHosts.SelectJoinedHostsForRooms(ctx, roomIDs)
 }
@@ -173,3 +180,35 @@ func (d *Database) RemoveServerFromBlacklist(serverName gomatrixserverlib.Server
 func (d *Database) IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error) {
 	return d.FederationSenderBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
+
+func (d *Database) UpdateInFlightJoin(ctx context.Context, join *types.InFlightJoin) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderInFlightJoins.UpsertInFlightJoin(ctx, txn, join)
+	})
+}
+
+func (d *Database) RemoveInFlightJoin(ctx context.Context, roomID, userID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderInFlightJoins.DeleteInFlightJoin(ctx, txn, roomID, userID)
+	})
+}
+
+func (d *Database) GetInFlightJoins(ctx context.Context) ([]types.InFlightJoin, error) {
+	return d.FederationSenderInFlightJoins.SelectInFlightJoins(ctx, nil)
+}
+
+func (d *Database) UpdateServerBackoff(ctx context.Context, backoff *types.ServerBackoff) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderBackoff.UpsertBackoff(ctx, txn, backoff)
+	})
+}
+
+func (d *Database) RemoveServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderBackoff.DeleteBackoff(ctx, txn, serverName)
+	})
+}
+
+func (d *Database) GetServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) (*types.ServerBackoff, error) {
+	return d.FederationSenderBackoff.SelectBackoff(ctx, nil, serverName)
+}
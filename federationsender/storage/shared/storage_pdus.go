@@ -20,10 +20,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
+// The number of PDUs to look at in one go when collapsing the queue for
+// a destination. This keeps us under the SQLite variable limit.
+const collapsePDUsBatchSize = 500
+
 // AssociatePDUWithDestination creates an association that the
 // destination queues will use to determine which JSON blobs to send
 // to which servers.
@@ -115,30 +122,102 @@ func (d *Database) CleanPDUs(
 	}
 
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.FederationSenderQueuePDUs.DeleteQueuePDUs(ctx, txn, serverName, nids); err != nil {
-			return err
+		return d.cleanPDUs(ctx, txn, serverName, nids)
+	})
+}
+
+// cleanPDUs removes the association between the given JSON NIDs and
+// the destination, and then deletes any JSON blobs that are no longer
+// associated with any destination at all.
+func (d *Database) cleanPDUs(
+	ctx context.Context, txn *sql.Tx,
+	serverName gomatrixserverlib.ServerName,
+	nids []int64,
+) error {
+	if err := d.FederationSenderQueuePDUs.DeleteQueuePDUs(ctx, txn, serverName, nids); err != nil {
+		return err
+	}
+
+	var deleteNIDs []int64
+	for _, nid := range nids {
+		count, err := d.FederationSenderQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
+		if err != nil {
+			return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
+		}
+		if count == 0 {
+			deleteNIDs = append(deleteNIDs, nid)
+			d.Cache.EvictFederationSenderQueuedPDU(nid)
 		}
+	}
 
-		var deleteNIDs []int64
-		for _, nid := range nids {
-			count, err := d.FederationSenderQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
+	if len(deleteNIDs) > 0 {
+		if err := d.FederationSenderQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+			return fmt.Errorf("DeleteQueueJSON: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CollapsePendingPDUs throws away all of the PDUs waiting to be sent to
+// the given server name except for the most recently queued PDU in each
+// room. This is used to catch up a server that has been unreachable for
+// a long time: the remote server will fetch anything it is missing in
+// each room using /get_missing_events once it receives the latest event,
+// which is far cheaper than replaying every PDU that was queued while it
+// was offline. Returns the number of PDUs that were thrown away.
+func (d *Database) CollapsePendingPDUs(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (dropped int, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		nids, err := d.FederationSenderQueuePDUs.SelectQueuePDUs(ctx, txn, serverName, math.MaxInt32)
+		if err != nil {
+			return fmt.Errorf("SelectQueuePDUs: %w", err)
+		}
+		// JSON NIDs are allocated in the order that the PDUs were queued, so
+		// the highest NID in each room is the most recent PDU in that room.
+		sort.Slice(nids, func(i, j int) bool { return nids[i] < nids[j] })
+		latest := make(map[string]int64)
+		for i := 0; i < len(nids); i += collapsePDUsBatchSize {
+			batch := nids[i:]
+			if len(batch) > collapsePDUsBatchSize {
+				batch = batch[:collapsePDUsBatchSize]
+			}
+			blobs, err := d.FederationSenderQueueJSON.SelectQueueJSON(ctx, txn, batch)
 			if err != nil {
-				return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
+				return fmt.Errorf("SelectQueueJSON: %w", err)
 			}
-			if count == 0 {
-				deleteNIDs = append(deleteNIDs, nid)
-				d.Cache.EvictFederationSenderQueuedPDU(nid)
+			for _, nid := range batch {
+				roomID := gjson.GetBytes(blobs[nid], "room_id").Str
+				if current, ok := latest[roomID]; !ok || nid > current {
+					latest[roomID] = nid
+				}
 			}
 		}
-
-		if len(deleteNIDs) > 0 {
-			if err := d.FederationSenderQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
-				return fmt.Errorf("DeleteQueueJSON: %w", err)
+		keep := make(map[int64]struct{}, len(latest))
+		for _, nid := range latest {
+			keep[nid] = struct{}{}
+		}
+		drop := make([]int64, 0, len(nids)-len(keep))
+		for _, nid := range nids {
+			if _, ok := keep[nid]; !ok {
+				drop = append(drop, nid)
 			}
 		}
-
+		for i := 0; i < len(drop); i += collapsePDUsBatchSize {
+			batch := drop[i:]
+			if len(batch) > collapsePDUsBatchSize {
+				batch = batch[:collapsePDUsBatchSize]
+			}
+			if err = d.cleanPDUs(ctx, txn, serverName, batch); err != nil {
+				return err
+			}
+		}
+		dropped = len(drop)
 		return nil
 	})
+	return
 }
 
 // GetPendingPDUCount returns the number of PDUs waiting to be
@@ -53,6 +53,7 @@ type FederationSenderJoinedHosts interface {
 	SelectJoinedHostsWithTx(ctx context.Context, txn *sql.Tx, roomID string) ([]types.JoinedHost, error)
 	SelectJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
 	SelectAllJoinedHosts(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+	SelectTopJoinedHosts(ctx context.Context, limit int) ([]types.JoinedHostCount, error)
 	SelectJoinedHostsForRooms(ctx context.Context, roomIDs []string) ([]gomatrixserverlib.ServerName, error)
 }
 
@@ -67,3 +68,15 @@ type FederationSenderBlacklist interface {
 	SelectBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (bool, error)
 	DeleteBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
 }
+
+type FederationSenderInFlightJoins interface {
+	UpsertInFlightJoin(ctx context.Context, txn *sql.Tx, join *types.InFlightJoin) error
+	DeleteInFlightJoin(ctx context.Context, txn *sql.Tx, roomID, userID string) error
+	SelectInFlightJoins(ctx context.Context, txn *sql.Tx) ([]types.InFlightJoin, error)
+}
+
+type FederationSenderBackoff interface {
+	UpsertBackoff(ctx context.Context, txn *sql.Tx, backoff *types.ServerBackoff) error
+	DeleteBackoff(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
+	SelectBackoff(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (*types.ServerBackoff, error)
+}
@@ -16,6 +16,7 @@ package types
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -28,12 +29,66 @@ type JoinedHost struct {
 	ServerName gomatrixserverlib.ServerName
 }
 
+// A JoinedHostCount is a server along with the number of rooms that it is
+// joined to which we are also joined to.
+type JoinedHostCount struct {
+	ServerName gomatrixserverlib.ServerName
+	RoomCount  int
+}
+
 type ServerNames []gomatrixserverlib.ServerName
 
 func (s ServerNames) Len() int           { return len(s) }
 func (s ServerNames) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ServerNames) Less(i, j int) bool { return s[i] < s[j] }
 
+// JoinProgress describes how far through the make_join/send_join
+// process a federated join has got.
+type JoinProgress string
+
+const (
+	// JoinProgressMakeJoin means that a make_join request has been sent.
+	JoinProgressMakeJoin JoinProgress = "make_join"
+	// JoinProgressEventSigned means that the join event has been built
+	// and signed from the make_join template.
+	JoinProgressEventSigned JoinProgress = "event_signed"
+	// JoinProgressSendJoin means that a send_join request is pending.
+	JoinProgressSendJoin JoinProgress = "send_join"
+	// JoinProgressProcessingState means that the send_join succeeded and
+	// the returned room state is being sent to the roomserver.
+	JoinProgressProcessingState JoinProgress = "processing_state"
+)
+
+// An InFlightJoin is a federated join that has been started but has not
+// yet completed. These are persisted so that joins interrupted by a crash
+// or restart can be resumed.
+type InFlightJoin struct {
+	RoomID string
+	UserID string
+	// The servers that we were asked to try joining through, in order.
+	ServerNames ServerNames
+	// The membership event content supplied by the client.
+	Content map[string]interface{}
+	// The server that we were last trying to join through.
+	ServerName gomatrixserverlib.ServerName
+	Progress   JoinProgress
+	// How many times the join has been resumed after being interrupted.
+	Attempts int
+	// When the join was first started.
+	Started gomatrixserverlib.Timestamp
+}
+
+// A ServerBackoff describes how long we are backing off from sending
+// to a remote server. These are persisted so that a restart doesn't
+// reset the backoff and cause us to hammer servers that are down.
+type ServerBackoff struct {
+	ServerName gomatrixserverlib.ServerName
+	// The number of consecutive failures that caused this backoff.
+	FailureCount uint32
+	// The time at which we should next try sending to the server.
+	RetryAfter time.Time
+}
+
 // A EventIDMismatchError indicates that we have got out of sync with the
 // room server.
 type EventIDMismatchError struct {
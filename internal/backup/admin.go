@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// AddPublicRoutes registers the /_dendrite/admin/v1/backup endpoint on the
+// admin API router. A POST starts a backup in the background and a GET
+// returns the status of the most recent backup.
+func AddPublicRoutes(dendriteAdminRouter *mux.Router, cfg *config.Dendrite, userAPI userapi.UserInternalAPI) {
+	b := &adminBackup{cfg: cfg}
+	adminMux := dendriteAdminRouter.PathPrefix("/v1").Subrouter()
+	adminMux.Handle("/backup",
+		httputil.MakeAdminAPI("admin_backup", &cfg.Global, userAPI, b.handle),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+}
+
+type adminBackup struct {
+	cfg     *config.Dendrite
+	mutex   sync.Mutex    // protects the below
+	running bool          // is a backup running?
+	last    *backupStatus // the most recent backup, if any
+}
+
+type backupStatus struct {
+	Directory  string                      `json:"directory,omitempty"`
+	StartedTS  gomatrixserverlib.Timestamp `json:"started_ts"`
+	FinishedTS gomatrixserverlib.Timestamp `json:"finished_ts,omitempty"`
+	Error      string                      `json:"error,omitempty"`
+	Manifest   *Manifest                   `json:"manifest,omitempty"`
+}
+
+type backupResponse struct {
+	Running    bool          `json:"running"`
+	LastBackup *backupStatus `json:"last_backup,omitempty"`
+}
+
+func (b *adminBackup) handle(req *http.Request) util.JSONResponse {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if req.Method == http.MethodGet {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: b.response(),
+		}
+	}
+	if b.running {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.Unknown("A backup is already running"),
+		}
+	}
+
+	status := &backupStatus{
+		StartedTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	b.running, b.last = true, status
+	util.GetLogger(req.Context()).Info("Starting backup")
+	go func() {
+		// The backup carries on after the request has finished.
+		dir, manifest, err := Run(context.Background(), b.cfg)
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.running = false
+		status.Directory = dir
+		status.FinishedTS = gomatrixserverlib.AsTimestamp(time.Now())
+		status.Manifest = manifest
+		if err != nil {
+			logrus.WithError(err).Error("Backup failed")
+			status.Error = err.Error()
+			return
+		}
+		logrus.WithField("directory", dir).Info("Backup finished")
+	}()
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: b.response(),
+	}
+}
+
+// response returns the current status. The status of the last backup is
+// copied as it is updated once the backup finishes. The mutex must be held.
+func (b *adminBackup) response() backupResponse {
+	res := backupResponse{Running: b.running}
+	if b.last != nil {
+		last := *b.last
+		res.LastBackup = &last
+	}
+	return res
+}
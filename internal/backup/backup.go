@@ -0,0 +1,284 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup takes consistent snapshots of the databases of all of the
+// components, along with a manifest of the files in the media store, while
+// the server is running.
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	mediastorage "github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ManifestFilename is the name of the file describing the backup.
+	ManifestFilename = "manifest.json"
+	// MediaManifestFilename is the name of the file listing the files in the
+	// media store, one JSON object per line.
+	MediaManifestFilename = "media_manifest.jsonl"
+)
+
+// errDatabaseNotFound is returned when a SQLite database doesn't exist, which
+// is the case if the component using it has never been started.
+var errDatabaseNotFound = errors.New("database does not exist")
+
+// How many media to look up from the database at a time for the media manifest.
+const mediaBatchSize = 1000
+
+// Manifest describes a backup.
+type Manifest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	StartedTS  gomatrixserverlib.Timestamp  `json:"started_ts"`
+	FinishedTS gomatrixserverlib.Timestamp  `json:"finished_ts"`
+	Databases  []DatabaseBackup             `json:"databases"`
+	// Where the media files listed in the media manifest are stored. The
+	// files themselves are not part of the backup.
+	MediaStorage config.MediaStorageProvider `json:"media_storage"`
+	MediaFiles   int                         `json:"media_files"`
+}
+
+// DatabaseBackup describes the backup of a single database.
+type DatabaseBackup struct {
+	// The components using the database. Components may share a database.
+	Components []string `json:"components"`
+	// Either "sqlite3" or "postgres".
+	Engine string `json:"engine"`
+	// The name of the backup file, relative to the backup directory. For
+	// PostgreSQL databases this is in the pg_dump custom format, which can
+	// be restored using pg_restore.
+	File      string `json:"file"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// MediaFile is an entry in the media manifest.
+type MediaFile struct {
+	MediaID       types.MediaID                `json:"media_id"`
+	Origin        gomatrixserverlib.ServerName `json:"origin"`
+	ContentType   types.ContentType            `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes          `json:"file_size_bytes"`
+	UploadName    types.Filename               `json:"upload_name"`
+	Base64Hash    types.Base64Hash             `json:"base64hash"`
+	UserID        types.MatrixUserID           `json:"user_id"`
+	// The key of the file in the media store
+	Key string `json:"key"`
+}
+
+type database struct {
+	components []string
+	options    *config.DatabaseOptions
+}
+
+// databases returns the databases of all of the components, grouping together
+// components that share a database so that it is only backed up once.
+func databases(cfg *config.Dendrite) []*database {
+	components := []struct {
+		name    string
+		options *config.DatabaseOptions
+	}{
+		{"appservice", &cfg.AppServiceAPI.Database},
+		{"federationsender", &cfg.FederationSender.Database},
+		{"keyserver", &cfg.KeyServer.Database},
+		{"mediaapi", &cfg.MediaAPI.Database},
+		{"roomserver", &cfg.RoomServer.Database},
+		{"signingkeyserver", &cfg.SigningKeyServer.Database},
+		{"syncapi", &cfg.SyncAPI.Database},
+		{"userapi_accounts", &cfg.UserAPI.AccountDatabase},
+		{"userapi_devices", &cfg.UserAPI.DeviceDatabase},
+	}
+	if cfg.Global.Kafka.UseNaffka {
+		components = append(components, struct {
+			name    string
+			options *config.DatabaseOptions
+		}{"naffka", &cfg.Global.Kafka.Database})
+	}
+	if len(cfg.MSCs.MSCs) > 0 {
+		components = append(components, struct {
+			name    string
+			options *config.DatabaseOptions
+		}{"mscs", &cfg.MSCs.Database})
+	}
+
+	var dbs []*database
+	byConnectionString := make(map[config.DataSource]*database)
+	for _, c := range components {
+		if db, ok := byConnectionString[c.options.ConnectionString]; ok {
+			db.components = append(db.components, c.name)
+			continue
+		}
+		db := &database{
+			components: []string{c.name},
+			options:    c.options,
+		}
+		byConnectionString[c.options.ConnectionString] = db
+		dbs = append(dbs, db)
+	}
+	return dbs
+}
+
+// Run takes a backup of all of the databases, and writes a manifest of the
+// media store, into a new directory within the configured backup directory.
+// It returns the path to the new directory. The backup is consistent for each
+// database, but not across databases, as the server keeps running.
+func Run(ctx context.Context, cfg *config.Dendrite) (string, *Manifest, error) {
+	started := time.Now()
+	dir := filepath.Join(string(cfg.Global.Backup.Directory), started.UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", nil, fmt.Errorf("os.Mkdir: %w", err)
+	}
+	manifest := &Manifest{
+		ServerName:   cfg.Global.ServerName,
+		StartedTS:    gomatrixserverlib.AsTimestamp(started),
+		MediaStorage: cfg.MediaAPI.Storage.Provider,
+	}
+
+	for _, db := range databases(cfg) {
+		logger := logrus.WithField("components", db.components)
+		logger.Info("Backing up database")
+		backup, err := backupDatabase(ctx, cfg, dir, db)
+		if err == errDatabaseNotFound {
+			logger.Warn("Skipping database which does not exist")
+			continue
+		}
+		if err != nil {
+			return dir, nil, fmt.Errorf("failed to back up database for %v: %w", db.components, err)
+		}
+		logger.WithField("size_bytes", backup.SizeBytes).Info("Backed up database")
+		manifest.Databases = append(manifest.Databases, *backup)
+	}
+
+	var err error
+	if manifest.MediaFiles, err = writeMediaManifest(ctx, cfg, filepath.Join(dir, MediaManifestFilename)); err != nil {
+		return dir, nil, fmt.Errorf("failed to write media manifest: %w", err)
+	}
+
+	manifest.FinishedTS = gomatrixserverlib.AsTimestamp(time.Now())
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return dir, nil, fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, ManifestFilename), manifestJSON, 0600); err != nil {
+		return dir, nil, fmt.Errorf("ioutil.WriteFile: %w", err)
+	}
+	return dir, manifest, nil
+}
+
+func backupDatabase(ctx context.Context, cfg *config.Dendrite, dir string, db *database) (*DatabaseBackup, error) {
+	backup := &DatabaseBackup{
+		Components: db.components,
+	}
+	var err error
+	switch {
+	case db.options.ConnectionString.IsSQLite():
+		backup.Engine = "sqlite3"
+		backup.File = db.components[0] + ".db"
+		err = backupSQLite(ctx, db.options.ConnectionString, filepath.Join(dir, backup.File))
+	case db.options.ConnectionString.IsPostgres():
+		backup.Engine = "postgres"
+		backup.File = db.components[0] + ".pgdump"
+		err = backupPostgres(ctx, cfg.Global.Backup.PgDumpPath, db.options.ConnectionString, filepath.Join(dir, backup.File))
+	default:
+		return nil, fmt.Errorf("unknown database type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.Join(dir, backup.File))
+	if err != nil {
+		return nil, fmt.Errorf("os.Stat: %w", err)
+	}
+	backup.SizeBytes = info.Size()
+	return backup, nil
+}
+
+// backupPostgres uses pg_dump, which takes a consistent snapshot of the
+// database without blocking writes to it.
+func backupPostgres(ctx context.Context, pgDumpPath string, connectionString config.DataSource, dest string) error {
+	cmd := exec.CommandContext(ctx, pgDumpPath, "--format=custom", "--file="+dest, "--dbname="+string(connectionString))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_dump failed: %w: %s", err, output)
+	}
+	return nil
+}
+
+// writeMediaManifest writes a line for each media file in the media store to
+// the given file, returning the number of media files.
+func writeMediaManifest(ctx context.Context, cfg *config.Dendrite, dest string) (int, error) {
+	mediaDB, err := mediastorage.Open(&cfg.MediaAPI.Database)
+	if err != nil {
+		return 0, fmt.Errorf("mediastorage.Open: %w", err)
+	}
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	count := 0
+	var afterOrigin gomatrixserverlib.ServerName
+	var afterMediaID types.MediaID
+	for {
+		media, err := mediaDB.GetMediaMetadataAfter(ctx, afterOrigin, afterMediaID, mediaBatchSize)
+		if err != nil {
+			return count, fmt.Errorf("mediaDB.GetMediaMetadataAfter: %w", err)
+		}
+		for _, m := range media {
+			key, err := fileutils.GetKeyFromBase64Hash(m.Base64Hash)
+			if err != nil {
+				return count, fmt.Errorf("fileutils.GetKeyFromBase64Hash: %w", err)
+			}
+			if err = encoder.Encode(MediaFile{
+				MediaID:       m.MediaID,
+				Origin:        m.Origin,
+				ContentType:   m.ContentType,
+				FileSizeBytes: m.FileSizeBytes,
+				UploadName:    m.UploadName,
+				Base64Hash:    m.Base64Hash,
+				UserID:        m.UserID,
+				Key:           key,
+			}); err != nil {
+				return count, err
+			}
+			count++
+			afterOrigin, afterMediaID = m.Origin, m.MediaID
+		}
+		if len(media) < mediaBatchSize {
+			break
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return count, err
+	}
+	return count, file.Close()
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupSQLite copies the database to dest using the SQLite online backup
+// API. The whole database is copied in a single step, so the copy is
+// consistent even if the server writes to the database at the same time.
+func backupSQLite(ctx context.Context, connectionString config.DataSource, dest string) error {
+	path, err := sqlutil.ParseFileURI(connectionString)
+	if err != nil {
+		return err
+	}
+	// Opening a database which doesn't exist would create an empty one.
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		return errDatabaseNotFound
+	} else if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+	srcDB, err := sql.Open("sqlite3", string(connectionString))
+	if err != nil {
+		return fmt.Errorf("sql.Open: %w", err)
+	}
+	defer srcDB.Close() // nolint: errcheck
+	destDB, err := sql.Open("sqlite3", "file:"+dest)
+	if err != nil {
+		return fmt.Errorf("sql.Open: %w", err)
+	}
+	defer destDB.Close() // nolint: errcheck
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("srcDB.Conn: %w", err)
+	}
+	defer srcConn.Close() // nolint: errcheck
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("destDB.Conn: %w", err)
+	}
+	defer destConn.Close() // nolint: errcheck
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSQLiteConn, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected connection type %T", destDriverConn)
+			}
+			srcSQLiteConn, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected connection type %T", srcDriverConn)
+			}
+			backup, err := destSQLiteConn.Backup("main", srcSQLiteConn, "main")
+			if err != nil {
+				return fmt.Errorf("destSQLiteConn.Backup: %w", err)
+			}
+			if _, err = backup.Step(-1); err != nil {
+				_ = backup.Finish()
+				return fmt.Errorf("backup.Step: %w", err)
+			}
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package caching
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The estimated memory used by a cache entry on top of the size of its key
+// and value, e.g. for the LRU list elements, map buckets and interfaces.
+const entryOverhead = 128
+
+// Budget is an estimated memory target which is shared by all of the
+// in-memory cache partitions. When the estimated size of everything in the
+// caches grows past the target, the least recently used entries are evicted
+// from whichever partitions they are in, so that a busy partition can't grow
+// without bound just because every partition is within its own entry limit.
+type Budget struct {
+	maxBytes int64
+	mu       sync.Mutex
+	used     int64
+	entries  *list.List // of *budgetEntry, most recently used at the front
+}
+
+// budgetEntry is what is stored in a partition for each key, so that the
+// budget can find its way back to the partition to evict it.
+type budgetEntry struct {
+	partition *InMemoryLRUCachePartition
+	key       string
+	value     interface{}
+	size      int64
+	element   *list.Element // nil once the budget has stopped counting the entry
+}
+
+// NewBudget creates a new budget with the given estimated target in bytes.
+// A target of zero or less means that the size is only measured, and entries
+// are only evicted when their partitions are full.
+func NewBudget(maxBytes int64) *Budget {
+	return &Budget{
+		maxBytes: maxBytes,
+		entries:  list.New(),
+	}
+}
+
+// EstimatedSize returns the estimated number of bytes used by everything in
+// the caches.
+func (b *Budget) EstimatedSize() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// add starts counting a new entry, and then evicts the least recently used
+// entries until everything fits into the budget again. The newest entry is
+// never evicted, even if it doesn't fit on its own.
+func (b *Budget) add(e *budgetEntry) {
+	var evicted []*budgetEntry
+	b.mu.Lock()
+	e.element = b.entries.PushFront(e)
+	b.used += e.size
+	for b.maxBytes > 0 && b.used > b.maxBytes && b.entries.Len() > 1 {
+		oldest := b.entries.Back().Value.(*budgetEntry)
+		b.removeLocked(oldest)
+		evicted = append(evicted, oldest)
+	}
+	b.mu.Unlock()
+	// The partitions are told without holding the lock, as removing the
+	// entries from them calls back into remove.
+	for _, oldest := range evicted {
+		oldest.partition.evict(oldest)
+	}
+}
+
+// touch marks the entry as the most recently used.
+func (b *Budget) touch(e *budgetEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e.element != nil {
+		b.entries.MoveToFront(e.element)
+	}
+}
+
+// remove stops counting the entry, e.g. because it has been removed from its
+// partition.
+func (b *Budget) remove(e *budgetEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(e)
+}
+
+func (b *Budget) removeLocked(e *budgetEntry) {
+	if e.element == nil {
+		return
+	}
+	b.entries.Remove(e.element)
+	e.element = nil
+	b.used -= e.size
+}
+
+// estimateSize estimates how much memory a cache entry uses. It only looks at
+// the values that are big or vary in size: anything else is assumed to fit
+// into the overhead.
+func estimateSize(key string, value interface{}) int64 {
+	size := entryOverhead + len(key)
+	switch v := value.(type) {
+	case string:
+		size += len(v)
+	case []byte:
+		size += len(v)
+	case gomatrixserverlib.RoomVersion:
+		size += len(v)
+	case *gomatrixserverlib.HeaderedEvent:
+		size += len(v.JSON())
+	case gomatrixserverlib.PublicKeyLookupResult:
+		size += len(v.Key)
+	case NotificationRoomContext:
+		size += len(v.RoomName)
+	case roomServerACLs:
+		for serverName := range v.banned {
+			size += len(serverName) + 16
+		}
+	}
+	return int64(size)
+}
@@ -0,0 +1,71 @@
+package caching
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustCreatePartition(t *testing.T, name string, maxEntries int, budget *Budget) *InMemoryLRUCachePartition {
+	t.Helper()
+	partition, err := NewInMemoryLRUCachePartition(name, true, maxEntries, budget, false)
+	if err != nil {
+		t.Fatalf("failed to create partition: %s", err)
+	}
+	return partition
+}
+
+func TestBudgetEvictsLeastRecentlyUsedAcrossPartitions(t *testing.T) {
+	value := strings.Repeat("x", 100)
+	entrySize := estimateSize("a1", value)
+	budget := NewBudget(3 * entrySize)
+	a := mustCreatePartition(t, "a", 10, budget)
+	b := mustCreatePartition(t, "b", 10, budget)
+
+	a.Set("a1", value)
+	b.Set("b1", value)
+	a.Set("a2", value)
+	// Using a1 makes b1 the least recently used entry.
+	if _, ok := a.Get("a1"); !ok {
+		t.Fatalf("a1 is missing")
+	}
+	b.Set("b2", value)
+
+	if _, ok := b.Get("b1"); ok {
+		t.Errorf("b1 should have been evicted")
+	}
+	for _, key := range []string{"a1", "a2"} {
+		if _, ok := a.Get(key); !ok {
+			t.Errorf("%s should not have been evicted", key)
+		}
+	}
+	if _, ok := b.Get("b2"); !ok {
+		t.Errorf("b2 should not have been evicted")
+	}
+	if got, want := budget.EstimatedSize(), 3*entrySize; got != want {
+		t.Errorf("got estimated size %d, want %d", got, want)
+	}
+}
+
+func TestBudgetCountsReplacedAndRemovedEntries(t *testing.T) {
+	budget := NewBudget(0)
+	a := mustCreatePartition(t, "a", 2, budget)
+
+	a.Set("a1", "short")
+	a.Set("a1", "longer value")
+	if got, want := budget.EstimatedSize(), estimateSize("a1", "longer value"); got != want {
+		t.Errorf("after replacing: got estimated size %d, want %d", got, want)
+	}
+
+	// The partition only holds two entries, so a1 falls out of it.
+	a.Set("a2", "value")
+	a.Set("a3", "value")
+	if got, want := budget.EstimatedSize(), 2*estimateSize("a2", "value"); got != want {
+		t.Errorf("after partition eviction: got estimated size %d, want %d", got, want)
+	}
+
+	a.Unset("a2")
+	a.Unset("a3")
+	if got := budget.EstimatedSize(); got != 0 {
+		t.Errorf("after unsetting: got estimated size %d, want 0", got)
+	}
+}
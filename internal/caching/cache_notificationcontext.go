@@ -0,0 +1,83 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The notification context cache is keyed on the room NID and the state
+// snapshot NID of the current room state. Any state change will result in
+// a new state snapshot NID, so entries never need to be invalidated: they
+// will simply stop being looked up and will fall out of the LRU. This is
+// only safe because the state snapshot NIDs are taken from the RoomInfo
+// cache, which is kept up-to-date by the latest events updater, so this
+// cache MUST NOT be used outside of the roomserver.
+
+const (
+	NotificationContextCacheName       = "notification_context"
+	NotificationContextCacheMaxEntries = 4096
+	NotificationContextCacheMutable    = true // concurrent misses may store the same key twice
+)
+
+// NotificationRoomContext contains the information about a room that is
+// needed to render a notification for an event in that room.
+type NotificationRoomContext struct {
+	RoomName          string
+	JoinedMemberCount int
+}
+
+// NotificationContextCache contains the subset of functions needed for
+// a notification context cache. It must only be used from the roomserver.
+type NotificationContextCache interface {
+	GetNotificationRoomContext(roomNID types.RoomNID, stateNID types.StateSnapshotNID) (roomContext NotificationRoomContext, ok bool)
+	StoreNotificationRoomContext(roomNID types.RoomNID, stateNID types.StateSnapshotNID, roomContext NotificationRoomContext)
+	GetNotificationSenderDisplayName(roomNID types.RoomNID, stateNID types.StateSnapshotNID, userID string) (displayName string, ok bool)
+	StoreNotificationSenderDisplayName(roomNID types.RoomNID, stateNID types.StateSnapshotNID, userID, displayName string)
+}
+
+func (c Caches) GetNotificationRoomContext(roomNID types.RoomNID, stateNID types.StateSnapshotNID) (NotificationRoomContext, bool) {
+	key := fmt.Sprintf("%d/%d", roomNID, stateNID)
+	val, found := c.NotificationContexts.Get(key)
+	if found && val != nil {
+		if roomContext, ok := val.(NotificationRoomContext); ok {
+			return roomContext, true
+		}
+	}
+	return NotificationRoomContext{}, false
+}
+
+func (c Caches) StoreNotificationRoomContext(roomNID types.RoomNID, stateNID types.StateSnapshotNID, roomContext NotificationRoomContext) {
+	key := fmt.Sprintf("%d/%d", roomNID, stateNID)
+	c.NotificationContexts.Set(key, roomContext)
+}
+
+func (c Caches) GetNotificationSenderDisplayName(roomNID types.RoomNID, stateNID types.StateSnapshotNID, userID string) (string, bool) {
+	key := fmt.Sprintf("%d/%d/%s", roomNID, stateNID, userID)
+	val, found := c.NotificationContexts.Get(key)
+	if found && val != nil {
+		if displayName, ok := val.(string); ok {
+			return displayName, true
+		}
+	}
+	return "", false
+}
+
+func (c Caches) StoreNotificationSenderDisplayName(roomNID types.RoomNID, stateNID types.StateSnapshotNID, userID, displayName string) {
+	key := fmt.Sprintf("%d/%d/%s", roomNID, stateNID, userID)
+	c.NotificationContexts.Set(key, displayName)
+}
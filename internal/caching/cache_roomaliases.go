@@ -0,0 +1,49 @@
+package caching
+
+import (
+	"time"
+)
+
+// The room alias cache remembers aliases which couldn't be resolved over
+// federation, so that repeated joins to an alias that doesn't exist, or
+// whose servers are unreachable, don't have to wait on every server again.
+// Entries expire after RoomAliasFailureCacheLifetime.
+
+const (
+	RoomAliasFailureCacheName       = "room_alias_failures"
+	RoomAliasFailureCacheMaxEntries = 1024
+	RoomAliasFailureCacheMutable    = true
+	RoomAliasFailureCacheLifetime   = time.Minute * 5
+)
+
+// RoomAliasFailureCache contains the subset of functions needed for
+// a negative room alias lookup cache.
+type RoomAliasFailureCache interface {
+	GetRoomAliasFailure(roomAlias string) (reason string, ok bool)
+	StoreRoomAliasFailure(roomAlias string, reason string)
+}
+
+type roomAliasFailure struct {
+	reason  string
+	expires time.Time
+}
+
+func (c Caches) GetRoomAliasFailure(roomAlias string) (string, bool) {
+	val, found := c.RoomAliasFailures.Get(roomAlias)
+	if found && val != nil {
+		if failure, ok := val.(roomAliasFailure); ok {
+			if time.Now().Before(failure.expires) {
+				return failure.reason, true
+			}
+			c.RoomAliasFailures.Unset(roomAlias)
+		}
+	}
+	return "", false
+}
+
+func (c Caches) StoreRoomAliasFailure(roomAlias string, reason string) {
+	c.RoomAliasFailures.Set(roomAlias, roomAliasFailure{
+		reason:  reason,
+		expires: time.Now().Add(RoomAliasFailureCacheLifetime),
+	})
+}
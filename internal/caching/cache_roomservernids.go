@@ -15,6 +15,10 @@ const (
 	RoomServerEventTypeNIDsCacheMaxEntries = 64
 	RoomServerEventTypeNIDsCacheMutable    = false
 
+	RoomServerRoomNIDsCacheName       = "roomserver_room_nids"
+	RoomServerRoomNIDsCacheMaxEntries = 1024
+	RoomServerRoomNIDsCacheMutable    = true // to allow use of Unset only, if a room is purged
+
 	RoomServerRoomIDsCacheName       = "roomserver_room_ids"
 	RoomServerRoomIDsCacheMaxEntries = 1024
 	RoomServerRoomIDsCacheMutable    = false
@@ -24,6 +28,8 @@ type RoomServerCaches interface {
 	RoomServerNIDsCache
 	RoomVersionCache
 	RoomInfoCache
+	NotificationContextCache
+	RoomAliasFailureCache
 }
 
 // RoomServerNIDsCache contains the subset of functions needed for
@@ -35,6 +41,10 @@ type RoomServerNIDsCache interface {
 	GetRoomServerEventTypeNID(eventType string) (types.EventTypeNID, bool)
 	StoreRoomServerEventTypeNID(eventType string, nid types.EventTypeNID)
 
+	GetRoomServerRoomNID(roomID string) (types.RoomNID, bool)
+	StoreRoomServerRoomNID(roomID string, nid types.RoomNID)
+	EvictRoomServerRoomNID(roomID string)
+
 	GetRoomServerRoomID(roomNID types.RoomNID) (string, bool)
 	StoreRoomServerRoomID(roomNID types.RoomNID, roomID string)
 }
@@ -67,6 +77,24 @@ func (c Caches) StoreRoomServerEventTypeNID(eventType string, nid types.EventTyp
 	c.RoomServerEventTypeNIDs.Set(eventType, nid)
 }
 
+func (c Caches) GetRoomServerRoomNID(roomID string) (types.RoomNID, bool) {
+	val, found := c.RoomServerRoomNIDs.Get(roomID)
+	if found && val != nil {
+		if roomNID, ok := val.(types.RoomNID); ok {
+			return roomNID, true
+		}
+	}
+	return 0, false
+}
+
+func (c Caches) StoreRoomServerRoomNID(roomID string, nid types.RoomNID) {
+	c.RoomServerRoomNIDs.Set(roomID, nid)
+}
+
+func (c Caches) EvictRoomServerRoomNID(roomID string) {
+	c.RoomServerRoomNIDs.Unset(roomID)
+}
+
 func (c Caches) GetRoomServerRoomID(roomNID types.RoomNID) (string, bool) {
 	val, found := c.RoomServerRoomIDs.Get(strconv.Itoa(int(roomNID)))
 	if found && val != nil {
@@ -0,0 +1,75 @@
+package caching
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The server ACL cache remembers whether servers are banned from rooms by
+// the m.room.server_acl state, so that components which talk to the
+// roomserver over HTTP don't have to ask it for every federation request and
+// every destination of every event. Entries are evicted by consumers of the
+// roomserver output log when the ACLs of a room change, and expire after
+// ServerACLCacheLifetime anyway for components which don't consume it.
+
+const (
+	ServerACLCacheName       = "server_acls"
+	ServerACLCacheMaxEntries = 1024
+	ServerACLCacheMutable    = true // stores are copy-on-write, so a concurrent store may be lost
+	ServerACLCacheLifetime   = time.Minute
+)
+
+// ServerACLCache contains the subset of functions needed for a server ACL
+// cache.
+type ServerACLCache interface {
+	GetServerBannedFromRoom(roomID string, serverName gomatrixserverlib.ServerName) (banned, ok bool)
+	StoreServerBannedFromRoom(roomID string, serverName gomatrixserverlib.ServerName, banned bool)
+	EvictServerACLs(roomID string)
+}
+
+// roomServerACLs is the cached result for each server that has been looked
+// up in a room. It's never modified once it has been stored.
+type roomServerACLs struct {
+	banned  map[gomatrixserverlib.ServerName]bool
+	expires time.Time
+}
+
+func (c Caches) getRoomServerACLs(roomID string) (roomServerACLs, bool) {
+	val, found := c.ServerACLs.Get(roomID)
+	if found && val != nil {
+		if acls, ok := val.(roomServerACLs); ok && time.Now().Before(acls.expires) {
+			return acls, true
+		}
+	}
+	return roomServerACLs{}, false
+}
+
+func (c Caches) GetServerBannedFromRoom(roomID string, serverName gomatrixserverlib.ServerName) (bool, bool) {
+	acls, ok := c.getRoomServerACLs(roomID)
+	if !ok {
+		return false, false
+	}
+	banned, ok := acls.banned[serverName]
+	return banned, ok
+}
+
+func (c Caches) StoreServerBannedFromRoom(roomID string, serverName gomatrixserverlib.ServerName, banned bool) {
+	acls, ok := c.getRoomServerACLs(roomID)
+	if !ok {
+		acls = roomServerACLs{
+			expires: time.Now().Add(ServerACLCacheLifetime),
+		}
+	}
+	updated := make(map[gomatrixserverlib.ServerName]bool, len(acls.banned)+1)
+	for s, b := range acls.banned {
+		updated[s] = b
+	}
+	updated[serverName] = banned
+	acls.banned = updated
+	c.ServerACLs.Set(roomID, acls)
+}
+
+func (c Caches) EvictServerACLs(roomID string) {
+	c.ServerACLs.Unset(roomID)
+}
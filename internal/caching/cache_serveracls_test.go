@@ -0,0 +1,32 @@
+package caching
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestServerACLCache(t *testing.T) {
+	c := Caches{ServerACLs: mustCreatePartition(t, ServerACLCacheName, 10, NewBudget(0))}
+	roomID := "!room:a"
+
+	if _, ok := c.GetServerBannedFromRoom(roomID, "b"); ok {
+		t.Fatalf("got a result before anything was stored")
+	}
+	c.StoreServerBannedFromRoom(roomID, "b", true)
+	c.StoreServerBannedFromRoom(roomID, "c", false)
+	for server, want := range map[string]bool{"b": true, "c": false} {
+		banned, ok := c.GetServerBannedFromRoom(roomID, gomatrixserverlib.ServerName(server))
+		if !ok || banned != want {
+			t.Errorf("server %s: got banned=%v ok=%v, want banned=%v", server, banned, ok, want)
+		}
+	}
+	if _, ok := c.GetServerBannedFromRoom("!other:a", "b"); ok {
+		t.Errorf("got a result for a different room")
+	}
+
+	c.EvictServerACLs(roomID)
+	if _, ok := c.GetServerBannedFromRoom(roomID, "b"); ok {
+		t.Errorf("got a result after the room was evicted")
+	}
+}
@@ -12,6 +12,9 @@ type Caches struct {
 	RoomServerRoomIDs       Cache // RoomServerNIDsCache
 	RoomInfos               Cache // RoomInfoCache
 	FederationEvents        Cache // FederationEventsCache
+	NotificationContexts    Cache // NotificationContextCache
+	RoomAliasFailures       Cache // RoomAliasFailureCache
+	ServerACLs              Cache // ServerACLCache
 }
 
 // Cache is the interface that an implementation must satisfy.
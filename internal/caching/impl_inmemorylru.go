@@ -2,17 +2,32 @@ package caching
 
 import (
 	"fmt"
+	"sync"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
+// NewInMemoryLRUCache creates all of the caches, sharing a budget with the
+// given estimated target in bytes between them. See NewBudget.
+func NewInMemoryLRUCache(maxEstimatedBytes int64, enablePrometheus bool) (*Caches, error) {
+	budget := NewBudget(maxEstimatedBytes)
+	if enablePrometheus {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_in_memory_lru",
+			Name:      "estimated_size_bytes",
+			Help:      "Estimated number of bytes used by all of the cache partitions",
+		}, func() float64 {
+			return float64(budget.EstimatedSize())
+		})
+	}
 	roomVersions, err := NewInMemoryLRUCachePartition(
 		RoomVersionCacheName,
 		RoomVersionCacheMutable,
 		RoomVersionCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -22,6 +37,7 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		ServerKeyCacheName,
 		ServerKeyCacheMutable,
 		ServerKeyCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -31,6 +47,7 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		RoomServerStateKeyNIDsCacheName,
 		RoomServerStateKeyNIDsCacheMutable,
 		RoomServerStateKeyNIDsCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -40,6 +57,17 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		RoomServerEventTypeNIDsCacheName,
 		RoomServerEventTypeNIDsCacheMutable,
 		RoomServerEventTypeNIDsCacheMaxEntries,
+		budget,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	roomServerRoomNIDs, err := NewInMemoryLRUCachePartition(
+		RoomServerRoomNIDsCacheName,
+		RoomServerRoomNIDsCacheMutable,
+		RoomServerRoomNIDsCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -49,6 +77,7 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		RoomServerRoomIDsCacheName,
 		RoomServerRoomIDsCacheMutable,
 		RoomServerRoomIDsCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -58,6 +87,7 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		RoomInfoCacheName,
 		RoomInfoCacheMutable,
 		RoomInfoCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -67,6 +97,37 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		FederationEventCacheName,
 		FederationEventCacheMutable,
 		FederationEventCacheMaxEntries,
+		budget,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	notificationContexts, err := NewInMemoryLRUCachePartition(
+		NotificationContextCacheName,
+		NotificationContextCacheMutable,
+		NotificationContextCacheMaxEntries,
+		budget,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	roomAliasFailures, err := NewInMemoryLRUCachePartition(
+		RoomAliasFailureCacheName,
+		RoomAliasFailureCacheMutable,
+		RoomAliasFailureCacheMaxEntries,
+		budget,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	serverACLs, err := NewInMemoryLRUCachePartition(
+		ServerACLCacheName,
+		ServerACLCacheMutable,
+		ServerACLCacheMaxEntries,
+		budget,
 		enablePrometheus,
 	)
 	if err != nil {
@@ -77,9 +138,13 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		ServerKeys:              serverKeys,
 		RoomServerStateKeyNIDs:  roomServerStateKeyNIDs,
 		RoomServerEventTypeNIDs: roomServerEventTypeNIDs,
+		RoomServerRoomNIDs:      roomServerRoomNIDs,
 		RoomServerRoomIDs:       roomServerRoomIDs,
 		RoomInfos:               roomInfos,
 		FederationEvents:        federationEvents,
+		NotificationContexts:    notificationContexts,
+		RoomAliasFailures:       roomAliasFailures,
+		ServerACLs:              serverACLs,
 	}, nil
 }
 
@@ -87,17 +152,24 @@ type InMemoryLRUCachePartition struct {
 	name       string
 	mutable    bool
 	maxEntries int
-	lru        *lru.Cache
+	budget     *Budget
+	setMutex   sync.Mutex // makes replacing entries atomic
+	lru        *lru.Cache // of *budgetEntry
+	hits       prometheus.Counter
+	misses     prometheus.Counter
 }
 
-func NewInMemoryLRUCachePartition(name string, mutable bool, maxEntries int, enablePrometheus bool) (*InMemoryLRUCachePartition, error) {
+func NewInMemoryLRUCachePartition(name string, mutable bool, maxEntries int, budget *Budget, enablePrometheus bool) (*InMemoryLRUCachePartition, error) {
 	var err error
 	cache := InMemoryLRUCachePartition{
 		name:       name,
 		mutable:    mutable,
 		maxEntries: maxEntries,
+		budget:     budget,
 	}
-	cache.lru, err = lru.New(maxEntries)
+	cache.lru, err = lru.NewWithEvict(maxEntries, func(_, value interface{}) {
+		budget.remove(value.(*budgetEntry))
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -109,17 +181,43 @@ func NewInMemoryLRUCachePartition(name string, mutable bool, maxEntries int, ena
 		}, func() float64 {
 			return float64(cache.lru.Len())
 		})
+		cache.hits = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_in_memory_lru",
+			Name:      name + "_hits",
+			Help:      "Number of lookups in this cache partition that were found",
+		})
+		cache.misses = promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_in_memory_lru",
+			Name:      name + "_misses",
+			Help:      "Number of lookups in this cache partition that were not found",
+		})
 	}
 	return &cache, nil
 }
 
 func (c *InMemoryLRUCachePartition) Set(key string, value interface{}) {
-	if !c.mutable {
-		if peek, ok := c.lru.Peek(key); ok && peek != value {
-			panic(fmt.Sprintf("invalid use of immutable cache tries to mutate existing value of %q", key))
-		}
+	entry := &budgetEntry{
+		partition: c,
+		key:       key,
+		value:     value,
+		size:      estimateSize(key, value),
+	}
+	c.setMutex.Lock()
+	peek, replaced := c.lru.Peek(key)
+	if replaced && !c.mutable && peek.(*budgetEntry).value != value {
+		c.setMutex.Unlock()
+		panic(fmt.Sprintf("invalid use of immutable cache tries to mutate existing value of %q", key))
+	}
+	// Replacing the value of a key doesn't count as an eviction, so the
+	// budget has to be told to stop counting the old entry.
+	c.lru.Add(key, entry)
+	c.setMutex.Unlock()
+	if replaced {
+		c.budget.remove(peek.(*budgetEntry))
 	}
-	c.lru.Add(key, value)
+	c.budget.add(entry)
 }
 
 func (c *InMemoryLRUCachePartition) Unset(key string) {
@@ -130,5 +228,26 @@ func (c *InMemoryLRUCachePartition) Unset(key string) {
 }
 
 func (c *InMemoryLRUCachePartition) Get(key string) (value interface{}, ok bool) {
-	return c.lru.Get(key)
+	var entry interface{}
+	entry, ok = c.lru.Get(key)
+	if ok {
+		c.budget.touch(entry.(*budgetEntry))
+		value = entry.(*budgetEntry).value
+	}
+	if ok && c.hits != nil {
+		c.hits.Inc()
+	} else if !ok && c.misses != nil {
+		c.misses.Inc()
+	}
+	return value, ok
+}
+
+// evict removes the entry from the partition because the budget is full,
+// unless the key has been given a new entry since.
+func (c *InMemoryLRUCachePartition) evict(entry *budgetEntry) {
+	c.setMutex.Lock()
+	defer c.setMutex.Unlock()
+	if peek, ok := c.lru.Peek(entry.key); ok && peek == entry {
+		c.lru.Remove(entry.key)
+	}
 }
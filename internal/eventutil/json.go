@@ -0,0 +1,56 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned by CheckStorableJSON if the JSON isn't valid UTF-8.
+var ErrInvalidUTF8 = errors.New("JSON contains invalid UTF-8")
+
+// ErrNullCharacter is returned by CheckStorableJSON if the JSON contains a
+// null character.
+var ErrNullCharacter = errors.New("JSON contains a null character")
+
+// CheckStorableJSON checks that the JSON doesn't contain anything which the
+// databases can't store. Neither PostgreSQL nor SQLite can store invalid UTF-8
+// or null characters in text columns, so JSON containing them needs to be
+// rejected before it reaches storage rather than failing there. Events can't
+// be sanitised instead, as that would break their hashes and signatures.
+func CheckStorableJSON(data []byte) error {
+	if !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+	if bytes.IndexByte(data, 0) != -1 {
+		return ErrNullCharacter
+	}
+	// Backslashes only appear in valid JSON as the start of an escape
+	// sequence within a string, so there's no need to keep track of whether
+	// we're in a string or not.
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' || i+1 == len(data) {
+			continue
+		}
+		if data[i+1] == 'u' && i+6 <= len(data) && string(data[i+2:i+6]) == "0000" {
+			return ErrNullCharacter
+		}
+		// Skip the escaped character, which may be another backslash.
+		i++
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package eventutil
+
+import "testing"
+
+func TestCheckStorableJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want error
+	}{
+		{`{"body":"hello"}`, nil},
+		{`{"body":"café"}`, nil},
+		{`{"body":"\\u0000"}`, nil},
+		{`{"body":"\\\\u0000"}`, nil},
+		{`{"body":"\u0000"}`, ErrNullCharacter},
+		{`{"body":"\\\u0000"}`, ErrNullCharacter},
+		{"{\"body\":\"\x00\"}", ErrNullCharacter},
+		{"{\"body\":\"\xff\"}", ErrInvalidUTF8},
+		{`{"body":"\u00`, nil},
+	}
+	for _, tc := range tests {
+		if got := CheckStorableJSON([]byte(tc.json)); got != tc.want {
+			t.Errorf("CheckStorableJSON(%q) = %v, want %v", tc.json, got, tc.want)
+		}
+	}
+}
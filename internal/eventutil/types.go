@@ -15,6 +15,7 @@
 package eventutil
 
 import (
+	"encoding/json"
 	"errors"
 	"strconv"
 )
@@ -28,6 +29,9 @@ var ErrProfileNoExists = errors.New("no known profile for given user ID")
 type AccountData struct {
 	RoomID string `json:"room_id"`
 	Type   string `json:"type"`
+	// The new content of the account data, so that consumers don't need to
+	// ask the user API for it. May be empty for messages from older versions.
+	Content json.RawMessage `json:"content,omitempty"`
 }
 
 // ProfileResponse is a struct containing all known user profile data
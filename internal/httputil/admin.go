@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// NewDendriteAdminRouter creates the router for the Dendrite admin API under
+// DendriteAdminPathPrefix. Requests which don't match any endpoint get a JSON
+// error like every other admin API response.
+func NewDendriteAdminRouter() *mux.Router {
+	router := mux.NewRouter().SkipClean(true).PathPrefix(DendriteAdminPathPrefix).Subrouter().UseEncodedPath()
+	router.Handle("/versions", MakeExternalAPI("admin_versions", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Versions []string `json:"versions"`
+			}{DendriteAdminVersions},
+		}
+	})).Methods(http.MethodGet, http.MethodOptions)
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(jsonerror.NotFound("Unknown admin API endpoint"))
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(jsonerror.Unknown("Method not allowed for this admin API endpoint"))
+	})
+	return router
+}
+
+// MakeAdminAPI turns a util.JSONRequestHandler function into an http.Handler
+// for the Dendrite admin API. The request must carry either the admin token
+// from the config or the access token of a server administrator.
+func MakeAdminAPI(
+	metricsName string, cfg *config.Global, userAPI userapi.UserInternalAPI,
+	f func(*http.Request) util.JSONResponse,
+) http.Handler {
+	h := func(req *http.Request) util.JSONResponse {
+		admin, resErr := verifyAdmin(req, cfg, userAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		// add the admin to the logger
+		logger := util.GetLogger(req.Context()).WithField("admin", admin)
+		req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+
+		return f(req)
+	}
+	return MakeExternalAPI(metricsName, h)
+}
+
+// MakeAdminRawAPI is like MakeAdminAPI, but for admin API endpoints which
+// write their own response rather than JSON, such as exports. Errors are
+// still returned as JSON.
+func MakeAdminRawAPI(
+	metricsName string, cfg *config.Global, userAPI userapi.UserInternalAPI,
+	f func(http.ResponseWriter, *http.Request) *util.JSONResponse,
+) http.Handler {
+	return MakeHTMLAPI(metricsName, func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+		admin, resErr := verifyAdmin(req, cfg, userAPI)
+		if resErr != nil {
+			return resErr
+		}
+		logger := util.GetLogger(req.Context()).WithField("admin", admin)
+		req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+
+		return f(w, req)
+	})
+}
+
+// verifyAdmin returns who is making the admin request, which is either the
+// user ID of an admin user or "admin_token".
+func verifyAdmin(
+	req *http.Request, cfg *config.Global, userAPI userapi.UserInternalAPI,
+) (string, *util.JSONResponse) {
+	token, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	if cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1 {
+		return "admin_token", nil
+	}
+	device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+	if resErr != nil {
+		return "", resErr
+	}
+	if cfg.IsAdmin(device.UserID) {
+		return device.UserID, nil
+	}
+	// Accounts can also be made server administrators through the admin API,
+	// rather than by being listed in the config.
+	var permsRes userapi.QueryAccountPermissionsResponse
+	if err = userAPI.QueryAccountPermissions(req.Context(), &userapi.QueryAccountPermissionsRequest{
+		UserID: device.UserID,
+	}, &permsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountPermissions failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if !permsRes.IsAdmin {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You must be a server administrator to use the admin API"),
+		}
+	}
+	return device.UserID, nil
+}
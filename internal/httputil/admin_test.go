@@ -0,0 +1,93 @@
+package httputil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type testUserAPI struct {
+	userapi.UserInternalAPI
+	devices map[string]*userapi.Device // access token -> device
+	admins  map[string]bool            // user ID -> whether the account is an admin
+}
+
+func (a *testUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	res.Device = a.devices[req.AccessToken]
+	return nil
+}
+
+func (a *testUserAPI) QueryAccountPermissions(ctx context.Context, req *userapi.QueryAccountPermissionsRequest, res *userapi.QueryAccountPermissionsResponse) error {
+	res.UserExists = true
+	res.IsAdmin = a.admins[req.UserID]
+	return nil
+}
+
+func TestDendriteAdminAPI(t *testing.T) {
+	cfg := &config.Global{
+		AdminUsers: []string{"@admin:localhost"},
+		AdminToken: "secret",
+	}
+	userAPI := &testUserAPI{
+		devices: map[string]*userapi.Device{
+			"admin_token":         {UserID: "@admin:localhost"},
+			"account_admin_token": {UserID: "@account_admin:localhost"},
+			"user_token":          {UserID: "@user:localhost"},
+		},
+		admins: map[string]bool{"@account_admin:localhost": true},
+	}
+	router := NewDendriteAdminRouter()
+	router.PathPrefix("/v1").Subrouter().Handle("/test",
+		MakeAdminAPI("admin_test", cfg, userAPI, func(req *http.Request) util.JSONResponse {
+			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+		}),
+	).Methods(http.MethodGet)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		token   string
+		code    int
+		errcode string
+	}{
+		{"admin token", http.MethodGet, "/_dendrite/admin/v1/test", "secret", http.StatusOK, ""},
+		{"admin user", http.MethodGet, "/_dendrite/admin/v1/test", "admin_token", http.StatusOK, ""},
+		{"admin account", http.MethodGet, "/_dendrite/admin/v1/test", "account_admin_token", http.StatusOK, ""},
+		{"other user", http.MethodGet, "/_dendrite/admin/v1/test", "user_token", http.StatusForbidden, "M_FORBIDDEN"},
+		{"unknown token", http.MethodGet, "/_dendrite/admin/v1/test", "wrong", http.StatusUnauthorized, "M_UNKNOWN_TOKEN"},
+		{"no token", http.MethodGet, "/_dendrite/admin/v1/test", "", http.StatusUnauthorized, "M_MISSING_TOKEN"},
+		{"unknown endpoint", http.MethodGet, "/_dendrite/admin/v1/nope", "secret", http.StatusNotFound, "M_NOT_FOUND"},
+		{"unknown version", http.MethodGet, "/_dendrite/admin/v2/test", "secret", http.StatusNotFound, "M_NOT_FOUND"},
+		{"wrong method", http.MethodPost, "/_dendrite/admin/v1/test", "secret", http.StatusMethodNotAllowed, "M_UNKNOWN"},
+		{"versions", http.MethodGet, "/_dendrite/admin/versions", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("got HTTP %d, want %d: %s", rec.Code, tt.code, rec.Body.String())
+			}
+			var body struct {
+				ErrCode string `json:"errcode"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response is not JSON: %s", rec.Body.String())
+			}
+			if body.ErrCode != tt.errcode {
+				t.Fatalf("got errcode %q, want %q", body.ErrCode, tt.errcode)
+			}
+		})
+	}
+}
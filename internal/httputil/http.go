@@ -60,6 +60,9 @@ func PostJSON(
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
 
 	res, err := httpClient.Do(req.WithContext(ctx))
 	if res != nil {
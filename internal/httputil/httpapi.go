@@ -21,13 +21,17 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationsenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -74,7 +78,9 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return WithRequestID(req, f(req))
+	}))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		nextWriter := w
 		if verbose {
@@ -136,7 +142,7 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
 		if err := f(w, req); err != nil {
 			h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
-				return *err
+				return WithRequestID(req, *err)
 			}))
 			h.ServeHTTP(w, req)
 		}
@@ -159,7 +165,9 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 // If we are passed a tracing context in the request headers then we use that
 // as the parent of any tracing spans we create.
 func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return f(withCallerRequestID(req))
+	}))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		carrier := opentracing.HTTPHeadersCarrier(req.Header)
 		tracer := opentracing.GlobalTracer()
@@ -181,20 +189,30 @@ func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 }
 
 // MakeFedAPI makes an http.Handler that checks matrix federation authentication.
+// The request is authenticated against whichever of our server names it was
+// sent to, going by the Host header.
 func MakeFedAPI(
 	metricsName string,
-	serverName gomatrixserverlib.ServerName,
+	cfg *config.Global,
 	keyRing gomatrixserverlib.JSONVerifier,
 	wakeup *FederationWakeups,
 	f func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
 		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
-			req, time.Now(), serverName, keyRing,
+			req, time.Now(), cfg.ServerNameForHost(req.Host), keyRing,
 		)
 		if fedReq == nil {
 			return errResp
 		}
+		if err := eventutil.CheckStorableJSON(fedReq.Content()); err != nil {
+			// The events in the request can't be sanitised without breaking
+			// their signatures, so reject them before they reach the database.
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body can't be accepted: " + err.Error()),
+			}
+		}
 		go wakeup.Wakeup(req.Context(), fedReq.Origin())
 		vars, err := URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
@@ -253,23 +271,85 @@ func WrapHandlerInBasicAuth(h http.Handler, b BasicAuth) http.HandlerFunc {
 	}
 }
 
-// WrapHandlerInCORS adds CORS headers to all responses, including all error
-// responses.
+// WrapHandlerInCORS adds the configured CORS headers to all responses,
+// including all error responses, replacing any which the handler set itself.
 // Handles OPTIONS requests directly.
-func WrapHandlerInCORS(h http.Handler) http.HandlerFunc {
+func WrapHandlerInCORS(h http.Handler, cfg *config.CORS) http.HandlerFunc {
+	allowAnyOrigin := false
+	allowedOrigins := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			allowAnyOrigin = true
+		}
+		allowedOrigins[strings.ToLower(origin)] = true
+	}
+	allowedHeaders := strings.Join(cfg.AllowedHeaders, ", ")
+	maxAge := ""
+	if cfg.MaxAge > 0 {
+		maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+		setHeaders := func(header http.Header) {
+			switch origin := r.Header.Get("Origin"); {
+			case allowAnyOrigin:
+				header.Set("Access-Control-Allow-Origin", "*")
+			case allowedOrigins[strings.ToLower(origin)]:
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Add("Vary", "Origin")
+			default:
+				// Without this header, the browser won't let the web client
+				// see the response.
+				header.Del("Access-Control-Allow-Origin")
+			}
+			header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", allowedHeaders)
+			header.Set("Access-Control-Expose-Headers", RequestIDHeader)
+			if maxAge != "" {
+				header.Set("Access-Control-Max-Age", maxAge)
+			}
+		}
 
 		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 			// Its easiest just to always return a 200 OK for everything. Whether
 			// this is technically correct or not is a question, but in the end this
 			// is what a lot of other people do (including synapse) and the clients
 			// are perfectly happy with it.
+			setHeaders(w.Header())
 			w.WriteHeader(http.StatusOK)
 		} else {
-			h.ServeHTTP(w, r)
+			h.ServeHTTP(&corsResponseWriter{ResponseWriter: w, setHeaders: setHeaders}, r)
 		}
 	})
 }
+
+// corsResponseWriter sets the CORS headers just before the response is
+// written, so that they replace any that the handler set, e.g. the ones
+// which util.MakeJSONAPI always sets.
+type corsResponseWriter struct {
+	http.ResponseWriter
+	setHeaders  func(http.Header)
+	wroteHeader bool
+}
+
+func (w *corsResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.setHeaders(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *corsResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, so that streamed responses still work.
+func (w *corsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
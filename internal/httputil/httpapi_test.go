@@ -15,9 +15,15 @@
 package httputil
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +113,106 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestWrapHandlerInCORS(t *testing.T) {
+	// The handler sets the permissive headers that util.MakeJSONAPI always
+	// sets, which should be replaced by the configured ones.
+	errorHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		util.SetCORSHeaders(w)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	cfg := &config.CORS{
+		AllowedOrigins: []string{"https://chat.example.com"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		MaxAge:         time.Hour,
+	}
+	h := WrapHandlerInCORS(errorHandler, cfg)
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantCode   int
+		wantOrigin string
+	}{
+		{"allowed origin", http.MethodGet, "https://chat.example.com", http.StatusNotFound, "https://chat.example.com"},
+		{"other origin", http.MethodGet, "https://evil.example.com", http.StatusNotFound, ""},
+		{"preflight from allowed origin", http.MethodOptions, "https://chat.example.com", http.StatusOK, "https://chat.example.com"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		req.Header.Set("Origin", tt.origin)
+		if tt.method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		_ = res.Body.Close()
+		if res.StatusCode != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, res.StatusCode, tt.wantCode)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", tt.name, got, tt.wantOrigin)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Headers"); got != "Authorization, Content-Type" {
+			t.Errorf("%s: got Access-Control-Allow-Headers %q", tt.name, got)
+		}
+		if got := res.Header.Get("Access-Control-Max-Age"); got != "3600" {
+			t.Errorf("%s: got Access-Control-Max-Age %q, want 3600", tt.name, got)
+		}
+	}
+
+	// Any origin is allowed by default.
+	cfg = &config.CORS{}
+	cfg.Defaults()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	WrapHandlerInCORS(errorHandler, cfg).ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q, want *", got)
+	}
+}
+
+func TestMakeExternalAPIRequestID(t *testing.T) {
+	var loggedID string
+	h := MakeExternalAPI("test", func(req *http.Request) util.JSONResponse {
+		loggedID, _ = util.GetLogger(req.Context()).Data["req.id"].(string)
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("nothing here"),
+		}
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	id := w.Header().Get(RequestIDHeader)
+	if id == "" || id != loggedID {
+		t.Fatalf("got request ID header %q, want the logged request ID %q", id, loggedID)
+	}
+	var body struct {
+		ErrCode   string `json:"errcode"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if body.ErrCode != "M_NOT_FOUND" || body.RequestID != id {
+		t.Errorf("got error body %+v, want M_NOT_FOUND with request ID %q", body, id)
+	}
+}
+
+func TestMakeInternalAPIUsesCallerRequestID(t *testing.T) {
+	var gotID string
+	h := MakeInternalAPI("test", func(req *http.Request) util.JSONResponse {
+		gotID = RequestID(req.Context())
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(RequestIDHeader, "abcdef")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if gotID != "abcdef" {
+		t.Errorf("got request ID %q, want abcdef", gotID)
+	}
+}
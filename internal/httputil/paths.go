@@ -20,4 +20,9 @@ const (
 	PublicKeyPathPrefix        = "/_matrix/key/"
 	PublicMediaPathPrefix      = "/_matrix/media/"
 	InternalPathPrefix         = "/api/"
+	DendriteAdminPathPrefix    = "/_dendrite/admin/"
 )
+
+// DendriteAdminVersions are the versions of the Dendrite admin API, which is
+// served under DendriteAdminPathPrefix, that this server supports.
+var DendriteAdminVersions = []string{"v1"}
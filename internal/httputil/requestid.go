@@ -0,0 +1,80 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/util"
+	"github.com/tidwall/sjson"
+)
+
+// RequestIDHeader is the header which the ID of a request is returned to
+// clients in, and which internal API calls made while handling the request
+// carry it in.
+const RequestIDHeader = "X-Dendrite-Request-ID"
+
+type requestIDContextKey struct{}
+
+// RequestID returns the ID of the request that the context belongs to, or an
+// empty string if there isn't one. Requests are given an ID when they arrive
+// at a public API, which is also used by any internal API calls that are
+// made while handling them.
+func RequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		return id
+	}
+	return util.GetRequestID(ctx)
+}
+
+// withCallerRequestID makes a request to an internal API use the ID of the
+// request which caused the call, if there is one, for its logging and any
+// further internal API calls.
+func withCallerRequestID(req *http.Request) *http.Request {
+	id := req.Header.Get(RequestIDHeader)
+	if id == "" {
+		return req
+	}
+	ctx := context.WithValue(req.Context(), requestIDContextKey{}, id)
+	ctx = util.ContextWithLogger(ctx, util.GetLogger(ctx).WithField("req.id", id))
+	return req.WithContext(ctx)
+}
+
+// WithRequestID returns the ID of the request in the response headers and, if
+// the response is an error, in the body too, so that users can refer to the
+// failure in bug reports.
+func WithRequestID(req *http.Request, res util.JSONResponse) util.JSONResponse {
+	id := RequestID(req.Context())
+	if id == "" {
+		return res
+	}
+	if res.Headers == nil {
+		res.Headers = map[string]string{}
+	}
+	res.Headers[RequestIDHeader] = id
+	if res.Code < 400 {
+		return res
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil || len(body) == 0 || body[0] != '{' {
+		return res
+	}
+	if body, err = sjson.SetBytes(body, "request_id", id); err == nil {
+		res.JSON = json.RawMessage(body)
+	}
+	return res
+}
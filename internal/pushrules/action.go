@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ActionKind is the kind of an action.
+type ActionKind string
+
+const (
+	// NotifyAction notifies the user about the event.
+	NotifyAction ActionKind = "notify"
+	// DontNotifyAction doesn't notify the user about the event.
+	DontNotifyAction ActionKind = "dont_notify"
+	// CoalesceAction notifies the user, but lets the push gateway coalesce
+	// the notification with others.
+	CoalesceAction ActionKind = "coalesce"
+	// SetTweakAction sets a tweak of the notification.
+	SetTweakAction ActionKind = "set_tweak"
+)
+
+// TweakKey is the name of a tweak.
+type TweakKey string
+
+const (
+	// SoundTweak is the sound to play for the notification.
+	SoundTweak TweakKey = "sound"
+	// HighlightTweak is whether the event should be highlighted.
+	HighlightTweak TweakKey = "highlight"
+)
+
+// Action is an action of a push rule. In JSON, actions other than
+// set_tweak are a plain string.
+type Action struct {
+	Kind  ActionKind
+	Tweak TweakKey
+	// Value is the value of the tweak. If it is nil for the highlight
+	// tweak then it is true.
+	Value interface{}
+}
+
+func (a *Action) MarshalJSON() ([]byte, error) {
+	if a.Kind != SetTweakAction {
+		return json.Marshal(a.Kind)
+	}
+	m := map[string]interface{}{
+		string(SetTweakAction): a.Tweak,
+	}
+	if a.Value != nil {
+		m["value"] = a.Value
+	}
+	return json.Marshal(m)
+}
+
+func (a *Action) UnmarshalJSON(bs []byte) error {
+	var kind string
+	if err := json.Unmarshal(bs, &kind); err == nil {
+		switch ActionKind(kind) {
+		case NotifyAction, DontNotifyAction, CoalesceAction:
+			a.Kind = ActionKind(kind)
+			return nil
+		}
+		return fmt.Errorf("unknown action %q", kind)
+	}
+	var m struct {
+		SetTweak TweakKey    `json:"set_tweak"`
+		Value    interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return err
+	}
+	if m.SetTweak == "" {
+		return fmt.Errorf("action has no set_tweak")
+	}
+	a.Kind, a.Tweak, a.Value = SetTweakAction, m.SetTweak, m.Value
+	return nil
+}
+
+// ActionsToTweaks works out from the actions of a matching rule whether the
+// user should be notified and with which tweaks.
+func ActionsToTweaks(actions []*Action) (notify bool, tweaks map[string]interface{}) {
+	tweaks = map[string]interface{}{}
+	for _, a := range actions {
+		switch a.Kind {
+		case NotifyAction, CoalesceAction:
+			notify = true
+		case DontNotifyAction:
+			notify = false
+		case SetTweakAction:
+			value := a.Value
+			if a.Tweak == HighlightTweak && value == nil {
+				value = true
+			}
+			tweaks[string(a.Tweak)] = value
+		}
+	}
+	return notify, tweaks
+}
+
+// IsHighlight returns true if the tweaks highlight the event.
+func IsHighlight(tweaks map[string]interface{}) bool {
+	highlight, _ := tweaks[string(HighlightTweak)].(bool)
+	return highlight
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+// ConditionKind is the kind of a condition.
+type ConditionKind string
+
+const (
+	// EventMatchCondition matches the glob in Pattern against the field
+	// of the event named by Key, e.g. "content.body".
+	EventMatchCondition ConditionKind = "event_match"
+	// ContainsDisplayNameCondition matches if the body of the event
+	// contains the display name of the user in the room.
+	ContainsDisplayNameCondition ConditionKind = "contains_display_name"
+	// RoomMemberCountCondition compares the number of joined members of
+	// the room against Is, e.g. "2" or ">10".
+	RoomMemberCountCondition ConditionKind = "room_member_count"
+	// SenderNotificationPermissionCondition matches if the sender of the
+	// event has the power level named by Key in the notifications of the
+	// power levels of the room, e.g. "room".
+	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+)
+
+// Condition is a condition of an override or underride push rule.
+type Condition struct {
+	Kind    ConditionKind `json:"kind"`
+	Key     string        `json:"key,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+	Is      string        `json:"is,omitempty"`
+}
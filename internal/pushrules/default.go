@@ -0,0 +1,192 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets returns the push rules which a user starts with,
+// as listed in https://matrix.org/docs/spec/client_server/r0.6.1#predefined-rules
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName) *AccountRuleSets {
+	userID := "@" + localpart + ":" + string(serverName)
+	return &AccountRuleSets{
+		Global: RuleSets{
+			Override: []*Rule{
+				{
+					RuleID:     ".m.rule.master",
+					Default:    true,
+					Enabled:    false,
+					Conditions: []*Condition{},
+					Actions:    []*Action{{Kind: DontNotifyAction}},
+				},
+				{
+					RuleID:  ".m.rule.suppress_notices",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "content.msgtype", Pattern: "m.notice"},
+					},
+					Actions: []*Action{{Kind: DontNotifyAction}},
+				},
+				{
+					RuleID:  ".m.rule.invite_for_me",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"},
+						{Kind: EventMatchCondition, Key: "content.membership", Pattern: "invite"},
+						{Kind: EventMatchCondition, Key: "state_key", Pattern: userID},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+						{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+					},
+				},
+				{
+					RuleID:  ".m.rule.member_event",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"},
+					},
+					Actions: []*Action{{Kind: DontNotifyAction}},
+				},
+				{
+					RuleID:  ".m.rule.contains_display_name",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: ContainsDisplayNameCondition},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+						{Kind: SetTweakAction, Tweak: HighlightTweak},
+					},
+				},
+				{
+					RuleID:  ".m.rule.tombstone",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.tombstone"},
+						{Kind: EventMatchCondition, Key: "state_key", Pattern: ""},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: HighlightTweak},
+					},
+				},
+				{
+					RuleID:  ".m.rule.roomnotif",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "content.body", Pattern: "@room"},
+						{Kind: SenderNotificationPermissionCondition, Key: "room"},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: HighlightTweak},
+					},
+				},
+			},
+			Content: []*Rule{
+				{
+					RuleID:  ".m.rule.contains_user_name",
+					Default: true,
+					Enabled: true,
+					Pattern: localpart,
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+						{Kind: SetTweakAction, Tweak: HighlightTweak},
+					},
+				},
+			},
+			Room:   []*Rule{},
+			Sender: []*Rule{},
+			Underride: []*Rule{
+				{
+					RuleID:  ".m.rule.call",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.call.invite"},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: SoundTweak, Value: "ring"},
+						{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+					},
+				},
+				{
+					RuleID:  ".m.rule.encrypted_room_one_to_one",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: RoomMemberCountCondition, Is: "2"},
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.encrypted"},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+						{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+					},
+				},
+				{
+					RuleID:  ".m.rule.room_one_to_one",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: RoomMemberCountCondition, Is: "2"},
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: SoundTweak, Value: "default"},
+						{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+					},
+				},
+				{
+					RuleID:  ".m.rule.message",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+					},
+				},
+				{
+					RuleID:  ".m.rule.encrypted",
+					Default: true,
+					Enabled: true,
+					Conditions: []*Condition{
+						{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.encrypted"},
+					},
+					Actions: []*Action{
+						{Kind: NotifyAction},
+						{Kind: SetTweakAction, Tweak: HighlightTweak, Value: false},
+					},
+				},
+			},
+		},
+	}
+}
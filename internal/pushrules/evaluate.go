@@ -0,0 +1,184 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// EvaluationContext tells the evaluator what it needs to know about the
+// room and the user that an event is being evaluated for.
+type EvaluationContext interface {
+	// UserDisplayName returns the display name of the user in the room,
+	// or an empty string if they don't have one.
+	UserDisplayName() string
+	// RoomMemberCount returns the number of joined members of the room.
+	RoomMemberCount() (int, error)
+	// HasPowerLevel returns true if the user has at least the power level
+	// named by levelKey in the notifications of the power levels of the
+	// room, e.g. "room".
+	HasPowerLevel(userID, levelKey string) (bool, error)
+}
+
+// MatchEvent returns the first enabled rule which matches the event, going
+// through the kinds in order, or nil if no rule matches.
+func (rs *RuleSets) MatchEvent(ev *gomatrixserverlib.Event, ec EvaluationContext) (*Rule, error) {
+	for _, kind := range Kinds {
+		for _, rule := range *rs.Rules(kind) {
+			if !rule.Enabled {
+				continue
+			}
+			ok, err := ruleMatches(rule, kind, ev, ec)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.RuleID, err)
+			}
+			if ok {
+				return rule, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func ruleMatches(rule *Rule, kind Kind, ev *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range rule.Conditions {
+			ok, err := conditionMatches(cond, ev, ec)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case ContentKind:
+		// Content rules only apply to events with a body.
+		body := gjson.GetBytes(ev.JSON(), "content.body")
+		if body.Type != gjson.String {
+			return false, nil
+		}
+		return globMatches(rule.Pattern, body.Str, true), nil
+	case RoomKind:
+		return rule.RuleID == ev.RoomID(), nil
+	case SenderKind:
+		return rule.RuleID == ev.Sender(), nil
+	default:
+		return false, nil
+	}
+}
+
+func conditionMatches(cond *Condition, ev *gomatrixserverlib.Event, ec EvaluationContext) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		value := gjson.GetBytes(ev.JSON(), cond.Key)
+		if value.Type != gjson.String {
+			return false, nil
+		}
+		// Patterns match whole words of the body, but the whole of any
+		// other field.
+		return globMatches(cond.Pattern, value.Str, cond.Key == "content.body"), nil
+	case ContainsDisplayNameCondition:
+		displayName := ec.UserDisplayName()
+		if displayName == "" {
+			return false, nil
+		}
+		body := gjson.GetBytes(ev.JSON(), "content.body")
+		if body.Type != gjson.String {
+			return false, nil
+		}
+		return wordRegexp(regexp.QuoteMeta(displayName)).MatchString(body.Str), nil
+	case RoomMemberCountCondition:
+		count, err := ec.RoomMemberCount()
+		if err != nil {
+			return false, err
+		}
+		return memberCountMatches(cond.Is, count), nil
+	case SenderNotificationPermissionCondition:
+		return ec.HasPowerLevel(ev.Sender(), cond.Key)
+	default:
+		// Unknown conditions never match, as required by the spec.
+		return false, nil
+	}
+}
+
+// memberCountMatches returns true if the member count satisfies the
+// comparison, which is a number optionally prefixed with ==, <, >, <= or >=.
+func memberCountMatches(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	n, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == n
+	case "<":
+		return count < n
+	case ">":
+		return count > n
+	case "<=":
+		return count <= n
+	case ">=":
+		return count >= n
+	default:
+		return false
+	}
+}
+
+// The compiled regexps of the globs that have been matched, keyed by the
+// glob and whether it matches words.
+var globRegexps sync.Map
+
+// globMatches matches the glob case-insensitively against the value. In a
+// glob, * matches any number of characters and ? matches any one character.
+// If words is true then the glob only has to match some words of the value,
+// otherwise it has to match the whole value.
+func globMatches(glob, value string, words bool) bool {
+	key := fmt.Sprintf("%t:%s", words, glob)
+	if re, ok := globRegexps.Load(key); ok {
+		return re.(*regexp.Regexp).MatchString(value)
+	}
+	var sb strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*?")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	var re *regexp.Regexp
+	if words {
+		re = wordRegexp(sb.String())
+	} else {
+		re = regexp.MustCompile(`(?is)^` + sb.String() + `$`)
+	}
+	globRegexps.Store(key, re)
+	return re.MatchString(value)
+}
+
+// wordRegexp returns a case-insensitive regexp which matches the expression
+// only when it is surrounded by word boundaries.
+func wordRegexp(expr string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)(^|\W)` + expr + `($|\W)`)
+}
@@ -0,0 +1,233 @@
+package pushrules
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeEvaluationContext struct {
+	displayName string
+	memberCount int
+	powerUsers  map[string]bool
+}
+
+func (ec *fakeEvaluationContext) UserDisplayName() string { return ec.displayName }
+
+func (ec *fakeEvaluationContext) RoomMemberCount() (int, error) { return ec.memberCount, nil }
+
+func (ec *fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	return ec.powerUsers[userID], nil
+}
+
+func mustEvent(t *testing.T, eventJSON string) *gomatrixserverlib.Event {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+func TestMatchEventDefaultRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       string
+		memberCount int
+		wantRuleID  string
+	}{
+		{
+			name:        "message in group room",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.message",
+		},
+		{
+			name:        "message in one to one room",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 2,
+			wantRuleID:  ".m.rule.room_one_to_one",
+		},
+		{
+			name:        "notice",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.notice","body":"alice"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.suppress_notices",
+		},
+		{
+			name:        "display name",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hi Ally McAlly!"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.contains_display_name",
+		},
+		{
+			name:        "user name",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"ALICE: ping"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.contains_user_name",
+		},
+		{
+			name:        "user name inside a word",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"malicexyz"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.message",
+		},
+		{
+			name:        "invite for the user",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.member","state_key":"@alice:x","content":{"membership":"invite"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.invite_for_me",
+		},
+		{
+			name:        "other member event",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.member","state_key":"@bob:x","content":{"membership":"join"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.member_event",
+		},
+		{
+			name:        "room notification from powerful sender",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@admin:x","type":"m.room.message","content":{"msgtype":"m.text","body":"@room hello"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.roomnotif",
+		},
+		{
+			name:        "room notification from other sender",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"@room hello"}}`,
+			memberCount: 5,
+			wantRuleID:  ".m.rule.message",
+		},
+		{
+			name:        "unknown event type",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.reaction","content":{}}`,
+			memberCount: 5,
+		},
+	}
+	rs := DefaultAccountRuleSets("alice", "x").Global
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ec := &fakeEvaluationContext{
+				displayName: "Ally McAlly",
+				memberCount: tc.memberCount,
+				powerUsers:  map[string]bool{"@admin:x": true},
+			}
+			rule, err := rs.MatchEvent(mustEvent(t, tc.event), ec)
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %s", err)
+			}
+			var gotRuleID string
+			if rule != nil {
+				gotRuleID = rule.RuleID
+			}
+			if gotRuleID != tc.wantRuleID {
+				t.Errorf("got rule %q, want %q", gotRuleID, tc.wantRuleID)
+			}
+		})
+	}
+}
+
+func TestMatchEventUserRules(t *testing.T) {
+	rs := DefaultAccountRuleSets("alice", "x").Global
+	rs.Room = append(rs.Room, &Rule{RuleID: "!quiet:x", Enabled: true, Actions: []*Action{{Kind: DontNotifyAction}}})
+	rs.Sender = append(rs.Sender, &Rule{RuleID: "@friend:x", Enabled: true, Actions: []*Action{{Kind: NotifyAction}}})
+	rs.Content = append(rs.Content, &Rule{RuleID: "cheese", Enabled: true, Pattern: "ch??se*", Actions: []*Action{{Kind: NotifyAction}}})
+	ec := &fakeEvaluationContext{memberCount: 5}
+
+	for event, wantRuleID := range map[string]string{
+		`{"event_id":"$a:x","room_id":"!quiet:x","sender":"@friend:x","type":"m.room.message","content":{"body":"hi"}}`:      "!quiet:x",
+		`{"event_id":"$a:x","room_id":"!r:x","sender":"@friend:x","type":"m.room.message","content":{"body":"hi"}}`:          "@friend:x",
+		`{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"body":"I like CHEESES"}}`: "cheese",
+	} {
+		rule, err := rs.MatchEvent(mustEvent(t, event), ec)
+		if err != nil {
+			t.Fatalf("MatchEvent failed: %s", err)
+		}
+		if rule == nil || rule.RuleID != wantRuleID {
+			t.Errorf("got rule %+v, want %q", rule, wantRuleID)
+		}
+	}
+
+	// Disabled rules are skipped.
+	rule, _ := rs.Find(RoomKind, "!quiet:x")
+	rule.Enabled = false
+	matched, err := rs.MatchEvent(mustEvent(t, `{"event_id":"$a:x","room_id":"!quiet:x","sender":"@bob:x","type":"m.room.message","content":{"body":"hi"}}`), ec)
+	if err != nil {
+		t.Fatalf("MatchEvent failed: %s", err)
+	}
+	if matched.RuleID != ".m.rule.message" {
+		t.Errorf("got rule %q, want .m.rule.message", matched.RuleID)
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	tests := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"==2", 2, true},
+		{"<3", 2, true},
+		{"<3", 3, false},
+		{">3", 4, true},
+		{"<=3", 3, true},
+		{">=3", 2, false},
+		{"!3", 2, false},
+		{"", 0, false},
+	}
+	for _, tc := range tests {
+		if got := memberCountMatches(tc.is, tc.count); got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d) = %v, want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+}
+
+func TestGlobMatches(t *testing.T) {
+	tests := []struct {
+		glob  string
+		value string
+		words bool
+		want  bool
+	}{
+		{"m.room.message", "m.room.message", false, true},
+		{"m.room.*", "m.room.message", false, true},
+		{"m.room.*", "xm.room.message", false, false},
+		{"m.?oom.message", "m.Room.message", false, true},
+		{"cake", "I like cake.", true, true},
+		{"cake", "I like cakes.", true, false},
+		{"cake*", "I like cakes.", true, true},
+		{"a.b", "axb", true, false},
+	}
+	for _, tc := range tests {
+		if got := globMatches(tc.glob, tc.value, tc.words); got != tc.want {
+			t.Errorf("globMatches(%q, %q, %v) = %v, want %v", tc.glob, tc.value, tc.words, got, tc.want)
+		}
+	}
+}
+
+func TestActionJSON(t *testing.T) {
+	in := `["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]`
+	var actions []*Action
+	if err := json.Unmarshal([]byte(in), &actions); err != nil {
+		t.Fatalf("failed to unmarshal actions: %s", err)
+	}
+	notify, tweaks := ActionsToTweaks(actions)
+	if !notify {
+		t.Errorf("expected notify")
+	}
+	if want := map[string]interface{}{"sound": "default", "highlight": true}; !reflect.DeepEqual(tweaks, want) {
+		t.Errorf("got tweaks %v, want %v", tweaks, want)
+	}
+	out, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatalf("failed to marshal actions: %s", err)
+	}
+	if string(out) != in {
+		t.Errorf("got %s, want %s", out, in)
+	}
+	if err := json.Unmarshal([]byte(`["explode"]`), &actions); err == nil {
+		t.Errorf("expected error for unknown action")
+	}
+}
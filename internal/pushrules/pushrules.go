@@ -0,0 +1,137 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules implements the push rules of the client-server API: the
+// rule sets that are stored in the m.push_rules account data of each user,
+// the default rules which every user starts with, and the evaluation of
+// rules against events to decide whether and how the user is notified.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#push-rules
+package pushrules
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AccountDataType is the type of the global account data that the push
+// rules of a user are stored in.
+const AccountDataType = "m.push_rules"
+
+// AccountRuleSets are the push rules of a user. Only the global scope is
+// defined by the spec.
+type AccountRuleSets struct {
+	Global RuleSets `json:"global"`
+}
+
+// RuleSets are the push rules of a scope, by kind. The kinds are evaluated
+// in the order of the fields.
+type RuleSets struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// Kind is the kind of a push rule.
+type Kind string
+
+const (
+	OverrideKind  Kind = "override"
+	ContentKind   Kind = "content"
+	RoomKind      Kind = "room"
+	SenderKind    Kind = "sender"
+	UnderrideKind Kind = "underride"
+)
+
+// Kinds are all the kinds of push rules, in the order they are evaluated.
+var Kinds = []Kind{OverrideKind, ContentKind, RoomKind, SenderKind, UnderrideKind}
+
+// Rule is a single push rule.
+type Rule struct {
+	RuleID  string `json:"rule_id"`
+	Default bool   `json:"default"`
+	Enabled bool   `json:"enabled"`
+	// Actions are what to do when the rule matches. An empty list means
+	// that the user isn't notified.
+	Actions []*Action `json:"actions"`
+	// Conditions must all hold for an override or underride rule to match.
+	// Other kinds of rules have implied conditions instead.
+	Conditions []*Condition `json:"conditions,omitempty"`
+	// Pattern is the glob which the body of the event has to match for a
+	// content rule to match.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Rules returns the rules of the given kind, or nil if the kind is unknown.
+func (rs *RuleSets) Rules(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override
+	case ContentKind:
+		return &rs.Content
+	case RoomKind:
+		return &rs.Room
+	case SenderKind:
+		return &rs.Sender
+	case UnderrideKind:
+		return &rs.Underride
+	default:
+		return nil
+	}
+}
+
+// IsEmpty returns true if there are no rules at all, which is what clients
+// see for accounts that were created before push rules were implemented.
+func (rs *RuleSets) IsEmpty() bool {
+	for _, kind := range Kinds {
+		if len(*rs.Rules(kind)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the rule with the given ID in the rules of the given kind,
+// and its index, or nil and -1 if there isn't one.
+func (rs *RuleSets) Find(kind Kind, ruleID string) (*Rule, int) {
+	rules := rs.Rules(kind)
+	if rules == nil {
+		return nil, -1
+	}
+	for i, rule := range *rules {
+		if rule.RuleID == ruleID {
+			return rule, i
+		}
+	}
+	return nil, -1
+}
+
+// ParseAccountRuleSets parses the push rules of a user from their account
+// data. If the user has no push rules stored yet then the default rules are
+// returned instead.
+func ParseAccountRuleSets(data json.RawMessage, localpart string, serverName gomatrixserverlib.ServerName) (*AccountRuleSets, error) {
+	if len(data) == 0 {
+		return DefaultAccountRuleSets(localpart, serverName), nil
+	}
+	var ruleSets AccountRuleSets
+	if err := json.Unmarshal(data, &ruleSets); err != nil {
+		return nil, err
+	}
+	if ruleSets.Global.IsEmpty() {
+		return DefaultAccountRuleSets(localpart, serverName), nil
+	}
+	return &ruleSets, nil
+}
@@ -123,6 +123,12 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if dbProperties.ConnectionString.IsSQLite() {
+		if err = enableWAL(db, dsn); err != nil {
+			return nil, fmt.Errorf("enableWAL: %w", err)
+		}
+		startWALCheckpointer(db, dsn, dbProperties)
+	}
 	if driverName != SQLiteDriverName() {
 		logrus.WithFields(logrus.Fields{
 			"MaxOpenConns":    dbProperties.MaxOpenConns,
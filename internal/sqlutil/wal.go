@@ -0,0 +1,143 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var walSizeBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "sqlite",
+		Name:      "wal_size_bytes",
+		Help:      "The size of the write-ahead log of the SQLite database",
+	},
+	[]string{"database"},
+)
+
+var walCheckpoints = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "sqlite",
+		Name:      "wal_checkpoints_total",
+		Help:      "The number of times the write-ahead log of the SQLite database was checkpointed and truncated",
+	},
+	[]string{"database", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(walSizeBytes, walCheckpoints)
+}
+
+// enableWAL switches the SQLite database at the given path to write-ahead
+// logging, so that readers don't block the writer and vice versa. The journal
+// mode is stored in the database file, so this only needs doing on one
+// connection. In-memory databases can't use a write-ahead log and stay as
+// they are.
+func enableWAL(db *sql.DB, path string) error {
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+		return err
+	}
+	if !strings.EqualFold(mode, "wal") {
+		logrus.WithField("database", path).Debugf("SQLite database is using journal mode %q", mode)
+	}
+	return nil
+}
+
+// startWALCheckpointer periodically checks the size of the write-ahead log of
+// the SQLite database at the given path, and checkpoints and truncates it once
+// it has grown past the threshold. SQLite checkpoints automatically but never
+// shrinks the log, so without this it stays at the largest size it has ever
+// reached. Nothing happens if the database isn't in WAL mode, as there is no
+// log file. It stops once the database is closed.
+func startWALCheckpointer(db *sql.DB, path string, dbProperties *config.DatabaseOptions) {
+	interval := dbProperties.WALCheckpointInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := db.Ping(); err != nil {
+				// The database has been closed.
+				walSizeBytes.DeleteLabelValues(path)
+				return
+			}
+			if err := checkpointWAL(db, path, dbProperties.WALCheckpointThresholdBytes); err != nil {
+				logrus.WithError(err).WithField("database", path).Warn("Failed to checkpoint SQLite write-ahead log")
+				walCheckpoints.WithLabelValues(path, "error").Inc()
+			}
+		}
+	}()
+}
+
+func checkpointWAL(db *sql.DB, path string, thresholdBytes int64) error {
+	size, err := walSize(path)
+	if err != nil {
+		return err
+	}
+	walSizeBytes.WithLabelValues(path).Set(float64(size))
+	if size == 0 || size < thresholdBytes {
+		return nil
+	}
+
+	// The result is whether the checkpoint was blocked by another connection,
+	// the number of frames in the log and the number that were checkpointed.
+	var busy, logFrames, checkpointedFrames int
+	if err = db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointedFrames); err != nil {
+		return err
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"database":     path,
+		"wal_size":     size,
+		"frames":       logFrames,
+		"checkpointed": checkpointedFrames,
+	})
+	if busy != 0 {
+		// Try again next time.
+		logger.Debug("SQLite write-ahead log checkpoint was blocked by another connection")
+		walCheckpoints.WithLabelValues(path, "busy").Inc()
+		return nil
+	}
+	logger.Debug("Checkpointed and truncated SQLite write-ahead log")
+	walCheckpoints.WithLabelValues(path, "ok").Inc()
+	if size, err = walSize(path); err == nil {
+		walSizeBytes.WithLabelValues(path).Set(float64(size))
+	}
+	return nil
+}
+
+// walSize returns the size of the write-ahead log of the SQLite database at
+// the given path, or 0 if there is no log.
+func walSize(path string) (int64, error) {
+	info, err := os.Stat(path + "-wal")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
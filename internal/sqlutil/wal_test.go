@@ -0,0 +1,80 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestCheckpointWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.db")
+	db, err := Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + path),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+
+	var mode string
+	if err = db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatalf("failed to query journal mode: %s", err)
+	}
+	if mode != "wal" {
+		t.Fatalf("expected the database to be in WAL mode, got %q", mode)
+	}
+
+	if _, err = db.Exec("CREATE TABLE test (id INTEGER PRIMARY KEY, value TEXT)"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = db.Exec("INSERT INTO test (value) VALUES ($1)", "some value"); err != nil {
+			t.Fatalf("failed to insert row: %s", err)
+		}
+	}
+	size, err := walSize(path)
+	if err != nil {
+		t.Fatalf("walSize failed: %s", err)
+	}
+	if size == 0 {
+		t.Fatalf("expected the write-ahead log to have grown")
+	}
+
+	// Below the threshold, the log is left alone.
+	if err = checkpointWAL(db, path, size+1); err != nil {
+		t.Fatalf("checkpointWAL failed: %s", err)
+	}
+	if after, _ := walSize(path); after != size {
+		t.Fatalf("expected the write-ahead log to be untouched, got %d bytes, want %d", after, size)
+	}
+
+	// At the threshold, the log is checkpointed and truncated.
+	if err = checkpointWAL(db, path, size); err != nil {
+		t.Fatalf("checkpointWAL failed: %s", err)
+	}
+	if after, _ := walSize(path); after != 0 {
+		t.Fatalf("expected the write-ahead log to be truncated, got %d bytes", after)
+	}
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM test").Scan(&count); err != nil {
+		t.Fatalf("failed to count rows: %s", err)
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 rows after checkpointing, got %d", count)
+	}
+}
@@ -32,6 +32,10 @@ type KeyInternalAPI interface {
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse)
 	// PerformClaimKeys claims one-time keys for use in pre-key messages
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse)
+	// PerformUploadDeviceKeys replaces the cross-signing keys of a local user
+	PerformUploadDeviceKeys(ctx context.Context, req *PerformUploadDeviceKeysRequest, res *PerformUploadDeviceKeysResponse)
+	// PerformUploadDeviceSignatures stores signatures which a local user has made on device or cross-signing keys
+	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse)
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse)
@@ -41,6 +45,10 @@ type KeyInternalAPI interface {
 // KeyError is returned if there was a problem performing/querying the server
 type KeyError struct {
 	Err string
+	// Set if the error is because a signature was missing or didn't verify
+	IsInvalidSignature bool
+	// Set if the error is because a required key was missing
+	IsMissingParam bool
 }
 
 func (k *KeyError) Error() string {
@@ -75,6 +83,39 @@ func (k *DeviceKeys) WithStreamID(streamID int) DeviceMessage {
 	}
 }
 
+// CrossSigningKeyPurpose is the purpose of a cross-signing key
+type CrossSigningKeyPurpose string
+
+const (
+	CrossSigningKeyPurposeMaster      CrossSigningKeyPurpose = "master"
+	CrossSigningKeyPurposeSelfSigning CrossSigningKeyPurpose = "self_signing"
+	CrossSigningKeyPurposeUserSigning CrossSigningKeyPurpose = "user_signing"
+)
+
+// CrossSigningSigMap is a map of user ID -> key ID -> signature
+type CrossSigningSigMap map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes
+
+// CrossSigningKey represents a cross-signing key
+// https://matrix.org/docs/spec/client_server/unstable#post-matrix-client-r0-keys-device-signing-upload
+type CrossSigningKey struct {
+	UserID     string                                                    `json:"user_id"`
+	Usage      []CrossSigningKeyPurpose                                  `json:"usage"`
+	Keys       map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+	Signatures CrossSigningSigMap                                        `json:"signatures,omitempty"`
+}
+
+// PublicKey returns the key ID and public key of this cross-signing key, which
+// must contain exactly one key.
+func (k *CrossSigningKey) PublicKey() (gomatrixserverlib.KeyID, gomatrixserverlib.Base64Bytes, bool) {
+	if len(k.Keys) != 1 {
+		return "", nil, false
+	}
+	for keyID, key := range k.Keys {
+		return keyID, key, true
+	}
+	return "", nil, false
+}
+
 // OneTimeKeys represents a set of one-time keys for a single device
 // https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-upload
 type OneTimeKeys struct {
@@ -106,10 +147,22 @@ type OneTimeKeysCount struct {
 	KeyCount map[string]int
 }
 
+// OneTimeKeyChange is produced into Kafka by the key server when one-time keys or
+// fallback keys are claimed from a local device, so that the sync API can tell
+// the device to upload more keys.
+type OneTimeKeyChange struct {
+	// The user who owns this device
+	UserID string
+	// The device ID of this device
+	DeviceID string
+}
+
 // PerformUploadKeysRequest is the request to PerformUploadKeys
 type PerformUploadKeysRequest struct {
 	DeviceKeys  []DeviceKeys
 	OneTimeKeys []OneTimeKeys
+	// FallbackKeys replace any existing fallback keys with the same algorithm, as per MSC2732.
+	FallbackKeys []OneTimeKeys
 	// OnlyDisplayNameUpdates should be `true` if ALL the DeviceKeys are present to update
 	// the display name for their respective device, and NOT to modify the keys. The key
 	// itself doesn't change but it's easier to pretend upload new keys and reuse the same code paths.
@@ -134,6 +187,37 @@ func (r *PerformUploadKeysResponse) KeyError(userID, deviceID string, err *KeyEr
 	r.KeyErrors[userID][deviceID] = err
 }
 
+// PerformUploadDeviceKeysRequest is the request to PerformUploadDeviceKeys.
+// Keys which are nil are left unchanged.
+type PerformUploadDeviceKeysRequest struct {
+	UserID         string
+	MasterKey      *CrossSigningKey
+	SelfSigningKey *CrossSigningKey
+	UserSigningKey *CrossSigningKey
+}
+
+// PerformUploadDeviceKeysResponse is the response to PerformUploadDeviceKeys
+type PerformUploadDeviceKeysResponse struct {
+	Error *KeyError
+}
+
+// PerformUploadDeviceSignaturesRequest is the request to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesRequest struct {
+	// The user who made the signatures
+	UserID string
+	// Map of user_id to key ID (either a device ID or a cross-signing public key)
+	// to the signed key JSON
+	Signatures map[string]map[string]json.RawMessage
+}
+
+// PerformUploadDeviceSignaturesResponse is the response to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesResponse struct {
+	// Map of user_id to key ID to the reason that the signatures on that key weren't stored
+	Failures map[string]map[string]*KeyError
+	// Set if there was a fatal error processing this action
+	Error *KeyError
+}
+
 type PerformClaimKeysRequest struct {
 	// Map of user_id to device_id to algorithm name
 	OneTimeKeys map[string]map[string]string
@@ -150,6 +234,9 @@ type PerformClaimKeysResponse struct {
 }
 
 type QueryKeysRequest struct {
+	// The user making the query, who can also see their own user-signing key and
+	// the signatures they have made on other users' keys
+	UserID string
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
@@ -160,6 +247,10 @@ type QueryKeysResponse struct {
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross-signing key. These are only filled in for local users.
+	MasterKeys      map[string]CrossSigningKey
+	SelfSigningKeys map[string]CrossSigningKey
+	UserSigningKeys map[string]CrossSigningKey
 	// Set if there was a fatal error processing this query
 	Error *KeyError
 }
@@ -195,7 +286,9 @@ type QueryOneTimeKeysRequest struct {
 type QueryOneTimeKeysResponse struct {
 	// OTK key counts, in the extended /sync form described by https://matrix.org/docs/spec/client_server/r0.6.1#id84
 	Count OneTimeKeysCount
-	Error *KeyError
+	// The algorithms of fallback keys which haven't been claimed yet, as per MSC2732
+	UnusedFallbackAlgorithms []string
+	Error                    *KeyError
 }
 
 type QueryDeviceMessagesRequest struct {
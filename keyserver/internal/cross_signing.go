@@ -0,0 +1,430 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func sanityCheckCrossSigningKey(userID string, purpose api.CrossSigningKeyPurpose, key *api.CrossSigningKey) error {
+	if key.UserID != userID {
+		return fmt.Errorf("%s key has user_id %q, expected %q", purpose, key.UserID, userID)
+	}
+	if len(key.Usage) != 1 || key.Usage[0] != purpose {
+		return fmt.Errorf("%s key must have usage [%q]", purpose, purpose)
+	}
+	keyID, publicKey, ok := key.PublicKey()
+	if !ok {
+		return fmt.Errorf("%s key must contain exactly one key", purpose)
+	}
+	if !strings.HasPrefix(string(keyID), "ed25519:") || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%s key must be an ed25519 key", purpose)
+	}
+	if string(keyID) != "ed25519:"+publicKey.Encode() {
+		return fmt.Errorf("%s key ID must be the public key", purpose)
+	}
+	return nil
+}
+
+// verifyCrossSigningSignature checks that the JSON has been signed by the
+// given user with the given cross-signing key.
+func verifyCrossSigningSignature(userID string, signingKey *api.CrossSigningKey, signedJSON []byte) error {
+	keyID, publicKey, ok := signingKey.PublicKey()
+	if !ok {
+		return fmt.Errorf("signing key is invalid")
+	}
+	return gomatrixserverlib.VerifyJSON(userID, keyID, ed25519.PublicKey(publicKey), signedJSON)
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.PerformUploadDeviceKeysRequest, res *api.PerformUploadDeviceKeysResponse) {
+	uploads := map[api.CrossSigningKeyPurpose]*api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster:      req.MasterKey,
+		api.CrossSigningKeyPurposeSelfSigning: req.SelfSigningKey,
+		api.CrossSigningKeyPurposeUserSigning: req.UserSigningKey,
+	}
+	toStore := make(map[api.CrossSigningKeyPurpose]api.CrossSigningKey)
+	for purpose, key := range uploads {
+		if key == nil {
+			continue
+		}
+		if err := sanityCheckCrossSigningKey(req.UserID, purpose, key); err != nil {
+			res.Error = &api.KeyError{
+				Err: err.Error(),
+			}
+			return
+		}
+		toStore[purpose] = *key
+	}
+	if len(toStore) == 0 {
+		res.Error = &api.KeyError{
+			Err:            "No cross-signing keys were supplied",
+			IsMissingParam: true,
+		}
+		return
+	}
+
+	// The self-signing and user-signing keys must be signed by the master key,
+	// which is either the one being uploaded now or the one we already have.
+	masterKey := req.MasterKey
+	if masterKey == nil {
+		existing, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+		if err != nil {
+			res.Error = &api.KeyError{
+				Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+			}
+			return
+		}
+		if key, ok := existing[api.CrossSigningKeyPurposeMaster]; ok {
+			masterKey = &key
+		}
+	}
+	for _, purpose := range []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeSelfSigning, api.CrossSigningKeyPurposeUserSigning} {
+		key, ok := toStore[purpose]
+		if !ok {
+			continue
+		}
+		if masterKey == nil {
+			res.Error = &api.KeyError{
+				Err:            "A master key must be uploaded before or with the " + string(purpose) + " key",
+				IsMissingParam: true,
+			}
+			return
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			res.Error = &api.KeyError{
+				Err: fmt.Sprintf("failed to marshal %s key: %s", purpose, err),
+			}
+			return
+		}
+		if err = verifyCrossSigningSignature(req.UserID, masterKey, keyJSON); err != nil {
+			res.Error = &api.KeyError{
+				Err:                "The " + string(purpose) + " key isn't signed by the master key: " + err.Error(),
+				IsInvalidSignature: true,
+			}
+			return
+		}
+	}
+
+	if err := a.DB.StoreCrossSigningKeysForUser(ctx, req.UserID, toStore); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+		return
+	}
+	a.emitCrossSigningKeyChange(ctx, req.UserID)
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req *api.PerformUploadDeviceSignaturesRequest, res *api.PerformUploadDeviceSignaturesResponse) {
+	res.Failures = make(map[string]map[string]*api.KeyError)
+	fail := func(targetUserID, targetKeyID string, err *api.KeyError) {
+		if res.Failures[targetUserID] == nil {
+			res.Failures[targetUserID] = make(map[string]*api.KeyError)
+		}
+		res.Failures[targetUserID][targetKeyID] = err
+	}
+
+	ownKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+		}
+		return
+	}
+
+	stored := false
+	for targetUserID, targetKeys := range req.Signatures {
+		for targetKeyID, signedJSON := range targetKeys {
+			// Only the signatures made by the uploading user are of interest.
+			var signed struct {
+				Signatures api.CrossSigningSigMap `json:"signatures"`
+			}
+			if err = json.Unmarshal(signedJSON, &signed); err != nil || len(signed.Signatures[req.UserID]) == 0 {
+				fail(targetUserID, targetKeyID, &api.KeyError{
+					Err:                "No signatures from " + req.UserID + " were found",
+					IsInvalidSignature: true,
+				})
+				continue
+			}
+			for originKeyID, signature := range signed.Signatures[req.UserID] {
+				if keyErr := a.verifyUploadedSignature(ctx, req.UserID, ownKeys, targetUserID, targetKeyID, originKeyID, signedJSON); keyErr != nil {
+					fail(targetUserID, targetKeyID, keyErr)
+					continue
+				}
+				if err = a.DB.StoreCrossSigningSigsForTarget(
+					ctx, req.UserID, originKeyID, targetUserID, gomatrixserverlib.KeyID(targetKeyID), signature,
+				); err != nil {
+					res.Error = &api.KeyError{
+						Err: fmt.Sprintf("failed to store signature: %s", err),
+					}
+					return
+				}
+				stored = true
+			}
+		}
+	}
+
+	// Signatures on the user's own keys change what everyone sees for them,
+	// and signatures on other users' keys are only visible to the uploader,
+	// so in either case the change is to the uploader's keys.
+	if stored {
+		a.emitCrossSigningKeyChange(ctx, req.UserID)
+	}
+}
+
+// verifyUploadedSignature checks that an uploaded signature is one that the
+// user is allowed to make and that it verifies. The user can sign their own
+// devices with their self-signing key, their own master key with one of their
+// devices, and other users' master keys with their user-signing key.
+func (a *KeyInternalAPI) verifyUploadedSignature(
+	ctx context.Context, userID string, ownKeys map[api.CrossSigningKeyPurpose]api.CrossSigningKey,
+	targetUserID, targetKeyID string, originKeyID gomatrixserverlib.KeyID, signedJSON []byte,
+) *api.KeyError {
+	invalid := func(msg string) *api.KeyError {
+		return &api.KeyError{
+			Err:                msg,
+			IsInvalidSignature: true,
+		}
+	}
+	requireOwnKey := func(purpose api.CrossSigningKeyPurpose) *api.KeyError {
+		key, ok := ownKeys[purpose]
+		if !ok {
+			return &api.KeyError{
+				Err:            "No " + string(purpose) + " key has been uploaded",
+				IsMissingParam: true,
+			}
+		}
+		if keyID, _, _ := key.PublicKey(); keyID != originKeyID {
+			return invalid(fmt.Sprintf("Signature must be made with the %s key", purpose))
+		}
+		if err := verifyCrossSigningSignature(userID, &key, signedJSON); err != nil {
+			return invalid("Invalid signature: " + err.Error())
+		}
+		return nil
+	}
+
+	if targetUserID != userID {
+		if keyErr := requireOwnKey(api.CrossSigningKeyPurposeUserSigning); keyErr != nil {
+			return keyErr
+		}
+		// We only know the master keys of local users, so only those can be
+		// checked against what was signed.
+		_, serverName, err := gomatrixserverlib.SplitID('@', targetUserID)
+		if err != nil {
+			return invalid("Invalid user ID")
+		}
+		if serverName == a.ThisServer {
+			return a.checkSignedMasterKey(ctx, targetUserID, targetKeyID, signedJSON)
+		}
+		return nil
+	}
+
+	if master, ok := ownKeys[api.CrossSigningKeyPurposeMaster]; ok {
+		if keyID, _, _ := master.PublicKey(); string(keyID) == "ed25519:"+targetKeyID {
+			// The master key is signed by one of the user's devices.
+			if keyErr := a.checkSignedMasterKey(ctx, targetUserID, targetKeyID, signedJSON); keyErr != nil {
+				return keyErr
+			}
+			deviceID := strings.TrimPrefix(string(originKeyID), "ed25519:")
+			deviceKeys, err := a.DB.DeviceKeysForUser(ctx, userID, []string{deviceID})
+			if err != nil || len(deviceKeys) == 0 || len(deviceKeys[0].KeyJSON) == 0 {
+				return invalid("Unknown signing device " + deviceID)
+			}
+			var device struct {
+				Keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+			}
+			if err = json.Unmarshal(deviceKeys[0].KeyJSON, &device); err != nil || len(device.Keys[originKeyID]) != ed25519.PublicKeySize {
+				return invalid("Signing device has no ed25519 key")
+			}
+			if err = gomatrixserverlib.VerifyJSON(userID, originKeyID, ed25519.PublicKey(device.Keys[originKeyID]), signedJSON); err != nil {
+				return invalid("Invalid signature: " + err.Error())
+			}
+			return nil
+		}
+	}
+
+	// Otherwise this must be one of the user's devices, signed by their
+	// self-signing key.
+	deviceKeys, err := a.DB.DeviceKeysForUser(ctx, userID, []string{targetKeyID})
+	if err != nil || len(deviceKeys) == 0 || len(deviceKeys[0].KeyJSON) == 0 {
+		return invalid("Unknown device " + targetKeyID)
+	}
+	var signedDevice, storedDevice struct {
+		Keys map[string]string `json:"keys"`
+	}
+	if err = json.Unmarshal(signedJSON, &signedDevice); err != nil {
+		return invalid("Signed device keys are invalid")
+	}
+	if err = json.Unmarshal(deviceKeys[0].KeyJSON, &storedDevice); err != nil || !reflect.DeepEqual(signedDevice.Keys, storedDevice.Keys) {
+		return invalid("Signed device keys don't match the uploaded device keys")
+	}
+	return requireOwnKey(api.CrossSigningKeyPurposeSelfSigning)
+}
+
+// checkSignedMasterKey checks that the signed JSON is the current master key
+// of the local target user.
+func (a *KeyInternalAPI) checkSignedMasterKey(ctx context.Context, targetUserID, targetKeyID string, signedJSON []byte) *api.KeyError {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, targetUserID)
+	if err != nil {
+		return &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+		}
+	}
+	master, ok := keys[api.CrossSigningKeyPurposeMaster]
+	if !ok {
+		return &api.KeyError{
+			Err:                "User has no master key",
+			IsInvalidSignature: true,
+		}
+	}
+	var signed api.CrossSigningKey
+	if err = json.Unmarshal(signedJSON, &signed); err != nil {
+		return &api.KeyError{
+			Err:                "Signed key is not a cross-signing key",
+			IsInvalidSignature: true,
+		}
+	}
+	keyID, publicKey, _ := master.PublicKey()
+	if signedKeyID, signedPublicKey, ok := signed.PublicKey(); !ok || signedKeyID != keyID || !bytes.Equal(publicKey, signedPublicKey) ||
+		string(keyID) != "ed25519:"+targetKeyID {
+		return &api.KeyError{
+			Err:                "Signed key is not the user's current master key",
+			IsInvalidSignature: true,
+		}
+	}
+	return nil
+}
+
+// emitCrossSigningKeyChange tells the sync API that the keys of the user have
+// changed, so that it is included in the device list changes of the users who
+// share rooms with them. There is no device ID, so it isn't sent over
+// federation as a device list update.
+func (a *KeyInternalAPI) emitCrossSigningKeyChange(ctx context.Context, userID string) {
+	if a.Producer == nil {
+		return
+	}
+	if err := a.Producer.ProduceKeyChanges([]api.DeviceMessage{
+		{DeviceKeys: api.DeviceKeys{UserID: userID}},
+	}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to produce cross-signing key change")
+	}
+}
+
+// crossSigningKeysForQuery adds the cross-signing keys of a local user to the
+// query response, along with any signatures which the requesting user is
+// allowed to see.
+func (a *KeyInternalAPI) crossSigningKeysForQuery(ctx context.Context, requestingUserID, userID string, res *api.QueryKeysResponse) error {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for purpose, key := range keys {
+		key := key
+		switch purpose {
+		case api.CrossSigningKeyPurposeMaster:
+			keyID, _, _ := key.PublicKey()
+			sigs, err := a.visibleSignatures(ctx, requestingUserID, userID, gomatrixserverlib.KeyID(strings.TrimPrefix(string(keyID), "ed25519:")))
+			if err != nil {
+				return err
+			}
+			key.Signatures = mergeSignatures(key.Signatures, sigs)
+			if res.MasterKeys == nil {
+				res.MasterKeys = make(map[string]api.CrossSigningKey)
+			}
+			res.MasterKeys[userID] = key
+		case api.CrossSigningKeyPurposeSelfSigning:
+			if res.SelfSigningKeys == nil {
+				res.SelfSigningKeys = make(map[string]api.CrossSigningKey)
+			}
+			res.SelfSigningKeys[userID] = key
+		case api.CrossSigningKeyPurposeUserSigning:
+			// Only the user themselves can see their user-signing key.
+			if userID != requestingUserID {
+				continue
+			}
+			if res.UserSigningKeys == nil {
+				res.UserSigningKeys = make(map[string]api.CrossSigningKey)
+			}
+			res.UserSigningKeys[userID] = key
+		}
+	}
+	return nil
+}
+
+// withDeviceSignatures returns the device key JSON with the uploaded
+// signatures for the device added which the requesting user can see.
+func (a *KeyInternalAPI) withDeviceSignatures(ctx context.Context, requestingUserID, userID, deviceID string, keyJSON []byte) ([]byte, error) {
+	sigs, err := a.visibleSignatures(ctx, requestingUserID, userID, gomatrixserverlib.KeyID(deviceID))
+	if err != nil || len(sigs) == 0 {
+		return keyJSON, err
+	}
+	var existing api.CrossSigningSigMap
+	if raw := gjson.GetBytes(keyJSON, "signatures").Raw; raw != "" {
+		if err = json.Unmarshal([]byte(raw), &existing); err != nil {
+			return keyJSON, err
+		}
+	}
+	merged, err := json.Marshal(mergeSignatures(existing, sigs))
+	if err != nil {
+		return keyJSON, err
+	}
+	return sjson.SetRawBytes(keyJSON, "signatures", merged)
+}
+
+// visibleSignatures returns the uploaded signatures on the target key which
+// were made by the key's owner or by the requesting user. Signatures that
+// users have made on other users' keys are private to them.
+func (a *KeyInternalAPI) visibleSignatures(ctx context.Context, requestingUserID, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSigMap, error) {
+	sigs, err := a.DB.CrossSigningSigsForTarget(ctx, targetUserID, targetKeyID)
+	if err != nil {
+		return nil, err
+	}
+	for originUserID := range sigs {
+		if originUserID != targetUserID && originUserID != requestingUserID {
+			delete(sigs, originUserID)
+		}
+	}
+	return sigs, nil
+}
+
+func mergeSignatures(a, b api.CrossSigningSigMap) api.CrossSigningSigMap {
+	if len(b) == 0 {
+		return a
+	}
+	if a == nil {
+		a = make(api.CrossSigningSigMap)
+	}
+	for userID, sigs := range b {
+		if a[userID] == nil {
+			a[userID] = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+		}
+		for keyID, sig := range sigs {
+			a[userID][keyID] = sig
+		}
+	}
+	return a
+}
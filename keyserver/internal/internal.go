@@ -35,12 +35,13 @@ import (
 )
 
 type KeyInternalAPI struct {
-	DB         storage.Database
-	ThisServer gomatrixserverlib.ServerName
-	FedClient  fedsenderapi.FederationClient
-	UserAPI    userapi.UserInternalAPI
-	Producer   *producers.KeyChange
-	Updater    *DeviceListUpdater
+	DB          storage.Database
+	ThisServer  gomatrixserverlib.ServerName
+	FedClient   fedsenderapi.FederationClient
+	UserAPI     userapi.UserInternalAPI
+	Producer    *producers.KeyChange
+	OTKProducer *producers.OneTimeKeyChange
+	Updater     *DeviceListUpdater
 }
 
 func (a *KeyInternalAPI) SetUserAPI(i userapi.UserInternalAPI) {
@@ -77,6 +78,7 @@ func (a *KeyInternalAPI) PerformUploadKeys(ctx context.Context, req *api.Perform
 	res.KeyErrors = make(map[string]map[string]*api.KeyError)
 	a.uploadLocalDeviceKeys(ctx, req, res)
 	a.uploadOneTimeKeys(ctx, req, res)
+	a.uploadFallbackKeys(ctx, req, res)
 }
 
 func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformClaimKeysRequest, res *api.PerformClaimKeysResponse) {
@@ -105,7 +107,12 @@ func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformC
 			}
 		}
 		util.GetLogger(ctx).WithField("keys_claimed", len(keys)).WithField("num_users", len(local)).Info("Claimed local keys")
+		changes := make([]api.OneTimeKeyChange, 0, len(keys))
 		for _, key := range keys {
+			changes = append(changes, api.OneTimeKeyChange{
+				UserID:   key.UserID,
+				DeviceID: key.DeviceID,
+			})
 			_, ok := res.OneTimeKeys[key.UserID]
 			if !ok {
 				res.OneTimeKeys[key.UserID] = make(map[string]map[string]json.RawMessage)
@@ -118,6 +125,11 @@ func (a *KeyInternalAPI) PerformClaimKeys(ctx context.Context, req *api.PerformC
 				res.OneTimeKeys[key.UserID][key.DeviceID][keyID] = keyJSON
 			}
 		}
+		if len(changes) > 0 && a.OTKProducer != nil {
+			if err = a.OTKProducer.ProduceOneTimeKeyChanges(changes); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to produce one-time key changes")
+			}
+		}
 		delete(domainToDeviceKeys, string(a.ThisServer))
 	}
 	if len(domainToDeviceKeys) > 0 {
@@ -191,6 +203,13 @@ func (a *KeyInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOne
 		return
 	}
 	res.Count = *count
+	res.UnusedFallbackAlgorithms, err = a.DB.UnusedFallbackKeyAlgorithms(ctx, req.UserID, req.DeviceID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("Failed to query unused fallback keys: %s", err),
+		}
+		return
+	}
 }
 
 func (a *KeyInternalAPI) QueryDeviceMessages(ctx context.Context, req *api.QueryDeviceMessagesRequest, res *api.QueryDeviceMessagesResponse) {
@@ -268,8 +287,20 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 				dk.KeyJSON, _ = sjson.SetBytes(dk.KeyJSON, "unsigned", struct {
 					DisplayName string `json:"device_display_name,omitempty"`
 				}{displayName})
+				if dk.KeyJSON, err = a.withDeviceSignatures(ctx, req.UserID, userID, dk.DeviceID, dk.KeyJSON); err != nil {
+					res.Error = &api.KeyError{
+						Err: fmt.Sprintf("failed to query device signatures: %s", err),
+					}
+					return
+				}
 				res.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
 			}
+			if err = a.crossSigningKeysForQuery(ctx, req.UserID, userID, res); err != nil {
+				res.Error = &api.KeyError{
+					Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+				}
+				return
+			}
 		} else {
 			domainToDeviceKeys[domain] = make(map[string][]string)
 			domainToDeviceKeys[domain][userID] = append(domainToDeviceKeys[domain][userID], deviceIDs...)
@@ -551,6 +582,16 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 
 }
 
+func (a *KeyInternalAPI) uploadFallbackKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
+	for _, key := range req.FallbackKeys {
+		if err := a.DB.StoreFallbackKeys(ctx, key); err != nil {
+			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
+				Err: fmt.Sprintf("%s device %s : failed to store fallback keys: %s", key.UserID, key.DeviceID, err.Error()),
+			})
+		}
+	}
+}
+
 func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.DeviceMessage) error {
 	// find keys in new that are not in existing
 	var keysAdded []api.DeviceMessage
@@ -55,11 +55,16 @@ func NewInternalAPI(
 			logrus.WithError(err).Panicf("failed to start device list updater")
 		}
 	}()
+	otkChangeProducer := &producers.OneTimeKeyChange{
+		Topic:    string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputOneTimeKeyChangeEvent)),
+		Producer: producer,
+	}
 	return &internal.KeyInternalAPI{
-		DB:         db,
-		ThisServer: cfg.Matrix.ServerName,
-		FedClient:  fedClient,
-		Producer:   keyChangeProducer,
-		Updater:    updater,
+		DB:          db,
+		ThisServer:  cfg.Matrix.ServerName,
+		FedClient:   fedClient,
+		Producer:    keyChangeProducer,
+		OTKProducer: otkChangeProducer,
+		Updater:     updater,
 	}
 }
@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/keyserver/api"
+)
+
+// OneTimeKeyChange produces events for the sync API to consume when keys are
+// claimed from local devices.
+type OneTimeKeyChange struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// ProduceOneTimeKeyChanges creates a new change event for each device
+func (p *OneTimeKeyChange) ProduceOneTimeKeyChanges(changes []api.OneTimeKeyChange) error {
+	for _, change := range changes {
+		var m sarama.ProducerMessage
+
+		value, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+
+		m.Topic = p.Topic
+		m.Key = sarama.StringEncoder(change.UserID)
+		m.Value = sarama.ByteEncoder(value)
+
+		if _, _, err = p.Producer.SendMessage(&m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -33,6 +33,12 @@ type Database interface {
 	// OneTimeKeysCount returns a count of all OTKs for this device.
 	OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error)
 
+	// StoreFallbackKeys persists the given fallback keys, replacing any existing fallback key for the same algorithm.
+	StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error
+
+	// UnusedFallbackKeyAlgorithms returns the algorithms of all fallback keys for this device which have not been claimed yet.
+	UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+
 	// DeviceKeysJSON populates the KeyJSON for the given keys. If any proided `keys` have a `KeyJSON` or `StreamID` already then it will be replaced.
 	DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 
@@ -54,7 +60,8 @@ type Database interface {
 	// If there are some missing keys, they are omitted from the returned slice. There is no ordering on the returned slice.
 	DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error)
 
-	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. Returns no error if a key
+	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. If there are no one-time keys
+	// left for this (user, device, algorithm) then the fallback key is returned instead, if there is one. Returns no error if a key
 	// cannot be claimed or if none exist for this (user, device, algorithm), instead it is omitted from the returned slice.
 	ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error)
 
@@ -73,4 +80,21 @@ type Database interface {
 
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// CrossSigningKeysForUser returns the cross-signing keys of the user, keyed by purpose.
+	CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error)
+
+	// StoreCrossSigningKeysForUser replaces the given cross-signing keys of the user. Keys with other purposes are left unchanged.
+	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]api.CrossSigningKey) error
+
+	// CrossSigningSigsForTarget returns the signatures which have been uploaded for the target key, which is either a
+	// device ID or a cross-signing public key, as origin user ID -> origin key ID -> signature.
+	CrossSigningSigsForTarget(ctx context.Context, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSigMap, error)
+
+	// StoreCrossSigningSigsForTarget stores a signature made by the origin key on the target key. An existing signature
+	// from the same origin key is replaced.
+	StoreCrossSigningSigsForTarget(
+		ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID,
+		targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes,
+	) error
 }
@@ -0,0 +1,145 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var fallbackKeysSchema = `
+-- Stores fallback keys for users, as per MSC2732. Unlike one-time keys, a
+-- fallback key is not deleted when it is claimed, but is instead marked as
+-- used until the device uploads a replacement.
+CREATE TABLE IF NOT EXISTS keyserver_fallback_keys (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	key_id TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	ts_added_secs BIGINT NOT NULL,
+	key_json TEXT NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	-- There is only ever one fallback key per user/device/algorithm.
+	CONSTRAINT keyserver_fallback_keys_unique UNIQUE (user_id, device_id, algorithm)
+);
+`
+
+const upsertFallbackKeysSQL = "" +
+	"INSERT INTO keyserver_fallback_keys (user_id, device_id, key_id, algorithm, ts_added_secs, key_json, used)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, FALSE)" +
+	" ON CONFLICT ON CONSTRAINT keyserver_fallback_keys_unique" +
+	" DO UPDATE SET key_id = $3, ts_added_secs = $5, key_json = $6, used = FALSE"
+
+const selectUnusedFallbackKeyAlgorithmsSQL = "" +
+	"SELECT algorithm FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2 AND used = FALSE"
+
+const selectFallbackKeyByAlgorithmSQL = "" +
+	"SELECT key_id, key_json FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3"
+
+const markFallbackKeyUsedSQL = "" +
+	"UPDATE keyserver_fallback_keys SET used = TRUE WHERE user_id = $1 AND device_id = $2 AND algorithm = $3"
+
+type fallbackKeysStatements struct {
+	db                                    *sql.DB
+	upsertFallbackKeysStmt                *sql.Stmt
+	selectUnusedFallbackKeyAlgorithmsStmt *sql.Stmt
+	selectFallbackKeyByAlgorithmStmt      *sql.Stmt
+	markFallbackKeyUsedStmt               *sql.Stmt
+}
+
+func NewPostgresFallbackKeysTable(db *sql.DB) (tables.FallbackKeys, error) {
+	s := &fallbackKeysStatements{
+		db: db,
+	}
+	_, err := db.Exec(fallbackKeysSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertFallbackKeysStmt, err = db.Prepare(upsertFallbackKeysSQL); err != nil {
+		return nil, err
+	}
+	if s.selectUnusedFallbackKeyAlgorithmsStmt, err = db.Prepare(selectUnusedFallbackKeyAlgorithmsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectFallbackKeyByAlgorithmStmt, err = db.Prepare(selectFallbackKeyByAlgorithmSQL); err != nil {
+		return nil, err
+	}
+	if s.markFallbackKeyUsedStmt, err = db.Prepare(markFallbackKeyUsedSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fallbackKeysStatements) SelectUnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error) {
+	rows, err := s.selectUnusedFallbackKeyAlgorithmsStmt.QueryContext(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUnusedFallbackKeyAlgorithmsStmt: rows.close() failed")
+	algorithms := []string{}
+	for rows.Next() {
+		var algorithm string
+		if err = rows.Scan(&algorithm); err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, rows.Err()
+}
+
+func (s *fallbackKeysStatements) InsertFallbackKeys(ctx context.Context, txn *sql.Tx, keys api.OneTimeKeys) error {
+	now := time.Now().Unix()
+	for keyIDWithAlgo, keyJSON := range keys.KeyJSON {
+		algo, keyID := keys.Split(keyIDWithAlgo)
+		_, err := sqlutil.TxStmt(txn, s.upsertFallbackKeysStmt).ExecContext(
+			ctx, keys.UserID, keys.DeviceID, keyID, algo, now, string(keyJSON),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fallbackKeysStatements) SelectAndMarkFallbackKey(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string,
+) (map[string]json.RawMessage, error) {
+	var keyID string
+	var keyJSON string
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectFallbackKeyByAlgorithmStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	_, err = sqlutil.TxStmtContext(ctx, txn, s.markFallbackKeyUsedStmt).ExecContext(ctx, userID, deviceID, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if keyJSON == "" {
+		return nil, nil
+	}
+	return map[string]json.RawMessage{
+		algorithm + ":" + keyID: json.RawMessage(keyJSON),
+	}, err
+}
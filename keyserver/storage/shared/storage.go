@@ -29,9 +29,12 @@ type Database struct {
 	DB                    *sql.DB
 	Writer                sqlutil.Writer
 	OneTimeKeysTable      tables.OneTimeKeys
+	FallbackKeysTable     tables.FallbackKeys
 	DeviceKeysTable       tables.DeviceKeys
 	KeyChangesTable       tables.KeyChanges
 	StaleDeviceListsTable tables.StaleDeviceLists
+	CrossSigningKeysTable tables.CrossSigningKeys
+	CrossSigningSigsTable tables.CrossSigningSigs
 }
 
 func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -50,6 +53,16 @@ func (d *Database) OneTimeKeysCount(ctx context.Context, userID, deviceID string
 	return d.OneTimeKeysTable.CountOneTimeKeys(ctx, userID, deviceID)
 }
 
+func (d *Database) StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FallbackKeysTable.InsertFallbackKeys(ctx, txn, keys)
+	})
+}
+
+func (d *Database) UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error) {
+	return d.FallbackKeysTable.SelectUnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+}
+
 func (d *Database) DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error {
 	return d.DeviceKeysTable.SelectDeviceKeysJSON(ctx, keys)
 }
@@ -116,6 +129,13 @@ func (d *Database) ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[st
 				if err != nil {
 					return err
 				}
+				if keyJSON == nil {
+					// there are no one-time keys left so use the fallback key, if any
+					keyJSON, err = d.FallbackKeysTable.SelectAndMarkFallbackKey(ctx, txn, userID, deviceID, algo)
+					if err != nil {
+						return err
+					}
+				}
 				if keyJSON != nil {
 					result = append(result, api.OneTimeKeys{
 						UserID:   userID,
@@ -152,3 +172,35 @@ func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isSta
 		return d.StaleDeviceListsTable.InsertStaleDeviceList(ctx, userID, isStale)
 	})
 }
+
+// CrossSigningKeysForUser returns the cross-signing keys of the user, keyed by purpose.
+func (d *Database) CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error) {
+	return d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, nil, userID)
+}
+
+// StoreCrossSigningKeysForUser replaces the given cross-signing keys of the user.
+func (d *Database) StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]api.CrossSigningKey) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for purpose, key := range keys {
+			if err := d.CrossSigningKeysTable.UpsertCrossSigningKeysForUser(ctx, txn, userID, purpose, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CrossSigningSigsForTarget returns the signatures which have been uploaded for the target key.
+func (d *Database) CrossSigningSigsForTarget(ctx context.Context, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSigMap, error) {
+	return d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, nil, targetUserID, targetKeyID)
+}
+
+// StoreCrossSigningSigsForTarget stores a signature on the target key.
+func (d *Database) StoreCrossSigningSigsForTarget(
+	ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID,
+	targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.CrossSigningSigsTable.UpsertCrossSigningSigsForTarget(ctx, txn, originUserID, originKeyID, targetUserID, targetKeyID, signature)
+	})
+}
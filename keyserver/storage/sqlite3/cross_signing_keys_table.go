@@ -0,0 +1,103 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var crossSigningKeysSchema = `
+-- Stores the master, self-signing and user-signing keys of local users.
+CREATE TABLE IF NOT EXISTS keyserver_cross_signing_keys (
+    user_id TEXT NOT NULL,
+	key_type TEXT NOT NULL,
+	-- The key JSON as uploaded, including the signatures made by the user
+	key_data TEXT NOT NULL,
+	UNIQUE (user_id, key_type)
+);
+`
+
+const selectCrossSigningKeysForUserSQL = "" +
+	"SELECT key_type, key_data FROM keyserver_cross_signing_keys WHERE user_id = $1"
+
+const upsertCrossSigningKeysForUserSQL = "" +
+	"INSERT INTO keyserver_cross_signing_keys (user_id, key_type, key_data) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, key_type)" +
+	" DO UPDATE SET key_data = $3"
+
+type crossSigningKeysStatements struct {
+	db                                *sql.DB
+	selectCrossSigningKeysForUserStmt *sql.Stmt
+	upsertCrossSigningKeysForUserStmt *sql.Stmt
+}
+
+func NewSqliteCrossSigningKeysTable(db *sql.DB) (tables.CrossSigningKeys, error) {
+	s := &crossSigningKeysStatements{
+		db: db,
+	}
+	_, err := db.Exec(crossSigningKeysSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.selectCrossSigningKeysForUserStmt, err = db.Prepare(selectCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.upsertCrossSigningKeysForUserStmt, err = db.Prepare(upsertCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *crossSigningKeysStatements) SelectCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectCrossSigningKeysForUserStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectCrossSigningKeysForUserStmt: rows.close() failed")
+	keys := make(map[api.CrossSigningKeyPurpose]api.CrossSigningKey)
+	for rows.Next() {
+		var keyType string
+		var keyData string
+		if err = rows.Scan(&keyType, &keyData); err != nil {
+			return nil, err
+		}
+		var key api.CrossSigningKey
+		if err = json.Unmarshal([]byte(keyData), &key); err != nil {
+			return nil, err
+		}
+		keys[api.CrossSigningKeyPurpose(keyType)] = key
+	}
+	return keys, rows.Err()
+}
+
+func (s *crossSigningKeysStatements) UpsertCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string, purpose api.CrossSigningKeyPurpose, key api.CrossSigningKey,
+) error {
+	keyData, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.upsertCrossSigningKeysForUserStmt).ExecContext(ctx, userID, string(purpose), string(keyData))
+	return err
+}
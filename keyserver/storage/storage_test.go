@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 var ctx = context.Background()
@@ -174,3 +176,113 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestClaimKeysFallsBackToFallbackKey(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:localhost"
+	_, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:otk": json.RawMessage(`{"key":"otk"}`),
+		},
+	})
+	MustNotError(t, err)
+	MustNotError(t, db.StoreFallbackKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:fallback": json.RawMessage(`{"key":"fallback","fallback":true}`),
+		},
+	}))
+	unused, err := db.UnusedFallbackKeyAlgorithms(ctx, alice, "DEVICE")
+	MustNotError(t, err)
+	if !reflect.DeepEqual(unused, []string{"signed_curve25519"}) {
+		t.Fatalf("UnusedFallbackKeyAlgorithms: got %v want [signed_curve25519]", unused)
+	}
+	claim := map[string]map[string]string{
+		alice: {"DEVICE": "signed_curve25519"},
+	}
+	// the one-time key must be claimed first, followed by the fallback key, which can be claimed repeatedly
+	wantKeyIDs := []string{"signed_curve25519:otk", "signed_curve25519:fallback", "signed_curve25519:fallback"}
+	for i, wantKeyID := range wantKeyIDs {
+		keys, err := db.ClaimKeys(ctx, claim)
+		MustNotError(t, err)
+		if len(keys) != 1 {
+			t.Fatalf("claim %d: got %d keys want 1", i, len(keys))
+		}
+		if _, ok := keys[0].KeyJSON[wantKeyID]; !ok {
+			t.Fatalf("claim %d: got keys %v want %s", i, keys[0].KeyJSON, wantKeyID)
+		}
+	}
+	unused, err = db.UnusedFallbackKeyAlgorithms(ctx, alice, "DEVICE")
+	MustNotError(t, err)
+	if len(unused) != 0 {
+		t.Fatalf("UnusedFallbackKeyAlgorithms: got %v want none after claiming", unused)
+	}
+	// uploading a new fallback key marks it as unused again
+	MustNotError(t, db.StoreFallbackKeys(ctx, api.OneTimeKeys{
+		UserID:   alice,
+		DeviceID: "DEVICE",
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:fallback2": json.RawMessage(`{"key":"fallback2","fallback":true}`),
+		},
+	}))
+	unused, err = db.UnusedFallbackKeyAlgorithms(ctx, alice, "DEVICE")
+	MustNotError(t, err)
+	if !reflect.DeepEqual(unused, []string{"signed_curve25519"}) {
+		t.Fatalf("UnusedFallbackKeyAlgorithms: got %v want [signed_curve25519]", unused)
+	}
+}
+
+func TestCrossSigningKeysAndSigs(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:localhost"
+	masterKey := api.CrossSigningKey{
+		UserID: alice,
+		Usage:  []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeMaster},
+		Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			"ed25519:master": gomatrixserverlib.Base64Bytes("master"),
+		},
+	}
+	selfSigningKey := api.CrossSigningKey{
+		UserID: alice,
+		Usage:  []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeSelfSigning},
+		Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+			"ed25519:self": gomatrixserverlib.Base64Bytes("self"),
+		},
+	}
+	MustNotError(t, db.StoreCrossSigningKeysForUser(ctx, alice, map[api.CrossSigningKeyPurpose]api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster:      masterKey,
+		api.CrossSigningKeyPurposeSelfSigning: selfSigningKey,
+	}))
+	// replacing the master key must leave the self-signing key alone
+	masterKey.Keys = map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+		"ed25519:master2": gomatrixserverlib.Base64Bytes("master2"),
+	}
+	MustNotError(t, db.StoreCrossSigningKeysForUser(ctx, alice, map[api.CrossSigningKeyPurpose]api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster: masterKey,
+	}))
+	keys, err := db.CrossSigningKeysForUser(ctx, alice)
+	MustNotError(t, err)
+	want := map[api.CrossSigningKeyPurpose]api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster:      masterKey,
+		api.CrossSigningKeyPurposeSelfSigning: selfSigningKey,
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("CrossSigningKeysForUser: got %+v want %+v", keys, want)
+	}
+
+	MustNotError(t, db.StoreCrossSigningSigsForTarget(ctx, alice, "ed25519:self", alice, "DEVICE", gomatrixserverlib.Base64Bytes("sig1")))
+	MustNotError(t, db.StoreCrossSigningSigsForTarget(ctx, alice, "ed25519:self", alice, "DEVICE", gomatrixserverlib.Base64Bytes("sig2")))
+	sigs, err := db.CrossSigningSigsForTarget(ctx, alice, "DEVICE")
+	MustNotError(t, err)
+	wantSigs := api.CrossSigningSigMap{
+		alice: {"ed25519:self": gomatrixserverlib.Base64Bytes("sig2")},
+	}
+	if !reflect.DeepEqual(sigs, wantSigs) {
+		t.Fatalf("CrossSigningSigsForTarget: got %+v want %+v", sigs, wantSigs)
+	}
+}
@@ -32,6 +32,16 @@ type OneTimeKeys interface {
 	SelectAndDeleteOneTimeKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
 }
 
+type FallbackKeys interface {
+	// SelectUnusedFallbackKeyAlgorithms returns the algorithms of all fallback keys for this device which have not been claimed yet.
+	SelectUnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+	// InsertFallbackKeys replaces the fallback keys for each algorithm in the given keys, marking them as unused.
+	InsertFallbackKeys(ctx context.Context, txn *sql.Tx, keys api.OneTimeKeys) error
+	// SelectAndMarkFallbackKey selects the fallback key matching the user/device/algorithm specified and returns the algo:key_id => JSON,
+	// marking the key as used. Fallback keys are never deleted by claiming them. Returns an empty map if the key does not exist.
+	SelectAndMarkFallbackKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+}
+
 type DeviceKeys interface {
 	SelectDeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 	InsertDeviceKeys(ctx context.Context, txn *sql.Tx, keys []api.DeviceMessage) error
@@ -52,3 +62,18 @@ type StaleDeviceLists interface {
 	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
 	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
 }
+
+type CrossSigningKeys interface {
+	SelectCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error)
+	UpsertCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string, purpose api.CrossSigningKeyPurpose, key api.CrossSigningKey) error
+}
+
+type CrossSigningSigs interface {
+	// SelectCrossSigningSigsForTarget returns the signatures on the target key, which is either a device ID or a
+	// cross-signing public key.
+	SelectCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, targetUserID string, targetKeyID gomatrixserverlib.KeyID) (api.CrossSigningSigMap, error)
+	UpsertCrossSigningSigsForTarget(
+		ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID,
+		targetUserID string, targetKeyID gomatrixserverlib.KeyID, signature gomatrixserverlib.Base64Bytes,
+	) error
+}
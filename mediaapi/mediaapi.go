@@ -16,6 +16,8 @@ package mediaapi
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/retention"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -26,7 +28,7 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
-	router *mux.Router, cfg *config.MediaAPI,
+	router, dendriteAdminRouter *mux.Router, cfg *config.MediaAPI,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
 ) {
@@ -35,7 +37,15 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	mediaStore, err := mediastore.NewProvider(cfg)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up media storage")
+	}
+
+	janitor := retention.NewJanitor(cfg, mediaDB, mediaStore)
+	janitor.Start()
+
 	routing.Setup(
-		router, cfg, mediaDB, userAPI, client,
+		router, dendriteAdminRouter, cfg, mediaDB, mediaStore, janitor, userAPI, client,
 	)
 }
@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// filesystemProvider stores media files in a directory on the local
+// filesystem, which is the media API base path.
+type filesystemProvider struct {
+	absBasePath config.Path
+}
+
+// NewFilesystemProvider returns a provider which stores media files beneath
+// the given absolute base path.
+func NewFilesystemProvider(absBasePath config.Path) Provider {
+	return &filesystemProvider{absBasePath}
+}
+
+// path returns the absolute path of the file stored under the given key.
+func (p *filesystemProvider) path(key string) (string, error) {
+	filePath, err := filepath.Abs(filepath.Join(string(p.absBasePath), filepath.FromSlash(key)))
+	if err != nil {
+		return "", fmt.Errorf("Unable to construct filePath: %w", err)
+	}
+	// check if the absolute absBasePath is a prefix of the absolute filePath
+	// if so, no directory escape has occurred and the filePath is valid
+	// Note: absBasePath is already absolute
+	if !strings.HasPrefix(filePath, string(p.absBasePath)) {
+		return "", fmt.Errorf("Invalid filePath (not within absBasePath %v): %v", p.absBasePath, filePath)
+	}
+	return filePath, nil
+}
+
+func (p *filesystemProvider) Store(ctx context.Context, src types.Path, key string) error {
+	dst, err := p.path(key)
+	if err != nil {
+		return err
+	}
+	if dst == string(src) {
+		// The file was written in place, e.g. a thumbnail generated next to
+		// the local copy of the original file.
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+		return fmt.Errorf("Failed to make directory: %w", err)
+	}
+	if err = os.Rename(string(src), dst); err != nil {
+		return fmt.Errorf("Failed to move file: %w", err)
+	}
+	return nil
+}
+
+func (p *filesystemProvider) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	filePath, err := p.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+func (p *filesystemProvider) Stat(ctx context.Context, key string) (int64, error) {
+	filePath, err := p.path(key)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// LocalPath returns the path of the stored file itself, so files written
+// alongside it are stored in place and cleanup does nothing.
+func (p *filesystemProvider) LocalPath(ctx context.Context, key string) (types.Path, func(), error) {
+	filePath, err := p.path(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return types.Path(filePath), func() {}, nil
+}
+
+func (p *filesystemProvider) Remove(ctx context.Context, key string) error {
+	filePath, err := p.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
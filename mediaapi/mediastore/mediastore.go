@@ -0,0 +1,97 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider stores media files and thumbnails. Files are identified by a key,
+// which is a slash-separated relative path such as that returned by
+// fileutils.GetKeyFromBase64Hash. Methods which fail because the file isn't
+// stored return an error which satisfies os.IsNotExist.
+type Provider interface {
+	// Store moves the local file at src into storage under the given key,
+	// replacing any file already stored under that key. The local file may be
+	// removed once it has been stored.
+	Store(ctx context.Context, src types.Path, key string) error
+	// Open returns the contents of the stored file along with its size in bytes.
+	// The caller must close the returned reader.
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Stat returns the size in bytes of the stored file.
+	Stat(ctx context.Context, key string) (int64, error)
+	// LocalPath returns the path to a local copy of the stored file, for
+	// operations such as thumbnailing which need to read from the filesystem.
+	// The cleanup function must be called once the local copy is no longer
+	// needed. Files written alongside the local copy are removed by cleanup.
+	LocalPath(ctx context.Context, key string) (path types.Path, cleanup func(), err error)
+	// Remove removes the stored file. It is not an error if it doesn't exist.
+	Remove(ctx context.Context, key string) error
+}
+
+// NewProvider returns the storage provider configured for the media API.
+func NewProvider(cfg *config.MediaAPI) (Provider, error) {
+	switch cfg.Storage.Provider {
+	case "", config.MediaStorageProviderFilesystem:
+		return NewFilesystemProvider(cfg.AbsBasePath), nil
+	case config.MediaStorageProviderS3:
+		return NewS3Provider(&cfg.Storage.S3, cfg.AbsBasePath)
+	default:
+		return nil, fmt.Errorf("unknown media storage provider %q", cfg.Storage.Provider)
+	}
+}
+
+// StoreFileWithHashCheck checks for hash collisions when storing a temporary file under its final key based on
+// metadata. The final key is based on the hash of the file.
+// If a file is already stored under the final key and the file size matches, the file does not need to be stored.
+// In error cases where the file is not a duplicate, the caller may decide to remove the stored file.
+// Returns the final key of the file, whether it is a duplicate and an error.
+func StoreFileWithHashCheck(
+	ctx context.Context, provider Provider, tmpDir types.Path, mediaMetadata *types.MediaMetadata, logger *log.Entry,
+) (string, bool, error) {
+	// Note: in all error and success cases, we need to remove the temporary directory
+	defer fileutils.RemoveDir(tmpDir, logger)
+	duplicate := false
+	key, err := fileutils.GetKeyFromBase64Hash(mediaMetadata.Base64Hash)
+	if err != nil {
+		return "", duplicate, fmt.Errorf("failed to get file key from metadata: %w", err)
+	}
+
+	size, err := provider.Stat(ctx, key)
+	switch {
+	case err == nil:
+		duplicate = true
+		if size == int64(mediaMetadata.FileSizeBytes) {
+			return key, duplicate, nil
+		}
+		return "", duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", key)
+	case !os.IsNotExist(err):
+		return "", duplicate, fmt.Errorf("failed to check for existing file (%v): %w", key, err)
+	}
+	err = provider.Store(ctx, types.Path(filepath.Join(string(tmpDir), "content")), key)
+	if err != nil {
+		return "", duplicate, fmt.Errorf("failed to store file (%v): %w", key, err)
+	}
+	return key, duplicate, nil
+}
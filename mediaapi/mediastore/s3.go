@@ -0,0 +1,276 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+const (
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3Service     = "s3"
+	s3TimeFormat  = "20060102T150405Z"
+	s3DateFormat  = "20060102"
+	s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Provider stores media files as objects in an S3-compatible bucket. It
+// only needs a handful of S3 operations, so rather than depending on an SDK
+// it signs requests itself using AWS Signature Version 4.
+type s3Provider struct {
+	client          *http.Client
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	prefix          string
+	usePathStyle    bool
+	accessKeyID     string
+	secretAccessKey string
+	absBasePath     config.Path // for temporary local copies
+}
+
+// NewS3Provider returns a provider which stores media files in the configured
+// S3 bucket. Local copies of files, which are needed for thumbnailing, are
+// written to temporary directories beneath the given absolute base path.
+func NewS3Provider(cfg *config.MediaStorageS3, absBasePath config.Path) (Provider, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	return &s3Provider{
+		client:          &http.Client{},
+		endpoint:        endpoint,
+		region:          cfg.Region,
+		bucket:          cfg.Bucket,
+		prefix:          strings.Trim(cfg.Prefix, "/"),
+		usePathStyle:    cfg.UsePathStyle,
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
+		absBasePath:     absBasePath,
+	}, nil
+}
+
+func (p *s3Provider) Store(ctx context.Context, src types.Path, key string) error {
+	file, err := os.Open(string(src))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	res, err := p.do(ctx, http.MethodPut, key, ioutil.NopCloser(file), size, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	res.Body.Close() // nolint: errcheck
+	return os.Remove(string(src))
+}
+
+func (p *s3Provider) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	res, err := p.do(ctx, http.MethodGet, key, nil, 0, s3EmptySHA256)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+func (p *s3Provider) Stat(ctx context.Context, key string) (int64, error) {
+	res, err := p.do(ctx, http.MethodHead, key, nil, 0, s3EmptySHA256)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close() // nolint: errcheck
+	return res.ContentLength, nil
+}
+
+func (p *s3Provider) LocalPath(ctx context.Context, key string) (types.Path, func(), error) {
+	body, _, err := p.Open(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer body.Close() // nolint: errcheck
+	_, _, tmpDir, err := fileutils.WriteTempFile(ctx, body, 0, p.absBasePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("fileutils.WriteTempFile: %w", err)
+	}
+	cleanup := func() {
+		fileutils.RemoveDir(tmpDir, util.GetLogger(ctx))
+	}
+	return types.Path(filepath.Join(string(tmpDir), "content")), cleanup, nil
+}
+
+func (p *s3Provider) Remove(ctx context.Context, key string) error {
+	res, err := p.do(ctx, http.MethodDelete, key, nil, 0, s3EmptySHA256)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	res.Body.Close() // nolint: errcheck
+	return nil
+}
+
+// do makes a signed request for the object with the given key. Responses
+// with a non-2xx status code are turned into errors, and a 404 results in
+// an error satisfying os.IsNotExist.
+func (p *s3Provider) do(
+	ctx context.Context, method, key string, body io.ReadCloser, size int64, payloadHash string,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+		req.ContentLength = size
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", time.Now().UTC().Format(s3TimeFormat))
+	p.sign(req, payloadHash)
+
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	}
+	// S3 error responses are XML documents describing the problem, which are
+	// small enough to include in the error.
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("S3 %s %q failed with HTTP %d: %s", method, key, res.StatusCode, msg)
+}
+
+// objectURL returns the URL of the object with the given key, addressing the
+// bucket either by hostname or by path.
+func (p *s3Provider) objectURL(key string) string {
+	if p.prefix != "" {
+		key = p.prefix + "/" + key
+	}
+	u := *p.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if p.usePathStyle {
+		path += "/" + p.bucket
+	} else {
+		u.Host = p.bucket + "." + u.Host
+	}
+	path += "/" + key
+	u.Path = path
+	u.RawPath = s3EscapePath(path)
+	return u.String()
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request,
+// covering the host and all of the headers which have been set so far. The
+// x-amz-date header must already be set.
+func (p *s3Provider) sign(req *http.Request, payloadHash string) {
+	amzDate := req.Header.Get("x-amz-date")
+	t, _ := time.Parse(s3TimeFormat, amzDate)
+	scope := strings.Join([]string{t.Format(s3DateFormat), p.region, s3Service, "aws4_request"}, "/")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+p.secretAccessKey), t.Format(s3DateFormat))
+	key = s3HMAC(key, p.region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s3Algorithm, p.accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) // nolint: errcheck
+	return h.Sum(nil)
+}
+
+// s3EscapePath percent-encodes everything in the path except for unreserved
+// characters and slashes, as required for the canonical request.
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
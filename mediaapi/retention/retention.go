@@ -0,0 +1,140 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// How many media to look up from the database at a time when purging.
+const purgeBatchSize = 100
+
+// Janitor deletes remote media, along with its thumbnails, which hasn't been
+// downloaded from this server for a while. Local media is never deleted.
+type Janitor struct {
+	cfg   *config.MediaAPI
+	db    storage.Database
+	store mediastore.Provider
+	mutex sync.Mutex // held while purging so that only one purge runs at a time
+}
+
+func NewJanitor(cfg *config.MediaAPI, db storage.Database, store mediastore.Provider) *Janitor {
+	return &Janitor{
+		cfg:   cfg,
+		db:    db,
+		store: store,
+	}
+}
+
+// Start purges remote media in the background, every retention interval,
+// which hasn't been downloaded within the remote media lifetime. It does
+// nothing if remote media is kept forever.
+func (j *Janitor) Start() {
+	if j.cfg.Retention.RemoteMediaLifetimeDays <= 0 {
+		return
+	}
+	lifetime := time.Duration(j.cfg.Retention.RemoteMediaLifetimeDays) * 24 * time.Hour
+	interval := time.Duration(j.cfg.Retention.IntervalMS) * time.Millisecond
+	go func() {
+		for {
+			before := types.UnixMs(time.Now().Add(-lifetime).UnixNano() / 1000000)
+			deleted, err := j.PurgeRemoteMedia(context.Background(), before)
+			if err != nil {
+				logrus.WithError(err).Error("Failed to purge remote media")
+			} else if deleted > 0 {
+				logrus.Infof("Purged %d remote media which hadn't been downloaded in %d days", deleted, j.cfg.Retention.RemoteMediaLifetimeDays)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// PurgeRemoteMedia deletes all remote media, and its thumbnails, that hasn't
+// been downloaded since the given time. It returns the number of media that
+// were deleted, which may be non-zero even if an error is returned.
+func (j *Janitor) PurgeRemoteMedia(ctx context.Context, before types.UnixMs) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	deleted := 0
+	for {
+		media, err := j.db.GetRemoteMediaNotAccessedSince(ctx, j.cfg.Matrix.ServerName, before, purgeBatchSize)
+		if err != nil {
+			return deleted, fmt.Errorf("j.db.GetRemoteMediaNotAccessedSince: %w", err)
+		}
+		for _, mediaMetadata := range media {
+			if err = j.purge(ctx, mediaMetadata); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(media) < purgeBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+func (j *Janitor) purge(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
+	logger := logrus.WithFields(logrus.Fields{
+		"MediaID": mediaMetadata.MediaID,
+		"Origin":  mediaMetadata.Origin,
+	})
+	thumbnails, err := j.db.GetThumbnails(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return fmt.Errorf("j.db.GetThumbnails: %w", err)
+	}
+	// The database is the source of truth, so the metadata is deleted first.
+	// If removing the files then fails they are orphaned rather than being
+	// referred to by metadata without a file.
+	if err = j.db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+		return fmt.Errorf("j.db.DeleteMedia: %w", err)
+	}
+
+	// Files are stored by their hash, so other media, including local media,
+	// may be using the same file and thumbnails.
+	count, err := j.db.GetMediaCountByHash(ctx, mediaMetadata.Base64Hash)
+	if err != nil {
+		return fmt.Errorf("j.db.GetMediaCountByHash: %w", err)
+	}
+	if count > 0 {
+		logger.Debug("Purged remote media metadata, file is still in use")
+		return nil
+	}
+	fileKey, err := fileutils.GetKeyFromBase64Hash(mediaMetadata.Base64Hash)
+	if err != nil {
+		return fmt.Errorf("fileutils.GetKeyFromBase64Hash: %w", err)
+	}
+	for _, thumbnail := range thumbnails {
+		thumbKey := thumbnailer.GetThumbnailKey(fileKey, thumbnail.ThumbnailSize)
+		if err = j.store.Remove(ctx, thumbKey); err != nil {
+			logger.WithError(err).WithField("key", thumbKey).Warn("Failed to remove thumbnail")
+		}
+	}
+	if err = j.store.Remove(ctx, fileKey); err != nil {
+		logger.WithError(err).WithField("key", fileKey).Warn("Failed to remove file")
+	}
+	logger.Debug("Purged remote media")
+	return nil
+}
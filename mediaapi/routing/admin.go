@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/retention"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type quarantineResponse struct {
+	// The number of media that were quarantined or released from quarantine
+	Count int64 `json:"count"`
+}
+
+type purgeRemoteMediaResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// AdminPurgeRemoteMedia implements POST /_dendrite/admin/v1/purgeRemoteMedia, which deletes
+// remote media that hasn't been downloaded since before_ts. If before_ts isn't
+// given then the configured remote media lifetime is used instead.
+func AdminPurgeRemoteMedia(
+	req *http.Request, cfg *config.MediaAPI, janitor *retention.Janitor,
+) util.JSONResponse {
+	var before types.UnixMs
+	if ts := req.URL.Query().Get("before_ts"); ts != "" {
+		t, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || t < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("before_ts must be a timestamp in milliseconds"),
+			}
+		}
+		before = types.UnixMs(t)
+	} else if days := cfg.Retention.RemoteMediaLifetimeDays; days > 0 {
+		lifetime := time.Duration(days) * 24 * time.Hour
+		before = types.UnixMs(time.Now().Add(-lifetime).UnixNano() / 1000000)
+	} else {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("before_ts must be supplied as no remote media lifetime is configured"),
+		}
+	}
+
+	deleted, err := janitor.PurgeRemoteMedia(req.Context(), before)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("deleted", deleted).Error("Failed to purge remote media")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: purgeRemoteMediaResponse{Deleted: deleted},
+	}
+}
+
+// AdminQuarantineMedia implements POST and DELETE /_dendrite/admin/v1/quarantineMedia/{serverName}/{mediaId},
+// which quarantine or release from quarantine the media with the given mxc URI.
+// Quarantined media can't be downloaded but, unlike purged media, is kept.
+func AdminQuarantineMedia(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database,
+	serverName gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	quarantined := req.Method != http.MethodDelete
+	count, err := db.SetMediaQuarantined(req.Context(), mediaID, serverName, quarantined)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SetMediaQuarantined failed")
+		return jsonerror.InternalServerError()
+	}
+	if count == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("There is no media with this ID on this server"),
+		}
+	}
+	util.GetLogger(req.Context()).WithFields(log.Fields{
+		"Origin":      serverName,
+		"MediaID":     mediaID,
+		"quarantined": quarantined,
+	}).Info("Updated media quarantine")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: quarantineResponse{Count: count},
+	}
+}
+
+// AdminQuarantineUserMedia implements POST and DELETE /_dendrite/admin/v1/quarantineUser/{userID},
+// which quarantine or release from quarantine all of the media uploaded by the user.
+func AdminQuarantineUserMedia(
+	req *http.Request, cfg *config.MediaAPI, db storage.Database,
+	userID string,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	quarantined := req.Method != http.MethodDelete
+	count, err := db.SetMediaQuarantinedByUser(req.Context(), types.MatrixUserID(userID), quarantined)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SetMediaQuarantinedByUser failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithFields(log.Fields{
+		"UserID":      userID,
+		"count":       count,
+		"quarantined": quarantined,
+	}).Info("Updated media quarantine for user")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: quarantineResponse{Count: count},
+	}
+}
@@ -22,16 +22,17 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -44,6 +45,9 @@ import (
 
 const mediaIDCharacters = "A-Za-z0-9_=-"
 
+// How often to record that media has been downloaded, in milliseconds.
+const lastAccessUpdateInterval = types.UnixMs(60 * 60 * 1000)
+
 // Note: unfortunately regex.MustCompile() cannot be assigned to a const
 var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
 
@@ -75,6 +79,7 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Provider,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -117,17 +122,17 @@ func Download(
 
 	// request validation
 	if resErr := dReq.Validate(); resErr != nil {
-		dReq.jsonErrorResponse(w, *resErr)
+		dReq.jsonErrorResponse(w, req, *resErr)
 		return
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
+		req.Context(), w, cfg, db, store, client,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
 	if err != nil {
 		// TODO: Handle the fact we might have started writing the response
-		dReq.jsonErrorResponse(w, util.JSONResponse{
+		dReq.jsonErrorResponse(w, req, util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Failed to download: " + err.Error()),
 		})
@@ -135,7 +140,7 @@ func Download(
 	}
 
 	if metadata == nil {
-		dReq.jsonErrorResponse(w, util.JSONResponse{
+		dReq.jsonErrorResponse(w, req, util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("File not found"),
 		})
@@ -144,7 +149,8 @@ func Download(
 
 }
 
-func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSONResponse) {
+func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, req *http.Request, res util.JSONResponse) {
+	res = httputil.WithRequestID(req, res)
 	// Marshal JSON response into raw bytes to send as the HTTP body
 	resBytes, err := json.Marshal(res.JSON)
 	if err != nil {
@@ -205,6 +211,7 @@ func (r *downloadRequest) doDownload(
 	w http.ResponseWriter,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Provider,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -216,6 +223,11 @@ func (r *downloadRequest) doDownload(
 	if err != nil {
 		return nil, errors.Wrap(err, "error querying the database")
 	}
+	if mediaMetadata != nil && mediaMetadata.Quarantined {
+		// Quarantined media, and its thumbnails, are treated as if they don't exist
+		r.Logger.Info("Refusing to serve quarantined media")
+		return nil, nil
+	}
 	if mediaMetadata == nil {
 		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
 			// If we do not have a record and the origin is local, the file is not found
@@ -223,7 +235,7 @@ func (r *downloadRequest) doDownload(
 		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, cfg, db, store, activeRemoteRequests, activeThumbnailGeneration,
 		)
 		if resErr != nil {
 			return nil, resErr
@@ -231,53 +243,65 @@ func (r *downloadRequest) doDownload(
 	} else {
 		// If we have a record, we can respond from the local file
 		r.MediaMetadata = mediaMetadata
+		r.updateLastAccess(ctx, db)
 	}
 	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
+		ctx, w, store, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
 		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
 	)
 }
 
-// respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
+// updateLastAccess records that the media has been downloaded, so that remote
+// media which is still being used isn't deleted. To avoid writing to the
+// database on every download, this is only done once per interval.
+func (r *downloadRequest) updateLastAccess(ctx context.Context, db storage.Database) {
+	now := types.UnixMs(time.Now().UnixNano() / 1000000)
+	if now-r.MediaMetadata.LastAccessTimestamp < lastAccessUpdateInterval {
+		return
+	}
+	if err := db.UpdateMediaLastAccess(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin, now); err != nil {
+		r.Logger.WithError(err).Warn("Failed to update when media was last downloaded")
+		return
+	}
+	r.MediaMetadata.LastAccessTimestamp = now
+}
+
+// respondFromLocalFile reads a file from the media store and writes it to the http.ResponseWriter
 // If no file was found then returns nil, nil
 func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
-	absBasePath config.Path,
+	store mediastore.Provider,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
+	fileKey, err := fileutils.GetKeyFromBase64Hash(r.MediaMetadata.Base64Hash)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get file path from metadata")
+		return nil, errors.Wrap(err, "failed to get file key from metadata")
 	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
+	file, size, err := store.Open(ctx, fileKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open file")
 	}
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to stat file")
-	}
+	defer file.Close() // nolint: errcheck
 
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
+	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != size {
 		r.Logger.WithFields(log.Fields{
 			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
+			"fileSizeDisk":     size,
 		}).Warn("File size in database and on-disk differ.")
 		return nil, errors.New("file size in database and on-disk differ")
 	}
 
-	var responseFile *os.File
+	var responseFile io.Reader
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
+			ctx, store, fileKey, activeThumbnailGeneration, maxThumbnailGenerators,
 			db, dynamicThumbnails, thumbnailSizes,
 		)
 		if thumbFile != nil {
@@ -394,19 +418,20 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
-	filePath types.Path,
+	store mediastore.Provider,
+	fileKey string,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+) (io.ReadCloser, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			ctx, store, fileKey, r.ThumbnailSize, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
 		if err != nil {
@@ -437,7 +462,7 @@ func (r *downloadRequest) getThumbnailFile(
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Info("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
+				ctx, store, fileKey, *thumbnailSize, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
 			)
 			if err != nil {
@@ -455,18 +480,12 @@ func (r *downloadRequest) getThumbnailFile(
 		"FileSizeBytes": thumbnail.MediaMetadata.FileSizeBytes,
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
-	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
+	thumbKey := thumbnailer.GetThumbnailKey(fileKey, thumbnail.ThumbnailSize)
+	thumbFile, thumbSize, err := store.Open(ctx, thumbKey)
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
 		return nil, nil, errors.Wrap(err, "failed to open file")
 	}
-	thumbStat, err := thumbFile.Stat()
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.Wrap(err, "failed to stat file")
-	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
+	if types.FileSizeBytes(thumbSize) != thumbnail.MediaMetadata.FileSizeBytes {
 		thumbFile.Close() // nolint: errcheck
 		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
 	}
@@ -475,7 +494,8 @@ func (r *downloadRequest) getThumbnailFile(
 
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
-	filePath types.Path,
+	store mediastore.Provider,
+	fileKey string,
 	thumbnailSize types.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -487,7 +507,7 @@ func (r *downloadRequest) generateThumbnail(
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
 	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
+		ctx, store, fileKey, thumbnailSize, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 	)
 	if err != nil {
@@ -507,7 +527,7 @@ func (r *downloadRequest) generateThumbnail(
 	return thumbnail, nil
 }
 
-// getRemoteFile fetches the remote file and caches it locally
+// getRemoteFile fetches the remote file and caches it in the media store
 // A hash map of active remote requests to a struct containing a sync.Cond is used to only download remote files once,
 // regardless of how many download requests are received.
 // Note: The named errorResponse return variable is used in a deferred broadcast of the metadata and error response to waiting goroutines.
@@ -516,6 +536,7 @@ func (r *downloadRequest) getRemoteFile(
 	client *gomatrixserverlib.Client,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Provider,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
@@ -549,7 +570,7 @@ func (r *downloadRequest) getRemoteFile(
 		if mediaMetadata == nil {
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
-				ctx, client,
+				ctx, client, store,
 				cfg.AbsBasePath, *cfg.MaxFileSizeBytes, db,
 				cfg.ThumbnailSizes, activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
@@ -615,6 +636,7 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
+	store mediastore.Provider,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
 	db storage.Database,
@@ -622,8 +644,8 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
+	finalKey, duplicate, err := r.fetchRemoteFile(
+		ctx, client, store, absBasePath, maxFileSizeBytes,
 	)
 	if err != nil {
 		return err
@@ -642,8 +664,9 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			finalDir := filepath.Dir(string(finalPath))
-			fileutils.RemoveDir(types.Path(finalDir), r.Logger)
+			if err = store.Remove(ctx, finalKey); err != nil {
+				r.Logger.WithError(err).WithField("key", finalKey).Warn("Failed to remove file")
+			}
 		}
 		// NOTE: It should really not be possible to fail the uniqueness test here so
 		// there is no need to handle that separately
@@ -652,7 +675,7 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, finalKey, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -676,9 +699,10 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 func (r *downloadRequest) fetchRemoteFile(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
+	store mediastore.Provider,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+) (string, bool, error) {
 	r.Logger.Info("Fetching remote file")
 
 	// create request for remote file
@@ -744,17 +768,17 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
 
-	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	// The database is the source of truth so we need to have stored the file first
+	finalKey, duplicate, err := mediastore.StoreFileWithHashCheck(ctx, store, tmpDir, r.MediaMetadata, r.Logger)
 	if err != nil {
-		return "", false, errors.Wrap(err, "failed to move file")
+		return "", false, errors.Wrap(err, "failed to store file")
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		r.Logger.WithField("dst", finalKey).Info("File was stored previously - discarding duplicate")
 		// Continue on to store the metadata in the database
 	}
 
-	return types.Path(finalPath), duplicate, nil
+	return finalKey, duplicate, nil
 }
 
 func (r *downloadRequest) createRemoteRequest(
@@ -22,6 +22,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/retention"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -38,14 +40,17 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router,
+	publicAPIMux, dendriteAdminMux *mux.Router,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Provider,
+	janitor *retention.Janitor,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
 ) {
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
+	adminMux := dendriteAdminMux.PathPrefix("/v1").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
@@ -54,7 +59,10 @@ func Setup(
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			if r := checkUploadAllowed(req.Context(), userAPI, dev); r != nil {
+				return *r
+			}
+			return Upload(req, cfg, dev, db, store, activeThumbnailGeneration)
 		},
 	)
 
@@ -65,21 +73,57 @@ func Setup(
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration)
+	downloadHandler := makeDownloadAPI("download", cfg, db, store, client, activeRemoteRequests, activeThumbnailGeneration)
 	r0mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v1mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)                // TODO: remove when synapse is fixed
 	v1mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions) // TODO: remove when synapse is fixed
 
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", cfg, db, store, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/purgeRemoteMedia",
+		httputil.MakeAdminAPI("admin_purge_remote_media", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			return AdminPurgeRemoteMedia(req, cfg, janitor)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/quarantineMedia/{serverName}/{mediaId}",
+		httputil.MakeAdminAPI("admin_quarantine_media", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminQuarantineMedia(
+				req, cfg, db,
+				gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+	adminMux.Handle("/quarantineUser/{userID}",
+		httputil.MakeAdminAPI("admin_quarantine_user", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminQuarantineUserMedia(req, cfg, db, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	if cfg.URLPreview.Enabled {
+		previewer := newURLPreviewer(cfg, db, store, activeThumbnailGeneration)
+		previewHandler := httputil.MakeAuthAPI("preview_url", userAPI, previewer.Preview)
+		r0mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+		v1mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
 }
 
 func makeDownloadAPI(
 	name string,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Provider,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -96,6 +140,7 @@ func makeDownloadAPI(
 
 		// Set internal headers returned regardless of the outcome of the request
 		util.SetCORSHeaders(w)
+		w.Header().Set(httputil.RequestIDHeader, httputil.RequestID(req.Context()))
 		// Content-Type will be overridden in case of returning file data, else we respond with JSON-formatted errors
 		w.Header().Set("Content-Type", "application/json")
 
@@ -119,6 +164,7 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
 			client,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
@@ -22,11 +22,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"path"
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -56,13 +56,13 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, store mediastore.Provider, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
@@ -74,6 +74,26 @@ func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db sto
 	}
 }
 
+// checkUploadAllowed returns an error response if a server administrator has
+// stopped the user from uploading media.
+func checkUploadAllowed(ctx context.Context, userAPI userapi.UserInternalAPI, dev *userapi.Device) *util.JSONResponse {
+	var res userapi.QueryAccountPermissionsResponse
+	if err := userAPI.QueryAccountPermissions(ctx, &userapi.QueryAccountPermissionsRequest{
+		UserID: dev.UserID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountPermissions failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.UserExists && !res.Permissions.CanUploadMedia {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to upload media"),
+		}
+	}
+	return nil
+}
+
 // parseAndValidateRequest parses the incoming upload request to validate and extract
 // all the metadata about the media being uploaded.
 // Returns either an uploadRequest or an error formatted as a util.JSONResponse
@@ -128,6 +148,7 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Provider,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -214,7 +235,7 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, store, db, cfg.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
@@ -263,21 +284,21 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
-// storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
-// See getPathFromMediaMetadata in fileutils for details of the final path.
+// storeFileAndMetadata moves the temporary file into the media store based on metadata and stores the metadata in the database
+// See GetKeyFromBase64Hash in fileutils for details of the final key.
 // The order of operations is important as it avoids metadata entering the database before the file
 // is ready, and if we fail to move the file, it never gets added to the database.
 // Returns a util.JSONResponse error and cleans up directories in case of error.
 func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
-	absBasePath config.Path,
+	store mediastore.Provider,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	finalKey, duplicate, err := mediastore.StoreFileWithHashCheck(ctx, store, tmpDir, r.MediaMetadata, r.Logger)
 	if err != nil {
 		r.Logger.WithError(err).Error("Failed to move file.")
 		return &util.JSONResponse{
@@ -286,7 +307,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		}
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		r.Logger.WithField("dst", finalKey).Info("File was stored previously - discarding duplicate")
 	}
 
 	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
@@ -295,7 +316,9 @@ func (r *uploadRequest) storeFileAndMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+			if err = store.Remove(ctx, finalKey); err != nil {
+				r.Logger.WithError(err).WithField("key", finalKey).Warn("Failed to remove file")
+			}
 		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -305,7 +328,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, finalKey, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -0,0 +1,427 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	// Imported so that the dimensions of proxied images can be worked out
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const maxURLPreviewRedirects = 10
+
+// urlPreviewer generates previews of URLs for GET /preview_url. Previews are
+// made up of the OpenGraph properties of the page, and any image referenced
+// by the page is stored in the media repository so that clients don't make
+// requests to the site themselves.
+type urlPreviewer struct {
+	cfg                       *config.MediaAPI
+	db                        storage.Database
+	store                     mediastore.Provider
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration
+	client                    *http.Client
+	deniedIPRanges            []*net.IPNet
+	activeMutex               sync.Mutex                   // protects active
+	active                    map[string]*urlPreviewResult // URL -> preview being generated
+}
+
+// urlPreviewResult is the result of generating a preview, which is shared
+// with any requests for the same URL that arrive while it is being generated.
+type urlPreviewResult struct {
+	done    chan struct{}
+	preview []byte
+	err     error
+}
+
+func newURLPreviewer(
+	cfg *config.MediaAPI,
+	db storage.Database,
+	store mediastore.Provider,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) *urlPreviewer {
+	p := &urlPreviewer{
+		cfg:                       cfg,
+		db:                        db,
+		store:                     store,
+		activeThumbnailGeneration: activeThumbnailGeneration,
+		active:                    make(map[string]*urlPreviewResult),
+	}
+	for _, cidr := range cfg.URLPreview.DeniedIPRanges {
+		// The ranges have already been validated by the config.
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			p.deniedIPRanges = append(p.deniedIPRanges, ipNet)
+		}
+	}
+	// The IP address is checked once the hostname has been resolved, just
+	// before connecting, so that names resolving to denied IP addresses
+	// can't be used to reach them. The proxy from the environment is not
+	// used as that would bypass the check.
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: p.checkDial,
+	}
+	p.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxURLPreviewRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxURLPreviewRedirects)
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+	return p
+}
+
+// Preview implements GET /preview_url
+func (p *urlPreviewer) Preview(req *http.Request, dev *userapi.Device) util.JSONResponse {
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("url must be supplied"),
+		}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("url must be an absolute URL"),
+		}
+	}
+	if err = p.checkURL(u); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Previews are not allowed for this URL"),
+		}
+	}
+	// The fragment isn't sent to the server, so it doesn't affect the preview.
+	u.Fragment = ""
+
+	preview, err := p.getPreview(req.Context(), u.String(), dev)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("url", u.String()).Warn("Failed to generate URL preview")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to generate a preview for this URL"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: json.RawMessage(preview),
+	}
+}
+
+// getPreview returns the cached preview for the URL if it hasn't expired,
+// otherwise generates a new one. Only one preview is generated at a time for
+// each URL.
+func (p *urlPreviewer) getPreview(ctx context.Context, rawURL string, dev *userapi.Device) ([]byte, error) {
+	cached, err := p.db.GetURLPreview(ctx, rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("p.db.GetURLPreview: %w", err)
+	}
+	now := types.UnixMs(time.Now().UnixNano() / 1000000)
+	if cached != nil && cached.ExpiresTimestamp > now {
+		return cached.Preview, nil
+	}
+
+	p.activeMutex.Lock()
+	if result, ok := p.active[rawURL]; ok {
+		p.activeMutex.Unlock()
+		<-result.done
+		return result.preview, result.err
+	}
+	result := &urlPreviewResult{done: make(chan struct{})}
+	p.active[rawURL] = result
+	p.activeMutex.Unlock()
+	defer func() {
+		p.activeMutex.Lock()
+		delete(p.active, rawURL)
+		p.activeMutex.Unlock()
+		close(result.done)
+	}()
+
+	result.preview, result.err = p.generatePreview(ctx, rawURL, dev)
+	if result.err != nil {
+		return nil, result.err
+	}
+	if err = p.db.StoreURLPreview(ctx, &types.URLPreview{
+		URL:               rawURL,
+		Preview:           result.preview,
+		CreationTimestamp: now,
+		ExpiresTimestamp:  now + types.UnixMs(p.cfg.URLPreview.CacheLifetimeMS),
+	}); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to store URL preview")
+	}
+	return result.preview, nil
+}
+
+func (p *urlPreviewer) generatePreview(ctx context.Context, rawURL string, dev *userapi.Device) ([]byte, error) {
+	res, err := p.fetch(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+
+	og := map[string]interface{}{}
+	contentType := res.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		body, err := charset.NewReader(io.LimitReader(res.Body, int64(p.cfg.URLPreview.MaxPageSizeBytes)), contentType)
+		if err != nil {
+			return nil, fmt.Errorf("charset.NewReader: %w", err)
+		}
+		for property, value := range parseOpenGraph(body) {
+			og[property] = value
+		}
+		if imageRef, ok := og["og:image"].(string); ok {
+			// The image will be replaced with a copy in the media repository
+			// if we manage to fetch it, otherwise it is left out.
+			delete(og, "og:image")
+			imageURL, err := res.Request.URL.Parse(imageRef)
+			if err == nil {
+				err = p.checkURL(imageURL)
+			}
+			if err == nil {
+				err = p.proxyImage(ctx, imageURL.String(), dev, og)
+			}
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("image", imageRef).Info("Failed to fetch image for URL preview")
+			}
+		}
+	case strings.HasPrefix(mediaType, "image/"):
+		if err = p.storeImage(ctx, res, dev, og); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(og)
+}
+
+func (p *urlPreviewer) fetch(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Dendrite URL preview")
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("received HTTP %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+func (p *urlPreviewer) proxyImage(ctx context.Context, imageURL string, dev *userapi.Device, og map[string]interface{}) error {
+	res, err := p.fetch(ctx, imageURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	return p.storeImage(ctx, res, dev, og)
+}
+
+// storeImage stores the image in the response in the media repository, as
+// if it had been uploaded by the user requesting the preview, and adds its
+// details to the OpenGraph properties.
+func (p *urlPreviewer) storeImage(ctx context.Context, res *http.Response, dev *userapi.Device, og map[string]interface{}) error {
+	maxFileSizeBytes := int64(*p.cfg.MaxFileSizeBytes)
+	body := io.Reader(res.Body)
+	if maxFileSizeBytes > 0 {
+		body = io.LimitReader(res.Body, maxFileSizeBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if maxFileSizeBytes > 0 && int64(len(data)) > maxFileSizeBytes {
+		return fmt.Errorf("image is larger than the maximum file size (%d bytes)", maxFileSizeBytes)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("image is empty")
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	uploadName := path.Base(res.Request.URL.Path)
+	if uploadName == "." || uploadName == "/" {
+		uploadName = ""
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        p.cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(len(data)),
+			ContentType:   types.ContentType(contentType),
+			UploadName:    types.Filename(url.PathEscape(uploadName)),
+			UserID:        types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(ctx).WithFields(log.Fields{
+			"Origin": p.cfg.Matrix.ServerName,
+			"URL":    res.Request.URL.String(),
+		}),
+	}
+	if resErr := r.doUpload(ctx, bytes.NewReader(data), p.cfg, p.db, p.store, p.activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("failed to store image: %+v", resErr.JSON)
+	}
+
+	og["og:image"] = fmt.Sprintf("mxc://%s/%s", p.cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	og["og:image:type"] = contentType
+	og["matrix:image:size"] = len(data)
+	if imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		og["og:image:width"] = imageConfig.Width
+		og["og:image:height"] = imageConfig.Height
+	}
+	return nil
+}
+
+// checkURL returns an error if the URL must not be previewed because of its
+// scheme or the allowed and denied hosts.
+func (p *urlPreviewer) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(p.cfg.URLPreview.AllowedHosts) > 0 && !matchesHost(host, p.cfg.URLPreview.AllowedHosts) {
+		return fmt.Errorf("host %q is not allowed", host)
+	}
+	if matchesHost(host, p.cfg.URLPreview.DeniedHosts) {
+		return fmt.Errorf("host %q is denied", host)
+	}
+	return nil
+}
+
+// checkDial is used as the net.Dialer control function, and refuses to
+// connect to IP addresses in the denied ranges.
+func (p *urlPreviewer) checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", host)
+	}
+	for _, ipNet := range p.deniedIPRanges {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("IP address %s is denied", ip)
+		}
+	}
+	return nil
+}
+
+// matchesHost returns true if the host is one of the given hosts or is a
+// subdomain of one of them.
+func matchesHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimPrefix(h, "."))
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOpenGraph returns the OpenGraph properties from the HTML document. If
+// the document has no og:title or og:description then they are taken from
+// the title element and the description meta tag instead.
+func parseOpenGraph(r io.Reader) map[string]string {
+	props := map[string]string{}
+	var title, description string
+	inTitle := false
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			// This is either the end of the document or we hit the size limit.
+			if _, ok := props["og:title"]; !ok && title != "" {
+				props["og:title"] = title
+			}
+			if _, ok := props["og:description"]; !ok && description != "" {
+				props["og:description"] = description
+			}
+			return props
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				var property, content string
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					switch string(key) {
+					case "property", "name":
+						property = strings.ToLower(string(val))
+					case "content":
+						content = string(val)
+					}
+				}
+				if strings.HasPrefix(property, "og:") {
+					if _, ok := props[property]; !ok {
+						props[property] = content
+					}
+				} else if property == "description" && description == "" {
+					description = content
+				}
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				inTitle = false
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestParseOpenGraph(t *testing.T) {
+	doc := `<html><head>
+		<title> Page title </title>
+		<meta name="description" content="Page description">
+		<meta property="og:title" content="OpenGraph &amp; title" />
+		<meta property="og:image" content="/image.png">
+		<meta property="og:title" content="Second title">
+	</head><body>Hello</body></html>`
+	want := map[string]string{
+		"og:title":       "OpenGraph & title",
+		"og:description": "Page description",
+		"og:image":       "/image.png",
+	}
+	if got := parseOpenGraph(strings.NewReader(doc)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	doc = `<html><head><title>Only a title</title></head></html>`
+	want = map[string]string{
+		"og:title": "Only a title",
+	}
+	if got := parseOpenGraph(strings.NewReader(doc)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestURLPreviewCheckURL(t *testing.T) {
+	p := &urlPreviewer{cfg: &config.MediaAPI{}}
+	p.cfg.URLPreview.AllowedHosts = []string{"example.com"}
+	p.cfg.URLPreview.DeniedHosts = []string{"private.example.com"}
+	for rawURL, allowed := range map[string]bool{
+		"https://example.com/page":              true,
+		"http://www.EXAMPLE.com/page":           true,
+		"https://private.example.com/page":      false,
+		"https://a.private.example.com/page":    false,
+		"https://notexample.com/page":           false,
+		"ftp://example.com/file":                false,
+		"https://example.com.attacker.net/page": false,
+	} {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.checkURL(u); (err == nil) != allowed {
+			t.Errorf("checkURL(%q) returned %v, want allowed=%v", rawURL, err, allowed)
+		}
+	}
+}
@@ -28,4 +28,13 @@ type Database interface {
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	StoreURLPreview(ctx context.Context, preview *types.URLPreview) error
+	GetURLPreview(ctx context.Context, url string) (*types.URLPreview, error)
+	UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs) error
+	GetRemoteMediaNotAccessedSince(ctx context.Context, localServerName gomatrixserverlib.ServerName, before types.UnixMs, limit int) ([]*types.MediaMetadata, error)
+	GetMediaMetadataAfter(ctx context.Context, afterOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int) ([]*types.MediaMetadata, error)
+	SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, quarantined bool) (int64, error)
+	SetMediaQuarantinedByUser(ctx context.Context, userID types.MatrixUserID, quarantined bool) (int64, error)
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	GetMediaCountByHash(ctx context.Context, mediaHash types.Base64Hash) (int, error)
 }
@@ -0,0 +1,49 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadLastAccessTS(m *sqlutil.Migrations) {
+	m.AddMigration(UpLastAccessTS, DownLastAccessTS)
+}
+
+func UpLastAccessTS(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE mediaapi_media_repository ADD COLUMN IF NOT EXISTS last_access_ts BIGINT;
+UPDATE mediaapi_media_repository SET last_access_ts = creation_ts WHERE last_access_ts IS NULL;
+ALTER TABLE mediaapi_media_repository ALTER COLUMN last_access_ts SET NOT NULL;
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_last_access_ts_idx ON mediaapi_media_repository (last_access_ts);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownLastAccessTS(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP INDEX IF EXISTS mediaapi_media_repository_last_access_ts_idx;
+ALTER TABLE mediaapi_media_repository DROP COLUMN IF EXISTS last_access_ts;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -20,6 +20,8 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -40,33 +42,79 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
     file_size_bytes BIGINT NOT NULL,
     -- When the content was uploaded in UNIX epoch ms.
     creation_ts BIGINT NOT NULL,
+    -- When the content was last downloaded in UNIX epoch ms. This is only updated
+    -- once an hour at most, and is used to decide when cached remote media is deleted.
+    last_access_ts BIGINT NOT NULL,
     -- The file name with which the media was uploaded.
     upload_name TEXT NOT NULL,
     -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
     base64hash TEXT NOT NULL,
     -- The user who uploaded the file. Should be a Matrix user ID.
-    user_id TEXT NOT NULL
+    user_id TEXT NOT NULL,
+    -- Whether the media has been quarantined by a server administrator. Quarantined
+    -- media can't be downloaded, but is kept rather than deleted.
+    quarantined BOOLEAN NOT NULL DEFAULT FALSE
 );
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
 `
 
 const insertMediaSQL = `
-INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, last_access_ts, upload_name, base64hash, user_id)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 `
 
 const selectMediaSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, last_access_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 const selectMediaByHashSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
 `
 
+const updateMediaLastAccessSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = $1 WHERE media_id = $2 AND media_origin = $3
+`
+
+// Note: this selects remote media only, and never quarantined media
+const selectRemoteMediaNotAccessedSinceSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, last_access_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository
+    WHERE media_origin != $1 AND last_access_ts < $2 AND NOT quarantined
+    ORDER BY last_access_ts ASC LIMIT $3
+`
+
+const selectMediaAfterSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, last_access_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository
+    WHERE media_origin > $1 OR (media_origin = $1 AND media_id > $2)
+    ORDER BY media_origin ASC, media_id ASC LIMIT $3
+`
+
+const updateMediaQuarantinedSQL = `
+UPDATE mediaapi_media_repository SET quarantined = $1 WHERE media_id = $2 AND media_origin = $3
+`
+
+const updateMediaQuarantinedByUserSQL = `
+UPDATE mediaapi_media_repository SET quarantined = $1 WHERE user_id = $2
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaCountByHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
 type mediaStatements struct {
-	insertMediaStmt       *sql.Stmt
-	selectMediaStmt       *sql.Stmt
-	selectMediaByHashStmt *sql.Stmt
+	insertMediaStmt                       *sql.Stmt
+	selectMediaStmt                       *sql.Stmt
+	selectMediaByHashStmt                 *sql.Stmt
+	updateMediaLastAccessStmt             *sql.Stmt
+	selectRemoteMediaNotAccessedSinceStmt *sql.Stmt
+	selectMediaAfterStmt                  *sql.Stmt
+	updateMediaQuarantinedStmt            *sql.Stmt
+	updateMediaQuarantinedByUserStmt      *sql.Stmt
+	deleteMediaStmt                       *sql.Stmt
+	selectMediaCountByHashStmt            *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB) (err error) {
@@ -79,6 +127,13 @@ func (s *mediaStatements) prepare(db *sql.DB) (err error) {
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.updateMediaLastAccessStmt, updateMediaLastAccessSQL},
+		{&s.selectRemoteMediaNotAccessedSinceStmt, selectRemoteMediaNotAccessedSinceSQL},
+		{&s.selectMediaAfterStmt, selectMediaAfterSQL},
+		{&s.updateMediaQuarantinedStmt, updateMediaQuarantinedSQL},
+		{&s.updateMediaQuarantinedByUserStmt, updateMediaQuarantinedByUserSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectMediaCountByHashStmt, selectMediaCountByHashSQL},
 	}.prepare(db)
 }
 
@@ -86,6 +141,7 @@ func (s *mediaStatements) insertMedia(
 	ctx context.Context, mediaMetadata *types.MediaMetadata,
 ) error {
 	mediaMetadata.CreationTimestamp = types.UnixMs(time.Now().UnixNano() / 1000000)
+	mediaMetadata.LastAccessTimestamp = mediaMetadata.CreationTimestamp
 	_, err := s.insertMediaStmt.ExecContext(
 		ctx,
 		mediaMetadata.MediaID,
@@ -93,6 +149,7 @@ func (s *mediaStatements) insertMedia(
 		mediaMetadata.ContentType,
 		mediaMetadata.FileSizeBytes,
 		mediaMetadata.CreationTimestamp,
+		mediaMetadata.LastAccessTimestamp,
 		mediaMetadata.UploadName,
 		mediaMetadata.Base64Hash,
 		mediaMetadata.UserID,
@@ -113,9 +170,11 @@ func (s *mediaStatements) selectMedia(
 		&mediaMetadata.ContentType,
 		&mediaMetadata.FileSizeBytes,
 		&mediaMetadata.CreationTimestamp,
+		&mediaMetadata.LastAccessTimestamp,
 		&mediaMetadata.UploadName,
 		&mediaMetadata.Base64Hash,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
@@ -139,3 +198,89 @@ func (s *mediaStatements) selectMediaByHash(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) updateMediaLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs,
+) error {
+	_, err := s.updateMediaLastAccessStmt.ExecContext(ctx, lastAccess, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) selectRemoteMediaNotAccessedSince(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName, before types.UnixMs, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectRemoteMediaNotAccessedSinceStmt.QueryContext(ctx, localServerName, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRemoteMediaNotAccessedSince: rows.close() failed")
+	return scanMedia(rows)
+}
+
+func (s *mediaStatements) selectMediaAfter(
+	ctx context.Context, afterOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectMediaAfterStmt.QueryContext(ctx, afterOrigin, afterMediaID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaAfter: rows.close() failed")
+	return scanMedia(rows)
+}
+
+func scanMedia(rows *sql.Rows) ([]*types.MediaMetadata, error) {
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err := rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.LastAccessTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+			&mediaMetadata.Quarantined,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) updateMediaQuarantined(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, quarantined bool,
+) (int64, error) {
+	res, err := s.updateMediaQuarantinedStmt.ExecContext(ctx, quarantined, mediaID, mediaOrigin)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *mediaStatements) updateMediaQuarantinedByUser(
+	ctx context.Context, userID types.MatrixUserID, quarantined bool,
+) (int64, error) {
+	res, err := s.updateMediaQuarantinedByUserStmt.ExecContext(ctx, quarantined, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) selectMediaCountByHash(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (count int, err error) {
+	err = s.selectMediaCountByHashStmt.QueryRowContext(ctx, mediaHash).Scan(&count)
+	return
+}
@@ -22,6 +22,7 @@ import (
 	// Import the postgres database driver.
 	_ "github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -40,6 +41,17 @@ func Open(dbProperties *config.DatabaseOptions) (*Database, error) {
 	if d.db, err = sqlutil.Open(dbProperties); err != nil {
 		return nil, err
 	}
+	// Create the media table before running the deltas against it, and only then
+	// prepare the statements as they refer to columns added by the deltas.
+	if _, err = d.db.Exec(mediaSchema); err != nil {
+		return nil, err
+	}
+	m := sqlutil.NewMigrations()
+	deltas.LoadLastAccessTS(m)
+	deltas.LoadQuarantined(m)
+	if err = m.RunDeltas(d.db, dbProperties); err != nil {
+		return nil, err
+	}
 	if err = d.statements.prepare(d.db); err != nil {
 		return nil, err
 	}
@@ -119,3 +131,85 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// StoreURLPreview stores a preview of a URL, replacing any existing preview of the URL.
+func (d *Database) StoreURLPreview(
+	ctx context.Context, preview *types.URLPreview,
+) error {
+	return d.statements.urlPreview.upsertURLPreview(ctx, preview)
+}
+
+// GetURLPreview returns the stored preview of a URL, which may have expired.
+// Returns nil if there is no preview stored for the URL.
+func (d *Database) GetURLPreview(
+	ctx context.Context, url string,
+) (*types.URLPreview, error) {
+	preview, err := d.statements.urlPreview.selectURLPreview(ctx, url)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return preview, err
+}
+
+// UpdateMediaLastAccess records when the media was last downloaded.
+func (d *Database) UpdateMediaLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs,
+) error {
+	return d.statements.media.updateMediaLastAccess(ctx, mediaID, mediaOrigin, lastAccess)
+}
+
+// GetRemoteMediaNotAccessedSince returns up to limit media from servers other than
+// the local server which haven't been downloaded since the given time, least
+// recently downloaded first.
+func (d *Database) GetRemoteMediaNotAccessedSince(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName, before types.UnixMs, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectRemoteMediaNotAccessedSince(ctx, localServerName, before, limit)
+}
+
+// GetMediaMetadataAfter returns up to limit media, from any origin, ordered by
+// origin and then media ID, starting after the given origin and media ID. This
+// is used to page through all of the media in the database.
+func (d *Database) GetMediaMetadataAfter(
+	ctx context.Context, afterOrigin gomatrixserverlib.ServerName, afterMediaID types.MediaID, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectMediaAfter(ctx, afterOrigin, afterMediaID, limit)
+}
+
+// SetMediaQuarantined quarantines, or releases from quarantine, the media with
+// the given ID. Returns the number of media updated, which is 0 if there is no
+// such media.
+func (d *Database) SetMediaQuarantined(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, quarantined bool,
+) (int64, error) {
+	return d.statements.media.updateMediaQuarantined(ctx, mediaID, mediaOrigin, quarantined)
+}
+
+// SetMediaQuarantinedByUser quarantines, or releases from quarantine, all of the
+// media uploaded by the given user. Returns the number of media updated.
+func (d *Database) SetMediaQuarantinedByUser(
+	ctx context.Context, userID types.MatrixUserID, quarantined bool,
+) (int64, error) {
+	return d.statements.media.updateMediaQuarantinedByUser(ctx, userID, quarantined)
+}
+
+// DeleteMedia deletes the metadata about the media and all of its thumbnails.
+// The files themselves must be removed separately.
+func (d *Database) DeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.statements.thumbnail.deleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		return d.statements.media.deleteMedia(ctx, txn, mediaID, mediaOrigin)
+	})
+}
+
+// GetMediaCountByHash returns the number of media with the given hash, from any
+// origin. As files are stored by hash, the file is still in use if this isn't 0.
+func (d *Database) GetMediaCountByHash(
+	ctx context.Context, mediaHash types.Base64Hash,
+) (int, error) {
+	return d.statements.media.selectMediaCountByHash(ctx, mediaHash)
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -66,10 +67,15 @@ const selectThumbnailsSQL = `
 SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
 `
 
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+`
+
 type thumbnailStatements struct {
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func (s *thumbnailStatements) prepare(db *sql.DB) (err error) {
@@ -82,6 +88,7 @@ func (s *thumbnailStatements) prepare(db *sql.DB) (err error) {
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.prepare(db)
 }
 
@@ -171,3 +178,10 @@ func (s *thumbnailStatements) selectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) deleteThumbnails(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThumbnailsStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
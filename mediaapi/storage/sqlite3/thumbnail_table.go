@@ -57,12 +57,17 @@ const selectThumbnailsSQL = `
 SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
 `
 
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+`
+
 type thumbnailStatements struct {
 	db                   *sql.DB
 	writer               sqlutil.Writer
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func (s *thumbnailStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -77,6 +82,7 @@ func (s *thumbnailStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err er
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.prepare(db)
 }
 
@@ -169,3 +175,10 @@ func (s *thumbnailStatements) selectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) deleteThumbnails(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThumbnailsStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
@@ -19,9 +19,11 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
 
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -48,6 +50,14 @@ func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
 	))
 }
 
+// GetThumbnailKey returns the media store key of a thumbnail given the key of the src file and thumbnail size configuration
+func GetThumbnailKey(src string, config types.ThumbnailSize) string {
+	return path.Join(
+		path.Dir(src),
+		fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod),
+	)
+}
+
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
 // The algorithm is very similar to what was implemented in Synapse
 // In order of priority unless absolute, the following metrics are compared; the image is:
@@ -133,7 +143,8 @@ func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.Active
 
 func isThumbnailExists(
 	ctx context.Context,
-	dst types.Path,
+	provider mediastore.Provider,
+	dst string,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	db storage.Database,
@@ -152,7 +163,7 @@ func isThumbnailExists(
 	}
 	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
 	// The functions are error checkers to be used in different cases.
-	if _, err = os.Stat(string(dst)); !os.IsNotExist(err) {
+	if _, err = provider.Stat(ctx, dst); !os.IsNotExist(err) {
 		// Thumbnail exists
 		return true, nil
 	}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -31,7 +32,8 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
-	src types.Path,
+	provider mediastore.Provider,
+	key string,
 	configs []config.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -39,6 +41,12 @@ func GenerateThumbnails(
 	db *storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
+	src, cleanup, err := provider.LocalPath(ctx, key)
+	if err != nil {
+		logger.WithError(err).WithField("key", key).Error("Failed to get local copy of src file")
+		return false, err
+	}
+	defer cleanup()
 	buffer, err := bimg.Read(string(src))
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
@@ -48,7 +56,7 @@ func GenerateThumbnails(
 	for _, config := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+			ctx, provider, key, src, img, config, mediaMetadata, activeThumbnailGeneration,
 			maxThumbnailGenerators, db, logger,
 		)
 		if err != nil {
@@ -65,7 +73,8 @@ func GenerateThumbnails(
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
-	src types.Path,
+	provider mediastore.Provider,
+	key string,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -73,6 +82,12 @@ func GenerateThumbnail(
 	db *storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
+	src, cleanup, err := provider.LocalPath(ctx, key)
+	if err != nil {
+		logger.WithError(err).WithField("key", key).Error("Failed to get local copy of src file")
+		return false, err
+	}
+	defer cleanup()
 	buffer, err := bimg.Read(string(src))
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -83,7 +98,7 @@ func GenerateThumbnail(
 	img := bimg.NewImage(buffer)
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+		ctx, provider, key, src, img, config, mediaMetadata, activeThumbnailGeneration,
 		maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
@@ -102,6 +117,8 @@ func GenerateThumbnail(
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
+	provider mediastore.Provider,
+	key string,
 	src types.Path,
 	img *bimg.Image,
 	config types.ThumbnailSize,
@@ -122,10 +139,11 @@ func createThumbnail(
 		return false, nil
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst := GetThumbnailKey(key, config)
+	localDst := GetThumbnailPath(src, config)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
-	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
+	isActive, busy, err := getActiveThumbnailGeneration(types.Path(dst), config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
 	if err != nil {
 		return false, err
 	}
@@ -139,20 +157,20 @@ func createThumbnail(
 		defer func() {
 			// Note: errorReturn is the named return variable so we wrap this in a closure to re-evaluate the arguments at defer-time
 			if err := recover(); err != nil {
-				broadcastGeneration(dst, activeThumbnailGeneration, config, err.(error), logger)
+				broadcastGeneration(types.Path(dst), activeThumbnailGeneration, config, err.(error), logger)
 				panic(err)
 			}
-			broadcastGeneration(dst, activeThumbnailGeneration, config, errorReturn, logger)
+			broadcastGeneration(types.Path(dst), activeThumbnailGeneration, config, errorReturn, logger)
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, provider, dst, config, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	width, height, err := resize(localDst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
 	if err != nil {
 		return false, err
 	}
@@ -162,10 +180,14 @@ func createThumbnail(
 		"processTime":  time.Now().Sub(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	stat, err := os.Stat(string(localDst))
 	if err != nil {
 		return false, err
 	}
+	if err = provider.Store(ctx, localDst, dst); err != nil {
+		logger.WithError(err).Error("Failed to store thumbnail.")
+		return false, err
+	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
@@ -55,9 +55,23 @@ type MediaMetadata struct {
 	ContentType       ContentType
 	FileSizeBytes     FileSizeBytes
 	CreationTimestamp UnixMs
-	UploadName        Filename
-	Base64Hash        Base64Hash
-	UserID            MatrixUserID
+	// When the media was last downloaded, updated no more than once an hour
+	LastAccessTimestamp UnixMs
+	UploadName          Filename
+	Base64Hash          Base64Hash
+	UserID              MatrixUserID
+	// Quarantined media can't be downloaded, but is kept as evidence
+	Quarantined bool
+}
+
+// URLPreview is a cached preview of a URL
+type URLPreview struct {
+	URL string
+	// The preview as returned to clients, i.e. a JSON object of OpenGraph properties
+	Preview           []byte
+	CreationTimestamp UnixMs
+	// The time at which the preview should be fetched again
+	ExpiresTimestamp UnixMs
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -20,6 +20,15 @@ type RoomserverInternalAPI interface {
 		response *InputRoomEventsResponse,
 	)
 
+	// InputRoomEventDryRun runs an event through the checks that InputRoomEvents
+	// would without storing anything, and returns the decisions that were made
+	// along the way. This is used to debug why events were rejected.
+	InputRoomEventDryRun(
+		ctx context.Context,
+		request *InputRoomEventDryRunRequest,
+		response *InputRoomEventDryRunResponse,
+	) error
+
 	PerformInvite(
 		ctx context.Context,
 		req *PerformInviteRequest,
@@ -146,6 +155,22 @@ type RoomserverInternalAPI interface {
 	// QueryCurrentState retrieves the requested state events. If state events are not found, they will be missing from
 	// the response.
 	QueryCurrentState(ctx context.Context, req *QueryCurrentStateRequest, res *QueryCurrentStateResponse) error
+	// QueryNotificationContext returns the room name, sender display name and joined member count needed to
+	// render a notification for an event, based on the current state of the room.
+	QueryNotificationContext(ctx context.Context, req *QueryNotificationContextRequest, res *QueryNotificationContextResponse) error
+	// QueryRoomUsage returns the approximate amount of storage used by a room, or by the rooms using the most storage.
+	QueryRoomUsage(ctx context.Context, req *QueryRoomUsageRequest, res *QueryRoomUsageResponse) error
+	// QueryRoomList returns the rooms that the roomserver knows about, with their versions and member counts.
+	QueryRoomList(ctx context.Context, req *QueryRoomListRequest, res *QueryRoomListResponse) error
+	// QueryRoomThroughput returns the rooms which have received the most events recently.
+	QueryRoomThroughput(ctx context.Context, req *QueryRoomThroughputRequest, res *QueryRoomThroughputResponse) error
+	// QueryEventsBySender returns the events sent by a user across all rooms, most recent first, a page at a time.
+	QueryEventsBySender(ctx context.Context, req *QueryEventsBySenderRequest, res *QueryEventsBySenderResponse) error
+	// QueryRoomDAG returns the events in a range of depths of a room along with how they were stored, for debugging.
+	QueryRoomDAG(ctx context.Context, req *QueryRoomDAGRequest, res *QueryRoomDAGResponse) error
+	// QueryTimestampToEvent returns the nearest event in the timeline of a room to a point in time, and optionally
+	// the state of the room after it. Only events stored since timestamps were recorded can be found.
+	QueryTimestampToEvent(ctx context.Context, req *QueryTimestampToEventRequest, res *QueryTimestampToEventResponse) error
 	// QueryRoomsForUser retrieves a list of room IDs matching the given query.
 	QueryRoomsForUser(ctx context.Context, req *QueryRoomsForUserRequest, res *QueryRoomsForUserResponse) error
 	// QueryBulkStateContent does a bulk query for state event content in the given rooms.
@@ -167,6 +192,19 @@ type RoomserverInternalAPI interface {
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
 
+	// PerformPurgeRoom completely removes a room that no local users are joined to
+	PerformPurgeRoom(ctx context.Context, req *PerformPurgeRoomRequest, resp *PerformPurgeRoomResponse) error
+
+	// PerformRemoveLocalUsers makes all of the local users who are joined or invited to a room leave it,
+	// optionally blocking the room first so that they can't join it again
+	PerformRemoveLocalUsers(ctx context.Context, req *PerformRemoveLocalUsersRequest, resp *PerformRemoveLocalUsersResponse) error
+
+	// PerformBlockRoom blocks or unblocks a room, so that local users can't join or be invited to it
+	PerformBlockRoom(ctx context.Context, req *PerformBlockRoomRequest, resp *PerformBlockRoomResponse) error
+
+	// PerformRoomUpgrade replaces a room with a new room of a different room version
+	PerformRoomUpgrade(ctx context.Context, req *PerformRoomUpgradeRequest, resp *PerformRoomUpgradeResponse) error
+
 	// Asks for the default room version as preferred by the server.
 	QueryRoomVersionCapabilities(
 		ctx context.Context,
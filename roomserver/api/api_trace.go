@@ -33,6 +33,16 @@ func (t *RoomserverInternalAPITrace) InputRoomEvents(
 	util.GetLogger(ctx).Infof("InputRoomEvents req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) InputRoomEventDryRun(
+	ctx context.Context,
+	req *InputRoomEventDryRunRequest,
+	res *InputRoomEventDryRunResponse,
+) error {
+	err := t.Impl.InputRoomEventDryRun(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("InputRoomEventDryRun req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) PerformInvite(
 	ctx context.Context,
 	req *PerformInviteRequest,
@@ -218,6 +228,46 @@ func (t *RoomserverInternalAPITrace) PerformForget(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) PerformPurgeRoom(
+	ctx context.Context,
+	req *PerformPurgeRoomRequest,
+	res *PerformPurgeRoomResponse,
+) error {
+	err := t.Impl.PerformPurgeRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformPurgeRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformRemoveLocalUsers(
+	ctx context.Context,
+	req *PerformRemoveLocalUsersRequest,
+	res *PerformRemoveLocalUsersResponse,
+) error {
+	err := t.Impl.PerformRemoveLocalUsers(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformRemoveLocalUsers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformBlockRoom(
+	ctx context.Context,
+	req *PerformBlockRoomRequest,
+	res *PerformBlockRoomResponse,
+) error {
+	err := t.Impl.PerformBlockRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformBlockRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformRoomUpgrade(
+	ctx context.Context,
+	req *PerformRoomUpgradeRequest,
+	res *PerformRoomUpgradeResponse,
+) error {
+	err := t.Impl.PerformRoomUpgrade(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformRoomUpgrade req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryRoomVersionCapabilities(
 	ctx context.Context,
 	req *QueryRoomVersionCapabilitiesRequest,
@@ -294,6 +344,55 @@ func (t *RoomserverInternalAPITrace) QueryCurrentState(ctx context.Context, req
 	return err
 }
 
+// QueryNotificationContext returns the information needed to render a notification for an event.
+func (t *RoomserverInternalAPITrace) QueryNotificationContext(ctx context.Context, req *QueryNotificationContextRequest, res *QueryNotificationContextResponse) error {
+	err := t.Impl.QueryNotificationContext(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryNotificationContext req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomUsage returns the approximate amount of storage used by rooms.
+func (t *RoomserverInternalAPITrace) QueryRoomUsage(ctx context.Context, req *QueryRoomUsageRequest, res *QueryRoomUsageResponse) error {
+	err := t.Impl.QueryRoomUsage(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomUsage req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomList returns the rooms that the roomserver knows about.
+func (t *RoomserverInternalAPITrace) QueryRoomList(ctx context.Context, req *QueryRoomListRequest, res *QueryRoomListResponse) error {
+	err := t.Impl.QueryRoomList(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomList req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomThroughput returns the rooms which have received the most events recently.
+func (t *RoomserverInternalAPITrace) QueryRoomThroughput(ctx context.Context, req *QueryRoomThroughputRequest, res *QueryRoomThroughputResponse) error {
+	err := t.Impl.QueryRoomThroughput(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomThroughput req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryEventsBySender returns the events sent by a user across all rooms.
+func (t *RoomserverInternalAPITrace) QueryEventsBySender(ctx context.Context, req *QueryEventsBySenderRequest, res *QueryEventsBySenderResponse) error {
+	err := t.Impl.QueryEventsBySender(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventsBySender req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomDAG returns the events in a range of depths of a room.
+func (t *RoomserverInternalAPITrace) QueryRoomDAG(ctx context.Context, req *QueryRoomDAGRequest, res *QueryRoomDAGResponse) error {
+	err := t.Impl.QueryRoomDAG(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomDAG req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryTimestampToEvent returns the nearest event in a room to a point in time.
+func (t *RoomserverInternalAPITrace) QueryTimestampToEvent(ctx context.Context, req *QueryTimestampToEventRequest, res *QueryTimestampToEventResponse) error {
+	err := t.Impl.QueryTimestampToEvent(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryTimestampToEvent req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 // QueryRoomsForUser retrieves a list of room IDs matching the given query.
 func (t *RoomserverInternalAPITrace) QueryRoomsForUser(ctx context.Context, req *QueryRoomsForUserRequest, res *QueryRoomsForUserResponse) error {
 	err := t.Impl.QueryRoomsForUser(ctx, req, res)
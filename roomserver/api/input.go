@@ -17,6 +17,7 @@ package api
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -86,18 +87,30 @@ type TransactionID struct {
 // InputRoomEventsRequest is a request to InputRoomEvents
 type InputRoomEventsRequest struct {
 	InputRoomEvents []InputRoomEvent `json:"input_room_events"`
+	// If true, the events will be rejected rather than queued if the roomserver
+	// already has too many events waiting to be processed. This should be set
+	// for events sent by clients, who can be told to retry later.
+	RejectIfBusy bool `json:"reject_if_busy"`
 }
 
 // InputRoomEventsResponse is a response to InputRoomEvents
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	// Set if the events were rejected because the roomserver was busy, to the
+	// number of milliseconds after which the caller should try again.
+	RetryAfterMS int64
 }
 
 func (r *InputRoomEventsResponse) Err() error {
 	if r.ErrMsg == "" {
 		return nil
 	}
+	if r.RetryAfterMS > 0 {
+		return &ErrRoomserverBusy{
+			RetryAfter: time.Duration(r.RetryAfterMS) * time.Millisecond,
+		}
+	}
 	if r.NotAllowed {
 		return &gomatrixserverlib.NotAllowed{
 			Message: r.ErrMsg,
@@ -105,3 +118,78 @@ func (r *InputRoomEventsResponse) Err() error {
 	}
 	return fmt.Errorf("InputRoomEventsResponse: %s", r.ErrMsg)
 }
+
+// ErrRoomserverBusy is returned when input events were rejected because the
+// roomserver already had too many events waiting to be processed.
+type ErrRoomserverBusy struct {
+	// How long the caller should wait before trying again.
+	RetryAfter time.Duration
+}
+
+func (e *ErrRoomserverBusy) Error() string {
+	return fmt.Sprintf("roomserver is busy, retry after %s", e.RetryAfter)
+}
+
+// The decisions that can be reported by InputRoomEventDryRun.
+const (
+	DryRunAccepted   = "accepted"
+	DryRunRejected   = "rejected"
+	DryRunSoftFailed = "soft_failed"
+)
+
+// The checks that InputRoomEventDryRun runs an event through, in order.
+const (
+	// DryRunStepSignatures checks the signatures on the event.
+	DryRunStepSignatures = "signatures"
+	// DryRunStepAuthEvents checks the event against its auth events. Events
+	// which fail this check are rejected.
+	DryRunStepAuthEvents = "auth_events"
+	// DryRunStepStateBeforeEvent works out the state before the event, either
+	// from the supplied state or by resolving the state at the prev events.
+	DryRunStepStateBeforeEvent = "state_before_event"
+	// DryRunStepAuthStateBeforeEvent checks the event against the state before
+	// the event. This is informational only and doesn't affect the decision.
+	DryRunStepAuthStateBeforeEvent = "auth_state_before_event"
+	// DryRunStepCurrentState checks new events against the current state of
+	// the room. Events which fail this check are soft-failed.
+	DryRunStepCurrentState = "current_state"
+)
+
+// InputRoomEventDryRunRequest is a request to InputRoomEventDryRun
+type InputRoomEventDryRunRequest struct {
+	InputRoomEvent InputRoomEvent `json:"input_room_event"`
+}
+
+// InputRoomEventDryRunResponse is a response to InputRoomEventDryRun
+type InputRoomEventDryRunResponse struct {
+	// Whether the roomserver knows about the room.
+	RoomExists bool `json:"room_exists"`
+	// Whether the event has already been stored.
+	AlreadyExists bool `json:"already_exists"`
+	// The decision that would have been made had the event been input:
+	// one of DryRunAccepted, DryRunRejected or DryRunSoftFailed.
+	Decision string `json:"decision"`
+	// The checks that the event was run through, in order. Checks which
+	// depend on a check that failed are left out.
+	Steps []InputDryRunStep `json:"steps"`
+}
+
+// InputDryRunStep is one of the checks that InputRoomEventDryRun runs an
+// event through, along with what it used to make its decision.
+type InputDryRunStep struct {
+	// One of the DryRunStep constants.
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Why the check failed, such as which auth rule wasn't met.
+	Error string `json:"error,omitempty"`
+	// The events that were used by the check, such as the auth events that
+	// the event was checked against or the prev events that state was
+	// resolved from.
+	EventIDs []string `json:"event_ids,omitempty"`
+	// The numeric IDs of the state snapshots that were used by the check.
+	StateSnapshotNIDs []int64 `json:"state_snapshot_nids,omitempty"`
+	// How the state before the event was worked out, and how many state
+	// keys were in conflict.
+	Algorithm string `json:"algorithm,omitempty"`
+	Conflicts int    `json:"conflicts,omitempty"`
+}
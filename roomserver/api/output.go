@@ -53,6 +53,8 @@ const (
 	OutputTypeNewPeek OutputType = "new_peek"
 	// OutputTypeRetirePeek indicates that the kafka event is an OutputRetirePeek
 	OutputTypeRetirePeek OutputType = "retire_peek"
+	// OutputTypeExpiredEvents indicates that the kafka event is an OutputExpiredEvents
+	OutputTypeExpiredEvents OutputType = "expired_events"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -74,6 +76,8 @@ type OutputEvent struct {
 	NewPeek *OutputNewPeek `json:"new_peek,omitempty"`
 	// The content of event with type OutputTypeRetirePeek
 	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
+	// The content of event with type OutputTypeExpiredEvents
+	ExpiredEvents *OutputExpiredEvents `json:"expired_events,omitempty"`
 }
 
 // Type of the OutputNewRoomEvent.
@@ -251,3 +255,12 @@ type OutputRetirePeek struct {
 	UserID   string
 	DeviceID string
 }
+
+// An OutputExpiredEvents is written when events in an ephemeral room have
+// been pruned by the roomserver because they were older than the TTL of the
+// room. Downstream components must prune their copies of the events using the
+// redaction algorithm so that none of their content is kept.
+type OutputExpiredEvents struct {
+	RoomID   string
+	EventIDs []string
+}
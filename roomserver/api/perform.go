@@ -179,3 +179,51 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformPurgeRoomRequest is a request to PerformPurgeRoom
+type PerformPurgeRoomRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformPurgeRoomResponse struct {
+	// If non-nil, the purge request failed. Contains more information why it failed.
+	Error *PerformError
+}
+
+// PerformRemoveLocalUsersRequest is a request to PerformRemoveLocalUsers
+type PerformRemoveLocalUsersRequest struct {
+	RoomID string `json:"room_id"`
+	// Whether to block the room first, so that the users can't join again.
+	Block bool `json:"block"`
+}
+
+type PerformRemoveLocalUsersResponse struct {
+	// The local users who left the room or whose invites were rejected.
+	RemovedUserIDs []string `json:"removed_user_ids"`
+	// The local users who couldn't be removed from the room.
+	FailedUserIDs []string `json:"failed_user_ids"`
+	// If non-nil, the request failed. Contains more information why it failed.
+	Error *PerformError
+}
+
+// PerformBlockRoomRequest is a request to PerformBlockRoom
+type PerformBlockRoomRequest struct {
+	RoomID  string `json:"room_id"`
+	Blocked bool   `json:"blocked"`
+}
+
+type PerformBlockRoomResponse struct{}
+
+// PerformRoomUpgradeRequest is a request to PerformRoomUpgrade
+type PerformRoomUpgradeRequest struct {
+	RoomID      string                        `json:"room_id"`
+	UserID      string                        `json:"user_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+}
+
+type PerformRoomUpgradeResponse struct {
+	// The ID of the room which replaces the upgraded room.
+	NewRoomID string `json:"new_room_id"`
+	// If non-nil, the upgrade request failed. Contains more information why it failed.
+	Error *PerformError
+}
@@ -108,6 +108,9 @@ type QueryMissingAuthPrevEventsResponse struct {
 type QueryEventsByIDRequest struct {
 	// The event IDs to look up.
 	EventIDs []string `json:"event_ids"`
+	// Whether to also return the full auth chains of the events that were
+	// found, so that callers don't need to walk the chains themselves.
+	IncludeAuthChain bool `json:"include_auth_chain"`
 }
 
 // QueryEventsByIDResponse is a response to QueryEventsByID
@@ -120,6 +123,11 @@ type QueryEventsByIDResponse struct {
 	// the entire request.
 	// This list will be in an arbitrary order.
 	Events []*gomatrixserverlib.HeaderedEvent `json:"events"`
+	// If IncludeAuthChain was set, the events in the auth chains of all of
+	// the returned events. Each event appears once, even if it is in the auth
+	// chain of more than one of the returned events. This list will be in an
+	// arbitrary order.
+	AuthChainEvents []*gomatrixserverlib.HeaderedEvent `json:"auth_chain_events,omitempty"`
 }
 
 // QueryMembershipForUserRequest is a request to QueryMembership
@@ -206,6 +214,8 @@ type QueryMissingEventsRequest struct {
 	LatestEvents []string `json:"latest_events"`
 	// Limit the number of events this query returns.
 	Limit int `json:"limit"`
+	// The minimum depth of events to return.
+	MinDepth int64 `json:"min_depth"`
 	// The server interested in the event
 	ServerName gomatrixserverlib.ServerName `json:"server_name"`
 }
@@ -271,8 +281,12 @@ type QueryPublishedRoomsRequest struct {
 }
 
 type QueryPublishedRoomsResponse struct {
-	// The list of published rooms.
+	// The list of published rooms, ordered by joined member count with the
+	// largest rooms first.
 	RoomIDs []string
+	// The joined member count of each published room. Not populated if
+	// RoomID was specified in the request.
+	JoinedMemberCounts map[string]int
 }
 
 type QueryAuthChainRequest struct {
@@ -336,6 +350,200 @@ type QueryCurrentStateResponse struct {
 	StateEvents map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
 }
 
+type QueryNotificationContextRequest struct {
+	RoomID string `json:"room_id"`
+	// The sender of the event being notified about. If empty then the
+	// sender display name won't be returned.
+	SenderID string `json:"sender_id"`
+}
+
+type QueryNotificationContextResponse struct {
+	// True if the room exists on this server.
+	RoomExists bool `json:"room_exists"`
+	// The m.room.name of the room, or the m.room.canonical_alias if the
+	// room has no name. Empty if the room has neither.
+	RoomName string `json:"room_name"`
+	// The display name from the sender's current m.room.member event, if any.
+	SenderDisplayName string `json:"sender_display_name"`
+	// The number of users that are currently joined to the room.
+	JoinedMemberCount int `json:"joined_member_count"`
+}
+
+type QueryRoomUsageRequest struct {
+	// The room to report on. If empty then the rooms with the most event
+	// JSON stored are returned instead, largest first.
+	RoomID string `json:"room_id"`
+	// The maximum number of rooms to return if no room ID is given.
+	Limit int `json:"limit"`
+}
+
+type QueryRoomUsageResponse struct {
+	// The storage used by each room. Empty if the room ID was given but we
+	// have no usage recorded for the room.
+	Rooms []RoomUsage `json:"rooms"`
+}
+
+type QueryRoomListRequest struct {
+	// The room to report on. If empty then up to Limit rooms are returned
+	// instead, in order of room ID.
+	RoomID string `json:"room_id"`
+	// Only rooms with IDs after this one are returned if no room ID is given.
+	From string `json:"from"`
+	// The maximum number of rooms to return if no room ID is given.
+	Limit int `json:"limit"`
+}
+
+type QueryRoomListResponse struct {
+	// The rooms that the roomserver knows about. Empty if the room ID was
+	// given but the roomserver doesn't know about the room.
+	Rooms []RoomListEntry `json:"rooms"`
+}
+
+// RoomListEntry describes a room that the roomserver knows about, for server
+// administrators.
+type RoomListEntry struct {
+	RoomID      string                        `json:"room_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The m.room.name of the room, if it has one.
+	Name string `json:"name,omitempty"`
+	// The number of users who are joined to the room, from any server.
+	JoinedMembers int `json:"joined_members"`
+	// The number of local users who are joined to the room.
+	JoinedLocalMembers int `json:"joined_local_members"`
+	// Whether the room has been blocked, so that local users can't join it.
+	Blocked bool `json:"blocked"`
+}
+
+// RoomUsage is the approximate amount of storage used by a room. The counts
+// are recorded as events and state snapshots are stored, so they don't take
+// into account redactions or recompression of event JSON after the fact.
+type RoomUsage struct {
+	RoomID string `json:"room_id"`
+	// The number of events stored for the room, including outliers.
+	Events int64 `json:"events"`
+	// The number of bytes of event JSON stored for the room, after compression.
+	EventJSONBytes int64 `json:"event_json_bytes"`
+	// The number of state snapshots stored for the room.
+	StateSnapshots int64 `json:"state_snapshots"`
+	// The number of mxc:// URIs in the content of the events stored for the room.
+	MediaReferences int64 `json:"media_references"`
+}
+
+type QueryRoomThroughputRequest struct {
+	// The number of minutes to count events over, including the current
+	// minute. Zero or anything over an hour means an hour.
+	Minutes int `json:"minutes"`
+	// The maximum number of rooms to return.
+	Limit int `json:"limit"`
+}
+
+type QueryRoomThroughputResponse struct {
+	// The rooms which received the most events, busiest first. Rooms which
+	// didn't receive any events are left out.
+	Rooms []RoomThroughput `json:"rooms"`
+}
+
+// RoomThroughput is the number of events that a room received, whether they
+// were accepted or not. The counts are kept in memory so they start again
+// when the roomserver restarts.
+type RoomThroughput struct {
+	RoomID          string  `json:"room_id"`
+	Events          int64   `json:"events"`
+	EventsPerMinute float64 `json:"events_per_minute"`
+}
+
+type QueryEventsBySenderRequest struct {
+	// The user whose events should be returned.
+	UserID string `json:"user_id"`
+	// Only return events with an origin_server_ts at or after this time, or
+	// all events if zero.
+	Since gomatrixserverlib.Timestamp `json:"since"`
+	// Return events from before this position, which comes from the Next
+	// of a previous response, or the most recent events if zero.
+	From int64 `json:"from"`
+	// The maximum number of events to look at.
+	Limit int `json:"limit"`
+}
+
+type QueryEventsBySenderResponse struct {
+	// The events sent by the user, most recent first. Events which are older
+	// than Since are left out, so there may be fewer than Limit events even
+	// if there are more to come.
+	Events []*gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The position to pass as From to get the next page of events, or zero
+	// if there are no more events.
+	Next int64 `json:"next"`
+}
+
+type QueryRoomDAGRequest struct {
+	// The room to return the events of.
+	RoomID string `json:"room_id"`
+	// Only return events with depths between FromDepth and ToDepth inclusive.
+	// A ToDepth of zero means that there is no upper bound.
+	FromDepth int64 `json:"from_depth"`
+	ToDepth   int64 `json:"to_depth"`
+	// The maximum number of events to return. If there are more events than
+	// this in the range then the deepest events are returned.
+	Limit int `json:"limit"`
+}
+
+type QueryRoomDAGResponse struct {
+	// Whether the roomserver knows about the room.
+	RoomExists bool `json:"room_exists"`
+	// The room version of the room.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version,omitempty"`
+	// The events in the range, in order of depth.
+	Events []RoomDAGEvent `json:"events"`
+	// The IDs of the forward extremities of the room, which may be outside
+	// of the range.
+	ForwardExtremities []string `json:"forward_extremities"`
+	// The numeric ID of the current state snapshot of the room.
+	StateSnapshotNID int64 `json:"state_snapshot_nid"`
+}
+
+// RoomDAGEvent is an event in the DAG of a room, as returned by QueryRoomDAG.
+type RoomDAGEvent struct {
+	EventID    string   `json:"event_id"`
+	Type       string   `json:"type"`
+	StateKey   *string  `json:"state_key,omitempty"`
+	Sender     string   `json:"sender"`
+	Depth      int64    `json:"depth"`
+	PrevEvents []string `json:"prev_events"`
+	AuthEvents []string `json:"auth_events"`
+	// The numeric ID of the state snapshot before the event, or zero if the
+	// event is an outlier and so has no state stored for it.
+	StateSnapshotNID int64 `json:"state_snapshot_nid"`
+	Rejected         bool  `json:"rejected,omitempty"`
+	SoftFailed       bool  `json:"soft_failed,omitempty"`
+	Outlier          bool  `json:"outlier,omitempty"`
+}
+
+type QueryTimestampToEventRequest struct {
+	// The room to find the event in.
+	RoomID string `json:"room_id"`
+	// The point in time to find the nearest event to.
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+	// If true, find the last event sent at or before Timestamp, otherwise
+	// find the first event sent at or after it.
+	Backwards bool `json:"backwards"`
+	// If true, the state after the event is also returned. If StateToFetch
+	// is empty then all of the state is returned.
+	IncludeState bool                              `json:"include_state"`
+	StateToFetch []gomatrixserverlib.StateKeyTuple `json:"state_to_fetch"`
+}
+
+type QueryTimestampToEventResponse struct {
+	// Whether the roomserver knows about the room.
+	RoomExists bool `json:"room_exists"`
+	// The room version of the room.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version,omitempty"`
+	// The nearest event, or empty if there are no events in that direction.
+	EventID        string                      `json:"event_id,omitempty"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts,omitempty"`
+	// The state after the event, if requested.
+	StateEvents []*gomatrixserverlib.HeaderedEvent `json:"state_events,omitempty"`
+}
+
 type QueryKnownUsersRequest struct {
 	UserID       string `json:"user_id"`
 	SearchString string `json:"search_string"`
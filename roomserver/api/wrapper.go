@@ -28,6 +28,30 @@ func SendEvents(
 	kind Kind, events []*gomatrixserverlib.HeaderedEvent,
 	sendAsServer gomatrixserverlib.ServerName, txnID *TransactionID,
 ) error {
+	return SendInputRoomEvents(ctx, rsAPI, newInputRoomEvents(kind, events, sendAsServer, txnID))
+}
+
+// SendEventsUnlessBusy is like SendEvents, but the events are rejected with an
+// *ErrRoomserverBusy rather than queued if the roomserver already has too many
+// events waiting to be processed. It should be used for events sent by clients.
+func SendEventsUnlessBusy(
+	ctx context.Context, rsAPI RoomserverInternalAPI,
+	kind Kind, events []*gomatrixserverlib.HeaderedEvent,
+	sendAsServer gomatrixserverlib.ServerName, txnID *TransactionID,
+) error {
+	request := InputRoomEventsRequest{
+		InputRoomEvents: newInputRoomEvents(kind, events, sendAsServer, txnID),
+		RejectIfBusy:    true,
+	}
+	var response InputRoomEventsResponse
+	rsAPI.InputRoomEvents(ctx, &request, &response)
+	return response.Err()
+}
+
+func newInputRoomEvents(
+	kind Kind, events []*gomatrixserverlib.HeaderedEvent,
+	sendAsServer gomatrixserverlib.ServerName, txnID *TransactionID,
+) []InputRoomEvent {
 	ires := make([]InputRoomEvent, len(events))
 	for i, event := range events {
 		ires[i] = InputRoomEvent{
@@ -38,7 +62,7 @@ func SendEvents(
 			TransactionID: txnID,
 		}
 	}
-	return SendInputRoomEvents(ctx, rsAPI, ires)
+	return ires
 }
 
 // SendEventWithState writes an event with the specified kind to the roomserver
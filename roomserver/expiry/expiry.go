@@ -0,0 +1,104 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expiry
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// MRoomTTL is the type of the state event which makes a room ephemeral. Events
+// in the room which are older than the TTL in the content of the event, which
+// has an empty state key, are pruned so that none of their content is kept.
+// It can be sent at any time, or given in the initial_state of /createRoom.
+const MRoomTTL = "org.matrix.dendrite.room_ttl"
+
+// RoomTTLContent is the content of an MRoomTTL event.
+type RoomTTLContent struct {
+	// The number of milliseconds to keep events for. 0 makes the room
+	// non-ephemeral again.
+	TTL int64 `json:"ttl"`
+}
+
+type RoomExpiryDatabase interface {
+	// GetKnownRooms returns a list of all rooms we know about.
+	GetKnownRooms(ctx context.Context) ([]string, error)
+	// GetStateEvent returns the state event of a given type for a given room with a given state key
+	// If no event could be found, returns nil
+	// If there was an issue during the retrieval, returns an error
+	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error)
+}
+
+// RoomExpiry keeps track of the TTLs of ephemeral rooms.
+type RoomExpiry struct {
+	ttls      map[string]time.Duration // room ID -> TTL
+	ttlsMutex sync.RWMutex             // protects the above
+}
+
+func NewRoomExpiry(db RoomExpiryDatabase) *RoomExpiry {
+	ctx := context.TODO()
+	e := &RoomExpiry{
+		ttls: make(map[string]time.Duration),
+	}
+	rooms, err := db.GetKnownRooms(ctx)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to get known rooms")
+	}
+	for _, room := range rooms {
+		state, err := db.GetStateEvent(ctx, room, MRoomTTL, "")
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get TTL for room %q", room)
+			continue
+		}
+		if state != nil {
+			e.OnRoomTTLUpdate(state.Event)
+		}
+	}
+	return e
+}
+
+// OnRoomTTLUpdate updates the TTL of the room when an MRoomTTL event becomes
+// part of its current state.
+func (e *RoomExpiry) OnRoomTTLUpdate(state *gomatrixserverlib.Event) {
+	var content RoomTTLContent
+	if err := json.Unmarshal(state.Content(), &content); err != nil {
+		// The content may have been removed by a redaction, which makes the
+		// room non-ephemeral again.
+		logrus.WithError(err).Warnf("Failed to unmarshal TTL for room %q", state.RoomID())
+	}
+	e.ttlsMutex.Lock()
+	defer e.ttlsMutex.Unlock()
+	if content.TTL <= 0 {
+		delete(e.ttls, state.RoomID())
+		return
+	}
+	e.ttls[state.RoomID()] = time.Duration(content.TTL) * time.Millisecond
+}
+
+// Rooms returns the TTLs of all of the ephemeral rooms, by room ID.
+func (e *RoomExpiry) Rooms() map[string]time.Duration {
+	e.ttlsMutex.RLock()
+	defer e.ttlsMutex.RUnlock()
+	rooms := make(map[string]time.Duration, len(e.ttls))
+	for roomID, ttl := range e.ttls {
+		rooms[roomID] = ttl
+	}
+	return rooms
+}
@@ -9,12 +9,16 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/expiry"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/perform"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/occupancy"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/throughput"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // RoomserverInternalAPI is an implementation of api.RoomserverInternalAPI
@@ -29,6 +33,9 @@ type RoomserverInternalAPI struct {
 	*perform.Publisher
 	*perform.Backfiller
 	*perform.Forgetter
+	*perform.Purger
+	*perform.Upgrader
+	*perform.Admin
 	DB                     storage.Database
 	Cfg                    *config.RoomServer
 	Producer               sarama.SyncProducer
@@ -47,6 +54,13 @@ func NewRoomserverAPI(
 	keyRing gomatrixserverlib.JSONVerifier, perspectiveServerNames []gomatrixserverlib.ServerName,
 ) *RoomserverInternalAPI {
 	serverACLs := acls.NewServerACLs(roomserverDB)
+	roomOccupancy := occupancy.NewRoomOccupancy(roomserverDB)
+	roomExpiry := expiry.NewRoomExpiry(roomserverDB)
+	roomThroughput := throughput.NewRoomThroughput()
+	contentScanner, err := input.NewContentScanner(&cfg.ContentScanning)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to set up content scanning")
+	}
 	a := &RoomserverInternalAPI{
 		DB:                     roomserverDB,
 		Cfg:                    cfg,
@@ -58,13 +72,22 @@ func NewRoomserverAPI(
 			DB:         roomserverDB,
 			Cache:      caches,
 			ServerACLs: serverACLs,
+			Occupancy:  roomOccupancy,
+			Throughput: roomThroughput,
 		},
 		Inputer: &input.Inputer{
-			DB:                   roomserverDB,
-			OutputRoomEventTopic: outputRoomEventTopic,
-			Producer:             producer,
-			ServerName:           cfg.Matrix.ServerName,
-			ACLs:                 serverACLs,
+			DB:                    roomserverDB,
+			OutputRoomEventTopic:  outputRoomEventTopic,
+			Producer:              producer,
+			ServerName:            cfg.Matrix.ServerName,
+			KeyRing:               keyRing,
+			ACLs:                  serverACLs,
+			Occupancy:             roomOccupancy,
+			Expiry:                roomExpiry,
+			Throughput:            roomThroughput,
+			MaxForwardExtremities: cfg.MaxForwardExtremities,
+			MaxQueuedEvents:       cfg.MaxInputQueueLength,
+			ContentScanner:        contentScanner,
 		},
 		// perform-er structs get initialised when we have a federation sender to use
 	}
@@ -87,6 +110,7 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 		ServerName: r.Cfg.Matrix.ServerName,
 		Cfg:        r.Cfg,
 		DB:         r.DB,
+		Cache:      r.Cache,
 		FSAPI:      r.fsAPI,
 		Inputer:    r.Inputer,
 	}
@@ -111,7 +135,8 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 		Inputer: r.Inputer,
 	}
 	r.Publisher = &perform.Publisher{
-		DB: r.DB,
+		DB:        r.DB,
+		Occupancy: r.Inputer.Occupancy,
 	}
 	r.Backfiller = &perform.Backfiller{
 		ServerName: r.ServerName,
@@ -126,6 +151,21 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 	r.Forgetter = &perform.Forgetter{
 		DB: r.DB,
 	}
+	r.Purger = &perform.Purger{
+		DB: r.DB,
+	}
+	r.Upgrader = &perform.Upgrader{
+		Cfg:       r.Cfg,
+		DB:        r.DB,
+		Inputer:   r.Inputer,
+		Publisher: r.Publisher,
+	}
+	r.Admin = &perform.Admin{
+		Cfg:     r.Cfg,
+		DB:      r.DB,
+		Leaver:  r.Leaver,
+		Inputer: r.Inputer,
+	}
 }
 
 func (r *RoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceQueryAPI) {
@@ -71,23 +71,36 @@ func CheckForSoftFail(
 		return false, nil
 	}
 
-	// Work out which of the state events we actually need.
-	stateNeeded := gomatrixserverlib.StateNeededForAuth([]*gomatrixserverlib.Event{event.Unwrap()})
-
-	// Load the actual auth events from the database.
-	authEvents, err := loadAuthEvents(ctx, db, stateNeeded, authStateEntries)
-	if err != nil {
-		return true, fmt.Errorf("loadAuthEvents: %w", err)
-	}
-
 	// Check if the event is allowed.
-	if err = gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
+	if _, err = CheckAllowedByState(ctx, db, event.Unwrap(), authStateEntries); err != nil {
 		// return true, nil
 		return true, err
 	}
 	return false, nil
 }
 
+// CheckAllowedByState checks that the event passes authentication checks
+// against the supplied room state. Returns the IDs of the state events that
+// the event was checked against, along with an error if the check couldn't
+// be run and a gomatrixserverlib.NotAllowed if the event isn't allowed.
+func CheckAllowedByState(
+	ctx context.Context,
+	db storage.Database,
+	event *gomatrixserverlib.Event,
+	state []types.StateEntry,
+) ([]string, error) {
+	stateNeeded := gomatrixserverlib.StateNeededForAuth([]*gomatrixserverlib.Event{event})
+	authEvents, err := loadAuthEvents(ctx, db, stateNeeded, state)
+	if err != nil {
+		return nil, fmt.Errorf("loadAuthEvents: %w", err)
+	}
+	authEventIDs := make([]string, len(authEvents.events))
+	for i := range authEvents.events {
+		authEventIDs[i] = authEvents.events[i].EventID()
+	}
+	return authEventIDs, gomatrixserverlib.Allowed(event, &authEvents)
+}
+
 // CheckAuthEvents checks that the event passes authentication checks
 // Returns the numeric IDs for the auth events.
 func CheckAuthEvents(
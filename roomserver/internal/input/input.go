@@ -18,6 +18,8 @@ package input
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -25,27 +27,45 @@ import (
 	"github.com/matrix-org/dendrite/internal/hooks"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/expiry"
+	"github.com/matrix-org/dendrite/roomserver/occupancy"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/throughput"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
 )
 
 type Inputer struct {
-	DB                   storage.Database
-	Producer             sarama.SyncProducer
-	ServerName           gomatrixserverlib.ServerName
-	ACLs                 *acls.ServerACLs
-	OutputRoomEventTopic string
+	DB                    storage.Database
+	Producer              sarama.SyncProducer
+	ServerName            gomatrixserverlib.ServerName
+	KeyRing               gomatrixserverlib.JSONVerifier // used by InputRoomEventDryRun, may be nil
+	ACLs                  *acls.ServerACLs
+	Occupancy             *occupancy.RoomOccupancy
+	Expiry                *expiry.RoomExpiry
+	Throughput            *throughput.RoomThroughput // may be nil
+	OutputRoomEventTopic  string
+	MaxForwardExtremities int             // 0 means no limit
+	MaxQueuedEvents       int             // 0 means no limit
+	ContentScanner        *ContentScanner // may be nil
 
-	workers sync.Map // room ID -> *inputWorker
+	workers sync.Map     // room ID -> *inputWorker
+	queued  atomic.Int64 // number of tasks waiting for or being processed by workers
 }
 
+// maxInputRetryAfter is the longest that callers will be told to wait before
+// retrying when the roomserver is busy.
+const maxInputRetryAfter = time.Second * 30
+
 type inputTask struct {
-	ctx   context.Context
-	event *api.InputRoomEvent
-	wg    *sync.WaitGroup
-	err   error // written back by worker, only safe to read when all tasks are done
+	ctx       context.Context
+	event     *api.InputRoomEvent
+	journalID int64
+	scan      *contentScanResult // nil if the content wasn't scanned
+	wg        *sync.WaitGroup
+	err       error // written back by worker, only safe to read when all tasks are done
 }
 
 type inputWorker struct {
@@ -61,10 +81,24 @@ func (w *inputWorker) start() {
 		select {
 		case task := <-w.input:
 			hooks.Run(hooks.KindNewEventReceived, task.event.Event)
-			_, task.err = w.r.processRoomEvent(task.ctx, task.event)
+			if w.r.Throughput != nil {
+				w.r.Throughput.OnEvent(task.event.Event.RoomID())
+			}
+			_, task.err = w.r.processRoomEvent(task.ctx, task.event, task.scan)
 			if task.err == nil {
 				hooks.Run(hooks.KindNewEventPersisted, task.event.Event)
 			}
+			if errors.Is(task.err, shared.ErrLatestEventsLockTimeout) {
+				// The event was stored but never made it into the latest events
+				// or the output log. Leave it in the journal so that it is
+				// processed again when the journal is next replayed.
+				log.WithError(task.err).WithField("event_id", task.event.Event.EventID()).Warn("Keeping input event in the journal to be retried")
+			} else if err := w.r.DB.ForgetJournalledInput(task.ctx, task.journalID); err != nil {
+				// The event has been dealt with one way or the other, so it doesn't
+				// need to be processed again if the roomserver restarts.
+				log.WithError(err).WithField("event_id", task.event.Event.EventID()).Error("Failed to remove input event from the journal")
+			}
+			w.r.queued.Dec()
 			task.wg.Done()
 		case <-time.After(time.Second * 5):
 			return
@@ -97,6 +131,10 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 				ev := updates[i].NewRoomEvent.Event.Unwrap()
 				defer r.ACLs.OnServerACLUpdate(ev)
 			}
+			if updates[i].NewRoomEvent.Event.Type() == expiry.MRoomTTL && updates[i].NewRoomEvent.Event.StateKeyEquals("") {
+				ev := updates[i].NewRoomEvent.Event.Unwrap()
+				defer r.Expiry.OnRoomTTLUpdate(ev)
+			}
 		}
 		logger.Infof("Producing to topic '%s'", r.OutputRoomEventTopic)
 		messages[i] = &sarama.ProducerMessage{
@@ -120,14 +158,80 @@ func (r *Inputer) InputRoomEvents(
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) {
+	// If the caller would rather be told to come back later than wait behind
+	// a long queue of events, check that there's room for these ones first.
+	// This is only a guide, so it doesn't matter if other requests add to the
+	// queue at the same time.
+	if request.RejectIfBusy && r.MaxQueuedEvents > 0 {
+		queued := r.queued.Load()
+		if queued+int64(len(request.InputRoomEvents)) > int64(r.MaxQueuedEvents) {
+			// The further over the limit we are, the longer it will take to catch up.
+			retryAfter := time.Duration(queued) * time.Second / time.Duration(r.MaxQueuedEvents)
+			if retryAfter < time.Second {
+				retryAfter = time.Second
+			} else if retryAfter > maxInputRetryAfter {
+				retryAfter = maxInputRetryAfter
+			}
+			log.WithFields(log.Fields{
+				"queued":      queued,
+				"events":      len(request.InputRoomEvents),
+				"retry_after": retryAfter,
+			}).Warn("Rejecting input events as the roomserver is busy")
+			response.ErrMsg = "the roomserver has too many events waiting to be processed"
+			response.RetryAfterMS = retryAfter.Milliseconds()
+			return
+		}
+	}
+
+	// Journal the events before accepting them, so that they will still be
+	// processed if the roomserver stops before it gets to them.
+	inputJSON := make([][]byte, len(request.InputRoomEvents))
+	for i := range request.InputRoomEvents {
+		var err error
+		if inputJSON[i], err = json.Marshal(request.InputRoomEvents[i]); err != nil {
+			response.ErrMsg = err.Error()
+			return
+		}
+	}
+	journalIDs, err := r.DB.JournalInputEvents(context.Background(), inputJSON)
+	if err != nil {
+		log.WithError(err).Error("Failed to journal input events")
+		response.ErrMsg = err.Error()
+		return
+	}
+
+	tasks := r.processInputEvents(request.InputRoomEvents, journalIDs)
+
+	// If any of the tasks returned an error, we should probably report
+	// that back to the caller.
+	for _, task := range tasks {
+		if task.err != nil {
+			response.ErrMsg = task.err.Error()
+			if notAllowed, ok := task.err.(*gomatrixserverlib.NotAllowed); ok {
+				// Err() wraps the message in a NotAllowed again, so don't
+				// include the prefix that NotAllowed adds to it twice.
+				response.ErrMsg = notAllowed.Message
+				response.NotAllowed = true
+			}
+			return
+		}
+	}
+}
+
+// processInputEvents hands the input events to the workers for their rooms,
+// and waits until they have all been processed.
+func (r *Inputer) processInputEvents(events []api.InputRoomEvent, journalIDs []int64) []*inputTask {
 	// Create a wait group. Each task that we dispatch will call Done on
 	// this wait group so that we know when all of our events have been
 	// processed.
 	wg := &sync.WaitGroup{}
-	wg.Add(len(request.InputRoomEvents))
-	tasks := make([]*inputTask, len(request.InputRoomEvents))
+	wg.Add(len(events))
+	tasks := make([]*inputTask, len(events))
+
+	// Scan the content of the events up front, rather than in the workers.
+	scans := r.scanInputEvents(events)
 
-	for i, e := range request.InputRoomEvents {
+	for i, e := range events {
 		// Work out if we are running per-room workers or if we're just doing
 		// it on a global basis (e.g. SQLite).
 		roomID := "global"
@@ -148,29 +252,59 @@ func (r *Inputer) InputRoomEvents(
 		// the wait group, so that the worker can notify us when this specific
 		// task has been finished.
 		tasks[i] = &inputTask{
-			ctx:   context.Background(),
-			event: &request.InputRoomEvents[i],
-			wg:    wg,
+			ctx:       context.Background(),
+			event:     &events[i],
+			journalID: journalIDs[i],
+			scan:      scans[i],
+			wg:        wg,
 		}
 
 		// Send the task to the worker.
 		if worker.running.CAS(false, true) {
 			go worker.start()
 		}
+		r.queued.Inc()
 		worker.input <- tasks[i]
 	}
 
 	// Wait for all of the workers to return results about our tasks.
 	wg.Wait()
 
-	// If any of the tasks returned an error, we should probably report
-	// that back to the caller.
-	for _, task := range tasks {
+	return tasks
+}
+
+// ReplayJournal processes any input events which were accepted but not
+// processed before the roomserver last stopped. It should be called on
+// startup, before any new input events are accepted.
+func (r *Inputer) ReplayJournal(ctx context.Context) error {
+	journalled, err := r.DB.JournalledInputs(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.JournalledInputs: %w", err)
+	}
+	if len(journalled) == 0 {
+		return nil
+	}
+	log.WithField("events", len(journalled)).Info("Replaying input events which were interrupted")
+	events := make([]api.InputRoomEvent, 0, len(journalled))
+	journalIDs := make([]int64, 0, len(journalled))
+	for _, input := range journalled {
+		var event api.InputRoomEvent
+		if err = json.Unmarshal(input.InputJSON, &event); err != nil {
+			// There's no way that this event will ever be processed, so
+			// don't try again next time.
+			log.WithError(err).WithField("journal_id", input.ID).Error("Failed to unmarshal journalled input event")
+			if err = r.DB.ForgetJournalledInput(ctx, input.ID); err != nil {
+				return fmt.Errorf("r.DB.ForgetJournalledInput: %w", err)
+			}
+			continue
+		}
+		events = append(events, event)
+		journalIDs = append(journalIDs, input.ID)
+	}
+	for _, task := range r.processInputEvents(events, journalIDs) {
 		if task.err != nil {
-			response.ErrMsg = task.err.Error()
-			_, rejected := task.err.(*gomatrixserverlib.NotAllowed)
-			response.NotAllowed = rejected
-			return
+			log.WithError(task.err).WithField("event_id", task.event.Event.EventID()).Warn("Failed to process journalled input event")
 		}
 	}
+	return nil
 }
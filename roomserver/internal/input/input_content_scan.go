@@ -0,0 +1,255 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// contentScanActionAllow is returned by the scanner for messages which passed.
+const contentScanActionAllow config.ContentScanAction = "allow"
+
+// linkRegexp matches http(s) URLs and mxc:// links in message content.
+var linkRegexp = regexp.MustCompile(`(?i)\b(?:https?|mxc)://[^\s"'<>]+`)
+
+// contentScanResults counts the messages which were scanned, by the action
+// that was taken.
+var contentScanResults = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "content_scan_results",
+		Help:      "The number of messages which were scanned, by the action that was taken",
+	},
+	[]string{"action"},
+)
+
+func init() {
+	prometheus.MustRegister(contentScanResults)
+}
+
+// ContentScanner checks the content of messages against the denylists in
+// the config, and optionally an external scanner, before they are accepted.
+type ContentScanner struct {
+	cfg        *config.ContentScanning
+	eventTypes map[string]bool
+	denyURLs   []*regexp.Regexp
+	denyText   []*regexp.Regexp
+	client     *http.Client
+}
+
+// contentScanRequest is the body POSTed to the external scanner.
+type contentScanRequest struct {
+	Event json.RawMessage `json:"event"`
+}
+
+// contentScanResponse is the reply from the external scanner.
+type contentScanResponse struct {
+	Action config.ContentScanAction `json:"action"`
+	Reason string                   `json:"reason"`
+}
+
+// NewContentScanner returns a content scanner for the config, or nil if
+// content scanning isn't enabled. The config should already have been
+// verified.
+func NewContentScanner(cfg *config.ContentScanning) (*ContentScanner, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	s := &ContentScanner{
+		cfg:        cfg,
+		eventTypes: make(map[string]bool, len(cfg.EventTypes)),
+		client: &http.Client{
+			Timeout: time.Duration(cfg.ScannerTimeoutMS) * time.Millisecond,
+		},
+	}
+	for _, eventType := range cfg.EventTypes {
+		s.eventTypes[eventType] = true
+	}
+	var err error
+	if s.denyURLs, err = compileRegexps(cfg.DenylistURLs); err != nil {
+		return nil, err
+	}
+	if s.denyText, err = compileRegexps(cfg.DenylistPatterns); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func compileRegexps(patterns []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile(%q): %w", pattern, err)
+		}
+		regexps[i] = re
+	}
+	return regexps, nil
+}
+
+// contentScanResult is the outcome of scanning the content of an input event.
+type contentScanResult struct {
+	action config.ContentScanAction
+	reason string
+}
+
+// scanInputEvents scans the content of new events before they are handed to
+// the workers, so that waiting for the external scanner only holds up the
+// caller that sent them, rather than every event queued behind them for the
+// room, or for all rooms when there is a single worker. The events are
+// scanned at the same time. The result is nil for events that weren't scanned.
+func (r *Inputer) scanInputEvents(events []api.InputRoomEvent) []*contentScanResult {
+	results := make([]*contentScanResult, len(events))
+	if r.ContentScanner == nil {
+		return results
+	}
+	var wg sync.WaitGroup
+	for i := range events {
+		if events[i].Kind != api.KindNew {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			action, reason := r.ContentScanner.Scan(context.Background(), events[i].Event.Unwrap())
+			results[i] = &contentScanResult{action: action, reason: reason}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// Scan returns the action to take for the event and the reason for it.
+// Events which aren't scanned are always allowed.
+func (s *ContentScanner) Scan(ctx context.Context, event *gomatrixserverlib.Event) (config.ContentScanAction, string) {
+	if !s.eventTypes[event.Type()] || event.StateKey() != nil {
+		return contentScanActionAllow, ""
+	}
+	action, reason := s.scan(ctx, event)
+	contentScanResults.WithLabelValues(string(action)).Inc()
+	if action != contentScanActionAllow {
+		util.GetLogger(ctx).WithFields(logrus.Fields{
+			"event_id": event.EventID(),
+			"room_id":  event.RoomID(),
+			"sender":   event.Sender(),
+			"action":   action,
+			"reason":   reason,
+		}).Warn("Message failed content scanning")
+	}
+	return action, reason
+}
+
+func (s *ContentScanner) scan(ctx context.Context, event *gomatrixserverlib.Event) (config.ContentScanAction, string) {
+	if reason := s.checkDenylists(event.Content()); reason != "" {
+		return s.cfg.Action, reason
+	}
+	if s.cfg.ScannerURL == "" {
+		return contentScanActionAllow, ""
+	}
+	res, err := s.callScanner(ctx, event)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("event_id", event.EventID()).Error("Failed to scan message content")
+		if s.cfg.RejectOnScannerError {
+			return config.ContentScanActionReject, "the content scanner is unavailable"
+		}
+		return contentScanActionAllow, ""
+	}
+	return res.Action, res.Reason
+}
+
+// checkDenylists returns why the content matched the denylists, or an empty
+// string if it didn't. Every string in the content is checked, so that links
+// in formatted bodies and the URLs of media are included.
+func (s *ContentScanner) checkDenylists(content []byte) (reason string) {
+	var check func(value gjson.Result) bool
+	check = func(value gjson.Result) bool {
+		if value.IsObject() || value.IsArray() {
+			value.ForEach(func(_, child gjson.Result) bool {
+				return check(child)
+			})
+			return reason == ""
+		}
+		if value.Type != gjson.String {
+			return true
+		}
+		for _, re := range s.denyText {
+			if re.MatchString(value.Str) {
+				reason = "message matches a denylisted pattern"
+				return false
+			}
+		}
+		if len(s.denyURLs) == 0 {
+			return true
+		}
+		for _, link := range linkRegexp.FindAllString(value.Str, -1) {
+			for _, re := range s.denyURLs {
+				if re.MatchString(link) {
+					reason = fmt.Sprintf("message links to denylisted URL %q", link)
+					return false
+				}
+			}
+		}
+		return true
+	}
+	check(gjson.ParseBytes(content))
+	return reason
+}
+
+// callScanner POSTs the event to the external scanner and returns its reply.
+func (s *ContentScanner) callScanner(ctx context.Context, event *gomatrixserverlib.Event) (*contentScanResponse, error) {
+	body, err := json.Marshal(contentScanRequest{Event: event.JSON()})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.ScannerURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s.client.Do: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scanner replied with HTTP %d", resp.StatusCode)
+	}
+	var res contentScanResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("json.Decode: %w", err)
+	}
+	switch res.Action {
+	case contentScanActionAllow, config.ContentScanActionFlag, config.ContentScanActionReject:
+	default:
+		return nil, fmt.Errorf("scanner replied with unknown action %q", res.Action)
+	}
+	return &res, nil
+}
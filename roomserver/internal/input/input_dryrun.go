@@ -0,0 +1,164 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// InputRoomEventDryRun implements api.RoomserverInternalAPI. It follows the
+// same path through the checks as processRoomEvent, but reads from the
+// database only, so that it can be run at any time without going through the
+// room's input worker.
+func (r *Inputer) InputRoomEventDryRun(
+	ctx context.Context,
+	request *api.InputRoomEventDryRunRequest,
+	response *api.InputRoomEventDryRunResponse,
+) error {
+	input := &request.InputRoomEvent
+	if input.Event == nil {
+		return fmt.Errorf("no event supplied")
+	}
+	headered := input.Event
+	event := headered.Unwrap()
+
+	roomInfo, err := r.DB.RoomInfo(ctx, event.RoomID())
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	response.RoomExists = roomInfo != nil && !roomInfo.IsStub
+	eventNIDs, err := r.DB.EventNIDs(ctx, []string{event.EventID()})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventNIDs: %w", err)
+	}
+	_, response.AlreadyExists = eventNIDs[event.EventID()]
+
+	isRejected, softfail := false, false
+	defer func() {
+		switch {
+		case isRejected:
+			response.Decision = api.DryRunRejected
+		case softfail:
+			response.Decision = api.DryRunSoftFailed
+		default:
+			response.Decision = api.DryRunAccepted
+		}
+	}()
+
+	// The federation API checks signatures before events reach us, so we only
+	// do so here if we have a key ring to check them with.
+	if r.KeyRing != nil {
+		step := api.InputDryRunStep{Name: api.DryRunStepSignatures, Passed: true}
+		if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []*gomatrixserverlib.Event{event}, r.KeyRing); err != nil {
+			step.Passed, step.Error = false, err.Error()
+			isRejected = true
+		}
+		response.Steps = append(response.Steps, step)
+	}
+
+	// Check the event against the auth events that were supplied with it.
+	step := api.InputDryRunStep{Name: api.DryRunStepAuthEvents, EventIDs: input.AuthEventIDs}
+	authStateEntries, err := r.DB.StateEntriesForEventIDs(ctx, input.AuthEventIDs)
+	if err == nil {
+		authStateEntries = types.DeduplicateStateEntries(authStateEntries)
+		_, err = helpers.CheckAllowedByState(ctx, r.DB, event, authStateEntries)
+	}
+	if err != nil {
+		step.Error = err.Error()
+		isRejected = true
+	}
+	step.Passed = err == nil
+	response.Steps = append(response.Steps, step)
+
+	// Outliers are stored without state, so there's nothing more to check.
+	if input.Kind == api.KindOutlier {
+		return nil
+	}
+
+	// Work out the state before the event, either from the state that was
+	// supplied with it or from the state at its prev events.
+	resolutionInfo := types.RoomInfo{RoomVersion: headered.RoomVersion}
+	if roomInfo != nil {
+		resolutionInfo = *roomInfo
+	}
+	var stateBeforeEvent []types.StateEntry
+	step = api.InputDryRunStep{Name: api.DryRunStepStateBeforeEvent}
+	if input.HasState && !isRejected {
+		step.Algorithm = "supplied_state"
+		step.EventIDs = input.StateEventIDs
+		stateBeforeEvent, err = r.DB.StateEntriesForEventIDs(ctx, input.StateEventIDs)
+		stateBeforeEvent = types.DeduplicateStateEntries(stateBeforeEvent)
+	} else {
+		var prevStates []types.StateAtEvent
+		step.EventIDs = event.PrevEventIDs()
+		prevStates, stateBeforeEvent, step.Algorithm, step.Conflicts, err =
+			state.NewStateResolution(r.DB, resolutionInfo).CalculateStateBeforeEvent(ctx, event)
+		for _, prevState := range prevStates {
+			step.StateSnapshotNIDs = append(step.StateSnapshotNIDs, int64(prevState.BeforeStateSnapshotNID))
+		}
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	step.Passed = err == nil
+	response.Steps = append(response.Steps, step)
+
+	// Check the event against the state before it. We don't reject events
+	// which fail this yet, but it's often the reason that other servers did.
+	if step.Passed {
+		step = api.InputDryRunStep{Name: api.DryRunStepAuthStateBeforeEvent, Passed: true}
+		if step.EventIDs, err = helpers.CheckAllowedByState(ctx, r.DB, event, stateBeforeEvent); err != nil {
+			step.Passed, step.Error = false, err.Error()
+		}
+		response.Steps = append(response.Steps, step)
+	}
+
+	// New events are soft-failed if they aren't allowed by the current state
+	// of the room, in the same way as helpers.CheckForSoftFail.
+	if input.Kind == api.KindNew {
+		step = api.InputDryRunStep{Name: api.DryRunStepCurrentState, Passed: true}
+		var currentState []types.StateEntry
+		switch {
+		case len(input.StateEventIDs) > 1:
+			step.Algorithm = "supplied_state"
+			currentState, err = r.DB.StateEntriesForEventIDs(ctx, input.StateEventIDs)
+			currentState = types.DeduplicateStateEntries(currentState)
+		case response.RoomExists:
+			step.StateSnapshotNIDs = []int64{int64(roomInfo.StateSnapshotNID)}
+			currentState, err = state.NewStateResolution(r.DB, *roomInfo).LoadStateAtSnapshot(ctx, roomInfo.StateSnapshotNID)
+		default:
+			// We don't have any state for the room yet, so nothing is
+			// soft-failed.
+			response.Steps = append(response.Steps, step)
+			return nil
+		}
+		if err == nil && (len(currentState) > 0 || event.Type() != gomatrixserverlib.MRoomCreate) {
+			step.EventIDs, err = helpers.CheckAllowedByState(ctx, r.DB, event, currentState)
+		}
+		if err != nil {
+			step.Passed, step.Error = false, err.Error()
+			softfail = true
+		}
+		response.Steps = append(response.Steps, step)
+	}
+	return nil
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
@@ -41,16 +42,18 @@ import (
 func (r *Inputer) processRoomEvent(
 	ctx context.Context,
 	input *api.InputRoomEvent,
+	scan *contentScanResult,
 ) (eventID string, err error) {
 	// Parse and validate the event JSON
 	headered := input.Event
 	event := headered.Unwrap()
 
 	// if we have already got this event then do not process it again, if the input kind is an outlier.
-	// Outliers contain no extra information which may warrant a re-processing.
+	// Outliers contain no extra information which may warrant a re-processing, unless they were rejected,
+	// which may have been because they arrived before their auth events.
 	if input.Kind == api.KindOutlier {
 		evs, err2 := r.DB.EventsFromIDs(ctx, []string{event.EventID()})
-		if err2 == nil && len(evs) == 1 {
+		if err2 == nil && len(evs) == 1 && !r.isRejected(ctx, event) {
 			// check hash matches if we're on early room versions where the event ID was a random string
 			idFormat, err2 := headered.RoomVersion.EventIDFormat()
 			if err2 == nil {
@@ -103,8 +106,35 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// Outliers are stored without any associated state and we don't need to
+	// notify anyone about them, so we can stop once the event itself is stored.
+	if input.Kind == api.KindOutlier {
+		if _, err = r.DB.StoreEventAsOutlier(ctx, event, authEventNIDs, isRejected); err != nil {
+			return "", fmt.Errorf("r.DB.StoreEventAsOutlier: %w", err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"event_id": event.EventID(),
+			"type":     event.Type(),
+			"room":     event.RoomID(),
+			"sender":   event.Sender(),
+			"rejected": isRejected,
+		}).Debug("Stored outlier")
+		return event.EventID(), nil
+	}
+
+	// The content of new messages was scanned before they were queued. Messages
+	// from local users which are rejected aren't stored at all, so that the
+	// sender finds out, but those from other servers are soft-failed, as they
+	// may be needed later on to fill in the room DAG.
+	if !isRejected && !softfail && scan != nil && scan.action == config.ContentScanActionReject {
+		if _, domain, err2 := gomatrixserverlib.SplitID('@', event.Sender()); err2 == nil && domain == r.ServerName {
+			return "", &gomatrixserverlib.NotAllowed{Message: scan.reason}
+		}
+		softfail = true
+	}
+
 	// Store the event.
-	_, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected)
+	_, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected, softfail)
 	if err != nil {
 		return "", fmt.Errorf("r.DB.StoreEvent: %w", err)
 	}
@@ -118,19 +148,6 @@ func (r *Inputer) processRoomEvent(
 		event = r
 	}
 
-	// For outliers we can stop after we've stored the event itself as it
-	// doesn't have any associated state to store and we don't need to
-	// notify anyone about it.
-	if input.Kind == api.KindOutlier {
-		logrus.WithFields(logrus.Fields{
-			"event_id": event.EventID(),
-			"type":     event.Type(),
-			"room":     event.RoomID(),
-			"sender":   event.Sender(),
-		}).Debug("Stored outlier")
-		return event.EventID(), nil
-	}
-
 	roomInfo, err := r.DB.RoomInfo(ctx, event.RoomID())
 	if err != nil {
 		return "", fmt.Errorf("r.DB.RoomInfo: %w", err)
@@ -173,6 +190,11 @@ func (r *Inputer) processRoomEvent(
 		); err != nil {
 			return "", fmt.Errorf("r.updateLatestEvents: %w", err)
 		}
+		// The membership changes have been committed by now, so the joined
+		// member count of the room can be refreshed.
+		if event.Type() == gomatrixserverlib.MRoomMember {
+			r.Occupancy.OnMembershipUpdate(event.RoomID())
+		}
 	case api.KindOld:
 		err = r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
 			{
@@ -210,6 +232,16 @@ func (r *Inputer) processRoomEvent(
 	return event.EventID(), nil
 }
 
+// isRejected returns whether an event that we have already stored was rejected.
+func (r *Inputer) isRejected(ctx context.Context, event *gomatrixserverlib.Event) bool {
+	roomInfo, err := r.DB.RoomInfo(ctx, event.RoomID())
+	if err != nil || roomInfo == nil {
+		return false
+	}
+	rejected, err := r.DB.IsEventRejected(ctx, roomInfo.RoomNID, event.EventID())
+	return err == nil && rejected
+}
+
 func (r *Inputer) calculateAndSetState(
 	ctx context.Context,
 	input *api.InputRoomEvent,
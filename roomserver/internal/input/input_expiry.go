@@ -0,0 +1,88 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// How often to look for events in ephemeral rooms which have expired.
+const expireEventsInterval = time.Minute
+
+// The number of events to expire at a time, so that we don't hold the
+// database writer for too long.
+const expireEventsBatchSize = 100
+
+// ExpireEvents prunes the events in ephemeral rooms which are older than the
+// TTL of the room, and tells downstream components to prune them too. Returns
+// the number of events that were pruned.
+func (r *Inputer) ExpireEvents(ctx context.Context, now time.Time) (int, error) {
+	expired := 0
+	for roomID, ttl := range r.Expiry.Rooms() {
+		roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return expired, fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		if roomInfo == nil || roomInfo.IsStub {
+			continue
+		}
+		before := gomatrixserverlib.AsTimestamp(now.Add(-ttl))
+		for {
+			eventIDs, err := r.DB.ExpireEvents(ctx, *roomInfo, before, expireEventsBatchSize)
+			if err != nil {
+				return expired, fmt.Errorf("r.DB.ExpireEvents: %w", err)
+			}
+			if len(eventIDs) > 0 {
+				if err = r.WriteOutputEvents(roomID, []api.OutputEvent{
+					{
+						Type: api.OutputTypeExpiredEvents,
+						ExpiredEvents: &api.OutputExpiredEvents{
+							RoomID:   roomID,
+							EventIDs: eventIDs,
+						},
+					},
+				}); err != nil {
+					return expired, fmt.Errorf("r.WriteOutputEvents: %w", err)
+				}
+			}
+			expired += len(eventIDs)
+			if len(eventIDs) < expireEventsBatchSize {
+				break
+			}
+		}
+	}
+	return expired, nil
+}
+
+// RunEventExpiry periodically expires the events in ephemeral rooms. It never
+// returns.
+func (r *Inputer) RunEventExpiry() {
+	for {
+		expired, err := r.ExpireEvents(context.Background(), time.Now())
+		if err != nil {
+			logrus.WithError(err).Error("Failed to expire events in ephemeral rooms")
+		}
+		if expired > 0 {
+			logrus.WithField("events", expired).Info("Expired events in ephemeral rooms")
+		}
+		time.Sleep(expireEventsInterval)
+	}
+}
@@ -18,7 +18,9 @@ package input
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -27,6 +29,8 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 // updateLatestEvents updates the list of latest events for this room in the database and writes the
@@ -46,6 +50,13 @@ import (
 //      7 <----- latest
 //
 // Can only be called once at a time
+//
+// The new forward extremities and state are worked out before the lock on the
+// room's latest events is taken, as state resolution can take a long time and
+// nothing else can update the room while the lock is held. If the latest
+// events have changed by the time that the lock is taken then the work is
+// repeated, up to maxLatestEventsAttempts times, after which it is done while
+// holding the lock so that the event is always processed.
 func (r *Inputer) updateLatestEvents(
 	ctx context.Context,
 	roomInfo *types.RoomInfo,
@@ -55,17 +66,9 @@ func (r *Inputer) updateLatestEvents(
 	transactionID *api.TransactionID,
 	rewritesState bool,
 ) (err error) {
-	updater, err := r.DB.GetLatestEventsForUpdate(ctx, *roomInfo)
-	if err != nil {
-		return fmt.Errorf("r.DB.GetLatestEventsForUpdate: %w", err)
-	}
-	succeeded := false
-	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
-
 	u := latestEventsUpdater{
 		ctx:           ctx,
 		api:           r,
-		updater:       updater,
 		roomInfo:      roomInfo,
 		stateAtEvent:  stateAtEvent,
 		event:         event,
@@ -74,12 +77,126 @@ func (r *Inputer) updateLatestEvents(
 		rewritesState: rewritesState,
 	}
 
+	// If the event has already been written to the output log then we
+	// don't need to do anything, as we've handled it already. This is
+	// checked again once the lock is held, but checking here first means
+	// that we don't work out the new state for nothing.
+	var hasBeenSent bool
+	if hasBeenSent, err = r.DB.HasEventBeenSent(ctx, stateAtEvent.EventNID); err != nil {
+		return fmt.Errorf("r.DB.HasEventBeenSent: %w", err)
+	} else if hasBeenSent {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		// If we are doing a regular event update then we will get the
+		// previous latest events to use as a part of the calculation. If
+		// we are overwriting the latest events because we have a complete
+		// state snapshot from somewhere else, e.g. a federated room join,
+		// then start with an empty set - none of the forward extremities
+		// that we knew about before matter anymore.
+		u.oldLatest, u.oldStateNID = []types.StateAtEventAndReference{}, 0
+		if !rewritesState {
+			if u.oldLatest, u.oldStateNID, err = r.DB.LatestEvents(ctx, roomInfo.RoomNID); err != nil {
+				return fmt.Errorf("r.DB.LatestEvents: %w", err)
+			}
+		}
+		if err = u.calculateLatestAndState(); err != nil {
+			return err
+		}
+
+		var retry bool
+		retry, err = u.commitLatestEvents(attempt < maxLatestEventsAttempts)
+		switch {
+		case errors.Is(err, shared.ErrLatestEventsLockTimeout) && attempt < maxLatestEventsAttempts:
+			// The event has already been stored, so if we give up now then
+			// it never becomes a forward extremity. Whatever is holding the
+			// lock has probably changed the latest events too, so start again.
+			util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+				"room_id":  event.RoomID(),
+				"event_id": event.EventID(),
+				"attempt":  attempt,
+			}).Warn("Timed out waiting for the latest events lock, retrying")
+			continue
+		case err != nil:
+			return err
+		case !retry:
+			return nil
+		}
+		latestEventsConflicts.Inc()
+		util.GetLogger(ctx).WithFields(logrus.Fields{
+			"room_id":  event.RoomID(),
+			"event_id": event.EventID(),
+			"attempt":  attempt,
+		}).Warn("Latest events changed while calculating state, retrying")
+	}
+}
+
+// maxLatestEventsAttempts is how many times the new latest events and state
+// are calculated without holding the lock before giving up and calculating
+// them while holding it instead.
+const maxLatestEventsAttempts = 3
+
+// commitLatestEvents takes the lock on the latest events in the room and, if
+// they haven't changed since the new latest events and state were calculated,
+// sends the output events and stores the new latest events. If they have
+// changed then either true is returned, so that the caller can try again, or,
+// if canRetry is false, the new latest events and state are calculated again
+// while the lock is held.
+func (u *latestEventsUpdater) commitLatestEvents(canRetry bool) (retry bool, err error) {
+	u.updater, err = u.api.DB.GetLatestEventsForUpdate(u.ctx, *u.roomInfo)
+	if err != nil {
+		return false, fmt.Errorf("r.DB.GetLatestEventsForUpdate: %w", err)
+	}
+	succeeded := false
+	defer sqlutil.EndTransactionWithCheck(u.updater, &succeeded, &err)
+
+	// The event may have been sent while the state was being calculated.
+	var hasBeenSent bool
+	if hasBeenSent, err = u.updater.HasEventBeenSent(u.stateAtEvent.EventNID); err != nil {
+		return false, fmt.Errorf("u.updater.HasEventBeenSent: %w", err)
+	} else if hasBeenSent {
+		succeeded = true
+		return false, nil
+	}
+
+	if !u.rewritesState && !u.basedOn(u.updater.LatestEvents(), u.updater.CurrentStateSnapshotNID()) {
+		if canRetry {
+			// Nothing has been written in the transaction, so rolling it
+			// back through EndTransactionWithCheck is all that's needed.
+			return true, nil
+		}
+		u.oldLatest = u.updater.LatestEvents()
+		u.oldStateNID = u.updater.CurrentStateSnapshotNID()
+		if err = u.calculateLatestAndState(); err != nil {
+			return false, err
+		}
+	}
+
 	if err = u.doUpdateLatestEvents(); err != nil {
-		return fmt.Errorf("u.doUpdateLatestEvents: %w", err)
+		return false, fmt.Errorf("u.doUpdateLatestEvents: %w", err)
 	}
 
 	succeeded = true
-	return
+	return false, nil
+}
+
+// basedOn returns true if the latest events and current state snapshot given
+// are the ones which the new latest events and state were calculated from.
+func (u *latestEventsUpdater) basedOn(latest []types.StateAtEventAndReference, stateNID types.StateSnapshotNID) bool {
+	if stateNID != u.oldStateNID || len(latest) != len(u.oldLatest) {
+		return false
+	}
+	nids := make(map[types.EventNID]struct{}, len(latest))
+	for _, l := range latest {
+		nids[l.EventNID] = struct{}{}
+	}
+	for _, l := range u.oldLatest {
+		if _, ok := nids[l.EventNID]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 // latestEventsUpdater tracks the state used to update the latest events in the
@@ -99,6 +216,12 @@ type latestEventsUpdater struct {
 	sendAsServer string
 	// The eventID of the event that was processed before this one.
 	lastEventIDSent string
+	// The latest events in the room before processing this event, which
+	// everything else was calculated from.
+	oldLatest []types.StateAtEventAndReference
+	// Whether the latest events or the state changed as a result of
+	// processing this event.
+	changed bool
 	// The latest events in the room after processing this event.
 	latest []types.StateAtEventAndReference
 	// The state entries removed from and added to the current state of the
@@ -114,33 +237,17 @@ type latestEventsUpdater struct {
 	newStateNID types.StateSnapshotNID
 }
 
-func (u *latestEventsUpdater) doUpdateLatestEvents() error {
-	u.lastEventIDSent = u.updater.LastEventIDSent()
-
-	// If we are doing a regular event update then we will get the
-	// previous latest events to use as a part of the calculation. If
-	// we are overwriting the latest events because we have a complete
-	// state snapshot from somewhere else, e.g. a federated room join,
-	// then start with an empty set - none of the forward extremities
-	// that we knew about before matter anymore.
-	oldLatest := []types.StateAtEventAndReference{}
-	if !u.rewritesState {
-		u.oldStateNID = u.updater.CurrentStateSnapshotNID()
-		oldLatest = u.updater.LatestEvents()
-	}
-
-	// If the event has already been written to the output log then we
-	// don't need to do anything, as we've handled it already.
-	if hasBeenSent, err := u.updater.HasEventBeenSent(u.stateAtEvent.EventNID); err != nil {
-		return fmt.Errorf("u.updater.HasEventBeenSent: %w", err)
-	} else if hasBeenSent {
-		return nil
-	}
+// calculateLatestAndState works out the new latest events and the new state
+// of the room from oldLatest and oldStateNID. It doesn't need the updater, so
+// it can be done without holding the lock on the latest events.
+func (u *latestEventsUpdater) calculateLatestAndState() error {
+	u.removed, u.added = nil, nil
+	u.stateBeforeEventRemoves, u.stateBeforeEventAdds = nil, nil
 
 	// Work out what the latest events are. This will include the new
 	// event if it is not already referenced.
 	extremitiesChanged, err := u.calculateLatest(
-		oldLatest, u.event,
+		u.oldLatest, u.event,
 		types.StateAtEventAndReference{
 			EventReference: u.event.EventReference(),
 			StateAtEvent:   u.stateAtEvent,
@@ -152,19 +259,33 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 
 	// Now that we know what the latest events are, it's time to get the
 	// latest state.
-	var updates []api.OutputEvent
-	if extremitiesChanged || u.rewritesState {
+	u.changed = extremitiesChanged || u.rewritesState
+	if u.changed {
 		if err = u.latestState(); err != nil {
 			return fmt.Errorf("u.latestState: %w", err)
 		}
+	} else {
+		u.newStateNID = u.oldStateNID
+	}
+	return nil
+}
+
+func (u *latestEventsUpdater) doUpdateLatestEvents() error {
+	u.lastEventIDSent = u.updater.LastEventIDSent()
 
-		// If we need to generate any output events then here's where we do it.
-		// TODO: Move this!
+	// If we need to generate any output events then here's where we do it.
+	// TODO: Move this!
+	var updates []api.OutputEvent
+	if u.changed {
+		var err error
 		if updates, err = u.api.updateMemberships(u.ctx, u.updater, u.removed, u.added); err != nil {
 			return fmt.Errorf("u.api.updateMemberships: %w", err)
 		}
-	} else {
-		u.newStateNID = u.oldStateNID
+		// When the state is rewritten, such as when joining a room over
+		// federation, it is expected to change in all sorts of ways.
+		if !u.rewritesState {
+			u.checkForStateReset()
+		}
 	}
 
 	update, err := u.makeOutputNewRoomEvent()
@@ -319,10 +440,155 @@ func (u *latestEventsUpdater) calculateLatest(
 		newLatest = append(newLatest, *old)
 	}
 
+	// If there are too many forward extremities then prune the oldest ones
+	// by depth. The new event is always kept, as it's the one that we are
+	// sending out. Otherwise rooms which accumulate lots of extremities,
+	// e.g. busy bridged rooms, make state resolution very expensive.
+	if limit := u.api.MaxForwardExtremities; limit > 0 && len(newLatest) > limit {
+		depths := make(map[string]int64, len(events))
+		for _, old := range events {
+			depths[old.EventID()] = old.Depth()
+		}
+		if newLatest, err = u.pruneExtremities(newLatest, depths, limit); err != nil {
+			return false, fmt.Errorf("u.pruneExtremities: %w", err)
+		}
+	}
+	if len(newLatest) > 1 {
+		forwardExtremities.WithLabelValues(newEvent.RoomID()).Set(float64(len(newLatest)))
+	} else {
+		forwardExtremities.DeleteLabelValues(newEvent.RoomID())
+	}
+
 	u.latest = newLatest
 	return true, nil
 }
 
+// pruneExtremities removes the oldest forward extremities by depth until there
+// are no more than limit, except for the first one, which is the new event.
+// Only extremities whose state after the event is entirely included in the
+// state after the extremities that are kept are removed, since the current
+// state is resolved from the kept ones alone. Otherwise state that only exists
+// on a pruned branch, such as a ban, would silently disappear from the current
+// state. This means that there can be more than limit extremities left if the
+// branches have different state.
+func (u *latestEventsUpdater) pruneExtremities(
+	latest []types.StateAtEventAndReference, depths map[string]int64, limit int,
+) ([]types.StateAtEventAndReference, error) {
+	roomState := state.NewStateResolution(u.api.DB, *u.roomInfo)
+	stateAfter := make([][]types.StateEntry, len(latest))
+	counts := make(map[types.StateEntry]int)
+	for i := range latest {
+		entries, err := roomState.LoadStateAtSnapshot(u.ctx, latest[i].BeforeStateSnapshotNID)
+		if err != nil {
+			return nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+		}
+		if latest[i].IsStateEvent() && !latest[i].IsRejected {
+			replaced := false
+			for j := range entries {
+				if entries[j].StateKeyTuple == latest[i].StateKeyTuple {
+					entries[j] = latest[i].StateEntry
+					replaced = true
+				}
+			}
+			if !replaced {
+				entries = append(entries, latest[i].StateEntry)
+			}
+		}
+		stateAfter[i] = entries
+		for _, entry := range entries {
+			counts[entry]++
+		}
+	}
+
+	// Consider the candidates oldest first.
+	candidates := make([]int, 0, len(latest)-1)
+	for i := 1; i < len(latest); i++ {
+		candidates = append(candidates, i)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := latest[candidates[i]], latest[candidates[j]]
+		if di, dj := depths[ci.EventID], depths[cj.EventID]; di != dj {
+			return di < dj
+		}
+		return ci.EventNID < cj.EventNID
+	})
+	pruned := make(map[int]bool)
+	for _, c := range candidates {
+		if len(latest)-len(pruned) <= limit {
+			break
+		}
+		// Every entry must also be in the state after another kept
+		// extremity, so that pruning this one doesn't lose anything.
+		covered := true
+		for _, entry := range stateAfter[c] {
+			if counts[entry] < 2 {
+				covered = false
+				break
+			}
+		}
+		if !covered {
+			continue
+		}
+		for _, entry := range stateAfter[c] {
+			counts[entry]--
+		}
+		pruned[c] = true
+	}
+
+	kept := make([]types.StateAtEventAndReference, 0, len(latest)-len(pruned))
+	for i := range latest {
+		if !pruned[i] {
+			kept = append(kept, latest[i])
+		}
+	}
+	fields := logrus.Fields{
+		"room_id": u.event.RoomID(),
+		"count":   len(latest),
+		"pruned":  len(pruned),
+	}
+	if len(kept) > limit {
+		util.GetLogger(u.ctx).WithFields(fields).Warn("Too many forward extremities with different state to prune down to the limit")
+	} else {
+		util.GetLogger(u.ctx).WithFields(fields).Warn("Pruning forward extremities")
+	}
+	forwardExtremitiesPruned.Add(float64(len(pruned)))
+	return kept, nil
+}
+
+// forwardExtremities is only populated for rooms with more than one forward
+// extremity, so that the number of label values stays small.
+var forwardExtremities = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "forward_extremities",
+		Help:      "The number of forward extremities in rooms that have more than one",
+	},
+	[]string{"room_id"},
+)
+
+var forwardExtremitiesPruned = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "forward_extremities_pruned",
+		Help:      "The number of forward extremities that have been pruned for going over the limit",
+	},
+)
+
+var latestEventsConflicts = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "latest_events_conflicts",
+		Help:      "The number of times the latest events in a room changed while the new state was being calculated",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(forwardExtremities, forwardExtremitiesPruned, latestEventsConflicts)
+}
+
 func (u *latestEventsUpdater) makeOutputNewRoomEvent() (*api.OutputEvent, error) {
 	latestEventIDs := make([]string, len(u.latest))
 	for i := range u.latest {
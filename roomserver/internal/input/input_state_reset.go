@@ -0,0 +1,165 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// stateResetRemoved means that a state key disappeared from the current
+	// state altogether. State keys can only ever be replaced, never removed.
+	stateResetRemoved = "removed"
+	// stateResetRolledBack means that a state key went back to an event which
+	// is older than the one it replaced.
+	stateResetRolledBack = "rolled_back"
+)
+
+// stateResetChange is a change to the current state of a room which looks
+// like it was caused by a state reset.
+type stateResetChange struct {
+	Type       string `json:"type"`
+	StateKey   string `json:"state_key"`
+	OldEventID string `json:"old_event_id"`
+	NewEventID string `json:"new_event_id,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+func (c stateResetChange) String() string {
+	return fmt.Sprintf("%s(%s) %s: %s -> %s", c.Type, c.StateKey, c.Reason, c.OldEventID, c.NewEventID)
+}
+
+// stateResetsDetected counts the updates to the current state of rooms which
+// look like state resets.
+var stateResetsDetected = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "state_resets_detected",
+		Help:      "The number of times that the current state of a room changed in a way that looks like a state reset",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(stateResetsDetected)
+}
+
+// checkForStateReset looks at how the current state of the room changed and
+// reports it if memberships or power levels changed unexpectedly, which is a
+// sign that state resolution has reset the state of the room. Changes made by
+// the event being processed itself are expected, as are changes which move a
+// state key on to a newer event, such as when a fork is merged. Problems with
+// checking are logged rather than returned, as they shouldn't stop the event
+// from being processed.
+func (u *latestEventsUpdater) checkForStateReset() {
+	changes, err := u.stateResetChanges()
+	if err != nil {
+		util.GetLogger(u.ctx).WithError(err).WithField("room_id", u.event.RoomID()).Warn("Failed to check for state reset")
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	stateResetsDetected.Inc()
+	extremities := make([]string, len(u.latest))
+	for i := range u.latest {
+		extremities[i] = u.latest[i].EventID
+	}
+	util.GetLogger(u.ctx).WithFields(logrus.Fields{
+		"room_id":                u.event.RoomID(),
+		"event_id":               u.event.EventID(),
+		"forward_extremities":    extremities,
+		"old_state_snapshot_nid": u.oldStateNID,
+		"new_state_snapshot_nid": u.newStateNID,
+		"changes":                changes,
+	}).Warn("Possible state reset detected")
+}
+
+// stateResetChanges returns the changes to memberships and power levels in
+// u.removed and u.added which look like they were caused by a state reset.
+func (u *latestEventsUpdater) stateResetChanges() ([]stateResetChange, error) {
+	watched := func(entry types.StateEntry) bool {
+		return entry.EventTypeNID == types.MRoomMemberNID || entry.EventTypeNID == types.MRoomPowerLevelsNID
+	}
+	added := make(map[types.StateKeyTuple]types.EventNID, len(u.added))
+	for _, entry := range u.added {
+		if watched(entry) {
+			added[entry.StateKeyTuple] = entry.EventNID
+		}
+	}
+	var removed []types.StateEntry
+	var eventNIDs []types.EventNID
+	for _, entry := range u.removed {
+		if !watched(entry) {
+			continue
+		}
+		newEventNID, ok := added[entry.StateKeyTuple]
+		if ok && newEventNID == u.stateAtEvent.EventNID {
+			// The event that we're processing made this change.
+			continue
+		}
+		removed = append(removed, entry)
+		eventNIDs = append(eventNIDs, entry.EventNID)
+		if ok {
+			eventNIDs = append(eventNIDs, newEventNID)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	events, err := u.api.DB.Events(u.ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("u.api.DB.Events: %w", err)
+	}
+	eventsByNID := make(map[types.EventNID]types.Event, len(events))
+	for _, ev := range events {
+		eventsByNID[ev.EventNID] = ev
+	}
+
+	var changes []stateResetChange
+	for _, entry := range removed {
+		oldEvent, ok := eventsByNID[entry.EventNID]
+		if !ok || oldEvent.StateKey() == nil {
+			continue
+		}
+		change := stateResetChange{
+			Type:       oldEvent.Type(),
+			StateKey:   *oldEvent.StateKey(),
+			OldEventID: oldEvent.EventID(),
+		}
+		newEventNID, replaced := added[entry.StateKeyTuple]
+		if !replaced {
+			change.Reason = stateResetRemoved
+			changes = append(changes, change)
+			continue
+		}
+		newEvent, ok := eventsByNID[newEventNID]
+		if !ok {
+			continue
+		}
+		change.NewEventID = newEvent.EventID()
+		if newEvent.Depth() < oldEvent.Depth() {
+			change.Reason = stateResetRolledBack
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
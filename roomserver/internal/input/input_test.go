@@ -0,0 +1,233 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestInputRoomEventsRejectIfBusy(t *testing.T) {
+	r := &Inputer{MaxQueuedEvents: 10}
+	r.queued.Store(30)
+
+	// Rejected events never reach the workers, so no database is needed.
+	var res api.InputRoomEventsResponse
+	r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{Kind: api.KindNew}},
+		RejectIfBusy:    true,
+	}, &res)
+
+	var busy *api.ErrRoomserverBusy
+	if !errors.As(res.Err(), &busy) {
+		t.Fatalf("expected ErrRoomserverBusy, got %v", res.Err())
+	}
+	if busy.RetryAfter != 3*time.Second {
+		t.Fatalf("expected to retry after 3s, got %s", busy.RetryAfter)
+	}
+
+	r.queued.Store(10000)
+	res = api.InputRoomEventsResponse{}
+	r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{Kind: api.KindNew}},
+		RejectIfBusy:    true,
+	}, &res)
+	if !errors.As(res.Err(), &busy) || busy.RetryAfter != maxInputRetryAfter {
+		t.Fatalf("expected to retry after %s, got %v", maxInputRetryAfter, res.Err())
+	}
+}
+
+type journalTestDatabase struct {
+	storage.Database
+	journalErr error
+	journalled []types.JournalledInput
+	forgotten  []int64
+}
+
+func (d *journalTestDatabase) JournalInputEvents(ctx context.Context, inputJSON [][]byte) ([]int64, error) {
+	return nil, d.journalErr
+}
+
+func (d *journalTestDatabase) JournalledInputs(ctx context.Context) ([]types.JournalledInput, error) {
+	return d.journalled, nil
+}
+
+func (d *journalTestDatabase) ForgetJournalledInput(ctx context.Context, id int64) error {
+	d.forgotten = append(d.forgotten, id)
+	return nil
+}
+
+func TestInputRoomEventsJournalFailure(t *testing.T) {
+	// Events which can't be journalled are never accepted, so they never
+	// reach the workers.
+	r := &Inputer{DB: &journalTestDatabase{journalErr: errors.New("disk full")}}
+	var res api.InputRoomEventsResponse
+	r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{Kind: api.KindNew}},
+	}, &res)
+	if res.Err() == nil {
+		t.Fatalf("expected an error when the events can't be journalled")
+	}
+	if r.queued.Load() != 0 {
+		t.Fatalf("expected no events to be queued, got %d", r.queued.Load())
+	}
+}
+
+func TestReplayJournalForgetsInvalidInput(t *testing.T) {
+	db := &journalTestDatabase{
+		journalled: []types.JournalledInput{{ID: 7, InputJSON: []byte("not json")}},
+	}
+	r := &Inputer{DB: db}
+	if err := r.ReplayJournal(context.Background()); err != nil {
+		t.Fatalf("ReplayJournal failed: %s", err)
+	}
+	if len(db.forgotten) != 1 || db.forgotten[0] != 7 {
+		t.Fatalf("expected journal entry 7 to be forgotten, got %v", db.forgotten)
+	}
+}
+
+func TestLatestEventsUpdaterBasedOn(t *testing.T) {
+	latest := func(nids ...types.EventNID) []types.StateAtEventAndReference {
+		l := make([]types.StateAtEventAndReference, len(nids))
+		for i, nid := range nids {
+			l[i].EventNID = nid
+		}
+		return l
+	}
+	u := latestEventsUpdater{oldLatest: latest(1, 2), oldStateNID: 5}
+	tests := []struct {
+		name     string
+		latest   []types.StateAtEventAndReference
+		stateNID types.StateSnapshotNID
+		want     bool
+	}{
+		{"same", latest(1, 2), 5, true},
+		{"same in a different order", latest(2, 1), 5, true},
+		{"state changed", latest(1, 2), 6, false},
+		{"extremity replaced", latest(1, 3), 5, false},
+		{"extremity added", latest(1, 2, 3), 5, false},
+		{"extremity removed", latest(1), 5, false},
+	}
+	for _, tt := range tests {
+		if got := u.basedOn(tt.latest, tt.stateNID); got != tt.want {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type sentEventTestDatabase struct {
+	storage.Database
+	latestEventsCalls int
+}
+
+func (d *sentEventTestDatabase) HasEventBeenSent(ctx context.Context, eventNID types.EventNID) (bool, error) {
+	return true, nil
+}
+
+func (d *sentEventTestDatabase) LatestEvents(ctx context.Context, roomNID types.RoomNID) ([]types.StateAtEventAndReference, types.StateSnapshotNID, error) {
+	d.latestEventsCalls++
+	return nil, 0, nil
+}
+
+func TestUpdateLatestEventsAlreadySent(t *testing.T) {
+	db := &sentEventTestDatabase{}
+	r := &Inputer{DB: db}
+	// Anything past the check would need the event, the room and the
+	// updater, none of which the database can provide.
+	err := r.updateLatestEvents(
+		context.Background(), &types.RoomInfo{RoomNID: 1},
+		types.StateAtEvent{StateEntry: types.StateEntry{EventNID: 1}},
+		nil, "", nil, false,
+	)
+	if err != nil {
+		t.Fatalf("updateLatestEvents failed: %s", err)
+	}
+	if db.latestEventsCalls != 0 {
+		t.Fatalf("expected no state to be calculated for an event which was already sent")
+	}
+}
+
+type stateResetTestDatabase struct {
+	storage.Database
+	events map[types.EventNID]types.Event
+}
+
+func (d *stateResetTestDatabase) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var events []types.Event
+	for _, nid := range eventNIDs {
+		if ev, ok := d.events[nid]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func TestStateResetChanges(t *testing.T) {
+	db := &stateResetTestDatabase{events: map[types.EventNID]types.Event{}}
+	entry := func(nid types.EventNID, typeNID types.EventTypeNID, stateKeyNID types.EventStateKeyNID, eventType, stateKey string, depth int64) types.StateEntry {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+			`{"event_id":"$%d:test","room_id":"!room:test","sender":"@alice:test","type":%q,"state_key":%q,"depth":%d,"content":{},"prev_events":[],"auth_events":[],"origin_server_ts":0}`,
+			nid, eventType, stateKey, depth,
+		)), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		db.events[nid] = types.Event{EventNID: nid, Event: ev}
+		return types.StateEntry{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: typeNID, EventStateKeyNID: stateKeyNID},
+			EventNID:      nid,
+		}
+	}
+	u := latestEventsUpdater{
+		ctx:          context.Background(),
+		api:          &Inputer{DB: db},
+		stateAtEvent: types.StateAtEvent{StateEntry: types.StateEntry{EventNID: 41}},
+		removed: []types.StateEntry{
+			entry(10, types.MRoomPowerLevelsNID, types.EmptyStateKeyNID, "m.room.power_levels", "", 5),
+			entry(20, types.MRoomMemberNID, 2, "m.room.member", "@bob:test", 4),
+			entry(30, types.MRoomMemberNID, 3, "m.room.member", "@carol:test", 2),
+			entry(40, types.MRoomMemberNID, 4, "m.room.member", "@dave:test", 5),
+			entry(50, 8, types.EmptyStateKeyNID, "m.room.name", "", 5),
+		},
+		added: []types.StateEntry{
+			// The power levels go back to an older event.
+			entry(11, types.MRoomPowerLevelsNID, types.EmptyStateKeyNID, "m.room.power_levels", "", 3),
+			// Carol's membership moves on to a newer event, which is expected.
+			entry(31, types.MRoomMemberNID, 3, "m.room.member", "@carol:test", 6),
+			// Dave's membership is changed by the event being processed.
+			entry(41, types.MRoomMemberNID, 4, "m.room.member", "@dave:test", 1),
+		},
+	}
+	changes, err := u.stateResetChanges()
+	if err != nil {
+		t.Fatalf("stateResetChanges failed: %s", err)
+	}
+	want := []stateResetChange{
+		{Type: "m.room.power_levels", StateKey: "", OldEventID: "$10:test", NewEventID: "$11:test", Reason: stateResetRolledBack},
+		{Type: "m.room.member", StateKey: "@bob:test", OldEventID: "$20:test", Reason: stateResetRemoved},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got changes %v, want %v", changes, want)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// Admin performs the room operations which are only available to server
+// administrators.
+type Admin struct {
+	Cfg     *config.RoomServer
+	DB      storage.Database
+	Leaver  *Leaver
+	Inputer *input.Inputer
+}
+
+// PerformRemoveLocalUsers implements api.RoomserverInternalAPI. Each local user
+// who is joined to the room leaves it, and each local user who is invited has
+// their invite rejected. A user who can't be removed doesn't stop the others
+// from being removed, but is reported in the response.
+func (r *Admin) PerformRemoveLocalUsers(
+	ctx context.Context,
+	req *api.PerformRemoveLocalUsersRequest,
+	res *api.PerformRemoveLocalUsersResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %s not found", req.RoomID),
+		}
+		return nil
+	}
+	if req.Block {
+		if err = r.DB.SetRoomBlocked(ctx, req.RoomID, true); err != nil {
+			return fmt.Errorf("r.DB.SetRoomBlocked: %w", err)
+		}
+	}
+
+	userIDs, err := r.localMembers(ctx, info)
+	if err != nil {
+		return err
+	}
+	res.RemovedUserIDs, res.FailedUserIDs = []string{}, []string{}
+	for _, userID := range userIDs {
+		outputEvents, leaveErr := r.Leaver.PerformLeave(ctx, &api.PerformLeaveRequest{
+			RoomID: req.RoomID,
+			UserID: userID,
+		}, &api.PerformLeaveResponse{})
+		if leaveErr == nil && len(outputEvents) > 0 {
+			leaveErr = r.Inputer.WriteOutputEvents(req.RoomID, outputEvents)
+		}
+		if leaveErr != nil {
+			util.GetLogger(ctx).WithError(leaveErr).WithField("user_id", userID).Warn("Failed to remove local user from room")
+			res.FailedUserIDs = append(res.FailedUserIDs, userID)
+			continue
+		}
+		res.RemovedUserIDs = append(res.RemovedUserIDs, userID)
+	}
+	return nil
+}
+
+// localMembers returns the local users who are joined or invited to the room
+// according to its current state.
+func (r *Admin) localMembers(ctx context.Context, info *types.RoomInfo) ([]string, error) {
+	entries, err := state.NewStateResolution(r.DB, *info).LoadStateAtSnapshot(ctx, info.StateSnapshotNID)
+	if err != nil {
+		return nil, fmt.Errorf("LoadStateAtSnapshot: %w", err)
+	}
+	var eventNIDs []types.EventNID
+	for _, entry := range entries {
+		if entry.EventTypeNID == types.MRoomMemberNID {
+			eventNIDs = append(eventNIDs, entry.EventNID)
+		}
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	var userIDs []string
+	for _, event := range events {
+		if event.StateKey() == nil {
+			continue
+		}
+		_, domain, splitErr := gomatrixserverlib.SplitID('@', *event.StateKey())
+		if splitErr != nil || !r.Cfg.Matrix.IsLocalServerName(domain) {
+			continue
+		}
+		membership, memErr := event.Membership()
+		if memErr == nil && (membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite) {
+			userIDs = append(userIDs, *event.StateKey())
+		}
+	}
+	return userIDs, nil
+}
+
+// PerformBlockRoom implements api.RoomserverInternalAPI
+func (r *Admin) PerformBlockRoom(
+	ctx context.Context,
+	req *api.PerformBlockRoomRequest,
+	res *api.PerformBlockRoomResponse,
+) error {
+	return r.DB.SetRoomBlocked(ctx, req.RoomID, req.Blocked)
+}
@@ -84,6 +84,22 @@ func (r *Inviter) PerformInvite(
 		}
 	}
 
+	if isTargetLocal {
+		// Local users can't be invited to rooms which have been blocked by the
+		// server administrator.
+		var blocked bool
+		if blocked, err = r.DB.IsRoomBlocked(ctx, roomID); err != nil {
+			return nil, fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+		}
+		if blocked {
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorNotAllowed,
+				Msg:  "This room has been blocked on this server",
+			}
+			return nil, nil
+		}
+	}
+
 	var isAlreadyJoined bool
 	if info != nil {
 		_, isAlreadyJoined, _, err = r.DB.GetMembership(ctx, info.RoomNID, *event.StateKey())
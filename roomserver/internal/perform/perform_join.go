@@ -22,6 +22,7 @@ import (
 	"time"
 
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
@@ -30,6 +31,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type Joiner struct {
@@ -37,6 +39,7 @@ type Joiner struct {
 	Cfg        *config.RoomServer
 	FSAPI      fsAPI.FederationSenderInternalAPI
 	DB         storage.Database
+	Cache      caching.RoomServerCaches
 
 	Inputer *input.Inputer
 }
@@ -107,13 +110,12 @@ func (r *Joiner) performJoinRoomByAlias(
 	var roomID string
 	if domain != r.Cfg.Matrix.ServerName {
 		// The alias isn't owned by us, so we will need to try joining using
-		// a remote server.
-		dirReq := fsAPI.PerformDirectoryLookupRequest{
-			RoomAlias:  req.RoomIDOrAlias, // the room alias to lookup
-			ServerName: domain,            // the server to ask
-		}
-		dirRes := fsAPI.PerformDirectoryLookupResponse{}
-		err = r.FSAPI.PerformDirectoryLookup(ctx, &dirReq, &dirRes)
+		// a remote server. Ask the server that owns the alias first, and if
+		// that fails, fall back to asking any of the servers that the client
+		// suggested, in order.
+		var dirRes fsAPI.PerformDirectoryLookupResponse
+		candidates := append([]gomatrixserverlib.ServerName{domain}, req.ServerNames...)
+		dirRes, err = r.performDirectoryLookup(ctx, req.RoomIDOrAlias, req.UserID, candidates)
 		if err != nil {
 			logrus.WithError(err).Errorf("error looking up alias %q", req.RoomIDOrAlias)
 			return "", "", fmt.Errorf("Looking up alias %q over federation failed: %w", req.RoomIDOrAlias, err)
@@ -138,12 +140,88 @@ func (r *Joiner) performJoinRoomByAlias(
 	return r.performJoinRoomByID(ctx, req)
 }
 
+// performDirectoryLookup asks all of the given servers at the same time
+// to resolve the room alias. Each server validates the room ID that it
+// returns on behalf of the joining user, so that a misconfigured server
+// can't send us to a room that doesn't exist. The first valid response,
+// in the order that the servers were given, wins, so the server names
+// should be ordered with the most authoritative first. Aliases that no
+// server could resolve are remembered for a while, so that we don't have
+// to wait on every server again if the client retries straight away.
+func (r *Joiner) performDirectoryLookup(
+	ctx context.Context,
+	roomAlias, userID string,
+	serverNames []gomatrixserverlib.ServerName,
+) (fsAPI.PerformDirectoryLookupResponse, error) {
+	if reason, ok := r.Cache.GetRoomAliasFailure(roomAlias); ok {
+		return fsAPI.PerformDirectoryLookupResponse{}, fmt.Errorf("%s (cached)", reason)
+	}
+
+	type lookupResult struct {
+		res fsAPI.PerformDirectoryLookupResponse
+		err error
+	}
+	var candidates []gomatrixserverlib.ServerName
+	tried := make(map[gomatrixserverlib.ServerName]bool)
+	for _, serverName := range serverNames {
+		if serverName == r.Cfg.Matrix.ServerName || tried[serverName] {
+			continue
+		}
+		tried[serverName] = true
+		candidates = append(candidates, serverName)
+	}
+	if len(candidates) == 0 {
+		return fsAPI.PerformDirectoryLookupResponse{}, fmt.Errorf("no servers to ask")
+	}
+
+	results := make([]chan lookupResult, len(candidates))
+	for i, serverName := range candidates {
+		results[i] = make(chan lookupResult, 1)
+		go func(serverName gomatrixserverlib.ServerName, result chan<- lookupResult) {
+			dirReq := fsAPI.PerformDirectoryLookupRequest{
+				RoomAlias:  roomAlias,  // the room alias to lookup
+				ServerName: serverName, // the server to ask
+				UserID:     userID,     // the user to validate the room ID for
+			}
+			dirRes := fsAPI.PerformDirectoryLookupResponse{}
+			err := r.FSAPI.PerformDirectoryLookup(ctx, &dirReq, &dirRes)
+			result <- lookupResult{dirRes, err}
+		}(serverName, results[i])
+	}
+
+	// Wait for the results in order of preference. The channels are
+	// buffered, so any lookups still running when we return won't leak.
+	var errs []string
+	for i, serverName := range candidates {
+		result := <-results[i]
+		if result.err != nil {
+			logrus.WithError(result.err).WithField("server_name", serverName).Warnf("Failed to look up alias %q", roomAlias)
+			errs = append(errs, fmt.Sprintf("%s: %s", serverName, result.err))
+			continue
+		}
+		if result.res.RoomID == "" {
+			errs = append(errs, fmt.Sprintf("%s: alias not found", serverName))
+			continue
+		}
+		return result.res, nil
+	}
+	reason := strings.Join(errs, "; ")
+	r.Cache.StoreRoomAliasFailure(roomAlias, reason)
+	return fsAPI.PerformDirectoryLookupResponse{}, fmt.Errorf("%s", reason)
+}
+
 // TODO: Break this function up a bit
 // nolint:gocyclo
 func (r *Joiner) performJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
 ) (string, gomatrixserverlib.ServerName, error) {
+	// If the room has been upgraded and frozen then join the room which
+	// replaced it instead.
+	if r.Cfg.FreezeUpgradedRooms {
+		req.RoomIDOrAlias = r.successorRoom(ctx, req.RoomIDOrAlias, req.UserID)
+	}
+
 	// Get the domain part of the room ID.
 	_, domain, err := gomatrixserverlib.SplitID('!', req.RoomIDOrAlias)
 	if err != nil {
@@ -153,6 +231,19 @@ func (r *Joiner) performJoinRoomByID(
 		}
 	}
 
+	// Local users can't join rooms which have been blocked by the server
+	// administrator.
+	blocked, err := r.DB.IsRoomBlocked(ctx, req.RoomIDOrAlias)
+	if err != nil {
+		return "", "", fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+	}
+	if blocked {
+		return "", "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "This room has been blocked on this server",
+		}
+	}
+
 	// If the server name in the room ID isn't ours then it's a
 	// possible candidate for finding the room via federation. Add
 	// it to the list of servers to try.
@@ -291,6 +382,47 @@ func (r *Joiner) performJoinRoomByID(
 	return req.RoomIDOrAlias, r.Cfg.Matrix.ServerName, nil
 }
 
+// maxUpgradeRedirects is the number of tombstones that successorRoom will
+// follow, so that a loop of tombstones can't keep us going forever.
+const maxUpgradeRedirects = 10
+
+// successorRoom follows the tombstones in the current state of the room to
+// the most recent room which replaced it. A room which the user is already
+// joined to isn't replaced, so that they aren't moved out of rooms that they
+// are still in. Rooms that we aren't in are returned as they are, as we don't
+// know whether they have been upgraded.
+func (r *Joiner) successorRoom(ctx context.Context, roomID, userID string) string {
+	for i := 0; i < maxUpgradeRedirects; i++ {
+		var res api.QueryLatestEventsAndStateResponse
+		if err := helpers.QueryLatestEventsAndState(ctx, r.DB, &api.QueryLatestEventsAndStateRequest{
+			RoomID: roomID,
+			StateToFetch: []gomatrixserverlib.StateKeyTuple{
+				{EventType: "m.room.tombstone", StateKey: ""},
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+			},
+		}, &res); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to check whether room has been upgraded")
+			return roomID
+		}
+		var replacementRoom string
+		for _, ev := range res.StateEvents {
+			switch ev.Type() {
+			case "m.room.tombstone":
+				replacementRoom = gjson.GetBytes(ev.Content(), "replacement_room").Str
+			case gomatrixserverlib.MRoomMember:
+				if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Join {
+					return roomID
+				}
+			}
+		}
+		if !strings.HasPrefix(replacementRoom, "!") || replacementRoom == roomID {
+			return roomID
+		}
+		roomID = replacementRoom
+	}
+	return roomID
+}
+
 func (r *Joiner) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
@@ -305,15 +437,45 @@ func (r *Joiner) performFederatedJoinRoomByID(
 	fedRes := fsAPI.PerformJoinResponse{}
 	r.FSAPI.PerformJoin(ctx, &fedReq, &fedRes)
 	if fedRes.LastError != nil {
+		msg := fedRes.LastError.Message
+		if fedRes.LastError.Code == 0 && len(fedRes.ServerErrors) > 1 {
+			// The last error wasn't a remote HTTP error that we can pass
+			// straight through to the client, so report on every server
+			// that we tried instead of just the last one.
+			msg = joinServerErrorsSummary(fedReq.ServerNames, fedRes.ServerErrors)
+		}
 		return "", &api.PerformError{
 			Code:       api.PerformErrRemote,
-			Msg:        fedRes.LastError.Message,
+			Msg:        msg,
 			RemoteCode: fedRes.LastError.Code,
 		}
 	}
 	return fedRes.JoinedVia, nil
 }
 
+// joinServerErrorsSummary builds a human-readable description of why
+// the join failed through each server, in the order that they were tried.
+func joinServerErrorsSummary(
+	serverNames []gomatrixserverlib.ServerName,
+	serverErrors map[gomatrixserverlib.ServerName]string,
+) string {
+	var errs []string
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	for _, serverName := range serverNames {
+		if seen[serverName] {
+			continue
+		}
+		seen[serverName] = true
+		if serverErr, ok := serverErrors[serverName]; ok {
+			errs = append(errs, fmt.Sprintf("%s: %s", serverName, serverErr))
+		}
+	}
+	return fmt.Sprintf(
+		"Failed to join room through %d server(s): %s",
+		len(errs), strings.Join(errs, "; "),
+	)
+}
+
 func buildEvent(
 	ctx context.Context, db storage.Database, cfg *config.Global, builder *gomatrixserverlib.EventBuilder,
 ) (*gomatrixserverlib.HeaderedEvent, *api.QueryLatestEventsAndStateResponse, error) {
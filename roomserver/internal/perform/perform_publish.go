@@ -18,11 +18,13 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/occupancy"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 )
 
 type Publisher struct {
-	DB storage.Database
+	DB        storage.Database
+	Occupancy *occupancy.RoomOccupancy
 }
 
 func (r *Publisher) PerformPublish(
@@ -30,10 +32,13 @@ func (r *Publisher) PerformPublish(
 	req *api.PerformPublishRequest,
 	res *api.PerformPublishResponse,
 ) {
-	err := r.DB.PublishRoom(ctx, req.RoomID, req.Visibility == "public")
+	published := req.Visibility == "public"
+	err := r.DB.PublishRoom(ctx, req.RoomID, published)
 	if err != nil {
 		res.Error = &api.PerformError{
 			Msg: err.Error(),
 		}
+		return
 	}
+	r.Occupancy.OnRoomPublished(req.RoomID, published)
 }
@@ -0,0 +1,56 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+type Purger struct {
+	DB storage.Database
+}
+
+// PerformPurgeRoom implements api.RoomserverInternalAPI
+func (p *Purger) PerformPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+	res *api.PerformPurgeRoomResponse,
+) error {
+	err := p.DB.PurgeRoom(ctx, req.RoomID)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, types.ErrRoomNotFound):
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %s not found", req.RoomID),
+		}
+		return nil
+	case errors.Is(err, types.ErrRoomHasLocalMembers):
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("Room %s still has local users joined to it", req.RoomID),
+		}
+		return nil
+	default:
+		return fmt.Errorf("p.DB.PurgeRoom: %w", err)
+	}
+}
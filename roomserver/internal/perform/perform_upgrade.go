@@ -0,0 +1,384 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type Upgrader struct {
+	Cfg       *config.RoomServer
+	DB        storage.Database
+	Inputer   *input.Inputer
+	Publisher *Publisher
+}
+
+// upgradedStateTypes are the types of the state events with an empty state
+// key which are copied from the old room into the new room.
+var upgradedStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	gomatrixserverlib.MRoomName,
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.server_acl",
+	"m.room.related_groups",
+	gomatrixserverlib.MRoomCanonicalAlias,
+}
+
+type upgradeEvent struct {
+	Type     string
+	StateKey string
+	Content  interface{}
+}
+
+// PerformRoomUpgrade implements api.RoomserverInternalAPI. The new room is
+// created with the state of the old room, the old room is replaced with a
+// tombstone pointing at the new room, and then its aliases are moved over to
+// the new room.
+// nolint:gocyclo
+func (r *Upgrader) PerformRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+	res *api.PerformRoomUpgradeResponse,
+) error {
+	if _, err := version.SupportedRoomVersion(req.RoomVersion); err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  err.Error(),
+		}
+		return nil
+	}
+
+	var latestRes api.QueryLatestEventsAndStateResponse
+	if err := helpers.QueryLatestEventsAndState(ctx, r.DB, &api.QueryLatestEventsAndStateRequest{
+		RoomID: req.RoomID,
+	}, &latestRes); err != nil {
+		return fmt.Errorf("helpers.QueryLatestEventsAndState: %w", err)
+	}
+	if !latestRes.RoomExists {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %s not found", req.RoomID),
+		}
+		return nil
+	}
+	oldState := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, len(latestRes.StateEvents))
+	for _, ev := range latestRes.StateEvents {
+		oldState[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev.Event
+	}
+
+	// The tombstone is built first, as the create event of the new room
+	// refers to it. Whether the user may send it decides whether they are
+	// allowed to upgrade the room.
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+	tombstone, err := r.buildOldRoomEvent(ctx, req.RoomID, req.UserID, "m.room.tombstone", map[string]interface{}{
+		"body":             "This room has been replaced",
+		"replacement_room": newRoomID,
+	})
+	if err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("User %s is not allowed to upgrade room %s: %s", req.UserID, req.RoomID, err),
+		}
+		return nil
+	}
+
+	if err = r.createNewRoom(ctx, req, newRoomID, tombstone.EventID(), oldState); err != nil {
+		return fmt.Errorf("r.createNewRoom: %w", err)
+	}
+
+	// The aliases and the room directory entry are only moved once the
+	// tombstone has been sent, as if it can't be then the old room is
+	// still the one that people should be using.
+	if err = r.sendEvents(ctx, []*gomatrixserverlib.HeaderedEvent{tombstone}); err != nil {
+		return fmt.Errorf("r.sendEvents: %w", err)
+	}
+	res.NewRoomID = newRoomID
+
+	if err = r.DB.MoveRoomAliases(ctx, req.RoomID, newRoomID); err != nil {
+		return fmt.Errorf("r.DB.MoveRoomAliases: %w", err)
+	}
+	publishedRooms, err := r.DB.GetPublishedRooms(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetPublishedRooms: %w", err)
+	}
+	for _, roomID := range publishedRooms {
+		if roomID != req.RoomID {
+			continue
+		}
+		publishReqs := []api.PerformPublishRequest{
+			{RoomID: newRoomID, Visibility: "public"},
+			{RoomID: req.RoomID, Visibility: "private"},
+		}
+		for i := range publishReqs {
+			var publishRes api.PerformPublishResponse
+			r.Publisher.PerformPublish(ctx, &publishReqs[i], &publishRes)
+			if publishRes.Error != nil {
+				return fmt.Errorf("r.Publisher.PerformPublish: %s", publishRes.Error.Msg)
+			}
+		}
+	}
+
+	// The aliases belong to the new room now, so the old room shouldn't
+	// advertise them any more.
+	if _, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias}]; ok {
+		if err = r.sendOldRoomEvent(ctx, req.RoomID, req.UserID, gomatrixserverlib.MRoomCanonicalAlias, map[string]interface{}{}); err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Failed to remove canonical alias from upgraded room")
+		}
+	}
+
+	// Stop users who aren't moderators from talking in or inviting people to
+	// the old room.
+	if !r.Cfg.FreezeUpgradedRooms {
+		return nil
+	}
+	if plEvent, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}]; ok {
+		powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent)
+		if err != nil {
+			return fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+		}
+		restrictedLevel := powerLevels.UsersDefault + 1
+		if restrictedLevel < 50 {
+			restrictedLevel = 50
+		}
+		if powerLevels.EventsDefault < restrictedLevel || powerLevels.Invite < restrictedLevel {
+			if powerLevels.EventsDefault < restrictedLevel {
+				powerLevels.EventsDefault = restrictedLevel
+			}
+			if powerLevels.Invite < restrictedLevel {
+				powerLevels.Invite = restrictedLevel
+			}
+			if err = r.sendOldRoomEvent(ctx, req.RoomID, req.UserID, gomatrixserverlib.MRoomPowerLevels, powerLevels); err != nil {
+				util.GetLogger(ctx).WithError(err).Warn("Failed to restrict power levels in upgraded room")
+			}
+		}
+	}
+	return nil
+}
+
+// createNewRoom creates the room which replaces the old room, copying over
+// its state and bans.
+func (r *Upgrader) createNewRoom(
+	ctx context.Context, req *api.PerformRoomUpgradeRequest, newRoomID, tombstoneEventID string,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+) error {
+	createContent := map[string]interface{}{}
+	if create, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate}]; ok {
+		if err := json.Unmarshal(create.Content(), &createContent); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	createContent["creator"] = req.UserID
+	createContent["room_version"] = req.RoomVersion
+	createContent["predecessor"] = map[string]string{
+		"room_id":  req.RoomID,
+		"event_id": tombstoneEventID,
+	}
+
+	membershipContent := gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}
+	if member, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID}]; ok {
+		if oldContent, err := gomatrixserverlib.NewMemberContentFromEvent(member); err == nil {
+			membershipContent.DisplayName = oldContent.DisplayName
+			membershipContent.AvatarURL = oldContent.AvatarURL
+		}
+	}
+
+	// The user needs to be able to send all of the state into the new room,
+	// so they are given the highest power level in the room until they have
+	// done so, and then the power levels from the old room are restored.
+	var oldPowerLevels interface{}
+	powerLevels := eventutil.InitialPowerLevelsContent(req.UserID)
+	if plEvent, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}]; ok {
+		var err error
+		if powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent); err != nil {
+			return fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+		}
+		oldPowerLevels = json.RawMessage(plEvent.Content())
+	}
+	users := make(map[string]int64, len(powerLevels.Users)+1)
+	for userID, level := range powerLevels.Users {
+		users[userID] = level
+	}
+	maxLevel := maxPowerLevel(&powerLevels)
+	if users[req.UserID] == maxLevel {
+		// The user can already do everything, so the power levels from the
+		// old room can be used straight away.
+		oldPowerLevels = nil
+	}
+	users[req.UserID] = maxLevel
+	powerLevels.Users = users
+
+	eventsToMake := []upgradeEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, req.UserID, membershipContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", powerLevels},
+	}
+	for _, eventType := range upgradedStateTypes {
+		if ev, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: eventType}]; ok {
+			eventsToMake = append(eventsToMake, upgradeEvent{eventType, "", json.RawMessage(ev.Content())})
+		}
+	}
+	// Users who were banned from the old room are banned from the new room
+	// too, as they could otherwise just join it.
+	var banned []string
+	for tuple, ev := range oldState {
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Ban {
+			banned = append(banned, tuple.StateKey)
+		}
+	}
+	sort.Strings(banned)
+	for _, userID := range banned {
+		ev := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}]
+		eventsToMake = append(eventsToMake, upgradeEvent{gomatrixserverlib.MRoomMember, userID, json.RawMessage(ev.Content())})
+	}
+	if oldPowerLevels != nil {
+		eventsToMake = append(eventsToMake, upgradeEvent{gomatrixserverlib.MRoomPowerLevels, "", oldPowerLevels})
+	}
+
+	var builtEvents []*gomatrixserverlib.HeaderedEvent
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	evTime := time.Now()
+	for i, e := range eventsToMake {
+		stateKey := e.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   req.UserID,
+			RoomID:   newRoomID,
+			Type:     e.Type,
+			StateKey: &stateKey,
+			Depth:    int64(i + 1), // depth starts at 1
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+			return fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		ev, err := builder.Build(
+			evTime, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+			r.Cfg.Matrix.PrivateKey, req.RoomVersion,
+		)
+		if err != nil {
+			return fmt.Errorf("builder.Build: %w", err)
+		}
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			return fmt.Errorf("gomatrixserverlib.Allowed for %s event: %w", e.Type, err)
+		}
+		if err = authEvents.AddEvent(ev); err != nil {
+			return fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		builtEvents = append(builtEvents, ev.Headered(req.RoomVersion))
+	}
+	return r.sendEvents(ctx, builtEvents)
+}
+
+// buildOldRoomEvent builds a state event with an empty state key in the old
+// room, returning an error if the user isn't allowed to send it.
+func (r *Upgrader) buildOldRoomEvent(
+	ctx context.Context, roomID, userID, eventType string, content interface{},
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Type:     eventType,
+		Sender:   userID,
+		StateKey: &stateKey,
+		RoomID:   roomID,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return nil, fmt.Errorf("builder.SetContent: %w", err)
+	}
+	event, buildRes, err := buildEvent(ctx, r.DB, r.Cfg.Matrix, &builder)
+	if err != nil {
+		return nil, fmt.Errorf("buildEvent: %w", err)
+	}
+	provider := gomatrixserverlib.NewAuthEvents(gomatrixserverlib.UnwrapEventHeaders(buildRes.StateEvents))
+	if err = gomatrixserverlib.Allowed(event.Event, &provider); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func (r *Upgrader) sendOldRoomEvent(
+	ctx context.Context, roomID, userID, eventType string, content interface{},
+) error {
+	event, err := r.buildOldRoomEvent(ctx, roomID, userID, eventType, content)
+	if err != nil {
+		return err
+	}
+	return r.sendEvents(ctx, []*gomatrixserverlib.HeaderedEvent{event})
+}
+
+func (r *Upgrader) sendEvents(ctx context.Context, events []*gomatrixserverlib.HeaderedEvent) error {
+	inputReq := api.InputRoomEventsRequest{}
+	for _, event := range events {
+		inputReq.InputRoomEvents = append(inputReq.InputRoomEvents, api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        event,
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		})
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, &inputReq, &inputRes)
+	return inputRes.Err()
+}
+
+// maxPowerLevel returns the highest power level that's needed to do anything
+// in the room.
+func maxPowerLevel(powerLevels *gomatrixserverlib.PowerLevelContent) int64 {
+	max := powerLevels.UsersDefault
+	for _, level := range []int64{
+		powerLevels.Ban, powerLevels.Invite, powerLevels.Kick, powerLevels.Redact,
+		powerLevels.EventsDefault, powerLevels.StateDefault,
+	} {
+		if level > max {
+			max = level
+		}
+	}
+	for _, levels := range []map[string]int64{powerLevels.Users, powerLevels.Events} {
+		for _, level := range levels {
+			if level > max {
+				max = level
+			}
+		}
+	}
+	return max
+}
@@ -16,16 +16,21 @@ package query
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/occupancy"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/throughput"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -37,6 +42,8 @@ type Queryer struct {
 	DB         storage.Database
 	Cache      caching.RoomServerCaches
 	ServerACLs *acls.ServerACLs
+	Occupancy  *occupancy.RoomOccupancy
+	Throughput *throughput.RoomThroughput
 }
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -187,6 +194,28 @@ func (r *Queryer) QueryEventsByID(
 		response.Events = append(response.Events, event.Headered(roomVersion))
 	}
 
+	if !request.IncludeAuthChain {
+		return nil
+	}
+
+	// Walk the auth chains of all of the events together, so that events
+	// which are shared between them are only fetched once.
+	var authEventIDs []string
+	for _, event := range events {
+		authEventIDs = append(authEventIDs, event.AuthEventIDs()...)
+	}
+	authEvents, err := getAuthChain(ctx, r.DB.EventsFromIDs, util.UniqueStrings(authEventIDs))
+	if err != nil {
+		return err
+	}
+	for _, event := range authEvents {
+		roomVersion, verr := r.roomVersion(event.RoomID())
+		if verr != nil {
+			return verr
+		}
+		response.AuthChainEvents = append(response.AuthChainEvents, event.Headered(roomVersion))
+	}
+
 	return nil
 }
 
@@ -406,7 +435,9 @@ func (r *Queryer) QueryMissingEvents(
 		return fmt.Errorf("missing RoomInfo for room %s", events[0].RoomID())
 	}
 
-	resultNIDs, err := helpers.ScanEventTree(ctx, r.DB, *info, front, visited, request.Limit, request.ServerName)
+	// The latest events are included in the results of the scan but are then
+	// filtered out, so make room for them in the limit.
+	resultNIDs, err := helpers.ScanEventTree(ctx, r.DB, *info, front, visited, request.Limit+len(eventsToFilter), request.ServerName)
 	if err != nil {
 		return err
 	}
@@ -416,9 +447,12 @@ func (r *Queryer) QueryMissingEvents(
 		return err
 	}
 
-	response.Events = make([]*gomatrixserverlib.HeaderedEvent, 0, len(loadedEvents)-len(eventsToFilter))
+	response.Events = make([]*gomatrixserverlib.HeaderedEvent, 0, len(loadedEvents))
 	for _, event := range loadedEvents {
-		if !eventsToFilter[event.EventID()] {
+		if len(response.Events) == request.Limit {
+			break
+		}
+		if !eventsToFilter[event.EventID()] && event.Depth() >= request.MinDepth {
 			roomVersion, verr := r.roomVersion(event.RoomID())
 			if verr != nil {
 				return verr
@@ -615,11 +649,15 @@ func (r *Queryer) QueryPublishedRooms(
 	req *api.QueryPublishedRoomsRequest,
 	res *api.QueryPublishedRoomsResponse,
 ) error {
-	rooms, err := r.DB.GetPublishedRooms(ctx)
-	if err != nil {
-		return err
+	rooms, counts := r.Occupancy.PublishedRooms()
+	if req.RoomID != "" {
+		if _, ok := counts[req.RoomID]; ok {
+			res.RoomIDs = []string{req.RoomID}
+		}
+		return nil
 	}
 	res.RoomIDs = rooms
+	res.JoinedMemberCounts = counts
 	return nil
 }
 
@@ -637,6 +675,294 @@ func (r *Queryer) QueryCurrentState(ctx context.Context, req *api.QueryCurrentSt
 	return nil
 }
 
+// QueryNotificationContext implements api.RoomserverInternalAPI. The results
+// are cached against the current state snapshot of the room, so repeated
+// notifications for the same room only need to touch the database when the
+// room state has changed.
+func (r *Queryer) QueryNotificationContext(ctx context.Context, req *api.QueryNotificationContextRequest, res *api.QueryNotificationContextResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	roomState := state.NewStateResolution(r.DB, *info)
+
+	roomContext, ok := r.Cache.GetNotificationRoomContext(info.RoomNID, info.StateSnapshotNID)
+	if !ok {
+		nameTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName, StateKey: ""}
+		aliasTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
+		stateEntries, err := roomState.LoadStateAtSnapshotForStringTuples(
+			ctx, info.StateSnapshotNID, []gomatrixserverlib.StateKeyTuple{nameTuple, aliasTuple},
+		)
+		if err != nil {
+			return fmt.Errorf("roomState.LoadStateAtSnapshotForStringTuples: %w", err)
+		}
+		stateEvents, err := helpers.LoadStateEvents(ctx, r.DB, stateEntries)
+		if err != nil {
+			return fmt.Errorf("helpers.LoadStateEvents: %w", err)
+		}
+		var name, alias string
+		for _, ev := range stateEvents {
+			var content struct {
+				Name  string `json:"name"`
+				Alias string `json:"alias"`
+			}
+			if err = json.Unmarshal(ev.Content(), &content); err != nil {
+				continue
+			}
+			switch ev.Type() {
+			case gomatrixserverlib.MRoomName:
+				name = content.Name
+			case gomatrixserverlib.MRoomCanonicalAlias:
+				alias = content.Alias
+			}
+		}
+		roomContext.RoomName = name
+		if roomContext.RoomName == "" {
+			roomContext.RoomName = alias
+		}
+		joined, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, false)
+		if err != nil {
+			return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+		}
+		roomContext.JoinedMemberCount = len(joined)
+		r.Cache.StoreNotificationRoomContext(info.RoomNID, info.StateSnapshotNID, roomContext)
+	}
+	res.RoomName = roomContext.RoomName
+	res.JoinedMemberCount = roomContext.JoinedMemberCount
+
+	if req.SenderID == "" {
+		return nil
+	}
+	displayName, ok := r.Cache.GetNotificationSenderDisplayName(info.RoomNID, info.StateSnapshotNID, req.SenderID)
+	if !ok {
+		memberTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.SenderID}
+		stateEntries, err := roomState.LoadStateAtSnapshotForStringTuples(
+			ctx, info.StateSnapshotNID, []gomatrixserverlib.StateKeyTuple{memberTuple},
+		)
+		if err != nil {
+			return fmt.Errorf("roomState.LoadStateAtSnapshotForStringTuples: %w", err)
+		}
+		stateEvents, err := helpers.LoadStateEvents(ctx, r.DB, stateEntries)
+		if err != nil {
+			return fmt.Errorf("helpers.LoadStateEvents: %w", err)
+		}
+		for _, ev := range stateEvents {
+			var content gomatrixserverlib.MemberContent
+			if err = json.Unmarshal(ev.Content(), &content); err == nil && content.DisplayName != "" {
+				displayName = content.DisplayName
+			}
+		}
+		r.Cache.StoreNotificationSenderDisplayName(info.RoomNID, info.StateSnapshotNID, req.SenderID, displayName)
+	}
+	res.SenderDisplayName = displayName
+	return nil
+}
+
+// QueryEventsBySender implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventsBySender(ctx context.Context, req *api.QueryEventsBySenderRequest, res *api.QueryEventsBySenderResponse) error {
+	events, err := r.DB.EventsBySender(ctx, req.UserID, types.EventNID(req.From), req.Limit)
+	if err != nil {
+		return err
+	}
+	res.Events = make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, event := range events {
+		if req.Since != 0 && event.OriginServerTS() < req.Since {
+			continue
+		}
+		res.Events = append(res.Events, event.Headered(event.Version()))
+	}
+	// The events are looked at in the order that we received them rather
+	// than by their timestamps, so keep going until we run out of events.
+	if len(events) > 0 && len(events) == req.Limit {
+		res.Next = int64(events[len(events)-1].EventNID)
+	}
+	return nil
+}
+
+// QueryRoomDAG implements api.RoomserverInternalAPI
+func (r *Queryer) QueryRoomDAG(ctx context.Context, req *api.QueryRoomDAGRequest, res *api.QueryRoomDAGResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = info.RoomVersion
+	toDepth := req.ToDepth
+	if toDepth == 0 {
+		toDepth = math.MaxInt64
+	}
+	entries, err := r.DB.RoomDAG(ctx, *info, req.FromDepth, toDepth, req.Limit)
+	if err != nil {
+		return err
+	}
+	res.Events = make([]api.RoomDAGEvent, 0, len(entries))
+	for _, entry := range entries {
+		res.Events = append(res.Events, api.RoomDAGEvent{
+			EventID:          entry.EventID(),
+			Type:             entry.Type(),
+			StateKey:         entry.StateKey(),
+			Sender:           entry.Sender(),
+			Depth:            entry.Depth(),
+			PrevEvents:       entry.PrevEventIDs(),
+			AuthEvents:       entry.AuthEventIDs(),
+			StateSnapshotNID: int64(entry.StateSnapshotNID),
+			Rejected:         entry.IsRejected,
+			SoftFailed:       entry.SoftFailed,
+			Outlier:          entry.IsOutlier,
+		})
+	}
+	latestEvents, stateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return err
+	}
+	res.StateSnapshotNID = int64(stateSnapshotNID)
+	res.ForwardExtremities = make([]string, 0, len(latestEvents))
+	for _, ref := range latestEvents {
+		res.ForwardExtremities = append(res.ForwardExtremities, ref.EventID)
+	}
+	return nil
+}
+
+// QueryTimestampToEvent implements api.RoomserverInternalAPI
+func (r *Queryer) QueryTimestampToEvent(ctx context.Context, req *api.QueryTimestampToEventRequest, res *api.QueryTimestampToEventResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = info.RoomVersion
+	res.EventID, res.OriginServerTS, err = r.DB.EventByTimestamp(ctx, *info, req.Timestamp, !req.Backwards)
+	if err != nil {
+		return err
+	}
+	if res.EventID == "" || !req.IncludeState {
+		return nil
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err = r.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       req.RoomID,
+		PrevEventIDs: []string{res.EventID},
+		StateToFetch: req.StateToFetch,
+	}, &stateRes); err != nil {
+		return fmt.Errorf("r.QueryStateAfterEvents: %w", err)
+	}
+	res.StateEvents = stateRes.StateEvents
+	return nil
+}
+
+// QueryRoomUsage implements api.RoomserverInternalAPI
+func (r *Queryer) QueryRoomUsage(ctx context.Context, req *api.QueryRoomUsageRequest, res *api.QueryRoomUsageResponse) error {
+	var usages []types.RoomUsage
+	if req.RoomID != "" {
+		usage, err := r.DB.RoomUsage(ctx, req.RoomID)
+		if err != nil {
+			return err
+		}
+		if usage != nil {
+			usages = append(usages, *usage)
+		}
+	} else {
+		var err error
+		if usages, err = r.DB.LargestRoomUsages(ctx, req.Limit); err != nil {
+			return err
+		}
+	}
+	res.Rooms = make([]api.RoomUsage, 0, len(usages))
+	for _, usage := range usages {
+		res.Rooms = append(res.Rooms, api.RoomUsage{
+			RoomID:          usage.RoomID,
+			Events:          usage.Events,
+			EventJSONBytes:  usage.EventJSONBytes,
+			StateSnapshots:  usage.StateSnapshots,
+			MediaReferences: usage.MediaReferences,
+		})
+	}
+	return nil
+}
+
+// QueryRoomList implements api.RoomserverInternalAPI
+func (r *Queryer) QueryRoomList(ctx context.Context, req *api.QueryRoomListRequest, res *api.QueryRoomListResponse) error {
+	var roomIDs []string
+	if req.RoomID != "" {
+		roomIDs = []string{req.RoomID}
+	} else {
+		knownRoomIDs, err := r.DB.GetKnownRooms(ctx)
+		if err != nil {
+			return fmt.Errorf("r.DB.GetKnownRooms: %w", err)
+		}
+		sort.Strings(knownRoomIDs)
+		for _, roomID := range knownRoomIDs {
+			if roomID > req.From {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	res.Rooms = []api.RoomListEntry{}
+	for _, roomID := range roomIDs {
+		if req.RoomID == "" && req.Limit > 0 && len(res.Rooms) >= req.Limit {
+			break
+		}
+		info, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		if info == nil || info.IsStub {
+			continue
+		}
+		entry := api.RoomListEntry{
+			RoomID:      roomID,
+			RoomVersion: info.RoomVersion,
+		}
+		joined, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, false)
+		if err != nil {
+			return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+		}
+		entry.JoinedMembers = len(joined)
+		localJoined, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, true)
+		if err != nil {
+			return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+		}
+		entry.JoinedLocalMembers = len(localJoined)
+		nameEvent, err := r.DB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomName, "")
+		if err != nil {
+			return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+		}
+		if nameEvent != nil {
+			var content struct {
+				Name string `json:"name"`
+			}
+			if json.Unmarshal(nameEvent.Content(), &content) == nil {
+				entry.Name = content.Name
+			}
+		}
+		if entry.Blocked, err = r.DB.IsRoomBlocked(ctx, roomID); err != nil {
+			return fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+		}
+		res.Rooms = append(res.Rooms, entry)
+	}
+	return nil
+}
+
+// QueryRoomThroughput implements api.RoomserverInternalAPI
+func (r *Queryer) QueryRoomThroughput(ctx context.Context, req *api.QueryRoomThroughputRequest, res *api.QueryRoomThroughputResponse) error {
+	rooms := r.Throughput.Busiest(req.Minutes, req.Limit)
+	res.Rooms = make([]api.RoomThroughput, 0, len(rooms))
+	for _, room := range rooms {
+		res.Rooms = append(res.Rooms, api.RoomThroughput(room))
+	}
+	return nil
+}
+
 func (r *Queryer) QueryRoomsForUser(ctx context.Context, req *api.QueryRoomsForUserRequest, res *api.QueryRoomsForUserResponse) error {
 	roomIDs, err := r.DB.GetRoomsByMembership(ctx, req.UserID, req.WantMembership)
 	if err != nil {
@@ -23,17 +23,22 @@ const (
 	RoomserverRemoveRoomAliasPath      = "/roomserver/removeRoomAlias"
 
 	// Input operations
-	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
+	RoomserverInputRoomEventsPath      = "/roomserver/inputRoomEvents"
+	RoomserverInputRoomEventDryRunPath = "/roomserver/inputRoomEventDryRun"
 
 	// Perform operations
-	RoomserverPerformInvitePath   = "/roomserver/performInvite"
-	RoomserverPerformPeekPath     = "/roomserver/performPeek"
-	RoomserverPerformUnpeekPath   = "/roomserver/performUnpeek"
-	RoomserverPerformJoinPath     = "/roomserver/performJoin"
-	RoomserverPerformLeavePath    = "/roomserver/performLeave"
-	RoomserverPerformBackfillPath = "/roomserver/performBackfill"
-	RoomserverPerformPublishPath  = "/roomserver/performPublish"
-	RoomserverPerformForgetPath   = "/roomserver/performForget"
+	RoomserverPerformInvitePath           = "/roomserver/performInvite"
+	RoomserverPerformPeekPath             = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath           = "/roomserver/performUnpeek"
+	RoomserverPerformJoinPath             = "/roomserver/performJoin"
+	RoomserverPerformLeavePath            = "/roomserver/performLeave"
+	RoomserverPerformBackfillPath         = "/roomserver/performBackfill"
+	RoomserverPerformPublishPath          = "/roomserver/performPublish"
+	RoomserverPerformForgetPath           = "/roomserver/performForget"
+	RoomserverPerformPurgeRoomPath        = "/roomserver/performPurgeRoom"
+	RoomserverPerformRoomUpgradePath      = "/roomserver/performRoomUpgrade"
+	RoomserverPerformRemoveLocalUsersPath = "/roomserver/performRemoveLocalUsers"
+	RoomserverPerformBlockRoomPath        = "/roomserver/performBlockRoom"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -50,6 +55,13 @@ const (
 	RoomserverQueryRoomVersionForRoomPath      = "/roomserver/queryRoomVersionForRoom"
 	RoomserverQueryPublishedRoomsPath          = "/roomserver/queryPublishedRooms"
 	RoomserverQueryCurrentStatePath            = "/roomserver/queryCurrentState"
+	RoomserverQueryNotificationContextPath     = "/roomserver/queryNotificationContext"
+	RoomserverQueryRoomUsagePath               = "/roomserver/queryRoomUsage"
+	RoomserverQueryRoomListPath                = "/roomserver/queryRoomList"
+	RoomserverQueryRoomThroughputPath          = "/roomserver/queryRoomThroughput"
+	RoomserverQueryEventsBySenderPath          = "/roomserver/queryEventsBySender"
+	RoomserverQueryRoomDAGPath                 = "/roomserver/queryRoomDAG"
+	RoomserverQueryTimestampToEventPath        = "/roomserver/queryTimestampToEvent"
 	RoomserverQueryRoomsForUserPath            = "/roomserver/queryRoomsForUser"
 	RoomserverQueryBulkStateContentPath        = "/roomserver/queryBulkStateContent"
 	RoomserverQuerySharedUsersPath             = "/roomserver/querySharedUsers"
@@ -61,7 +73,14 @@ const (
 type httpRoomserverInternalAPI struct {
 	roomserverURL string
 	httpClient    *http.Client
-	cache         caching.RoomVersionCache
+	cache         RoomserverClientCache
+}
+
+// RoomserverClientCache contains the caches used by the roomserver client to
+// avoid asking the roomserver for things which rarely change.
+type RoomserverClientCache interface {
+	caching.RoomVersionCache
+	caching.ServerACLCache
 }
 
 // NewRoomserverClient creates a RoomserverInputAPI implemented by talking to a HTTP POST API.
@@ -69,7 +88,7 @@ type httpRoomserverInternalAPI struct {
 func NewRoomserverClient(
 	roomserverURL string,
 	httpClient *http.Client,
-	cache caching.RoomVersionCache,
+	cache RoomserverClientCache,
 ) (api.RoomserverInternalAPI, error) {
 	if httpClient == nil {
 		return nil, errors.New("NewRoomserverInternalAPIHTTP: httpClient is <nil>")
@@ -170,6 +189,19 @@ func (h *httpRoomserverInternalAPI) InputRoomEvents(
 	}
 }
 
+// InputRoomEventDryRun implements RoomserverInputAPI
+func (h *httpRoomserverInternalAPI) InputRoomEventDryRun(
+	ctx context.Context,
+	request *api.InputRoomEventDryRunRequest,
+	response *api.InputRoomEventDryRunResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputRoomEventDryRun")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverInputRoomEventDryRunPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpRoomserverInternalAPI) PerformInvite(
 	ctx context.Context,
 	request *api.PerformInviteRequest,
@@ -464,6 +496,90 @@ func (h *httpRoomserverInternalAPI) QueryCurrentState(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpRoomserverInternalAPI) QueryNotificationContext(
+	ctx context.Context,
+	request *api.QueryNotificationContextRequest,
+	response *api.QueryNotificationContextResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryNotificationContext")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryNotificationContextPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomUsage(
+	ctx context.Context,
+	request *api.QueryRoomUsageRequest,
+	response *api.QueryRoomUsageResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomUsage")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomUsagePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomList(
+	ctx context.Context,
+	request *api.QueryRoomListRequest,
+	response *api.QueryRoomListResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomList")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomListPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomThroughput(
+	ctx context.Context,
+	request *api.QueryRoomThroughputRequest,
+	response *api.QueryRoomThroughputResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomThroughput")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomThroughputPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventsBySender(
+	ctx context.Context,
+	request *api.QueryEventsBySenderRequest,
+	response *api.QueryEventsBySenderResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventsBySender")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventsBySenderPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomDAG(
+	ctx context.Context,
+	request *api.QueryRoomDAGRequest,
+	response *api.QueryRoomDAGResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomDAG")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomDAGPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryTimestampToEvent(
+	ctx context.Context,
+	request *api.QueryTimestampToEventRequest,
+	response *api.QueryTimestampToEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryTimestampToEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryTimestampToEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpRoomserverInternalAPI) QueryRoomsForUser(
 	ctx context.Context,
 	request *api.QueryRoomsForUserRequest,
@@ -521,11 +637,20 @@ func (h *httpRoomserverInternalAPI) QueryAuthChain(
 func (h *httpRoomserverInternalAPI) QueryServerBannedFromRoom(
 	ctx context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse,
 ) error {
+	if banned, ok := h.cache.GetServerBannedFromRoom(req.RoomID, req.ServerName); ok {
+		res.Banned = banned
+		return nil
+	}
+
 	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerBannedFromRoom")
 	defer span.Finish()
 
 	apiURL := h.roomserverURL + RoomserverQueryServerBannedFromRoomPath
-	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err == nil {
+		h.cache.StoreServerBannedFromRoom(req.RoomID, req.ServerName, res.Banned)
+	}
+	return err
 }
 
 func (h *httpRoomserverInternalAPI) PerformForget(ctx context.Context, req *api.PerformForgetRequest, res *api.PerformForgetResponse) error {
@@ -536,3 +661,35 @@ func (h *httpRoomserverInternalAPI) PerformForget(ctx context.Context, req *api.
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 
 }
+
+func (h *httpRoomserverInternalAPI) PerformPurgeRoom(ctx context.Context, req *api.PerformPurgeRoomRequest, res *api.PerformPurgeRoomResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPurgeRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformPurgeRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) PerformRemoveLocalUsers(ctx context.Context, req *api.PerformRemoveLocalUsersRequest, res *api.PerformRemoveLocalUsersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRemoveLocalUsers")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformRemoveLocalUsersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) PerformBlockRoom(ctx context.Context, req *api.PerformBlockRoomRequest, res *api.PerformBlockRoomResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformBlockRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformBlockRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) PerformRoomUpgrade(ctx context.Context, req *api.PerformRoomUpgradeRequest, res *api.PerformRoomUpgradeResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRoomUpgrade")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformRoomUpgradePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
@@ -24,6 +24,19 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverInputRoomEventDryRunPath,
+		httputil.MakeInternalAPI("inputRoomEventDryRun", func(req *http.Request) util.JSONResponse {
+			var request api.InputRoomEventDryRunRequest
+			var response api.InputRoomEventDryRunResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.InputRoomEventDryRun(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(RoomserverPerformInvitePath,
 		httputil.MakeInternalAPI("performInvite", func(req *http.Request) util.JSONResponse {
 			var request api.PerformInviteRequest
@@ -276,6 +289,62 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(
+		RoomserverPerformPurgeRoomPath,
+		httputil.MakeInternalAPI("PerformPurgeRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformPurgeRoomRequest
+			var response api.PerformPurgeRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.PerformPurgeRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverPerformRoomUpgradePath,
+		httputil.MakeInternalAPI("PerformRoomUpgrade", func(req *http.Request) util.JSONResponse {
+			var request api.PerformRoomUpgradeRequest
+			var response api.PerformRoomUpgradeResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.PerformRoomUpgrade(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverPerformRemoveLocalUsersPath,
+		httputil.MakeInternalAPI("PerformRemoveLocalUsers", func(req *http.Request) util.JSONResponse {
+			var request api.PerformRemoveLocalUsersRequest
+			var response api.PerformRemoveLocalUsersResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.PerformRemoveLocalUsers(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(
+		RoomserverPerformBlockRoomPath,
+		httputil.MakeInternalAPI("PerformBlockRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformBlockRoomRequest
+			var response api.PerformBlockRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.PerformBlockRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(
 		RoomserverQueryRoomVersionCapabilitiesPath,
 		httputil.MakeInternalAPI("QueryRoomVersionCapabilities", func(req *http.Request) util.JSONResponse {
@@ -387,6 +456,97 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(RoomserverQueryNotificationContextPath,
+		httputil.MakeInternalAPI("queryNotificationContext", func(req *http.Request) util.JSONResponse {
+			request := api.QueryNotificationContextRequest{}
+			response := api.QueryNotificationContextResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryNotificationContext(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomUsagePath,
+		httputil.MakeInternalAPI("queryRoomUsage", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomUsageRequest{}
+			response := api.QueryRoomUsageResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomUsage(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomListPath,
+		httputil.MakeInternalAPI("queryRoomList", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomListRequest{}
+			response := api.QueryRoomListResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomList(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomThroughputPath,
+		httputil.MakeInternalAPI("queryRoomThroughput", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomThroughputRequest{}
+			response := api.QueryRoomThroughputResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomThroughput(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryEventsBySenderPath,
+		httputil.MakeInternalAPI("queryEventsBySender", func(req *http.Request) util.JSONResponse {
+			request := api.QueryEventsBySenderRequest{}
+			response := api.QueryEventsBySenderResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryEventsBySender(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryRoomDAGPath,
+		httputil.MakeInternalAPI("queryRoomDAG", func(req *http.Request) util.JSONResponse {
+			request := api.QueryRoomDAGRequest{}
+			response := api.QueryRoomDAGResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryRoomDAG(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(RoomserverQueryTimestampToEventPath,
+		httputil.MakeInternalAPI("queryTimestampToEvent", func(req *http.Request) util.JSONResponse {
+			request := api.QueryTimestampToEventRequest{}
+			response := api.QueryTimestampToEventResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.QueryTimestampToEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	internalAPIMux.Handle(RoomserverQueryRoomsForUserPath,
 		httputil.MakeInternalAPI("queryRoomsForUser", func(req *http.Request) util.JSONResponse {
 			request := api.QueryRoomsForUserRequest{}
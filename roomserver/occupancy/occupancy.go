@@ -0,0 +1,179 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package occupancy
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/sirupsen/logrus"
+)
+
+type RoomOccupancyDatabase interface {
+	// GetPublishedRooms returns a list of all rooms that are published in the room directory.
+	GetPublishedRooms(ctx context.Context) ([]string, error)
+	// RoomInfo returns room information for the given room ID, or nil if there is no room.
+	RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error)
+	// GetMembershipEventNIDsForRoom returns the membership event NIDs for the given room.
+	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool) ([]types.EventNID, error)
+}
+
+// RoomOccupancy keeps track of the joined member counts of the rooms that
+// are published in the room directory, along with a list of those rooms
+// which is kept ordered by joined member count. The counts are updated as
+// membership events are processed, so building the public rooms list does
+// not require counting and sorting every published room on each request.
+type RoomOccupancy struct {
+	db     RoomOccupancyDatabase
+	mutex  sync.RWMutex   // protects the below
+	counts map[string]int // room ID -> joined member count
+	order  []string       // room IDs, largest rooms first
+}
+
+func NewRoomOccupancy(db RoomOccupancyDatabase) *RoomOccupancy {
+	ctx := context.TODO()
+	o := &RoomOccupancy{
+		db:     db,
+		counts: make(map[string]int),
+	}
+	// Look up all of the published rooms and count their members.
+	rooms, err := db.GetPublishedRooms(ctx)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to get published rooms")
+	}
+	for _, roomID := range rooms {
+		count, err := o.joinedMemberCount(ctx, roomID)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get joined member count for room %q", roomID)
+		}
+		o.counts[roomID] = count
+		o.order = append(o.order, roomID)
+	}
+	sort.SliceStable(o.order, func(i, j int) bool {
+		return o.less(o.order[i], o.order[j])
+	})
+	return o
+}
+
+// OnRoomPublished should be called when a room is published to, or removed
+// from, the room directory.
+func (o *RoomOccupancy) OnRoomPublished(roomID string, published bool) {
+	if !published {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		if _, ok := o.counts[roomID]; ok {
+			o.remove(roomID)
+			delete(o.counts, roomID)
+		}
+		return
+	}
+	count, err := o.joinedMemberCount(context.TODO(), roomID)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get joined member count for room %q", roomID)
+	}
+	o.update(roomID, count, true)
+}
+
+// OnMembershipUpdate should be called once a membership change in a room
+// has been committed to the database. It does nothing if the room is not
+// published.
+func (o *RoomOccupancy) OnMembershipUpdate(roomID string) {
+	o.mutex.RLock()
+	_, ok := o.counts[roomID]
+	o.mutex.RUnlock()
+	if !ok {
+		return
+	}
+	count, err := o.joinedMemberCount(context.TODO(), roomID)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get joined member count for room %q", roomID)
+		return
+	}
+	o.update(roomID, count, false)
+}
+
+// PublishedRooms returns the room IDs of all published rooms, ordered by
+// joined member count with the largest rooms first, along with the joined
+// member count of each room.
+func (o *RoomOccupancy) PublishedRooms() ([]string, map[string]int) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	roomIDs := make([]string, len(o.order))
+	copy(roomIDs, o.order)
+	counts := make(map[string]int, len(o.counts))
+	for roomID, count := range o.counts {
+		counts[roomID] = count
+	}
+	return roomIDs, counts
+}
+
+// update sets the joined member count for the room and moves it into the
+// correct position in the ordered list. If add is false then rooms that
+// aren't already being tracked are ignored, as they may have been removed
+// from the room directory while the count was being worked out.
+func (o *RoomOccupancy) update(roomID string, count int, add bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if prev, ok := o.counts[roomID]; ok {
+		if prev == count {
+			return
+		}
+		o.remove(roomID)
+	} else if !add {
+		return
+	}
+	o.counts[roomID] = count
+	i := sort.Search(len(o.order), func(i int) bool {
+		return o.less(roomID, o.order[i])
+	})
+	o.order = append(o.order, "")
+	copy(o.order[i+1:], o.order[i:])
+	o.order[i] = roomID
+}
+
+// remove removes the room from the ordered list. The mutex must be held
+// and the room's count must not have been changed yet.
+func (o *RoomOccupancy) remove(roomID string) {
+	i := sort.Search(len(o.order), func(i int) bool {
+		return !o.less(o.order[i], roomID)
+	})
+	if i < len(o.order) && o.order[i] == roomID {
+		o.order = append(o.order[:i], o.order[i+1:]...)
+	}
+}
+
+// less returns true if room a should be ordered before room b. Rooms with
+// the same number of joined members are ordered by room ID so that the
+// ordering is stable between requests.
+func (o *RoomOccupancy) less(a, b string) bool {
+	if o.counts[a] != o.counts[b] {
+		return o.counts[a] > o.counts[b]
+	}
+	return a < b
+}
+
+func (o *RoomOccupancy) joinedMemberCount(ctx context.Context, roomID string) (int, error) {
+	info, err := o.db.RoomInfo(ctx, roomID)
+	if err != nil || info == nil {
+		return 0, err
+	}
+	nids, err := o.db.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, false)
+	if err != nil {
+		return 0, err
+	}
+	return len(nids), nil
+}
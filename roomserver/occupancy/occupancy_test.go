@@ -0,0 +1,85 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package occupancy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+type testDatabase struct {
+	published []string
+	roomNIDs  map[string]types.RoomNID
+	joined    map[types.RoomNID]int
+}
+
+func (d *testDatabase) GetPublishedRooms(ctx context.Context) ([]string, error) {
+	return d.published, nil
+}
+
+func (d *testDatabase) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	roomNID, ok := d.roomNIDs[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: roomNID}, nil
+}
+
+func (d *testDatabase) GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool) ([]types.EventNID, error) {
+	return make([]types.EventNID, d.joined[roomNID]), nil
+}
+
+func TestRoomOccupancyOrdering(t *testing.T) {
+	db := &testDatabase{
+		published: []string{"!a:test", "!b:test", "!c:test"},
+		roomNIDs:  map[string]types.RoomNID{"!a:test": 1, "!b:test": 2, "!c:test": 3, "!d:test": 4},
+		joined:    map[types.RoomNID]int{1: 1, 2: 5, 3: 5, 4: 3},
+	}
+	o := NewRoomOccupancy(db)
+	check := func(want []string) {
+		t.Helper()
+		got, counts := o.PublishedRooms()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got room order %v, want %v", got, want)
+		}
+		if len(counts) != len(want) {
+			t.Fatalf("got %d counts, want %d", len(counts), len(want))
+		}
+	}
+	check([]string{"!b:test", "!c:test", "!a:test"})
+
+	// Membership changes in published rooms move them around.
+	db.joined[1] = 10
+	o.OnMembershipUpdate("!a:test")
+	check([]string{"!a:test", "!b:test", "!c:test"})
+
+	// Membership changes in unpublished rooms are ignored.
+	o.OnMembershipUpdate("!d:test")
+	check([]string{"!a:test", "!b:test", "!c:test"})
+
+	// Publishing a room inserts it in the right place.
+	o.OnRoomPublished("!d:test", true)
+	check([]string{"!a:test", "!b:test", "!c:test", "!d:test"})
+	db.joined[4] = 6
+	o.OnMembershipUpdate("!d:test")
+	check([]string{"!a:test", "!d:test", "!b:test", "!c:test"})
+
+	// Unpublishing a room removes it.
+	o.OnRoomPublished("!b:test", false)
+	check([]string{"!a:test", "!d:test", "!c:test"})
+}
@@ -15,6 +15,8 @@
 package roomserver
 
 import (
+	"context"
+
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/inthttp"
@@ -49,13 +51,34 @@ func NewInternalAPI(
 		perspectiveServerNames = append(perspectiveServerNames, kp.ServerName)
 	}
 
-	roomserverDB, err := storage.Open(&cfg.Database, base.Caches)
+	roomserverDB, err := storage.Open(&cfg.Database, cfg.EventJSONCompression, base.Caches)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
+	if cfg.RecompressEventJSON {
+		go func() {
+			rewritten, err := roomserverDB.RecompressEventJSON(context.Background())
+			if err != nil {
+				logrus.WithError(err).Error("Failed to recompress event JSON")
+				return
+			}
+			if rewritten > 0 {
+				logrus.WithField("events", rewritten).Info("Recompressed event JSON")
+			}
+		}()
+	}
+	go collectTableStatistics(roomserverDB)
 
-	return internal.NewRoomserverAPI(
+	rsAPI := internal.NewRoomserverAPI(
 		cfg, roomserverDB, producer, string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
 		base.Caches, keyRing, perspectiveServerNames,
 	)
+	// Finish processing any input events that were interrupted when we last
+	// stopped, before we accept any new ones.
+	if err = rsAPI.ReplayJournal(context.Background()); err != nil {
+		logrus.WithError(err).Error("Failed to replay journalled input events")
+	}
+	go rsAPI.RunEventExpiry()
+	go rsAPI.Queryer.Throughput.RunMetrics()
+	return rsAPI
 }
@@ -4,23 +4,35 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/internal/test"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/expiry"
 	"github.com/matrix-org/dendrite/roomserver/internal"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 const (
@@ -39,6 +51,8 @@ var (
 type dummyProducer struct {
 	topic            string
 	producedMessages []*api.OutputEvent
+	// If set, new room events of this type fail to be produced.
+	failEventType string
 }
 
 // SendMessage produces a given message, and returns only when it either has
@@ -56,6 +70,9 @@ func (p *dummyProducer) SendMessage(msg *sarama.ProducerMessage) (partition int3
 	if err != nil {
 		return 0, 0, err
 	}
+	if p.failEventType != "" && out.NewRoomEvent != nil && out.NewRoomEvent.Event.Type() == p.failEventType {
+		return 0, 0, fmt.Errorf("failed to produce %s event", p.failEventType)
+	}
 	p.producedMessages = append(p.producedMessages, &out)
 	return 0, 0, nil
 }
@@ -65,8 +82,14 @@ func (p *dummyProducer) SendMessage(msg *sarama.ProducerMessage) (partition int3
 // can succeed and fail individually; if some succeed and some fail,
 // SendMessages will return an error.
 func (p *dummyProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var errs sarama.ProducerErrors
 	for _, m := range msgs {
-		p.SendMessage(m)
+		if _, _, err := p.SendMessage(m); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: m, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
@@ -84,6 +107,12 @@ func deleteDatabase() {
 	if err != nil {
 		fmt.Printf("failed to delete database %s: %s\n", roomserverDBFilePath, err)
 	}
+	// A stale write-ahead log would be replayed into the next database.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err = os.Remove(roomserverDBFilePath + suffix); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("failed to delete %s: %s\n", roomserverDBFilePath+suffix, err)
+		}
+	}
 }
 
 type fledglingEvent struct {
@@ -126,7 +155,13 @@ func mustCreateEvents(t *testing.T, roomVer gomatrixserverlib.RoomVersion, event
 			}
 		}
 		eb.AuthEvents = authEvents
-		signedEvent, err := eb.Build(time.Now(), testOrigin, "ed25519:test", key, roomVer)
+		// Sign the event as the sender's server, which is testOrigin unless
+		// the test is pretending that the event came over federation.
+		_, origin, err := gomatrixserverlib.SplitID('@', ev.Sender)
+		if err != nil {
+			t.Fatalf("mustCreateEvent: invalid sender %q: %s", ev.Sender, err)
+		}
+		signedEvent, err := eb.Build(time.Now(), origin, "ed25519:test", key, roomVer)
 		if err != nil {
 			t.Fatalf("mustCreateEvent: failed to sign event: %s", err)
 		}
@@ -161,6 +196,8 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
 	cfg.Global.ServerName = testOrigin
+	cfg.Global.KeyID = "ed25519:test"
+	cfg.Global.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
 	cfg.Global.Kafka.UseNaffka = true
 	cfg.RoomServer.Database = config.DatabaseOptions{
 		ConnectionString: roomserverDBFileURI,
@@ -168,7 +205,7 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 	dp := &dummyProducer{
 		topic: cfg.Global.Kafka.TopicFor(config.TopicOutputRoomEvent),
 	}
-	cache, err := caching.NewInMemoryLRUCache(false)
+	cache, err := caching.NewInMemoryLRUCache(0, false)
 	if err != nil {
 		t.Fatalf("failed to make caches: %s", err)
 	}
@@ -176,7 +213,7 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 		Caches: cache,
 		Cfg:    cfg,
 	}
-	roomserverDB, err := storage.Open(&cfg.RoomServer.Database, base.Caches)
+	roomserverDB, err := storage.Open(&cfg.RoomServer.Database, cfg.RoomServer.EventJSONCompression, base.Caches)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
@@ -406,3 +443,1890 @@ func TestOutputRewritesState(t *testing.T) {
 		t.Errorf("Output event did not overwrite room state")
 	}
 }
+
+// This tests that events are stored and loaded with the right event IDs in
+// both the event format where the event ID is in the event JSON and the one
+// where it is derived from the reference hash.
+func TestStoreEventRoomVersions(t *testing.T) {
+	cache, err := caching.NewInMemoryLRUCache(0, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	deleteDatabase()
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString: roomserverDBFileURI,
+	}, "", cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer deleteDatabase()
+
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	rooms := map[gomatrixserverlib.RoomVersion][]*gomatrixserverlib.HeaderedEvent{
+		// The event IDs are in the event JSON.
+		gomatrixserverlib.RoomVersionV1: mustLoadRawEvents(t, gomatrixserverlib.RoomVersionV1, []json.RawMessage{
+			[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+			[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+		}),
+		// The event IDs are derived from the reference hash.
+		gomatrixserverlib.RoomVersionV6: mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+			{
+				RoomID: "!foo:" + string(testOrigin),
+				Sender: alice,
+				Content: map[string]interface{}{
+					"creator":      alice,
+					"room_version": "6",
+				},
+				StateKey: &emptyKey,
+				Type:     gomatrixserverlib.MRoomCreate,
+			},
+			{
+				RoomID:   "!foo:" + string(testOrigin),
+				Sender:   alice,
+				Content:  map[string]interface{}{"membership": "join"},
+				StateKey: &alice,
+				Type:     gomatrixserverlib.MRoomMember,
+			},
+		}),
+	}
+	for roomVer, events := range rooms {
+		var eventIDs []string
+		for _, ev := range events {
+			if _, _, _, _, err = db.StoreEvent(ctx, ev.Unwrap(), nil, nil, false, false); err != nil {
+				t.Fatalf("room version %s: failed to store event: %s", roomVer, err)
+			}
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		nids, err := db.EventNIDs(ctx, eventIDs)
+		if err != nil {
+			t.Fatalf("room version %s: failed to get event NIDs: %s", roomVer, err)
+		}
+		for _, eventID := range eventIDs {
+			loaded, err := db.Events(ctx, []types.EventNID{nids[eventID]})
+			if err != nil || len(loaded) != 1 {
+				t.Fatalf("room version %s: failed to load event %s: %v", roomVer, eventID, err)
+			}
+			if loaded[0].EventID() != eventID {
+				t.Errorf("room version %s: loaded event ID %s want %s", roomVer, loaded[0].EventID(), eventID)
+			}
+			if loaded[0].Version() != roomVer {
+				t.Errorf("room version %s: loaded event has room version %s", roomVer, loaded[0].Version())
+			}
+		}
+	}
+}
+
+// lockTimeoutDatabase fails to take the latest events lock the given number
+// of times, as if something else was holding it for too long.
+type lockTimeoutDatabase struct {
+	storage.Database
+	timeouts int
+}
+
+func (d *lockTimeoutDatabase) GetLatestEventsForUpdate(ctx context.Context, roomInfo types.RoomInfo) (*shared.LatestEventsUpdater, error) {
+	if d.timeouts > 0 {
+		d.timeouts--
+		return nil, fmt.Errorf("room NID %d: %w", roomInfo.RoomNID, shared.ErrLatestEventsLockTimeout)
+	}
+	return d.Database.GetLatestEventsForUpdate(ctx, roomInfo)
+}
+
+func TestLatestEventsLockTimeout(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!locktimeout:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "retried", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "replayed", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, dp := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	inputer := rsAPI.(*internal.RoomserverInternalAPI).Inputer
+	db := &lockTimeoutDatabase{Database: inputer.DB}
+	inputer.DB = db
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	latestEvents := func() []string {
+		var res api.QueryLatestEventsAndStateResponse
+		if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: roomID}, &res); err != nil {
+			t.Fatalf("QueryLatestEventsAndState failed: %s", err)
+		}
+		ids := make([]string, len(res.LatestEvents))
+		for i := range res.LatestEvents {
+			ids[i] = res.LatestEvents[i].EventID
+		}
+		return ids
+	}
+	sent := func(eventID string) bool {
+		for _, out := range dp.producedMessages {
+			if out.NewRoomEvent != nil && out.NewRoomEvent.Event.EventID() == eventID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A single timeout is retried straight away.
+	db.timeouts = 1
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[2:3], testOrigin, nil); err != nil {
+		t.Fatalf("expected the lock timeout to be retried, got %s", err)
+	}
+	if got := latestEvents(); len(got) != 1 || got[0] != events[2].EventID() || !sent(events[2].EventID()) {
+		t.Fatalf("expected the retried event to be the latest event and sent, got %v", got)
+	}
+
+	// If the lock can't be taken at all, the event is kept in the journal
+	// rather than being lost, and is processed when the journal is replayed.
+	db.timeouts = 100
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[3:], testOrigin, nil); err == nil || !strings.Contains(err.Error(), shared.ErrLatestEventsLockTimeout.Error()) {
+		t.Fatalf("expected the lock to time out, got %v", err)
+	}
+	if sent(events[3].EventID()) {
+		t.Fatalf("event was sent even though the lock was never taken")
+	}
+	journalled, err := db.JournalledInputs(ctx)
+	if err != nil {
+		t.Fatalf("JournalledInputs failed: %s", err)
+	}
+	if len(journalled) != 1 {
+		t.Fatalf("expected the event to be kept in the journal, got %d entries", len(journalled))
+	}
+	db.timeouts = 0
+	if err = inputer.ReplayJournal(ctx); err != nil {
+		t.Fatalf("ReplayJournal failed: %s", err)
+	}
+	if got := latestEvents(); len(got) != 1 || got[0] != events[3].EventID() || !sent(events[3].EventID()) {
+		t.Fatalf("expected the replayed event to be the latest event and sent, got %v", got)
+	}
+	if journalled, err = db.JournalledInputs(ctx); err != nil || len(journalled) != 0 {
+		t.Fatalf("expected the journal to be empty after replaying, got %d entries (%v)", len(journalled), err)
+	}
+}
+
+func TestPerformRoomUpgrade(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	roomID := "!upgrade:" + string(testOrigin)
+	alias := "#upgrade:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV5, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "5"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"users": map[string]int64{alice: 100}},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomPowerLevels,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "ban"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	if err := rsAPI.SetRoomAlias(ctx, &api.SetRoomAliasRequest{
+		UserID: alice,
+		Alias:  alias,
+		RoomID: roomID,
+	}, &api.SetRoomAliasResponse{}); err != nil {
+		t.Fatalf("failed to SetRoomAlias: %s", err)
+	}
+
+	var upgradeRes api.PerformRoomUpgradeResponse
+	if err := rsAPI.PerformRoomUpgrade(ctx, &api.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      bob,
+		RoomVersion: gomatrixserverlib.RoomVersionV6,
+	}, &upgradeRes); err != nil {
+		t.Fatalf("PerformRoomUpgrade failed: %s", err)
+	}
+	if upgradeRes.Error == nil || upgradeRes.Error.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("banned user was allowed to upgrade the room: %+v", upgradeRes)
+	}
+
+	upgradeRes = api.PerformRoomUpgradeResponse{}
+	if err := rsAPI.PerformRoomUpgrade(ctx, &api.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      alice,
+		RoomVersion: gomatrixserverlib.RoomVersionV6,
+	}, &upgradeRes); err != nil {
+		t.Fatalf("PerformRoomUpgrade failed: %s", err)
+	}
+	if upgradeRes.Error != nil {
+		t.Fatalf("PerformRoomUpgrade returned an error: %+v", upgradeRes.Error)
+	}
+	newRoomID := upgradeRes.NewRoomID
+
+	oldState := mustQueryState(t, rsAPI, roomID)
+	tombstone, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: "m.room.tombstone"}]
+	if !ok {
+		t.Fatalf("old room has no tombstone")
+	}
+	if got := gjson.GetBytes(tombstone.Content(), "replacement_room").Str; got != newRoomID {
+		t.Errorf("tombstone points at %q, want %q", got, newRoomID)
+	}
+	if got := gjson.GetBytes(oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}].Content(), "events_default").Int(); got != 50 {
+		t.Errorf("old room has events_default %d, want 50", got)
+	}
+
+	newState := mustQueryState(t, rsAPI, newRoomID)
+	create := newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate}]
+	if create == nil || create.Version() != gomatrixserverlib.RoomVersionV6 {
+		t.Fatalf("new room has the wrong create event: %v", create)
+	}
+	if got := gjson.GetBytes(create.Content(), "predecessor.event_id").Str; got != tombstone.EventID() {
+		t.Errorf("new room's predecessor is %q, want %q", got, tombstone.EventID())
+	}
+	if _, ok = newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules}]; !ok {
+		t.Errorf("join rules were not copied to the new room")
+	}
+	if ban := newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: bob}]; ban == nil {
+		t.Errorf("ban was not copied to the new room")
+	} else if membership, _ := ban.Membership(); membership != gomatrixserverlib.Ban {
+		t.Errorf("banned user has membership %q in the new room", membership)
+	}
+	if got := gjson.GetBytes(newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}].Content(), "users").Raw; got != `{"`+alice+`":100}` {
+		t.Errorf("new room has users power levels %s", got)
+	}
+
+	var aliasRes api.GetRoomIDForAliasResponse
+	if err := rsAPI.GetRoomIDForAlias(ctx, &api.GetRoomIDForAliasRequest{Alias: alias}, &aliasRes); err != nil {
+		t.Fatalf("GetRoomIDForAlias failed: %s", err)
+	}
+	if aliasRes.RoomID != newRoomID {
+		t.Errorf("alias points at %q, want %q", aliasRes.RoomID, newRoomID)
+	}
+
+	// Joining the old room should join the new room instead, unless the user
+	// is still in the old room.
+	for userID, wantRoomID := range map[string]string{
+		"@carol:" + string(testOrigin): newRoomID,
+		alice:                          roomID,
+	} {
+		var joinRes api.PerformJoinResponse
+		rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+			RoomIDOrAlias: roomID,
+			UserID:        userID,
+		}, &joinRes)
+		if joinRes.Error != nil {
+			t.Fatalf("PerformJoin for %s returned an error: %+v", userID, joinRes.Error)
+		}
+		if joinRes.RoomID != wantRoomID {
+			t.Errorf("%s joined %q, want %q", userID, joinRes.RoomID, wantRoomID)
+		}
+	}
+}
+
+func TestPerformRoomUpgradeTombstoneFails(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!upgradefail:" + string(testOrigin)
+	alias := "#upgradefail:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV5, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "5"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, dp := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	if err := rsAPI.SetRoomAlias(ctx, &api.SetRoomAliasRequest{
+		UserID: alice,
+		Alias:  alias,
+		RoomID: roomID,
+	}, &api.SetRoomAliasResponse{}); err != nil {
+		t.Fatalf("failed to SetRoomAlias: %s", err)
+	}
+	var publishRes api.PerformPublishResponse
+	rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: roomID, Visibility: "public"}, &publishRes)
+	if publishRes.Error != nil {
+		t.Fatalf("PerformPublish returned an error: %+v", publishRes.Error)
+	}
+
+	dp.failEventType = "m.room.tombstone"
+	var upgradeRes api.PerformRoomUpgradeResponse
+	if err := rsAPI.PerformRoomUpgrade(ctx, &api.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      alice,
+		RoomVersion: gomatrixserverlib.RoomVersionV6,
+	}, &upgradeRes); err == nil {
+		t.Fatalf("expected PerformRoomUpgrade to fail when the tombstone can't be sent")
+	}
+
+	// The old room is still the one in use, so it keeps its alias and its
+	// place in the room directory.
+	if _, ok := mustQueryState(t, rsAPI, roomID)[gomatrixserverlib.StateKeyTuple{EventType: "m.room.tombstone"}]; ok {
+		t.Fatalf("old room has a tombstone")
+	}
+	var aliasRes api.GetRoomIDForAliasResponse
+	if err := rsAPI.GetRoomIDForAlias(ctx, &api.GetRoomIDForAliasRequest{Alias: alias}, &aliasRes); err != nil {
+		t.Fatalf("GetRoomIDForAlias failed: %s", err)
+	}
+	if aliasRes.RoomID != roomID {
+		t.Errorf("alias points at %q, want %q", aliasRes.RoomID, roomID)
+	}
+	var publishedRes api.QueryPublishedRoomsResponse
+	if err := rsAPI.QueryPublishedRooms(ctx, &api.QueryPublishedRoomsRequest{}, &publishedRes); err != nil {
+		t.Fatalf("QueryPublishedRooms failed: %s", err)
+	}
+	if len(publishedRes.RoomIDs) != 1 || publishedRes.RoomIDs[0] != roomID {
+		t.Errorf("published rooms are %v, want [%s]", publishedRes.RoomIDs, roomID)
+	}
+}
+
+func mustQueryState(t *testing.T, rsAPI api.RoomserverInternalAPI, roomID string) map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	var res api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: roomID}, &res); err != nil {
+		t.Fatalf("QueryLatestEventsAndState failed: %s", err)
+	}
+	state := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent, len(res.StateEvents))
+	for _, ev := range res.StateEvents {
+		state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+	return state
+}
+
+func TestQueryEventsBySender(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	roomID := "!sender:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  bob,
+			Content: map[string]interface{}{"body": "first", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  bob,
+			Content: map[string]interface{}{"body": "second", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	var gotEventIDs []string
+	var res api.QueryEventsBySenderResponse
+	for page := 0; page == 0 || res.Next != 0; page++ {
+		if page > len(events) {
+			t.Fatalf("too many pages of events")
+		}
+		from := res.Next
+		res = api.QueryEventsBySenderResponse{}
+		if err := rsAPI.QueryEventsBySender(ctx, &api.QueryEventsBySenderRequest{
+			UserID: bob,
+			From:   from,
+			Limit:  2,
+		}, &res); err != nil {
+			t.Fatalf("QueryEventsBySender failed: %s", err)
+		}
+		for _, ev := range res.Events {
+			gotEventIDs = append(gotEventIDs, ev.EventID())
+		}
+	}
+	wantEventIDs := []string{events[5].EventID(), events[4].EventID(), events[3].EventID()}
+	if !reflect.DeepEqual(gotEventIDs, wantEventIDs) {
+		t.Errorf("got events %v, want %v", gotEventIDs, wantEventIDs)
+	}
+
+	res = api.QueryEventsBySenderResponse{}
+	if err := rsAPI.QueryEventsBySender(ctx, &api.QueryEventsBySenderRequest{
+		UserID: bob,
+		Since:  gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		Limit:  10,
+	}, &res); err != nil {
+		t.Fatalf("QueryEventsBySender failed: %s", err)
+	}
+	if len(res.Events) != 0 || res.Next != 0 {
+		t.Errorf("got %d events and next %d for the future, want none", len(res.Events), res.Next)
+	}
+}
+
+func TestQueryMissingEvents(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!missing:" + string(testOrigin)
+	emptyKey := ""
+	fledglings := []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	}
+	for i := 0; i < 4; i++ {
+		fledglings = append(fledglings, fledglingEvent{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": fmt.Sprintf("message %d", i), "msgtype": "m.text"},
+			Type:    "m.room.message",
+		})
+	}
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, fledglings)
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	testCases := []struct {
+		name     string
+		limit    int
+		minDepth int64
+		want     []*gomatrixserverlib.HeaderedEvent
+	}{
+		{"all", 10, 0, events[2:5]},
+		{"limit", 2, 0, events[3:5]},
+		{"min_depth", 10, events[3].Depth(), events[3:5]},
+	}
+	for _, tc := range testCases {
+		var res api.QueryMissingEventsResponse
+		if err := rsAPI.QueryMissingEvents(ctx, &api.QueryMissingEventsRequest{
+			EarliestEvents: []string{events[1].EventID()},
+			LatestEvents:   []string{events[5].EventID()},
+			Limit:          tc.limit,
+			MinDepth:       tc.minDepth,
+			ServerName:     testOrigin,
+		}, &res); err != nil {
+			t.Fatalf("%s: QueryMissingEvents failed: %s", tc.name, err)
+		}
+		got := map[string]bool{}
+		for _, ev := range res.Events {
+			got[ev.EventID()] = true
+		}
+		want := map[string]bool{}
+		for _, ev := range tc.want {
+			want[ev.EventID()] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got events %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestQueryRoomDAG(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!dag:" + string(testOrigin)
+	emptyKey := ""
+	fledglings := []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	}
+	for i := 0; i < 4; i++ {
+		fledglings = append(fledglings, fledglingEvent{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": fmt.Sprintf("message %d", i), "msgtype": "m.text"},
+			Type:    "m.room.message",
+		})
+	}
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, fledglings)
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	testCases := []struct {
+		name      string
+		fromDepth int64
+		toDepth   int64
+		limit     int
+		want      []*gomatrixserverlib.HeaderedEvent
+	}{
+		{"all", 0, 0, 10, events},
+		{"range", events[1].Depth(), events[3].Depth(), 10, events[1:4]},
+		{"limit", 0, 0, 2, events[4:]},
+	}
+	for _, tc := range testCases {
+		var res api.QueryRoomDAGResponse
+		if err := rsAPI.QueryRoomDAG(ctx, &api.QueryRoomDAGRequest{
+			RoomID:    roomID,
+			FromDepth: tc.fromDepth,
+			ToDepth:   tc.toDepth,
+			Limit:     tc.limit,
+		}, &res); err != nil {
+			t.Fatalf("%s: QueryRoomDAG failed: %s", tc.name, err)
+		}
+		if !res.RoomExists {
+			t.Fatalf("%s: expected room to exist", tc.name)
+		}
+		var gotEventIDs, wantEventIDs []string
+		for _, ev := range res.Events {
+			gotEventIDs = append(gotEventIDs, ev.EventID)
+			if ev.StateSnapshotNID == 0 {
+				t.Errorf("%s: event %s has no state snapshot", tc.name, ev.EventID)
+			}
+		}
+		for _, ev := range tc.want {
+			wantEventIDs = append(wantEventIDs, ev.EventID())
+		}
+		if !reflect.DeepEqual(gotEventIDs, wantEventIDs) {
+			t.Errorf("%s: got events %v, want %v", tc.name, gotEventIDs, wantEventIDs)
+		}
+		if want := []string{events[5].EventID()}; !reflect.DeepEqual(res.ForwardExtremities, want) {
+			t.Errorf("%s: got forward extremities %v, want %v", tc.name, res.ForwardExtremities, want)
+		}
+	}
+
+	var res api.QueryRoomDAGResponse
+	if err := rsAPI.QueryRoomDAG(ctx, &api.QueryRoomDAGRequest{
+		RoomID: "!unknown:" + string(testOrigin),
+		Limit:  10,
+	}, &res); err != nil {
+		t.Fatalf("QueryRoomDAG failed: %s", err)
+	}
+	if res.RoomExists || len(res.Events) != 0 {
+		t.Errorf("expected unknown room not to exist")
+	}
+}
+
+func TestInputRoomEventDryRun(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	roomID := "!dryrun:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  bob,
+			Content: map[string]interface{}{"body": "not joined", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	testCases := []struct {
+		name      string
+		event     *gomatrixserverlib.HeaderedEvent
+		decision  string
+		failedAt  string
+		stepNames []string
+	}{
+		{
+			name:     "allowed",
+			event:    events[2],
+			decision: api.DryRunAccepted,
+			stepNames: []string{
+				api.DryRunStepSignatures, api.DryRunStepAuthEvents, api.DryRunStepStateBeforeEvent,
+				api.DryRunStepAuthStateBeforeEvent, api.DryRunStepCurrentState,
+			},
+		},
+		{
+			name:     "sender not joined",
+			event:    events[3],
+			decision: api.DryRunRejected,
+			failedAt: api.DryRunStepAuthEvents,
+			// The prev event of this event was never stored, so the state
+			// before it can't be worked out.
+			stepNames: []string{
+				api.DryRunStepSignatures, api.DryRunStepAuthEvents, api.DryRunStepStateBeforeEvent,
+				api.DryRunStepCurrentState,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		var res api.InputRoomEventDryRunResponse
+		if err := rsAPI.InputRoomEventDryRun(ctx, &api.InputRoomEventDryRunRequest{
+			InputRoomEvent: api.InputRoomEvent{
+				Kind:         api.KindNew,
+				Event:        tc.event,
+				AuthEventIDs: tc.event.AuthEventIDs(),
+			},
+		}, &res); err != nil {
+			t.Fatalf("%s: InputRoomEventDryRun failed: %s", tc.name, err)
+		}
+		if !res.RoomExists || res.AlreadyExists {
+			t.Errorf("%s: got room exists %v, already exists %v", tc.name, res.RoomExists, res.AlreadyExists)
+		}
+		if res.Decision != tc.decision {
+			t.Errorf("%s: got decision %q, want %q", tc.name, res.Decision, tc.decision)
+		}
+		var stepNames []string
+		for _, step := range res.Steps {
+			stepNames = append(stepNames, step.Name)
+			if step.Name == tc.failedAt && (step.Passed || step.Error == "") {
+				t.Errorf("%s: expected step %s to fail with an error", tc.name, step.Name)
+			}
+		}
+		if !reflect.DeepEqual(stepNames, tc.stepNames) {
+			t.Errorf("%s: got steps %v, want %v", tc.name, stepNames, tc.stepNames)
+		}
+	}
+
+	// Nothing should have been stored by the dry runs.
+	var eventsRes api.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+		EventIDs: []string{events[2].EventID(), events[3].EventID()},
+	}, &eventsRes); err != nil {
+		t.Fatalf("QueryEventsByID failed: %s", err)
+	}
+	if len(eventsRes.Events) != 0 {
+		t.Errorf("expected dry runs not to store events, got %d events", len(eventsRes.Events))
+	}
+}
+
+func TestQueryTimestampToEvent(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!timestamp:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	last := events[len(events)-1]
+
+	testCases := []struct {
+		name      string
+		ts        gomatrixserverlib.Timestamp
+		backwards bool
+		want      string
+	}{
+		{"forwards from the start", 0, false, events[0].EventID()},
+		{"backwards from the end", last.OriginServerTS() + 1000, true, last.EventID()},
+		{"forwards from the end", last.OriginServerTS() + 1000, false, ""},
+		{"backwards from the start", events[0].OriginServerTS() - 1, true, ""},
+	}
+	for _, tc := range testCases {
+		var res api.QueryTimestampToEventResponse
+		if err := rsAPI.QueryTimestampToEvent(ctx, &api.QueryTimestampToEventRequest{
+			RoomID:    roomID,
+			Timestamp: tc.ts,
+			Backwards: tc.backwards,
+		}, &res); err != nil {
+			t.Fatalf("%s: QueryTimestampToEvent failed: %s", tc.name, err)
+		}
+		if !res.RoomExists {
+			t.Fatalf("%s: expected room to exist", tc.name)
+		}
+		if res.EventID != tc.want {
+			t.Errorf("%s: got event %q, want %q", tc.name, res.EventID, tc.want)
+		}
+	}
+
+	// The state after the first event should only contain the create event.
+	var res api.QueryTimestampToEventResponse
+	if err := rsAPI.QueryTimestampToEvent(ctx, &api.QueryTimestampToEventRequest{
+		RoomID:       roomID,
+		IncludeState: true,
+	}, &res); err != nil {
+		t.Fatalf("QueryTimestampToEvent failed: %s", err)
+	}
+	if len(res.StateEvents) != 1 || res.StateEvents[0].EventID() != events[0].EventID() {
+		t.Errorf("expected the state after the first event to be the create event, got %d events", len(res.StateEvents))
+	}
+}
+
+func TestExpireEvents(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!ephemeral:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"ttl": time.Hour.Milliseconds()},
+			StateKey: &emptyKey,
+			Type:     expiry.MRoomTTL,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, dp := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	inputer := rsAPI.(*internal.RoomserverInternalAPI).Inputer
+
+	// Nothing has expired yet.
+	expired, err := inputer.ExpireEvents(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("ExpireEvents failed: %s", err)
+	}
+	if expired != 0 {
+		t.Fatalf("expected no events to expire, got %d", expired)
+	}
+
+	// Only the message should expire, as state events are still needed.
+	dp.producedMessages = nil
+	expired, err = inputer.ExpireEvents(ctx, time.Now().Add(time.Hour*2))
+	if err != nil {
+		t.Fatalf("ExpireEvents failed: %s", err)
+	}
+	if expired != 1 {
+		t.Fatalf("expected 1 event to expire, got %d", expired)
+	}
+	message := events[len(events)-1]
+	if len(dp.producedMessages) != 1 || dp.producedMessages[0].Type != api.OutputTypeExpiredEvents {
+		t.Fatalf("expected an expired events output event, got %+v", dp.producedMessages)
+	}
+	if got := dp.producedMessages[0].ExpiredEvents.EventIDs; len(got) != 1 || got[0] != message.EventID() {
+		t.Errorf("expected the message to expire, got %v", got)
+	}
+	var res api.QueryEventsByIDResponse
+	if err = rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+		EventIDs: []string{message.EventID(), events[2].EventID()},
+	}, &res); err != nil {
+		t.Fatalf("QueryEventsByID failed: %s", err)
+	}
+	for _, ev := range res.Events {
+		content := string(ev.Content())
+		switch ev.EventID() {
+		case message.EventID():
+			if content != "{}" {
+				t.Errorf("expected the message content to be pruned, got %s", content)
+			}
+		default:
+			if content == "{}" {
+				t.Errorf("expected the TTL event to be kept")
+			}
+		}
+	}
+
+	// Events only expire once.
+	if expired, err = inputer.ExpireEvents(ctx, time.Now().Add(time.Hour*2)); err != nil {
+		t.Fatalf("ExpireEvents failed: %s", err)
+	}
+	if expired != 0 {
+		t.Errorf("expected no more events to expire, got %d", expired)
+	}
+}
+
+func TestStoreEventAsOutlier(t *testing.T) {
+	cache, err := caching.NewInMemoryLRUCache(0, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	deleteDatabase()
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString: roomserverDBFileURI,
+	}, "", cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer deleteDatabase()
+
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!outlier:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+	create, join := events[0], events[1]
+
+	if _, _, _, _, err = db.StoreEvent(ctx, create.Unwrap(), nil, nil, false, false); err != nil {
+		t.Fatalf("failed to store event: %s", err)
+	}
+	joinNID, err := db.StoreEventAsOutlier(ctx, join.Unwrap(), nil, true)
+	if err != nil {
+		t.Fatalf("failed to store outlier: %s", err)
+	}
+	roomInfo, err := db.RoomInfo(ctx, roomID)
+	if err != nil || roomInfo == nil {
+		t.Fatalf("failed to get room info: %v", err)
+	}
+
+	// check asserts whether the create event is referenced by the join event
+	// and whether the join event is an outlier and rejected.
+	check := func(name string, wantReferenced, wantOutlier, wantRejected bool) {
+		updater, uerr := db.GetLatestEventsForUpdate(ctx, *roomInfo)
+		if uerr != nil {
+			t.Fatalf("%s: failed to get latest events updater: %s", name, uerr)
+		}
+		referenced, uerr := updater.IsReferenced(create.EventReference())
+		if uerr != nil {
+			t.Fatalf("%s: failed to check if event is referenced: %s", name, uerr)
+		}
+		if uerr = updater.Rollback(); uerr != nil {
+			t.Fatalf("%s: failed to roll back updater: %s", name, uerr)
+		}
+		if referenced != wantReferenced {
+			t.Errorf("%s: got create event referenced %v, want %v", name, referenced, wantReferenced)
+		}
+		rejected, uerr := db.IsEventRejected(ctx, roomInfo.RoomNID, join.EventID())
+		if uerr != nil {
+			t.Fatalf("%s: failed to check if event is rejected: %s", name, uerr)
+		}
+		if rejected != wantRejected {
+			t.Errorf("%s: got join event rejected %v, want %v", name, rejected, wantRejected)
+		}
+		entries, uerr := db.RoomDAG(ctx, *roomInfo, join.Depth(), join.Depth(), 1)
+		if uerr != nil {
+			t.Fatalf("%s: failed to get room DAG: %s", name, uerr)
+		}
+		if len(entries) != 1 || entries[0].IsOutlier != wantOutlier {
+			t.Errorf("%s: got join event entries %+v, want outlier %v", name, entries, wantOutlier)
+		}
+	}
+
+	// An outlier doesn't reference its prev events, so it can't stop them
+	// from becoming forward extremities.
+	check("outlier", false, true, true)
+
+	// Storing the event again once its auth events are known brings it into
+	// the event graph and re-evaluates whether it was rejected.
+	if _, _, _, _, err = db.StoreEvent(ctx, join.Unwrap(), nil, nil, false, false); err != nil {
+		t.Fatalf("failed to store event: %s", err)
+	}
+	check("stored", true, false, false)
+
+	if err = db.MarkEventRejected(ctx, joinNID); err != nil {
+		t.Fatalf("failed to mark event as rejected: %s", err)
+	}
+	check("marked", true, false, true)
+}
+
+func TestSoftFailedEventsAreNotLatest(t *testing.T) {
+	cache, err := caching.NewInMemoryLRUCache(0, false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	deleteDatabase()
+	db, err := storage.Open(&config.DatabaseOptions{
+		ConnectionString: roomserverDBFileURI,
+	}, "", cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer deleteDatabase()
+
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!softfail:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+
+	var latest []types.StateAtEventAndReference
+	for i, ev := range events {
+		// Pretend that the last event was soft-failed.
+		softFailed := i == len(events)-1
+		_, stateAtEvent, _, _, serr := db.StoreEvent(ctx, ev.Unwrap(), nil, nil, false, softFailed)
+		if serr != nil {
+			t.Fatalf("failed to store event: %s", serr)
+		}
+		latest = append(latest, types.StateAtEventAndReference{
+			StateAtEvent:   stateAtEvent,
+			EventReference: ev.EventReference(),
+		})
+	}
+	roomInfo, err := db.RoomInfo(ctx, roomID)
+	if err != nil || roomInfo == nil {
+		t.Fatalf("failed to get room info: %v", err)
+	}
+
+	updater, err := db.GetLatestEventsForUpdate(ctx, *roomInfo)
+	if err != nil {
+		t.Fatalf("failed to get latest events updater: %s", err)
+	}
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, latest, 0, 0); err != nil {
+		t.Fatalf("failed to set latest events: %s", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("failed to commit latest events: %s", err)
+	}
+
+	refs, _, _, err := db.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		t.Fatalf("failed to get latest event IDs: %s", err)
+	}
+	if len(refs) != 1 || refs[0].EventID != events[0].EventID() {
+		t.Errorf("got latest events %v, want only %s", refs, events[0].EventID())
+	}
+}
+
+func TestContentScanning(t *testing.T) {
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		action := "allow"
+		if bytes.Contains(body, []byte("scanner-flag")) {
+			action = "flag"
+		} else if bytes.Contains(body, []byte("scanner-reject")) {
+			action = "reject"
+		}
+		_, _ = fmt.Fprintf(w, `{"action":%q,"reason":"scanner says %s"}`, action, action)
+	}))
+	defer scanner.Close()
+
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	roomID := "!scan:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "see https://good.example/page", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "scanner-flag", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID: roomID,
+			Sender: bob,
+			Content: map[string]interface{}{
+				"body": "link", "msgtype": "m.text", "format": "org.matrix.custom.html",
+				"formatted_body": `<a href="https://evil.example/page">link</a>`,
+			},
+			Type: "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  bob,
+			Content: map[string]interface{}{"body": "scanner-reject", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "image.png", "msgtype": "m.image", "url": "mxc://evil.example/abcdef"},
+			Type:    "m.room.message",
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, dp := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	contentScanner, err := input.NewContentScanner(&config.ContentScanning{
+		Enabled:          true,
+		EventTypes:       []string{"m.room.message"},
+		DenylistURLs:     []string{`^(https?|mxc)://evil\.example/`},
+		Action:           config.ContentScanActionReject,
+		ScannerURL:       scanner.URL,
+		ScannerTimeoutMS: 5000,
+	})
+	if err != nil {
+		t.Fatalf("failed to create content scanner: %s", err)
+	}
+	rsAPI.(*internal.RoomserverInternalAPI).Inputer.ContentScanner = contentScanner
+
+	for i, ev := range events[:len(events)-1] {
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{ev}, testOrigin, nil); err != nil {
+			t.Fatalf("failed to send event %d: %s", i, err)
+		}
+	}
+	// Messages from local users which are rejected are refused outright.
+	rejected := events[len(events)-1]
+	err = api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{rejected}, testOrigin, nil)
+	var notAllowed *gomatrixserverlib.NotAllowed
+	if !errors.As(err, &notAllowed) {
+		t.Fatalf("expected rejected message to fail with NotAllowed, got %v", err)
+	}
+	if !strings.Contains(notAllowed.Message, "mxc://evil.example/abcdef") {
+		t.Errorf("expected rejection to give the denylisted URL, got %q", notAllowed.Message)
+	}
+
+	// Messages from other servers which are rejected are soft-failed, so they
+	// are stored but nobody is told about them.
+	var output []string
+	for _, msg := range dp.producedMessages {
+		if msg.Type == api.OutputTypeNewRoomEvent {
+			output = append(output, msg.NewRoomEvent.Event.EventID())
+		}
+	}
+	var want []string
+	for _, ev := range events[:6] {
+		want = append(want, ev.EventID())
+	}
+	if !reflect.DeepEqual(output, want) {
+		t.Errorf("got output events %v, want %v", output, want)
+	}
+	var eventsRes api.QueryEventsByIDResponse
+	if err = rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+		EventIDs: []string{events[6].EventID(), events[7].EventID(), rejected.EventID()},
+	}, &eventsRes); err != nil {
+		t.Fatalf("QueryEventsByID failed: %s", err)
+	}
+	if len(eventsRes.Events) != 2 {
+		t.Errorf("expected the soft-failed messages to be stored and not the rejected one, got %d events", len(eventsRes.Events))
+	}
+}
+
+func TestContentScanningScannerDown(t *testing.T) {
+	// Nothing is listening at the scanner URL once the server is closed.
+	scanner := httptest.NewServer(http.NotFoundHandler())
+	scanner.Close()
+
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	roomID := "!scandown:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  bob,
+			Content: map[string]interface{}{"body": "hello from bob", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "hello from alice", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+	fromBob, fromAlice := events[4], events[5]
+
+	for _, rejectOnError := range []bool{false, true} {
+		deleteDatabase()
+		rsAPI, dp := mustCreateRoomserverAPI(t)
+		contentScanner, err := input.NewContentScanner(&config.ContentScanning{
+			Enabled:              true,
+			EventTypes:           []string{"m.room.message"},
+			Action:               config.ContentScanActionReject,
+			ScannerURL:           scanner.URL,
+			ScannerTimeoutMS:     5000,
+			RejectOnScannerError: rejectOnError,
+		})
+		if err != nil {
+			t.Fatalf("failed to create content scanner: %s", err)
+		}
+		rsAPI.(*internal.RoomserverInternalAPI).Inputer.ContentScanner = contentScanner
+
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, events[:5], testOrigin, nil); err != nil {
+			t.Fatalf("reject_on_scanner_error %v: failed to send events: %s", rejectOnError, err)
+		}
+		err = api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{fromAlice}, testOrigin, nil)
+		var notAllowed *gomatrixserverlib.NotAllowed
+		if rejectOnError != errors.As(err, &notAllowed) {
+			t.Errorf("reject_on_scanner_error %v: got error %v when sending a local message", rejectOnError, err)
+		}
+
+		output := make(map[string]bool)
+		for _, msg := range dp.producedMessages {
+			if msg.Type == api.OutputTypeNewRoomEvent {
+				output[msg.NewRoomEvent.Event.EventID()] = true
+			}
+		}
+		// If the scanner is down then messages are either all accepted or,
+		// if they must be scanned, none of them are sent out.
+		for _, ev := range []*gomatrixserverlib.HeaderedEvent{fromBob, fromAlice} {
+			if output[ev.EventID()] == rejectOnError {
+				t.Errorf("reject_on_scanner_error %v: message from %s output %v", rejectOnError, ev.Sender(), output[ev.EventID()])
+			}
+		}
+		deleteDatabase()
+	}
+}
+
+// mustCountRows returns the number of rows in each of the roomserver tables,
+// apart from those which are shared between all rooms.
+func mustCountRows(t *testing.T, db *sql.DB) map[string]int {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'roomserver_%'")
+	if err != nil {
+		t.Fatalf("failed to list tables: %s", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			t.Fatalf("failed to scan table name: %s", err)
+		}
+		tables = append(tables, table)
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatalf("failed to list tables: %s", err)
+	}
+	counts := make(map[string]int, len(tables))
+	for _, table := range tables {
+		switch table {
+		case "roomserver_event_types", "roomserver_event_state_keys":
+			continue
+		}
+		var count int
+		if err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("failed to count rows in %s: %s", table, err)
+		}
+		counts[table] = count
+	}
+	return counts
+}
+
+func TestPurgeRoom(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:remote.server"
+	keptRoomID := "!kept:" + string(testOrigin)
+	purgedRoomID := "!purged:remote.server"
+	emptyKey := ""
+	kept := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   keptRoomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   keptRoomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+	purged := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   purgedRoomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"creator": bob, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   purgedRoomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   purgedRoomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   purgedRoomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:  purgedRoomID,
+			Sender:  bob,
+			Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:   purgedRoomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "leave"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	rawDB, err := sql.Open(sqlutil.SQLiteDriverName(), roomserverDBFilePath)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer rawDB.Close() // nolint: errcheck
+
+	if err = api.SendEvents(ctx, rsAPI, api.KindNew, kept, testOrigin, nil); err != nil {
+		t.Fatalf("failed to send events: %s", err)
+	}
+	before := mustCountRows(t, rawDB)
+
+	// The room can't be purged while alice is still joined to it.
+	if err = api.SendEvents(ctx, rsAPI, api.KindNew, purged[:len(purged)-1], testOrigin, nil); err != nil {
+		t.Fatalf("failed to send events: %s", err)
+	}
+	joined := mustCountRows(t, rawDB)
+	var res api.PerformPurgeRoomResponse
+	if err = rsAPI.PerformPurgeRoom(ctx, &api.PerformPurgeRoomRequest{RoomID: purgedRoomID}, &res); err != nil {
+		t.Fatalf("PerformPurgeRoom failed: %s", err)
+	}
+	if res.Error == nil || res.Error.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("expected purge to be refused while a local user is joined, got %+v", res.Error)
+	}
+	if after := mustCountRows(t, rawDB); !reflect.DeepEqual(after, joined) {
+		t.Errorf("refused purge changed the tables: got %v, want %v", after, joined)
+	}
+
+	// Once alice has left, purging removes everything about the room.
+	if err = api.SendEvents(ctx, rsAPI, api.KindNew, purged[len(purged)-1:], testOrigin, nil); err != nil {
+		t.Fatalf("failed to send leave event: %s", err)
+	}
+	res = api.PerformPurgeRoomResponse{}
+	if err = rsAPI.PerformPurgeRoom(ctx, &api.PerformPurgeRoomRequest{RoomID: purgedRoomID}, &res); err != nil {
+		t.Fatalf("PerformPurgeRoom failed: %s", err)
+	}
+	if res.Error != nil {
+		t.Fatalf("PerformPurgeRoom returned an error: %+v", res.Error)
+	}
+	if after := mustCountRows(t, rawDB); !reflect.DeepEqual(after, before) {
+		t.Errorf("purge left rows behind: got %v, want %v", after, before)
+	}
+	if state := mustQueryState(t, rsAPI, keptRoomID); len(state) != 2 {
+		t.Errorf("expected the other room to be untouched, got %d state events", len(state))
+	}
+}
+
+func TestRoomAdmin(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	charlie := "@charlie:" + string(testOrigin)
+	roomID := "!admin:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"users": map[string]int64{alice: 100}},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomPowerLevels,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"name": "Admin test"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomName,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	var listRes api.QueryRoomListResponse
+	if err := rsAPI.QueryRoomList(ctx, &api.QueryRoomListRequest{Limit: 10}, &listRes); err != nil {
+		t.Fatalf("QueryRoomList failed: %s", err)
+	}
+	want := []api.RoomListEntry{{
+		RoomID:             roomID,
+		RoomVersion:        gomatrixserverlib.RoomVersionV6,
+		Name:               "Admin test",
+		JoinedMembers:      2,
+		JoinedLocalMembers: 2,
+	}}
+	if !reflect.DeepEqual(listRes.Rooms, want) {
+		t.Fatalf("QueryRoomList returned %+v, want %+v", listRes.Rooms, want)
+	}
+	listRes = api.QueryRoomListResponse{}
+	if err := rsAPI.QueryRoomList(ctx, &api.QueryRoomListRequest{From: roomID, Limit: 10}, &listRes); err != nil {
+		t.Fatalf("QueryRoomList failed: %s", err)
+	}
+	if len(listRes.Rooms) != 0 {
+		t.Errorf("expected no rooms after %s, got %+v", roomID, listRes.Rooms)
+	}
+
+	var removeRes api.PerformRemoveLocalUsersResponse
+	if err := rsAPI.PerformRemoveLocalUsers(ctx, &api.PerformRemoveLocalUsersRequest{
+		RoomID: roomID,
+		Block:  true,
+	}, &removeRes); err != nil {
+		t.Fatalf("PerformRemoveLocalUsers failed: %s", err)
+	}
+	if removeRes.Error != nil {
+		t.Fatalf("PerformRemoveLocalUsers returned error: %s", removeRes.Error)
+	}
+	if len(removeRes.RemovedUserIDs) != 2 || len(removeRes.FailedUserIDs) != 0 {
+		t.Errorf("expected alice and bob to be removed, got removed %v failed %v", removeRes.RemovedUserIDs, removeRes.FailedUserIDs)
+	}
+
+	listRes = api.QueryRoomListResponse{}
+	if err := rsAPI.QueryRoomList(ctx, &api.QueryRoomListRequest{RoomID: roomID}, &listRes); err != nil {
+		t.Fatalf("QueryRoomList failed: %s", err)
+	}
+	if len(listRes.Rooms) != 1 || !listRes.Rooms[0].Blocked || listRes.Rooms[0].JoinedMembers != 0 {
+		t.Errorf("expected room to be blocked with no members, got %+v", listRes.Rooms)
+	}
+
+	var joinRes api.PerformJoinResponse
+	rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        charlie,
+	}, &joinRes)
+	if joinRes.Error == nil || joinRes.Error.Code != api.PerformErrorNotAllowed {
+		t.Errorf("expected joining a blocked room to be refused, got %+v", joinRes.Error)
+	}
+
+	if err := rsAPI.PerformBlockRoom(ctx, &api.PerformBlockRoomRequest{
+		RoomID:  roomID,
+		Blocked: false,
+	}, &api.PerformBlockRoomResponse{}); err != nil {
+		t.Fatalf("PerformBlockRoom failed: %s", err)
+	}
+	listRes = api.QueryRoomListResponse{}
+	if err := rsAPI.QueryRoomList(ctx, &api.QueryRoomListRequest{RoomID: roomID}, &listRes); err != nil {
+		t.Fatalf("QueryRoomList failed: %s", err)
+	}
+	if len(listRes.Rooms) != 1 || listRes.Rooms[0].Blocked {
+		t.Errorf("expected room to be unblocked, got %+v", listRes.Rooms)
+	}
+
+	removeRes = api.PerformRemoveLocalUsersResponse{}
+	if err := rsAPI.PerformRemoveLocalUsers(ctx, &api.PerformRemoveLocalUsersRequest{
+		RoomID: "!unknown:" + string(testOrigin),
+	}, &removeRes); err != nil {
+		t.Fatalf("PerformRemoveLocalUsers failed: %s", err)
+	}
+	if removeRes.Error == nil || removeRes.Error.Code != api.PerformErrorNoRoom {
+		t.Errorf("expected unknown room to be reported, got %+v", removeRes.Error)
+	}
+}
+
+// mustCreateForkEvent creates an event with the given prev and auth events
+// rather than chaining it onto the previous event like mustCreateEvents does.
+func mustCreateForkEvent(t *testing.T, roomVer gomatrixserverlib.RoomVersion, ev fledglingEvent, depth int64, prevs, authEvents []string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     ev.Sender,
+		Depth:      depth,
+		Type:       ev.Type,
+		StateKey:   ev.StateKey,
+		RoomID:     ev.RoomID,
+		PrevEvents: prevs,
+		AuthEvents: authEvents,
+	}
+	if err := eb.SetContent(ev.Content); err != nil {
+		t.Fatalf("mustCreateForkEvent: failed to marshal event content %+v", ev.Content)
+	}
+	signedEvent, err := eb.Build(time.Now(), testOrigin, "ed25519:test", key, roomVer)
+	if err != nil {
+		t.Fatalf("mustCreateForkEvent: failed to sign event: %s", err)
+	}
+	return signedEvent.Headered(roomVer)
+}
+
+func TestPruneForwardExtremitiesKeepsState(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	roomID := "!prune:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"users": map[string]int64{alice: 100}},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomPowerLevels,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+	create, aliceJoin, powerLevels, bobJoin := events[0], events[1], events[2], events[4]
+	forkDepth := bobJoin.Depth() + 1
+	forkPrevs := []string{bobJoin.EventID()}
+
+	// Ban bob on one branch, then send messages on other branches with the
+	// same parent, so that the branch with the ban is the oldest extremity.
+	events = append(events, mustCreateForkEvent(t, gomatrixserverlib.RoomVersionV6, fledglingEvent{
+		RoomID:   roomID,
+		Sender:   alice,
+		Content:  map[string]interface{}{"membership": "ban"},
+		StateKey: &bob,
+		Type:     gomatrixserverlib.MRoomMember,
+	}, forkDepth, forkPrevs, []string{create.EventID(), powerLevels.EventID(), aliceJoin.EventID(), bobJoin.EventID()}))
+	for i := 0; i < 3; i++ {
+		events = append(events, mustCreateForkEvent(t, gomatrixserverlib.RoomVersionV6, fledglingEvent{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": fmt.Sprintf("message %d", i)},
+			Type:    "m.room.message",
+		}, forkDepth, forkPrevs, []string{create.EventID(), powerLevels.EventID(), aliceJoin.EventID()}))
+	}
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	rsAPI.(*internal.RoomserverInternalAPI).Inputer.MaxForwardExtremities = 2
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+
+	state := mustQueryState(t, rsAPI, roomID)
+	member := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: bob}]
+	if member == nil {
+		t.Fatalf("bob has no membership in the current state")
+	}
+	if membership, _ := member.Membership(); membership != gomatrixserverlib.Ban {
+		t.Errorf("bob's membership is %q, want %q", membership, gomatrixserverlib.Ban)
+	}
+
+	var res api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: roomID}, &res); err != nil {
+		t.Fatalf("QueryLatestEventsAndState failed: %s", err)
+	}
+	got := make(map[string]bool, len(res.LatestEvents))
+	for _, ref := range res.LatestEvents {
+		got[ref.EventID] = true
+	}
+	// The message branches have the same state, so all but the newest one
+	// should have been pruned, while the ban branch must be kept.
+	want := map[string]bool{
+		events[5].EventID():             true,
+		events[len(events)-1].EventID(): true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got forward extremities %v, want %v", got, want)
+	}
+}
+
+func TestRecompressEventJSONMixedCodecs(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	roomID := "!recompress:" + string(testOrigin)
+	emptyKey := ""
+	fledglings := []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	}
+	for i := 0; i < 4; i++ {
+		fledglings = append(fledglings, fledglingEvent{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"msgtype": "m.text", "body": fmt.Sprintf("message %d message %d message %d", i, i, i)},
+			Type:    "m.room.message",
+		})
+	}
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, fledglings)
+
+	deleteDatabase()
+	defer deleteDatabase()
+	mustOpen := func(compression config.EventJSONCompression) storage.Database {
+		t.Helper()
+		// Use a new cache each time so that the events are always loaded
+		// from the database.
+		cache, err := caching.NewInMemoryLRUCache(0, false)
+		if err != nil {
+			t.Fatalf("failed to make caches: %s", err)
+		}
+		db, err := storage.Open(&config.DatabaseOptions{
+			ConnectionString: roomserverDBFileURI,
+		}, compression, cache)
+		if err != nil {
+			t.Fatalf("failed to open database with %s: %s", compression, err)
+		}
+		return db
+	}
+	mustRecompress := func(db storage.Database, want int) {
+		t.Helper()
+		rewritten, err := db.RecompressEventJSON(ctx)
+		if err != nil {
+			t.Fatalf("RecompressEventJSON failed: %s", err)
+		}
+		if rewritten != want {
+			t.Errorf("RecompressEventJSON rewrote %d events, want %d", rewritten, want)
+		}
+		var eventIDs []string
+		for _, ev := range events {
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		loaded, err := db.EventsFromIDs(ctx, eventIDs)
+		if err != nil {
+			t.Fatalf("EventsFromIDs failed: %s", err)
+		}
+		if len(loaded) != len(events) {
+			t.Fatalf("loaded %d events, want %d", len(loaded), len(events))
+		}
+		for i, ev := range loaded {
+			if !bytes.Equal(ev.JSON(), events[i].JSON()) {
+				t.Errorf("event %s was changed by recompression", ev.EventID())
+			}
+		}
+	}
+
+	// Store a third of the events each without compression, with snappy and
+	// with zstd.
+	for i, compression := range []config.EventJSONCompression{
+		config.EventJSONCompressionNone,
+		config.EventJSONCompressionSnappy,
+		config.EventJSONCompressionZstd,
+	} {
+		db := mustOpen(compression)
+		for _, ev := range events[i*2 : i*2+2] {
+			if _, _, _, _, err := db.StoreEvent(ctx, ev.Unwrap(), nil, nil, false, false); err != nil {
+				t.Fatalf("failed to store event with %s: %s", compression, err)
+			}
+		}
+	}
+
+	// Only the events which weren't stored with zstd need rewriting, and
+	// doing it again shouldn't find anything else to do.
+	db := mustOpen(config.EventJSONCompressionZstd)
+	mustRecompress(db, 4)
+	mustRecompress(db, 0)
+
+	// Put back some uncompressed event JSON. It's before the point that the
+	// recompression got to, so it isn't looked at again, but can still be read.
+	rawDB, err := sql.Open(sqlutil.SQLiteDriverName(), roomserverDBFilePath)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer rawDB.Close() // nolint: errcheck
+	if _, err = rawDB.Exec(
+		"UPDATE roomserver_event_json SET event_json = $1 WHERE event_nid = (SELECT MIN(event_nid) FROM roomserver_event_json)",
+		string(events[0].JSON()),
+	); err != nil {
+		t.Fatalf("failed to update event JSON: %s", err)
+	}
+	mustRecompress(db, 0)
+
+	// Changing the compression starts again from the beginning.
+	db = mustOpen(config.EventJSONCompressionSnappy)
+	mustRecompress(db, len(events))
+}
@@ -535,6 +535,27 @@ func (v StateResolution) CalculateAndStoreStateBeforeEvent(
 	return v.CalculateAndStoreStateAfterEvents(ctx, prevStates)
 }
 
+// CalculateStateBeforeEvent works out the state of a room before an event in
+// the same way as CalculateAndStoreStateBeforeEvent, but without storing it.
+// Returns the state at each of the prev events, the sorted state before the
+// event, the algorithm that was used and the number of conflicted state keys.
+func (v StateResolution) CalculateStateBeforeEvent(
+	ctx context.Context,
+	event *gomatrixserverlib.Event,
+) (prevStates []types.StateAtEvent, state []types.StateEntry, algorithm string, conflictLength int, err error) {
+	prevStates, err = v.db.StateAtEventIDs(ctx, event.PrevEventIDs())
+	if err != nil {
+		err = fmt.Errorf("v.db.StateAtEventIDs: %w", err)
+		return
+	}
+	if len(prevStates) == 0 {
+		algorithm = "empty_state"
+		return
+	}
+	state, algorithm, conflictLength, err = v.calculateStateAfterManyEvents(ctx, v.roomInfo.RoomVersion, prevStates)
+	return
+}
+
 // CalculateAndStoreStateAfterEvents finds the room state after the given events.
 // Stores the resulting state in the database and returns a numeric ID for that snapshot.
 func (v StateResolution) CalculateAndStoreStateAfterEvents(
@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package roomserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// How often to update the table statistics. Counting rows can be slow on
+// SQLite so we don't want to do this too often.
+const tableStatisticsInterval = time.Minute * 5
+
+var tableRows = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "table_rows",
+		Help:      "The approximate number of rows in the roomserver table",
+	},
+	[]string{"table"},
+)
+
+var tableSizeBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "table_size_bytes",
+		Help:      "The size of the roomserver table on disk including indexes, if known",
+	},
+	[]string{"table"},
+)
+
+func init() {
+	prometheus.MustRegister(tableRows, tableSizeBytes)
+}
+
+// collectTableStatistics periodically updates the table statistics metrics.
+// It never returns.
+func collectTableStatistics(db storage.Database) {
+	for {
+		stats, err := db.TableStatistics(context.Background())
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to collect roomserver table statistics")
+		}
+		for _, stat := range stats {
+			tableRows.WithLabelValues(stat.Table).Set(float64(stat.Rows))
+			if stat.SizeBytes >= 0 {
+				tableSizeBytes.WithLabelValues(stat.Table).Set(float64(stat.SizeBytes))
+			}
+		}
+		time.Sleep(tableStatisticsInterval)
+	}
+}
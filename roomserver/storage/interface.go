@@ -68,10 +68,18 @@ type Database interface {
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
+	// Soft-failed events are never made forward extremities. Whether an event is soft-failed is only recorded when it is first stored.
 	StoreEvent(
 		ctx context.Context, event *gomatrixserverlib.Event, txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
-		isRejected bool,
+		isRejected, softFailed bool,
 	) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
+	// StoreEventAsOutlier stores an event without state, returning its numeric ID. The prev events of outliers
+	// aren't recorded as referenced, so they don't affect the latest events of the room.
+	StoreEventAsOutlier(ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected bool) (types.EventNID, error)
+	// MarkEventRejected marks an event which has already been stored as rejected.
+	MarkEventRejected(ctx context.Context, eventNID types.EventNID) error
+	// IsEventRejected returns whether the event in the room was rejected, or sql.ErrNoRows if it isn't stored.
+	IsEventRejected(ctx context.Context, roomNID types.RoomNID, eventID string) (bool, error)
 	// Look up the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
 	// Returns a types.MissingEventError if the event IDs aren't in the database.
@@ -92,6 +100,12 @@ type Database interface {
 	// Returns the latest events in the room and the last eventID sent to the log along with an updater.
 	// If this returns an error then no further action is required.
 	GetLatestEventsForUpdate(ctx context.Context, roomInfo types.RoomInfo) (*shared.LatestEventsUpdater, error)
+	// Look up the latest events in a room and the current state snapshot without locking the room.
+	// The result may be out of date by the time it is used, so it must be checked against the
+	// updater from GetLatestEventsForUpdate before anything is written based on it.
+	LatestEvents(ctx context.Context, roomNID types.RoomNID) ([]types.StateAtEventAndReference, types.StateSnapshotNID, error)
+	// Look up whether an event has already been written to the output log, without locking the room.
+	HasEventBeenSent(ctx context.Context, eventNID types.EventNID) (bool, error)
 	// Look up event ID by transaction's info.
 	// This is used to determine if the room event is processed/processing already.
 	// Returns an empty string if no such event exists.
@@ -119,6 +133,10 @@ type Database interface {
 	// Remove a given room alias.
 	// Returns an error if there was a problem talking to the database.
 	RemoveRoomAlias(ctx context.Context, alias string) error
+	// Make all of the aliases of a room refer to another room instead, e.g.
+	// when the room is upgraded.
+	// Returns an error if there was a problem talking to the database.
+	MoveRoomAliases(ctx context.Context, oldRoomID, newRoomID string) error
 	// Build a membership updater for the target user in a room.
 	MembershipUpdater(ctx context.Context, roomID, targetUserID string, targetLocal bool, roomVersion gomatrixserverlib.RoomVersion) (*shared.MembershipUpdater, error)
 	// Lookup the membership of a given user in a given room.
@@ -160,4 +178,42 @@ type Database interface {
 	GetKnownRooms(ctx context.Context) ([]string, error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
 	ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error
+	// PurgeRoom removes all events, state, aliases, memberships and invites
+	// for a room. Returns types.ErrRoomHasLocalMembers if any local users
+	// are still joined to the room.
+	PurgeRoom(ctx context.Context, roomID string) error
+	// RecompressEventJSON rewrites any event JSON which wasn't stored using the configured
+	// compression algorithm, carrying on from where it last got to. Returns the number of
+	// events that were rewritten.
+	RecompressEventJSON(ctx context.Context) (int, error)
+	// RoomUsage returns the approximate storage usage of the given room, or nil if there is none.
+	RoomUsage(ctx context.Context, roomID string) (*types.RoomUsage, error)
+	// LargestRoomUsages returns the approximate storage usage of the rooms with the most event JSON stored.
+	LargestRoomUsages(ctx context.Context, limit int) ([]types.RoomUsage, error)
+	// EventsBySender returns up to limit events sent by the given user across all rooms, most recent first,
+	// starting before the given event NID, or from the most recent event if it is 0.
+	EventsBySender(ctx context.Context, userID string, beforeEventNID types.EventNID, limit int) ([]types.Event, error)
+	// RoomDAG returns up to limit events in the room with depths between fromDepth and toDepth inclusive,
+	// along with how they were stored, in order of depth. If there are too many events then the deepest are returned.
+	RoomDAG(ctx context.Context, roomInfo types.RoomInfo, fromDepth, toDepth int64, limit int) ([]types.RoomDAGEntry, error)
+	// EventByTimestamp returns the ID and origin_server_ts of the nearest event in the timeline of the room
+	// at or after ts if forwards is true, or at or before ts otherwise, or an empty event ID if there is none.
+	EventByTimestamp(ctx context.Context, roomInfo types.RoomInfo, ts gomatrixserverlib.Timestamp, forwards bool) (string, gomatrixserverlib.Timestamp, error)
+	// ExpireEvents prunes up to limit timeline events in the room which aren't state events and were sent
+	// before the given time, oldest first, so that their content is no longer stored. Returns the IDs of
+	// the events that were pruned.
+	ExpireEvents(ctx context.Context, roomInfo types.RoomInfo, before gomatrixserverlib.Timestamp, limit int) ([]string, error)
+	// TableStatistics returns the approximate row counts and sizes of the largest roomserver tables.
+	TableStatistics(ctx context.Context) ([]tables.TableStatistic, error)
+	// JournalInputEvents stores the JSON of input events before they are processed, so
+	// that they aren't lost if the roomserver stops first. Returns the journal ID of each.
+	JournalInputEvents(ctx context.Context, inputJSON [][]byte) ([]int64, error)
+	// ForgetJournalledInput removes an input event from the journal once it has been processed.
+	ForgetJournalledInput(ctx context.Context, id int64) error
+	// JournalledInputs returns the input events which were journalled but never processed, oldest first.
+	JournalledInputs(ctx context.Context) ([]types.JournalledInput, error)
+	// SetRoomBlocked blocks or unblocks a room. Local users can't join or be invited to blocked rooms.
+	SetRoomBlocked(ctx context.Context, roomID string, blocked bool) error
+	// IsRoomBlocked returns whether the room has been blocked.
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
 }
@@ -0,0 +1,82 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const blockedRoomsSchema = `
+-- Stores the rooms which have been blocked by a server administrator, which
+-- local users can't join or be invited to.
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+    room_id TEXT NOT NULL PRIMARY KEY
+);
+`
+
+const insertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id) VALUES ($1) ON CONFLICT (room_id) DO NOTHING"
+
+const deleteBlockedRoomSQL = "" +
+	"DELETE FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+const selectRoomBlockedSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+type blockedRoomsStatements struct {
+	insertBlockedRoomStmt *sql.Stmt
+	deleteBlockedRoomStmt *sql.Stmt
+	selectRoomBlockedStmt *sql.Stmt
+}
+
+func NewPostgresBlockedRoomsTable(db *sql.DB) (tables.BlockedRooms, error) {
+	s := &blockedRoomsStatements{}
+	_, err := db.Exec(blockedRoomsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertBlockedRoomStmt, insertBlockedRoomSQL},
+		{&s.deleteBlockedRoomStmt, deleteBlockedRoomSQL},
+		{&s.selectRoomBlockedStmt, selectRoomBlockedSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedRoomsStatements) InsertBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertBlockedRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) DeleteBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteBlockedRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) SelectRoomBlocked(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (bool, error) {
+	var count int
+	err := sqlutil.TxStmt(txn, s.selectRoomBlockedStmt).QueryRowContext(ctx, roomID).Scan(&count)
+	return count > 0, err
+}
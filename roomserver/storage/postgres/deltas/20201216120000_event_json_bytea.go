@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadEventJSONBytea(m *sqlutil.Migrations) {
+	m.AddMigration(UpEventJSONBytea, DownEventJSONBytea)
+}
+
+// UpEventJSONBytea converts the event JSON column to BYTEA so that it can hold
+// compressed event JSON. Existing rows are left as uncompressed UTF-8 JSON.
+func UpEventJSONBytea(tx *sql.Tx) error {
+	var dataType string
+	err := tx.QueryRow(
+		`SELECT data_type FROM information_schema.columns WHERE table_name = 'roomserver_event_json' AND column_name = 'event_json';`,
+	).Scan(&dataType)
+	if err == sql.ErrNoRows || dataType == "bytea" {
+		// The table doesn't exist yet or has already been created with the
+		// right column type, so there's nothing to do.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query column type: %w", err)
+	}
+	_, err = tx.Exec(`ALTER TABLE roomserver_event_json ALTER COLUMN event_json TYPE BYTEA USING convert_to(event_json, 'UTF8');`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+// DownEventJSONBytea converts the event JSON column back to TEXT. This will fail
+// if any event JSON is still compressed, so compression must be set to "none" and
+// all events recompressed before downgrading.
+func DownEventJSONBytea(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE roomserver_event_json ALTER COLUMN event_json TYPE TEXT USING convert_from(event_json, 'UTF8');`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
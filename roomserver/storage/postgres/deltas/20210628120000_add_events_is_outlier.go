@@ -0,0 +1,68 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAddEventsIsOutlier(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddEventsIsOutlier, DownAddEventsIsOutlier)
+}
+
+// UpAddEventsIsOutlier adds a flag to the events table for events which were
+// stored without state, outside of the contiguous part of the room DAG. Events
+// which were stored before the flag existed are outliers if we don't know the
+// state before them.
+func UpAddEventsIsOutlier(tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'roomserver_events');`,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query table: %w", err)
+	}
+	if !exists {
+		// The table will be created with the column.
+		return nil
+	}
+	var columnExists bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'roomserver_events' AND column_name = 'is_outlier');`,
+	).Scan(&columnExists)
+	if err != nil {
+		return fmt.Errorf("failed to query columns: %w", err)
+	}
+	if columnExists {
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE roomserver_events ADD COLUMN is_outlier BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE roomserver_events SET is_outlier = TRUE WHERE state_snapshot_nid = 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddEventsIsOutlier(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE roomserver_events DROP COLUMN IF EXISTS is_outlier;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
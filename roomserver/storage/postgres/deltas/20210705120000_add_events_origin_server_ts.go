@@ -0,0 +1,59 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAddEventsOriginServerTS(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddEventsOriginServerTS, DownAddEventsOriginServerTS)
+}
+
+// UpAddEventsOriginServerTS adds the origin_server_ts of each event to the
+// events table, so that the nearest event to a point in time can be found.
+// Existing events are left with a timestamp of 0, as it is only in their
+// (possibly compressed) event JSON.
+func UpAddEventsOriginServerTS(tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'roomserver_events');`,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query table: %w", err)
+	}
+	if !exists {
+		// The table will be created with the column and index.
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS origin_server_ts BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS roomserver_events_origin_server_ts_idx ON roomserver_events (room_nid, origin_server_ts);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddEventsOriginServerTS(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP INDEX IF EXISTS roomserver_events_origin_server_ts_idx;
+ALTER TABLE roomserver_events DROP COLUMN IF EXISTS origin_server_ts;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
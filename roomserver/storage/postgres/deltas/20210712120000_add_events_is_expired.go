@@ -0,0 +1,55 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAddEventsIsExpired(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddEventsIsExpired, DownAddEventsIsExpired)
+}
+
+// UpAddEventsIsExpired adds a flag to the events table for events which have
+// been pruned because they were older than the TTL of an ephemeral room.
+func UpAddEventsIsExpired(tx *sql.Tx) error {
+	var exists bool
+	err := tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'roomserver_events');`,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query table: %w", err)
+	}
+	if !exists {
+		// The table will be created with the column.
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS is_expired BOOLEAN NOT NULL DEFAULT FALSE;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddEventsIsExpired(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE roomserver_events DROP COLUMN IF EXISTS is_expired;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const recompressionSchema = `
+-- Stores how far the event JSON has been recompressed using the configured
+-- compression algorithm, so that recompression can carry on where it left
+-- off after a restart. There is at most one row, for the algorithm that was
+-- last used, since changing the algorithm means starting again.
+CREATE TABLE IF NOT EXISTS roomserver_event_json_recompression (
+    compression TEXT NOT NULL PRIMARY KEY,
+    -- All event JSON up to and including this event NID has been recompressed.
+    event_nid BIGINT NOT NULL
+);
+`
+
+const deleteOtherRecompressionSQL = "" +
+	"DELETE FROM roomserver_event_json_recompression WHERE compression != $1"
+
+const upsertRecompressionSQL = "" +
+	"INSERT INTO roomserver_event_json_recompression (compression, event_nid) VALUES ($1, $2)" +
+	" ON CONFLICT (compression) DO UPDATE SET event_nid = $2"
+
+const selectRecompressionSQL = "" +
+	"SELECT event_nid FROM roomserver_event_json_recompression WHERE compression = $1"
+
+type recompressionStatements struct {
+	deleteOtherRecompressionStmt *sql.Stmt
+	upsertRecompressionStmt      *sql.Stmt
+	selectRecompressionStmt      *sql.Stmt
+}
+
+func NewPostgresRecompressionTable(db *sql.DB) (tables.Recompression, error) {
+	s := &recompressionStatements{}
+	_, err := db.Exec(recompressionSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.deleteOtherRecompressionStmt, deleteOtherRecompressionSQL},
+		{&s.upsertRecompressionStmt, upsertRecompressionSQL},
+		{&s.selectRecompressionStmt, selectRecompressionSQL},
+	}.Prepare(db)
+}
+
+func (s *recompressionStatements) UpsertRecompression(
+	ctx context.Context, txn *sql.Tx, compression string, eventNID types.EventNID,
+) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteOtherRecompressionStmt).ExecContext(ctx, compression); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.upsertRecompressionStmt).ExecContext(ctx, compression, eventNID)
+	return err
+}
+
+func (s *recompressionStatements) SelectRecompression(
+	ctx context.Context, txn *sql.Tx, compression string,
+) (types.EventNID, error) {
+	var eventNID types.EventNID
+	err := sqlutil.TxStmt(txn, s.selectRecompressionStmt).QueryRowContext(ctx, compression).Scan(&eventNID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return eventNID, err
+}
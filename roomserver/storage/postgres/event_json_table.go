@@ -20,6 +20,7 @@ import (
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -32,13 +33,13 @@ CREATE TABLE IF NOT EXISTS roomserver_event_json (
     -- Local numeric ID for the event.
     event_nid BIGINT NOT NULL PRIMARY KEY,
     -- The JSON for the event.
-    -- Stored as TEXT because this should be valid UTF-8.
+    -- Stored as BYTEA because the event JSON may be compressed, depending
+    -- on the room_server.event_json_compression config option.
     -- Not stored as a JSONB because we always just pull the entire event
     -- so there is no point in postgres parsing it.
     -- Not stored as JSON because we already validate the JSON in the server
     -- so there is no point in postgres validating it.
-    -- TODO: Should we be compressing the events with Snappy or DEFLATE?
-    event_json TEXT NOT NULL
+    event_json BYTEA NOT NULL
 );
 `
 
@@ -54,9 +55,19 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+const selectEventJSONAfterSQL = "" +
+	"SELECT event_nid, event_json FROM roomserver_event_json" +
+	" WHERE event_nid > $1" +
+	" ORDER BY event_nid ASC LIMIT $2"
+
+const updateEventJSONSQL = "" +
+	"UPDATE roomserver_event_json SET event_json = $1 WHERE event_nid = $2 AND event_json = $3"
+
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt      *sql.Stmt
+	bulkSelectEventJSONStmt  *sql.Stmt
+	selectEventJSONAfterStmt *sql.Stmt
+	updateEventJSONStmt      *sql.Stmt
 }
 
 func NewPostgresEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
@@ -68,6 +79,8 @@ func NewPostgresEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectEventJSONAfterStmt, selectEventJSONAfterSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -103,3 +116,32 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) SelectEventJSONAfter(
+	ctx context.Context, afterEventNID types.EventNID, limit int,
+) ([]tables.EventJSONPair, error) {
+	rows, err := s.selectEventJSONAfterStmt.QueryContext(ctx, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventJSONAfter: rows.close() failed")
+
+	var results []tables.EventJSONPair
+	for rows.Next() {
+		var result tables.EventJSONPair
+		var eventNID int64
+		if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) UpdateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, oldEventJSON, newEventJSON []byte,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, newEventJSON, int64(eventNID), oldEventJSON)
+	return err
+}
@@ -45,6 +45,9 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     -- Local numeric ID for the state_key of the event
     -- This is 0 if the event is not a state event.
     event_state_key_nid BIGINT NOT NULL,
+    -- Local numeric ID for the sender of the event, from the state_key table.
+    -- This is 0 for events which were stored before senders were recorded.
+    sender_nid BIGINT NOT NULL DEFAULT 0,
     -- Whether the event has been written to the output log.
     sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
     -- Local numeric ID for the state at the event.
@@ -56,6 +59,9 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     state_snapshot_nid BIGINT NOT NULL DEFAULT 0,
     -- Depth of the event in the event graph.
     depth BIGINT NOT NULL,
+    -- The origin_server_ts of the event, for finding events by time.
+    -- This is 0 for events which were stored before timestamps were recorded.
+    origin_server_ts BIGINT NOT NULL DEFAULT 0,
     -- The textual event id.
     -- Used to lookup the numeric ID when processing requests.
     -- Needed for state resolution.
@@ -66,13 +72,29 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
 	auth_event_nids BIGINT[] NOT NULL,
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the event passed auth against the state before it but failed
+    -- against the current state of the room, in which case it mustn't become
+    -- a forward extremity or be sent to clients.
+    soft_failed BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the event was stored as an outlier, without state and outside
+    -- of the contiguous part of the event graph. Outliers don't reference
+    -- their prev events, so they can't affect the latest events of the room.
+    is_outlier BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the event has been pruned because it was older than the TTL
+    -- of an ephemeral room.
+    is_expired BOOLEAN NOT NULL DEFAULT FALSE
 );
+
+-- Lets the events sent by a user be found for moderation, most recent first.
+CREATE INDEX IF NOT EXISTS roomserver_events_sender_nid_idx ON roomserver_events (sender_nid, event_nid);
+-- Lets the nearest event in a room to a point in time be found.
+CREATE INDEX IF NOT EXISTS roomserver_events_origin_server_ts_idx ON roomserver_events (room_nid, origin_server_ts);
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, sender_nid, event_id, reference_sha256, auth_event_nids, depth, origin_server_ts, is_rejected, soft_failed, is_outlier)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -101,6 +123,15 @@ const selectEventSentToOutputSQL = "" +
 const updateEventSentToOutputSQL = "" +
 	"UPDATE roomserver_events SET sent_to_output = TRUE WHERE event_nid = $1"
 
+const updateEventRejectedSQL = "" +
+	"UPDATE roomserver_events SET is_rejected = $1 WHERE event_nid = $2"
+
+const updateEventOutlierSQL = "" +
+	"UPDATE roomserver_events SET is_outlier = $1 WHERE event_nid = $2"
+
+const selectEventRejectedSQL = "" +
+	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
+
 const selectEventIDSQL = "" +
 	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
 
@@ -123,6 +154,43 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const bulkSelectSoftFailedEventNIDSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE soft_failed = TRUE AND event_nid = ANY($1)"
+
+const selectEventNIDsBySenderSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE sender_nid = $1 AND event_nid < $2" +
+	" ORDER BY event_nid DESC LIMIT $3"
+
+const selectRoomDAGEntriesSQL = "" +
+	"SELECT event_nid, state_snapshot_nid, is_rejected, soft_failed, is_outlier FROM roomserver_events" +
+	" WHERE room_nid = $1 AND depth >= $2 AND depth <= $3" +
+	" ORDER BY depth DESC, event_nid DESC LIMIT $4"
+
+// Events without a state snapshot, which were rejected or which were soft-failed
+// aren't part of the timeline of the room, so they are never returned.
+const selectEventByTimestampForwardsSQL = "" +
+	"SELECT event_nid, event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2 AND origin_server_ts > 0" +
+	" AND is_outlier = FALSE AND is_rejected = FALSE AND soft_failed = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+const selectEventByTimestampBackwardsSQL = "" +
+	"SELECT event_nid, event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2 AND origin_server_ts > 0" +
+	" AND is_outlier = FALSE AND is_rejected = FALSE AND soft_failed = FALSE" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
+// Only events in the timeline of the room which aren't state events can expire,
+// as the rest are needed for auth and state resolution.
+const selectExpiredEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts < $2 AND origin_server_ts > 0" +
+	" AND event_state_key_nid = 0 AND is_outlier = FALSE AND is_expired = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT $3"
+
+const updateEventExpiredSQL = "" +
+	"UPDATE roomserver_events SET is_expired = TRUE WHERE event_nid = $1"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -131,6 +199,9 @@ type eventStatements struct {
 	updateEventStateStmt                   *sql.Stmt
 	selectEventSentToOutputStmt            *sql.Stmt
 	updateEventSentToOutputStmt            *sql.Stmt
+	updateEventRejectedStmt                *sql.Stmt
+	updateEventOutlierStmt                 *sql.Stmt
+	selectEventRejectedStmt                *sql.Stmt
 	selectEventIDStmt                      *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
@@ -138,6 +209,13 @@ type eventStatements struct {
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
 	selectRoomNIDsForEventNIDsStmt         *sql.Stmt
+	selectEventNIDsBySenderStmt            *sql.Stmt
+	selectRoomDAGEntriesStmt               *sql.Stmt
+	selectEventByTimestampForwardsStmt     *sql.Stmt
+	selectEventByTimestampBackwardsStmt    *sql.Stmt
+	bulkSelectSoftFailedEventNIDStmt       *sql.Stmt
+	selectExpiredEventNIDsStmt             *sql.Stmt
+	updateEventExpiredStmt                 *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -154,6 +232,9 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.updateEventRejectedStmt, updateEventRejectedSQL},
+		{&s.updateEventOutlierStmt, updateEventOutlierSQL},
+		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
@@ -162,6 +243,13 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
+		{&s.selectEventNIDsBySenderStmt, selectEventNIDsBySenderSQL},
+		{&s.selectRoomDAGEntriesStmt, selectRoomDAGEntriesSQL},
+		{&s.selectEventByTimestampForwardsStmt, selectEventByTimestampForwardsSQL},
+		{&s.selectEventByTimestampBackwardsStmt, selectEventByTimestampBackwardsSQL},
+		{&s.bulkSelectSoftFailedEventNIDStmt, bulkSelectSoftFailedEventNIDSQL},
+		{&s.selectExpiredEventNIDsStmt, selectExpiredEventNIDsSQL},
+		{&s.updateEventExpiredStmt, updateEventExpiredSQL},
 	}.Prepare(db)
 }
 
@@ -171,18 +259,22 @@ func (s *eventStatements) InsertEvent(
 	roomNID types.RoomNID,
 	eventTypeNID types.EventTypeNID,
 	eventStateKeyNID types.EventStateKeyNID,
+	senderNID types.EventStateKeyNID,
 	eventID string,
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	originServerTS gomatrixserverlib.Timestamp,
 	isRejected bool,
+	softFailed bool,
+	isOutlier bool,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
 	err := s.insertEventStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
-		isRejected,
+		int64(senderNID), eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		int64(originServerTS), isRejected, softFailed, isOutlier,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -301,6 +393,30 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 	return err
 }
 
+func (s *eventStatements) UpdateEventRejected(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, isRejected bool,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventRejectedStmt)
+	_, err := stmt.ExecContext(ctx, isRejected, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) UpdateEventOutlier(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, isOutlier bool,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventOutlierStmt)
+	_, err := stmt.ExecContext(ctx, isOutlier, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) SelectEventRejected(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string,
+) (rejected bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventRejectedStmt)
+	err = stmt.QueryRowContext(ctx, int64(roomNID), eventID).Scan(&rejected)
+	return
+}
+
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
@@ -452,6 +568,44 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) SelectEventNIDsBySender(
+	ctx context.Context, senderNID types.EventStateKeyNID, beforeEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectEventNIDsBySenderStmt.QueryContext(ctx, int64(senderNID), int64(beforeEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDsBySenderStmt: rows.close() failed")
+	var result []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		result = append(result, eventNID)
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomDAGEntries(
+	ctx context.Context, roomNID types.RoomNID, fromDepth, toDepth int64, limit int,
+) ([]types.RoomDAGEntry, error) {
+	rows, err := s.selectRoomDAGEntriesStmt.QueryContext(ctx, int64(roomNID), fromDepth, toDepth, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomDAGEntriesStmt: rows.close() failed")
+	var result []types.RoomDAGEntry
+	for rows.Next() {
+		var entry types.RoomDAGEntry
+		if err = rows.Scan(&entry.EventNID, &entry.StateSnapshotNID, &entry.IsRejected, &entry.SoftFailed, &entry.IsOutlier); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
@@ -459,3 +613,65 @@ func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	}
 	return nids
 }
+
+// BulkSelectSoftFailedEventNID returns which of the given events were soft-failed.
+func (s *eventStatements) BulkSelectSoftFailedEventNID(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (map[types.EventNID]bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.bulkSelectSoftFailedEventNIDStmt)
+	rows, err := stmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectSoftFailedEventNID: rows.close() failed")
+	results := make(map[types.EventNID]bool)
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = true
+	}
+	return results, rows.Err()
+}
+
+func (s *eventStatements) SelectEventByTimestamp(
+	ctx context.Context, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, forwards bool,
+) (types.EventNID, string, gomatrixserverlib.Timestamp, error) {
+	stmt := s.selectEventByTimestampBackwardsStmt
+	if forwards {
+		stmt = s.selectEventByTimestampForwardsStmt
+	}
+	var eventNID, originServerTS int64
+	var eventID string
+	err := stmt.QueryRowContext(ctx, int64(roomNID), int64(ts)).Scan(&eventNID, &eventID, &originServerTS)
+	return types.EventNID(eventNID), eventID, gomatrixserverlib.Timestamp(originServerTS), err
+}
+
+func (s *eventStatements) SelectExpiredEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectExpiredEventNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), int64(before), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectExpiredEventNIDsStmt: rows.close() failed")
+	var result []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		result = append(result, eventNID)
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) UpdateEventExpired(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventExpiredStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
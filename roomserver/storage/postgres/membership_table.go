@@ -223,7 +223,7 @@ func (s *membershipStatements) SelectMembershipsFromRoom(
 }
 
 func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
-	ctx context.Context,
+	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, membership tables.MembershipState, localOnly bool,
 ) (eventNIDs []types.EventNID, err error) {
 	var rows *sql.Rows
@@ -233,7 +233,7 @@ func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
 	} else {
 		stmt = s.selectMembershipsFromRoomAndMembershipStmt
 	}
-	rows, err = stmt.QueryContext(ctx, roomNID, membership)
+	rows, err = sqlutil.TxStmt(txn, stmt).QueryContext(ctx, roomNID, membership)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The purge statements remove all traces of a room from the roomserver
+// tables. Statements that refer to roomserver_events must run before the
+// events themselves are deleted.
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY(" +
+	" SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redaction_event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	") OR redacts_event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeStateBlockEntriesSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = ANY(" +
+	" SELECT DISTINCT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE room_nid = $1" +
+	")"
+
+const purgeStateSnapshotEntriesSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeRoomUsageSQL = "" +
+	"DELETE FROM roomserver_room_usage WHERE room_nid = $1"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const purgePublishedSQL = "" +
+	"DELETE FROM roomserver_published WHERE room_id = $1"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+type purgeStatements struct {
+	purgeEventJSONStmt            *sql.Stmt
+	purgePreviousEventsStmt       *sql.Stmt
+	purgeRedactionsStmt           *sql.Stmt
+	purgeStateBlockEntriesStmt    *sql.Stmt
+	purgeStateSnapshotEntriesStmt *sql.Stmt
+	purgeInvitesStmt              *sql.Stmt
+	purgeMembershipsStmt          *sql.Stmt
+	purgeRoomUsageStmt            *sql.Stmt
+	purgeEventsStmt               *sql.Stmt
+	purgeRoomAliasesStmt          *sql.Stmt
+	purgePublishedStmt            *sql.Stmt
+	purgeRoomStmt                 *sql.Stmt
+}
+
+func NewPostgresPurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	return s, shared.StatementList{
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
+		{&s.purgeRedactionsStmt, purgeRedactionsSQL},
+		{&s.purgeStateBlockEntriesStmt, purgeStateBlockEntriesSQL},
+		{&s.purgeStateSnapshotEntriesStmt, purgeStateSnapshotEntriesSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeRoomUsageStmt, purgeRoomUsageSQL},
+		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgePublishedStmt, purgePublishedSQL},
+		{&s.purgeRoomStmt, purgeRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
+) error {
+	byRoomNID := []*sql.Stmt{
+		s.purgeEventJSONStmt,
+		s.purgePreviousEventsStmt,
+		s.purgeRedactionsStmt,
+		s.purgeStateBlockEntriesStmt,
+		s.purgeStateSnapshotEntriesStmt,
+		s.purgeInvitesStmt,
+		s.purgeMembershipsStmt,
+		s.purgeEventsStmt,
+		s.purgeRoomUsageStmt,
+	}
+	for _, stmt := range byRoomNID {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomNID); err != nil {
+			return err
+		}
+	}
+	byRoomID := []*sql.Stmt{
+		s.purgeRoomAliasesStmt,
+		s.purgePublishedStmt,
+	}
+	for _, stmt := range byRoomID {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	_, err := sqlutil.TxStmt(txn, s.purgeRoomStmt).ExecContext(ctx, roomNID)
+	return err
+}
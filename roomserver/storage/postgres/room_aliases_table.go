@@ -54,12 +54,16 @@ const selectCreatorIDFromAliasSQL = "" +
 const deleteRoomAliasSQL = "" +
 	"DELETE FROM roomserver_room_aliases WHERE alias = $1"
 
+const updateRoomIDForAliasesSQL = "" +
+	"UPDATE roomserver_room_aliases SET room_id = $1 WHERE room_id = $2"
+
 type roomAliasesStatements struct {
 	insertRoomAliasStmt          *sql.Stmt
 	selectRoomIDFromAliasStmt    *sql.Stmt
 	selectAliasesFromRoomIDStmt  *sql.Stmt
 	selectCreatorIDFromAliasStmt *sql.Stmt
 	deleteRoomAliasStmt          *sql.Stmt
+	updateRoomIDForAliasesStmt   *sql.Stmt
 }
 
 func NewPostgresRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
@@ -74,6 +78,7 @@ func NewPostgresRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
 		{&s.selectAliasesFromRoomIDStmt, selectAliasesFromRoomIDSQL},
 		{&s.selectCreatorIDFromAliasStmt, selectCreatorIDFromAliasSQL},
 		{&s.deleteRoomAliasStmt, deleteRoomAliasSQL},
+		{&s.updateRoomIDForAliasesStmt, updateRoomIDForAliasesSQL},
 	}.Prepare(db)
 }
 
@@ -133,3 +138,11 @@ func (s *roomAliasesStatements) DeleteRoomAlias(
 	_, err = stmt.ExecContext(ctx, alias)
 	return
 }
+
+func (s *roomAliasesStatements) UpdateRoomIDForAliases(
+	ctx context.Context, txn *sql.Tx, oldRoomID, newRoomID string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.updateRoomIDForAliasesStmt)
+	_, err = stmt.ExecContext(ctx, newRoomID, oldRoomID)
+	return
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const roomUsageSchema = `
+-- Tracks approximately how much storage each room is using. The counters are
+-- updated as events and state snapshots are stored, rather than being worked
+-- out from the other tables when they are needed.
+CREATE TABLE IF NOT EXISTS roomserver_room_usage (
+    -- Local numeric ID for the room.
+    room_nid BIGINT PRIMARY KEY,
+    -- The number of events stored for the room.
+    event_count BIGINT NOT NULL DEFAULT 0,
+    -- The number of bytes of event JSON stored for the room, as it was
+    -- stored at the time (i.e. after compression).
+    event_json_bytes BIGINT NOT NULL DEFAULT 0,
+    -- The number of state snapshots stored for the room.
+    state_snapshot_count BIGINT NOT NULL DEFAULT 0,
+    -- The number of mxc:// URIs referenced by events in the room.
+    media_reference_count BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const updateRoomUsageSQL = "" +
+	"INSERT INTO roomserver_room_usage (room_nid, event_count, event_json_bytes, state_snapshot_count, media_reference_count)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (room_nid) DO UPDATE SET" +
+	" event_count = roomserver_room_usage.event_count + $2," +
+	" event_json_bytes = roomserver_room_usage.event_json_bytes + $3," +
+	" state_snapshot_count = roomserver_room_usage.state_snapshot_count + $4," +
+	" media_reference_count = roomserver_room_usage.media_reference_count + $5"
+
+const selectRoomUsageSQL = "" +
+	"SELECT r.room_id, u.event_count, u.event_json_bytes, u.state_snapshot_count, u.media_reference_count" +
+	" FROM roomserver_room_usage u JOIN roomserver_rooms r ON r.room_nid = u.room_nid" +
+	" WHERE r.room_id = $1"
+
+const selectLargestRoomUsagesSQL = "" +
+	"SELECT r.room_id, u.event_count, u.event_json_bytes, u.state_snapshot_count, u.media_reference_count" +
+	" FROM roomserver_room_usage u JOIN roomserver_rooms r ON r.room_nid = u.room_nid" +
+	" ORDER BY u.event_json_bytes DESC LIMIT $1"
+
+// The usage table was added after rooms were already being stored, so if it
+// is empty but there are events then we work out the event and snapshot
+// counts from the existing tables. Media references can't be counted this
+// way as the event JSON may be compressed, so they only include events that
+// are stored from now on.
+const selectRoomUsageNeedsPopulatingSQL = "" +
+	"SELECT NOT EXISTS(SELECT 1 FROM roomserver_room_usage) AND EXISTS(SELECT 1 FROM roomserver_events)"
+
+const populateRoomUsageEventsSQL = "" +
+	"INSERT INTO roomserver_room_usage (room_nid, event_count, event_json_bytes)" +
+	" SELECT e.room_nid, COUNT(*), COALESCE(SUM(OCTET_LENGTH(j.event_json)), 0)" +
+	" FROM roomserver_events e LEFT JOIN roomserver_event_json j ON j.event_nid = e.event_nid" +
+	" GROUP BY e.room_nid"
+
+const populateRoomUsageStateSnapshotsSQL = "" +
+	"INSERT INTO roomserver_room_usage (room_nid, state_snapshot_count)" +
+	" SELECT room_nid, COUNT(*) FROM roomserver_state_snapshots GROUP BY room_nid" +
+	" ON CONFLICT (room_nid) DO UPDATE SET state_snapshot_count = excluded.state_snapshot_count"
+
+type roomUsageStatements struct {
+	updateRoomUsageStmt         *sql.Stmt
+	selectRoomUsageStmt         *sql.Stmt
+	selectLargestRoomUsagesStmt *sql.Stmt
+}
+
+func NewPostgresRoomUsageTable(db *sql.DB) (tables.RoomUsage, error) {
+	s := &roomUsageStatements{}
+	_, err := db.Exec(roomUsageSchema)
+	if err != nil {
+		return nil, err
+	}
+	var needsPopulating bool
+	if err = db.QueryRow(selectRoomUsageNeedsPopulatingSQL).Scan(&needsPopulating); err != nil {
+		return nil, err
+	}
+	if needsPopulating {
+		err = sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			if _, err = txn.Exec(populateRoomUsageEventsSQL); err != nil {
+				return err
+			}
+			_, err = txn.Exec(populateRoomUsageStateSnapshotsSQL)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to populate room usage: %w", err)
+		}
+	}
+	return s, shared.StatementList{
+		{&s.updateRoomUsageStmt, updateRoomUsageSQL},
+		{&s.selectRoomUsageStmt, selectRoomUsageSQL},
+		{&s.selectLargestRoomUsagesStmt, selectLargestRoomUsagesSQL},
+	}.Prepare(db)
+}
+
+func (s *roomUsageStatements) UpdateRoomUsage(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, usage types.RoomUsage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateRoomUsageStmt).ExecContext(
+		ctx, roomNID, usage.Events, usage.EventJSONBytes, usage.StateSnapshots, usage.MediaReferences,
+	)
+	return err
+}
+
+func (s *roomUsageStatements) SelectRoomUsage(
+	ctx context.Context, roomID string,
+) (usage types.RoomUsage, err error) {
+	err = s.selectRoomUsageStmt.QueryRowContext(ctx, roomID).Scan(
+		&usage.RoomID, &usage.Events, &usage.EventJSONBytes, &usage.StateSnapshots, &usage.MediaReferences,
+	)
+	return
+}
+
+func (s *roomUsageStatements) SelectLargestRoomUsages(
+	ctx context.Context, limit int,
+) ([]types.RoomUsage, error) {
+	rows, err := s.selectLargestRoomUsagesStmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectLargestRoomUsages: rows.close() failed")
+	var result []types.RoomUsage
+	for rows.Next() {
+		var usage types.RoomUsage
+		if err = rows.Scan(
+			&usage.RoomID, &usage.Events, &usage.EventJSONBytes, &usage.StateSnapshots, &usage.MediaReferences,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, usage)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+// The row counts come from the statistics collector rather than counting
+// the rows, so they are only as accurate as the last (auto)vacuum/analyze,
+// but they are cheap to query even for very large tables.
+const selectTableStatisticsSQL = "" +
+	"SELECT relname, n_live_tup, pg_total_relation_size(relid) FROM pg_stat_user_tables" +
+	" WHERE relname = ANY($1)"
+
+type statisticsStatements struct {
+	selectTableStatisticsStmt *sql.Stmt
+}
+
+func NewPostgresStatisticsStatements(db *sql.DB) (tables.Statistics, error) {
+	s := &statisticsStatements{}
+	return s, shared.StatementList{
+		{&s.selectTableStatisticsStmt, selectTableStatisticsSQL},
+	}.Prepare(db)
+}
+
+func (s *statisticsStatements) SelectTableStatistics(
+	ctx context.Context, tableNames []string,
+) ([]tables.TableStatistic, error) {
+	rows, err := s.selectTableStatisticsStmt.QueryContext(ctx, pq.StringArray(tableNames))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectTableStatistics: rows.close() failed")
+	var result []tables.TableStatistic
+	for rows.Next() {
+		var stat tables.TableStatistic
+		if err = rows.Scan(&stat.Table, &stat.Rows, &stat.SizeBytes); err != nil {
+			return nil, err
+		}
+		result = append(result, stat)
+	}
+	return result, rows.Err()
+}
@@ -34,7 +34,7 @@ type Database struct {
 }
 
 // Open a postgres database.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (*Database, error) {
+func Open(dbProperties *config.DatabaseOptions, compression config.EventJSONCompression, cache caching.RoomServerCaches) (*Database, error) {
 	var d Database
 	var db *sql.DB
 	var err error
@@ -50,10 +50,16 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadAddForgottenColumn(m)
+	deltas.LoadEventJSONBytea(m)
+	deltas.LoadAddEventsSenderNID(m)
+	deltas.LoadAddEventsSoftFailed(m)
+	deltas.LoadAddEventsIsOutlier(m)
+	deltas.LoadAddEventsOriginServerTS(m)
+	deltas.LoadAddEventsIsExpired(m)
 	if err := m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
-	if err := d.prepare(db, cache); err != nil {
+	if err := d.prepare(db, compression, cache); err != nil {
 		return nil, err
 	}
 
@@ -61,7 +67,7 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 }
 
 // nolint: gocyclo
-func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) (err error) {
+func (d *Database) prepare(db *sql.DB, compression config.EventJSONCompression, cache caching.RoomServerCaches) (err error) {
 	eventStateKeys, err := NewPostgresEventStateKeysTable(db)
 	if err != nil {
 		return err
@@ -74,6 +80,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) (err erro
 	if err != nil {
 		return err
 	}
+	eventJSONCodec, err := shared.NewEventJSONCodec(compression)
+	if err != nil {
+		return err
+	}
 	events, err := NewPostgresEventsTable(db)
 	if err != nil {
 		return err
@@ -118,24 +128,55 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) (err erro
 	if err != nil {
 		return err
 	}
+	roomUsage, err := NewPostgresRoomUsageTable(db)
+	if err != nil {
+		return err
+	}
+	purge, err := NewPostgresPurgeStatements(db)
+	if err != nil {
+		return err
+	}
+	statistics, err := NewPostgresStatisticsStatements(db)
+	if err != nil {
+		return err
+	}
+	inputJournal, err := NewPostgresInputJournalTable(db)
+	if err != nil {
+		return err
+	}
+	blockedRooms, err := NewPostgresBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
+	recompression, err := NewPostgresRecompressionTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
-		DB:                  db,
-		Cache:               cache,
-		Writer:              sqlutil.NewDummyWriter(),
-		EventTypesTable:     eventTypes,
-		EventStateKeysTable: eventStateKeys,
-		EventJSONTable:      eventJSON,
-		EventsTable:         events,
-		RoomsTable:          rooms,
-		TransactionsTable:   transactions,
-		StateBlockTable:     stateBlock,
-		StateSnapshotTable:  stateSnapshot,
-		PrevEventsTable:     prevEvents,
-		RoomAliasesTable:    roomAliases,
-		InvitesTable:        invites,
-		MembershipTable:     membership,
-		PublishedTable:      published,
-		RedactionsTable:     redactions,
+		DB:                   db,
+		Cache:                cache,
+		Writer:               sqlutil.NewDummyWriter(),
+		EventTypesTable:      eventTypes,
+		EventStateKeysTable:  eventStateKeys,
+		EventJSONTable:       eventJSON,
+		EventJSONCodec:       eventJSONCodec,
+		EventsTable:          events,
+		RoomsTable:           rooms,
+		TransactionsTable:    transactions,
+		StateBlockTable:      stateBlock,
+		StateSnapshotTable:   stateSnapshot,
+		PrevEventsTable:      prevEvents,
+		RoomAliasesTable:     roomAliases,
+		InvitesTable:         invites,
+		MembershipTable:      membership,
+		PublishedTable:       published,
+		RedactionsTable:      redactions,
+		PurgeStatements:      purge,
+		RoomUsageTable:       roomUsage,
+		InputJournalTable:    inputJournal,
+		BlockedRoomsTable:    blockedRooms,
+		RecompressionTable:   recompression,
+		StatisticsStatements: statistics,
 	}
 	return nil
 }
@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Compressed event JSON is prefixed with a single byte which identifies the
+// algorithm used. Event JSON always starts with a '{' so it can't be mistaken
+// for compressed event JSON, which means that rows which were stored before
+// compression was enabled can still be read.
+const (
+	eventJSONFormatNone   byte = 0x00 // never stored, only used for comparisons
+	eventJSONFormatSnappy byte = 0x01
+	eventJSONFormatZstd   byte = 0x02
+)
+
+// EventJSONCodec compresses and decompresses event JSON for storage in the
+// event JSON table. It is safe to use from multiple goroutines.
+type EventJSONCodec struct {
+	compression config.EventJSONCompression
+	format      byte
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+// NewEventJSONCodec returns a codec which compresses event JSON using the given
+// algorithm. It can decompress event JSON stored using any algorithm.
+func NewEventJSONCodec(compression config.EventJSONCompression) (*EventJSONCodec, error) {
+	c := &EventJSONCodec{compression: compression}
+	switch compression {
+	case "", config.EventJSONCompressionNone:
+		c.compression = config.EventJSONCompressionNone
+		c.format = eventJSONFormatNone
+	case config.EventJSONCompressionSnappy:
+		c.format = eventJSONFormatSnappy
+	case config.EventJSONCompressionZstd:
+		c.format = eventJSONFormatZstd
+	default:
+		return nil, fmt.Errorf("unknown event JSON compression %q", compression)
+	}
+	var err error
+	if c.zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+		return nil, fmt.Errorf("zstd.NewWriter: %w", err)
+	}
+	if c.zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		return nil, fmt.Errorf("zstd.NewReader: %w", err)
+	}
+	return c, nil
+}
+
+// Encode returns the event JSON in the form that it should be stored.
+func (c *EventJSONCodec) Encode(eventJSON []byte) []byte {
+	switch c.format {
+	case eventJSONFormatSnappy:
+		return append([]byte{eventJSONFormatSnappy}, snappy.Encode(nil, eventJSON)...)
+	case eventJSONFormatZstd:
+		return c.zstdEncoder.EncodeAll(eventJSON, []byte{eventJSONFormatZstd})
+	default:
+		return eventJSON
+	}
+}
+
+// Decode returns the event JSON from the form that it was stored in.
+func (c *EventJSONCodec) Decode(data []byte) ([]byte, error) {
+	switch storedFormat(data) {
+	case eventJSONFormatSnappy:
+		return snappy.Decode(nil, data[1:])
+	case eventJSONFormatZstd:
+		return c.zstdDecoder.DecodeAll(data[1:], nil)
+	default:
+		return data, nil
+	}
+}
+
+// Compression returns the algorithm that this codec compresses with.
+func (c *EventJSONCodec) Compression() config.EventJSONCompression {
+	return c.compression
+}
+
+// NeedsRecompressing returns true if the stored event JSON wasn't stored
+// using the algorithm that this codec compresses with.
+func (c *EventJSONCodec) NeedsRecompressing(data []byte) bool {
+	return storedFormat(data) != c.format
+}
+
+func storedFormat(data []byte) byte {
+	if len(data) == 0 {
+		return eventJSONFormatNone
+	}
+	switch data[0] {
+	case eventJSONFormatSnappy, eventJSONFormatZstd:
+		return data[0]
+	default:
+		return eventJSONFormatNone
+	}
+}
@@ -0,0 +1,47 @@
+package shared
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestEventJSONCodec(t *testing.T) {
+	eventJSON := []byte(`{"type":"m.room.message","content":{"body":"hello hello hello hello hello"}}`)
+	compressions := []config.EventJSONCompression{
+		config.EventJSONCompressionNone,
+		config.EventJSONCompressionSnappy,
+		config.EventJSONCompressionZstd,
+	}
+	codecs := make(map[config.EventJSONCompression]*EventJSONCodec)
+	for _, compression := range compressions {
+		codec, err := NewEventJSONCodec(compression)
+		if err != nil {
+			t.Fatalf("NewEventJSONCodec(%q): %s", compression, err)
+		}
+		codecs[compression] = codec
+	}
+	for _, encodeWith := range compressions {
+		stored := codecs[encodeWith].Encode(eventJSON)
+		if codecs[encodeWith].NeedsRecompressing(stored) {
+			t.Errorf("%s: event JSON needs recompressing straight after encoding", encodeWith)
+		}
+		// every codec must be able to read event JSON stored by any other codec
+		for _, decodeWith := range compressions {
+			decoded, err := codecs[decodeWith].Decode(stored)
+			if err != nil {
+				t.Fatalf("encoded with %s, decoded with %s: %s", encodeWith, decodeWith, err)
+			}
+			if !bytes.Equal(decoded, eventJSON) {
+				t.Errorf("encoded with %s, decoded with %s: got %q want %q", encodeWith, decodeWith, decoded, eventJSON)
+			}
+			if wantRecompress := encodeWith != decodeWith; codecs[decodeWith].NeedsRecompressing(stored) != wantRecompress {
+				t.Errorf("encoded with %s, decoded with %s: NeedsRecompressing should be %v", encodeWith, decodeWith, wantRecompress)
+			}
+		}
+	}
+	if _, err := NewEventJSONCodec("lzma"); err == nil {
+		t.Errorf("NewEventJSONCodec should fail for unknown compression")
+	}
+}
@@ -3,12 +3,29 @@ package shared
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
+// LatestEventsLockTimeout is how long to wait for the lock on the latest
+// events of a room before giving up, rather than queueing forever behind an
+// updater which is stuck.
+var LatestEventsLockTimeout = 30 * time.Second
+
+// LatestEventsHeldWarning is how long an updater can hold the lock on the
+// latest events of a room before a warning is logged, as anything waiting
+// for the same room will be blocked until it is released.
+var LatestEventsHeldWarning = 10 * time.Second
+
+// ErrLatestEventsLockTimeout is returned when the lock on the latest events
+// of a room couldn't be taken within LatestEventsLockTimeout.
+var ErrLatestEventsLockTimeout = errors.New("timed out waiting for the latest events lock")
+
 type LatestEventsUpdater struct {
 	transaction
 	d                       *Database
@@ -16,6 +33,8 @@ type LatestEventsUpdater struct {
 	latestEvents            []types.StateAtEventAndReference
 	lastEventIDSent         string
 	currentStateSnapshotNID types.StateSnapshotNID
+	acquired                time.Time
+	watchdog                *time.Timer
 }
 
 func rollback(txn *sql.Tx) {
@@ -26,12 +45,25 @@ func rollback(txn *sql.Tx) {
 }
 
 func NewLatestEventsUpdater(ctx context.Context, d *Database, txn *sql.Tx, roomInfo types.RoomInfo) (*LatestEventsUpdater, error) {
+	lockCtx, cancel := context.WithTimeout(ctx, LatestEventsLockTimeout)
+	defer cancel()
 	eventNIDs, lastEventNIDSent, currentStateSnapshotNID, err :=
-		d.RoomsTable.SelectLatestEventsNIDsForUpdate(ctx, txn, roomInfo.RoomNID)
+		d.RoomsTable.SelectLatestEventsNIDsForUpdate(lockCtx, txn, roomInfo.RoomNID)
+	if err != nil {
+		rollback(txn)
+		if lockCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, fmt.Errorf("room NID %d: %w", roomInfo.RoomNID, ErrLatestEventsLockTimeout)
+		}
+		return nil, err
+	}
+	// Soft-failed events should never have been made forward extremities,
+	// but make sure that they don't get built upon if they were.
+	softFailed, err := d.EventsTable.BulkSelectSoftFailedEventNID(ctx, txn, eventNIDs)
 	if err != nil {
 		rollback(txn)
 		return nil, err
 	}
+	eventNIDs = withoutSoftFailed(eventNIDs, softFailed)
 	stateAndRefs, err := d.EventsTable.BulkSelectStateAtEventAndReference(ctx, txn, eventNIDs)
 	if err != nil {
 		rollback(txn)
@@ -45,9 +77,44 @@ func NewLatestEventsUpdater(ctx context.Context, d *Database, txn *sql.Tx, roomI
 			return nil, err
 		}
 	}
-	return &LatestEventsUpdater{
-		transaction{ctx, txn}, d, roomInfo, stateAndRefs, lastEventIDSent, currentStateSnapshotNID,
-	}, nil
+	u := &LatestEventsUpdater{
+		transaction:             transaction{ctx, txn},
+		d:                       d,
+		roomInfo:                roomInfo,
+		latestEvents:            stateAndRefs,
+		lastEventIDSent:         lastEventIDSent,
+		currentStateSnapshotNID: currentStateSnapshotNID,
+		acquired:                time.Now(),
+	}
+	u.watchdog = time.AfterFunc(LatestEventsHeldWarning, func() {
+		logrus.WithFields(logrus.Fields{
+			"room_nid": roomInfo.RoomNID,
+			"held_for": time.Since(u.acquired).String(),
+		}).Warn("Latest events updater is still held, other updates to the room are blocked")
+	})
+	return u, nil
+}
+
+// Commit implements types.Transaction
+func (u *LatestEventsUpdater) Commit() error {
+	u.release()
+	return u.transaction.Commit()
+}
+
+// Rollback implements types.Transaction
+func (u *LatestEventsUpdater) Rollback() error {
+	u.release()
+	return u.transaction.Rollback()
+}
+
+// release stops the watchdog and logs if the updater was held for too long.
+func (u *LatestEventsUpdater) release() {
+	if !u.watchdog.Stop() {
+		logrus.WithFields(logrus.Fields{
+			"room_nid": u.roomInfo.RoomNID,
+			"held_for": time.Since(u.acquired).String(),
+		}).Warn("Latest events updater was held for a long time")
+	}
 }
 
 // RoomVersion implements types.RoomRecentEventsUpdater
@@ -102,6 +169,11 @@ func (u *LatestEventsUpdater) SetLatestEvents(
 		eventNIDs[i] = latest[i].EventNID
 	}
 	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		softFailed, err := u.d.EventsTable.BulkSelectSoftFailedEventNID(u.ctx, txn, eventNIDs)
+		if err != nil {
+			return fmt.Errorf("u.d.EventsTable.BulkSelectSoftFailedEventNID: %w", err)
+		}
+		eventNIDs = withoutSoftFailed(eventNIDs, softFailed)
 		if err := u.d.RoomsTable.UpdateLatestEventNIDs(u.ctx, txn, roomNID, eventNIDs, lastEventNIDSent, currentStateSnapshotNID); err != nil {
 			return fmt.Errorf("u.d.RoomsTable.updateLatestEventNIDs: %w", err)
 		}
@@ -131,3 +203,17 @@ func (u *LatestEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error {
 func (u *LatestEventsUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID, targetLocal bool) (*MembershipUpdater, error) {
 	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomInfo.RoomNID, targetUserNID, targetLocal)
 }
+
+// withoutSoftFailed returns the event NIDs that aren't soft-failed.
+func withoutSoftFailed(eventNIDs []types.EventNID, softFailed map[types.EventNID]bool) []types.EventNID {
+	if len(softFailed) == 0 {
+		return eventNIDs
+	}
+	result := make([]types.EventNID, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		if !softFailed[eventNID] {
+			result = append(result, eventNID)
+		}
+	}
+	return result
+}
@@ -1,10 +1,11 @@
 package shared
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	"math"
 	"sort"
 
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -32,6 +33,7 @@ type Database struct {
 	Writer                     sqlutil.Writer
 	EventsTable                tables.Events
 	EventJSONTable             tables.EventJSON
+	EventJSONCodec             *EventJSONCodec
 	EventTypesTable            tables.EventTypes
 	EventStateKeysTable        tables.EventStateKeys
 	RoomsTable                 tables.Rooms
@@ -44,6 +46,12 @@ type Database struct {
 	MembershipTable            tables.Membership
 	PublishedTable             tables.Published
 	RedactionsTable            tables.Redactions
+	PurgeStatements            tables.Purge
+	RoomUsageTable             tables.RoomUsage
+	StatisticsStatements       tables.Statistics
+	InputJournalTable          tables.InputJournal
+	BlockedRoomsTable          tables.BlockedRooms
+	RecompressionTable         tables.Recompression
 	GetLatestEventsForUpdateFn func(ctx context.Context, roomInfo types.RoomInfo) (*LatestEventsUpdater, error)
 }
 
@@ -79,7 +87,16 @@ func (d *Database) EventTypeNIDs(
 func (d *Database) EventStateKeys(
 	ctx context.Context, eventStateKeyNIDs []types.EventStateKeyNID,
 ) (map[types.EventStateKeyNID]string, error) {
-	return d.EventStateKeysTable.BulkSelectEventStateKey(ctx, eventStateKeyNIDs)
+	result, err := d.EventStateKeysTable.BulkSelectEventStateKey(ctx, eventStateKeyNIDs)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping is immutable once assigned, so take the opportunity to
+	// warm the forward cache for later lookups by state key.
+	for nid, eventStateKey := range result {
+		d.Cache.StoreRoomServerStateKeyNID(eventStateKey, nid)
+	}
+	return result, nil
 }
 
 func (d *Database) EventStateKeyNIDs(
@@ -129,6 +146,7 @@ func (d *Database) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo
 	}
 	roomInfo, err := d.RoomsTable.SelectRoomInfo(ctx, roomID)
 	if err == nil && roomInfo != nil {
+		d.Cache.StoreRoomServerRoomNID(roomID, roomInfo.RoomNID)
 		d.Cache.StoreRoomServerRoomID(roomInfo.RoomNID, roomID)
 		d.Cache.StoreRoomInfo(roomID, *roomInfo)
 	}
@@ -154,6 +172,11 @@ func (d *Database) AddState(
 		if err != nil {
 			return fmt.Errorf("d.StateSnapshotTable.InsertState: %w", err)
 		}
+		if err = d.RoomUsageTable.UpdateRoomUsage(ctx, txn, roomNID, types.RoomUsage{
+			StateSnapshots: 1,
+		}); err != nil {
+			return fmt.Errorf("d.RoomUsageTable.UpdateRoomUsage: %w", err)
+		}
 		return nil
 	})
 	if err != nil {
@@ -228,6 +251,29 @@ func (d *Database) LatestEventIDs(
 	return
 }
 
+// LatestEvents returns the latest events in the room and the current state
+// snapshot without taking a lock on the room, so the result may already be
+// out of date by the time that it is used.
+func (d *Database) LatestEvents(
+	ctx context.Context, roomNID types.RoomNID,
+) ([]types.StateAtEventAndReference, types.StateSnapshotNID, error) {
+	eventNIDs, currentStateSnapshotNID, err := d.RoomsTable.SelectLatestEventNIDs(ctx, nil, roomNID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("d.RoomsTable.SelectLatestEventNIDs: %w", err)
+	}
+	stateAndRefs, err := d.EventsTable.BulkSelectStateAtEventAndReference(ctx, nil, eventNIDs)
+	if err != nil {
+		return nil, 0, fmt.Errorf("d.EventsTable.BulkSelectStateAtEventAndReference: %w", err)
+	}
+	return stateAndRefs, currentStateSnapshotNID, nil
+}
+
+// HasEventBeenSent returns whether the event has already been written to the
+// output log, without taking a lock on the room.
+func (d *Database) HasEventBeenSent(ctx context.Context, eventNID types.EventNID) (bool, error) {
+	return d.EventsTable.SelectEventSentToOutput(ctx, nil, eventNID)
+}
+
 func (d *Database) StateBlockNIDs(
 	ctx context.Context, stateNIDs []types.StateSnapshotNID,
 ) ([]types.StateBlockNIDList, error) {
@@ -266,6 +312,12 @@ func (d *Database) RemoveRoomAlias(ctx context.Context, alias string) error {
 	})
 }
 
+func (d *Database) MoveRoomAliases(ctx context.Context, oldRoomID, newRoomID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RoomAliasesTable.UpdateRoomIDForAliases(ctx, txn, oldRoomID, newRoomID)
+	})
+}
+
 func (d *Database) GetMembership(ctx context.Context, roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom, isRoomforgotten bool, err error) {
 	var requestSenderUserNID types.EventStateKeyNID
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
@@ -295,7 +347,7 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 ) ([]types.EventNID, error) {
 	if joinOnly {
 		return d.MembershipTable.SelectMembershipsFromRoomAndMembership(
-			ctx, roomNID, tables.MembershipStateJoin, localOnly,
+			ctx, nil, roomNID, tables.MembershipStateJoin, localOnly,
 		)
 	}
 
@@ -313,13 +365,15 @@ func (d *Database) GetInvitesForUser(
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
 ) ([]types.Event, error) {
-	eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, eventNIDs)
+	eventJSONs, err := d.bulkSelectEventJSON(ctx, eventNIDs)
 	if err != nil {
 		return nil, err
 	}
-	eventIDs, _ := d.EventsTable.BulkSelectEventID(ctx, eventNIDs)
+	// The event IDs for room versions 3 and later aren't in the event JSON,
+	// so use the stored ones rather than calculating them all again.
+	eventIDs, err := d.EventsTable.BulkSelectEventID(ctx, eventNIDs)
 	if err != nil {
-		eventIDs = map[types.EventNID]string{}
+		return nil, err
 	}
 	var roomNIDs map[types.EventNID]types.RoomNID
 	roomNIDs, err = d.EventsTable.SelectRoomNIDsForEventNIDs(ctx, eventNIDs)
@@ -412,15 +466,36 @@ func (d *Database) GetLatestEventsForUpdate(
 	return updater, err
 }
 
-// nolint:gocyclo
 func (d *Database) StoreEvent(
 	ctx context.Context, event *gomatrixserverlib.Event,
-	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected, softFailed bool,
+) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	return d.storeEvent(ctx, event, txnAndSessionID, authEventNIDs, isRejected, softFailed, false)
+}
+
+// StoreEventAsOutlier stores an event without state, such as an auth event
+// or an event that we fetched because it was missing. The prev events of an
+// outlier aren't recorded as being referenced, as the outlier isn't part of
+// the contiguous part of the event graph, so storing an event that arrives out
+// of order doesn't stop its prev events from becoming forward extremities. If
+// the event is stored again later by StoreEvent then it stops being an outlier.
+func (d *Database) StoreEventAsOutlier(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID, isRejected bool,
+) (types.EventNID, error) {
+	_, stateAtEvent, _, _, err := d.storeEvent(ctx, event, nil, authEventNIDs, isRejected, false, true)
+	return stateAtEvent.EventNID, err
+}
+
+// nolint:gocyclo
+func (d *Database) storeEvent(
+	ctx context.Context, event *gomatrixserverlib.Event,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected, softFailed, isOutlier bool,
 ) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
 	var (
 		roomNID          types.RoomNID
 		eventTypeNID     types.EventTypeNID
 		eventStateKeyNID types.EventStateKeyNID
+		senderNID        types.EventStateKeyNID
 		eventNID         types.EventNID
 		stateNID         types.StateSnapshotNID
 		redactionEvent   *gomatrixserverlib.Event
@@ -441,18 +516,13 @@ func (d *Database) StoreEvent(
 		// TODO: Here we should aim to have two different code paths for new rooms
 		// vs existing ones.
 
-		// Get the default room version. If the client doesn't supply a room_version
-		// then we will use our configured default to create the room.
-		// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
-		// Note that the below logic depends on the m.room.create event being the
-		// first event that is persisted to the database when creating or joining a
-		// room.
-		var roomVersion gomatrixserverlib.RoomVersion
-		if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
-			return fmt.Errorf("extractRoomVersionFromCreateEvent: %w", err)
-		}
-
-		if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), roomVersion); err != nil {
+		// The room is stored with the version that the event was parsed with,
+		// since that decides the event format. Event IDs in room versions 3 and
+		// later are derived from the reference hash rather than being in the
+		// event JSON, so if the room was stored with a different version then
+		// the events couldn't be read back with the same event IDs that we
+		// have assigned NIDs to.
+		if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), event.Version()); err != nil {
 			return fmt.Errorf("d.assignRoomNID: %w", err)
 		}
 
@@ -469,29 +539,61 @@ func (d *Database) StoreEvent(
 			}
 		}
 
+		// The sender shares the numeric IDs for state keys, as it will usually
+		// have one already from its membership event.
+		if senderNID, err = d.assignStateKeyNID(ctx, txn, event.Sender()); err != nil {
+			return fmt.Errorf("d.assignStateKeyNID: %w", err)
+		}
+
+		inserted := true
 		if eventNID, stateNID, err = d.EventsTable.InsertEvent(
 			ctx,
 			txn,
 			roomNID,
 			eventTypeNID,
 			eventStateKeyNID,
+			senderNID,
 			event.EventID(),
 			event.EventReference().EventSHA256,
 			authEventNIDs,
 			event.Depth(),
+			event.OriginServerTS(),
 			isRejected,
+			softFailed,
+			isOutlier,
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
+				inserted = false
 				eventNID, stateNID, err = d.EventsTable.SelectEvent(ctx, txn, event.EventID())
 			}
 			if err != nil {
 				return fmt.Errorf("d.EventsTable.SelectEvent: %w", err)
 			}
+			// The event may have been stored before we had all of its auth
+			// events, or as an outlier, so update it with what we know now.
+			if err = d.EventsTable.UpdateEventRejected(ctx, txn, eventNID, isRejected); err != nil {
+				return fmt.Errorf("d.EventsTable.UpdateEventRejected: %w", err)
+			}
+			if !isOutlier {
+				if err = d.EventsTable.UpdateEventOutlier(ctx, txn, eventNID, false); err != nil {
+					return fmt.Errorf("d.EventsTable.UpdateEventOutlier: %w", err)
+				}
+			}
 		}
 
-		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
-			return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+		var storedBytes int
+		if storedBytes, err = d.insertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
+			return fmt.Errorf("d.insertEventJSON: %w", err)
+		}
+		if inserted {
+			if err = d.RoomUsageTable.UpdateRoomUsage(ctx, txn, roomNID, types.RoomUsage{
+				Events:          1,
+				EventJSONBytes:  int64(storedBytes),
+				MediaReferences: int64(bytes.Count(event.Content(), []byte("mxc://"))),
+			}); err != nil {
+				return fmt.Errorf("d.RoomUsageTable.UpdateRoomUsage: %w", err)
+			}
 		}
 		if !isRejected { // ignore rejected redaction events
 			redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
@@ -512,7 +614,7 @@ func (d *Database) StoreEvent(
 	// on Postgres at least).
 	var roomInfo *types.RoomInfo
 	var updater *LatestEventsUpdater
-	if prevEvents := event.PrevEvents(); len(prevEvents) > 0 {
+	if prevEvents := event.PrevEvents(); !isOutlier && len(prevEvents) > 0 {
 		roomInfo, err = d.RoomInfo(ctx, event.RoomID())
 		if err != nil {
 			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.RoomInfo: %w", err)
@@ -560,6 +662,19 @@ func (d *Database) StoreEvent(
 	}, redactionEvent, redactedEventID, err
 }
 
+// MarkEventRejected marks an event which has already been stored as rejected.
+func (d *Database) MarkEventRejected(ctx context.Context, eventNID types.EventNID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EventsTable.UpdateEventRejected(ctx, txn, eventNID, true)
+	})
+}
+
+// IsEventRejected returns whether the event in the room was rejected. Returns
+// sql.ErrNoRows if the event hasn't been stored.
+func (d *Database) IsEventRejected(ctx context.Context, roomNID types.RoomNID, eventID string) (bool, error) {
+	return d.EventsTable.SelectEventRejected(ctx, nil, roomNID, eventID)
+}
+
 func (d *Database) PublishRoom(ctx context.Context, roomID string, publish bool) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.PublishedTable.UpsertRoomPublished(ctx, txn, roomID, publish)
@@ -577,6 +692,9 @@ func (d *Database) assignRoomNID(
 	if roomInfo, ok := d.Cache.GetRoomInfo(roomID); ok {
 		return roomInfo.RoomNID, nil
 	}
+	if roomNID, ok := d.Cache.GetRoomServerRoomNID(roomID); ok {
+		return roomNID, nil
+	}
 	// Check if we already have a numeric ID in the database.
 	roomNID, err := d.RoomsTable.SelectRoomNID(ctx, txn, roomID)
 	if err == sql.ErrNoRows {
@@ -587,6 +705,10 @@ func (d *Database) assignRoomNID(
 			roomNID, err = d.RoomsTable.SelectRoomNID(ctx, txn, roomID)
 		}
 	}
+	if err == nil {
+		d.Cache.StoreRoomServerRoomNID(roomID, roomNID)
+		d.Cache.StoreRoomServerRoomID(roomNID, roomID)
+	}
 	return roomNID, err
 }
 
@@ -634,29 +756,6 @@ func (d *Database) assignStateKeyNID(
 	return eventStateKeyNID, err
 }
 
-func extractRoomVersionFromCreateEvent(event *gomatrixserverlib.Event) (
-	gomatrixserverlib.RoomVersion, error,
-) {
-	var err error
-	var roomVersion gomatrixserverlib.RoomVersion
-	// Look for m.room.create events.
-	if event.Type() != gomatrixserverlib.MRoomCreate {
-		return gomatrixserverlib.RoomVersion(""), nil
-	}
-	roomVersion = gomatrixserverlib.RoomVersionV1
-	var createContent gomatrixserverlib.CreateContent
-	// The m.room.create event contains an optional "room_version" key in
-	// the event content, so we need to unmarshal that first.
-	if err = json.Unmarshal(event.Content(), &createContent); err != nil {
-		return gomatrixserverlib.RoomVersion(""), err
-	}
-	// A room version was specified in the event content?
-	if createContent.RoomVersion != nil {
-		roomVersion = gomatrixserverlib.RoomVersion(*createContent.RoomVersion)
-	}
-	return roomVersion, err
-}
-
 // handleRedactions manages the redacted status of events. There's two cases to consider in order to comply with the spec:
 // "servers should not apply or send redactions to clients until both the redaction event and original event have been seen, and are valid."
 // https://matrix.org/docs/spec/rooms/v3#authorization-rules-for-events
@@ -716,9 +815,9 @@ func (d *Database) handleRedactions(
 		redactedEvent.Event = redactedEvent.Redact()
 	}
 	// overwrite the eventJSON table
-	err = d.EventJSONTable.InsertEventJSON(ctx, txn, redactedEvent.EventNID, redactedEvent.JSON())
+	_, err = d.insertEventJSON(ctx, txn, redactedEvent.EventNID, redactedEvent.JSON())
 	if err != nil {
-		return nil, "", fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+		return nil, "", fmt.Errorf("d.insertEventJSON: %w", err)
 	}
 
 	err = d.RedactionsTable.MarkRedactionValidated(ctx, txn, redactionEvent.EventID(), true)
@@ -830,14 +929,14 @@ func (d *Database) GetStateEvent(ctx context.Context, roomID, evType, stateKey s
 			eventNIDs = append(eventNIDs, e.EventNID)
 		}
 	}
-	eventIDs, _ := d.EventsTable.BulkSelectEventID(ctx, eventNIDs)
+	eventIDs, err := d.EventsTable.BulkSelectEventID(ctx, eventNIDs)
 	if err != nil {
-		eventIDs = map[types.EventNID]string{}
+		return nil, err
 	}
 	// return the event requested
 	for _, e := range entries {
 		if e.EventTypeNID == eventTypeNID && e.EventStateKeyNID == stateKeyNID {
-			data, err := d.EventJSONTable.BulkSelectEventJSON(ctx, []types.EventNID{e.EventNID})
+			data, err := d.bulkSelectEventJSON(ctx, []types.EventNID{e.EventNID})
 			if err != nil {
 				return nil, err
 			}
@@ -955,11 +1054,11 @@ func (d *Database) GetBulkStateContent(ctx context.Context, roomIDs []string, tu
 			}
 		}
 	}
-	eventIDs, _ := d.EventsTable.BulkSelectEventID(ctx, eventNIDs)
+	eventIDs, err := d.EventsTable.BulkSelectEventID(ctx, eventNIDs)
 	if err != nil {
-		eventIDs = map[types.EventNID]string{}
+		return nil, fmt.Errorf("GetBulkStateContent: failed to load event IDs for event nids: %w", err)
 	}
-	events, err := d.EventJSONTable.BulkSelectEventJSON(ctx, eventNIDs)
+	events, err := d.bulkSelectEventJSON(ctx, eventNIDs)
 	if err != nil {
 		return nil, fmt.Errorf("GetBulkStateContent: failed to load event JSON for event nids: %w", err)
 	}
@@ -1105,3 +1204,333 @@ func (s stateEntryByStateKeySorter) Less(i, j int) bool {
 	return s[i].StateKeyTuple.LessThan(s[j].StateKeyTuple)
 }
 func (s stateEntryByStateKeySorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// PurgeRoom removes all information about a room from the roomserver
+// database. It refuses to do so if any local users are still joined to
+// the room.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		return types.ErrRoomNotFound
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		// Check for local members in the same transaction as the purge, so
+		// that a local user can't join the room in between. Locking the room
+		// row holds off any events being added to the room until we're done.
+		if _, _, _, jerr := d.RoomsTable.SelectLatestEventsNIDsForUpdate(ctx, txn, roomInfo.RoomNID); jerr != nil {
+			return fmt.Errorf("d.RoomsTable.SelectLatestEventsNIDsForUpdate: %w", jerr)
+		}
+		joined, jerr := d.MembershipTable.SelectMembershipsFromRoomAndMembership(
+			ctx, txn, roomInfo.RoomNID, tables.MembershipStateJoin, true,
+		)
+		if jerr != nil {
+			return fmt.Errorf("d.MembershipTable.SelectMembershipsFromRoomAndMembership: %w", jerr)
+		}
+		if len(joined) > 0 {
+			return types.ErrRoomHasLocalMembers
+		}
+		if jerr = d.PurgeStatements.PurgeRoom(ctx, txn, roomInfo.RoomNID, roomID); jerr != nil {
+			return fmt.Errorf("d.PurgeStatements.PurgeRoom: %w", jerr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The room NID will change if we ever join the room again, so make sure
+	// that we don't hand out stale values from the caches.
+	d.Cache.EvictRoomInfo(roomID)
+	d.Cache.EvictRoomServerRoomNID(roomID)
+	return nil
+}
+
+// insertEventJSON stores the event JSON, compressing it if needed.
+func (d *Database) insertEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) (int, error) {
+	data := d.EventJSONCodec.Encode(eventJSON)
+	return len(data), d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, data)
+}
+
+// bulkSelectEventJSON loads the event JSON for the given events, decompressing it if needed.
+func (d *Database) bulkSelectEventJSON(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]tables.EventJSONPair, error) {
+	pairs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pairs {
+		pairs[i].EventJSON, err = d.EventJSONCodec.Decode(pairs[i].EventJSON)
+		if err != nil {
+			return nil, fmt.Errorf("d.EventJSONCodec.Decode: event NID %d: %w", pairs[i].EventNID, err)
+		}
+	}
+	return pairs, nil
+}
+
+// The number of events to look at in each batch when recompressing event JSON.
+const recompressEventJSONBatchSize = 100
+
+// RecompressEventJSON rewrites any event JSON which wasn't stored using the
+// configured compression algorithm, e.g. because it was stored before
+// compression was enabled. Progress is saved after each batch, so that it
+// carries on where it left off if it is stopped. Returns the number of events
+// that were rewritten.
+func (d *Database) RecompressEventJSON(ctx context.Context) (int, error) {
+	compression := string(d.EventJSONCodec.Compression())
+	afterEventNID, err := d.RecompressionTable.SelectRecompression(ctx, nil, compression)
+	if err != nil {
+		return 0, fmt.Errorf("d.RecompressionTable.SelectRecompression: %w", err)
+	}
+	rewritten := 0
+	for {
+		var pairs []tables.EventJSONPair
+		pairs, err = d.EventJSONTable.SelectEventJSONAfter(ctx, afterEventNID, recompressEventJSONBatchSize)
+		if err != nil {
+			return rewritten, fmt.Errorf("d.EventJSONTable.SelectEventJSONAfter: %w", err)
+		}
+		if len(pairs) == 0 {
+			return rewritten, nil
+		}
+		afterEventNID = pairs[len(pairs)-1].EventNID
+		type update struct {
+			eventNID types.EventNID
+			oldJSON  []byte
+			newJSON  []byte
+		}
+		var updates []update
+		for _, pair := range pairs {
+			if !d.EventJSONCodec.NeedsRecompressing(pair.EventJSON) {
+				continue
+			}
+			eventJSON, decodeErr := d.EventJSONCodec.Decode(pair.EventJSON)
+			if decodeErr != nil {
+				return rewritten, fmt.Errorf("d.EventJSONCodec.Decode: event NID %d: %w", pair.EventNID, decodeErr)
+			}
+			updates = append(updates, update{pair.EventNID, pair.EventJSON, d.EventJSONCodec.Encode(eventJSON)})
+		}
+		err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			for _, u := range updates {
+				// Only replace the event JSON if it hasn't changed since we read it
+				// above, e.g. because the event was redacted in the meantime.
+				if uerr := d.EventJSONTable.UpdateEventJSON(ctx, txn, u.eventNID, u.oldJSON, u.newJSON); uerr != nil {
+					return fmt.Errorf("d.EventJSONTable.UpdateEventJSON: %w", uerr)
+				}
+			}
+			if uerr := d.RecompressionTable.UpsertRecompression(ctx, txn, compression, afterEventNID); uerr != nil {
+				return fmt.Errorf("d.RecompressionTable.UpsertRecompression: %w", uerr)
+			}
+			return nil
+		})
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += len(updates)
+	}
+}
+
+// statisticsTables are the tables that grow the most as rooms get bigger,
+// which are the ones that are worth keeping an eye on.
+var statisticsTables = []string{
+	"roomserver_events",
+	"roomserver_event_json",
+	"roomserver_state_block",
+	"roomserver_state_snapshots",
+}
+
+func (d *Database) TableStatistics(ctx context.Context) ([]tables.TableStatistic, error) {
+	return d.StatisticsStatements.SelectTableStatistics(ctx, statisticsTables)
+}
+
+// RoomUsage returns the approximate storage usage of the given room, or nil
+// if we don't have any usage recorded for the room.
+func (d *Database) RoomUsage(ctx context.Context, roomID string) (*types.RoomUsage, error) {
+	usage, err := d.RoomUsageTable.SelectRoomUsage(ctx, roomID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// LargestRoomUsages returns the approximate storage usage of the rooms that
+// have the most event JSON stored, largest first.
+func (d *Database) LargestRoomUsages(ctx context.Context, limit int) ([]types.RoomUsage, error) {
+	return d.RoomUsageTable.SelectLargestRoomUsages(ctx, limit)
+}
+
+// EventsBySender returns up to limit events sent by the given user across all
+// rooms with numeric IDs lower than beforeEventNID, most recent first. If
+// beforeEventNID is 0 then the most recent events are returned.
+func (d *Database) EventsBySender(
+	ctx context.Context, userID string, beforeEventNID types.EventNID, limit int,
+) ([]types.Event, error) {
+	senderNIDs, err := d.EventStateKeyNIDs(ctx, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	senderNID, ok := senderNIDs[userID]
+	if !ok {
+		return nil, nil
+	}
+	if beforeEventNID == 0 {
+		beforeEventNID = math.MaxInt64
+	}
+	eventNIDs, err := d.EventsTable.SelectEventNIDsBySender(ctx, senderNID, beforeEventNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err := d.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventNID > events[j].EventNID
+	})
+	return events, nil
+}
+
+// RoomDAG returns up to limit events in the room with depths between fromDepth
+// and toDepth inclusive, in order of depth. If there are more events than that
+// in the range then the deepest ones are returned.
+func (d *Database) RoomDAG(
+	ctx context.Context, roomInfo types.RoomInfo, fromDepth, toDepth int64, limit int,
+) ([]types.RoomDAGEntry, error) {
+	entries, err := d.EventsTable.SelectRoomDAGEntries(ctx, roomInfo.RoomNID, fromDepth, toDepth, limit)
+	if err != nil {
+		return nil, fmt.Errorf("d.EventsTable.SelectRoomDAGEntries: %w", err)
+	}
+	eventNIDs := make([]types.EventNID, len(entries))
+	for i := range entries {
+		eventNIDs[i] = entries[i].EventNID
+	}
+	events, err := d.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.Events: %w", err)
+	}
+	eventsByNID := make(map[types.EventNID]*gomatrixserverlib.Event, len(events))
+	for _, event := range events {
+		eventsByNID[event.EventNID] = event.Event
+	}
+	result := make([]types.RoomDAGEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Event.Event = eventsByNID[entry.EventNID]; entry.Event.Event == nil {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// EventByTimestamp returns the ID and origin_server_ts of the first event in
+// the timeline of the room sent at or after ts if forwards is true, or of the
+// last event sent at or before ts otherwise. Returns an empty event ID if
+// there is no such event.
+func (d *Database) EventByTimestamp(
+	ctx context.Context, roomInfo types.RoomInfo, ts gomatrixserverlib.Timestamp, forwards bool,
+) (string, gomatrixserverlib.Timestamp, error) {
+	_, eventID, originServerTS, err := d.EventsTable.SelectEventByTimestamp(ctx, roomInfo.RoomNID, ts, forwards)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("d.EventsTable.SelectEventByTimestamp: %w", err)
+	}
+	return eventID, originServerTS, nil
+}
+
+// ExpireEvents prunes up to limit events in the timeline of the room which
+// aren't state events and were sent before the given time, using the redaction
+// algorithm of the room version so that none of their content is kept. The
+// events themselves stay in the room DAG, as they are still referenced by
+// other events. Returns the IDs of the events that were pruned.
+func (d *Database) ExpireEvents(
+	ctx context.Context, roomInfo types.RoomInfo, before gomatrixserverlib.Timestamp, limit int,
+) ([]string, error) {
+	eventNIDs, err := d.EventsTable.SelectExpiredEventNIDs(ctx, nil, roomInfo.RoomNID, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("d.EventsTable.SelectExpiredEventNIDs: %w", err)
+	}
+	if len(eventNIDs) == 0 {
+		return nil, nil
+	}
+	events, err := d.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.Events: %w", err)
+	}
+	eventIDs := make([]string, 0, len(events))
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, event := range events {
+			if _, err = d.insertEventJSON(ctx, txn, event.EventNID, event.Redact().JSON()); err != nil {
+				return fmt.Errorf("d.insertEventJSON: %w", err)
+			}
+			eventIDs = append(eventIDs, event.EventID())
+		}
+		// Mark all of the events as expired, even if we couldn't find their
+		// JSON, so that we don't keep trying to expire them.
+		for _, eventNID := range eventNIDs {
+			if err = d.EventsTable.UpdateEventExpired(ctx, txn, eventNID); err != nil {
+				return fmt.Errorf("d.EventsTable.UpdateEventExpired: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return eventIDs, nil
+}
+
+// JournalInputEvents stores the JSON of input events which are about to be
+// processed, returning the journal ID of each one.
+func (d *Database) JournalInputEvents(ctx context.Context, inputJSON [][]byte) ([]int64, error) {
+	ids := make([]int64, len(inputJSON))
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for i := range inputJSON {
+			id, err := d.InputJournalTable.InsertInputJournal(ctx, txn, inputJSON[i])
+			if err != nil {
+				return fmt.Errorf("d.InputJournalTable.InsertInputJournal: %w", err)
+			}
+			ids[i] = id
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// ForgetJournalledInput removes an input event from the journal once it has
+// been processed.
+func (d *Database) ForgetJournalledInput(ctx context.Context, id int64) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.InputJournalTable.DeleteInputJournal(ctx, txn, id)
+	})
+}
+
+// JournalledInputs returns the input events which were journalled but never
+// processed, oldest first.
+func (d *Database) JournalledInputs(ctx context.Context) ([]types.JournalledInput, error) {
+	return d.InputJournalTable.SelectInputJournal(ctx, nil)
+}
+
+// SetRoomBlocked blocks or unblocks a room, so that local users can't join or
+// be invited to it.
+func (d *Database) SetRoomBlocked(ctx context.Context, roomID string, blocked bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if blocked {
+			return d.BlockedRoomsTable.InsertBlockedRoom(ctx, txn, roomID)
+		}
+		return d.BlockedRoomsTable.DeleteBlockedRoom(ctx, txn, roomID)
+	})
+}
+
+// IsRoomBlocked returns whether the room has been blocked.
+func (d *Database) IsRoomBlocked(ctx context.Context, roomID string) (bool, error) {
+	return d.BlockedRoomsTable.SelectRoomBlocked(ctx, nil, roomID)
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAddEventsSenderNID(m *sqlutil.Migrations) {
+	m.AddMigration(UpAddEventsSenderNID, DownAddEventsSenderNID)
+}
+
+// UpAddEventsSenderNID adds the sender of each event to the events table, so
+// that the events sent by a user can be found. Existing events are left with
+// a sender NID of 0, as the sender is only in their (possibly compressed)
+// event JSON.
+func UpAddEventsSenderNID(tx *sql.Tx) error {
+	var tables, columns int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'roomserver_events';`,
+	).Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("failed to query table: %w", err)
+	}
+	if tables == 0 {
+		// The table will be created with the column and index.
+		return nil
+	}
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM pragma_table_info('roomserver_events') WHERE name = 'sender_nid';`,
+	).Scan(&columns)
+	if err != nil {
+		return fmt.Errorf("failed to query columns: %w", err)
+	}
+	if columns == 0 {
+		if _, err = tx.Exec(`ALTER TABLE roomserver_events ADD COLUMN sender_nid INTEGER NOT NULL DEFAULT 0;`); err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS roomserver_events_sender_nid_idx ON roomserver_events (sender_nid, event_nid);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+// DownAddEventsSenderNID only drops the index, as SQLite can't drop columns
+// without rebuilding the table. The column is ignored by older versions.
+func DownAddEventsSenderNID(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP INDEX IF EXISTS roomserver_events_sender_nid_idx;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -47,10 +47,22 @@ const bulkSelectEventJSONSQL = `
 	  ORDER BY event_nid ASC
 `
 
+const selectEventJSONAfterSQL = `
+	SELECT event_nid, event_json FROM roomserver_event_json
+	  WHERE event_nid > $1
+	  ORDER BY event_nid ASC LIMIT $2
+`
+
+const updateEventJSONSQL = `
+	UPDATE roomserver_event_json SET event_json = $1 WHERE event_nid = $2 AND event_json = $3
+`
+
 type eventJSONStatements struct {
-	db                      *sql.DB
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	db                       *sql.DB
+	insertEventJSONStmt      *sql.Stmt
+	bulkSelectEventJSONStmt  *sql.Stmt
+	selectEventJSONAfterStmt *sql.Stmt
+	updateEventJSONStmt      *sql.Stmt
 }
 
 func NewSqliteEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
@@ -64,6 +76,8 @@ func NewSqliteEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectEventJSONAfterStmt, selectEventJSONAfterSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -105,3 +119,32 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], nil
 }
+
+func (s *eventJSONStatements) SelectEventJSONAfter(
+	ctx context.Context, afterEventNID types.EventNID, limit int,
+) ([]tables.EventJSONPair, error) {
+	rows, err := s.selectEventJSONAfterStmt.QueryContext(ctx, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventJSONAfter: rows.close() failed")
+
+	var results []tables.EventJSONPair
+	for rows.Next() {
+		var result tables.EventJSONPair
+		var eventNID int64
+		if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) UpdateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, oldEventJSON, newEventJSON []byte,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, newEventJSON, int64(eventNID), oldEventJSON)
+	return err
+}
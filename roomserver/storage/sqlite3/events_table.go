@@ -36,19 +36,26 @@ const eventsSchema = `
     room_nid INTEGER NOT NULL,
     event_type_nid INTEGER NOT NULL,
     event_state_key_nid INTEGER NOT NULL,
+    sender_nid INTEGER NOT NULL DEFAULT 0,
     sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
     state_snapshot_nid INTEGER NOT NULL DEFAULT 0,
     depth INTEGER NOT NULL,
+    origin_server_ts INTEGER NOT NULL DEFAULT 0,
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	soft_failed BOOLEAN NOT NULL DEFAULT FALSE,
+	is_outlier BOOLEAN NOT NULL DEFAULT FALSE,
+	is_expired BOOLEAN NOT NULL DEFAULT FALSE
   );
+  CREATE INDEX IF NOT EXISTS roomserver_events_sender_nid_idx ON roomserver_events (sender_nid, event_nid);
+  CREATE INDEX IF NOT EXISTS roomserver_events_origin_server_ts_idx ON roomserver_events (room_nid, origin_server_ts);
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, sender_nid, event_id, reference_sha256, auth_event_nids, depth, origin_server_ts, is_rejected, soft_failed, is_outlier)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 	  ON CONFLICT DO NOTHING;
 `
 
@@ -76,6 +83,15 @@ const selectEventSentToOutputSQL = "" +
 const updateEventSentToOutputSQL = "" +
 	"UPDATE roomserver_events SET sent_to_output = TRUE WHERE event_nid = $1"
 
+const updateEventRejectedSQL = "" +
+	"UPDATE roomserver_events SET is_rejected = $1 WHERE event_nid = $2"
+
+const updateEventOutlierSQL = "" +
+	"UPDATE roomserver_events SET is_outlier = $1 WHERE event_nid = $2"
+
+const selectEventRejectedSQL = "" +
+	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
+
 const selectEventIDSQL = "" +
 	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
 
@@ -98,6 +114,43 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
 
+const bulkSelectSoftFailedEventNIDSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE soft_failed = TRUE AND event_nid IN ($1)"
+
+const selectEventNIDsBySenderSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE sender_nid = $1 AND event_nid < $2" +
+	" ORDER BY event_nid DESC LIMIT $3"
+
+const selectRoomDAGEntriesSQL = "" +
+	"SELECT event_nid, state_snapshot_nid, is_rejected, soft_failed, is_outlier FROM roomserver_events" +
+	" WHERE room_nid = $1 AND depth >= $2 AND depth <= $3" +
+	" ORDER BY depth DESC, event_nid DESC LIMIT $4"
+
+// Events without a state snapshot, which were rejected or which were soft-failed
+// aren't part of the timeline of the room, so they are never returned.
+const selectEventByTimestampForwardsSQL = "" +
+	"SELECT event_nid, event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2 AND origin_server_ts > 0" +
+	" AND is_outlier = FALSE AND is_rejected = FALSE AND soft_failed = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+const selectEventByTimestampBackwardsSQL = "" +
+	"SELECT event_nid, event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2 AND origin_server_ts > 0" +
+	" AND is_outlier = FALSE AND is_rejected = FALSE AND soft_failed = FALSE" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
+// Only events in the timeline of the room which aren't state events can expire,
+// as the rest are needed for auth and state resolution.
+const selectExpiredEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts < $2 AND origin_server_ts > 0" +
+	" AND event_state_key_nid = 0 AND is_outlier = FALSE AND is_expired = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT $3"
+
+const updateEventExpiredSQL = "" +
+	"UPDATE roomserver_events SET is_expired = TRUE WHERE event_nid = $1"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -107,11 +160,20 @@ type eventStatements struct {
 	updateEventStateStmt                   *sql.Stmt
 	selectEventSentToOutputStmt            *sql.Stmt
 	updateEventSentToOutputStmt            *sql.Stmt
+	updateEventRejectedStmt                *sql.Stmt
+	updateEventOutlierStmt                 *sql.Stmt
+	selectEventRejectedStmt                *sql.Stmt
 	selectEventIDStmt                      *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
+	selectEventNIDsBySenderStmt            *sql.Stmt
+	selectRoomDAGEntriesStmt               *sql.Stmt
+	selectEventByTimestampForwardsStmt     *sql.Stmt
+	selectEventByTimestampBackwardsStmt    *sql.Stmt
+	selectExpiredEventNIDsStmt             *sql.Stmt
+	updateEventExpiredStmt                 *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt           *sql.Stmt
 }
 
@@ -131,12 +193,21 @@ func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.updateEventRejectedStmt, updateEventRejectedSQL},
+		{&s.updateEventOutlierStmt, updateEventOutlierSQL},
+		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.selectEventNIDsBySenderStmt, selectEventNIDsBySenderSQL},
+		{&s.selectRoomDAGEntriesStmt, selectRoomDAGEntriesSQL},
+		{&s.selectEventByTimestampForwardsStmt, selectEventByTimestampForwardsSQL},
+		{&s.selectEventByTimestampBackwardsStmt, selectEventByTimestampBackwardsSQL},
+		{&s.selectExpiredEventNIDsStmt, selectExpiredEventNIDsSQL},
+		{&s.updateEventExpiredStmt, updateEventExpiredSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 	}.Prepare(db)
 }
@@ -147,18 +218,22 @@ func (s *eventStatements) InsertEvent(
 	roomNID types.RoomNID,
 	eventTypeNID types.EventTypeNID,
 	eventStateKeyNID types.EventStateKeyNID,
+	senderNID types.EventStateKeyNID,
 	eventID string,
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	originServerTS gomatrixserverlib.Timestamp,
 	isRejected bool,
+	softFailed bool,
+	isOutlier bool,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	var eventNID int64
 	insertStmt := sqlutil.TxStmt(txn, s.insertEventStmt)
 	result, err := insertStmt.ExecContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected,
+		int64(senderNID), eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, int64(originServerTS), isRejected, softFailed, isOutlier,
 	)
 	if err != nil {
 		return 0, 0, err
@@ -303,6 +378,30 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 	return err
 }
 
+func (s *eventStatements) UpdateEventRejected(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, isRejected bool,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventRejectedStmt)
+	_, err := stmt.ExecContext(ctx, isRejected, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) UpdateEventOutlier(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, isOutlier bool,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventOutlierStmt)
+	_, err := stmt.ExecContext(ctx, isOutlier, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) SelectEventRejected(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string,
+) (rejected bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventRejectedStmt)
+	err = stmt.QueryRowContext(ctx, int64(roomNID), eventID).Scan(&rejected)
+	return
+}
+
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
@@ -509,7 +608,120 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) SelectEventNIDsBySender(
+	ctx context.Context, senderNID types.EventStateKeyNID, beforeEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectEventNIDsBySenderStmt.QueryContext(ctx, int64(senderNID), int64(beforeEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDsBySenderStmt: rows.close() failed")
+	var result []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		result = append(result, eventNID)
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomDAGEntries(
+	ctx context.Context, roomNID types.RoomNID, fromDepth, toDepth int64, limit int,
+) ([]types.RoomDAGEntry, error) {
+	rows, err := s.selectRoomDAGEntriesStmt.QueryContext(ctx, int64(roomNID), fromDepth, toDepth, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomDAGEntriesStmt: rows.close() failed")
+	var result []types.RoomDAGEntry
+	for rows.Next() {
+		var entry types.RoomDAGEntry
+		if err = rows.Scan(&entry.EventNID, &entry.StateSnapshotNID, &entry.IsRejected, &entry.SoftFailed, &entry.IsOutlier); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
 }
+
+// BulkSelectSoftFailedEventNID returns which of the given events were soft-failed.
+func (s *eventStatements) BulkSelectSoftFailedEventNID(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (map[types.EventNID]bool, error) {
+	results := make(map[types.EventNID]bool)
+	if len(eventNIDs) == 0 {
+		return results, nil
+	}
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = v
+	}
+	selectOrig := strings.Replace(bulkSelectSoftFailedEventNIDSQL, "($1)", sqlutil.QueryVariadic(len(iEventNIDs)), 1)
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, selectOrig, iEventNIDs...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, selectOrig, iEventNIDs...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectSoftFailedEventNID: rows.close() failed")
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = true
+	}
+	return results, rows.Err()
+}
+
+func (s *eventStatements) SelectEventByTimestamp(
+	ctx context.Context, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, forwards bool,
+) (types.EventNID, string, gomatrixserverlib.Timestamp, error) {
+	stmt := s.selectEventByTimestampBackwardsStmt
+	if forwards {
+		stmt = s.selectEventByTimestampForwardsStmt
+	}
+	var eventNID, originServerTS int64
+	var eventID string
+	err := stmt.QueryRowContext(ctx, int64(roomNID), int64(ts)).Scan(&eventNID, &eventID, &originServerTS)
+	return types.EventNID(eventNID), eventID, gomatrixserverlib.Timestamp(originServerTS), err
+}
+
+func (s *eventStatements) SelectExpiredEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectExpiredEventNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), int64(before), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectExpiredEventNIDsStmt: rows.close() failed")
+	var result []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		result = append(result, eventNID)
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) UpdateEventExpired(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventExpiredStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
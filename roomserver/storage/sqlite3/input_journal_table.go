@@ -0,0 +1,101 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const inputJournalSchema = `
+-- Holds input events which have been accepted but not processed yet. Events
+-- are removed once they have been processed, so any which are left when the
+-- roomserver starts must have been interrupted and are processed again.
+CREATE TABLE IF NOT EXISTS roomserver_input_journal (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The JSON of the api.InputRoomEvent.
+    input_json BLOB NOT NULL
+);
+`
+
+const insertInputJournalSQL = "" +
+	"INSERT INTO roomserver_input_journal (input_json) VALUES ($1)"
+
+const deleteInputJournalSQL = "" +
+	"DELETE FROM roomserver_input_journal WHERE id = $1"
+
+const selectInputJournalSQL = "" +
+	"SELECT id, input_json FROM roomserver_input_journal ORDER BY id ASC"
+
+type inputJournalStatements struct {
+	insertInputJournalStmt *sql.Stmt
+	deleteInputJournalStmt *sql.Stmt
+	selectInputJournalStmt *sql.Stmt
+}
+
+func NewSqliteInputJournalTable(db *sql.DB) (tables.InputJournal, error) {
+	s := &inputJournalStatements{}
+	_, err := db.Exec(inputJournalSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertInputJournalStmt, insertInputJournalSQL},
+		{&s.deleteInputJournalStmt, deleteInputJournalSQL},
+		{&s.selectInputJournalStmt, selectInputJournalSQL},
+	}.Prepare(db)
+}
+
+func (s *inputJournalStatements) InsertInputJournal(
+	ctx context.Context, txn *sql.Tx, inputJSON []byte,
+) (id int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.insertInputJournalStmt).ExecContext(ctx, inputJSON)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *inputJournalStatements) DeleteInputJournal(
+	ctx context.Context, txn *sql.Tx, id int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteInputJournalStmt).ExecContext(ctx, id)
+	return err
+}
+
+func (s *inputJournalStatements) SelectInputJournal(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.JournalledInput, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectInputJournalStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectInputJournal: rows.close() failed")
+	var result []types.JournalledInput
+	for rows.Next() {
+		var input types.JournalledInput
+		if err = rows.Scan(&input.ID, &input.InputJSON); err != nil {
+			return nil, err
+		}
+		result = append(result, input)
+	}
+	return result, rows.Err()
+}
@@ -55,6 +55,10 @@ const deleteRoomAliasSQL = `
 	DELETE FROM roomserver_room_aliases WHERE alias = $1
 `
 
+const updateRoomIDForAliasesSQL = `
+	UPDATE roomserver_room_aliases SET room_id = $1 WHERE room_id = $2
+`
+
 type roomAliasesStatements struct {
 	db                           *sql.DB
 	insertRoomAliasStmt          *sql.Stmt
@@ -62,6 +66,7 @@ type roomAliasesStatements struct {
 	selectAliasesFromRoomIDStmt  *sql.Stmt
 	selectCreatorIDFromAliasStmt *sql.Stmt
 	deleteRoomAliasStmt          *sql.Stmt
+	updateRoomIDForAliasesStmt   *sql.Stmt
 }
 
 func NewSqliteRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
@@ -78,6 +83,7 @@ func NewSqliteRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
 		{&s.selectAliasesFromRoomIDStmt, selectAliasesFromRoomIDSQL},
 		{&s.selectCreatorIDFromAliasStmt, selectCreatorIDFromAliasSQL},
 		{&s.deleteRoomAliasStmt, deleteRoomAliasSQL},
+		{&s.updateRoomIDForAliasesStmt, updateRoomIDForAliasesSQL},
 	}.Prepare(db)
 }
 
@@ -139,3 +145,11 @@ func (s *roomAliasesStatements) DeleteRoomAlias(
 	_, err := stmt.ExecContext(ctx, alias)
 	return err
 }
+
+func (s *roomAliasesStatements) UpdateRoomIDForAliases(
+	ctx context.Context, txn *sql.Tx, oldRoomID, newRoomID string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.updateRoomIDForAliasesStmt)
+	_, err = stmt.ExecContext(ctx, newRoomID, oldRoomID)
+	return
+}
@@ -36,7 +36,7 @@ type Database struct {
 }
 
 // Open a sqlite database.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (*Database, error) {
+func Open(dbProperties *config.DatabaseOptions, compression config.EventJSONCompression, cache caching.RoomServerCaches) (*Database, error) {
 	var d Database
 	var db *sql.DB
 	var err error
@@ -44,7 +44,6 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 		return nil, err
 	}
 
-	//db.Exec("PRAGMA journal_mode=WAL;")
 	//db.Exec("PRAGMA read_uncommitted = true;")
 
 	// FIXME: We are leaking connections somewhere. Setting this to 2 will eventually
@@ -61,10 +60,15 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadAddForgottenColumn(m)
+	deltas.LoadAddEventsSenderNID(m)
+	deltas.LoadAddEventsSoftFailed(m)
+	deltas.LoadAddEventsIsOutlier(m)
+	deltas.LoadAddEventsOriginServerTS(m)
+	deltas.LoadAddEventsIsExpired(m)
 	if err := m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
-	if err := d.prepare(db, cache); err != nil {
+	if err := d.prepare(db, compression, cache); err != nil {
 		return nil, err
 	}
 
@@ -72,7 +76,7 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 }
 
 // nolint: gocyclo
-func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
+func (d *Database) prepare(db *sql.DB, compression config.EventJSONCompression, cache caching.RoomServerCaches) error {
 	var err error
 	eventStateKeys, err := NewSqliteEventStateKeysTable(db)
 	if err != nil {
@@ -86,6 +90,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	eventJSONCodec, err := shared.NewEventJSONCodec(compression)
+	if err != nil {
+		return err
+	}
 	events, err := NewSqliteEventsTable(db)
 	if err != nil {
 		return err
@@ -130,6 +138,30 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	roomUsage, err := NewSqliteRoomUsageTable(db)
+	if err != nil {
+		return err
+	}
+	purge, err := NewSqlitePurgeStatements(db)
+	if err != nil {
+		return err
+	}
+	statistics, err := NewSqliteStatisticsStatements(db)
+	if err != nil {
+		return err
+	}
+	inputJournal, err := NewSqliteInputJournalTable(db)
+	if err != nil {
+		return err
+	}
+	blockedRooms, err := NewSqliteBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
+	recompression, err := NewSqliteRecompressionTable(db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                         db,
 		Cache:                      cache,
@@ -138,6 +170,7 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		EventTypesTable:            eventTypes,
 		EventStateKeysTable:        eventStateKeys,
 		EventJSONTable:             eventJSON,
+		EventJSONCodec:             eventJSONCodec,
 		RoomsTable:                 rooms,
 		TransactionsTable:          transactions,
 		StateBlockTable:            stateBlock,
@@ -148,6 +181,12 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		MembershipTable:            membership,
 		PublishedTable:             published,
 		RedactionsTable:            redactions,
+		PurgeStatements:            purge,
+		RoomUsageTable:             roomUsage,
+		InputJournalTable:          inputJournal,
+		BlockedRoomsTable:          blockedRooms,
+		RecompressionTable:         recompression,
+		StatisticsStatements:       statistics,
 		GetLatestEventsForUpdateFn: d.GetLatestEventsForUpdate,
 	}
 	return nil
@@ -26,12 +26,12 @@ import (
 )
 
 // Open opens a database connection.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (Database, error) {
+func Open(dbProperties *config.DatabaseOptions, compression config.EventJSONCompression, cache caching.RoomServerCaches) (Database, error) {
 	switch {
 	case dbProperties.ConnectionString.IsSQLite():
-		return sqlite3.Open(dbProperties, cache)
+		return sqlite3.Open(dbProperties, compression, cache)
 	case dbProperties.ConnectionString.IsPostgres():
-		return postgres.Open(dbProperties, cache)
+		return postgres.Open(dbProperties, compression, cache)
 	default:
 		return nil, fmt.Errorf("unexpected database type")
 	}
@@ -19,6 +19,11 @@ type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 	BulkSelectEventJSON(ctx context.Context, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	// SelectEventJSONAfter returns up to limit rows of event JSON with an event NID greater than afterEventNID, ordered by event NID.
+	SelectEventJSONAfter(ctx context.Context, afterEventNID types.EventNID, limit int) ([]EventJSONPair, error)
+	// UpdateEventJSON replaces the event JSON with newEventJSON only if it is still oldEventJSON, so that concurrent
+	// updates (e.g. redactions) are not lost.
+	UpdateEventJSON(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, oldEventJSON, newEventJSON []byte) error
 }
 
 type EventTypes interface {
@@ -36,8 +41,9 @@ type EventStateKeys interface {
 
 type Events interface {
 	InsertEvent(
-		ctx context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string,
-		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool,
+		ctx context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, senderNID types.EventStateKeyNID, eventID string,
+		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, originServerTS gomatrixserverlib.Timestamp,
+		isRejected, softFailed, isOutlier bool,
 	) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	// bulkSelectStateEventByID lookups a list of state events by event ID.
@@ -50,6 +56,10 @@ type Events interface {
 	UpdateEventState(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	SelectEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error)
 	UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	UpdateEventRejected(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, isRejected bool) error
+	UpdateEventOutlier(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, isOutlier bool) error
+	// SelectEventRejected returns whether the event was rejected. Returns sql.ErrNoRows if the event isn't in the room.
+	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
 	SelectEventID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (eventID string, err error)
 	BulkSelectStateAtEventAndReference(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]types.StateAtEventAndReference, error)
 	BulkSelectEventReference(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]gomatrixserverlib.EventReference, error)
@@ -60,6 +70,21 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
+	// SelectEventNIDsBySender returns the numeric IDs of up to limit events sent by the
+	// given user with numeric IDs lower than beforeEventNID, most recent first.
+	SelectEventNIDsBySender(ctx context.Context, senderNID types.EventStateKeyNID, beforeEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// SelectRoomDAGEntries returns up to limit events in the room with depths between fromDepth and toDepth
+	// inclusive, deepest first. Only the event NIDs of the entries are filled in.
+	SelectRoomDAGEntries(ctx context.Context, roomNID types.RoomNID, fromDepth, toDepth int64, limit int) ([]types.RoomDAGEntry, error)
+	// SelectEventByTimestamp returns the first event in the timeline of the room sent at or after ts if forwards is
+	// true, or the last event sent at or before ts otherwise. Returns sql.ErrNoRows if there is no such event.
+	SelectEventByTimestamp(ctx context.Context, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, forwards bool) (types.EventNID, string, gomatrixserverlib.Timestamp, error)
+	// BulkSelectSoftFailedEventNID returns which of the given events were soft-failed.
+	BulkSelectSoftFailedEventNID(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (map[types.EventNID]bool, error)
+	// SelectExpiredEventNIDs returns up to limit timeline events in the room which aren't state events, were
+	// sent before the given time and haven't expired yet, oldest first.
+	SelectExpiredEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, limit int) ([]types.EventNID, error)
+	UpdateEventExpired(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
 }
 
 type Rooms interface {
@@ -97,6 +122,7 @@ type RoomAliases interface {
 	SelectAliasesFromRoomID(ctx context.Context, roomID string) ([]string, error)
 	SelectCreatorIDFromAlias(ctx context.Context, alias string) (creatorID string, err error)
 	DeleteRoomAlias(ctx context.Context, txn *sql.Tx, alias string) (err error)
+	UpdateRoomIDForAliases(ctx context.Context, txn *sql.Tx, oldRoomID, newRoomID string) (err error)
 }
 
 type PreviousEvents interface {
@@ -126,7 +152,7 @@ type Membership interface {
 	SelectMembershipForUpdate(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (MembershipState, error)
 	SelectMembershipFromRoomAndTarget(ctx context.Context, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (types.EventNID, MembershipState, bool, error)
 	SelectMembershipsFromRoom(ctx context.Context, roomNID types.RoomNID, localOnly bool) (eventNIDs []types.EventNID, err error)
-	SelectMembershipsFromRoomAndMembership(ctx context.Context, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
+	SelectMembershipsFromRoomAndMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
 	UpdateMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership MembershipState, eventNID types.EventNID, forgotten bool) error
 	SelectRoomsWithMembership(ctx context.Context, userID types.EventStateKeyNID, membershipState MembershipState) ([]types.RoomNID, error)
 	// SelectJoinedUsersSetForRooms returns the set of all users in the rooms who are joined to any of these rooms, along with the
@@ -162,6 +188,66 @@ type Redactions interface {
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
 }
 
+type Purge interface {
+	// PurgeRoom removes all events, state and metadata for the given room.
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string) error
+}
+
+type RoomUsage interface {
+	// UpdateRoomUsage adds the given amounts to the storage usage counters for the room.
+	// The RoomID field of the usage is ignored.
+	UpdateRoomUsage(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, usage types.RoomUsage) error
+	// SelectRoomUsage returns the storage usage of the given room. Returns sql.ErrNoRows if the room has no usage.
+	SelectRoomUsage(ctx context.Context, roomID string) (types.RoomUsage, error)
+	// SelectLargestRoomUsages returns the storage usage of the rooms with the most event JSON stored.
+	SelectLargestRoomUsages(ctx context.Context, limit int) ([]types.RoomUsage, error)
+}
+
+// InputJournal holds input events which have been accepted by the roomserver
+// but not processed yet, so that they can be processed when the roomserver
+// starts up again if it stops before getting to them.
+type InputJournal interface {
+	InsertInputJournal(ctx context.Context, txn *sql.Tx, inputJSON []byte) (int64, error)
+	DeleteInputJournal(ctx context.Context, txn *sql.Tx, id int64) error
+	// SelectInputJournal returns all of the journalled input events in the
+	// order that they were journalled.
+	SelectInputJournal(ctx context.Context, txn *sql.Tx) ([]types.JournalledInput, error)
+}
+
+// BlockedRooms holds the rooms which have been blocked by a server
+// administrator, which local users can't join or be invited to.
+type BlockedRooms interface {
+	InsertBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	DeleteBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	SelectRoomBlocked(ctx context.Context, txn *sql.Tx, roomID string) (bool, error)
+}
+
+// Recompression holds how far the event JSON has been recompressed using a
+// compression algorithm.
+type Recompression interface {
+	// UpsertRecompression records that all event JSON up to and including the
+	// given event NID has been recompressed, forgetting the progress of any
+	// other compression algorithm.
+	UpsertRecompression(ctx context.Context, txn *sql.Tx, compression string, eventNID types.EventNID) error
+	// SelectRecompression returns the event NID that event JSON has been
+	// recompressed up to, or 0 if recompression hasn't started.
+	SelectRecompression(ctx context.Context, txn *sql.Tx, compression string) (types.EventNID, error)
+}
+
+// TableStatistic contains the approximate size of a table.
+type TableStatistic struct {
+	Table string
+	Rows  int64
+	// The size of the table on disk including indexes, or -1 if the
+	// database backend can't tell us.
+	SizeBytes int64
+}
+
+type Statistics interface {
+	// SelectTableStatistics returns the approximate row counts and sizes of the given tables.
+	SelectTableStatistics(ctx context.Context, tableNames []string) ([]TableStatistic, error)
+}
+
 // StrippedEvent represents a stripped event for returning extracted content values.
 type StrippedEvent struct {
 	RoomID       string
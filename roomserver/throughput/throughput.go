@@ -0,0 +1,159 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package throughput
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaxMinutes is the number of minutes of history kept for each room.
+const MaxMinutes = 60
+
+const (
+	// metricsRooms is the number of rooms which are reported in the metrics,
+	// which stops the number of room ID labels from growing without bound.
+	metricsRooms = 10
+	// metricsMinutes is the number of minutes that the events per minute in
+	// the metrics are averaged over.
+	metricsMinutes = 5
+)
+
+var busiestRooms = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "busiest_rooms_events_per_minute",
+		Help:      "The number of events received per minute by the busiest rooms, averaged over the last few minutes",
+	},
+	[]string{"room_id"},
+)
+
+func init() {
+	prometheus.MustRegister(busiestRooms)
+}
+
+// RoomCount is the number of events that a room received over some minutes.
+type RoomCount struct {
+	RoomID          string  `json:"room_id"`
+	Events          int64   `json:"events"`
+	EventsPerMinute float64 `json:"events_per_minute"`
+}
+
+// roomCounts is a ring buffer of the number of events received by a room in
+// each minute, indexed by the minute modulo MaxMinutes.
+type roomCounts struct {
+	counts [MaxMinutes]int64
+	latest int64 // the minute that was last written to
+}
+
+// RoomThroughput keeps track of how many events each room has received in
+// each of the last MaxMinutes minutes, so that the rooms which are causing
+// load can be found. Nothing is stored in the database, so the counts start
+// again from zero when the roomserver restarts.
+type RoomThroughput struct {
+	mutex sync.Mutex             // protects the below
+	rooms map[string]*roomCounts // room ID -> counts
+	now   func() time.Time
+}
+
+func NewRoomThroughput() *RoomThroughput {
+	return &RoomThroughput{
+		rooms: make(map[string]*roomCounts),
+		now:   time.Now,
+	}
+}
+
+func (t *RoomThroughput) minute() int64 {
+	return t.now().Unix() / 60
+}
+
+// OnEvent should be called for every event that the room receives.
+func (t *RoomThroughput) OnEvent(roomID string) {
+	minute := t.minute()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, ok := t.rooms[roomID]
+	if !ok {
+		c = &roomCounts{latest: minute}
+		t.rooms[roomID] = c
+	}
+	// Clear out the minutes which went by without any events, so that the
+	// counts from the last time around the ring aren't included.
+	for m := c.latest + 1; m <= minute && m <= c.latest+MaxMinutes; m++ {
+		c.counts[m%MaxMinutes] = 0
+	}
+	if minute > c.latest {
+		c.latest = minute
+	}
+	c.counts[minute%MaxMinutes]++
+}
+
+// Busiest returns up to limit rooms which received the most events over the
+// given number of minutes, including the current one, busiest first. Rooms
+// which haven't received any events in the last MaxMinutes minutes are
+// forgotten.
+func (t *RoomThroughput) Busiest(minutes, limit int) []RoomCount {
+	if minutes <= 0 || minutes > MaxMinutes {
+		minutes = MaxMinutes
+	}
+	now := t.minute()
+	t.mutex.Lock()
+	var result []RoomCount
+	for roomID, c := range t.rooms {
+		if now-c.latest >= MaxMinutes {
+			delete(t.rooms, roomID)
+			continue
+		}
+		var events int64
+		for m := now - int64(minutes) + 1; m <= c.latest; m++ {
+			events += c.counts[m%MaxMinutes]
+		}
+		if events > 0 {
+			result = append(result, RoomCount{
+				RoomID:          roomID,
+				Events:          events,
+				EventsPerMinute: float64(events) / float64(minutes),
+			})
+		}
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Events != result[j].Events {
+			return result[i].Events > result[j].Events
+		}
+		return result[i].RoomID < result[j].RoomID
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// RunMetrics updates the busiest rooms metrics every minute. It never returns.
+func (t *RoomThroughput) RunMetrics() {
+	for {
+		rooms := t.Busiest(metricsMinutes, metricsRooms)
+		busiestRooms.Reset()
+		for _, room := range rooms {
+			busiestRooms.WithLabelValues(room.RoomID).Set(room.EventsPerMinute)
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,49 @@
+package throughput
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoomThroughput(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tp := NewRoomThroughput()
+	tp.now = func() time.Time { return now }
+
+	send := func(roomID string, count int) {
+		for i := 0; i < count; i++ {
+			tp.OnEvent(roomID)
+		}
+	}
+	send("!quiet:a", 1)
+	send("!busy:a", 10)
+	now = now.Add(time.Minute)
+	send("!busy:a", 20)
+	send("!medium:a", 5)
+
+	if got, want := tp.Busiest(1, 10), []RoomCount{
+		{RoomID: "!busy:a", Events: 20, EventsPerMinute: 20},
+		{RoomID: "!medium:a", Events: 5, EventsPerMinute: 5},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("over one minute: got %+v, want %+v", got, want)
+	}
+	if got, want := tp.Busiest(2, 2), []RoomCount{
+		{RoomID: "!busy:a", Events: 30, EventsPerMinute: 15},
+		{RoomID: "!medium:a", Events: 5, EventsPerMinute: 2.5},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("over two minutes: got %+v, want %+v", got, want)
+	}
+
+	// Going all the way around the ring shouldn't count the old minutes.
+	now = now.Add(time.Minute * MaxMinutes)
+	send("!busy:a", 1)
+	if got, want := tp.Busiest(MaxMinutes, 10), []RoomCount{
+		{RoomID: "!busy:a", Events: 1, EventsPerMinute: 1.0 / MaxMinutes},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after an hour: got %+v, want %+v", got, want)
+	}
+	if len(tp.rooms) != 1 {
+		t.Fatalf("expected quiet rooms to be forgotten, got %d rooms", len(tp.rooms))
+	}
+}
@@ -16,6 +16,7 @@
 package types
 
 import (
+	"errors"
 	"sort"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -169,6 +170,41 @@ type MissingEventError string
 
 func (e MissingEventError) Error() string { return string(e) }
 
+// ErrRoomNotFound is returned when an operation refers to a room that the
+// roomserver doesn't know about.
+var ErrRoomNotFound = errors.New("room not found")
+
+// ErrRoomHasLocalMembers is returned when trying to purge a room that
+// local users are still joined to.
+var ErrRoomHasLocalMembers = errors.New("room still has joined local members")
+
+// RoomUsage contains approximate storage usage counters for a room.
+type RoomUsage struct {
+	RoomID          string
+	Events          int64
+	EventJSONBytes  int64
+	StateSnapshots  int64
+	MediaReferences int64
+}
+
+// RoomDAGEntry is an event in a room's DAG along with how it was stored,
+// which is useful when debugging problems with the state of a room.
+type RoomDAGEntry struct {
+	Event
+	// The state before the event, or 0 if the event is an outlier.
+	StateSnapshotNID StateSnapshotNID
+	IsRejected       bool
+	SoftFailed       bool
+	IsOutlier        bool
+}
+
+// JournalledInput is an input event which was accepted by the roomserver,
+// as it was given in the JSON of an api.InputRoomEvent.
+type JournalledInput struct {
+	ID        int64
+	InputJSON []byte
+}
+
 // RoomInfo contains metadata about a room
 type RoomInfo struct {
 	RoomNID          RoomNID
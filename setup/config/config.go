@@ -253,6 +253,24 @@ func loadConfig(
 		c.Global.OldVerifyKeys[i].KeyID, c.Global.OldVerifyKeys[i].PrivateKey = keyID, privateKey
 	}
 
+	for _, virtualHost := range c.Global.VirtualHosts {
+		var virtualHostKeyData []byte
+
+		virtualHostKeyPath := absPath(basePath, virtualHost.PrivateKeyPath)
+		virtualHostKeyData, err = readFile(virtualHostKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if virtualHost.KeyID, virtualHost.PrivateKey, err = readKeyPEM(virtualHostKeyPath, virtualHostKeyData, true); err != nil {
+			return nil, err
+		}
+
+		if virtualHost.KeyValidityPeriod == 0 {
+			virtualHost.KeyValidityPeriod = c.Global.KeyValidityPeriod
+		}
+	}
+
 	c.MediaAPI.AbsBasePath = Path(absPath(basePath, c.MediaAPI.BasePath))
 
 	// Generate data from config options
@@ -272,18 +290,41 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
 	if config.ClientAPI.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.ClientAPI.RecaptchaPublicKey}
+	}
+
+	switch {
+	case len(config.ClientAPI.RegistrationFlows) > 0:
+		for _, stages := range config.ClientAPI.RegistrationFlows {
+			flow := authtypes.Flow{Stages: make([]authtypes.LoginType, 0, len(stages))}
+			for _, stage := range stages {
+				flow.Stages = append(flow.Stages, authtypes.LoginType(stage))
+			}
+			config.Derived.Registration.Flows = append(config.Derived.Registration.Flows, flow)
+		}
+	case config.ClientAPI.RecaptchaEnabled:
 		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}})
-	} else {
+	default:
 		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
 
+	if config.ClientAPI.RegistrationRequiresToken {
+	flows:
+		for i, flow := range config.Derived.Registration.Flows {
+			for _, stage := range flow.Stages {
+				if stage == authtypes.LoginTypeRegistrationToken {
+					continue flows
+				}
+			}
+			config.Derived.Registration.Flows[i].Stages = append(flow.Stages, authtypes.LoginTypeRegistrationToken)
+		}
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
 		return err
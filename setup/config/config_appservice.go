@@ -34,6 +34,9 @@ type AppServiceAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	ConfigFiles []string `yaml:"config_files"`
+
+	// External HTTP endpoints that selected room events are sent to.
+	Webhooks []Webhook `yaml:"webhooks"`
 }
 
 func (c *AppServiceAPI) Defaults() {
@@ -47,6 +50,48 @@ func (c *AppServiceAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "app_service_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "app_service_api.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "app_service_api.database.connection_string", string(c.Database.ConnectionString))
+	seen := map[string]bool{}
+	for _, webhook := range c.Webhooks {
+		checkNotEmpty(configErrs, "app_service_api.webhooks.id", webhook.ID)
+		checkURL(configErrs, "app_service_api.webhooks.url", webhook.URL)
+		if seen[webhook.ID] {
+			configErrs.Add(fmt.Sprintf("duplicate webhook ID %q in config key %q", webhook.ID, "app_service_api.webhooks"))
+		}
+		seen[webhook.ID] = true
+	}
+}
+
+// A Webhook is an external HTTP endpoint that room events are POSTed to, as
+// a simpler alternative to writing an application service.
+type Webhook struct {
+	// A unique, persistent ID for the webhook. Events that haven't been sent
+	// yet are queued under this ID, so changing it will drop them.
+	ID string `yaml:"id"`
+	// The URL to POST events to.
+	URL string `yaml:"url"`
+	// A shared secret used to sign each request, so that the endpoint can
+	// check that the request came from us. Requests aren't signed if empty.
+	Secret string `yaml:"secret"`
+	// The room IDs to send events from. Events from all rooms are sent if empty.
+	Rooms []string `yaml:"rooms"`
+	// The event types to send. Events of all types are sent if empty.
+	EventTypes []string `yaml:"event_types"`
+}
+
+// IsInterestedInEvent returns true if events of the given type in the given
+// room should be sent to the webhook.
+func (w *Webhook) IsInterestedInEvent(roomID, eventType string) bool {
+	return (len(w.Rooms) == 0 || contains(w.Rooms, roomID)) &&
+		(len(w.EventTypes) == 0 || contains(w.EventTypes, eventType))
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 // ApplicationServiceNamespace is the namespace that a specific application
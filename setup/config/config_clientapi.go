@@ -2,9 +2,18 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
 	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 )
 
+// validIdentityProviderID matches the IDs allowed for identity providers by
+// the spec.
+var validIdentityProviderID = regexp.MustCompile(`^[a-z0-9._~-]{1,255}$`)
+
 type ClientAPI struct {
 	Matrix  *Global  `yaml:"-"`
 	Derived *Derived `yaml:"-"` // TODO: Nuke Derived from orbit
@@ -18,6 +27,9 @@ type ClientAPI struct {
 	// If set, allows registration by anyone who also has the shared
 	// secret, even if registration is otherwise disabled.
 	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+	// If set, new users need a registration token to register. Tokens are
+	// created by server administrators using the admin API.
+	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
 
 	// Boolean stating whether catpcha registration is enabled
 	// and required
@@ -32,11 +44,33 @@ type ClientAPI struct {
 	// was successful
 	RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
 
+	// The flows that clients can complete to register, each of which is a
+	// list of stages. If empty then registration needs the captcha stage if
+	// it's enabled, or the dummy stage otherwise.
+	RegistrationFlows [][]string `yaml:"registration_flows"`
+
+	// Room IDs or aliases that newly registered users will be joined to.
+	// Rooms with local aliases that don't exist yet will be created by the
+	// first user to register.
+	AutoJoinRooms []string `yaml:"auto_join_rooms"`
+
+	// Options for sending a welcome message to newly registered users.
+	WelcomeMessage WelcomeMessage `yaml:"welcome_message"`
+
 	// TURN options
 	TURN TURN `yaml:"turn"`
 
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
+
+	// Options for logging in through single sign-on providers
+	SSO SSO `yaml:"sso"`
+
+	// If set, the client API rejects requests which would write to the
+	// database, e.g. during database migrations or backups. Reads such as
+	// /sync and /messages continue to work. Server administrators can also
+	// change this at runtime using the /_dendrite/admin/v1/readOnly endpoint.
+	ReadOnly bool `yaml:"read_only"`
 }
 
 func (c *ClientAPI) Defaults() {
@@ -64,8 +98,57 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", string(c.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", string(c.RecaptchaSiteVerifyAPI))
 	}
+	for _, flow := range c.RegistrationFlows {
+		if len(flow) == 0 {
+			configErrs.Add("invalid value for config key \"client_api.registration_flows\": flows must have at least one stage")
+		}
+		for _, stage := range flow {
+			switch stage {
+			case authtypes.LoginTypeDummy, authtypes.LoginTypeRegistrationToken:
+			case authtypes.LoginTypeRecaptcha:
+				if !c.RecaptchaEnabled {
+					configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.registration_flows\": %q needs enable_registration_captcha", stage))
+				}
+			case authtypes.LoginTypeEmail:
+				if c.Matrix == nil || len(c.Matrix.TrustedIDServers) == 0 {
+					configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.registration_flows\": %q needs global.trusted_third_party_id_servers", stage))
+				}
+			default:
+				configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.registration_flows\": unknown stage %q", stage))
+			}
+		}
+	}
+	for _, room := range c.AutoJoinRooms {
+		if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") {
+			configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.auto_join_rooms\": %q is not a room ID or alias", room))
+		}
+	}
+	c.WelcomeMessage.Verify(configErrs)
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.SSO.Verify(configErrs)
+}
+
+type WelcomeMessage struct {
+	// Whether or not to send newly registered users a welcome message
+	Enabled bool `yaml:"enabled"`
+	// The localpart of the user that sends the welcome message. The account
+	// is created without a password if it doesn't exist yet.
+	SenderLocalpart string `yaml:"sender_localpart"`
+	// The body of the message, as a Go text/template. The template is given
+	// the UserID, Localpart, DisplayName and ServerName of the new user.
+	Template string `yaml:"template"`
+}
+
+func (c *WelcomeMessage) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.welcome_message.sender_localpart", c.SenderLocalpart)
+	checkNotEmpty(configErrs, "client_api.welcome_message.template", c.Template)
+	if _, err := template.New("welcome_message").Parse(c.Template); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.welcome_message.template\": %s", err))
+	}
 }
 
 type TURN struct {
@@ -121,3 +204,70 @@ func (r *RateLimiting) Defaults() {
 	r.Threshold = 5
 	r.CooloffMS = 500
 }
+
+type SSO struct {
+	// Whether or not people can log in through the identity providers
+	Enabled bool `yaml:"enabled"`
+	// The URL that clients reach the client API on, such as
+	// https://matrix.example.com, which the identity providers redirect
+	// people back to once they've logged in.
+	PublicBaseURL string `yaml:"public_base_url"`
+	// The URLs that clients can ask for people to be sent back to with a
+	// login token once they've logged in. URLs are allowed if they have the
+	// same scheme and host as one of these and a path starting with its path.
+	// If empty then only URLs on the public base URL are allowed.
+	ClientRedirectURLs []string `yaml:"client_redirect_urls"`
+	// The OpenID Connect identity providers that people can log in through
+	Providers []IdentityProvider `yaml:"providers"`
+}
+
+// IdentityProvider is an OpenID Connect provider. The endpoints are found
+// through discovery using the issuer, unless they are all given.
+type IdentityProvider struct {
+	// The ID of the provider, which is given to clients and is used to map
+	// people to accounts, so it shouldn't be changed
+	ID string `yaml:"id"`
+	// The name of the provider which is shown to people
+	Name string `yaml:"name"`
+	// The issuer URL of the provider
+	Issuer string `yaml:"issuer"`
+	// The endpoints of the provider, if discovery isn't used
+	AuthorizationURL string `yaml:"authorization_url"`
+	TokenURL         string `yaml:"token_url"`
+	UserInfoURL      string `yaml:"userinfo_url"`
+	// The credentials of the client registered with the provider
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The scopes to request. Defaults to openid and profile.
+	Scopes []string `yaml:"scopes"`
+	// The claim to take the localpart of new accounts from. Defaults to
+	// preferred_username.
+	LocalpartClaim string `yaml:"localpart_claim"`
+	// The claim to take the display name of new accounts from. Defaults to
+	// name.
+	DisplayNameClaim string `yaml:"display_name_claim"`
+}
+
+func (c *SSO) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkURL(configErrs, "client_api.sso.public_base_url", c.PublicBaseURL)
+	if len(c.Providers) == 0 {
+		configErrs.Add("invalid value for config key \"client_api.sso.providers\": at least one provider is needed")
+	}
+	seen := make(map[string]bool, len(c.Providers))
+	for _, p := range c.Providers {
+		if !validIdentityProviderID.MatchString(p.ID) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.sso.providers.id\": %q must be 1-255 characters from a-z, 0-9, ., _, ~ and -", p.ID))
+		} else if seen[p.ID] {
+			configErrs.Add(fmt.Sprintf("invalid value for config key \"client_api.sso.providers.id\": %q is used more than once", p.ID))
+		}
+		seen[p.ID] = true
+		checkNotEmpty(configErrs, "client_api.sso.providers.name", p.Name)
+		checkNotEmpty(configErrs, "client_api.sso.providers.client_id", p.ClientID)
+		if p.AuthorizationURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+			checkURL(configErrs, "client_api.sso.providers.issuer", p.Issuer)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package config
 
+import (
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 type FederationAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -12,12 +18,16 @@ type FederationAPI struct {
 	// to match one of these certificates.
 	// The certificates should be in PEM format.
 	FederationCertificatePaths []Path `yaml:"federation_certificates"`
+
+	// Limits on the transactions that other servers can send to us.
+	InboundLimits FederationInboundLimits `yaml:"inbound_limits"`
 }
 
 func (c *FederationAPI) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7772"
 	c.InternalAPI.Connect = "http://localhost:7772"
 	c.ExternalAPI.Listen = "http://[::]:8072"
+	c.InboundLimits.Defaults()
 }
 
 func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -28,4 +38,63 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	}
 	// TODO: not applicable always, e.g. in demos
 	//checkNotZero(configErrs, "federation_api.federation_certificates", int64(len(c.FederationCertificatePaths)))
+	c.InboundLimits.Verify(configErrs)
+}
+
+type FederationInboundLimits struct {
+	// Are the limits enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The limits which apply to servers that don't have an override.
+	InboundLimits `yaml:",inline"`
+
+	// Different limits for specific servers, e.g. trusted peers that are
+	// expected to send a lot of traffic. These replace the default limits
+	// entirely, so any limit left out doesn't apply to that server.
+	Overrides map[gomatrixserverlib.ServerName]InboundLimits `yaml:"overrides"`
+}
+
+// InboundLimits are the limits for a single origin server. A limit of 0
+// means that there is no limit.
+type InboundLimits struct {
+	// The largest transaction body that will be accepted, in bytes.
+	MaxTransactionBytes int64 `yaml:"max_transaction_bytes"`
+
+	// The most PDUs that a transaction can contain. Transactions can never
+	// contain more than 50 PDUs, regardless of this setting.
+	MaxPDUsPerTransaction int64 `yaml:"max_pdus_per_transaction"`
+
+	// How many transactions the server can send us per minute.
+	TransactionsPerMinute int64 `yaml:"transactions_per_minute"`
+}
+
+// ForOrigin returns the limits that apply to the given origin server.
+func (c *FederationInboundLimits) ForOrigin(origin gomatrixserverlib.ServerName) InboundLimits {
+	if limits, ok := c.Overrides[origin]; ok {
+		return limits
+	}
+	return c.InboundLimits
+}
+
+func (c *FederationInboundLimits) Defaults() {
+	c.Enabled = true
+	c.MaxTransactionBytes = 10 * 1024 * 1024
+	c.MaxPDUsPerTransaction = 50
+	c.TransactionsPerMinute = 300
+}
+
+func (c *FederationInboundLimits) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	c.InboundLimits.verify(configErrs, "federation_api.inbound_limits")
+	for origin, limits := range c.Overrides {
+		limits.verify(configErrs, fmt.Sprintf("federation_api.inbound_limits.overrides.%s", origin))
+	}
+}
+
+func (l *InboundLimits) verify(configErrs *ConfigErrors, prefix string) {
+	checkPositive(configErrs, prefix+".max_transaction_bytes", l.MaxTransactionBytes)
+	checkPositive(configErrs, prefix+".max_pdus_per_transaction", l.MaxPDUsPerTransaction)
+	checkPositive(configErrs, prefix+".transactions_per_minute", l.TransactionsPerMinute)
 }
@@ -20,6 +20,53 @@ type FederationSender struct {
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
 
 	Proxy Proxy `yaml:"proxy_outbound"`
+
+	// Periodic probing of the servers that we federate with the most.
+	LatencyProbe LatencyProbe `yaml:"latency_probe"`
+}
+
+// LatencyProbe configures a background prober which measures the round trip
+// time and key fetch success of the servers that we share the most rooms with,
+// so that it is possible to tell whether federation is slow in general or
+// only with certain servers.
+type LatencyProbe struct {
+	// Whether servers are probed at all.
+	Enabled bool `yaml:"enabled"`
+	// How often to probe each server in milliseconds.
+	IntervalMS int64 `yaml:"interval_ms"`
+	// How long to wait for a server to reply in milliseconds.
+	TimeoutMS int64 `yaml:"timeout_ms"`
+	// How many servers to probe, starting with those that we share the most
+	// rooms with.
+	Peers int `yaml:"peers"`
+	// How many of the most recent probes to keep for each server.
+	History int `yaml:"history"`
+}
+
+func (c *LatencyProbe) Defaults() {
+	c.Enabled = false
+	c.IntervalMS = 300000
+	c.TimeoutMS = 10000
+	c.Peers = 20
+	c.History = 12
+}
+
+func (c *LatencyProbe) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	for _, option := range []struct {
+		key   string
+		value int64
+	}{
+		{"federation_sender.latency_probe.interval_ms", c.IntervalMS},
+		{"federation_sender.latency_probe.timeout_ms", c.TimeoutMS},
+		{"federation_sender.latency_probe.peers", int64(c.Peers)},
+		{"federation_sender.latency_probe.history", int64(c.History)},
+	} {
+		checkNotZero(configErrs, option.key, option.value)
+		checkPositive(configErrs, option.key, option.value)
+	}
 }
 
 func (c *FederationSender) Defaults() {
@@ -32,12 +79,14 @@ func (c *FederationSender) Defaults() {
 	c.DisableTLSValidation = false
 
 	c.Proxy.Defaults()
+	c.LatencyProbe.Defaults()
 }
 
 func (c *FederationSender) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "federation_sender.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "federation_sender.internal_api.connect", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "federation_sender.database.connection_string", string(c.Database.ConnectionString))
+	c.LatencyProbe.Verify(configErrs)
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"math/rand"
+	"net"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -34,6 +36,12 @@ type Global struct {
 	// Defaults to 24 hours.
 	KeyValidityPeriod time.Duration `yaml:"key_validity_period"`
 
+	// Additional server names that this server is responsible for, each with its
+	// own signing key. Federation requests are routed to the right server name by
+	// the Host header of the request.
+	// Defaults to an empty array.
+	VirtualHosts []*VirtualHost `yaml:"virtual_hosts"`
+
 	// Disables federation. Dendrite will not be able to make any outbound HTTP requests
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
@@ -43,11 +51,30 @@ type Global struct {
 	// Defaults to an empty array.
 	TrustedIDServers []string `yaml:"trusted_third_party_id_servers"`
 
+	// List of fully-qualified user IDs of local users who are allowed to use the
+	// server administration endpoints.
+	// Defaults to an empty array.
+	AdminUsers []string `yaml:"admin_users"`
+
+	// A shared secret which can be sent as the access token to use the server
+	// administration endpoints without logging in as one of the AdminUsers.
+	// Defaults to empty, which only allows the AdminUsers.
+	AdminToken string `yaml:"admin_token"`
+
 	// Kafka/Naffka configuration
 	Kafka Kafka `yaml:"kafka"`
 
 	// Metrics configuration
 	Metrics Metrics `yaml:"metrics"`
+
+	// Backup configuration
+	Backup Backup `yaml:"backup"`
+
+	// In-memory cache configuration
+	Cache Cache `yaml:"cache"`
+
+	// Cross-Origin Resource Sharing configuration for the client and media APIs
+	CORS CORS `yaml:"cors"`
 }
 
 func (c *Global) Defaults() {
@@ -59,14 +86,109 @@ func (c *Global) Defaults() {
 
 	c.Kafka.Defaults()
 	c.Metrics.Defaults()
+	c.Backup.Defaults()
+	c.Cache.Defaults()
+	c.CORS.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "global.server_name", string(c.ServerName))
 	checkNotEmpty(configErrs, "global.private_key", string(c.PrivateKeyPath))
 
+	seen := map[gomatrixserverlib.ServerName]bool{c.ServerName: true}
+	for _, v := range c.VirtualHosts {
+		checkNotEmpty(configErrs, "global.virtual_hosts.server_name", string(v.ServerName))
+		checkNotEmpty(configErrs, "global.virtual_hosts.private_key", string(v.PrivateKeyPath))
+		if seen[v.ServerName] {
+			configErrs.Add(fmt.Sprintf("duplicate server name %q in config key %q", v.ServerName, "global.virtual_hosts"))
+		}
+		seen[v.ServerName] = true
+	}
+
 	c.Kafka.Verify(configErrs, isMonolith)
 	c.Metrics.Verify(configErrs, isMonolith)
+	c.Backup.Verify(configErrs, isMonolith)
+	c.Cache.Verify(configErrs, isMonolith)
+	c.CORS.Verify(configErrs, isMonolith)
+}
+
+// IsAdmin returns true if the given user ID is listed as a server administrator.
+func (c *Global) IsAdmin(userID string) bool {
+	for _, admin := range c.AdminUsers {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocalServerName returns true if the given server name is either the
+// server name of this server or one of its virtual hosts.
+func (c *Global) IsLocalServerName(serverName gomatrixserverlib.ServerName) bool {
+	return c.VirtualHostFor(serverName) != nil
+}
+
+// VirtualHostFor returns the server name, signing key and key validity
+// period to use for the given local server name, which may be the server
+// name of this server itself. Returns nil if the server name isn't local.
+func (c *Global) VirtualHostFor(serverName gomatrixserverlib.ServerName) *VirtualHost {
+	if serverName == c.ServerName {
+		return &VirtualHost{
+			ServerName:        c.ServerName,
+			PrivateKeyPath:    c.PrivateKeyPath,
+			PrivateKey:        c.PrivateKey,
+			KeyID:             c.KeyID,
+			KeyValidityPeriod: c.KeyValidityPeriod,
+		}
+	}
+	for _, v := range c.VirtualHosts {
+		if v.ServerName == serverName {
+			return v
+		}
+	}
+	return nil
+}
+
+// ServerNameForHost returns the local server name that a request with the
+// given Host header was sent to. The Host header may or may not include
+// the port. If it doesn't match any of the virtual hosts then the server
+// name of this server is returned, since the request may have been
+// delegated to us through .well-known or SRV records.
+func (c *Global) ServerNameForHost(host string) gomatrixserverlib.ServerName {
+	if host == "" {
+		return c.ServerName
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, v := range c.VirtualHosts {
+		if string(v.ServerName) == host || string(v.ServerName) == hostname {
+			return v.ServerName
+		}
+	}
+	return c.ServerName
+}
+
+// A VirtualHost is an additional server name that this server is responsible
+// for, with its own signing key.
+type VirtualHost struct {
+	// The server name of the virtual host, e.g. 'example.com'.
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+
+	// Path to the private key which will be used to sign requests and events
+	// for this virtual host.
+	PrivateKeyPath Path `yaml:"private_key"`
+
+	// The private key itself.
+	PrivateKey ed25519.PrivateKey `yaml:"-"`
+
+	// The key ID of the private key.
+	KeyID gomatrixserverlib.KeyID `yaml:"-"`
+
+	// How long a remote server can cache the key for this virtual host for.
+	// Defaults to the key validity period of the server.
+	KeyValidityPeriod time.Duration `yaml:"key_validity_period"`
 }
 
 type OldVerifyKeys struct {
@@ -106,6 +228,61 @@ func (c *Metrics) Defaults() {
 func (c *Metrics) Verify(configErrs *ConfigErrors, isMonolith bool) {
 }
 
+// The configuration to use for online backups
+type Backup struct {
+	// The directory that backups are written to
+	Directory Path `yaml:"directory"`
+	// The pg_dump binary used to back up PostgreSQL databases
+	PgDumpPath string `yaml:"pg_dump_path"`
+}
+
+func (c *Backup) Defaults() {
+	c.Directory = "./backups"
+	c.PgDumpPath = "pg_dump"
+}
+
+func (c *Backup) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkNotEmpty(configErrs, "global.backup.directory", string(c.Directory))
+	checkNotEmpty(configErrs, "global.backup.pg_dump_path", c.PgDumpPath)
+}
+
+// The configuration to use for the in-memory caches
+type Cache struct {
+	// The estimated total number of bytes that all of the in-memory caches may
+	// use together. Once they grow past this, the least recently used entries
+	// of all caches are evicted. Zero or less means no limit other than the
+	// number of entries in each cache.
+	EstimatedMaxSizeBytes int64 `yaml:"max_size_estimated_bytes"`
+}
+
+func (c *Cache) Defaults() {
+	c.EstimatedMaxSizeBytes = 1024 * 1024 * 1024
+}
+
+func (c *Cache) Verify(configErrs *ConfigErrors, isMonolith bool) {
+}
+
+// The CORS headers to send in responses from the client and media APIs, which
+// decide whether web clients served from other origins can use them.
+type CORS struct {
+	// The origins which web clients may be served from, or "*" for any origin.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// The request headers which web clients may send.
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// How long browsers may cache the result of a preflight request for. Zero
+	// or less leaves it up to the browser.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c *CORS) Defaults() {
+	c.AllowedOrigins = []string{"*"}
+	c.AllowedHeaders = []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization"}
+}
+
+func (c *CORS) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkNotZero(configErrs, "global.cors.allowed_origins", int64(len(c.AllowedOrigins)))
+}
+
 type DatabaseOptions struct {
 	// The connection string, file:filename.db or postgres://server....
 	ConnectionString DataSource `yaml:"connection_string"`
@@ -115,12 +292,18 @@ type DatabaseOptions struct {
 	MaxIdleConnections int `yaml:"max_idle_conns"`
 	// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 	ConnMaxLifetimeSeconds int `yaml:"conn_max_lifetime"`
+	// SQLite only: how often (in seconds) to check the size of the write-ahead log (<= 0 means never)
+	WALCheckpointIntervalSeconds int `yaml:"wal_checkpoint_interval"`
+	// SQLite only: the write-ahead log is checkpointed and truncated once it is at least this big
+	WALCheckpointThresholdBytes int64 `yaml:"wal_checkpoint_threshold_bytes"`
 }
 
 func (c *DatabaseOptions) Defaults() {
 	c.MaxOpenConnections = 100
 	c.MaxIdleConnections = 2
 	c.ConnMaxLifetimeSeconds = -1
+	c.WALCheckpointIntervalSeconds = 300
+	c.WALCheckpointThresholdBytes = 64 * 1024 * 1024
 }
 
 func (c *DatabaseOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -140,3 +323,8 @@ func (c DatabaseOptions) MaxOpenConns() int {
 func (c DatabaseOptions) ConnMaxLifetime() time.Duration {
 	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
 }
+
+// WALCheckpointInterval returns how often to check the size of the SQLite write-ahead log
+func (c DatabaseOptions) WALCheckpointInterval() time.Duration {
+	return time.Duration(c.WALCheckpointIntervalSeconds) * time.Second
+}
@@ -4,12 +4,13 @@ import "fmt"
 
 // Defined Kafka topics.
 const (
-	TopicOutputTypingEvent       = "OutputTypingEvent"
-	TopicOutputSendToDeviceEvent = "OutputSendToDeviceEvent"
-	TopicOutputKeyChangeEvent    = "OutputKeyChangeEvent"
-	TopicOutputRoomEvent         = "OutputRoomEvent"
-	TopicOutputClientData        = "OutputClientData"
-	TopicOutputReceiptEvent      = "OutputReceiptEvent"
+	TopicOutputTypingEvent           = "OutputTypingEvent"
+	TopicOutputSendToDeviceEvent     = "OutputSendToDeviceEvent"
+	TopicOutputKeyChangeEvent        = "OutputKeyChangeEvent"
+	TopicOutputOneTimeKeyChangeEvent = "OutputOneTimeKeyChangeEvent"
+	TopicOutputRoomEvent             = "OutputRoomEvent"
+	TopicOutputClientData            = "OutputClientData"
+	TopicOutputReceiptEvent          = "OutputReceiptEvent"
 )
 
 type Kafka struct {
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net"
 )
 
 type MediaAPI struct {
@@ -33,6 +34,112 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// Where media files and thumbnails are stored. By default they are stored on
+	// the filesystem in the base path. If another provider is used then the base
+	// path is only used for temporary files.
+	Storage MediaStorage `yaml:"storage"`
+
+	// Options for generating previews of URLs for clients
+	URLPreview URLPreview `yaml:"url_preview"`
+
+	// Options for deleting cached remote media
+	Retention MediaRetention `yaml:"retention"`
+}
+
+type MediaRetention struct {
+	// Cached remote media, along with its thumbnails, is deleted once it hasn't
+	// been downloaded for this many days. If 0 then remote media is kept forever.
+	RemoteMediaLifetimeDays int64 `yaml:"remote_media_lifetime_days"`
+	// How often to look for remote media to delete, in milliseconds.
+	IntervalMS int64 `yaml:"interval_ms"`
+}
+
+type URLPreview struct {
+	// Whether to enable the /preview_url endpoint. This causes the server to make
+	// requests to arbitrary URLs on behalf of clients.
+	Enabled bool `yaml:"enabled"`
+	// If not empty, only URLs on these hosts (or their subdomains) are previewed.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// URLs on these hosts (or their subdomains) are never previewed.
+	DeniedHosts []string `yaml:"denied_hosts"`
+	// IP address ranges, in CIDR notation, which must never be connected to
+	// when previewing URLs. This should include any internal networks.
+	DeniedIPRanges []string `yaml:"denied_ip_ranges"`
+	// The maximum size of a page to download when generating a preview.
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// How long to cache previews for, in milliseconds.
+	CacheLifetimeMS int64 `yaml:"cache_lifetime_ms"`
+}
+
+func (c *URLPreview) Defaults() {
+	c.Enabled = false
+	c.DeniedIPRanges = []string{
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"169.254.0.0/16",
+		"192.0.0.0/24",
+		"198.18.0.0/15",
+		"0.0.0.0/8",
+		"224.0.0.0/4",
+		"::1/128",
+		"::/128",
+		"fe80::/10",
+		"fc00::/7",
+	}
+	c.MaxPageSizeBytes = FileSizeBytes(10485760)
+	c.CacheLifetimeMS = 60 * 60 * 1000
+}
+
+func (c *URLPreview) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	for i, cidr := range c.DeniedIPRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", fmt.Sprintf("media_api.url_preview.denied_ip_ranges[%d]", i), cidr))
+		}
+	}
+	checkPositive(configErrs, "media_api.url_preview.max_page_size_bytes", int64(c.MaxPageSizeBytes))
+	checkPositive(configErrs, "media_api.url_preview.cache_lifetime_ms", c.CacheLifetimeMS)
+}
+
+// MediaStorageProvider is a place where media files can be stored.
+type MediaStorageProvider string
+
+const (
+	MediaStorageProviderFilesystem MediaStorageProvider = "filesystem"
+	MediaStorageProviderS3         MediaStorageProvider = "s3"
+)
+
+type MediaStorage struct {
+	// The storage provider to use, either "filesystem" or "s3".
+	Provider MediaStorageProvider `yaml:"provider"`
+
+	// Options for the S3 storage provider. Any S3-compatible object storage,
+	// such as MinIO, can be used.
+	S3 MediaStorageS3 `yaml:"s3"`
+}
+
+type MediaStorageS3 struct {
+	// The base URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com.
+	Endpoint string `yaml:"endpoint"`
+	// The region that the bucket is in. Defaults to us-east-1, which is what
+	// most S3-compatible services other than AWS expect.
+	Region string `yaml:"region"`
+	// The bucket to store media in. It must already exist.
+	Bucket string `yaml:"bucket"`
+	// An optional prefix for the keys of all objects stored in the bucket.
+	Prefix string `yaml:"prefix"`
+	// Whether to address the bucket as part of the path rather than as part of
+	// the hostname. This is needed for MinIO and most other self-hosted services.
+	UsePathStyle bool `yaml:"use_path_style"`
+	// The credentials used to access the bucket.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
 }
 
 func (c *MediaAPI) Defaults() {
@@ -46,6 +153,10 @@ func (c *MediaAPI) Defaults() {
 	c.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
 	c.BasePath = "./media_store"
+	c.Storage.Provider = MediaStorageProviderFilesystem
+	c.Storage.S3.Region = "us-east-1"
+	c.URLPreview.Defaults()
+	c.Retention.IntervalMS = 60 * 60 * 1000
 }
 
 func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -64,4 +175,23 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+
+	switch c.Storage.Provider {
+	case MediaStorageProviderFilesystem:
+	case MediaStorageProviderS3:
+		checkURL(configErrs, "media_api.storage.s3.endpoint", c.Storage.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.storage.s3.region", c.Storage.S3.Region)
+		checkNotEmpty(configErrs, "media_api.storage.s3.bucket", c.Storage.S3.Bucket)
+		checkNotEmpty(configErrs, "media_api.storage.s3.access_key_id", c.Storage.S3.AccessKeyID)
+		checkNotEmpty(configErrs, "media_api.storage.s3.secret_access_key", c.Storage.S3.SecretAccessKey)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "media_api.storage.provider", c.Storage.Provider))
+	}
+
+	c.URLPreview.Verify(configErrs)
+
+	checkPositive(configErrs, "media_api.retention.remote_media_lifetime_days", c.Retention.RemoteMediaLifetimeDays)
+	if c.Retention.RemoteMediaLifetimeDays > 0 && c.Retention.IntervalMS <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.retention.interval_ms", c.Retention.IntervalMS))
+	}
 }
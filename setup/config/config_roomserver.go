@@ -1,22 +1,146 @@
 package config
 
+import (
+	"fmt"
+	"regexp"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// The algorithm used to compress event JSON in the database. New events are
+	// always stored using this algorithm.
+	EventJSONCompression EventJSONCompression `yaml:"event_json_compression"`
+
+	// Whether to recompress events which were stored using a different algorithm
+	// in the background. The progress is saved, so only events which haven't been
+	// looked at yet are scanned after a restart.
+	RecompressEventJSON bool `yaml:"recompress_event_json"`
+
+	// The maximum number of forward extremities to keep for a room. When a new
+	// event would take a room over this limit, the oldest extremities by depth
+	// are pruned. 0 disables the limit.
+	MaxForwardExtremities int `yaml:"max_forward_extremities"`
+
+	// The maximum number of events which can be waiting to be processed before
+	// events sent by clients are rejected with a 429, asking them to retry later.
+	// Events received over federation are always queued. 0 disables the limit.
+	MaxInputQueueLength int `yaml:"max_input_queue_length"`
+
+	// Whether rooms are frozen when they are upgraded. Users who aren't
+	// moderators can't send messages in or invite people to a frozen room, and
+	// anyone trying to join it is sent to the room which replaced it instead.
+	FreezeUpgradedRooms bool `yaml:"freeze_upgraded_rooms"`
+
+	// Scanning of the content of messages before they are accepted.
+	ContentScanning ContentScanning `yaml:"content_scanning"`
 }
 
+// ContentScanning configures checks on the content of messages, which can flag
+// or reject messages containing denylisted URLs or patterns.
+type ContentScanning struct {
+	// Whether messages are scanned at all.
+	Enabled bool `yaml:"enabled"`
+	// The event types to scan. Defaults to m.room.message and m.sticker.
+	EventTypes []string `yaml:"event_types"`
+	// Regular expressions which are matched against each of the URLs and mxc://
+	// links in a message.
+	DenylistURLs []string `yaml:"denylist_urls"`
+	// Regular expressions which are matched against the text of a message.
+	DenylistPatterns []string `yaml:"denylist_patterns"`
+	// What to do with messages which match the denylists.
+	Action ContentScanAction `yaml:"action"`
+	// An optional HTTP(S) endpoint which the event is POSTed to, which replies
+	// with the action to take. Empty if only the denylists are used.
+	ScannerURL string `yaml:"scanner_url"`
+	// How long to wait for the scanner to reply in milliseconds.
+	ScannerTimeoutMS int64 `yaml:"scanner_timeout_ms"`
+	// Whether messages are rejected if the scanner can't be reached or replies
+	// with an error, rather than accepted.
+	RejectOnScannerError bool `yaml:"reject_on_scanner_error"`
+}
+
+// ContentScanAction is what to do with a message that failed content scanning.
+type ContentScanAction string
+
+const (
+	// ContentScanActionFlag accepts the message but logs a warning about it.
+	ContentScanActionFlag ContentScanAction = "flag"
+	// ContentScanActionReject refuses messages sent by local users and
+	// soft-fails messages received over federation, so that they aren't shown
+	// to anyone.
+	ContentScanActionReject ContentScanAction = "reject"
+)
+
+func (c *ContentScanning) Defaults() {
+	c.Enabled = false
+	c.EventTypes = []string{"m.room.message", "m.sticker"}
+	c.Action = ContentScanActionReject
+	c.ScannerTimeoutMS = 5000
+}
+
+func (c *ContentScanning) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	switch c.Action {
+	case ContentScanActionFlag, ContentScanActionReject:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "room_server.content_scanning.action", c.Action))
+	}
+	checkRegexps(configErrs, "room_server.content_scanning.denylist_urls", c.DenylistURLs)
+	checkRegexps(configErrs, "room_server.content_scanning.denylist_patterns", c.DenylistPatterns)
+	if c.ScannerURL != "" {
+		checkURL(configErrs, "room_server.content_scanning.scanner_url", c.ScannerURL)
+		checkPositive(configErrs, "room_server.content_scanning.scanner_timeout_ms", c.ScannerTimeoutMS)
+	} else if len(c.DenylistURLs) == 0 && len(c.DenylistPatterns) == 0 {
+		configErrs.Add("invalid value for config key \"room_server.content_scanning\": at least one of denylist_urls, denylist_patterns or scanner_url must be set")
+	}
+}
+
+// EventJSONCompression is an algorithm used to compress event JSON.
+type EventJSONCompression string
+
+const (
+	EventJSONCompressionNone   EventJSONCompression = "none"
+	EventJSONCompressionSnappy EventJSONCompression = "snappy"
+	EventJSONCompressionZstd   EventJSONCompression = "zstd"
+)
+
 func (c *RoomServer) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7770"
 	c.InternalAPI.Connect = "http://localhost:7770"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:roomserver.db"
+	c.EventJSONCompression = EventJSONCompressionNone
+	c.MaxForwardExtremities = 10
+	c.MaxInputQueueLength = 1000
+	c.FreezeUpgradedRooms = true
+	c.ContentScanning.Defaults()
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "room_server.max_forward_extremities", int64(c.MaxForwardExtremities))
+	checkPositive(configErrs, "room_server.max_input_queue_length", int64(c.MaxInputQueueLength))
+	switch c.EventJSONCompression {
+	case EventJSONCompressionNone, EventJSONCompressionSnappy, EventJSONCompressionZstd:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "room_server.event_json_compression", c.EventJSONCompression))
+	}
+	c.ContentScanning.Verify(configErrs)
+}
+
+func checkRegexps(configErrs *ConfigErrors, key string, patterns []string) {
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q: %s", key, pattern, err))
+		}
+	}
 }
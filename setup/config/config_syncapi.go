@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -9,6 +14,60 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	// The maximum number of send-to-device messages that will be queued for a
+	// single device. When the limit is reached, the oldest messages are dropped
+	// to make room for new ones. Zero means no limit.
+	MaxSendToDeviceMessagesPerDevice int `yaml:"max_send_to_device_messages_per_device"`
+
+	// A read-only view of the history of some world-readable rooms, which can
+	// be seen without logging in.
+	PublicArchive PublicArchive `yaml:"public_archive"`
+}
+
+// PublicArchive configures the public archive of rooms, which serves their
+// history as HTML or JSON to anyone, with links to the media in it.
+type PublicArchive struct {
+	// Whether the archive is served at all.
+	Enabled bool `yaml:"enabled"`
+	// The IDs of the rooms in the archive. Rooms are only shown while their
+	// history visibility is world_readable, and only the events which were
+	// sent while it was are shown.
+	Rooms []string `yaml:"rooms"`
+	// The number of events shown on each page.
+	PageSize int `yaml:"page_size"`
+}
+
+func (c *PublicArchive) Defaults() {
+	c.Enabled = false
+	c.PageSize = 50
+}
+
+func (c *PublicArchive) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	for _, roomID := range c.Rooms {
+		if !strings.HasPrefix(roomID, "!") || !strings.Contains(roomID, ":") {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q is not a room ID", "sync_api.public_archive.rooms", roomID))
+		}
+	}
+	if c.PageSize < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "sync_api.public_archive.page_size", c.PageSize))
+	}
+}
+
+// IsArchived returns whether the room is in the public archive.
+func (c *PublicArchive) IsArchived(roomID string) bool {
+	if !c.Enabled {
+		return false
+	}
+	for _, archived := range c.Rooms {
+		if archived == roomID {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *SyncAPI) Defaults() {
@@ -17,6 +76,8 @@ func (c *SyncAPI) Defaults() {
 	c.ExternalAPI.Listen = "http://localhost:8073"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:syncapi.db"
+	c.MaxSendToDeviceMessagesPerDevice = 1000
+	c.PublicArchive.Defaults()
 }
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -26,4 +87,6 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkURL(configErrs, "sync_api.external_api.listen", string(c.ExternalAPI.Listen))
 	}
 	checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "sync_api.max_send_to_device_messages_per_device", int64(c.MaxSendToDeviceMessagesPerDevice))
+	c.PublicArchive.Verify(configErrs)
 }
@@ -244,6 +244,58 @@ func TestReadKey(t *testing.T) {
 	}
 }
 
+func TestVirtualHosts(t *testing.T) {
+	var c Global
+	c.Defaults()
+	c.ServerName = "main.com"
+	c.VirtualHosts = []*VirtualHost{
+		{ServerName: "virtual.com"},
+		{ServerName: "port.com:8448"},
+	}
+
+	for host, want := range map[string]string{
+		"":                 "main.com",
+		"main.com":         "main.com",
+		"virtual.com":      "virtual.com",
+		"virtual.com:8448": "virtual.com",
+		"port.com:8448":    "port.com:8448",
+		"delegated.com":    "main.com",
+	} {
+		if got := c.ServerNameForHost(host); string(got) != want {
+			t.Errorf("wanted Host %q to route to %q, got %q", host, want, got)
+		}
+	}
+
+	if !c.IsLocalServerName("main.com") || !c.IsLocalServerName("virtual.com") {
+		t.Errorf("wanted main and virtual server names to be local")
+	}
+	if c.IsLocalServerName("remote.com") {
+		t.Errorf("wanted remote server name not to be local")
+	}
+	if host := c.VirtualHostFor("main.com"); host == nil || host.KeyID != c.KeyID {
+		t.Errorf("wanted main server name to use the main signing key")
+	}
+}
+
+func TestWebhookIsInterestedInEvent(t *testing.T) {
+	webhook := Webhook{
+		Rooms:      []string{"!a:test"},
+		EventTypes: []string{"m.room.member"},
+	}
+	if !webhook.IsInterestedInEvent("!a:test", "m.room.member") {
+		t.Errorf("wanted webhook to be interested in matching event")
+	}
+	if webhook.IsInterestedInEvent("!b:test", "m.room.member") {
+		t.Errorf("wanted webhook not to be interested in other rooms")
+	}
+	if webhook.IsInterestedInEvent("!a:test", "m.room.message") {
+		t.Errorf("wanted webhook not to be interested in other event types")
+	}
+	if all := (Webhook{}); !all.IsInterestedInEvent("!b:test", "m.room.message") {
+		t.Errorf("wanted webhook without filters to be interested in all events")
+	}
+}
+
 const testKeyID = "ed25519:c8NsuQ"
 
 const testKey = `
@@ -283,3 +335,117 @@ n0Xq64k7fc42HXJpF8CGBkSaIhtlzcruO+vqR80B9r62+D0V7VmHOnP135MT6noU
 ANAf5kxmMsM0zlN2hkxl0H6o7wKlBSw3RI3cjfilXiMWRPJrzlc4
 -----END CERTIFICATE-----
 `
+
+func TestRegistrationFlows(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	c.Wiring()
+	c.ClientAPI.RegistrationFlows = [][]string{
+		{"m.login.recaptcha", "m.login.email.identity"},
+		{"m.login.unknown"},
+	}
+
+	var errs ConfigErrors
+	c.ClientAPI.Verify(&errs, true)
+	if len(errs) != 3 {
+		t.Errorf("wanted errors for disabled captcha, untrusted ID servers and unknown stage, got %v", errs)
+	}
+
+	c.ClientAPI.RecaptchaEnabled = true
+	c.ClientAPI.RecaptchaPublicKey = "public"
+	c.ClientAPI.RegistrationFlows = c.ClientAPI.RegistrationFlows[:1]
+	if err := c.Derive(); err != nil {
+		t.Fatal(err)
+	}
+	flows := c.Derived.Registration.Flows
+	if len(flows) != 1 || len(flows[0].Stages) != 2 || flows[0].Stages[1] != "m.login.email.identity" {
+		t.Errorf("wanted configured registration flow, got %v", flows)
+	}
+	if _, ok := c.Derived.Registration.Params["m.login.recaptcha"]; !ok {
+		t.Errorf("wanted captcha params to be set")
+	}
+
+	c.Derived.Registration.Flows = nil
+	c.ClientAPI.RegistrationFlows = nil
+	c.ClientAPI.RegistrationRequiresToken = true
+	if err := c.Derive(); err != nil {
+		t.Fatal(err)
+	}
+	flows = c.Derived.Registration.Flows
+	if len(flows) != 1 || len(flows[0].Stages) != 2 || flows[0].Stages[1] != "m.login.registration_token" {
+		t.Errorf("wanted registration token stage to be added to the flow, got %v", flows)
+	}
+}
+
+func TestContentScanningConfig(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	c.RoomServer.ContentScanning.Enabled = true
+
+	var errs ConfigErrors
+	c.RoomServer.ContentScanning.Verify(&errs)
+	if len(errs) != 1 {
+		t.Errorf("wanted an error for having nothing to scan with, got %v", errs)
+	}
+
+	errs = nil
+	c.RoomServer.ContentScanning.Action = "delete"
+	c.RoomServer.ContentScanning.DenylistURLs = []string{`^https://(evil\.example/`}
+	c.RoomServer.ContentScanning.DenylistPatterns = []string{`forbidden`}
+	c.RoomServer.ContentScanning.Verify(&errs)
+	if len(errs) != 2 {
+		t.Errorf("wanted errors for unknown action and invalid regexp, got %v", errs)
+	}
+
+	errs = nil
+	c.RoomServer.ContentScanning.Action = ContentScanActionFlag
+	c.RoomServer.ContentScanning.DenylistURLs = nil
+	c.RoomServer.ContentScanning.ScannerURL = "http://localhost:8080/scan"
+	c.RoomServer.ContentScanning.Verify(&errs)
+	if len(errs) != 0 {
+		t.Errorf("wanted no errors, got %v", errs)
+	}
+}
+
+func TestPublicArchiveConfig(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	c.SyncAPI.PublicArchive.Rooms = []string{"!announcements:localhost"}
+	if c.SyncAPI.PublicArchive.IsArchived("!announcements:localhost") {
+		t.Errorf("rooms shouldn't be archived while the archive is disabled")
+	}
+
+	c.SyncAPI.PublicArchive.Enabled = true
+	c.SyncAPI.PublicArchive.Rooms = append(c.SyncAPI.PublicArchive.Rooms, "#announcements:localhost")
+	c.SyncAPI.PublicArchive.PageSize = 0
+	var errs ConfigErrors
+	c.SyncAPI.PublicArchive.Verify(&errs)
+	if len(errs) != 2 {
+		t.Errorf("wanted errors for room alias and page size, got %v", errs)
+	}
+
+	if !c.SyncAPI.PublicArchive.IsArchived("!announcements:localhost") {
+		t.Errorf("wanted room to be archived")
+	}
+	if c.SyncAPI.PublicArchive.IsArchived("!other:localhost") {
+		t.Errorf("wanted room not to be archived")
+	}
+}
+
+func TestLatencyProbeConfig(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	c.FederationSender.LatencyProbe.IntervalMS = 0
+	var errs ConfigErrors
+	c.FederationSender.LatencyProbe.Verify(&errs)
+	if len(errs) != 0 {
+		t.Errorf("wanted no errors while the prober is disabled, got %v", errs)
+	}
+
+	c.FederationSender.LatencyProbe.Enabled = true
+	c.FederationSender.LatencyProbe.Peers = 0
+	c.FederationSender.LatencyProbe.Verify(&errs)
+	if len(errs) != 2 {
+		t.Errorf("wanted errors for interval and peers, got %v", errs)
+	}
+}
@@ -1,5 +1,7 @@
 package config
 
+import "fmt"
+
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -11,6 +13,41 @@ type UserAPI struct {
 	// The Device database stores session information for the devices of logged
 	// in local users. It is accessed by the UserAPI.
 	DeviceDatabase DatabaseOptions `yaml:"device_database"`
+
+	// How the passwords of local accounts are hashed.
+	PasswordHashing PasswordHashing `yaml:"password_hashing"`
+}
+
+// PasswordHashingAlgorithm is an algorithm used to hash passwords.
+type PasswordHashingAlgorithm string
+
+const (
+	PasswordHashingBcrypt   PasswordHashingAlgorithm = "bcrypt"
+	PasswordHashingArgon2id PasswordHashingAlgorithm = "argon2id"
+)
+
+// PasswordHashing configures how the passwords of local accounts are hashed.
+// Passwords hashed in any other way, e.g. before the configuration changed,
+// are hashed again the next time that the user logs in.
+type PasswordHashing struct {
+	// The algorithm used to hash new passwords.
+	Algorithm PasswordHashingAlgorithm `yaml:"algorithm"`
+	// The cost of bcrypt hashes, between 4 and 31.
+	BcryptCost int `yaml:"bcrypt_cost"`
+	// The parameters of argon2id hashes.
+	Argon2id Argon2idOptions `yaml:"argon2id"`
+	// Whether to hash bcrypt passwords which were imported from Synapse again
+	// when the user logs in, even if they already use the configured cost.
+	RehashSynapseHashes bool `yaml:"rehash_synapse_hashes"`
+}
+
+type Argon2idOptions struct {
+	// The amount of memory used to hash each password, in KiB.
+	MemoryKiB uint32 `yaml:"memory_kib"`
+	// The number of passes over the memory.
+	Iterations uint32 `yaml:"iterations"`
+	// The number of threads used to hash each password.
+	Parallelism uint8 `yaml:"parallelism"`
 }
 
 func (c *UserAPI) Defaults() {
@@ -20,6 +57,15 @@ func (c *UserAPI) Defaults() {
 	c.DeviceDatabase.Defaults()
 	c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
 	c.DeviceDatabase.ConnectionString = "file:userapi_devices.db"
+	c.PasswordHashing.Defaults()
+}
+
+func (c *PasswordHashing) Defaults() {
+	c.Algorithm = PasswordHashingBcrypt
+	c.BcryptCost = 10
+	c.Argon2id.MemoryKiB = 64 * 1024
+	c.Argon2id.Iterations = 3
+	c.Argon2id.Parallelism = 2
 }
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -27,4 +73,20 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "user_api.internal_api.connect", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	checkNotEmpty(configErrs, "user_api.device_database.connection_string", string(c.DeviceDatabase.ConnectionString))
+	c.PasswordHashing.Verify(configErrs)
+}
+
+func (c *PasswordHashing) Verify(configErrs *ConfigErrors) {
+	switch c.Algorithm {
+	case PasswordHashingBcrypt:
+		if c.BcryptCost < 4 || c.BcryptCost > 31 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "user_api.password_hashing.bcrypt_cost", c.BcryptCost))
+		}
+	case PasswordHashingArgon2id:
+		checkNotZero(configErrs, "user_api.password_hashing.argon2id.memory_kib", int64(c.Argon2id.MemoryKiB))
+		checkNotZero(configErrs, "user_api.password_hashing.argon2id.iterations", int64(c.Argon2id.Iterations))
+		checkNotZero(configErrs, "user_api.password_hashing.argon2id.parallelism", int64(c.Argon2id.Parallelism))
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "user_api.password_hashing.algorithm", c.Algorithm))
+	}
 }
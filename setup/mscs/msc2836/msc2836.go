@@ -126,7 +126,7 @@ func Enable(
 	base.PublicFederationAPIMux.Handle("/unstable/event_relationships", httputil.MakeExternalAPI(
 		"msc2836_event_relationships", func(req *http.Request) util.JSONResponse {
 			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
-				req, time.Now(), base.Cfg.Global.ServerName, keyRing,
+				req, time.Now(), base.Cfg.Global.ServerNameForHost(req.Host), keyRing,
 			)
 			if fedReq == nil {
 				return errResp
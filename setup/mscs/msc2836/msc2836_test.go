@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
@@ -548,6 +549,15 @@ func (u *testUserAPI) QueryDeviceInfos(ctx context.Context, req *userapi.QueryDe
 func (u *testUserAPI) QuerySearchProfiles(ctx context.Context, req *userapi.QuerySearchProfilesRequest, res *userapi.QuerySearchProfilesResponse) error {
 	return nil
 }
+func (u *testUserAPI) QueryAccountPermissions(ctx context.Context, req *userapi.QueryAccountPermissionsRequest, res *userapi.QueryAccountPermissionsResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPusherDeletion(ctx context.Context, req *userapi.PerformPusherDeletionRequest, res *userapi.PerformPusherDeletionResponse) error {
+	return nil
+}
 
 type testRoomserverAPI struct {
 	// use a trace API as it implements method stubs so we don't need to have them here.
@@ -585,7 +595,7 @@ func injectEvents(t *testing.T, userAPI userapi.UserInternalAPI, rsAPI roomserve
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
 	cfg.Global.ServerName = "localhost"
-	cfg.MSCs.Database.ConnectionString = "file:msc2836_test.db"
+	cfg.MSCs.Database.ConnectionString = config.DataSource("file:" + filepath.Join(t.TempDir(), "msc2836.db"))
 	cfg.MSCs.MSCs = []string{"msc2836"}
 	base := &setup.BaseDendrite{
 		Cfg:                    cfg,
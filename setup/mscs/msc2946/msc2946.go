@@ -0,0 +1,265 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msc2946 'Spaces Summary' implements https://github.com/matrix-org/matrix-doc/pull/2946
+package msc2946
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// The number of rooms returned in each page if the client doesn't ask
+	// for fewer.
+	maxHierarchyLimit = 50
+	// How long a next_batch token can be used for.
+	paginationTimeout = 10 * time.Minute
+)
+
+type hierarchyResponse struct {
+	Rooms     []fs.MSC2946Room `json:"rooms"`
+	NextBatch string           `json:"next_batch,omitempty"`
+}
+
+// hierarchy keeps track of the walks through spaces that clients are
+// paginating through.
+type hierarchy struct {
+	cfg   *config.Global
+	rsAPI roomserver.RoomserverInternalAPI
+	fsAPI fs.FederationSenderInternalAPI
+
+	mu    sync.Mutex
+	pages map[string]*paginationInfo
+}
+
+// Enable this MSC
+func Enable(
+	base *setup.BaseDendrite, rsAPI roomserver.RoomserverInternalAPI, fsAPI fs.FederationSenderInternalAPI,
+	userAPI userapi.UserInternalAPI, keyRing gomatrixserverlib.JSONVerifier,
+) error {
+	h := &hierarchy{
+		cfg:   &base.Cfg.Global,
+		rsAPI: rsAPI,
+		fsAPI: fsAPI,
+		pages: make(map[string]*paginationInfo),
+	}
+	base.PublicClientAPIMux.Handle("/unstable/org.matrix.msc2946/rooms/{roomID}/hierarchy",
+		httputil.MakeAuthAPI("msc2946_hierarchy", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return h.clientHierarchy(req, device, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	base.PublicFederationAPIMux.Handle("/unstable/org.matrix.msc2946/hierarchy/{roomID}", httputil.MakeExternalAPI(
+		"msc2946_federation_hierarchy", func(req *http.Request) util.JSONResponse {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), base.Cfg.Global.ServerNameForHost(req.Host), keyRing,
+			)
+			if fedReq == nil {
+				return errResp
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return h.federatedHierarchy(req, fedReq, vars["roomID"])
+		},
+	)).Methods(http.MethodGet)
+	return nil
+}
+
+// clientHierarchy implements GET /rooms/{roomID}/hierarchy. The space is
+// walked breadth first, asking other servers about the rooms that we aren't
+// in, and only the rooms that the user is allowed to see are returned.
+func (h *hierarchy) clientHierarchy(req *http.Request, device *userapi.Device, roomID string) util.JSONResponse {
+	query := req.URL.Query()
+	suggestedOnly := query.Get("suggested_only") == "true"
+	limit := maxHierarchyLimit
+	if s := query.Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if l < limit {
+			limit = l
+		}
+	}
+	maxDepth := -1
+	if s := query.Get("max_depth"); s != "" {
+		d, err := strconv.Atoi(s)
+		if err != nil || d < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("max_depth must not be negative"),
+			}
+		}
+		maxDepth = d
+	}
+
+	var page *paginationInfo
+	if from := query.Get("from"); from != "" {
+		page = h.loadPage(from)
+		if page == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unknown or expired from token"),
+			}
+		}
+		if page.rootRoomID != roomID || page.userID != device.UserID || page.suggestedOnly != suggestedOnly || page.maxDepth != maxDepth {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from token doesn't match the request"),
+			}
+		}
+	} else {
+		page = newPaginationInfo(roomID, device.UserID, suggestedOnly, maxDepth)
+	}
+
+	w := &walker{
+		ctx:   req.Context(),
+		cfg:   h.cfg,
+		rsAPI: h.rsAPI,
+		fsAPI: h.fsAPI,
+		page:  page,
+	}
+	first := len(page.processed) == 0
+	rooms := w.walk(limit)
+	if first && (len(rooms) == 0 || rooms[0].RoomID != roomID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't allowed to see this room"),
+		}
+	}
+
+	res := hierarchyResponse{Rooms: rooms}
+	if res.Rooms == nil {
+		res.Rooms = []fs.MSC2946Room{}
+	}
+	if len(page.queue) > 0 {
+		res.NextBatch = h.storePage(page)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// federatedHierarchy implements GET /_matrix/federation/unstable/org.matrix.msc2946/hierarchy/{roomID}.
+// Only the rooms that we are in are returned, and we don't ask other servers
+// about the rest. Rooms with restricted join rules are returned along with
+// the rooms that give access to them, and the requesting server decides
+// which of its users can see them.
+func (h *hierarchy) federatedHierarchy(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest, roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	suggestedOnly := req.URL.Query().Get("suggested_only") == "true"
+	if roomserver.IsServerBannedFromRoom(ctx, h.rsAPI, roomID, fedReq.Origin()) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+		}
+	}
+
+	room, err := loadLocalRoom(ctx, h.rsAPI, h.cfg, roomID, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("loadLocalRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if room == nil || !room.accessibleToServer(fedReq.Origin()) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown room"),
+		}
+	}
+
+	res := fs.RespMSC2946Hierarchy{
+		Room:                 room.MSC2946Room,
+		Children:             []fs.MSC2946Room{},
+		InaccessibleChildren: []string{},
+	}
+	res.Room.ChildrenState = childrenState(&room.MSC2946Room, suggestedOnly)
+	for _, ev := range res.Room.ChildrenState {
+		child, err := loadLocalRoom(ctx, h.rsAPI, h.cfg, ev.StateKey, "")
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("room_id", ev.StateKey).Warn("Failed to load child room")
+			continue
+		}
+		if child == nil {
+			// We aren't in the room, so we don't know anything about it.
+			continue
+		}
+		if !child.accessibleToServer(fedReq.Origin()) {
+			res.InaccessibleChildren = append(res.InaccessibleChildren, child.RoomID)
+			continue
+		}
+		res.Children = append(res.Children, child.MSC2946Room)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// loadPage returns the walk that the next_batch token refers to, or nil if
+// it doesn't exist or has expired. Each token can only be used once.
+func (h *hierarchy) loadPage(token string) *paginationInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	page, ok := h.pages[token]
+	if !ok {
+		return nil
+	}
+	delete(h.pages, token)
+	if time.Since(page.created) > paginationTimeout {
+		return nil
+	}
+	return page
+}
+
+// storePage stores the walk so that the client can carry on with it, and
+// returns the next_batch token for it.
+func (h *hierarchy) storePage(page *paginationInfo) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for token, p := range h.pages {
+		if time.Since(p.created) > paginationTimeout {
+			delete(h.pages, token)
+		}
+	}
+	token := util.RandomString(16)
+	page.created = time.Now()
+	h.pages[token] = page
+	return token
+}
@@ -0,0 +1,305 @@
+package msc2946
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	alice        = "@alice:localhost"
+	bob          = "@bob:localhost"
+	spaceID      = "!space:localhost"
+	publicID     = "!public:localhost"
+	privateID    = "!private:localhost"
+	restrictedID = "!restricted:localhost"
+	remoteID     = "!remote:remote"
+)
+
+// Walks a space that looks like this, where alice is only in the space and
+// the other rooms were created by bob:
+//   space
+//   ├── restricted (order "a", restricted to members of space)
+//   ├── public (order "b", suggested)
+//   ├── private (invite only)
+//   └── remote (on another server)
+//       ├── remote-public
+//       └── remote-restricted (restricted to members of a room alice isn't in)
+func TestHierarchy(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	rooms := getHierarchy(t, h, "")
+	want := []string{spaceID, restrictedID, publicID, remoteID, "!remote-public:remote"}
+	if got := roomIDs(rooms); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rooms %v, want %v", got, want)
+	}
+	if got := roomIDs(getHierarchy(t, h, "suggested_only=true")); !reflect.DeepEqual(got, []string{spaceID, publicID}) {
+		t.Errorf("got suggested rooms %v, want %v", got, []string{spaceID, publicID})
+	}
+	if got := roomIDs(getHierarchy(t, h, "max_depth=1")); !reflect.DeepEqual(got, want[:4]) {
+		t.Errorf("got rooms %v with max_depth=1, want %v", got, want[:4])
+	}
+
+	// Page through the same walk two rooms at a time.
+	var paged []string
+	from := ""
+	for i := 0; i < 5; i++ {
+		res := mustGetHierarchy(t, h, "limit=2&from="+from)
+		paged = append(paged, roomIDs(res.Rooms)...)
+		if res.NextBatch == "" {
+			break
+		}
+		from = res.NextBatch
+	}
+	if !reflect.DeepEqual(paged, want) {
+		t.Errorf("got paged rooms %v, want %v", paged, want)
+	}
+
+	res := h.clientHierarchy(httptest.NewRequest(http.MethodGet, "/hierarchy", nil), &userapi.Device{UserID: alice}, privateID)
+	if res.Code != http.StatusForbidden {
+		t.Errorf("got %d for a room alice can't see, want %d", res.Code, http.StatusForbidden)
+	}
+}
+
+func TestFederatedHierarchy(t *testing.T) {
+	h := newTestHierarchy(t)
+
+	res := getFederatedHierarchy(t, h, spaceID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", res.Code, http.StatusOK)
+	}
+	hierarchy := res.JSON.(fs.RespMSC2946Hierarchy)
+	if hierarchy.Room.RoomID != spaceID || hierarchy.Room.RoomType != spaceRoomType {
+		t.Errorf("got room %+v", hierarchy.Room)
+	}
+	if got := len(hierarchy.Room.ChildrenState); got != 4 {
+		t.Errorf("got %d children_state, want 4", got)
+	}
+	// Rooms that we aren't in aren't returned at all.
+	if got := roomIDs(hierarchy.Children); !reflect.DeepEqual(got, []string{restrictedID, publicID}) {
+		t.Errorf("got children %v, want %v", got, []string{restrictedID, publicID})
+	}
+	if got := hierarchy.Children[0].AllowedRoomIDs; !reflect.DeepEqual(got, []string{spaceID}) {
+		t.Errorf("got allowed_room_ids %v, want %v", got, []string{spaceID})
+	}
+	if got := hierarchy.InaccessibleChildren; !reflect.DeepEqual(got, []string{privateID}) {
+		t.Errorf("got inaccessible children %v, want %v", got, []string{privateID})
+	}
+
+	if res = getFederatedHierarchy(t, h, privateID); res.Code != http.StatusNotFound {
+		t.Errorf("got %d for a private room, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func newTestHierarchy(t *testing.T) *hierarchy {
+	t.Helper()
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+
+	child := func(roomID, order string, suggested bool) fledglingEvent {
+		content := map[string]interface{}{"via": []string{"localhost"}, "suggested": suggested}
+		if order != "" {
+			content["order"] = order
+		}
+		if roomID == remoteID {
+			content["via"] = []string{"remote"}
+		}
+		return fledglingEvent{Type: spaceChildEventType, StateKey: roomID, Content: content}
+	}
+	rsAPI := &testRoomserverAPI{
+		state: map[string][]*gomatrixserverlib.HeaderedEvent{
+			spaceID: mustCreateRoom(t, alice, spaceID, spaceRoomType, gomatrixserverlib.Public,
+				child(restrictedID, "a", false),
+				child(publicID, "b", true),
+				child(privateID, "", false),
+				child(remoteID, "", false),
+				// Children without any via servers have been removed.
+				fledglingEvent{Type: spaceChildEventType, StateKey: "!removed:localhost", Content: map[string]interface{}{"via": []string{}}},
+			),
+			publicID:  mustCreateRoom(t, bob, publicID, "", gomatrixserverlib.Public),
+			privateID: mustCreateRoom(t, bob, privateID, "", gomatrixserverlib.Invite),
+			restrictedID: mustCreateRoom(t, bob, restrictedID, "", joinRuleRestricted, fledglingEvent{
+				Type: gomatrixserverlib.MRoomJoinRules,
+				Content: map[string]interface{}{
+					"join_rule": joinRuleRestricted,
+					"allow":     []map[string]interface{}{{"type": "m.room_membership", "room_id": spaceID}},
+				},
+			}),
+		},
+		joinedRooms: map[string][]string{alice: {spaceID}},
+	}
+	fsAPI := &testFederationAPI{
+		hierarchies: map[string]fs.RespMSC2946Hierarchy{
+			remoteID: {
+				Room: fs.MSC2946Room{
+					PublicRoom: gomatrixserverlib.PublicRoom{RoomID: remoteID},
+					JoinRule:   gomatrixserverlib.Public,
+					RoomType:   spaceRoomType,
+					ChildrenState: []fs.MSC2946StrippedEvent{
+						{Type: spaceChildEventType, StateKey: "!remote-public:remote", Content: []byte(`{"via":["remote"]}`)},
+						{Type: spaceChildEventType, StateKey: "!remote-restricted:remote", Content: []byte(`{"via":["remote"]}`)},
+					},
+				},
+				Children: []fs.MSC2946Room{
+					{
+						PublicRoom: gomatrixserverlib.PublicRoom{RoomID: "!remote-public:remote"},
+						JoinRule:   gomatrixserverlib.Public,
+					},
+					{
+						PublicRoom:     gomatrixserverlib.PublicRoom{RoomID: "!remote-restricted:remote"},
+						JoinRule:       joinRuleRestricted,
+						AllowedRoomIDs: []string{"!other:localhost"},
+					},
+				},
+			},
+		},
+	}
+	return &hierarchy{
+		cfg:   &cfg.Global,
+		rsAPI: rsAPI,
+		fsAPI: fsAPI,
+		pages: make(map[string]*paginationInfo),
+	}
+}
+
+func getHierarchy(t *testing.T, h *hierarchy, query string) []fs.MSC2946Room {
+	t.Helper()
+	res := mustGetHierarchy(t, h, query)
+	if res.NextBatch != "" {
+		t.Errorf("got next_batch %q, want none", res.NextBatch)
+	}
+	return res.Rooms
+}
+
+func mustGetHierarchy(t *testing.T, h *hierarchy, query string) hierarchyResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/hierarchy?"+query, nil)
+	res := h.clientHierarchy(req, &userapi.Device{UserID: alice}, spaceID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got %d for %q: %+v", res.Code, query, res.JSON)
+	}
+	return res.JSON.(hierarchyResponse)
+}
+
+func getFederatedHierarchy(t *testing.T, h *hierarchy, roomID string) util.JSONResponse {
+	t.Helper()
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, "localhost", "/hierarchy/"+roomID)
+	if err := fedReq.Sign("remote", "ed25519:test", testKey); err != nil {
+		t.Fatalf("failed to sign request: %s", err)
+	}
+	return h.federatedHierarchy(httptest.NewRequest(http.MethodGet, "/hierarchy", nil), &fedReq, roomID)
+}
+
+func roomIDs(rooms []fs.MSC2946Room) []string {
+	ids := []string{}
+	for _, room := range rooms {
+		ids = append(ids, room.RoomID)
+	}
+	return ids
+}
+
+type testRoomserverAPI struct {
+	// use a trace API as it implements method stubs so we don't need to have them here.
+	// We'll override the functions we care about.
+	roomserver.RoomserverInternalAPITrace
+	state       map[string][]*gomatrixserverlib.HeaderedEvent
+	joinedRooms map[string][]string
+}
+
+func (r *testRoomserverAPI) QueryLatestEventsAndState(ctx context.Context, req *roomserver.QueryLatestEventsAndStateRequest, res *roomserver.QueryLatestEventsAndStateResponse) error {
+	res.StateEvents, res.RoomExists = r.state[req.RoomID]
+	return nil
+}
+
+func (r *testRoomserverAPI) QueryRoomsForUser(ctx context.Context, req *roomserver.QueryRoomsForUserRequest, res *roomserver.QueryRoomsForUserResponse) error {
+	res.RoomIDs = r.joinedRooms[req.UserID]
+	return nil
+}
+
+func (r *testRoomserverAPI) QueryServerBannedFromRoom(ctx context.Context, req *roomserver.QueryServerBannedFromRoomRequest, res *roomserver.QueryServerBannedFromRoomResponse) error {
+	return nil
+}
+
+type testFederationAPI struct {
+	fs.FederationSenderInternalAPI
+	hierarchies map[string]fs.RespMSC2946Hierarchy
+}
+
+func (f *testFederationAPI) MSC2946Hierarchy(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, suggestedOnly bool) (fs.RespMSC2946Hierarchy, error) {
+	res, ok := f.hierarchies[roomID]
+	if !ok {
+		return res, &fs.FederationClientError{Err: "unknown room"}
+	}
+	// Round trip the response to make sure that it survives being sent over
+	// federation.
+	b, err := json.Marshal(res)
+	if err != nil {
+		return res, err
+	}
+	var out fs.RespMSC2946Hierarchy
+	return out, json.Unmarshal(b, &out)
+}
+
+var testKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+type fledglingEvent struct {
+	Type     string
+	StateKey string
+	Content  interface{}
+}
+
+// mustCreateRoom returns the state of a room with the given creator, room
+// type and join rule. Later events replace earlier ones with the
+// same type and state key.
+func mustCreateRoom(t *testing.T, creator, roomID, roomType, joinRule string, extra ...fledglingEvent) []*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	createContent := map[string]interface{}{"creator": creator}
+	if roomType != "" {
+		createContent["type"] = roomType
+	}
+	fledglings := append([]fledglingEvent{
+		{Type: gomatrixserverlib.MRoomCreate, Content: createContent},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: creator, Content: map[string]interface{}{"membership": "join"}},
+		{Type: gomatrixserverlib.MRoomJoinRules, Content: map[string]interface{}{"join_rule": joinRule}},
+	}, extra...)
+	byTuple := map[gomatrixserverlib.StateKeyTuple]int{}
+	var events []*gomatrixserverlib.HeaderedEvent
+	for _, f := range fledglings {
+		stateKey := f.StateKey
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:   creator,
+			Depth:    int64(len(events) + 1),
+			Type:     f.Type,
+			StateKey: &stateKey,
+			RoomID:   roomID,
+		}
+		if err := eb.SetContent(f.Content); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", testKey, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: f.Type, StateKey: stateKey}
+		if i, ok := byTuple[tuple]; ok {
+			events[i] = ev.Headered(gomatrixserverlib.RoomVersionV6)
+			continue
+		}
+		byTuple[tuple] = len(events)
+		events = append(events, ev.Headered(gomatrixserverlib.RoomVersionV6))
+	}
+	return events
+}
@@ -0,0 +1,381 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msc2946
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	spaceChildEventType = "m.space.child"
+	spaceRoomType       = "m.space"
+
+	joinRuleKnock           = "knock"
+	joinRuleRestricted      = "restricted"
+	joinRuleKnockRestricted = "knock_restricted"
+)
+
+// queueEntry is a room which is waiting to be visited by the walker.
+type queueEntry struct {
+	roomID string
+	depth  int
+	// The servers to ask about the room if we aren't in it.
+	vias []gomatrixserverlib.ServerName
+}
+
+// paginationInfo is the state of a walk through a space, which is kept
+// between pages.
+type paginationInfo struct {
+	rootRoomID    string
+	userID        string
+	suggestedOnly bool
+	maxDepth      int
+	created       time.Time
+
+	queue     []queueEntry
+	processed map[string]bool
+	// The rooms that other servers have told us about, so that we don't
+	// have to ask about them again.
+	remoteRooms map[string]fs.MSC2946Room
+	// The rooms that the user is joined to, which are loaded when they are
+	// first needed.
+	joinedRooms map[string]bool
+}
+
+func newPaginationInfo(roomID, userID string, suggestedOnly bool, maxDepth int) *paginationInfo {
+	var vias []gomatrixserverlib.ServerName
+	if _, serverName, err := gomatrixserverlib.SplitID('!', roomID); err == nil {
+		vias = append(vias, serverName)
+	}
+	return &paginationInfo{
+		rootRoomID:    roomID,
+		userID:        userID,
+		suggestedOnly: suggestedOnly,
+		maxDepth:      maxDepth,
+		queue:         []queueEntry{{roomID: roomID, vias: vias}},
+		processed:     make(map[string]bool),
+		remoteRooms:   make(map[string]fs.MSC2946Room),
+	}
+}
+
+type walker struct {
+	ctx   context.Context
+	cfg   *config.Global
+	rsAPI roomserver.RoomserverInternalAPI
+	fsAPI fs.FederationSenderInternalAPI
+	page  *paginationInfo
+}
+
+// walk returns up to limit more rooms that the user is allowed to see,
+// breadth first. Rooms which the user can't see are skipped along with
+// their children.
+func (w *walker) walk(limit int) []fs.MSC2946Room {
+	var rooms []fs.MSC2946Room
+	for len(w.page.queue) > 0 && len(rooms) < limit {
+		entry := w.page.queue[0]
+		w.page.queue = w.page.queue[1:]
+		if w.page.processed[entry.roomID] {
+			continue
+		}
+		w.page.processed[entry.roomID] = true
+
+		room := w.room(entry)
+		if room == nil {
+			continue
+		}
+		room.ChildrenState = childrenState(room, w.page.suggestedOnly)
+		rooms = append(rooms, *room)
+		if w.page.maxDepth >= 0 && entry.depth >= w.page.maxDepth {
+			continue
+		}
+		for _, ev := range room.ChildrenState {
+			w.page.queue = append(w.page.queue, queueEntry{
+				roomID: ev.StateKey,
+				depth:  entry.depth + 1,
+				vias:   viaServers(ev),
+			})
+		}
+	}
+	return rooms
+}
+
+// room returns the summary of the room if the user is allowed to see it.
+// Rooms that we aren't in are looked up over federation.
+func (w *walker) room(entry queueEntry) *fs.MSC2946Room {
+	local, err := loadLocalRoom(w.ctx, w.rsAPI, w.cfg, entry.roomID, w.page.userID)
+	if err != nil {
+		util.GetLogger(w.ctx).WithError(err).WithField("room_id", entry.roomID).Warn("Failed to load room")
+		return nil
+	}
+	if local != nil {
+		if local.membership == gomatrixserverlib.Join || local.membership == gomatrixserverlib.Invite || w.accessible(&local.MSC2946Room) {
+			return &local.MSC2946Room
+		}
+		return nil
+	}
+	room := w.remoteRoom(entry)
+	if room == nil || !w.accessible(room) {
+		return nil
+	}
+	return room
+}
+
+// remoteRoom asks the servers in entry.vias about a room that we aren't in,
+// remembering what they tell us about its children for later.
+func (w *walker) remoteRoom(entry queueEntry) *fs.MSC2946Room {
+	// Children returned by other servers may not include their own children,
+	// so spaces need to be asked about again.
+	if room, ok := w.page.remoteRooms[entry.roomID]; ok && (room.RoomType != spaceRoomType || room.ChildrenState != nil) {
+		return &room
+	}
+	for _, serverName := range entry.vias {
+		if w.cfg.IsLocalServerName(serverName) {
+			continue
+		}
+		res, err := w.fsAPI.MSC2946Hierarchy(w.ctx, serverName, entry.roomID, w.page.suggestedOnly)
+		if err != nil {
+			util.GetLogger(w.ctx).WithError(err).WithField("server_name", serverName).Warn("Failed to ask server for space hierarchy")
+			continue
+		}
+		if res.Room.RoomID != entry.roomID {
+			continue
+		}
+		for _, child := range res.Children {
+			if _, ok := w.page.remoteRooms[child.RoomID]; !ok {
+				w.page.remoteRooms[child.RoomID] = child
+			}
+		}
+		room := res.Room
+		if room.ChildrenState == nil {
+			room.ChildrenState = []fs.MSC2946StrippedEvent{}
+		}
+		w.page.remoteRooms[entry.roomID] = room
+		return &room
+	}
+	return nil
+}
+
+// accessible returns whether the user can see a room without being in it,
+// because anyone can join or peek into it, or because it's restricted to
+// members of a room that the user is in.
+func (w *walker) accessible(room *fs.MSC2946Room) bool {
+	switch room.JoinRule {
+	case gomatrixserverlib.Public, joinRuleKnock:
+		return true
+	case joinRuleRestricted, joinRuleKnockRestricted:
+		if w.page.joinedRooms == nil {
+			var res roomserver.QueryRoomsForUserResponse
+			if err := w.rsAPI.QueryRoomsForUser(w.ctx, &roomserver.QueryRoomsForUserRequest{
+				UserID:         w.page.userID,
+				WantMembership: gomatrixserverlib.Join,
+			}, &res); err != nil {
+				util.GetLogger(w.ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+				return room.WorldReadable
+			}
+			w.page.joinedRooms = make(map[string]bool, len(res.RoomIDs))
+			for _, roomID := range res.RoomIDs {
+				w.page.joinedRooms[roomID] = true
+			}
+		}
+		for _, roomID := range room.AllowedRoomIDs {
+			if w.page.joinedRooms[roomID] {
+				return true
+			}
+		}
+	}
+	return room.WorldReadable
+}
+
+// localRoom is the summary of a room that we are in.
+type localRoom struct {
+	fs.MSC2946Room
+	// The membership of the user that the room was loaded for.
+	membership    string
+	joinedServers map[gomatrixserverlib.ServerName]bool
+}
+
+// accessibleToServer returns whether a server can be told about the room.
+// Restricted rooms are always returned, as it's up to the other server to
+// work out which of its users are in the allowed rooms.
+func (r *localRoom) accessibleToServer(serverName gomatrixserverlib.ServerName) bool {
+	switch r.JoinRule {
+	case gomatrixserverlib.Public, joinRuleKnock, joinRuleRestricted, joinRuleKnockRestricted:
+		return true
+	}
+	return r.WorldReadable || r.joinedServers[serverName]
+}
+
+// loadLocalRoom returns the summary of a room from its current state, and
+// the membership of the user in it if a user ID is given. It returns nil if
+// we aren't in the room, as then we can't trust that the state is current.
+// nolint:gocyclo
+func loadLocalRoom(
+	ctx context.Context, rsAPI roomserver.RoomserverInternalAPI, cfg *config.Global, roomID, userID string,
+) (*localRoom, error) {
+	var res roomserver.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &roomserver.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		return nil, fmt.Errorf("rsAPI.QueryLatestEventsAndState: %w", err)
+	}
+	if !res.RoomExists {
+		return nil, nil
+	}
+
+	room := &localRoom{
+		MSC2946Room: fs.MSC2946Room{
+			PublicRoom:    gomatrixserverlib.PublicRoom{RoomID: roomID},
+			ChildrenState: []fs.MSC2946StrippedEvent{},
+		},
+		joinedServers: make(map[gomatrixserverlib.ServerName]bool),
+	}
+	var guestAccess string
+	for _, ev := range res.StateEvents {
+		content := ev.Content()
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			room.RoomType = gjson.GetBytes(content, "type").Str
+		case gomatrixserverlib.MRoomName:
+			room.Name = gjson.GetBytes(content, "name").Str
+		case "m.room.topic":
+			room.Topic = gjson.GetBytes(content, "topic").Str
+		case "m.room.avatar":
+			room.AvatarURL = gjson.GetBytes(content, "url").Str
+		case gomatrixserverlib.MRoomCanonicalAlias:
+			room.CanonicalAlias = gjson.GetBytes(content, "alias").Str
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			room.WorldReadable = gjson.GetBytes(content, "history_visibility").Str == "world_readable"
+		case "m.room.guest_access":
+			guestAccess = gjson.GetBytes(content, "guest_access").Str
+		case gomatrixserverlib.MRoomJoinRules:
+			room.JoinRule = gjson.GetBytes(content, "join_rule").Str
+			for _, allow := range gjson.GetBytes(content, "allow").Array() {
+				if allow.Get("type").Str == "m.room_membership" && allow.Get("room_id").Str != "" {
+					room.AllowedRoomIDs = append(room.AllowedRoomIDs, allow.Get("room_id").Str)
+				}
+			}
+		case gomatrixserverlib.MRoomMember:
+			membership, err := ev.Membership()
+			if err != nil {
+				continue
+			}
+			if *ev.StateKey() == userID {
+				room.membership = membership
+			}
+			if membership != gomatrixserverlib.Join {
+				continue
+			}
+			room.JoinedMembersCount++
+			if _, serverName, err := gomatrixserverlib.SplitID('@', *ev.StateKey()); err == nil {
+				room.joinedServers[serverName] = true
+			}
+		case spaceChildEventType:
+			// Children without any servers to join them through have been
+			// removed from the space.
+			if len(gjson.GetBytes(content, "via").Array()) == 0 {
+				continue
+			}
+			room.ChildrenState = append(room.ChildrenState, fs.MSC2946StrippedEvent{
+				Type:           ev.Type(),
+				StateKey:       *ev.StateKey(),
+				Content:        json.RawMessage(content),
+				Sender:         ev.Sender(),
+				OriginServerTS: ev.OriginServerTS(),
+			})
+		}
+	}
+	room.GuestCanJoin = room.JoinRule == gomatrixserverlib.Public && guestAccess == "can_join"
+
+	joined := false
+	for serverName := range room.joinedServers {
+		if cfg.IsLocalServerName(serverName) {
+			joined = true
+			break
+		}
+	}
+	if !joined {
+		return nil, nil
+	}
+	return room, nil
+}
+
+// childrenState returns the children of the room that should be walked, in
+// the order that they should be walked in. Children with a valid order are
+// sorted by it and come first, and then the rest are sorted by when they
+// were added to the space.
+func childrenState(room *fs.MSC2946Room, suggestedOnly bool) []fs.MSC2946StrippedEvent {
+	children := make([]fs.MSC2946StrippedEvent, 0, len(room.ChildrenState))
+	for _, ev := range room.ChildrenState {
+		if ev.Type != spaceChildEventType || len(viaServers(ev)) == 0 {
+			continue
+		}
+		if suggestedOnly && !gjson.GetBytes(ev.Content, "suggested").Bool() {
+			continue
+		}
+		children = append(children, ev)
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		oi, oki := childOrder(children[i])
+		oj, okj := childOrder(children[j])
+		switch {
+		case oki && okj && oi != oj:
+			return oi < oj
+		case oki != okj:
+			return oki
+		case children[i].OriginServerTS != children[j].OriginServerTS:
+			return children[i].OriginServerTS < children[j].OriginServerTS
+		}
+		return children[i].StateKey < children[j].StateKey
+	})
+	return children
+}
+
+// childOrder returns the order of a child in its space, if it has a valid
+// one. Orders must be at most 50 printable ASCII characters.
+func childOrder(ev fs.MSC2946StrippedEvent) (string, bool) {
+	order := gjson.GetBytes(ev.Content, "order")
+	if order.Type != gjson.String || len(order.Str) > 50 {
+		return "", false
+	}
+	for _, c := range order.Str {
+		if c < 0x20 || c > 0x7E {
+			return "", false
+		}
+	}
+	return order.Str, true
+}
+
+// viaServers returns the servers that a child of a space can be joined
+// through.
+func viaServers(ev fs.MSC2946StrippedEvent) []gomatrixserverlib.ServerName {
+	var servers []gomatrixserverlib.ServerName
+	for _, via := range gjson.GetBytes(ev.Content, "via").Array() {
+		if via.Type == gjson.String && via.Str != "" {
+			servers = append(servers, gomatrixserverlib.ServerName(via.Str))
+		}
+	}
+	return servers
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msc3030 'Jump to date' implements https://github.com/matrix-org/matrix-doc/pull/3030
+package msc3030
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	dirForwards  = "f"
+	dirBackwards = "b"
+)
+
+type timestampToEventResponse struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// Enable this MSC
+func Enable(
+	base *setup.BaseDendrite, rsAPI roomserver.RoomserverInternalAPI, fsAPI fs.FederationSenderInternalAPI,
+	userAPI userapi.UserInternalAPI, keyRing gomatrixserverlib.JSONVerifier,
+) error {
+	base.PublicClientAPIMux.Handle("/unstable/org.matrix.msc3030/rooms/{roomID}/timestamp_to_event",
+		httputil.MakeAuthAPI("msc3030_timestamp_to_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return timestampToEvent(req, device, vars["roomID"], &base.Cfg.Global, rsAPI, fsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	base.PublicFederationAPIMux.Handle("/unstable/org.matrix.msc3030/timestamp_to_event/{roomID}", httputil.MakeExternalAPI(
+		"msc3030_federation_timestamp_to_event", func(req *http.Request) util.JSONResponse {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), base.Cfg.Global.ServerNameForHost(req.Host), keyRing,
+			)
+			if fedReq == nil {
+				return errResp
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return federatedTimestampToEvent(req, fedReq, vars["roomID"], rsAPI)
+		},
+	)).Methods(http.MethodGet)
+	return nil
+}
+
+// parseParams parses the ts and dir query parameters, which are the same
+// over the client and federation APIs.
+func parseParams(req *http.Request) (gomatrixserverlib.Timestamp, string, *util.JSONResponse) {
+	ts, err := strconv.ParseUint(req.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return 0, "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := req.URL.Query().Get("dir")
+	if dir != dirForwards && dir != dirBackwards {
+		return 0, "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("dir must be f or b"),
+		}
+	}
+	return gomatrixserverlib.Timestamp(ts), dir, nil
+}
+
+func notFound(ts gomatrixserverlib.Timestamp, dir string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, dir)),
+	}
+}
+
+// timestampToEvent implements GET /rooms/{roomID}/timestamp_to_event. If we
+// don't have an event in that direction, which can happen if we joined the
+// room recently or haven't backfilled far enough, then the other servers in
+// the room are asked instead.
+func timestampToEvent(
+	req *http.Request, device *userapi.Device, roomID string, cfg *config.Global,
+	rsAPI roomserver.RoomserverInternalAPI, fsAPI fs.FederationSenderInternalAPI,
+) util.JSONResponse {
+	ts, dir, resErr := parseParams(req)
+	if resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+
+	var membershipRes roomserver.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(ctx, &roomserver.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.HasBeenInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+
+	var res roomserver.QueryTimestampToEventResponse
+	if err := rsAPI.QueryTimestampToEvent(ctx, &roomserver.QueryTimestampToEventRequest{
+		RoomID:    roomID,
+		Timestamp: ts,
+		Backwards: dir == dirBackwards,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryTimestampToEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.EventID != "" {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: timestampToEventResponse{res.EventID, res.OriginServerTS},
+		}
+	}
+
+	for _, serverName := range remoteServersInRoom(ctx, roomID, cfg, rsAPI) {
+		remoteRes, err := fsAPI.MSC3030TimestampToEvent(ctx, serverName, roomID, ts, dir)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Warn("Failed to ask server for event by timestamp")
+			continue
+		}
+		if remoteRes.EventID != "" {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: timestampToEventResponse(remoteRes),
+			}
+		}
+	}
+	return notFound(ts, dir)
+}
+
+// remoteServersInRoom returns the other servers in the room, or the server
+// that created the room if we don't know of any.
+func remoteServersInRoom(
+	ctx context.Context, roomID string, cfg *config.Global, rsAPI roomserver.RoomserverInternalAPI,
+) []gomatrixserverlib.ServerName {
+	var joinedRes roomserver.QueryServerJoinedToRoomResponse
+	if err := rsAPI.QueryServerJoinedToRoom(ctx, &roomserver.QueryServerJoinedToRoomRequest{
+		RoomID: roomID,
+	}, &joinedRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+	}
+	var servers []gomatrixserverlib.ServerName
+	for _, serverName := range joinedRes.ServerNames {
+		if !cfg.IsLocalServerName(serverName) {
+			servers = append(servers, serverName)
+		}
+	}
+	if len(servers) == 0 {
+		if _, serverName, err := gomatrixserverlib.SplitID('!', roomID); err == nil && !cfg.IsLocalServerName(serverName) {
+			servers = append(servers, serverName)
+		}
+	}
+	return servers
+}
+
+// federatedTimestampToEvent implements GET /_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/{roomID}.
+// Only servers in the room can ask.
+func federatedTimestampToEvent(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest, roomID string,
+	rsAPI roomserver.RoomserverInternalAPI,
+) util.JSONResponse {
+	ts, dir, resErr := parseParams(req)
+	if resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	if roomserver.IsServerBannedFromRoom(ctx, rsAPI, roomID, fedReq.Origin()) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+		}
+	}
+
+	var joinedRes roomserver.QueryServerJoinedToRoomResponse
+	if err := rsAPI.QueryServerJoinedToRoom(ctx, &roomserver.QueryServerJoinedToRoomRequest{
+		ServerName: fedReq.Origin(),
+		RoomID:     roomID,
+	}, &joinedRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !joinedRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown room"),
+		}
+	}
+	if !joinedRes.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Your server isn't in the room"),
+		}
+	}
+
+	var res roomserver.QueryTimestampToEventResponse
+	if err := rsAPI.QueryTimestampToEvent(ctx, &roomserver.QueryTimestampToEventRequest{
+		RoomID:    roomID,
+		Timestamp: ts,
+		Backwards: dir == dirBackwards,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryTimestampToEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.EventID == "" {
+		return notFound(ts, dir)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: timestampToEventResponse{res.EventID, res.OriginServerTS},
+	}
+}
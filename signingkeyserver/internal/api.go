@@ -20,6 +20,7 @@ type ServerKeyAPI struct {
 	ServerKeyID       gomatrixserverlib.KeyID
 	ServerKeyValidity time.Duration
 	OldServerKeys     []config.OldVerifyKeys
+	VirtualHosts      []*config.VirtualHost
 
 	OurKeyRing gomatrixserverlib.KeyRing
 	FedClient  gomatrixserverlib.KeyClient
@@ -109,6 +110,29 @@ func (s *ServerKeyAPI) FetcherName() string {
 	return fmt.Sprintf("ServerKeyAPI (wrapping %q)", s.OurKeyRing.KeyDatabase.FetcherName())
 }
 
+// handleVirtualHostKey handles a key request for one of our virtual hosts,
+// if the request is for one.
+func (s *ServerKeyAPI) handleVirtualHostKey(
+	req gomatrixserverlib.PublicKeyLookupRequest,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	for _, host := range s.VirtualHosts {
+		if req.ServerName != host.ServerName || req.KeyID != host.KeyID {
+			continue
+		}
+		delete(requests, req)
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(host.PrivateKey.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(host.KeyValidityPeriod)),
+		}
+		return
+	}
+}
+
 // handleLocalKeys handles cases where the key request contains
 // a request for our own server keys, either current or old.
 func (s *ServerKeyAPI) handleLocalKeys(
@@ -118,6 +142,7 @@ func (s *ServerKeyAPI) handleLocalKeys(
 ) {
 	for req := range requests {
 		if req.ServerName != s.ServerName {
+			s.handleVirtualHostKey(req, requests, results)
 			continue
 		}
 		if req.KeyID == s.ServerKeyID {
@@ -63,7 +63,7 @@ func TestMain(m *testing.M) {
 		}
 
 		// Create a new cache but don't enable prometheus!
-		s.cache, err = caching.NewInMemoryLRUCache(false)
+		s.cache, err = caching.NewInMemoryLRUCache(0, false)
 		if err != nil {
 			panic("can't create cache: " + err.Error())
 		}
@@ -118,7 +118,7 @@ func (m *MockRoundTripper) RoundTrip(req *http.Request) (res *http.Response, err
 	}
 
 	// Get the keys and JSON-ify them.
-	keys := routing.LocalKeys(s.fedconfig)
+	keys := routing.LocalKeys(s.fedconfig, s.fedconfig.Matrix.ServerName)
 	body, err := json.MarshalIndent(keys.JSON, "", "  ")
 	if err != nil {
 		return nil, err
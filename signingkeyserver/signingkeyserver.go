@@ -50,6 +50,7 @@ func NewInternalAPI(
 		ServerKeyID:       cfg.Matrix.KeyID,
 		ServerKeyValidity: cfg.Matrix.KeyValidityPeriod,
 		OldServerKeys:     cfg.Matrix.OldVerifyKeys,
+		VirtualHosts:      cfg.Matrix.VirtualHosts,
 		FedClient:         fedClient,
 		OurKeyRing: gomatrixserverlib.KeyRing{
 			KeyFetchers: []gomatrixserverlib.KeyFetcher{},
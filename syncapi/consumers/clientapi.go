@@ -82,7 +82,7 @@ func (s *OutputClientDataConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	}).Info("received data from client API server")
 
 	pduPos, err := s.db.UpsertAccountData(
-		context.TODO(), string(msg.Key), output.RoomID, output.Type,
+		context.TODO(), string(msg.Key), output.RoomID, output.Type, output.Content,
 	)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -36,6 +36,7 @@ type OutputSendToDeviceEventConsumer struct {
 	db                   storage.Database
 	serverName           gomatrixserverlib.ServerName // our server name
 	notifier             *sync.Notifier
+	maxQueued            int
 }
 
 // NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer.
@@ -59,6 +60,7 @@ func NewOutputSendToDeviceEventConsumer(
 		db:                   store,
 		serverName:           cfg.Matrix.ServerName,
 		notifier:             n,
+		maxQueued:            cfg.MaxSendToDeviceMessagesPerDevice,
 	}
 
 	consumer.ProcessMessage = s.onMessage
@@ -95,7 +97,7 @@ func (s *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage)
 	}).Info("sync API received send-to-device event from EDU server")
 
 	streamPos, err := s.db.StoreNewSendForDeviceMessage(
-		context.TODO(), output.UserID, output.DeviceID, output.SendToDeviceEvent,
+		context.TODO(), output.UserID, output.DeviceID, output.SendToDeviceEvent, s.maxQueued,
 	)
 	if err != nil {
 		log.WithError(err).Errorf("failed to store send-to-device message")
@@ -0,0 +1,76 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputOneTimeKeyChangeEventConsumer consumes one-time key claims that originated in the key server.
+type OutputOneTimeKeyChangeEventConsumer struct {
+	otkConsumer *internal.ContinualConsumer
+	notifier    *sync.Notifier
+}
+
+// NewOutputOneTimeKeyChangeEventConsumer creates a new OutputOneTimeKeyChangeEventConsumer.
+// Call Start() to begin consuming from the key server.
+func NewOutputOneTimeKeyChangeEventConsumer(
+	cfg *config.SyncAPI,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputOneTimeKeyChangeEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		ComponentName:  "syncapi/keyserver/onetimekeys",
+		Topic:          cfg.Matrix.Kafka.TopicFor(config.TopicOutputOneTimeKeyChangeEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputOneTimeKeyChangeEventConsumer{
+		otkConsumer: &consumer,
+		notifier:    n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the key server
+func (s *OutputOneTimeKeyChangeEventConsumer) Start() error {
+	return s.otkConsumer.Start()
+}
+
+func (s *OutputOneTimeKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OneTimeKeyChange
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("key server one-time key output log: message parse failure")
+		return nil
+	}
+
+	s.notifier.OnNewOneTimeKeyChange(output.UserID, output.DeviceID)
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/push"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -37,6 +38,7 @@ type OutputRoomEventConsumer struct {
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
 	notifier   *sync.Notifier
+	pusher     *push.Sender
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -46,6 +48,7 @@ func NewOutputRoomEventConsumer(
 	n *sync.Notifier,
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
+	pusher *push.Sender,
 ) *OutputRoomEventConsumer {
 
 	consumer := internal.ContinualConsumer{
@@ -60,6 +63,7 @@ func NewOutputRoomEventConsumer(
 		db:         store,
 		notifier:   n,
 		rsAPI:      rsAPI,
+		pusher:     pusher,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -108,6 +112,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onRetirePeek(context.TODO(), *output.RetirePeek)
 	case api.OutputTypeRedactedEvent:
 		return s.onRedactEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypeExpiredEvents:
+		return s.onExpiredEvents(context.TODO(), *output.ExpiredEvents)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -131,6 +137,16 @@ func (s *OutputRoomEventConsumer) onRedactEvent(
 	})
 }
 
+func (s *OutputRoomEventConsumer) onExpiredEvents(
+	ctx context.Context, msg api.OutputExpiredEvents,
+) error {
+	if err := s.db.ExpireEvents(ctx, msg.EventIDs); err != nil {
+		log.WithError(err).WithField("room_id", msg.RoomID).Error("ExpireEvents error'd")
+		return err
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	ctx context.Context, msg api.OutputNewRoomEvent,
 ) error {
@@ -175,6 +191,12 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		return nil
 	}
 
+	// Work out the push notifications before waking up /sync, so that the
+	// unread notification counts are up to date when the event arrives.
+	if err = s.pusher.OnNewEvent(ctx, ev, pduPos); err != nil {
+		log.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to process push notifications for event")
+	}
+
 	if pduPos, err = s.notifyJoinedPeeks(ctx, ev, pduPos); err != nil {
 		log.WithError(err).Errorf("Failed to notifyJoinedPeeks for PDU pos %d", pduPos)
 		return err
@@ -0,0 +1,104 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// IgnoredUsersAccountDataType is the type of the global account data which
+// lists the users that a user has ignored.
+const IgnoredUsersAccountDataType = "m.ignored_user_list"
+
+// IgnoredUsers returns the set of user IDs which the given user has ignored.
+func IgnoredUsers(ctx context.Context, userAPI userapi.UserInternalAPI, userID string) (map[string]bool, error) {
+	var res userapi.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: IgnoredUsersAccountDataType,
+	}, &res); err != nil {
+		return nil, fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	data, ok := res.GlobalAccountData[IgnoredUsersAccountDataType]
+	if !ok {
+		return nil, nil
+	}
+	var content struct {
+		IgnoredUsers map[string]json.RawMessage `json:"ignored_users"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		// Clients can store whatever they like as account data, so don't
+		// fail every /sync because of it.
+		return nil, nil
+	}
+	ignored := make(map[string]bool, len(content.IgnoredUsers))
+	for ignoredUserID := range content.IgnoredUsers {
+		ignored[ignoredUserID] = true
+	}
+	return ignored, nil
+}
+
+// IsIgnoredEvent returns true if the event should be hidden from a user who
+// has ignored the given users. State events are never hidden, so that the
+// state of the room seen by the user is still correct.
+func IsIgnoredEvent(ignored map[string]bool, sender string, stateKey *string) bool {
+	return stateKey == nil && ignored[sender]
+}
+
+// RemoveIgnoredEvents removes the timeline events sent by ignored users from
+// the /sync response, along with any invites from them.
+func RemoveIgnoredEvents(res *types.Response, ignored map[string]bool) {
+	if len(ignored) == 0 {
+		return
+	}
+	for roomID, jr := range res.Rooms.Join {
+		jr.Timeline.Events = removeIgnoredClientEvents(jr.Timeline.Events, ignored)
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, jr := range res.Rooms.Peek {
+		jr.Timeline.Events = removeIgnoredClientEvents(jr.Timeline.Events, ignored)
+		res.Rooms.Peek[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		lr.Timeline.Events = removeIgnoredClientEvents(lr.Timeline.Events, ignored)
+		res.Rooms.Leave[roomID] = lr
+	}
+	for roomID, ir := range res.Rooms.Invite {
+		// The invite event itself is always the last of the invite state.
+		if n := len(ir.InviteState.Events); n > 0 {
+			invite := ir.InviteState.Events[n-1]
+			if gjson.GetBytes(invite, "type").Str == gomatrixserverlib.MRoomMember && ignored[gjson.GetBytes(invite, "sender").Str] {
+				delete(res.Rooms.Invite, roomID)
+			}
+		}
+	}
+}
+
+func removeIgnoredClientEvents(events []gomatrixserverlib.ClientEvent, ignored map[string]bool) []gomatrixserverlib.ClientEvent {
+	filtered := events[:0]
+	for _, ev := range events {
+		if !IsIgnoredEvent(ignored, ev.Sender, ev.StateKey) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
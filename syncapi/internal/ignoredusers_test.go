@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type ignoringUserAPI struct {
+	userapi.UserInternalAPI
+	accountData map[string]json.RawMessage
+}
+
+func (a *ignoringUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.GlobalAccountData = a.accountData
+	return nil
+}
+
+func TestIgnoredUsers(t *testing.T) {
+	userAPI := &ignoringUserAPI{}
+	ignored, err := IgnoredUsers(context.Background(), userAPI, syncingUser)
+	if err != nil {
+		t.Fatalf("IgnoredUsers failed: %s", err)
+	}
+	if len(ignored) != 0 {
+		t.Errorf("got ignored users %v, want none", ignored)
+	}
+
+	userAPI.accountData = map[string]json.RawMessage{
+		IgnoredUsersAccountDataType: json.RawMessage(`{"ignored_users":{"@bob:localhost":{}}}`),
+	}
+	ignored, err = IgnoredUsers(context.Background(), userAPI, syncingUser)
+	if err != nil {
+		t.Fatalf("IgnoredUsers failed: %s", err)
+	}
+	if len(ignored) != 1 || !ignored["@bob:localhost"] {
+		t.Errorf("got ignored users %v, want @bob:localhost", ignored)
+	}
+}
+
+func TestRemoveIgnoredEvents(t *testing.T) {
+	stateKey := "@bob:localhost"
+	res := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{EventID: "$1", Sender: "@bob:localhost", Type: "m.room.message"},
+		{EventID: "$2", Sender: "@bob:localhost", Type: "m.room.member", StateKey: &stateKey},
+		{EventID: "$3", Sender: "@charlie:localhost", Type: "m.room.message"},
+	}
+	res.Rooms.Join["!join:localhost"] = *jr
+	res.Rooms.Invite["!ignored:localhost"] = inviteFrom("@bob:localhost")
+	res.Rooms.Invite["!invite:localhost"] = inviteFrom("@charlie:localhost")
+
+	RemoveIgnoredEvents(res, map[string]bool{"@bob:localhost": true})
+
+	var gotEventIDs []string
+	for _, ev := range res.Rooms.Join["!join:localhost"].Timeline.Events {
+		gotEventIDs = append(gotEventIDs, ev.EventID)
+	}
+	if len(gotEventIDs) != 2 || gotEventIDs[0] != "$2" || gotEventIDs[1] != "$3" {
+		t.Errorf("got timeline events %v, want [$2 $3]", gotEventIDs)
+	}
+	if _, ok := res.Rooms.Invite["!ignored:localhost"]; ok {
+		t.Errorf("invite from ignored user was not removed")
+	}
+	if _, ok := res.Rooms.Invite["!invite:localhost"]; !ok {
+		t.Errorf("invite from other user was removed")
+	}
+}
+
+func inviteFrom(sender string) types.InviteResponse {
+	var ir types.InviteResponse
+	ir.InviteState.Events = []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.create","sender":"@charlie:localhost","state_key":""}`),
+		json.RawMessage(`{"type":"m.room.member","sender":"` + sender + `","state_key":"@alice:localhost"}`),
+	}
+	return ir
+}
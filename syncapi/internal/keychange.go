@@ -29,7 +29,7 @@ import (
 
 const DeviceListLogName = "dl"
 
-// DeviceOTKCounts adds one-time key counts to the /sync response
+// DeviceOTKCounts adds one-time key counts and unused fallback key types to the /sync response
 func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID, deviceID string, res *types.Response) error {
 	var queryRes api.QueryOneTimeKeysResponse
 	keyAPI.QueryOneTimeKeys(ctx, &api.QueryOneTimeKeysRequest{
@@ -40,6 +40,12 @@ func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID,
 		return queryRes.Error
 	}
 	res.DeviceListsOTKCount = queryRes.Count.KeyCount
+	// A missing list means that the server doesn't support fallback keys, so
+	// make sure we always send an empty list rather than null.
+	res.DeviceUnusedFallbackKeyTypes = queryRes.UnusedFallbackAlgorithms
+	if res.DeviceUnusedFallbackKeyTypes == nil {
+		res.DeviceUnusedFallbackKeyTypes = []string{}
+	}
 	return nil
 }
 
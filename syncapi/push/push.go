@@ -0,0 +1,337 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// The number of times a notification is sent to a push gateway before giving
+// up, and how long to wait before the first retry. The wait doubles after
+// every attempt.
+const maxAttempts = 5
+
+var retryInterval = time.Second
+
+// Sender evaluates the push rules of local users against new events in their
+// rooms, storing the notifications so that they are counted in /sync and
+// sending them to the push gateways of the pushers of the users.
+type Sender struct {
+	serverName gomatrixserverlib.ServerName
+	db         storage.Database
+	userAPI    userapi.UserInternalAPI
+	rsAPI      api.RoomserverInternalAPI
+	client     *http.Client
+}
+
+// NewSender creates a new Sender.
+func NewSender(
+	cfg *config.SyncAPI, db storage.Database, userAPI userapi.UserInternalAPI, rsAPI api.RoomserverInternalAPI,
+) *Sender {
+	return &Sender{
+		serverName: cfg.Matrix.ServerName,
+		db:         db,
+		userAPI:    userAPI,
+		rsAPI:      rsAPI,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// OnNewEvent works out which local users should be notified about the event
+// at the given stream position. The notifications are stored before this
+// returns, so that they are in the next /sync, but they are sent to the push
+// gateways in the background.
+func (s *Sender) OnNewEvent(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition) error {
+	if s.isLocal(ev.Sender()) {
+		// Users have obviously seen everything up to the events they send.
+		if err := s.db.ClearNotifications(ctx, ev.Sender(), ev.RoomID(), pos); err != nil {
+			return fmt.Errorf("s.db.ClearNotifications: %w", err)
+		}
+	}
+
+	var res api.QueryMembershipsForRoomResponse
+	if err := s.rsAPI.QueryMembershipsForRoom(ctx, &api.QueryMembershipsForRoomRequest{
+		JoinedOnly: true,
+		RoomID:     ev.RoomID(),
+		Sender:     ev.Sender(),
+	}, &res); err != nil {
+		return fmt.Errorf("s.rsAPI.QueryMembershipsForRoom: %w", err)
+	}
+	// The recipients are the joined members, and the user being invited if
+	// this is an invite, by user ID with their display names.
+	recipients := make(map[string]string, len(res.JoinEvents)+1)
+	for _, join := range res.JoinEvents {
+		if join.StateKey != nil {
+			recipients[*join.StateKey] = gjson.GetBytes(join.Content, "displayname").Str
+		}
+	}
+	if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Invite && ev.StateKey() != nil {
+		recipients[*ev.StateKey()] = gjson.GetBytes(ev.Content(), "displayname").Str
+	}
+
+	ec := &evaluationContext{
+		ctx:         ctx,
+		rsAPI:       s.rsAPI,
+		roomID:      ev.RoomID(),
+		memberCount: len(res.JoinEvents),
+	}
+	for userID, displayName := range recipients {
+		if userID == ev.Sender() || !s.isLocal(userID) {
+			continue
+		}
+		ignored, err := internal.IgnoredUsers(ctx, s.userAPI, userID)
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to get ignored users")
+			continue
+		}
+		if ignored[ev.Sender()] {
+			// Users aren't notified about anything that ignored users send,
+			// including invites.
+			continue
+		}
+		ec.displayName = displayName
+		notify, tweaks, err := s.evaluate(ctx, ev.Unwrap(), userID, ec)
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", userID).Error("Failed to evaluate push rules")
+			continue
+		}
+		if !notify {
+			continue
+		}
+		if err = s.db.StoreNotification(ctx, userID, ev.RoomID(), ev.EventID(), pos, pushrules.IsHighlight(tweaks)); err != nil {
+			return fmt.Errorf("s.db.StoreNotification: %w", err)
+		}
+		var pushersRes userapi.QueryPushersResponse
+		if err = s.userAPI.QueryPushers(ctx, &userapi.QueryPushersRequest{UserID: userID}, &pushersRes); err != nil {
+			return fmt.Errorf("s.userAPI.QueryPushers: %w", err)
+		}
+		for _, pusher := range pushersRes.Pushers {
+			if pusher.Kind != "http" {
+				continue
+			}
+			go s.send(userID, pusher, makeNotification(ev.Unwrap(), pusher, tweaks))
+		}
+	}
+	return nil
+}
+
+func (s *Sender) isLocal(userID string) bool {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	return err == nil && domain == s.serverName
+}
+
+// evaluate works out from the push rules of the user whether they should be
+// notified about the event, and if so, the tweaks to send with the
+// notification.
+func (s *Sender) evaluate(
+	ctx context.Context, ev *gomatrixserverlib.Event, userID string, ec pushrules.EvaluationContext,
+) (bool, map[string]interface{}, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return false, nil, err
+	}
+	var res userapi.QueryAccountDataResponse
+	if err = s.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: pushrules.AccountDataType,
+	}, &res); err != nil {
+		return false, nil, fmt.Errorf("s.userAPI.QueryAccountData: %w", err)
+	}
+	ruleSets, err := pushrules.ParseAccountRuleSets(res.GlobalAccountData[pushrules.AccountDataType], localpart, s.serverName)
+	if err != nil {
+		return false, nil, fmt.Errorf("pushrules.ParseAccountRuleSets: %w", err)
+	}
+	rule, err := ruleSets.Global.MatchEvent(ev, ec)
+	if err != nil || rule == nil {
+		return false, nil, err
+	}
+	notify, tweaks := pushrules.ActionsToTweaks(rule.Actions)
+	return notify, tweaks, nil
+}
+
+// evaluationContext answers the questions that push rules ask about the room
+// of an event, for one recipient at a time.
+type evaluationContext struct {
+	ctx         context.Context
+	rsAPI       api.RoomserverInternalAPI
+	roomID      string
+	memberCount int
+	displayName string
+	// The power levels of the room, which are only fetched if a rule needs them.
+	powerLevels *gomatrixserverlib.PowerLevelContent
+}
+
+func (ec *evaluationContext) UserDisplayName() string { return ec.displayName }
+
+func (ec *evaluationContext) RoomMemberCount() (int, error) { return ec.memberCount, nil }
+
+func (ec *evaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	if ec.powerLevels == nil {
+		plTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}
+		var res api.QueryCurrentStateResponse
+		if err := ec.rsAPI.QueryCurrentState(ec.ctx, &api.QueryCurrentStateRequest{
+			RoomID:      ec.roomID,
+			StateTuples: []gomatrixserverlib.StateKeyTuple{plTuple},
+		}, &res); err != nil {
+			return false, fmt.Errorf("ec.rsAPI.QueryCurrentState: %w", err)
+		}
+		powerLevels := gomatrixserverlib.PowerLevelContent{}
+		powerLevels.Defaults()
+		if plEvent, ok := res.StateEvents[plTuple]; ok {
+			var err error
+			if powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent.Event); err != nil {
+				return false, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+			}
+		}
+		ec.powerLevels = &powerLevels
+	}
+	return ec.powerLevels.UserLevel(userID) >= ec.powerLevels.NotificationLevel(levelKey), nil
+}
+
+type notification struct {
+	EventID string          `json:"event_id,omitempty"`
+	RoomID  string          `json:"room_id,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Sender  string          `json:"sender,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+	Prio    string          `json:"prio,omitempty"`
+	Devices []device        `json:"devices"`
+}
+
+type device struct {
+	AppID     string                      `json:"app_id"`
+	PushKey   string                      `json:"pushkey"`
+	PushKeyTS gomatrixserverlib.Timestamp `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{}      `json:"data,omitempty"`
+	Tweaks    map[string]interface{}      `json:"tweaks,omitempty"`
+}
+
+func makeNotification(ev *gomatrixserverlib.Event, pusher userapi.Pusher, tweaks map[string]interface{}) notification {
+	// The URL of the push gateway is for us, not for the push gateway.
+	data := make(map[string]interface{}, len(pusher.Data))
+	for k, v := range pusher.Data {
+		if k != "url" {
+			data[k] = v
+		}
+	}
+	n := notification{
+		EventID: ev.EventID(),
+		RoomID:  ev.RoomID(),
+		Prio:    "low",
+		Devices: []device{{
+			AppID:     pusher.AppID,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+			Data:      data,
+			Tweaks:    tweaks,
+		}},
+	}
+	if _, ok := tweaks["sound"]; ok {
+		n.Prio = "high"
+	}
+	if format, _ := pusher.Data["format"].(string); format != "event_id_only" {
+		n.Type = ev.Type()
+		n.Sender = ev.Sender()
+		n.Content = ev.Content()
+	}
+	return n
+}
+
+// send sends the notification to the push gateway of the pusher, retrying
+// with a backoff if the push gateway can't be reached. If the push gateway
+// rejects the push key then the pusher is deleted.
+func (s *Sender) send(userID string, pusher userapi.Pusher, n notification) {
+	logger := logrus.WithFields(logrus.Fields{
+		"user_id":  userID,
+		"app_id":   pusher.AppID,
+		"event_id": n.EventID,
+	})
+	gateway, _ := pusher.Data["url"].(string)
+	body, err := json.Marshal(struct {
+		Notification notification `json:"notification"`
+	}{n})
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal push notification")
+		return
+	}
+
+	wait := retryInterval
+	for attempt := 1; ; attempt++ {
+		var rejected []string
+		var retry bool
+		rejected, retry, err = s.post(gateway, body)
+		if err == nil {
+			for _, pushKey := range rejected {
+				if pushKey != pusher.PushKey {
+					continue
+				}
+				logger.Info("Push gateway rejected the push key, deleting pusher")
+				if err = s.userAPI.PerformPusherDeletion(context.Background(), &userapi.PerformPusherDeletionRequest{
+					UserID:  userID,
+					AppID:   pusher.AppID,
+					PushKey: pusher.PushKey,
+				}, &userapi.PerformPusherDeletionResponse{}); err != nil {
+					logger.WithError(err).Error("Failed to delete rejected pusher")
+				}
+			}
+			return
+		}
+		if !retry || attempt == maxAttempts {
+			logger.WithError(err).Warn("Failed to send push notification")
+			return
+		}
+		logger.WithError(err).Debugf("Failed to send push notification, retrying in %s", wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post sends the notification to the push gateway, returning the push keys
+// which it rejected. If it fails, retry is true if it's worth trying again.
+func (s *Sender) post(gateway string, body []byte) (rejected []string, retry bool, err error) {
+	res, err := s.client.Post(gateway, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, true, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		retry = res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("push gateway returned %d", res.StatusCode)
+	}
+	var resBody struct {
+		Rejected []string `json:"rejected"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		// The notification was delivered, so there is nothing to retry.
+		return nil, false, nil
+	}
+	return resBody.Rejected, false, nil
+}
@@ -0,0 +1,223 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustEvent(t *testing.T, eventJSON string) *gomatrixserverlib.Event {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       string
+		memberCount int
+		notify      bool
+		highlight   bool
+		sound       bool
+	}{
+		{
+			name:        "message in group room",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 5,
+			notify:      true,
+		},
+		{
+			name:        "message in one to one room",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 2,
+			notify:      true,
+			sound:       true,
+		},
+		{
+			name:        "message mentioning the user",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hi Alice!"}}`,
+			memberCount: 5,
+			notify:      true,
+			highlight:   true,
+			sound:       true,
+		},
+		{
+			name:        "message containing the user name in a word",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"malicexyz"}}`,
+			memberCount: 5,
+			notify:      true,
+		},
+		{
+			name:        "notice",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.notice","body":"alice"}}`,
+			memberCount: 2,
+		},
+		{
+			name:   "invite for the user",
+			event:  `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.member","state_key":"@alice:x","content":{"membership":"invite"}}`,
+			notify: true,
+			sound:  true,
+		},
+		{
+			name:  "other membership",
+			event: `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.member","state_key":"@bob:x","content":{"membership":"join"}}`,
+		},
+		{
+			name:        "other event type",
+			event:       `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.reaction","content":{}}`,
+			memberCount: 2,
+		},
+	}
+	s := &Sender{serverName: "x", userAPI: &testUserAPI{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec := &evaluationContext{memberCount: tt.memberCount}
+			notify, tweaks, err := s.evaluate(context.Background(), mustEvent(t, tt.event), "@alice:x", ec)
+			if err != nil {
+				t.Fatalf("evaluate failed: %s", err)
+			}
+			if notify != tt.notify {
+				t.Fatalf("got notify %v, want %v", notify, tt.notify)
+			}
+			_, sound := tweaks["sound"]
+			highlight, _ := tweaks["highlight"].(bool)
+			if sound != tt.sound || highlight != tt.highlight {
+				t.Fatalf("got tweaks %v, want sound %v and highlight %v", tweaks, tt.sound, tt.highlight)
+			}
+		})
+	}
+}
+
+func TestEvaluateUserRules(t *testing.T) {
+	// The user has muted one room.
+	s := &Sender{serverName: "x", userAPI: &testUserAPI{
+		accountData: map[string]json.RawMessage{
+			pushrules.AccountDataType: json.RawMessage(`{"global":{"override":[],"content":[],"room":[{"rule_id":"!r:x","default":false,"enabled":true,"actions":["dont_notify"]}],"sender":[],"underride":[{"rule_id":".m.rule.message","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":["notify"]}]}}`),
+		},
+	}}
+	ev := mustEvent(t, `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`)
+	notify, _, err := s.evaluate(context.Background(), ev, "@alice:x", &evaluationContext{memberCount: 5})
+	if err != nil {
+		t.Fatalf("evaluate failed: %s", err)
+	}
+	if notify {
+		t.Fatalf("got notified in a muted room")
+	}
+	ev = mustEvent(t, `{"event_id":"$a:x","room_id":"!other:x","sender":"@bob:x","type":"m.room.message","content":{"msgtype":"m.text","body":"hello"}}`)
+	notify, _, err = s.evaluate(context.Background(), ev, "@alice:x", &evaluationContext{memberCount: 5})
+	if err != nil {
+		t.Fatalf("evaluate failed: %s", err)
+	}
+	if !notify {
+		t.Fatalf("didn't get notified in another room")
+	}
+}
+
+func TestMakeNotificationEventIDOnly(t *testing.T) {
+	ev := mustEvent(t, `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"body":"secret"}}`)
+	n := makeNotification(ev, userapi.Pusher{
+		AppID:   "app",
+		PushKey: "key",
+		Data:    map[string]interface{}{"url": "https://push.example.com", "format": "event_id_only"},
+	}, map[string]interface{}{})
+	if n.EventID != "$a:x" || n.RoomID != "!r:x" {
+		t.Fatalf("notification is missing IDs: %+v", n)
+	}
+	if n.Content != nil || n.Sender != "" || n.Type != "" {
+		t.Fatalf("event_id_only notification includes the event: %+v", n)
+	}
+	if _, ok := n.Devices[0].Data["url"]; ok {
+		t.Fatalf("notification includes the push gateway URL")
+	}
+}
+
+type testUserAPI struct {
+	userapi.UserInternalAPI
+	accountData map[string]json.RawMessage
+	deleted     chan userapi.PerformPusherDeletionRequest
+}
+
+func (a *testUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.GlobalAccountData = a.accountData
+	return nil
+}
+
+func (a *testUserAPI) PerformPusherDeletion(ctx context.Context, req *userapi.PerformPusherDeletionRequest, res *userapi.PerformPusherDeletionResponse) error {
+	a.deleted <- *req
+	return nil
+}
+
+func TestSendRetriesAndDeletesRejectedPushers(t *testing.T) {
+	retryInterval = time.Millisecond
+	var attempts int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var body struct {
+			Notification notification `json:"notification"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode notification: %s", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]string{
+			"rejected": {body.Notification.Devices[0].PushKey},
+		})
+	}))
+	defer gateway.Close()
+
+	userAPI := &testUserAPI{deleted: make(chan userapi.PerformPusherDeletionRequest, 1)}
+	s := &Sender{userAPI: userAPI, client: gateway.Client()}
+	pusher := userapi.Pusher{
+		Kind:    "http",
+		AppID:   "app",
+		PushKey: "key",
+		Data:    map[string]interface{}{"url": gateway.URL},
+	}
+	ev := mustEvent(t, `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"body":"hello"}}`)
+	s.send("@alice:x", pusher, makeNotification(ev, pusher, map[string]interface{}{}))
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("got %d attempts, want 3", got)
+	}
+	select {
+	case req := <-userAPI.deleted:
+		if req.UserID != "@alice:x" || req.AppID != "app" || req.PushKey != "key" {
+			t.Fatalf("deleted the wrong pusher: %+v", req)
+		}
+	default:
+		t.Fatalf("rejected pusher was not deleted")
+	}
+}
+
+func TestSendDoesNotRetryClientErrors(t *testing.T) {
+	retryInterval = time.Millisecond
+	var attempts int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer gateway.Close()
+
+	s := &Sender{client: gateway.Client()}
+	pusher := userapi.Pusher{Kind: "http", Data: map[string]interface{}{"url": gateway.URL}}
+	ev := mustEvent(t, `{"event_id":"$a:x","room_id":"!r:x","sender":"@bob:x","type":"m.room.message","content":{"body":"hello"}}`)
+	s.send("@alice:x", pusher, makeNotification(ev, pusher, nil))
+
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("got %d attempts, want 1", got)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// The default and maximum number of queued send-to-device messages that
+// will be returned when inspecting a device's queue.
+const (
+	adminSendToDeviceDefaultLimit = 100
+	adminSendToDeviceMaxLimit     = 1000
+)
+
+type adminSendToDeviceMessage struct {
+	ID int `json:"id"`
+	gomatrixserverlib.SendToDeviceEvent
+}
+
+type adminSendToDeviceQueueResponse struct {
+	UserID   string                     `json:"user_id"`
+	DeviceID string                     `json:"device_id"`
+	Count    int                        `json:"count"`
+	Messages []adminSendToDeviceMessage `json:"messages"`
+}
+
+type adminSendToDeviceFlushResponse struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	Flushed  int64  `json:"flushed"`
+}
+
+// AdminSendToDeviceQueue implements GET and DELETE on
+// /_dendrite/admin/v1/sendToDevice/{userID}/{deviceID}. GET returns the number of
+// send-to-device messages queued for the device along with the oldest
+// of them, DELETE throws away everything that is queued for the device.
+func AdminSendToDeviceQueue(
+	req *http.Request,
+	userID, deviceID string,
+	syncDB storage.Database,
+	cfg *config.SyncAPI,
+) util.JSONResponse {
+	if req.Method == http.MethodDelete {
+		flushed, err := syncDB.FlushSendToDeviceQueue(req.Context(), userID, deviceID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncDB.FlushSendToDeviceQueue failed")
+			return jsonerror.InternalServerError()
+		}
+		util.GetLogger(req.Context()).WithFields(log.Fields{
+			"user_id":   userID,
+			"device_id": deviceID,
+			"flushed":   flushed,
+		}).Info("Flushed send-to-device queue")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: adminSendToDeviceFlushResponse{
+				UserID:   userID,
+				DeviceID: deviceID,
+				Flushed:  flushed,
+			},
+		}
+	}
+
+	limit := adminSendToDeviceDefaultLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > adminSendToDeviceMaxLimit {
+			limit = adminSendToDeviceMaxLimit
+		}
+	}
+	count, events, err := syncDB.SendToDeviceQueue(req.Context(), userID, deviceID, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.SendToDeviceQueue failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminSendToDeviceQueueResponse{
+		UserID:   userID,
+		DeviceID: deviceID,
+		Count:    count,
+		Messages: make([]adminSendToDeviceMessage, 0, len(events)),
+	}
+	for _, event := range events {
+		res.Messages = append(res.Messages, adminSendToDeviceMessage{
+			ID:                int(event.ID),
+			SendToDeviceEvent: event.SendToDeviceEvent,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// archivePathPrefix is where the public archive is served, under the
+// client API path prefix.
+const archivePathPrefix = "/unstable/org.matrix.dendrite.archive"
+
+type archiveResponse struct {
+	RoomID string                          `json:"room_id"`
+	Name   string                          `json:"name,omitempty"`
+	Topic  string                          `json:"topic,omitempty"`
+	Chunk  []gomatrixserverlib.ClientEvent `json:"chunk"`
+	// Passed as from to get the next, older page of events, or empty if this
+	// is the start of the room.
+	End string `json:"end,omitempty"`
+}
+
+type archiveMessageContent struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+	URL     string `json:"url"`
+}
+
+type archiveMessage struct {
+	Sender   string
+	Name     string
+	Time     string
+	Emote    bool
+	Body     string
+	MediaURL string
+	Image    bool
+}
+
+type archivePage struct {
+	RoomID   string
+	Name     string
+	Topic    string
+	Messages []archiveMessage
+	NextURL  string
+}
+
+var archiveTemplate = template.Must(template.New("archive").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Name}}{{.Name}}{{else}}{{.RoomID}}{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 0 auto; padding: 1em; }
+.message { border-bottom: 1px solid #ddd; padding: 0.5em 0; }
+.meta { color: #666; font-size: 0.85em; }
+.body { white-space: pre-wrap; overflow-wrap: break-word; }
+img { max-width: 100%; max-height: 30em; }
+</style>
+</head>
+<body>
+<h1>{{if .Name}}{{.Name}}{{else}}{{.RoomID}}{{end}}</h1>
+{{if .Topic}}<p>{{.Topic}}</p>{{end}}
+{{range .Messages}}<div class="message">
+<div class="meta">{{.Time}} <span title="{{.Sender}}">{{.Name}}</span></div>
+{{if .Image}}<a href="{{.MediaURL}}"><img src="{{.MediaURL}}" alt="{{.Body}}"></a>
+{{else if .MediaURL}}<a href="{{.MediaURL}}">{{.Body}}</a>
+{{else if .Emote}}<div class="body">* {{.Name}} {{.Body}}</div>
+{{else}}<div class="body">{{.Body}}</div>
+{{end}}</div>
+{{else}}<p>There are no messages to show.</p>
+{{end}}
+{{if .NextURL}}<p><a href="{{.NextURL}}">Older messages</a></p>{{end}}
+</body>
+</html>
+`))
+
+// archiveURL returns the path of the archive of the room, with the given
+// suffix added.
+func archiveURL(roomID, suffix string) string {
+	return strings.TrimSuffix(httputil.PublicClientPathPrefix, "/") + archivePathPrefix +
+		"/rooms/" + url.PathEscape(roomID) + suffix
+}
+
+// checkArchived returns an error response if the room isn't in the public
+// archive or its history isn't world readable any more. Rooms which aren't
+// archived look the same as rooms which don't exist.
+func checkArchived(
+	ctx context.Context, roomID string, db storage.Database, cfg *config.SyncAPI,
+) *util.JSONResponse {
+	notFound := &util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Room not found"),
+	}
+	if !cfg.PublicArchive.IsArchived(roomID) {
+		return notFound
+	}
+	hisVisEvent, err := db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.GetStateEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if hisVisEvent == nil {
+		return notFound
+	}
+	if hisVis, _ := hisVisEvent.HistoryVisibility(); hisVis != "world_readable" {
+		return notFound
+	}
+	return nil
+}
+
+// worldReadableAt returns whether the history visibility of the room was
+// world_readable when the event was sent.
+func worldReadableAt(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, event *gomatrixserverlib.HeaderedEvent,
+) (bool, error) {
+	if len(event.PrevEventIDs()) == 0 {
+		// Nothing comes before the create event, so the history visibility
+		// is the default, which isn't world_readable.
+		return false, nil
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       event.RoomID(),
+		PrevEventIDs: event.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}, &stateRes); err != nil {
+		return false, err
+	}
+	for _, ev := range stateRes.StateEvents {
+		if hisVis, err := ev.HistoryVisibility(); err == nil && hisVis == "world_readable" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// worldReadableEvents returns the events, which must be sorted newest first,
+// that were sent while the history visibility of the room was world_readable.
+// Rather than asking the roomserver about every event, the history visibility
+// is looked up once before the oldest event and then followed through any
+// changes to it in the events themselves.
+func worldReadableEvents(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, events []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	worldReadable, err := worldReadableAt(ctx, rsAPI, events[len(events)-1])
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if worldReadable {
+			visible = append(visible, event)
+		}
+		if event.Type() == gomatrixserverlib.MRoomHistoryVisibility && event.StateKeyEquals("") {
+			hisVis, _ := event.HistoryVisibility()
+			worldReadable = hisVis == "world_readable"
+		}
+	}
+	// Put the visible events back into newest first order.
+	for i, j := 0, len(visible)-1; i < j; i, j = i+1, j-1 {
+		visible[i], visible[j] = visible[j], visible[i]
+	}
+	return visible, nil
+}
+
+// stateContentField returns a field from the content of a state event in the
+// current state of the room, or an empty string if there isn't one.
+func stateContentField(
+	ctx context.Context, db storage.Database, roomID, evType, stateKey, field string,
+) (string, error) {
+	event, err := db.GetStateEvent(ctx, roomID, evType, stateKey)
+	if err != nil || event == nil {
+		return "", err
+	}
+	var content map[string]interface{}
+	if err = json.Unmarshal(event.Content(), &content); err != nil {
+		return "", nil
+	}
+	value, _ := content[field].(string)
+	return value, nil
+}
+
+// ArchiveRoom implements GET /unstable/org.matrix.dendrite.archive/rooms/{roomID},
+// which serves a page of the history of a room in the public archive to
+// anyone, newest first. The page is HTML unless format=json is given. Events
+// are only shown if the room's history was world readable when they were
+// sent.
+func ArchiveRoom(
+	w http.ResponseWriter, req *http.Request, roomID string,
+	db storage.Database, rsAPI api.RoomserverInternalAPI, cfg *config.SyncAPI,
+) *util.JSONResponse {
+	ctx := req.Context()
+	if resErr := checkArchived(ctx, roomID, db, cfg); resErr != nil {
+		return resErr
+	}
+
+	var from types.TopologyToken
+	var err error
+	if f := req.URL.Query().Get("from"); f != "" {
+		if from, err = types.NewTopologyTokenFromString(f); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err.Error()),
+			}
+		}
+	} else if from, err = db.MaxTopologicalPosition(ctx, roomID); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.MaxTopologicalPosition failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	limit := cfg.PublicArchive.PageSize
+	streamEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &types.TopologyToken{}, roomID, limit, true)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.GetEventsInTopologicalRange failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	sort.Slice(streamEvents, func(i, j int) bool {
+		if streamEvents[i].Depth() != streamEvents[j].Depth() {
+			return streamEvents[i].Depth() > streamEvents[j].Depth()
+		}
+		return streamEvents[i].StreamPosition > streamEvents[j].StreamPosition
+	})
+	events := db.StreamEventsToEvents(nil, streamEvents)
+
+	res := archiveResponse{
+		RoomID: roomID,
+		Chunk:  []gomatrixserverlib.ClientEvent{},
+	}
+	if len(events) == limit && events[len(events)-1].Type() != gomatrixserverlib.MRoomCreate {
+		var end types.TopologyToken
+		if end, err = db.EventPositionInTopology(ctx, events[len(events)-1].EventID()); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("db.EventPositionInTopology failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		end.Decrement()
+		res.End = end.String()
+	}
+	visible, err := worldReadableEvents(ctx, rsAPI, events)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("worldReadableEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.Name, err = stateContentField(ctx, db, roomID, gomatrixserverlib.MRoomName, "", "name"); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateContentField failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.Topic, err = stateContentField(ctx, db, roomID, "m.room.topic", "", "topic"); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateContentField failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	if req.URL.Query().Get("format") == "json" {
+		res.Chunk = gomatrixserverlib.HeaderedToClientEvents(visible, gomatrixserverlib.FormatAll)
+		return &util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+
+	page := archivePage{RoomID: roomID, Name: res.Name, Topic: res.Topic}
+	if res.End != "" {
+		page.NextURL = archiveURL(roomID, "?from="+url.QueryEscape(res.End))
+	}
+	names := map[string]string{}
+	for _, event := range visible {
+		if event.Type() != "m.room.message" && event.Type() != "m.sticker" {
+			continue
+		}
+		var content archiveMessageContent
+		if err = json.Unmarshal(event.Content(), &content); err != nil || content.Body == "" {
+			continue
+		}
+		name, ok := names[event.Sender()]
+		if !ok {
+			if name, err = stateContentField(ctx, db, roomID, gomatrixserverlib.MRoomMember, event.Sender(), "displayname"); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("stateContentField failed")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
+			if name == "" {
+				name = event.Sender()
+			}
+			names[event.Sender()] = name
+		}
+		msg := archiveMessage{
+			Sender: event.Sender(),
+			Name:   name,
+			Time:   event.OriginServerTS().Time().UTC().Format("2006-01-02 15:04 MST"),
+			Emote:  content.MsgType == "m.emote",
+			Body:   content.Body,
+		}
+		if strings.HasPrefix(content.URL, "mxc://") {
+			msg.MediaURL = archiveURL(roomID, "/media/"+url.PathEscape(event.EventID()))
+			msg.Image = content.MsgType == "m.image" || event.Type() == "m.sticker"
+		}
+		page.Messages = append(page.Messages, msg)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = archiveTemplate.Execute(w, page); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("archiveTemplate.Execute failed")
+	}
+	return nil
+}
+
+// ArchiveMedia implements GET /unstable/org.matrix.dendrite.archive/rooms/{roomID}/media/{eventID},
+// which redirects to the media API download of the media attached to an
+// event in the public archive. The media API serves local media from the
+// media store and fetches remote media through its cache, subject to the
+// configured maximum file size. Only media that is attached to an event shown
+// in the archive can be found this way.
+func ArchiveMedia(
+	req *http.Request, roomID, eventID string,
+	db storage.Database, rsAPI api.RoomserverInternalAPI, cfg *config.SyncAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	if resErr := checkArchived(ctx, roomID, db, cfg); resErr != nil {
+		return *resErr
+	}
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Media not found"),
+	}
+	events, err := db.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	visible, err := worldReadableAt(ctx, rsAPI, events[0])
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("worldReadableAt failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return notFound
+	}
+
+	var content archiveMessageContent
+	if err = json.Unmarshal(events[0].Content(), &content); err != nil {
+		return notFound
+	}
+	parts := strings.Split(strings.TrimPrefix(content.URL, "mxc://"), "/")
+	if !strings.HasPrefix(content.URL, "mxc://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return notFound
+	}
+	return util.RedirectResponse(
+		httputil.PublicMediaPathPrefix + "r0/download/" + url.PathEscape(parts[0]) + "/" + url.PathEscape(parts[1]),
+	)
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// archiveTestDatabase holds a single page of events of the room, oldest
+// first, along with its current history visibility.
+type archiveTestDatabase struct {
+	storage.Database
+	hisVis *gomatrixserverlib.HeaderedEvent
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+func (d *archiveTestDatabase) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType == gomatrixserverlib.MRoomHistoryVisibility {
+		return d.hisVis, nil
+	}
+	return nil, nil
+}
+
+func (d *archiveTestDatabase) MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error) {
+	return types.TopologyToken{Depth: 10}, nil
+}
+
+func (d *archiveTestDatabase) GetEventsInTopologicalRange(
+	ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	streamEvents := make([]types.StreamEvent, len(d.events))
+	for i, ev := range d.events {
+		streamEvents[i] = types.StreamEvent{HeaderedEvent: ev, StreamPosition: types.StreamPosition(i)}
+	}
+	return streamEvents, nil
+}
+
+func (d *archiveTestDatabase) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent {
+	events := make([]*gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		events[i] = in[i].HeaderedEvent
+	}
+	return events
+}
+
+func (d *archiveTestDatabase) Events(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	for _, ev := range d.events {
+		for _, eventID := range eventIDs {
+			if ev.EventID() == eventID {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, nil
+}
+
+// archiveRoomserverAPI answers that the room was world readable after the
+// event $worldreadable, and only shared before it.
+type archiveRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	shared, worldReadable *gomatrixserverlib.HeaderedEvent
+	queries               int
+}
+
+func (a *archiveRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse,
+) error {
+	a.queries++
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.StateEvents = []*gomatrixserverlib.HeaderedEvent{a.shared}
+	for _, prevEventID := range req.PrevEventIDs {
+		if prevEventID == a.worldReadable.EventID() || prevEventID == "$after:test" {
+			res.StateEvents = []*gomatrixserverlib.HeaderedEvent{a.worldReadable}
+		}
+	}
+	return nil
+}
+
+func mustCreateArchiveEvent(t *testing.T, eventID string, depth int, prevEventID, evType, stateKey, content string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	stateKeyField := ""
+	if stateKey != "-" {
+		stateKeyField = fmt.Sprintf(`"state_key":%q,`, stateKey)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+		`{"event_id":%q,"room_id":"!room:test","sender":"@alice:test","type":%q,%s"depth":%d,"content":%s,"prev_events":[[%q,{}]],"auth_events":[],"origin_server_ts":0}`,
+		eventID, evType, stateKeyField, depth, content, prevEventID,
+	)), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event %s: %s", eventID, err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func TestArchive(t *testing.T) {
+	shared := mustCreateArchiveEvent(t, "$shared:test", 2, "$create:test", gomatrixserverlib.MRoomHistoryVisibility, "", `{"history_visibility":"shared"}`)
+	before := mustCreateArchiveEvent(t, "$before:test", 3, "$shared:test", "m.room.message", "-", `{"msgtype":"m.image","body":"before","url":"mxc://test/before"}`)
+	worldReadable := mustCreateArchiveEvent(t, "$worldreadable:test", 4, "$before:test", gomatrixserverlib.MRoomHistoryVisibility, "", `{"history_visibility":"world_readable"}`)
+	after := mustCreateArchiveEvent(t, "$after:test", 5, "$worldreadable:test", "m.room.message", "-", `{"msgtype":"m.image","body":"after","url":"mxc://remote/after"}`)
+	later := mustCreateArchiveEvent(t, "$later:test", 6, "$after:test", "m.room.message", "-", `{"msgtype":"m.text","body":"later"}`)
+
+	newArchive := func(rooms []string, hisVis *gomatrixserverlib.HeaderedEvent) (*config.SyncAPI, *archiveTestDatabase, *archiveRoomserverAPI) {
+		cfg := &config.SyncAPI{Matrix: &config.Global{ServerName: "test"}}
+		cfg.PublicArchive = config.PublicArchive{Enabled: true, Rooms: rooms, PageSize: 50}
+		db := &archiveTestDatabase{hisVis: hisVis, events: []*gomatrixserverlib.HeaderedEvent{before, worldReadable, after, later}}
+		return cfg, db, &archiveRoomserverAPI{shared: shared, worldReadable: worldReadable}
+	}
+
+	t.Run("room not in the archive", func(t *testing.T) {
+		cfg, db, rsAPI := newArchive([]string{"!other:test"}, worldReadable)
+		w := httptest.NewRecorder()
+		if res := ArchiveRoom(w, httptest.NewRequest(http.MethodGet, "/", nil), "!room:test", db, rsAPI, cfg); res == nil || res.Code != http.StatusNotFound {
+			t.Fatalf("expected room not in the archive to be not found, got %+v", res)
+		}
+		if res := ArchiveMedia(httptest.NewRequest(http.MethodGet, "/", nil), "!room:test", after.EventID(), db, rsAPI, cfg); res.Code != http.StatusNotFound {
+			t.Fatalf("expected media in a room not in the archive to be not found, got %+v", res)
+		}
+	})
+
+	t.Run("room not world readable", func(t *testing.T) {
+		cfg, db, rsAPI := newArchive([]string{"!room:test"}, shared)
+		w := httptest.NewRecorder()
+		if res := ArchiveRoom(w, httptest.NewRequest(http.MethodGet, "/", nil), "!room:test", db, rsAPI, cfg); res == nil || res.Code != http.StatusNotFound {
+			t.Fatalf("expected room which isn't world readable to be not found, got %+v", res)
+		}
+		if res := ArchiveMedia(httptest.NewRequest(http.MethodGet, "/", nil), "!room:test", after.EventID(), db, rsAPI, cfg); res.Code != http.StatusNotFound {
+			t.Fatalf("expected media in a room which isn't world readable to be not found, got %+v", res)
+		}
+	})
+
+	t.Run("events before the room was world readable", func(t *testing.T) {
+		cfg, db, rsAPI := newArchive([]string{"!room:test"}, worldReadable)
+		w := httptest.NewRecorder()
+		res := ArchiveRoom(w, httptest.NewRequest(http.MethodGet, "/?format=json", nil), "!room:test", db, rsAPI, cfg)
+		if res == nil || res.Code != http.StatusOK {
+			t.Fatalf("expected the archive to be served, got %+v", res)
+		}
+		data, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var archive struct {
+			Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+		}
+		if err = json.Unmarshal(data, &archive); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		var got []string
+		for _, ev := range archive.Chunk {
+			got = append(got, ev.EventID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint([]string{later.EventID(), after.EventID()}) {
+			t.Errorf("archive has events %v, want only the events after the room became world readable", got)
+		}
+		if rsAPI.queries != 1 {
+			t.Errorf("expected the history visibility to be queried once for the page, got %d queries", rsAPI.queries)
+		}
+	})
+
+	t.Run("media", func(t *testing.T) {
+		cfg, db, rsAPI := newArchive([]string{"!room:test"}, worldReadable)
+		res := ArchiveMedia(httptest.NewRequest(http.MethodGet, "/", nil), "!room:test", before.EventID(), db, rsAPI, cfg)
+		if res.Code != http.StatusNotFound {
+			t.Errorf("expected media attached to a hidden event to be not found, got %+v", res)
+		}
+		res = ArchiveMedia(httptest.NewRequest(http.MethodGet, "/", nil), "!room:test", after.EventID(), db, rsAPI, cfg)
+		if res.Code != http.StatusFound || res.Headers["Location"] != "/_matrix/media/r0/download/remote/after" {
+			t.Errorf("expected a redirect to the media API, got %+v", res)
+		}
+	})
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type contextResp struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+const (
+	defaultContextLimit = 10
+	maxContextLimit     = 100
+)
+
+// Context implements GET /rooms/{roomID}/context/{eventID}
+// See: https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-context-eventid
+// nolint:gocyclo
+func Context(
+	req *http.Request, device *userapi.Device, syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI, roomID, eventID string,
+) util.JSONResponse {
+	ctx := req.Context()
+
+	// The limit is the total number of events to return either side of the
+	// requested event.
+	limit := defaultContextLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+		if limit > maxContextLimit {
+			limit = maxContextLimit
+		}
+	}
+
+	isForgotten, err := checkIsRoomForgotten(ctx, roomID, device.UserID, rsAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("checkIsRoomForgotten failed")
+		return jsonerror.InternalServerError()
+	}
+	if isForgotten {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("user already forgot about this room"),
+		}
+	}
+
+	// We don't say whether the event exists if the user isn't allowed to see
+	// it, so that the response doesn't leak anything about the room.
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Event not found"),
+	}
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	event := events[0]
+	visible, err := eventVisibleToUser(ctx, rsAPI, event, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("eventVisibleToUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return notFound
+	}
+
+	pos, err := syncDB.EventPositionInTopology(ctx, eventID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.EventPositionInTopology failed")
+		return jsonerror.InternalServerError()
+	}
+	limitBefore := limit / 2
+	limitAfter := limit - limitBefore
+	streamEventsBefore, err := syncDB.EventsAroundPosition(ctx, roomID, pos, limitBefore, false)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.EventsAroundPosition failed")
+		return jsonerror.InternalServerError()
+	}
+	streamEventsAfter, err := syncDB.EventsAroundPosition(ctx, roomID, pos, limitAfter, true)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.EventsAroundPosition failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Leave out any events either side which the user isn't allowed to see,
+	// in the same way as /messages does.
+	mReq := &messagesReq{
+		ctx:    ctx,
+		db:     syncDB,
+		rsAPI:  rsAPI,
+		roomID: roomID,
+		device: device,
+	}
+	eventsBefore := syncDB.StreamEventsToEvents(device, streamEventsBefore)
+	if len(eventsBefore) > 0 {
+		mReq.backwardOrdering = true
+		eventsBefore = mReq.filterHistoryVisible(eventsBefore)
+	}
+	eventsAfter := syncDB.StreamEventsToEvents(device, streamEventsAfter)
+	if len(eventsAfter) > 0 {
+		mReq.backwardOrdering = false
+		eventsAfter = mReq.filterHistoryVisible(eventsAfter)
+	}
+
+	// The start token lets the client paginate backwards from the oldest event
+	// and the end token lets it paginate forwards from the newest one.
+	start, end := pos, pos
+	if len(eventsBefore) > 0 {
+		if start, err = syncDB.EventPositionInTopology(ctx, eventsBefore[len(eventsBefore)-1].EventID()); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("syncDB.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	start.Decrement()
+	lastEvent := event
+	if len(eventsAfter) > 0 {
+		lastEvent = eventsAfter[len(eventsAfter)-1]
+		if end, err = syncDB.EventPositionInTopology(ctx, lastEvent.EventID()); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("syncDB.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	// Return the state of the room at the last event that we're returning.
+	var stateRes api.QueryStateAfterEventsResponse
+	if err = rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEvent.EventID()},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: contextResp{
+			Start:        start.String(),
+			End:          end.String(),
+			Event:        gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+			EventsBefore: gomatrixserverlib.HeaderedToClientEvents(eventsBefore, gomatrixserverlib.FormatAll),
+			EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(eventsAfter, gomatrixserverlib.FormatAll),
+			State:        gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll),
+		},
+	}
+}
+
+// eventVisibleToUser works out whether the history visibility of the room
+// allows the user to see the given event.
+func eventVisibleToUser(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI,
+	event *gomatrixserverlib.HeaderedEvent, userID string,
+) (bool, error) {
+	// Users can always see their own membership events.
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKeyEquals(userID) {
+		return true, nil
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       event.RoomID(),
+		PrevEventIDs: event.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}, &stateRes); err != nil {
+		return false, err
+	}
+	hisVis, membership := "shared", gomatrixserverlib.Leave
+	for _, ev := range stateRes.StateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			if v, err := ev.HistoryVisibility(); err == nil {
+				hisVis = v
+			}
+		case gomatrixserverlib.MRoomMember:
+			if m, err := ev.Membership(); err == nil {
+				membership = m
+			}
+		}
+	}
+	switch {
+	case hisVis == "world_readable":
+		return true, nil
+	case membership == gomatrixserverlib.Join:
+		return true, nil
+	case hisVis == "invited" && membership == gomatrixserverlib.Invite:
+		return true, nil
+	case hisVis == "shared":
+		// Shared history is visible to anyone who is in the room now.
+		var membershipRes api.QueryMembershipForUserResponse
+		if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: event.RoomID(),
+			UserID: userID,
+		}, &membershipRes); err != nil {
+			return false, err
+		}
+		return membershipRes.IsInRoom, nil
+	}
+	return false, nil
+}
@@ -16,6 +16,8 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -24,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -33,10 +36,17 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// errBackfillFailed is returned when there are no local events to return and
+// backfilling them from other servers failed. An empty chunk would tell the
+// client that it has reached the start of the room, so it must not be
+// returned in that case.
+var errBackfillFailed = errors.New("backfill failed")
+
 type messagesReq struct {
 	ctx              context.Context
 	db               storage.Database
 	rsAPI            api.RoomserverInternalAPI
+	userAPI          userapi.UserInternalAPI
 	federation       *gomatrixserverlib.FederationClient
 	cfg              *config.SyncAPI
 	roomID           string
@@ -54,6 +64,7 @@ type messagesResp struct {
 	StartStream string                          `json:"start_stream,omitempty"` // NOTSPEC: so clients can hit /messages then immediately /sync with a latest sync token
 	End         string                          `json:"end"`
 	Chunk       []gomatrixserverlib.ClientEvent `json:"chunk"`
+	State       []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -66,6 +77,7 @@ func OnIncomingMessagesRequest(
 	req *http.Request, db storage.Database, roomID string, device *userapi.Device,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
+	userAPI userapi.UserInternalAPI,
 	cfg *config.SyncAPI,
 	srp *sync.RequestPool,
 ) util.JSONResponse {
@@ -156,7 +168,16 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
+	// TODO: Implement the rest of the filtering (#587)
+	var filter gomatrixserverlib.RoomEventFilter
+	if f := req.URL.Query().Get("filter"); f != "" {
+		if err = json.Unmarshal([]byte(f), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -170,6 +191,7 @@ func OnIncomingMessagesRequest(
 		ctx:              req.Context(),
 		db:               db,
 		rsAPI:            rsAPI,
+		userAPI:          userAPI,
 		federation:       federation,
 		cfg:              cfg,
 		roomID:           roomID,
@@ -183,6 +205,13 @@ func OnIncomingMessagesRequest(
 	}
 
 	clientEvents, start, end, err := mReq.retrieveEvents()
+	if errors.Is(err, errBackfillFailed) {
+		util.GetLogger(req.Context()).WithError(err).Warn("mreq.retrieveEvents failed to backfill")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to fetch history from other servers, try again later"),
+		}
+	}
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveEvents failed")
 		return jsonerror.InternalServerError()
@@ -205,6 +234,13 @@ func OnIncomingMessagesRequest(
 	if emptyFromSupplied {
 		res.StartStream = fromStream.String()
 	}
+	if filter.LazyLoadMembers {
+		res.State, err = lazyLoadedMembers(req.Context(), db, roomID, clientEvents)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("lazyLoadedMembers failed")
+			return jsonerror.InternalServerError()
+		}
+	}
 
 	// Respond with the events.
 	return util.JSONResponse{
@@ -213,6 +249,29 @@ func OnIncomingMessagesRequest(
 	}
 }
 
+// lazyLoadedMembers returns the membership events for the senders of the
+// given events, for clients which are lazy-loading members.
+func lazyLoadedMembers(
+	ctx context.Context, db storage.Database, roomID string, events []gomatrixserverlib.ClientEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	members := []gomatrixserverlib.ClientEvent{}
+	seen := make(map[string]bool)
+	for _, event := range events {
+		if seen[event.Sender] {
+			continue
+		}
+		seen[event.Sender] = true
+		member, err := db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, event.Sender)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetStateEvent: %w", err)
+		}
+		if member != nil {
+			members = append(members, gomatrixserverlib.HeaderedToClientEvent(member, gomatrixserverlib.FormatAll))
+		}
+	}
+	return members, nil
+}
+
 func checkIsRoomForgotten(ctx context.Context, roomID, userID string, rsAPI api.RoomserverInternalAPI) (bool, error) {
 	req := api.QueryMembershipForUserRequest{
 		RoomID: roomID,
@@ -290,8 +349,22 @@ func (r *messagesReq) retrieveEvents() (
 		return []gomatrixserverlib.ClientEvent{}, *r.from, *r.to, nil
 	}
 
-	// Convert all of the events into client events.
-	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
+	// Convert all of the events into client events, leaving out the ones sent
+	// by users that the requesting user has ignored. The pagination tokens are
+	// still worked out from all of the events, so that the ignored events
+	// aren't returned again on the next request.
+	ignored, err := internal.IgnoredUsers(r.ctx, r.userAPI, r.device.UserID)
+	if err != nil {
+		err = fmt.Errorf("internal.IgnoredUsers: %w", err)
+		return
+	}
+	visible := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if !internal.IsIgnoredEvent(ignored, ev.Sender(), ev.StateKey()) {
+			visible = append(visible, ev)
+		}
+	}
+	clientEvents = gomatrixserverlib.HeaderedToClientEvents(visible, gomatrixserverlib.FormatAll)
 	// Get the position of the first and the last event in the room's topology.
 	// This position is currently determined by the event's depth, so we could
 	// also use it instead of retrieving from the database. However, if we ever
@@ -387,6 +460,11 @@ func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedE
 	return result
 }
 
+// getStartEnd returns the pagination tokens for the events, which are in the
+// order that they will be returned. Topology tokens sit just after the event
+// at their position, so the start token is moved before the first event when
+// paginating forwards, and the end token before the last event when
+// paginating backwards, so that no events are skipped or returned twice.
 func (r *messagesReq) getStartEnd(events []*gomatrixserverlib.HeaderedEvent) (start, end types.TopologyToken, err error) {
 	start, err = r.db.EventPositionInTopology(
 		r.ctx, events[0].EventID(),
@@ -395,6 +473,9 @@ func (r *messagesReq) getStartEnd(events []*gomatrixserverlib.HeaderedEvent) (st
 		err = fmt.Errorf("EventPositionInTopology: for start event %s: %w", events[0].EventID(), err)
 		return
 	}
+	if !r.backwardOrdering {
+		start.Decrement()
+	}
 	if r.backwardOrdering && events[len(events)-1].Type() == gomatrixserverlib.MRoomCreate {
 		// We've hit the beginning of the room so there's really nowhere else
 		// to go. This seems to fix Riot iOS from looping on /messages endlessly.
@@ -408,11 +489,6 @@ func (r *messagesReq) getStartEnd(events []*gomatrixserverlib.HeaderedEvent) (st
 			return
 		}
 		if r.backwardOrdering {
-			// A stream/topological position is a cursor located between two events.
-			// While they are identified in the code by the event on their right (if
-			// we consider a left to right chronological order), tokens need to refer
-			// to them by the event on their left, therefore we need to decrement the
-			// end position we send in the response if we're going backward.
 			end.Decrement()
 		}
 	}
@@ -424,19 +500,25 @@ func (r *messagesReq) getStartEnd(events []*gomatrixserverlib.HeaderedEvent) (st
 // the set is empty because we've reached a backward extremity, and if that is
 // the case, by retrieving as much events as requested by backfilling from
 // another homeserver.
-// Returns an error if there was an issue talking with the database or
-// backfilling.
+// Returns an error if there was an issue talking with the database, or one
+// wrapping errBackfillFailed if backfilling failed.
 func (r *messagesReq) handleEmptyEventsSlice() (
 	events []*gomatrixserverlib.HeaderedEvent, err error,
 ) {
 	backwardExtremities, err := r.db.BackwardExtremitiesForRoom(r.ctx, r.roomID)
+	if err != nil {
+		return
+	}
 
-	// Check if we have backward extremities for this room.
-	if len(backwardExtremities) > 0 {
-		// If so, retrieve as much events as needed through backfilling.
+	// Check if we have backward extremities for this room. Backfilling only
+	// makes sense if we're paginating backwards.
+	if len(backwardExtremities) > 0 && r.backwardOrdering {
+		// If so, retrieve as much events as needed through backfilling. We
+		// have nothing else to return, so if none of the servers in the room
+		// can help us then the request fails and the client can try again.
 		events, err = r.backfill(r.roomID, backwardExtremities, r.limit)
 		if err != nil {
-			return
+			err = fmt.Errorf("%w: %s", errBackfillFailed, err)
 		}
 	} else {
 		// If not, it means the slice was empty because we reached the room's
@@ -485,16 +567,28 @@ func (r *messagesReq) handleNonEmptyEventsSlice(streamEvents []types.StreamEvent
 		// Only ask the remote server for enough events to reach the limit.
 		pdus, err = r.backfill(r.roomID, backwardExtremities, r.limit-len(streamEvents))
 		if err != nil {
-			return
+			// We still have some events to return, so don't fail the request
+			// just because we couldn't get more from federation.
+			util.GetLogger(r.ctx).WithError(err).Warn("Failed to backfill, returning local events only")
+			err = nil
 		}
 
 		// Append the PDUs to the list to send back to the client.
 		events = append(events, pdus...)
 	}
 
-	// Append the events ve previously retrieved locally.
-	events = append(events, r.db.StreamEventsToEvents(nil, streamEvents)...)
-	sort.Sort(eventsByDepth(events))
+	// Put the events that we previously retrieved locally first, oldest
+	// first. The backfilled events were stored after them, so at the same
+	// depth they come later in the room's topological order. Sorting stably
+	// by depth then keeps the events in the same order as their tokens.
+	local := r.db.StreamEventsToEvents(nil, streamEvents)
+	if r.backwardOrdering {
+		for i, j := 0, len(local)-1; i < j; i, j = i+1, j-1 {
+			local[i], local[j] = local[j], local[i]
+		}
+	}
+	events = append(local, events...)
+	sort.Stable(eventsByDepth(events))
 
 	return
 }
@@ -0,0 +1,83 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type backfillTestDatabase struct {
+	storage.Database
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+func (d *backfillTestDatabase) BackwardExtremitiesForRoom(ctx context.Context, roomID string) (map[string][]string, error) {
+	return map[string][]string{"$missing:remote": {"$older:remote"}}, nil
+}
+
+func (d *backfillTestDatabase) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent {
+	return d.events
+}
+
+type backfillFailingRoomserverAPI struct {
+	api.RoomserverInternalAPI
+}
+
+func (a *backfillFailingRoomserverAPI) PerformBackfill(ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse) error {
+	return errors.New("no servers could be reached")
+}
+
+func TestMessagesBackfillFails(t *testing.T) {
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(
+		`{"event_id":"$local:test","room_id":"!room:test","sender":"@alice:test","type":"m.room.message","depth":5,"content":{"body":"hello"},"prev_events":[],"auth_events":[],"origin_server_ts":0}`,
+	), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	local := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	r := messagesReq{
+		ctx:              context.Background(),
+		db:               &backfillTestDatabase{events: []*gomatrixserverlib.HeaderedEvent{local}},
+		rsAPI:            &backfillFailingRoomserverAPI{},
+		cfg:              &config.SyncAPI{Matrix: &config.Global{ServerName: "test"}},
+		roomID:           "!room:test",
+		limit:            10,
+		backwardOrdering: true,
+	}
+
+	// With nothing stored locally, an empty chunk would look like the start
+	// of the room, so the request has to fail instead.
+	if _, err = r.handleEmptyEventsSlice(); !errors.Is(err, errBackfillFailed) {
+		t.Fatalf("expected errBackfillFailed with no local events, got %v", err)
+	}
+
+	// With some local events, those are returned.
+	events, err := r.handleNonEmptyEventsSlice([]types.StreamEvent{{HeaderedEvent: local}})
+	if err != nil {
+		t.Fatalf("expected the local events to be returned, got error %s", err)
+	}
+	if len(events) != 1 || events[0].EventID() != local.EventID() {
+		t.Fatalf("expected the local event to be returned, got %v", events)
+	}
+}
@@ -34,7 +34,7 @@ import (
 // applied:
 // nolint: gocyclo
 func Setup(
-	csMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
+	csMux, dendriteAdminMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
 	userAPI userapi.UserInternalAPI, federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.SyncAPI,
@@ -51,7 +51,15 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, federation, rsAPI, cfg, srp)
+		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, federation, rsAPI, userAPI, cfg, srp)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}", httputil.MakeAuthAPI("room_context", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return Context(req, device, syncDB, rsAPI, vars["roomID"], vars["eventID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/user/{userId}/filter",
@@ -74,6 +82,52 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/search",
+		httputil.MakeAuthAPI("search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Search(req, device, syncDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/user_directory/search",
+		httputil.MakeAuthAPI("userdirectory_search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SearchUserDirectory(req, device, syncDB, userAPI, cfg.Matrix.ServerName)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminMux.PathPrefix("/v1").Subrouter().Handle("/sendToDevice/{userID}/{deviceID}",
+		httputil.MakeAdminAPI("admin_send_to_device", cfg.Matrix, userAPI, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminSendToDeviceQueue(req, vars["userID"], vars["deviceID"], syncDB, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	if cfg.PublicArchive.Enabled {
+		archiveMux := csMux.PathPrefix(archivePathPrefix).Subrouter()
+		archiveMux.Handle("/rooms/{roomID}",
+			httputil.MakeHTMLAPI("archive_room", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					res := util.ErrorResponse(err)
+					return &res
+				}
+				return ArchiveRoom(w, req, vars["roomID"], syncDB, rsAPI, cfg)
+			}),
+		).Methods(http.MethodGet)
+
+		archiveMux.Handle("/rooms/{roomID}/media/{eventID}",
+			httputil.MakeExternalAPI("archive_media", func(req *http.Request) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return ArchiveMedia(req, vars["roomID"], vars["eventID"], syncDB, rsAPI, cfg)
+			}),
+		).Methods(http.MethodGet)
+	}
+
 	r0mux.Handle("/keys/changes", httputil.MakeAuthAPI("keys_changes", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingKeyChangeRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
@@ -0,0 +1,255 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	clienthttputil "github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+)
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm string                            `json:"search_term"`
+	Keys       []string                          `json:"keys"`
+	Filter     gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy    string                            `json:"order_by"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsResults `json:"room_events,omitempty"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	Count      int            `json:"count"`
+	Highlights []string       `json:"highlights"`
+	Results    []searchResult `json:"results"`
+	NextBatch  string         `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank   float64                       `json:"rank"`
+	Result gomatrixserverlib.ClientEvent `json:"result"`
+}
+
+// Search implements POST /search
+// See: https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-search
+// nolint:gocyclo
+func Search(req *http.Request, device *userapi.Device, syncDB storage.Database) util.JSONResponse {
+	var r searchRequest
+	if resErr := clienthttputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	var res searchResponse
+	criteria := r.SearchCategories.RoomEvents
+	if criteria == nil {
+		// Room events are the only category that we support, so if they
+		// weren't asked for then there's nothing to return.
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+	if criteria.SearchTerm == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("search_term must be supplied"),
+		}
+	}
+	if len(criteria.Keys) == 0 {
+		for key := range types.SearchKeys {
+			criteria.Keys = append(criteria.Keys, key)
+		}
+	}
+	for _, key := range criteria.Keys {
+		if _, ok := types.SearchKeys[key]; !ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unknown search key " + strconv.Quote(key)),
+			}
+		}
+	}
+	orderByRank := true
+	switch criteria.OrderBy {
+	case "", "rank":
+	case "recent":
+		orderByRank = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order_by must be either 'rank' or 'recent'"),
+		}
+	}
+
+	var from int64
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if from, err = strconv.ParseInt(nextBatch, 10, 64); err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch parameter"),
+			}
+		}
+	}
+
+	limit := criteria.Filter.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	// Only search the rooms that the user is currently joined to, narrowed
+	// down by the rooms in the filter.
+	joinedRoomIDs, err := syncDB.RoomIDsWithMembership(req.Context(), device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.RoomIDsWithMembership failed")
+		return jsonerror.InternalServerError()
+	}
+	roomIDs := filterStrings(joinedRoomIDs, criteria.Filter.Rooms, criteria.Filter.NotRooms)
+	keys := criteria.Keys
+	if len(criteria.Filter.Types) > 0 || len(criteria.Filter.NotTypes) > 0 {
+		var filtered []string
+		for _, key := range keys {
+			eventType := types.SearchKeys[key]
+			if len(filterStrings([]string{eventType}, criteria.Filter.Types, criteria.Filter.NotTypes)) > 0 {
+				filtered = append(filtered, key)
+			}
+		}
+		keys = filtered
+	}
+
+	results, count, err := syncDB.SearchRoomEvents(req.Context(), &types.SearchRequest{
+		Term:        criteria.SearchTerm,
+		RoomIDs:     roomIDs,
+		Keys:        keys,
+		Senders:     criteria.Filter.Senders,
+		NotSenders:  criteria.Filter.NotSenders,
+		OrderByRank: orderByRank,
+		From:        from,
+		Limit:       limit,
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.SearchRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	eventIDs := make([]string, 0, len(results))
+	for _, result := range results {
+		eventIDs = append(eventIDs, result.EventID)
+	}
+	events, err := syncDB.Events(req.Context(), eventIDs)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+
+	roomEvents := &roomEventsResults{
+		Count:      count,
+		Highlights: searchHighlights(criteria.SearchTerm),
+		Results:    []searchResult{},
+	}
+	for _, result := range results {
+		event, ok := eventsByID[result.EventID]
+		if !ok {
+			continue
+		}
+		roomEvents.Results = append(roomEvents.Results, searchResult{
+			Rank:   result.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+		})
+	}
+	// If we got a full page of results then there might be more of them.
+	if len(results) == limit {
+		if orderByRank {
+			roomEvents.NextBatch = strconv.FormatInt(from+int64(limit), 10)
+		} else {
+			roomEvents.NextBatch = strconv.FormatInt(int64(results[len(results)-1].StreamPos), 10)
+		}
+	}
+	res.SearchCategories.RoomEvents = roomEvents
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// filterStrings returns the values which are in include, if it isn't nil,
+// and which aren't in exclude.
+func filterStrings(values, include, exclude []string) []string {
+	contains := func(list []string, value string) bool {
+		for _, v := range list {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	var filtered []string
+	for _, value := range values {
+		if include != nil && !contains(include, value) {
+			continue
+		}
+		if contains(exclude, value) {
+			continue
+		}
+		filtered = append(filtered, value)
+	}
+	return filtered
+}
+
+// searchHighlights returns the words in the search term, which clients can
+// use to highlight the matching parts of the results.
+func searchHighlights(term string) []string {
+	highlights := []string{}
+	seen := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(term), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			highlights = append(highlights, word)
+		}
+	}
+	return highlights
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	clienthttputil "github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const defaultUserDirectoryLimit = 10
+
+type userDirectoryRequest struct {
+	SearchTerm string `json:"search_term"`
+	Limit      int    `json:"limit"`
+}
+
+type userDirectoryResponse struct {
+	Results []authtypes.FullyQualifiedProfile `json:"results"`
+	Limited bool                              `json:"limited"`
+}
+
+// SearchUserDirectory implements POST /user_directory/search, which finds the
+// users who share a room with the requesting user, as well as all of the local
+// users, whose user ID or display name contains the search term.
+// See: https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-user-directory-search
+func SearchUserDirectory(
+	req *http.Request, device *userapi.Device, syncDB storage.Database,
+	userAPI userapi.UserInternalAPI, serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	var r userDirectoryRequest
+	if resErr := clienthttputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.SearchTerm == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("search_term must be supplied"),
+		}
+	}
+	if r.Limit <= 0 {
+		r.Limit = defaultUserDirectoryLimit
+	}
+
+	// Ask for one more result than we need from each source, so that we know
+	// whether the results were limited.
+	shared, err := syncDB.SearchUserDirectory(req.Context(), device.UserID, r.SearchTerm, r.Limit+1)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.SearchUserDirectory failed")
+		return jsonerror.InternalServerError()
+	}
+	localReq := &userapi.QuerySearchProfilesRequest{
+		SearchString: r.SearchTerm,
+		Limit:        r.Limit + 1,
+	}
+	localRes := &userapi.QuerySearchProfilesResponse{}
+	if err = userAPI.QuerySearchProfiles(req.Context(), localReq, localRes); err != nil {
+		return util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
+	}
+
+	// The profiles of local users are always up to date, whereas the ones from
+	// shared rooms are only as new as the user's latest membership event, so
+	// prefer them.
+	local := make(map[string]authtypes.FullyQualifiedProfile, len(localRes.Profiles))
+	var localUserIDs []string
+	for _, profile := range localRes.Profiles {
+		userID := fmt.Sprintf("@%s:%s", profile.Localpart, serverName)
+		local[userID] = authtypes.FullyQualifiedProfile{
+			UserID:      userID,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}
+		localUserIDs = append(localUserIDs, userID)
+	}
+
+	res := userDirectoryResponse{
+		Results: []authtypes.FullyQualifiedProfile{},
+	}
+	seen := map[string]bool{}
+	add := func(profile authtypes.FullyQualifiedProfile) {
+		if seen[profile.UserID] {
+			return
+		}
+		seen[profile.UserID] = true
+		if len(res.Results) == r.Limit {
+			res.Limited = true
+			return
+		}
+		if localProfile, ok := local[profile.UserID]; ok {
+			profile = localProfile
+		}
+		res.Results = append(res.Results, profile)
+	}
+	for _, profile := range shared {
+		add(profile)
+	}
+	for _, userID := range localUserIDs {
+		add(local[userID])
+	}
+	if len(shared) > r.Limit || len(localRes.Profiles) > r.Limit {
+		res.Limited = true
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -16,8 +16,10 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 
 	"github.com/matrix-org/dendrite/eduserver/cache"
@@ -63,24 +65,30 @@ type Database interface {
 	// transaction IDs associated with the given device. These transaction IDs come
 	// from when the device sent the event via an API that included a transaction
 	// ID. A response object must be provided for IncrementaSync to populate - it
-	// will not create one.
-	IncrementalSync(ctx context.Context, res *types.Response, device userapi.Device, fromPos, toPos types.StreamingToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
-	// CompleteSync returns a complete /sync API response for the given user. A response object
-	// must be provided for CompleteSync to populate - it will not create one.
-	CompleteSync(ctx context.Context, res *types.Response, device userapi.Device, numRecentEventsPerRoom int) (*types.Response, error)
+	// will not create one. The filter decides which rooms, state and timeline
+	// events are returned. If the state filter lazy-loads members then only the
+	// membership events of timeline senders which haven't already been sent to
+	// the device are included in the room state.
+	IncrementalSync(ctx context.Context, res *types.Response, device userapi.Device, fromPos, toPos types.StreamingToken, filter *gomatrixserverlib.Filter, wantFullState bool) (*types.Response, error)
+	// CompleteSync returns a complete /sync API response for the given user, with the
+	// given filter applied. A response object must be provided for CompleteSync to
+	// populate - it will not create one.
+	CompleteSync(ctx context.Context, res *types.Response, device userapi.Device, filter *gomatrixserverlib.Filter) (*types.Response, error)
 	// GetAccountDataInRange returns all account data for a given user inserted or
 	// updated between two given positions
-	// Returns a map following the format data[roomID] = []dataTypes
+	// Returns a map following the format data[roomID][dataType] = content, where
+	// the content is nil if the client API didn't send it
 	// If no data is retrieved, returns an empty map
 	// If there was an issue with the retrieval, returns an error
-	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string][]string, error)
+	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string]map[string]json.RawMessage, error)
 	// UpsertAccountData keeps track of new or updated account data, by saving the type
 	// of the new/updated data, and the user ID and room ID the data is related to (empty)
-	// room ID means the data isn't specific to any room)
+	// room ID means the data isn't specific to any room), along with its content
+	// if the client API sent it
 	// If no data with the given type, user ID and room ID exists in the database,
 	// creates a new row, else update the existing one
 	// Returns an error if there was an issue with the upsert
-	UpsertAccountData(ctx context.Context, userID, roomID, dataType string) (types.StreamPosition, error)
+	UpsertAccountData(ctx context.Context, userID, roomID, dataType string, content json.RawMessage) (types.StreamPosition, error)
 	// AddInviteEvent stores a new invite event for a user.
 	// If the invite was successfully stored this returns the stream ID it was stored at.
 	// Returns an error if there was a problem communicating with the database.
@@ -108,10 +116,15 @@ type Database interface {
 	RemoveTypingUser(userID, roomID string) types.StreamPosition
 	// GetEventsInStreamingRange retrieves all of the events on a given ordering using the given extremities and limit.
 	GetEventsInStreamingRange(ctx context.Context, from, to *types.StreamingToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
-	// GetEventsInTopologicalRange retrieves all of the events on a given ordering using the given extremities and limit.
+	// GetEventsInTopologicalRange retrieves all of the events on a given ordering using the given extremities and limit. Events
+	// after the earlier token, up to and including the event at the later token, are returned.
 	GetEventsInTopologicalRange(ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
 	// EventPositionInTopology returns the depth and stream position of the given event.
 	EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error)
+	// EventsAroundPosition returns up to limit events either before or after the given position in the
+	// room's topology, not including the event at that position. Events before the position are returned
+	// newest first, and events after it oldest first.
+	EventsAroundPosition(ctx context.Context, roomID string, pos types.TopologyToken, limit int, after bool) ([]types.StreamEvent, error)
 	// BackwardExtremitiesForRoom returns a map of backwards extremity event ID to a list of its prev_events.
 	BackwardExtremitiesForRoom(ctx context.Context, roomID string) (backwardExtremities map[string][]string, err error)
 	// MaxTopologicalPosition returns the highest topological position for a given room.
@@ -122,26 +135,25 @@ type Database interface {
 	StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent
 	// AddSendToDevice increases the EDU position in the cache and returns the stream position.
 	AddSendToDevice() types.StreamPosition
-	// SendToDeviceUpdatesForSync returns a list of send-to-device updates. It returns three lists:
-	// - "events": a list of send-to-device events that should be included in the sync
-	// - "changes": a list of send-to-device events that should be updated in the database by
-	//      CleanSendToDeviceUpdates
-	// - "deletions": a list of send-to-device events which have been confirmed as sent and
-	//      can be deleted altogether by CleanSendToDeviceUpdates
+	// SendToDeviceUpdatesForSync returns up to limit send-to-device updates that should be included
+	// in the sync, along with the send-to-device position that should be used in the next_batch.
 	// The token supplied should be the current requested sync token, e.g. from the "since"
-	// parameter.
-	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, token types.StreamingToken) (pos types.StreamPosition, events []types.SendToDeviceEvent, changes []types.SendToDeviceNID, deletions []types.SendToDeviceNID, err error)
-	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device.
-	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
-	// CleanSendToDeviceUpdates will update or remove any send-to-device updates based on the
-	// result to a previous call to SendDeviceUpdatesForSync. This is separate as it allows
-	// SendToDeviceUpdatesForSync to be called multiple times if needed (e.g. before and after
-	// starting to wait for an incremental sync with timeout).
-	// The token supplied should be the current requested sync token, e.g. from the "since"
-	// parameter.
-	CleanSendToDeviceUpdates(ctx context.Context, toUpdate, toDelete []types.SendToDeviceNID, token types.StreamingToken) (err error)
-	// SendToDeviceUpdatesWaiting returns true if there are send-to-device updates waiting to be sent.
-	SendToDeviceUpdatesWaiting(ctx context.Context, userID, deviceID string) (bool, error)
+	// parameter. Any updates up to the send-to-device position in that token are treated as
+	// acknowledged by the client and are deleted.
+	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, since types.StreamingToken, limit int) (pos types.StreamPosition, events []types.SendToDeviceEvent, err error)
+	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device. If
+	// maxQueued is greater than zero then the oldest events for the device will be dropped so
+	// that no more than maxQueued events are waiting to be sent to the device.
+	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent, maxQueued int) (types.StreamPosition, error)
+	// SendToDeviceUpdatesWaiting returns true if there are send-to-device updates after the
+	// given position waiting to be sent.
+	SendToDeviceUpdatesWaiting(ctx context.Context, userID, deviceID string, from types.StreamPosition) (bool, error)
+	// SendToDeviceQueue returns the total number of send-to-device updates waiting for a device,
+	// along with up to limit of the oldest of them.
+	SendToDeviceQueue(ctx context.Context, userID, deviceID string, limit int) (count int, events []types.SendToDeviceEvent, err error)
+	// FlushSendToDeviceQueue deletes all send-to-device updates waiting for a device, returning
+	// the number of updates that were deleted.
+	FlushSendToDeviceQueue(ctx context.Context, userID, deviceID string) (int64, error)
 	// GetFilter looks up the filter associated with a given local user and filter ID.
 	// Returns a filter structure. Otherwise returns an error if no such filter exists
 	// or if there was an error talking to the database.
@@ -152,8 +164,29 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
-	// StoreReceipt stores new receipt events
+	// ExpireEvents prunes the given events so that none of their content is kept, because they were
+	// older than the TTL of an ephemeral room.
+	ExpireEvents(ctx context.Context, eventIDs []string) error
+	// RoomIDsWithMembership returns the IDs of the rooms in which the given user has the given membership.
+	RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// SearchRoomEvents returns the events which match a full-text search, along with the total
+	// number of events which match it.
+	SearchRoomEvents(ctx context.Context, req *types.SearchRequest) ([]types.SearchResult, int, error)
+	// SearchUserDirectory returns up to limit users who share a room with the given
+	// user and whose user ID or display name contains the search term.
+	SearchUserDirectory(ctx context.Context, userID, searchTerm string, limit int) ([]authtypes.FullyQualifiedProfile, error)
+	// StoreReceipt stores new receipt events. A read receipt also clears the
+	// notifications of the user in the room up to the event that was read.
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
 	GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error)
+	// StoreNotification remembers that the push rules of the user notified them
+	// about the event at the given stream position.
+	StoreNotification(ctx context.Context, userID, roomID, eventID string, pos types.StreamPosition, highlight bool) error
+	// ClearNotifications forgets the notifications of the user in the room for
+	// events up to and including the given stream position.
+	ClearNotifications(ctx context.Context, userID, roomID string, pos types.StreamPosition) error
+	// NotificationCounts returns the number of events in the room which the user
+	// has been notified about and hasn't read yet, and how many of them are highlighted.
+	NotificationCounts(ctx context.Context, userID, roomID string) (notificationCount, highlightCount int, err error)
 }
@@ -18,6 +18,7 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
@@ -42,6 +43,8 @@ CREATE TABLE IF NOT EXISTS syncapi_account_data_type (
     room_id TEXT NOT NULL,
     -- Type of the data
     type TEXT NOT NULL,
+    -- The content of the data, if the client API sent it
+    content TEXT,
 
     -- We don't want two entries of the same type for the same user
     CONSTRAINT syncapi_account_data_unique UNIQUE (user_id, room_id, type)
@@ -51,13 +54,13 @@ CREATE UNIQUE INDEX IF NOT EXISTS syncapi_account_data_id_idx ON syncapi_account
 `
 
 const insertAccountDataSQL = "" +
-	"INSERT INTO syncapi_account_data_type (user_id, room_id, type) VALUES ($1, $2, $3)" +
+	"INSERT INTO syncapi_account_data_type (user_id, room_id, type, content) VALUES ($1, $2, $3, $4)" +
 	" ON CONFLICT ON CONSTRAINT syncapi_account_data_unique" +
-	" DO UPDATE SET id = EXCLUDED.id" +
+	" DO UPDATE SET id = EXCLUDED.id, content = EXCLUDED.content" +
 	" RETURNING id"
 
 const selectAccountDataInRangeSQL = "" +
-	"SELECT room_id, type FROM syncapi_account_data_type" +
+	"SELECT room_id, type, content FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
 	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
@@ -92,9 +95,9 @@ func NewPostgresAccountDataTable(db *sql.DB) (tables.AccountData, error) {
 
 func (s *accountDataStatements) InsertAccountData(
 	ctx context.Context, txn *sql.Tx,
-	userID, roomID, dataType string,
+	userID, roomID, dataType string, content json.RawMessage,
 ) (pos types.StreamPosition, err error) {
-	err = s.insertAccountDataStmt.QueryRowContext(ctx, userID, roomID, dataType).Scan(&pos)
+	err = s.insertAccountDataStmt.QueryRowContext(ctx, userID, roomID, dataType, accountDataContent(content)).Scan(&pos)
 	return
 }
 
@@ -103,8 +106,8 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	accountDataEventFilter *gomatrixserverlib.EventFilter,
-) (data map[string][]string, err error) {
-	data = make(map[string][]string)
+) (data map[string]map[string]json.RawMessage, err error) {
+	data = make(map[string]map[string]json.RawMessage)
 
 	rows, err := s.selectAccountDataInRangeStmt.QueryContext(ctx, userID, r.Low(), r.High(),
 		pq.StringArray(filterConvertTypeWildcardToSQL(accountDataEventFilter.Types)),
@@ -119,20 +122,29 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	for rows.Next() {
 		var dataType string
 		var roomID string
+		var content sql.NullString
 
-		if err = rows.Scan(&roomID, &dataType); err != nil {
+		if err = rows.Scan(&roomID, &dataType, &content); err != nil {
 			return
 		}
 
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
-		} else {
-			data[roomID] = []string{dataType}
+		if data[roomID] == nil {
+			data[roomID] = make(map[string]json.RawMessage)
+		}
+		data[roomID][dataType] = nil
+		if content.Valid {
+			data[roomID][dataType] = json.RawMessage(content.String)
 		}
 	}
 	return data, rows.Err()
 }
 
+// accountDataContent returns the content to store, which is NULL if the client
+// API didn't send it.
+func accountDataContent(content json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(content), Valid: len(content) > 0}
+}
+
 func (s *accountDataStatements) SelectMaxAccountDataID(
 	ctx context.Context, txn *sql.Tx,
 ) (id int64, err error) {
@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/pressly/goose"
+	"github.com/tidwall/gjson"
+)
+
+const searchBatchSize = 1000
+
+func LoadFromGooseSearch() {
+	goose.AddMigration(UpSearch, DownSearch)
+}
+
+func LoadSearch(m *sqlutil.Migrations) {
+	m.AddMigration(UpSearch, DownSearch)
+}
+
+// UpSearch adds all of the existing events to the search index, which will
+// have been created empty.
+func UpSearch(tx *sql.Tx) error {
+	var eventTypes []string
+	for _, eventType := range types.SearchKeys {
+		eventTypes = append(eventTypes, eventType)
+	}
+	type searchEvent struct {
+		id                      int64
+		eventID, roomID, sender string
+		key, text               string
+	}
+	// Work through the events in batches, as we can't insert while the rows
+	// are still being read.
+	var after int64
+	for {
+		rows, err := tx.Query(
+			"SELECT id, event_id, room_id, sender, type, headered_event_json FROM syncapi_output_room_events"+
+				" WHERE id > $1 AND type = ANY($2) ORDER BY id ASC LIMIT $3",
+			after, pq.StringArray(eventTypes), searchBatchSize,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to select events: %w", err)
+		}
+		var events []searchEvent
+		scanned := 0
+		for rows.Next() {
+			scanned++
+			var ev searchEvent
+			var eventType string
+			var eventJSON []byte
+			if err = rows.Scan(&ev.id, &ev.eventID, &ev.roomID, &ev.sender, &eventType, &eventJSON); err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("failed to scan event: %w", err)
+			}
+			after = ev.id
+			var stateKey *string
+			if sk := gjson.GetBytes(eventJSON, "state_key"); sk.Exists() {
+				stateKey = &sk.Str
+			}
+			content := []byte(gjson.GetBytes(eventJSON, "content").Raw)
+			var ok bool
+			if ev.key, ev.text, ok = types.SearchableText(eventType, stateKey, content); ok {
+				events = append(events, ev)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to select events: %w", err)
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if _, err = tx.Exec(
+				"INSERT INTO syncapi_search_events (stream_pos, event_id, room_id, sender, key, vector)"+
+					" VALUES ($1, $2, $3, $4, $5, to_tsvector('english', $6))"+
+					" ON CONFLICT DO NOTHING",
+				ev.id, ev.eventID, ev.roomID, ev.sender, ev.key, ev.text,
+			); err != nil {
+				return fmt.Errorf("failed to index event %q: %w", ev.eventID, err)
+			}
+		}
+		if scanned < searchBatchSize {
+			return nil
+		}
+	}
+}
+
+func DownSearch(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM syncapi_search_events;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGooseContainsURL() {
+	goose.AddMigration(UpContainsURL, DownContainsURL)
+}
+
+func LoadContainsURL(m *sqlutil.Migrations) {
+	m.AddMigration(UpContainsURL, DownContainsURL)
+}
+
+// UpContainsURL sets contains_url on existing events. It was previously
+// never set because the check for a "url" key in the content was inverted,
+// so any event with a URL will have been stored with contains_url = FALSE.
+func UpContainsURL(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		UPDATE syncapi_output_room_events SET contains_url = TRUE
+			WHERE headered_event_json::jsonb -> 'content' ? 'url';
+		UPDATE syncapi_current_room_state SET contains_url = TRUE
+			WHERE headered_event_json::jsonb -> 'content' ? 'url';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownContainsURL(tx *sql.Tx) error {
+	// There's nothing to undo, since the column is still correct for the
+	// old version.
+	return nil
+}
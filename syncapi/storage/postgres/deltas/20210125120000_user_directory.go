@@ -0,0 +1,57 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGooseUserDirectory() {
+	goose.AddMigration(UpUserDirectory, DownUserDirectory)
+}
+
+func LoadUserDirectory(m *sqlutil.Migrations) {
+	m.AddMigration(UpUserDirectory, DownUserDirectory)
+}
+
+// UpUserDirectory adds the joined members of the rooms that we already know
+// about to the user directory, which will have been created empty.
+func UpUserDirectory(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		INSERT INTO syncapi_user_directory (user_id, room_id, event_id, display_name, avatar_url)
+			SELECT state_key, room_id, event_id,
+				COALESCE(headered_event_json::jsonb -> 'content' ->> 'displayname', ''),
+				COALESCE(headered_event_json::jsonb -> 'content' ->> 'avatar_url', '')
+			FROM syncapi_current_room_state
+			WHERE type = 'm.room.member' AND membership = 'join'
+		ON CONFLICT DO NOTHING;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownUserDirectory(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM syncapi_user_directory;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAccountDataContent(m *sqlutil.Migrations) {
+	m.AddMigration(UpAccountDataContent, DownAccountDataContent)
+}
+
+// UpAccountDataContent adds the content of account data, which the client API
+// now sends along with updates so that it doesn't need to be requested from
+// the user API. It's NULL for existing account data. The table is created
+// after the deltas have run, so there's nothing to do if it doesn't exist yet.
+func UpAccountDataContent(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE IF EXISTS syncapi_account_data_type ADD COLUMN IF NOT EXISTS content TEXT;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAccountDataContent(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE IF EXISTS syncapi_account_data_type DROP COLUMN IF EXISTS content;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
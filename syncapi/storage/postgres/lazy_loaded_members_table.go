@@ -0,0 +1,112 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const lazyLoadedMembersSchema = `
+-- Stores the membership events that have already been sent to each device
+-- when lazy-loading members, so that they aren't sent again.
+CREATE TABLE IF NOT EXISTS syncapi_lazy_loaded_members (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	-- The user whose membership event was sent.
+	member_user_id TEXT NOT NULL,
+	-- The ID of the membership event that was sent.
+	event_id TEXT NOT NULL,
+	UNIQUE (user_id, device_id, room_id, member_user_id)
+);
+`
+
+const upsertLazyLoadedMemberSQL = "" +
+	"INSERT INTO syncapi_lazy_loaded_members (user_id, device_id, room_id, member_user_id, event_id)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id, room_id, member_user_id)" +
+	" DO UPDATE SET event_id = $5"
+
+const selectLazyLoadedMembersSQL = "" +
+	"SELECT member_user_id, event_id FROM syncapi_lazy_loaded_members" +
+	" WHERE user_id = $1 AND device_id = $2 AND room_id = $3"
+
+const deleteLazyLoadedMembersSQL = "" +
+	"DELETE FROM syncapi_lazy_loaded_members WHERE user_id = $1 AND device_id = $2"
+
+type lazyLoadedMembersStatements struct {
+	upsertLazyLoadedMemberStmt  *sql.Stmt
+	selectLazyLoadedMembersStmt *sql.Stmt
+	deleteLazyLoadedMembersStmt *sql.Stmt
+}
+
+func NewPostgresLazyLoadedMembersTable(db *sql.DB) (tables.LazyLoadedMembers, error) {
+	s := &lazyLoadedMembersStatements{}
+	_, err := db.Exec(lazyLoadedMembersSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertLazyLoadedMemberStmt, err = db.Prepare(upsertLazyLoadedMemberSQL); err != nil {
+		return nil, err
+	}
+	if s.selectLazyLoadedMembersStmt, err = db.Prepare(selectLazyLoadedMembersSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteLazyLoadedMembersStmt, err = db.Prepare(deleteLazyLoadedMembersSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *lazyLoadedMembersStatements) UpsertLazyLoadedMember(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, roomID, memberUserID, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertLazyLoadedMemberStmt).ExecContext(
+		ctx, userID, deviceID, roomID, memberUserID, eventID,
+	)
+	return err
+}
+
+func (s *lazyLoadedMembersStatements) SelectLazyLoadedMembers(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, roomID string,
+) (map[string]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectLazyLoadedMembersStmt).QueryContext(ctx, userID, deviceID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectLazyLoadedMembers: rows.close() failed")
+
+	members := make(map[string]string)
+	for rows.Next() {
+		var memberUserID, eventID string
+		if err = rows.Scan(&memberUserID, &eventID); err != nil {
+			return nil, err
+		}
+		members[memberUserID] = eventID
+	}
+	return members, rows.Err()
+}
+
+func (s *lazyLoadedMembersStatements) DeleteLazyLoadedMembers(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteLazyLoadedMembersStmt).ExecContext(ctx, userID, deviceID)
+	return err
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchSchema = `
+-- Stores a full-text index of the searchable text of room events.
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	-- The position of the event in syncapi_output_room_events.
+	stream_pos BIGINT NOT NULL,
+	event_id TEXT NOT NULL CONSTRAINT syncapi_search_event_id_idx UNIQUE,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	-- The search key that the text came from, e.g. 'content.body'.
+	key TEXT NOT NULL,
+	vector TSVECTOR NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_vector_idx ON syncapi_search_events USING GIN(vector);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id_idx ON syncapi_search_events(room_id, stream_pos);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (stream_pos, event_id, room_id, sender, key, vector)" +
+	" VALUES ($1, $2, $3, $4, $5, to_tsvector('english', $6))" +
+	" ON CONFLICT ON CONSTRAINT syncapi_search_event_id_idx DO NOTHING"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+// The conditions shared by all of the search queries.
+const searchConditions = "" +
+	" FROM syncapi_search_events, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" AND ( $4::text[] IS NULL OR sender = ANY($4) )" +
+	" AND ( $5::text[] IS NULL OR NOT(sender = ANY($5)) )"
+
+const selectSearchByRankSQL = "" +
+	"SELECT event_id, stream_pos, ts_rank_cd(vector, query) AS rank" + searchConditions +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $6 OFFSET $7"
+
+const selectSearchByRecentSQL = "" +
+	"SELECT event_id, stream_pos, ts_rank_cd(vector, query) AS rank" + searchConditions +
+	" AND stream_pos < $6 ORDER BY stream_pos DESC LIMIT $7"
+
+const selectSearchCountSQL = "" +
+	"SELECT COUNT(*)" + searchConditions
+
+type searchStatements struct {
+	insertSearchEventStmt    *sql.Stmt
+	deleteSearchEventStmt    *sql.Stmt
+	selectSearchByRankStmt   *sql.Stmt
+	selectSearchByRecentStmt *sql.Stmt
+	selectSearchCountStmt    *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &searchStatements{}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchEvent statement: %w", err)
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEvent statement: %w", err)
+	}
+	if s.selectSearchByRankStmt, err = db.Prepare(selectSearchByRankSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchByRank statement: %w", err)
+	}
+	if s.selectSearchByRecentStmt, err = db.Prepare(selectSearchByRecentSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchByRecent statement: %w", err)
+	}
+	if s.selectSearchCountStmt, err = db.Prepare(selectSearchCountSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchCount statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, pos types.StreamPosition,
+	event *gomatrixserverlib.HeaderedEvent, key, text string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(
+		ctx, pos, event.EventID(), event.RoomID(), event.Sender(), key, text,
+	)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearch(
+	ctx context.Context, txn *sql.Tx, req *types.SearchRequest,
+) ([]types.SearchResult, error) {
+	var rows *sql.Rows
+	var err error
+	if req.OrderByRank {
+		rows, err = sqlutil.TxStmt(txn, s.selectSearchByRankStmt).QueryContext(
+			ctx, req.Term, pq.StringArray(req.RoomIDs), pq.StringArray(req.Keys),
+			pq.StringArray(req.Senders), pq.StringArray(req.NotSenders),
+			req.Limit, req.From,
+		)
+	} else {
+		before := req.From
+		if before <= 0 {
+			before = math.MaxInt64
+		}
+		rows, err = sqlutil.TxStmt(txn, s.selectSearchByRecentStmt).QueryContext(
+			ctx, req.Term, pq.StringArray(req.RoomIDs), pq.StringArray(req.Keys),
+			pq.StringArray(req.Senders), pq.StringArray(req.NotSenders),
+			before, req.Limit,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query search: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearch: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.StreamPos, &result.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *searchStatements) SelectSearchCount(
+	ctx context.Context, txn *sql.Tx, req *types.SearchRequest,
+) (count int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectSearchCountStmt).QueryRowContext(
+		ctx, req.Term, pq.StringArray(req.RoomIDs), pq.StringArray(req.Keys),
+		pq.StringArray(req.Senders), pq.StringArray(req.NotSenders),
+	).Scan(&count)
+	return
+}
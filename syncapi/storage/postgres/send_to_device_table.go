@@ -19,7 +19,6 @@ import (
 	"database/sql"
 	"encoding/json"
 
-	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
@@ -39,11 +38,12 @@ CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
 	device_id TEXT NOT NULL,
 	-- The event content JSON.
 	content TEXT NOT NULL,
-	-- The token that was supplied to the /sync at the time that this
-	-- message was included in a sync response, or NULL if we haven't
-	-- included it in a /sync response yet.
+	-- No longer used: messages are now acknowledged by the send-to-device
+	-- position in the "since" parameter of the next /sync.
 	sent_by_token TEXT
 );
+
+CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device(user_id, device_id);
 `
 
 const insertSendToDeviceMessageSQL = `
@@ -55,31 +55,37 @@ const insertSendToDeviceMessageSQL = `
 const countSendToDeviceMessagesSQL = `
 	SELECT COUNT(*)
 	  FROM syncapi_send_to_device
-	  WHERE user_id = $1 AND device_id = $2
+	  WHERE user_id = $1 AND device_id = $2 AND id > $3
 `
 
 const selectSendToDeviceMessagesSQL = `
-	SELECT id, user_id, device_id, content, sent_by_token
+	SELECT id, user_id, device_id, content
 	  FROM syncapi_send_to_device
-	  WHERE user_id = $1 AND device_id = $2
-	  ORDER BY id DESC
+	  WHERE user_id = $1 AND device_id = $2 AND id > $3
+	  ORDER BY id ASC
+	  LIMIT $4
 `
 
-const updateSentSendToDeviceMessagesSQL = `
-	UPDATE syncapi_send_to_device SET sent_by_token = $1
-	  WHERE id = ANY($2)
+const deleteSendToDeviceMessagesSQL = `
+	DELETE FROM syncapi_send_to_device
+	  WHERE user_id = $1 AND device_id = $2 AND id <= $3
 `
 
-const deleteSendToDeviceMessagesSQL = `
-	DELETE FROM syncapi_send_to_device WHERE id = ANY($1)
+const deleteOldestSendToDeviceMessagesSQL = `
+	DELETE FROM syncapi_send_to_device WHERE id IN (
+	  SELECT id FROM syncapi_send_to_device
+	    WHERE user_id = $1 AND device_id = $2
+	    ORDER BY id DESC
+	    OFFSET $3
+	)
 `
 
 type sendToDeviceStatements struct {
-	insertSendToDeviceMessageStmt      *sql.Stmt
-	countSendToDeviceMessagesStmt      *sql.Stmt
-	selectSendToDeviceMessagesStmt     *sql.Stmt
-	updateSentSendToDeviceMessagesStmt *sql.Stmt
-	deleteSendToDeviceMessagesStmt     *sql.Stmt
+	insertSendToDeviceMessageStmt        *sql.Stmt
+	countSendToDeviceMessagesStmt        *sql.Stmt
+	selectSendToDeviceMessagesStmt       *sql.Stmt
+	deleteSendToDeviceMessagesStmt       *sql.Stmt
+	deleteOldestSendToDeviceMessagesStmt *sql.Stmt
 }
 
 func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
@@ -97,10 +103,10 @@ func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 	if s.selectSendToDeviceMessagesStmt, err = db.Prepare(selectSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
-	if s.updateSentSendToDeviceMessagesStmt, err = db.Prepare(updateSentSendToDeviceMessagesSQL); err != nil {
+	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
-	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
+	if s.deleteOldestSendToDeviceMessagesStmt, err = db.Prepare(deleteOldestSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -114,9 +120,9 @@ func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
 }
 
 func (s *sendToDeviceStatements) CountSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition,
 ) (count int, err error) {
-	row := sqlutil.TxStmt(txn, s.countSendToDeviceMessagesStmt).QueryRowContext(ctx, userID, deviceID)
+	row := sqlutil.TxStmt(txn, s.countSendToDeviceMessagesStmt).QueryRowContext(ctx, userID, deviceID, from)
 	if err = row.Scan(&count); err != nil {
 		return
 	}
@@ -124,9 +130,9 @@ func (s *sendToDeviceStatements) CountSendToDeviceMessages(
 }
 
 func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition, limit int,
 ) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error) {
-	rows, err := sqlutil.TxStmt(txn, s.selectSendToDeviceMessagesStmt).QueryContext(ctx, userID, deviceID)
+	rows, err := sqlutil.TxStmt(txn, s.selectSendToDeviceMessagesStmt).QueryContext(ctx, userID, deviceID, from, limit)
 	if err != nil {
 		return
 	}
@@ -135,8 +141,7 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 	for rows.Next() {
 		var id types.SendToDeviceNID
 		var userID, deviceID, content string
-		var sentByToken *string
-		if err = rows.Scan(&id, &userID, &deviceID, &content, &sentByToken); err != nil {
+		if err = rows.Scan(&id, &userID, &deviceID, &content); err != nil {
 			return
 		}
 		event := types.SendToDeviceEvent{
@@ -147,11 +152,6 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 		if err = json.Unmarshal([]byte(content), &event.SendToDeviceEvent); err != nil {
 			return
 		}
-		if sentByToken != nil {
-			if token, err := types.NewStreamTokenFromString(*sentByToken); err == nil {
-				event.SentByToken = &token
-			}
-		}
 		events = append(events, event)
 		if types.StreamPosition(id) > lastPos {
 			lastPos = types.StreamPosition(id)
@@ -161,16 +161,22 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 	return lastPos, events, rows.Err()
 }
 
-func (s *sendToDeviceStatements) UpdateSentSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, token string, nids []types.SendToDeviceNID,
-) (err error) {
-	_, err = sqlutil.TxStmt(txn, s.updateSentSendToDeviceMessagesStmt).ExecContext(ctx, token, pq.Array(nids))
-	return
+func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, upTo types.StreamPosition,
+) (count int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteSendToDeviceMessagesStmt).ExecContext(ctx, userID, deviceID, upTo)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID,
-) (err error) {
-	_, err = sqlutil.TxStmt(txn, s.deleteSendToDeviceMessagesStmt).ExecContext(ctx, pq.Array(nids))
-	return
+func (s *sendToDeviceStatements) DeleteOldestSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, keep int,
+) (count int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteOldestSendToDeviceMessagesStmt).ExecContext(ctx, userID, deviceID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
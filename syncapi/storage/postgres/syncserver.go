@@ -48,10 +48,6 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err = d.PartitionOffsetStatements.Prepare(d.db, d.writer, "syncapi"); err != nil {
 		return nil, err
 	}
-	accountData, err := NewPostgresAccountDataTable(d.db)
-	if err != nil {
-		return nil, err
-	}
 	events, err := NewPostgresEventsTable(d.db)
 	if err != nil {
 		return nil, err
@@ -88,11 +84,37 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err != nil {
 		return nil, err
 	}
+	search, err := NewPostgresSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	lazyLoadedMembers, err := NewPostgresLazyLoadedMembersTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	notifications, err := NewPostgresNotificationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	userDirectory, err := NewPostgresUserDirectoryTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
+	deltas.LoadSearch(m)
+	deltas.LoadContainsURL(m)
+	deltas.LoadUserDirectory(m)
+	deltas.LoadAccountDataContent(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
 		return nil, err
 	}
+	// The account data table is created after the deltas have run, so that
+	// its statements can refer to columns which the deltas add.
+	accountData, err := NewPostgresAccountDataTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Writer:              d.writer,
@@ -106,6 +128,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
+		Search:              search,
+		LazyLoadedMembers:   lazyLoadedMembers,
+		Notifications:       notifications,
+		UserDirectory:       userDirectory,
 		EDUCache:            cache.New(),
 	}
 	return &d, nil
@@ -19,8 +19,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"path"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
@@ -31,7 +34,23 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	prometheus.MustRegister(sendToDeviceMessages)
+}
+
+var sendToDeviceMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "send_to_device_messages",
+		Help:      "The number of send-to-device messages that were queued, acknowledged, evicted or flushed",
+	},
+	[]string{"state"},
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -49,6 +68,10 @@ type Database struct {
 	SendToDevice        tables.SendToDevice
 	Filter              tables.Filter
 	Receipts            tables.Receipts
+	Search              tables.Search
+	LazyLoadedMembers   tables.LazyLoadedMembers
+	Notifications       tables.Notifications
+	UserDirectory       tables.UserDirectory
 	EDUCache            *cache.EDUCache
 }
 
@@ -81,17 +104,19 @@ func (d *Database) GetEventsInStreamingRange(
 		To:        to.PDUPosition,
 		Backwards: backwardOrdering,
 	}
+	eventFilter := gomatrixserverlib.DefaultRoomEventFilter()
+	eventFilter.Limit = limit
 	if backwardOrdering {
 		// When using backward ordering, we want the most recent events first.
 		if events, _, err = d.OutputEvents.SelectRecentEvents(
-			ctx, nil, roomID, r, limit, false, false,
+			ctx, nil, roomID, r, &eventFilter, false, false,
 		); err != nil {
 			return
 		}
 	} else {
 		// When using forward ordering, we want the least recent events first.
 		if events, err = d.OutputEvents.SelectEarlyEvents(
-			ctx, nil, roomID, r, limit,
+			ctx, nil, roomID, r, &eventFilter,
 		); err != nil {
 			return
 		}
@@ -214,27 +239,29 @@ func (d *Database) DeletePeeks(
 
 // GetAccountDataInRange returns all account data for a given user inserted or
 // updated between two given positions
-// Returns a map following the format data[roomID] = []dataTypes
+// Returns a map following the format data[roomID][dataType] = content, where
+// the content is nil if the client API didn't send it
 // If no data is retrieved, returns an empty map
 // If there was an issue with the retrieval, returns an error
 func (d *Database) GetAccountDataInRange(
 	ctx context.Context, userID string, r types.Range,
 	accountDataFilterPart *gomatrixserverlib.EventFilter,
-) (map[string][]string, error) {
+) (map[string]map[string]json.RawMessage, error) {
 	return d.AccountData.SelectAccountDataInRange(ctx, userID, r, accountDataFilterPart)
 }
 
 // UpsertAccountData keeps track of new or updated account data, by saving the type
 // of the new/updated data, and the user ID and room ID the data is related to (empty)
-// room ID means the data isn't specific to any room)
+// room ID means the data isn't specific to any room), along with its content
+// if the client API sent it
 // If no data with the given type, user ID and room ID exists in the database,
 // creates a new row, else update the existing one
 // Returns an error if there was an issue with the upsert
 func (d *Database) UpsertAccountData(
-	ctx context.Context, userID, roomID, dataType string,
+	ctx context.Context, userID, roomID, dataType string, content json.RawMessage,
 ) (sp types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		sp, err = d.AccountData.InsertAccountData(ctx, txn, userID, roomID, dataType)
+		sp, err = d.AccountData.InsertAccountData(ctx, txn, userID, roomID, dataType, content)
 		return err
 	})
 	return
@@ -305,6 +332,9 @@ func (d *Database) PurgeRoomState(
 		if err := d.CurrentRoomState.DeleteRoomStateForRoom(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("d.CurrentRoomState.DeleteRoomStateForRoom: %w", err)
 		}
+		if err := d.UserDirectory.DeleteUserDirectoryForRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("d.UserDirectory.DeleteUserDirectoryForRoom: %w", err)
+		}
 		return nil
 	})
 }
@@ -330,6 +360,12 @@ func (d *Database) WriteEvent(
 			return fmt.Errorf("d.Topology.InsertEventInTopology: %w", err)
 		}
 
+		if key, text, ok := types.SearchableText(ev.Type(), ev.StateKey(), ev.Content()); ok {
+			if err = d.Search.InsertSearchEvent(ctx, txn, pos, ev, key, text); err != nil {
+				return fmt.Errorf("d.Search.InsertSearchEvent: %w", err)
+			}
+		}
+
 		if err = d.handleBackwardExtremities(ctx, txn, ev); err != nil {
 			return fmt.Errorf("d.handleBackwardExtremities: %w", err)
 		}
@@ -357,6 +393,9 @@ func (d *Database) updateRoomState(
 		if err := d.CurrentRoomState.DeleteRoomStateByEventID(ctx, txn, eventID); err != nil {
 			return fmt.Errorf("d.CurrentRoomState.DeleteRoomStateByEventID: %w", err)
 		}
+		if err := d.UserDirectory.DeleteUserDirectoryByEventID(ctx, txn, eventID); err != nil {
+			return fmt.Errorf("d.UserDirectory.DeleteUserDirectoryByEventID: %w", err)
+		}
 	}
 
 	for _, event := range addedEvents {
@@ -371,6 +410,9 @@ func (d *Database) updateRoomState(
 				return fmt.Errorf("event.Membership: %w", err)
 			}
 			membership = &value
+			if err = d.updateUserDirectory(ctx, txn, event, value); err != nil {
+				return fmt.Errorf("d.updateUserDirectory: %w", err)
+			}
 		}
 
 		if err := d.CurrentRoomState.UpsertRoomState(ctx, txn, event, membership, pduPosition); err != nil {
@@ -381,31 +423,40 @@ func (d *Database) updateRoomState(
 	return nil
 }
 
+// updateUserDirectory adds the profile from a join event to the user directory,
+// or removes the user from the room for any other membership.
+func (d *Database) updateUserDirectory(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, membership string,
+) error {
+	userID := *event.StateKey()
+	if membership != gomatrixserverlib.Join {
+		return d.UserDirectory.DeleteUserDirectory(ctx, txn, userID, event.RoomID())
+	}
+	content := event.Content()
+	return d.UserDirectory.UpsertUserDirectory(
+		ctx, txn, userID, event.RoomID(), event.EventID(),
+		gjson.GetBytes(content, "displayname").Str, gjson.GetBytes(content, "avatar_url").Str,
+	)
+}
+
 func (d *Database) GetEventsInTopologicalRange(
 	ctx context.Context,
 	from, to *types.TopologyToken,
 	roomID string, limit int,
 	backwardOrdering bool,
 ) (events []types.StreamEvent, err error) {
-	var minDepth, maxDepth, maxStreamPosForMaxDepth types.StreamPosition
+	// Backward ordering means the 'from' token is after the 'to' token, and
+	// forward ordering means that it's before. Either way, the events after
+	// the earlier token and up to and including the later one are returned.
+	earlier, later := from, to
 	if backwardOrdering {
-		// Backward ordering means the 'from' token has a higher depth than the 'to' token
-		minDepth = to.Depth
-		maxDepth = from.Depth
-		// for cases where we have say 5 events with the same depth, the TopologyToken needs to
-		// know which of the 5 the client has seen. This is done by using the PDU position.
-		// Events with the same maxDepth but less than this PDU position will be returned.
-		maxStreamPosForMaxDepth = from.PDUPosition
-	} else {
-		// Forward ordering means the 'from' token has a lower depth than the 'to' token.
-		minDepth = from.Depth
-		maxDepth = to.Depth
+		earlier, later = to, from
 	}
 
 	// Select the event IDs from the defined range.
 	var eIDs []string
 	eIDs, err = d.Topology.SelectEventIDsInRange(
-		ctx, nil, roomID, minDepth, maxDepth, maxStreamPosForMaxDepth, limit, !backwardOrdering,
+		ctx, nil, roomID, earlier.Depth, earlier.PDUPosition, later.Depth, later.PDUPosition, limit, !backwardOrdering,
 	)
 	if err != nil {
 		return
@@ -454,6 +505,32 @@ func (d *Database) EventPositionInTopology(
 	return types.TopologyToken{Depth: depth, PDUPosition: stream}, nil
 }
 
+func (d *Database) EventsAroundPosition(
+	ctx context.Context, roomID string, pos types.TopologyToken, limit int, after bool,
+) ([]types.StreamEvent, error) {
+	eventIDs, err := d.Topology.SelectEventIDsAround(ctx, nil, roomID, pos.Depth, pos.PDUPosition, limit, after)
+	if err != nil {
+		return nil, fmt.Errorf("d.Topology.SelectEventIDsAround: %w", err)
+	}
+	events, err := d.OutputEvents.SelectEvents(ctx, nil, eventIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	// The events won't necessarily come back in the order that we asked
+	// for them, so put them back into topological order.
+	byID := make(map[string]types.StreamEvent, len(events))
+	for _, ev := range events {
+		byID[ev.EventID()] = ev
+	}
+	ordered := make([]types.StreamEvent, 0, len(events))
+	for _, eventID := range eventIDs {
+		if ev, ok := byID[eventID]; ok {
+			ordered = append(ordered, ev)
+		}
+	}
+	return ordered, nil
+}
+
 func (d *Database) syncPositionTx(
 	ctx context.Context, txn *sql.Tx,
 ) (sp types.StreamingToken, err error) {
@@ -502,8 +579,9 @@ func (d *Database) addPDUDeltaToResponse(
 	ctx context.Context,
 	device userapi.Device,
 	r types.Range,
-	numRecentEventsPerRoom int,
 	wantFullState bool,
+	filter *gomatrixserverlib.Filter,
+	sentMembers *[]lazyLoadedMember,
 	res *types.Response,
 ) (joinedRoomIDs []string, err error) {
 	txn, err := d.DB.BeginTx(ctx, &txReadOnlySnapshot)
@@ -513,8 +591,6 @@ func (d *Database) addPDUDeltaToResponse(
 	succeeded := false
 	defer sqlutil.EndTransactionWithCheck(txn, &succeeded, &err)
 
-	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
-
 	// Work out which rooms to return in the response. This is done by getting not only the currently
 	// joined rooms, but also which rooms have membership transitions for this user between the 2 PDU stream positions.
 	// This works out what the 'state' key should be for each room as well as which membership block
@@ -522,22 +598,26 @@ func (d *Database) addPDUDeltaToResponse(
 	var deltas []stateDelta
 	if !wantFullState {
 		deltas, joinedRoomIDs, err = d.getStateDeltas(
-			ctx, &device, txn, r, device.UserID, &stateFilter,
+			ctx, &device, txn, r, device.UserID, &filter.Room.State,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("d.getStateDeltas: %w", err)
 		}
 	} else {
 		deltas, joinedRoomIDs, err = d.getStateDeltasForFullStateSync(
-			ctx, &device, txn, r, device.UserID, &stateFilter,
+			ctx, &device, txn, r, device.UserID, &filter.Room.State,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("d.getStateDeltasForFullStateSync: %w", err)
 		}
 	}
 
+	joinedRoomIDs = filterRoomIDs(&filter.Room, joinedRoomIDs)
 	for _, delta := range deltas {
-		err = d.addRoomDeltaToResponse(ctx, &device, txn, r, delta, numRecentEventsPerRoom, res)
+		if !roomIncluded(filter.Room.Rooms, filter.Room.NotRooms, delta.roomID) {
+			continue
+		}
+		err = d.addRoomDeltaToResponse(ctx, &device, txn, r, delta, filter, sentMembers, res)
 		if err != nil {
 			return nil, fmt.Errorf("d.addRoomDeltaToResponse: %w", err)
 		}
@@ -607,7 +687,7 @@ func (d *Database) addReceiptDeltaToResponse(
 		// Make sure we use an existing JoinResponse if there is one.
 		// If not, we'll create a new one
 		if jr, ok = res.Rooms.Join[roomID]; !ok {
-			jr = types.JoinResponse{}
+			jr = *types.NewJoinResponse()
 		}
 
 		ev := gomatrixserverlib.ClientEvent{
@@ -685,7 +765,7 @@ func (d *Database) IncrementalSync(
 	ctx context.Context, res *types.Response,
 	device userapi.Device,
 	fromPos, toPos types.StreamingToken,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	wantFullState bool,
 ) (*types.Response, error) {
 	res.NextBatch = fromPos.WithUpdates(toPos)
@@ -697,12 +777,23 @@ func (d *Database) IncrementalSync(
 			From: fromPos.PDUPosition,
 			To:   toPos.PDUPosition,
 		}
+		if wantFullState && filter.Room.State.LazyLoadMembers {
+			// The client has asked for the full state, so send the members
+			// even if we've sent them before.
+			f := *filter
+			f.Room.State.IncludeRedundantMembers = true
+			filter = &f
+		}
+		var sentMembers []lazyLoadedMember
 		joinedRoomIDs, err = d.addPDUDeltaToResponse(
-			ctx, device, r, numRecentEventsPerRoom, wantFullState, res,
+			ctx, device, r, wantFullState, filter, &sentMembers, res,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("d.addPDUDeltaToResponse: %w", err)
 		}
+		if err = d.storeLazyLoadedMembers(ctx, device, false, sentMembers); err != nil {
+			return nil, fmt.Errorf("d.storeLazyLoadedMembers: %w", err)
+		}
 	} else {
 		joinedRoomIDs, err = d.CurrentRoomState.SelectRoomIDsWithMembership(
 			ctx, nil, device.UserID, gomatrixserverlib.Join,
@@ -710,6 +801,7 @@ func (d *Database) IncrementalSync(
 		if err != nil {
 			return nil, fmt.Errorf("d.CurrentRoomState.SelectRoomIDsWithMembership: %w", err)
 		}
+		joinedRoomIDs = filterRoomIDs(&filter.Room, joinedRoomIDs)
 	}
 
 	// TODO: handle EDUs in peeked rooms
@@ -725,7 +817,7 @@ func (d *Database) IncrementalSync(
 		From: fromPos.InvitePosition,
 		To:   toPos.InvitePosition,
 	}
-	if err = d.addInvitesToResponse(ctx, nil, device.UserID, ir, res); err != nil {
+	if err = d.addInvitesToResponse(ctx, nil, device.UserID, ir, &filter.Room, res); err != nil {
 		return nil, fmt.Errorf("d.addInvitesToResponse: %w", err)
 	}
 
@@ -750,18 +842,70 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 
 	newEvent := ev.Headered(redactedBecause.RoomVersion)
 	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
-		return d.OutputEvents.UpdateEventJSON(ctx, newEvent)
+		if err = d.OutputEvents.UpdateEventJSON(ctx, newEvent); err != nil {
+			return err
+		}
+		// The searchable text has been redacted away, so it shouldn't be
+		// possible to find the event by searching for it any more.
+		return d.Search.DeleteSearchEvent(ctx, txn, redactedEventID)
 	})
 	return err
 }
 
+// ExpireEvents prunes the given events using the redaction algorithm, because
+// they were older than the TTL of an ephemeral room.
+func (d *Database) ExpireEvents(ctx context.Context, eventIDs []string) error {
+	events, err := d.Events(ctx, eventIDs)
+	if err != nil {
+		return err
+	}
+	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		for _, event := range events {
+			pruned := event.Unwrap().Redact().Headered(event.RoomVersion)
+			if err = d.OutputEvents.UpdateEventJSON(ctx, pruned); err != nil {
+				return err
+			}
+			if err = d.Search.DeleteSearchEvent(ctx, txn, event.EventID()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
+}
+
+func (d *Database) SearchRoomEvents(
+	ctx context.Context, req *types.SearchRequest,
+) (results []types.SearchResult, count int, err error) {
+	if len(req.RoomIDs) == 0 || len(req.Keys) == 0 {
+		return nil, 0, nil
+	}
+	if results, err = d.Search.SelectSearch(ctx, nil, req); err != nil {
+		return nil, 0, fmt.Errorf("d.Search.SelectSearch: %w", err)
+	}
+	if count, err = d.Search.SelectSearchCount(ctx, nil, req); err != nil {
+		return nil, 0, fmt.Errorf("d.Search.SelectSearchCount: %w", err)
+	}
+	return results, count, nil
+}
+
+func (d *Database) SearchUserDirectory(
+	ctx context.Context, userID, searchTerm string, limit int,
+) ([]authtypes.FullyQualifiedProfile, error) {
+	return d.UserDirectory.SelectUserDirectory(ctx, nil, userID, searchTerm, limit)
+}
+
 // getResponseWithPDUsForCompleteSync creates a response and adds all PDUs needed
 // to it. It returns toPos and joinedRoomIDs for use of adding EDUs.
 // nolint:nakedret
 func (d *Database) getResponseWithPDUsForCompleteSync(
 	ctx context.Context, res *types.Response,
 	userID string, device userapi.Device,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
+	sentMembers *[]lazyLoadedMember,
 ) (
 	toPos types.StreamingToken,
 	joinedRoomIDs []string,
@@ -799,14 +943,13 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 	if err != nil {
 		return
 	}
-
-	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+	joinedRoomIDs = filterRoomIDs(&filter.Room, joinedRoomIDs)
 
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
 		var jr *types.JoinResponse
 		jr, err = d.getJoinResponseForCompleteSync(
-			ctx, txn, roomID, r, &stateFilter, numRecentEventsPerRoom, device,
+			ctx, txn, roomID, r, filter, device, sentMembers,
 		)
 		if err != nil {
 			return
@@ -820,10 +963,10 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 		return
 	}
 	for _, peek := range peeks {
-		if !peek.Deleted {
+		if !peek.Deleted && roomIncluded(filter.Room.Rooms, filter.Room.NotRooms, peek.RoomID) {
 			var jr *types.JoinResponse
 			jr, err = d.getJoinResponseForCompleteSync(
-				ctx, txn, peek.RoomID, r, &stateFilter, numRecentEventsPerRoom, device,
+				ctx, txn, peek.RoomID, r, filter, device, sentMembers,
 			)
 			if err != nil {
 				return
@@ -832,7 +975,7 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 		}
 	}
 
-	if err = d.addInvitesToResponse(ctx, txn, userID, ir, res); err != nil {
+	if err = d.addInvitesToResponse(ctx, txn, userID, ir, &filter.Room, res); err != nil {
 		return
 	}
 
@@ -844,23 +987,27 @@ func (d *Database) getJoinResponseForCompleteSync(
 	ctx context.Context, txn *sql.Tx,
 	roomID string,
 	r types.Range,
-	stateFilter *gomatrixserverlib.StateFilter,
-	numRecentEventsPerRoom int, device userapi.Device,
+	filter *gomatrixserverlib.Filter,
+	device userapi.Device,
+	sentMembers *[]lazyLoadedMember,
 ) (jr *types.JoinResponse, err error) {
+	stateFilter := &filter.Room.State
 	var stateEvents []*gomatrixserverlib.HeaderedEvent
-	stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
-	if err != nil {
-		return
+	if roomIncluded(stateFilter.Rooms, stateFilter.NotRooms, roomID) {
+		stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, withoutLazyLoadedMembers(stateFilter))
+		if err != nil {
+			return
+		}
 	}
-	// TODO: When filters are added, we may need to call this multiple times to get enough events.
-	//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
 	var recentStreamEvents []types.StreamEvent
 	var limited bool
-	recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
-		ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
-	)
-	if err != nil {
-		return
+	if timelineFilter := &filter.Room.Timeline; roomIncluded(timelineFilter.Rooms, timelineFilter.NotRooms, roomID) {
+		recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
+			ctx, txn, roomID, r, timelineFilter, true, true,
+		)
+		if err != nil {
+			return
+		}
 	}
 
 	// TODO FIXME: We don't fully implement history visibility yet. To avoid leaking events which the
@@ -911,6 +1058,14 @@ func (d *Database) getJoinResponseForCompleteSync(
 	// "Can sync a room with a message with a transaction id" - which does a complete sync to check.
 	recentEvents := d.StreamEventsToEvents(&device, recentStreamEvents)
 	stateEvents = removeDuplicates(stateEvents, recentEvents)
+	if stateFilter.LazyLoadMembers {
+		var sent []lazyLoadedMember
+		stateEvents, sent, err = d.lazyLoadMembers(ctx, txn, &device, roomID, stateFilter, recentEvents, stateEvents)
+		if err != nil {
+			return
+		}
+		*sentMembers = append(*sentMembers, sent...)
+	}
 	jr = types.NewJoinResponse()
 	jr.Timeline.PrevBatch = prevBatch
 	jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
@@ -921,14 +1076,21 @@ func (d *Database) getJoinResponseForCompleteSync(
 
 func (d *Database) CompleteSync(
 	ctx context.Context, res *types.Response,
-	device userapi.Device, numRecentEventsPerRoom int,
+	device userapi.Device,
+	filter *gomatrixserverlib.Filter,
 ) (*types.Response, error) {
+	var sentMembers []lazyLoadedMember
 	toPos, joinedRoomIDs, err := d.getResponseWithPDUsForCompleteSync(
-		ctx, res, device.UserID, device, numRecentEventsPerRoom,
+		ctx, res, device.UserID, device, filter, &sentMembers,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("d.getResponseWithPDUsForCompleteSync: %w", err)
 	}
+	// The client is starting again from scratch, so forget about any members
+	// that were sent to it before.
+	if err = d.storeLazyLoadedMembers(ctx, device, true, sentMembers); err != nil {
+		return nil, fmt.Errorf("d.storeLazyLoadedMembers: %w", err)
+	}
 
 	// TODO: handle EDUs in peeked rooms
 
@@ -957,6 +1119,7 @@ func (d *Database) addInvitesToResponse(
 	ctx context.Context, txn *sql.Tx,
 	userID string,
 	r types.Range,
+	roomFilter *gomatrixserverlib.RoomFilter,
 	res *types.Response,
 ) error {
 	invites, retiredInvites, err := d.Invites.SelectInviteEventsInRange(
@@ -966,10 +1129,16 @@ func (d *Database) addInvitesToResponse(
 		return fmt.Errorf("d.Invites.SelectInviteEventsInRange: %w", err)
 	}
 	for roomID, inviteEvent := range invites {
+		if !roomIncluded(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			continue
+		}
 		ir := types.NewInviteResponse(inviteEvent)
 		res.Rooms.Invite[roomID] = *ir
 	}
 	for roomID := range retiredInvites {
+		if !roomIncluded(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			continue
+		}
 		if _, ok := res.Rooms.Join[roomID]; !ok {
 			lr := types.NewLeaveResponse()
 			res.Rooms.Leave[roomID] = *lr
@@ -1004,9 +1173,11 @@ func (d *Database) addRoomDeltaToResponse(
 	txn *sql.Tx,
 	r types.Range,
 	delta stateDelta,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
+	sentMembers *[]lazyLoadedMember,
 	res *types.Response,
 ) error {
+	stateFilter := &filter.Room.State
 	if delta.membershipPos > 0 && delta.membership == gomatrixserverlib.Leave {
 		// make sure we don't leak recent events after the leave event.
 		// TODO: History visibility makes this somewhat complex to handle correctly. For example:
@@ -1016,15 +1187,38 @@ func (d *Database) addRoomDeltaToResponse(
 		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		r.To = delta.membershipPos
 	}
-	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
-		ctx, txn, delta.roomID, r,
-		numRecentEventsPerRoom, true, true,
-	)
-	if err != nil {
-		return err
+	var recentStreamEvents []types.StreamEvent
+	var limited bool
+	var err error
+	if timelineFilter := &filter.Room.Timeline; roomIncluded(timelineFilter.Rooms, timelineFilter.NotRooms, delta.roomID) {
+		recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
+			ctx, txn, delta.roomID, r, timelineFilter, true, true,
+		)
+		if err != nil {
+			return err
+		}
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
+	if limited && !delta.fullState && len(recentStreamEvents) > 0 {
+		// There's a gap between the position the client already has and the
+		// start of the timeline, so the state changes in the gap need to be
+		// sent instead of the changes across the whole range, otherwise any
+		// changes which were then changed again in the timeline are lost.
+		delta.stateEvents, err = d.stateDeltaBeforeTimeline(ctx, txn, device, delta.roomID, r, recentStreamEvents, stateFilter)
+		if err != nil {
+			return err
+		}
+	}
+	delta.stateEvents = filterStateEvents(stateFilter, delta.roomID, delta.stateEvents)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
+	if stateFilter.LazyLoadMembers {
+		var sent []lazyLoadedMember
+		delta.stateEvents, sent, err = d.lazyLoadMembers(ctx, txn, device, delta.roomID, stateFilter, recentEvents, delta.stateEvents)
+		if err != nil {
+			return err
+		}
+		*sentMembers = append(*sentMembers, sent...)
+	}
 	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
 	if err != nil {
 		return err
@@ -1069,6 +1263,61 @@ func (d *Database) addRoomDeltaToResponse(
 	return nil
 }
 
+// stateDeltaBeforeTimeline returns the changes to the state of the room
+// between the position that the client already has and the start of the given
+// timeline, which must be in chronological order. The client learns about the
+// state changes in the timeline from the timeline itself, apart from those
+// which weren't made by timeline events, e.g. by state resolution, so these
+// are included too.
+func (d *Database) stateDeltaBeforeTimeline(
+	ctx context.Context, txn *sql.Tx, device *userapi.Device,
+	roomID string, r types.Range, timeline []types.StreamEvent,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	timelineStart := timeline[0].StreamPosition - 1
+	gapNeeded, gapEvents, err := d.OutputEvents.SelectStateInRange(
+		ctx, txn, types.Range{From: r.Low(), To: timelineStart}, roomID, stateFilter,
+	)
+	if err != nil {
+		return nil, err
+	}
+	timelineNeeded, timelineEvents, err := d.OutputEvents.SelectStateInRange(
+		ctx, txn, types.Range{From: timelineStart, To: r.High()}, roomID, stateFilter,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range timeline {
+		delete(timelineNeeded[roomID], ev.EventID())
+	}
+
+	gapState, err := d.fetchStateEvents(ctx, txn, gapNeeded, gapEvents)
+	if err != nil {
+		return nil, err
+	}
+	timelineState, err := d.fetchStateEvents(ctx, txn, timelineNeeded, timelineEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// Changes made in the timeline's range replace those made in the gap.
+	var stateEvents []types.StreamEvent
+	indexes := make(map[gomatrixserverlib.StateKeyTuple]int)
+	for _, ev := range append(gapState[roomID], timelineState[roomID]...) {
+		if ev.StateKey() == nil {
+			continue
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}
+		if i, ok := indexes[tuple]; ok {
+			stateEvents[i] = ev
+			continue
+		}
+		indexes[tuple] = len(stateEvents)
+		stateEvents = append(stateEvents, ev)
+	}
+	return d.StreamEventsToEvents(device, stateEvents), nil
+}
+
 // fetchStateEvents converts the set of event IDs into a set of events. It will fetch any which are missing from the database.
 // Returns a map of room ID to list of events.
 func (d *Database) fetchStateEvents(
@@ -1182,7 +1431,7 @@ func (d *Database) getStateDeltas(
 	var deltas []stateDelta
 
 	// get all the state events ever (i.e. for all available rooms) between these two positions
-	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, stateFilter)
+	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, "", stateFilter)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1214,10 +1463,14 @@ func (d *Database) getStateDeltas(
 				membership:  gomatrixserverlib.Peek,
 				stateEvents: d.StreamEventsToEvents(device, state[peek.RoomID]),
 				roomID:      peek.RoomID,
+				fullState:   peek.New,
 			})
 		}
 	}
 
+	// rooms which the user newly joined, for which we send the full state
+	newlyJoined := make(map[string]bool)
+
 	// handle newly joined rooms and non-joined rooms
 	for roomID, stateStreamEvents := range state {
 		for _, ev := range stateStreamEvents {
@@ -1235,6 +1488,7 @@ func (d *Database) getStateDeltas(
 						return nil, nil, err
 					}
 					state[roomID] = s
+					newlyJoined[roomID] = true
 					continue // we'll add this room in when we do joined rooms
 				}
 
@@ -1259,6 +1513,7 @@ func (d *Database) getStateDeltas(
 			membership:  gomatrixserverlib.Join,
 			stateEvents: d.StreamEventsToEvents(device, state[joinedRoomID]),
 			roomID:      joinedRoomID,
+			fullState:   newlyJoined[joinedRoomID],
 		})
 	}
 
@@ -1294,12 +1549,13 @@ func (d *Database) getStateDeltasForFullStateSync(
 				membership:  gomatrixserverlib.Peek,
 				stateEvents: d.StreamEventsToEvents(device, s),
 				roomID:      peek.RoomID,
+				fullState:   true,
 			}
 		}
 	}
 
 	// Get all the state events ever between these two positions
-	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, stateFilter)
+	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, "", stateFilter)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1340,6 +1596,7 @@ func (d *Database) getStateDeltasForFullStateSync(
 			membership:  gomatrixserverlib.Join,
 			stateEvents: d.StreamEventsToEvents(device, s),
 			roomID:      joinedRoomID,
+			fullState:   true,
 		}
 	}
 
@@ -1358,7 +1615,10 @@ func (d *Database) currentStateStreamEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	stateFilter *gomatrixserverlib.StateFilter,
 ) ([]types.StreamEvent, error) {
-	allState, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
+	if !roomIncluded(stateFilter.Rooms, stateFilter.NotRooms, roomID) {
+		return nil, nil
+	}
+	allState, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, withoutLazyLoadedMembers(stateFilter))
 	if err != nil {
 		return nil, err
 	}
@@ -1370,9 +1630,9 @@ func (d *Database) currentStateStreamEventsForRoom(
 }
 
 func (d *Database) SendToDeviceUpdatesWaiting(
-	ctx context.Context, userID, deviceID string,
+	ctx context.Context, userID, deviceID string, from types.StreamPosition,
 ) (bool, error) {
-	count, err := d.SendToDevice.CountSendToDeviceMessages(ctx, nil, userID, deviceID)
+	count, err := d.SendToDevice.CountSendToDeviceMessages(ctx, nil, userID, deviceID, from)
 	if err != nil {
 		return false, err
 	}
@@ -1380,94 +1640,319 @@ func (d *Database) SendToDeviceUpdatesWaiting(
 }
 
 func (d *Database) StoreNewSendForDeviceMessage(
-	ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent,
+	ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent, maxQueued int,
 ) (newPos types.StreamPosition, err error) {
 	j, err := json.Marshal(event)
 	if err != nil {
 		return 0, err
 	}
+	var evicted int64
 	// Delegate the database write task to the SendToDeviceWriter. It'll guarantee
 	// that we don't lock the table for writes in more than one place.
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		newPos, err = d.SendToDevice.InsertSendToDeviceMessage(
 			ctx, txn, userID, deviceID, string(j),
 		)
+		if err != nil {
+			return err
+		}
+		// If the device has more messages queued up than we are willing to keep
+		// then drop the oldest ones, as they are the least likely to be useful.
+		if maxQueued > 0 {
+			evicted, err = d.SendToDevice.DeleteOldestSendToDeviceMessages(ctx, txn, userID, deviceID, maxQueued)
+		}
 		return err
 	})
 	if err != nil {
 		return 0, err
 	}
-	return 0, nil
+	sendToDeviceMessages.WithLabelValues("queued").Inc()
+	if evicted > 0 {
+		sendToDeviceMessages.WithLabelValues("evicted").Add(float64(evicted))
+		log.WithFields(log.Fields{
+			"user_id":   userID,
+			"device_id": deviceID,
+			"evicted":   evicted,
+		}).Warn("Send-to-device queue for device is full, dropped oldest messages")
+	}
+	return newPos, nil
 }
 
 func (d *Database) SendToDeviceUpdatesForSync(
 	ctx context.Context,
 	userID, deviceID string,
-	token types.StreamingToken,
-) (types.StreamPosition, []types.SendToDeviceEvent, []types.SendToDeviceNID, []types.SendToDeviceNID, error) {
-	// First of all, get our send-to-device updates for this user.
-	lastPos, events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID)
-	if err != nil {
-		return 0, nil, nil, nil, fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
+	since types.StreamingToken,
+	limit int,
+) (types.StreamPosition, []types.SendToDeviceEvent, error) {
+	// The client has successfully received everything up to the send-to-device
+	// position in their since token, otherwise they wouldn't have it, so any
+	// messages up to that point can be deleted.
+	if since.SendToDevicePosition > 0 {
+		var acknowledged int64
+		err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) (err error) {
+			acknowledged, err = d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, since.SendToDevicePosition)
+			return err
+		})
+		if err != nil {
+			return 0, nil, fmt.Errorf("d.SendToDevice.DeleteSendToDeviceMessages: %w", err)
+		}
+		if acknowledged > 0 {
+			sendToDeviceMessages.WithLabelValues("acknowledged").Add(float64(acknowledged))
+		}
 	}
 
-	// If there's nothing to do then stop here.
+	// Then get any send-to-device updates that are still waiting for this device.
+	lastPos, events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID, since.SendToDevicePosition, limit)
+	if err != nil {
+		return 0, nil, fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
+	}
 	if len(events) == 0 {
-		return 0, nil, nil, nil, nil
+		return since.SendToDevicePosition, nil, nil
 	}
+	return lastPos, events, nil
+}
 
-	// Work out whether we need to update any of the database entries.
-	toReturn := []types.SendToDeviceEvent{}
-	toUpdate := []types.SendToDeviceNID{}
-	toDelete := []types.SendToDeviceNID{}
-	for _, event := range events {
-		if event.SentByToken == nil {
-			// If the event has no sent-by token yet then we haven't attempted to send
-			// it. Record the current requested sync token in the database.
-			toUpdate = append(toUpdate, event.ID)
-			toReturn = append(toReturn, event)
-			event.SentByToken = &token
-		} else if token.IsAfter(*event.SentByToken) {
-			// The event had a sync token, therefore we've sent it before. The current
-			// sync token is now after the stored one so we can assume that the client
-			// successfully completed the previous sync (it would re-request it otherwise)
-			// so we can remove the entry from the database.
-			toDelete = append(toDelete, event.ID)
-		} else {
-			// It looks like the sync is being re-requested, maybe it timed out or
-			// failed. Re-send any that should have been acknowledged by now.
-			toReturn = append(toReturn, event)
+func (d *Database) SendToDeviceQueue(
+	ctx context.Context, userID, deviceID string, limit int,
+) (int, []types.SendToDeviceEvent, error) {
+	count, err := d.SendToDevice.CountSendToDeviceMessages(ctx, nil, userID, deviceID, 0)
+	if err != nil {
+		return 0, nil, fmt.Errorf("d.SendToDevice.CountSendToDeviceMessages: %w", err)
+	}
+	_, events, err := d.SendToDevice.SelectSendToDeviceMessages(ctx, nil, userID, deviceID, 0, limit)
+	if err != nil {
+		return 0, nil, fmt.Errorf("d.SendToDevice.SelectSendToDeviceMessages: %w", err)
+	}
+	return count, events, nil
+}
+
+func (d *Database) FlushSendToDeviceQueue(
+	ctx context.Context, userID, deviceID string,
+) (flushed int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		flushed, err = d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, math.MaxInt64)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("d.SendToDevice.DeleteSendToDeviceMessages: %w", err)
+	}
+	if flushed > 0 {
+		sendToDeviceMessages.WithLabelValues("flushed").Add(float64(flushed))
+	}
+	return flushed, nil
+}
+
+// lazyLoadedMember is a membership event that was sent to a device which
+// is lazy-loading members.
+type lazyLoadedMember struct {
+	roomID  string
+	userID  string
+	eventID string
+}
+
+// withoutLazyLoadedMembers returns a copy of the state filter which excludes
+// membership events if the filter lazy-loads members, since they will be
+// added back in for the relevant senders by lazyLoadMembers.
+func withoutLazyLoadedMembers(stateFilter *gomatrixserverlib.StateFilter) *gomatrixserverlib.StateFilter {
+	if !stateFilter.LazyLoadMembers {
+		return stateFilter
+	}
+	f := *stateFilter
+	f.NotTypes = append(append([]string{}, stateFilter.NotTypes...), gomatrixserverlib.MRoomMember)
+	return &f
+}
+
+// roomIncluded returns whether the room passes the rooms and not_rooms
+// lists of a filter. A nil rooms list allows every room, whereas an empty
+// one allows none.
+func roomIncluded(rooms, notRooms []string, roomID string) bool {
+	for _, notRoomID := range notRooms {
+		if notRoomID == roomID {
+			return false
+		}
+	}
+	if rooms == nil {
+		return true
+	}
+	for _, includedRoomID := range rooms {
+		if includedRoomID == roomID {
+			return true
 		}
 	}
+	return false
+}
 
-	return lastPos, toReturn, toUpdate, toDelete, nil
+// filterRoomIDs returns the room IDs which are allowed by the room filter.
+func filterRoomIDs(roomFilter *gomatrixserverlib.RoomFilter, roomIDs []string) []string {
+	if roomFilter.Rooms == nil && len(roomFilter.NotRooms) == 0 {
+		return roomIDs
+	}
+	filtered := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if roomIncluded(roomFilter.Rooms, roomFilter.NotRooms, roomID) {
+			filtered = append(filtered, roomID)
+		}
+	}
+	return filtered
 }
 
-func (d *Database) CleanSendToDeviceUpdates(
-	ctx context.Context,
-	toUpdate, toDelete []types.SendToDeviceNID,
-	token types.StreamingToken,
-) (err error) {
-	if len(toUpdate) == 0 && len(toDelete) == 0 {
+// filterStateEvents applies the state filter to state which came from
+// SelectStateInRange. Everything except membership events will already
+// have been filtered by the database, but membership events are always
+// returned so that we can tell when the user joins or leaves a room.
+func filterStateEvents(
+	stateFilter *gomatrixserverlib.StateFilter, roomID string,
+	stateEvents []*gomatrixserverlib.HeaderedEvent,
+) []*gomatrixserverlib.HeaderedEvent {
+	if !roomIncluded(stateFilter.Rooms, stateFilter.NotRooms, roomID) {
 		return nil
 	}
-	// If we need to write to the database then we'll ask the SendToDeviceWriter to
-	// do that for us. It'll guarantee that we don't lock the table for writes in
-	// more than one place.
-	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		// Delete any send-to-device messages marked for deletion.
-		if e := d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, toDelete); e != nil {
-			return fmt.Errorf("d.SendToDevice.DeleteSendToDeviceMessages: %w", e)
+	filtered := stateEvents[:0]
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || memberEventAllowed(stateFilter, ev) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
+// memberEventAllowed returns whether the membership event matches the
+// sender, type and contains_url parts of the state filter.
+func memberEventAllowed(stateFilter *gomatrixserverlib.StateFilter, ev *gomatrixserverlib.HeaderedEvent) bool {
+	if stateFilter.Senders != nil && !stringInSlice(ev.Sender(), stateFilter.Senders) {
+		return false
+	}
+	if stringInSlice(ev.Sender(), stateFilter.NotSenders) {
+		return false
+	}
+	if stateFilter.Types != nil && !typeMatchesAny(ev.Type(), stateFilter.Types) {
+		return false
+	}
+	if typeMatchesAny(ev.Type(), stateFilter.NotTypes) {
+		return false
+	}
+	if stateFilter.ContainsURL != nil {
+		if gjson.GetBytes(ev.Content(), "url").Exists() != *stateFilter.ContainsURL {
+			return false
+		}
+	}
+	return true
+}
+
+// typeMatchesAny returns whether the event type matches any of the given
+// filter types, which may contain '*' wildcards.
+func typeMatchesAny(eventType string, filterTypes []string) bool {
+	for _, filterType := range filterTypes {
+		if matched, err := path.Match(filterType, eventType); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lazyLoadMembers removes the membership events from the state of a room
+// for everyone except the senders of the timeline events, fetching any of
+// the senders' membership events which are missing from the state. Unless
+// the filter asks for redundant members, membership events which have
+// already been sent to the device are left out. Returns the new state and
+// the membership events which the device will now know about.
+func (d *Database) lazyLoadMembers(
+	ctx context.Context, txn *sql.Tx, device *userapi.Device, roomID string,
+	stateFilter *gomatrixserverlib.StateFilter,
+	timelineEvents, stateEvents []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, []lazyLoadedMember, error) {
+	var senders []string
+	isSender := make(map[string]bool)
+	covered := make(map[string]bool)
+	var sent []lazyLoadedMember
+	for _, ev := range timelineEvents {
+		if !isSender[ev.Sender()] {
+			isSender[ev.Sender()] = true
+			senders = append(senders, ev.Sender())
+		}
+		// Membership events in the timeline are sent regardless.
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			covered[*ev.StateKey()] = true
+			sent = append(sent, lazyLoadedMember{roomID, *ev.StateKey(), ev.EventID()})
+		}
+	}
+
+	alreadySent := map[string]string{}
+	if !stateFilter.IncludeRedundantMembers {
+		var err error
+		alreadySent, err = d.LazyLoadedMembers.SelectLazyLoadedMembers(ctx, txn, device.UserID, device.ID, roomID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("d.LazyLoadedMembers.SelectLazyLoadedMembers: %w", err)
 		}
+	}
 
-		// Now update any outstanding send-to-device messages with the new sync token.
-		if e := d.SendToDevice.UpdateSentSendToDeviceMessages(ctx, txn, token.String(), toUpdate); e != nil {
-			return fmt.Errorf("d.SendToDevice.UpdateSentSendToDeviceMessages: %w", err)
+	state := make([]*gomatrixserverlib.HeaderedEvent, 0, len(stateEvents))
+	addMember := func(ev *gomatrixserverlib.HeaderedEvent) {
+		userID := *ev.StateKey()
+		covered[userID] = true
+		if alreadySent[userID] == ev.EventID() {
+			return
+		}
+		state = append(state, ev)
+		sent = append(sent, lazyLoadedMember{roomID, userID, ev.EventID()})
+	}
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			state = append(state, ev)
+			continue
+		}
+		if isSender[*ev.StateKey()] && !covered[*ev.StateKey()] {
+			addMember(ev)
+		}
+	}
+	for _, sender := range senders {
+		if covered[sender] {
+			continue
+		}
+		ev, err := d.CurrentRoomState.SelectStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, sender)
+		if err != nil {
+			return nil, nil, fmt.Errorf("d.CurrentRoomState.SelectStateEvent: %w", err)
+		}
+		if ev != nil {
+			addMember(ev)
 		}
+	}
+	return state, sent, nil
+}
 
+// storeLazyLoadedMembers remembers the membership events that have been
+// sent to the device, so that they aren't sent again. If reset is true then
+// any membership events that were sent before are forgotten first.
+func (d *Database) storeLazyLoadedMembers(
+	ctx context.Context, device userapi.Device, reset bool, sent []lazyLoadedMember,
+) error {
+	if !reset && len(sent) == 0 {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if reset {
+			if err := d.LazyLoadedMembers.DeleteLazyLoadedMembers(ctx, txn, device.UserID, device.ID); err != nil {
+				return err
+			}
+		}
+		for _, member := range sent {
+			if err := d.LazyLoadedMembers.UpsertLazyLoadedMember(
+				ctx, txn, device.UserID, device.ID, member.roomID, member.userID, member.eventID,
+			); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
-	return
 }
 
 // There may be some overlap where events in stateEvents are already in recentEvents, so filter
@@ -1515,13 +2000,26 @@ type stateDelta struct {
 	// The PDU stream position of the latest membership event for this user, if applicable.
 	// Can be 0 if there is no membership event in this delta.
 	membershipPos types.StreamPosition
+	// True if stateEvents is the full current state of the room rather than
+	// the changes since the position the client already has.
+	fullState bool
 }
 
 // StoreReceipt stores user receipts
 func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, timestamp)
-		return err
+		if err != nil || receiptType != "m.read" {
+			return err
+		}
+		_, eventPos, posErr := d.Topology.SelectPositionInTopology(ctx, txn, eventId)
+		if posErr == sql.ErrNoRows {
+			// We don't have the event, so there's nothing to clear up to.
+			return nil
+		} else if posErr != nil {
+			return fmt.Errorf("d.Topology.SelectPositionInTopology: %w", posErr)
+		}
+		return d.Notifications.DeleteNotificationsUpTo(ctx, txn, userId, roomId, eventPos)
 	})
 	return
 }
@@ -1530,3 +2028,25 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	_, receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 	return receipts, err
 }
+
+func (d *Database) StoreNotification(
+	ctx context.Context, userID, roomID, eventID string, pos types.StreamPosition, highlight bool,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Notifications.InsertNotification(ctx, txn, userID, roomID, eventID, pos, highlight)
+	})
+}
+
+func (d *Database) ClearNotifications(
+	ctx context.Context, userID, roomID string, pos types.StreamPosition,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Notifications.DeleteNotificationsUpTo(ctx, txn, userID, roomID, pos)
+	})
+}
+
+func (d *Database) NotificationCounts(
+	ctx context.Context, userID, roomID string,
+) (notificationCount, highlightCount int, err error) {
+	return d.Notifications.SelectNotificationCounts(ctx, nil, userID, roomID)
+}
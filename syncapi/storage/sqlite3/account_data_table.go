@@ -18,6 +18,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -32,17 +33,18 @@ CREATE TABLE IF NOT EXISTS syncapi_account_data_type (
     user_id TEXT NOT NULL,
     room_id TEXT NOT NULL,
     type TEXT NOT NULL,
+    content TEXT,
     UNIQUE (user_id, room_id, type)
 );
 `
 
 const insertAccountDataSQL = "" +
-	"INSERT INTO syncapi_account_data_type (id, user_id, room_id, type) VALUES ($1, $2, $3, $4)" +
+	"INSERT INTO syncapi_account_data_type (id, user_id, room_id, type, content) VALUES ($1, $2, $3, $4, $5)" +
 	" ON CONFLICT (user_id, room_id, type) DO UPDATE" +
-	" SET id = EXCLUDED.id"
+	" SET id = EXCLUDED.id, content = EXCLUDED.content"
 
 const selectAccountDataInRangeSQL = "" +
-	"SELECT room_id, type FROM syncapi_account_data_type" +
+	"SELECT room_id, type, content FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
 	" ORDER BY id ASC"
 
@@ -80,13 +82,13 @@ func NewSqliteAccountDataTable(db *sql.DB, streamID *streamIDStatements) (tables
 
 func (s *accountDataStatements) InsertAccountData(
 	ctx context.Context, txn *sql.Tx,
-	userID, roomID, dataType string,
+	userID, roomID, dataType string, content json.RawMessage,
 ) (pos types.StreamPosition, err error) {
 	pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
 	if err != nil {
 		return
 	}
-	_, err = sqlutil.TxStmt(txn, s.insertAccountDataStmt).ExecContext(ctx, pos, userID, roomID, dataType)
+	_, err = sqlutil.TxStmt(txn, s.insertAccountDataStmt).ExecContext(ctx, pos, userID, roomID, dataType, accountDataContent(content))
 	return
 }
 
@@ -95,8 +97,8 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	accountDataFilterPart *gomatrixserverlib.EventFilter,
-) (data map[string][]string, err error) {
-	data = make(map[string][]string)
+) (data map[string]map[string]json.RawMessage, err error) {
+	data = make(map[string]map[string]json.RawMessage)
 
 	rows, err := s.selectAccountDataInRangeStmt.QueryContext(ctx, userID, r.Low(), r.High())
 	if err != nil {
@@ -109,8 +111,9 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	for rows.Next() {
 		var dataType string
 		var roomID string
+		var content sql.NullString
 
-		if err = rows.Scan(&roomID, &dataType); err != nil {
+		if err = rows.Scan(&roomID, &dataType, &content); err != nil {
 			return
 		}
 
@@ -130,10 +133,12 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 			}
 		}
 
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
-		} else {
-			data[roomID] = []string{dataType}
+		if data[roomID] == nil {
+			data[roomID] = make(map[string]json.RawMessage)
+		}
+		data[roomID][dataType] = nil
+		if content.Valid {
+			data[roomID][dataType] = json.RawMessage(content.String)
 		}
 		entries++
 		if entries >= accountDataFilterPart.Limit {
@@ -154,3 +159,9 @@ func (s *accountDataStatements) SelectMaxAccountDataID(
 	}
 	return
 }
+
+// accountDataContent returns the content to store, which is NULL if the client
+// API didn't send it.
+func accountDataContent(content json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(content), Valid: len(content) > 0}
+}
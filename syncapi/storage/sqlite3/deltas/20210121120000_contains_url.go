@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+	"github.com/tidwall/gjson"
+)
+
+const containsURLBatchSize = 1000
+
+func LoadFromGooseContainsURL() {
+	goose.AddMigration(UpContainsURL, DownContainsURL)
+}
+
+func LoadContainsURL(m *sqlutil.Migrations) {
+	m.AddMigration(UpContainsURL, DownContainsURL)
+}
+
+// UpContainsURL sets contains_url on existing events. It was previously
+// never set because the check for a "url" key in the content was inverted,
+// so any event with a URL will have been stored with contains_url = FALSE.
+// SQLite may not have the JSON functions available, so the events are
+// checked here instead.
+func UpContainsURL(tx *sql.Tx) error {
+	if err := updateContainsURL(
+		tx, "syncapi_output_room_events", "id",
+	); err != nil {
+		return err
+	}
+	return updateContainsURL(
+		tx, "syncapi_current_room_state", "rowid",
+	)
+}
+
+// updateContainsURL works through the table in batches, as we can't update
+// while the rows are still being read.
+func updateContainsURL(tx *sql.Tx, table, idColumn string) error {
+	selectSQL := fmt.Sprintf(
+		"SELECT %s, headered_event_json FROM %s WHERE %s > $1 ORDER BY %s ASC LIMIT $2",
+		idColumn, table, idColumn, idColumn,
+	)
+	updateSQL := fmt.Sprintf(
+		"UPDATE %s SET contains_url = TRUE WHERE %s = $1", table, idColumn,
+	)
+	var after int64
+	for {
+		rows, err := tx.Query(selectSQL, after, containsURLBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to select events: %w", err)
+		}
+		var ids []int64
+		scanned := 0
+		for rows.Next() {
+			scanned++
+			var eventJSON []byte
+			if err = rows.Scan(&after, &eventJSON); err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("failed to scan event: %w", err)
+			}
+			if gjson.GetBytes(eventJSON, "content.url").Exists() {
+				ids = append(ids, after)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to select events: %w", err)
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, err = tx.Exec(updateSQL, id); err != nil {
+				return fmt.Errorf("failed to update %s: %w", table, err)
+			}
+		}
+		if scanned < containsURLBatchSize {
+			return nil
+		}
+	}
+}
+
+func DownContainsURL(tx *sql.Tx) error {
+	// There's nothing to undo, since the column is still correct for the
+	// old version.
+	return nil
+}
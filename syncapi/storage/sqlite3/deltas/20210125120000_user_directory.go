@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+	"github.com/tidwall/gjson"
+)
+
+const userDirectoryBatchSize = 1000
+
+func LoadFromGooseUserDirectory() {
+	goose.AddMigration(UpUserDirectory, DownUserDirectory)
+}
+
+func LoadUserDirectory(m *sqlutil.Migrations) {
+	m.AddMigration(UpUserDirectory, DownUserDirectory)
+}
+
+// UpUserDirectory adds the joined members of the rooms that we already know
+// about to the user directory, which will have been created empty. SQLite may
+// not have the JSON functions available, so the profiles are read from the
+// events here instead.
+func UpUserDirectory(tx *sql.Tx) error {
+	type member struct {
+		userID, roomID, eventID string
+		displayName, avatarURL  string
+	}
+	// Work through the members in batches, as we can't insert while the rows
+	// are still being read.
+	var after int64
+	for {
+		rows, err := tx.Query(
+			"SELECT rowid, state_key, room_id, event_id, headered_event_json FROM syncapi_current_room_state"+
+				" WHERE rowid > $1 AND type = 'm.room.member' AND membership = 'join' ORDER BY rowid ASC LIMIT $2",
+			after, userDirectoryBatchSize,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to select members: %w", err)
+		}
+		var members []member
+		for rows.Next() {
+			var m member
+			var eventJSON []byte
+			if err = rows.Scan(&after, &m.userID, &m.roomID, &m.eventID, &eventJSON); err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("failed to scan member: %w", err)
+			}
+			m.displayName = gjson.GetBytes(eventJSON, "content.displayname").Str
+			m.avatarURL = gjson.GetBytes(eventJSON, "content.avatar_url").Str
+			members = append(members, m)
+		}
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to select members: %w", err)
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+		for _, m := range members {
+			if _, err = tx.Exec(
+				"INSERT OR IGNORE INTO syncapi_user_directory (user_id, room_id, event_id, display_name, avatar_url)"+
+					" VALUES ($1, $2, $3, $4, $5)",
+				m.userID, m.roomID, m.eventID, m.displayName, m.avatarURL,
+			); err != nil {
+				return fmt.Errorf("failed to add %q to the user directory: %w", m.userID, err)
+			}
+		}
+		if len(members) < userDirectoryBatchSize {
+			return nil
+		}
+	}
+}
+
+func DownUserDirectory(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM syncapi_user_directory;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAccountDataContent(m *sqlutil.Migrations) {
+	m.AddMigration(UpAccountDataContent, DownAccountDataContent)
+}
+
+// UpAccountDataContent adds the content of account data, which the client API
+// now sends along with updates so that it doesn't need to be requested from
+// the user API. It's NULL for existing account data. The table is created
+// after the deltas have run, so there's nothing to do if it doesn't exist yet.
+func UpAccountDataContent(tx *sql.Tx) error {
+	var columns, contentColumns int
+	err := tx.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(name = 'content'), 0) FROM pragma_table_info('syncapi_account_data_type');`,
+	).Scan(&columns, &contentColumns)
+	if err != nil {
+		return fmt.Errorf("failed to query columns: %w", err)
+	}
+	if columns > 0 && contentColumns == 0 {
+		if _, err = tx.Exec(`ALTER TABLE syncapi_account_data_type ADD COLUMN content TEXT;`); err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	return nil
+}
+
+// DownAccountDataContent does nothing, as SQLite can't drop columns without
+// rebuilding the table. The column is ignored by older versions.
+func DownAccountDataContent(tx *sql.Tx) error {
+	return nil
+}
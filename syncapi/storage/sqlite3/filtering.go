@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// filterConditions returns the SQL conditions needed to apply the given
+// filter fields to a query, along with the parameters to go with them. The
+// parameters are numbered starting after the given offset, which should be
+// the number of parameters that the query already has. SQLite has no array
+// type, so unlike Postgres we can't use the same prepared statement for
+// every filter and instead have to build the query as we go.
+//
+// The fields are passed separately rather than as a filter struct because
+// they might come from a StateFilter or a RoomEventFilter.
+func filterConditions(
+	offset int, senders, notSenders, types, notTypes []string, containsURL *bool,
+) ([]string, []interface{}) {
+	var conditions []string
+	var params []interface{}
+	if len(senders) > 0 {
+		conditions = append(conditions, "sender IN "+sqlutil.QueryVariadicOffset(len(senders), offset+len(params)))
+		for _, sender := range senders {
+			params = append(params, sender)
+		}
+	}
+	if len(notSenders) > 0 {
+		conditions = append(conditions, "sender NOT IN "+sqlutil.QueryVariadicOffset(len(notSenders), offset+len(params)))
+		for _, sender := range notSenders {
+			params = append(params, sender)
+		}
+	}
+	// The wildcards allowed in filters are the same as those used by GLOB,
+	// so the types don't need converting like they do for LIKE on Postgres.
+	// GLOB is also case sensitive, which LIKE isn't on SQLite.
+	if len(types) > 0 {
+		globs := make([]string, len(types))
+		for i, eventType := range types {
+			params = append(params, eventType)
+			globs[i] = fmt.Sprintf("type GLOB $%d", offset+len(params))
+		}
+		conditions = append(conditions, "("+strings.Join(globs, " OR ")+")")
+	}
+	if len(notTypes) > 0 {
+		globs := make([]string, len(notTypes))
+		for i, eventType := range notTypes {
+			params = append(params, eventType)
+			globs[i] = fmt.Sprintf("type GLOB $%d", offset+len(params))
+		}
+		conditions = append(conditions, "NOT ("+strings.Join(globs, " OR ")+")")
+	}
+	if containsURL != nil {
+		params = append(params, *containsURL)
+		conditions = append(conditions, fmt.Sprintf("contains_url = $%d", offset+len(params)))
+	}
+	return conditions, params
+}
+
+// queryFiltered runs a query built with filterConditions, inside the given
+// transaction if there is one.
+func queryFiltered(
+	ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params ...interface{},
+) (*sql.Rows, error) {
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return db.QueryContext(ctx, query, params...)
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationsSchema = `
+-- Stores the events which local users have been notified about by their push
+-- rules and haven't read yet, so that they can be counted in /sync.
+CREATE TABLE IF NOT EXISTS syncapi_notifications (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- The PDU stream position of the event.
+	stream_pos INTEGER NOT NULL,
+	-- Whether the event is highlighted for the user, e.g. it mentions them.
+	highlight BOOLEAN NOT NULL,
+	UNIQUE (user_id, event_id)
+);
+CREATE INDEX IF NOT EXISTS syncapi_notifications_user_room_idx ON syncapi_notifications(user_id, room_id, stream_pos);
+`
+
+const insertNotificationSQL = "" +
+	"INSERT INTO syncapi_notifications (user_id, room_id, event_id, stream_pos, highlight)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, event_id) DO NOTHING"
+
+const deleteNotificationsUpToSQL = "" +
+	"DELETE FROM syncapi_notifications WHERE user_id = $1 AND room_id = $2 AND stream_pos <= $3"
+
+const selectNotificationCountsSQL = "" +
+	"SELECT COUNT(*), COALESCE(SUM(highlight), 0) FROM syncapi_notifications" +
+	" WHERE user_id = $1 AND room_id = $2"
+
+type notificationsStatements struct {
+	insertNotificationStmt       *sql.Stmt
+	deleteNotificationsUpToStmt  *sql.Stmt
+	selectNotificationCountsStmt *sql.Stmt
+}
+
+func NewSqliteNotificationsTable(db *sql.DB) (tables.Notifications, error) {
+	s := &notificationsStatements{}
+	_, err := db.Exec(notificationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertNotificationStmt, err = db.Prepare(insertNotificationSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteNotificationsUpToStmt, err = db.Prepare(deleteNotificationsUpToSQL); err != nil {
+		return nil, err
+	}
+	if s.selectNotificationCountsStmt, err = db.Prepare(selectNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *notificationsStatements) InsertNotification(
+	ctx context.Context, txn *sql.Tx, userID, roomID, eventID string, pos types.StreamPosition, highlight bool,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertNotificationStmt).ExecContext(
+		ctx, userID, roomID, eventID, pos, highlight,
+	)
+	return err
+}
+
+func (s *notificationsStatements) DeleteNotificationsUpTo(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteNotificationsUpToStmt).ExecContext(ctx, userID, roomID, pos)
+	return err
+}
+
+func (s *notificationsStatements) SelectNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) (notificationCount, highlightCount int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectNotificationCountsStmt).QueryRowContext(ctx, userID, roomID).Scan(
+		&notificationCount, &highlightCount,
+	)
+	return
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -45,25 +46,39 @@ const insertEventInTopologySQL = "" +
 
 const selectEventIDsInRangeASCSQL = "" +
 	"SELECT event_id FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $2 AND stream_position > $3))" +
+	" AND (topological_position < $4 OR (topological_position = $4 AND stream_position <= $5))" +
+	" ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
 
 const selectEventIDsInRangeDESCSQL = "" +
-	"SELECT event_id  FROM syncapi_output_room_events_topology" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $2 AND stream_position > $3))" +
+	" AND (topological_position < $4 OR (topological_position = $4 AND stream_position <= $5))" +
+	" ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
+
+const selectEventIDsBeforeSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND (" +
+	"topological_position < $2 OR (topological_position = $2 AND stream_position < $3)" +
+	") ORDER BY topological_position DESC, stream_position DESC LIMIT $4"
+
+const selectEventIDsAfterSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
 	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
+	"topological_position > $2 OR (topological_position = $2 AND stream_position > $3)" +
+	") ORDER BY topological_position ASC, stream_position ASC LIMIT $4"
 
 const selectPositionInTopologySQL = "" +
 	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
 	" WHERE event_id = $1"
 
+// The highest position is the event with the highest depth, and if there are
+// multiple then the one with the highest stream position.
 const selectMaxPositionInTopologySQL = "" +
-	"SELECT MAX(topological_position), stream_position FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 ORDER BY stream_position DESC"
+	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 ORDER BY topological_position DESC, stream_position DESC LIMIT 1"
 
 const deleteTopologyForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
@@ -73,6 +88,8 @@ type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt       *sql.Stmt
 	selectEventIDsInRangeASCStmt    *sql.Stmt
 	selectEventIDsInRangeDESCStmt   *sql.Stmt
+	selectEventIDsBeforeStmt        *sql.Stmt
+	selectEventIDsAfterStmt         *sql.Stmt
 	selectPositionInTopologyStmt    *sql.Stmt
 	selectMaxPositionInTopologyStmt *sql.Stmt
 	deleteTopologyForRoomStmt       *sql.Stmt
@@ -95,6 +112,12 @@ func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.selectEventIDsInRangeDESCStmt, err = db.Prepare(selectEventIDsInRangeDESCSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventIDsBeforeStmt, err = db.Prepare(selectEventIDsBeforeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectEventIDsAfterStmt, err = db.Prepare(selectEventIDsAfterSQL); err != nil {
+		return nil, err
+	}
 	if s.selectPositionInTopologyStmt, err = db.Prepare(selectPositionInTopologySQL); err != nil {
 		return nil, err
 	}
@@ -121,7 +144,7 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 
 func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	ctx context.Context, txn *sql.Tx, roomID string,
-	minDepth, maxDepth, maxStreamPos types.StreamPosition,
+	minDepth, minStreamPos, maxDepth, maxStreamPos types.StreamPosition,
 	limit int, chronologicalOrder bool,
 ) (eventIDs []string, err error) {
 	// Decide on the selection's order according to whether chronological order
@@ -134,7 +157,7 @@ func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	}
 
 	// Query the event IDs.
-	rows, err := stmt.QueryContext(ctx, roomID, minDepth, maxDepth, maxDepth, maxStreamPos, limit)
+	rows, err := stmt.QueryContext(ctx, roomID, minDepth, minStreamPos, maxDepth, maxStreamPos, limit)
 	if err == sql.ErrNoRows {
 		// If no event matched the request, return an empty slice.
 		return []string{}, nil
@@ -154,6 +177,32 @@ func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	return
 }
 
+// SelectEventIDsAround selects the IDs of up to limit events either before or after
+// the given position in a given room's topological order. The events before are
+// returned newest first and the events after are returned oldest first.
+func (s *outputRoomEventsTopologyStatements) SelectEventIDsAround(
+	ctx context.Context, txn *sql.Tx, roomID string, depth, streamPos types.StreamPosition,
+	limit int, after bool,
+) (eventIDs []string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventIDsBeforeStmt)
+	if after {
+		stmt = sqlutil.TxStmt(txn, s.selectEventIDsAfterStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, roomID, depth, streamPos, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventIDsAround: rows.close() failed")
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
 // selectPositionInTopology returns the position of a given event in the
 // topology of the room it belongs to.
 func (s *outputRoomEventsTopologyStatements) SelectPositionInTopology(
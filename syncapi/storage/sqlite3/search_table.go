@@ -0,0 +1,268 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// The searchable text of room events is stored in a full-text table, whose
+// rowid is the stream position of the event, with the rest of the details
+// of the event stored alongside it in an ordinary table.
+const searchSchema = `
+-- Stores the details of room events which are in the full-text index.
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	-- The position of the event in syncapi_output_room_events, which is
+	-- also the rowid of the event in syncapi_search_fts.
+	stream_pos INTEGER PRIMARY KEY,
+	event_id TEXT NOT NULL UNIQUE,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	-- The search key that the text came from, e.g. 'content.body'.
+	key TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id_idx ON syncapi_search_events(room_id, stream_pos);
+`
+
+// FTS5 is only available if go-sqlite3 was built with the sqlite_fts5 tag,
+// so we fall back to FTS4, which is always available but can't rank results
+// as well.
+const searchFTS5Schema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_fts USING fts5(text, tokenize = 'porter unicode61');
+`
+
+const searchFTS4Schema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_fts USING fts4(text, tokenize=porter);
+`
+
+const selectSearchModuleSQL = "" +
+	"SELECT sql FROM sqlite_master WHERE name = 'syncapi_search_fts'"
+
+const insertSearchEventSQL = "" +
+	"INSERT OR IGNORE INTO syncapi_search_events (stream_pos, event_id, room_id, sender, key)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const insertSearchTextSQL = "" +
+	"INSERT INTO syncapi_search_fts (rowid, text) VALUES ($1, $2)"
+
+const deleteSearchTextSQL = "" +
+	"DELETE FROM syncapi_search_fts WHERE rowid IN (" +
+	"SELECT stream_pos FROM syncapi_search_events WHERE event_id = $1" +
+	")"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+// The rank of each result. FTS5 has BM25 built in, for which lower is better.
+// FTS4 doesn't, so instead we use the number of times that the words appear,
+// which is the number of space-separated values returned by offsets() over 4.
+const (
+	searchRankFTS5 = "-bm25(syncapi_search_fts)"
+	searchRankFTS4 = "" +
+		"(length(offsets(syncapi_search_fts)) - length(replace(offsets(syncapi_search_fts), ' ', '')) + 1) / 4.0"
+)
+
+type searchStatements struct {
+	db                    *sql.DB
+	rank                  string
+	insertSearchEventStmt *sql.Stmt
+	insertSearchTextStmt  *sql.Stmt
+	deleteSearchTextStmt  *sql.Stmt
+	deleteSearchEventStmt *sql.Stmt
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(searchFTS5Schema); err != nil {
+		if !strings.Contains(err.Error(), "no such module") {
+			return nil, err
+		}
+		logrus.Warn("SQLite doesn't support FTS5, so search results won't be ranked as well. Build with the sqlite_fts5 tag to enable it.")
+		if _, err = db.Exec(searchFTS4Schema); err != nil {
+			return nil, err
+		}
+	}
+	// The full-text table may have been created by a previous build which
+	// had FTS5 support, or not, so check which module it really uses.
+	var module string
+	if err = db.QueryRow(selectSearchModuleSQL).Scan(&module); err != nil {
+		return nil, err
+	}
+	s := &searchStatements{
+		db:   db,
+		rank: searchRankFTS4,
+	}
+	if strings.Contains(strings.ToLower(module), "fts5") {
+		s.rank = searchRankFTS5
+	}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchEvent statement: %w", err)
+	}
+	if s.insertSearchTextStmt, err = db.Prepare(insertSearchTextSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchText statement: %w", err)
+	}
+	if s.deleteSearchTextStmt, err = db.Prepare(deleteSearchTextSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchText statement: %w", err)
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEvent statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, pos types.StreamPosition,
+	event *gomatrixserverlib.HeaderedEvent, key, text string,
+) error {
+	res, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(
+		ctx, pos, event.EventID(), event.RoomID(), event.Sender(), key,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 0 {
+		// The event is already in the index.
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertSearchTextStmt).ExecContext(ctx, pos, text)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteSearchTextStmt).ExecContext(ctx, eventID); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearch(
+	ctx context.Context, txn *sql.Tx, req *types.SearchRequest,
+) ([]types.SearchResult, error) {
+	match := searchMatchQuery(req.Term)
+	if match == "" {
+		return nil, nil
+	}
+	conditions, params := searchConditions(match, req)
+	query := "SELECT syncapi_search_events.event_id, syncapi_search_events.stream_pos, " + s.rank + " AS rank" + conditions
+	if req.OrderByRank {
+		query += fmt.Sprintf(" ORDER BY rank DESC, syncapi_search_events.stream_pos DESC LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
+		params = append(params, req.Limit, req.From)
+	} else {
+		before := req.From
+		if before <= 0 {
+			before = math.MaxInt64
+		}
+		query += fmt.Sprintf(" AND syncapi_search_events.stream_pos < $%d ORDER BY syncapi_search_events.stream_pos DESC LIMIT $%d", len(params)+1, len(params)+2)
+		params = append(params, before, req.Limit)
+	}
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, params...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, params...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query search: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearch: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.StreamPos, &result.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *searchStatements) SelectSearchCount(
+	ctx context.Context, txn *sql.Tx, req *types.SearchRequest,
+) (count int, err error) {
+	match := searchMatchQuery(req.Term)
+	if match == "" {
+		return 0, nil
+	}
+	conditions, params := searchConditions(match, req)
+	query := "SELECT COUNT(*)" + conditions
+	if txn != nil {
+		err = txn.QueryRowContext(ctx, query, params...).Scan(&count)
+	} else {
+		err = s.db.QueryRowContext(ctx, query, params...).Scan(&count)
+	}
+	return
+}
+
+// searchConditions returns the FROM and WHERE clauses of a search query,
+// along with the parameters for them.
+func searchConditions(match string, req *types.SearchRequest) (string, []interface{}) {
+	query := "" +
+		" FROM syncapi_search_fts JOIN syncapi_search_events" +
+		" ON syncapi_search_events.stream_pos = syncapi_search_fts.rowid" +
+		" WHERE syncapi_search_fts MATCH $1"
+	params := []interface{}{match}
+	in := func(column string, values []string, not bool) {
+		op := "IN"
+		if not {
+			op = "NOT IN"
+		}
+		query += fmt.Sprintf(" AND syncapi_search_events.%s %s %s", column, op, sqlutil.QueryVariadicOffset(len(values), len(params)))
+		for _, value := range values {
+			params = append(params, value)
+		}
+	}
+	in("room_id", req.RoomIDs, false)
+	in("key", req.Keys, false)
+	if req.Senders != nil {
+		in("sender", req.Senders, false)
+	}
+	if req.NotSenders != nil {
+		in("sender", req.NotSenders, true)
+	}
+	return query, params
+}
+
+// searchMatchQuery turns a search term into a full-text query which matches
+// text containing all of the words in it. Each word is quoted so that nothing
+// in the search term is treated as query syntax. Returns an empty string if
+// there are no words in the search term.
+func searchMatchQuery(term string) string {
+	words := strings.FieldsFunc(term, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i := range words {
+		words[i] = `"` + words[i] + `"`
+	}
+	return strings.Join(words, " ")
+}
@@ -18,7 +18,6 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"strings"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -37,11 +36,12 @@ CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
 	device_id TEXT NOT NULL,
 	-- The event content JSON.
 	content TEXT NOT NULL,
-	-- The token that was supplied to the /sync at the time that this
-	-- message was included in a sync response, or NULL if we haven't
-	-- included it in a /sync response yet.
+	-- No longer used: messages are now acknowledged by the send-to-device
+	-- position in the "since" parameter of the next /sync.
 	sent_by_token TEXT
 );
+
+CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device(user_id, device_id);
 `
 
 const insertSendToDeviceMessageSQL = `
@@ -52,30 +52,38 @@ const insertSendToDeviceMessageSQL = `
 const countSendToDeviceMessagesSQL = `
 	SELECT COUNT(*)
 	  FROM syncapi_send_to_device
-	  WHERE user_id = $1 AND device_id = $2
+	  WHERE user_id = $1 AND device_id = $2 AND id > $3
 `
 
 const selectSendToDeviceMessagesSQL = `
-	SELECT id, user_id, device_id, content, sent_by_token
+	SELECT id, user_id, device_id, content
 	  FROM syncapi_send_to_device
-	  WHERE user_id = $1 AND device_id = $2
-	  ORDER BY id DESC
+	  WHERE user_id = $1 AND device_id = $2 AND id > $3
+	  ORDER BY id ASC
+	  LIMIT $4
 `
 
-const updateSentSendToDeviceMessagesSQL = `
-	UPDATE syncapi_send_to_device SET sent_by_token = $1
-	  WHERE id IN ($2)
+const deleteSendToDeviceMessagesSQL = `
+	DELETE FROM syncapi_send_to_device
+	  WHERE user_id = $1 AND device_id = $2 AND id <= $3
 `
 
-const deleteSendToDeviceMessagesSQL = `
-	DELETE FROM syncapi_send_to_device WHERE id IN ($1)
+const deleteOldestSendToDeviceMessagesSQL = `
+	DELETE FROM syncapi_send_to_device WHERE id IN (
+	  SELECT id FROM syncapi_send_to_device
+	    WHERE user_id = $1 AND device_id = $2
+	    ORDER BY id DESC
+	    LIMIT -1 OFFSET $3
+	)
 `
 
 type sendToDeviceStatements struct {
-	db                             *sql.DB
-	insertSendToDeviceMessageStmt  *sql.Stmt
-	selectSendToDeviceMessagesStmt *sql.Stmt
-	countSendToDeviceMessagesStmt  *sql.Stmt
+	db                                   *sql.DB
+	insertSendToDeviceMessageStmt        *sql.Stmt
+	selectSendToDeviceMessagesStmt       *sql.Stmt
+	countSendToDeviceMessagesStmt        *sql.Stmt
+	deleteSendToDeviceMessagesStmt       *sql.Stmt
+	deleteOldestSendToDeviceMessagesStmt *sql.Stmt
 }
 
 func NewSqliteSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
@@ -95,6 +103,12 @@ func NewSqliteSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 	if s.selectSendToDeviceMessagesStmt, err = db.Prepare(selectSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteOldestSendToDeviceMessagesStmt, err = db.Prepare(deleteOldestSendToDeviceMessagesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -103,6 +117,9 @@ func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
 ) (pos types.StreamPosition, err error) {
 	var result sql.Result
 	result, err = sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).ExecContext(ctx, userID, deviceID, content)
+	if err != nil {
+		return 0, err
+	}
 	if p, err := result.LastInsertId(); err != nil {
 		return 0, err
 	} else {
@@ -112,9 +129,9 @@ func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
 }
 
 func (s *sendToDeviceStatements) CountSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition,
 ) (count int, err error) {
-	row := sqlutil.TxStmt(txn, s.countSendToDeviceMessagesStmt).QueryRowContext(ctx, userID, deviceID)
+	row := sqlutil.TxStmt(txn, s.countSendToDeviceMessagesStmt).QueryRowContext(ctx, userID, deviceID, from)
 	if err = row.Scan(&count); err != nil {
 		return
 	}
@@ -122,9 +139,9 @@ func (s *sendToDeviceStatements) CountSendToDeviceMessages(
 }
 
 func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition, limit int,
 ) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error) {
-	rows, err := sqlutil.TxStmt(txn, s.selectSendToDeviceMessagesStmt).QueryContext(ctx, userID, deviceID)
+	rows, err := sqlutil.TxStmt(txn, s.selectSendToDeviceMessagesStmt).QueryContext(ctx, userID, deviceID, from, limit)
 	if err != nil {
 		return
 	}
@@ -133,8 +150,7 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 	for rows.Next() {
 		var id types.SendToDeviceNID
 		var userID, deviceID, content string
-		var sentByToken *string
-		if err = rows.Scan(&id, &userID, &deviceID, &content, &sentByToken); err != nil {
+		if err = rows.Scan(&id, &userID, &deviceID, &content); err != nil {
 			return
 		}
 		event := types.SendToDeviceEvent{
@@ -145,11 +161,6 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 		if err = json.Unmarshal([]byte(content), &event.SendToDeviceEvent); err != nil {
 			return
 		}
-		if sentByToken != nil {
-			if token, err := types.NewStreamTokenFromString(*sentByToken); err == nil {
-				event.SentByToken = &token
-			}
-		}
 		events = append(events, event)
 		if types.StreamPosition(id) > lastPos {
 			lastPos = types.StreamPosition(id)
@@ -159,27 +170,22 @@ func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
 	return lastPos, events, rows.Err()
 }
 
-func (s *sendToDeviceStatements) UpdateSentSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, token string, nids []types.SendToDeviceNID,
-) (err error) {
-	query := strings.Replace(updateSentSendToDeviceMessagesSQL, "($2)", sqlutil.QueryVariadic(1+len(nids)), 1)
-	params := make([]interface{}, 1+len(nids))
-	params[0] = token
-	for k, v := range nids {
-		params[k+1] = v
+func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, upTo types.StreamPosition,
+) (count int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteSendToDeviceMessagesStmt).ExecContext(ctx, userID, deviceID, upTo)
+	if err != nil {
+		return 0, err
 	}
-	_, err = txn.ExecContext(ctx, query, params...)
-	return
+	return res.RowsAffected()
 }
 
-func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
-	ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID,
-) (err error) {
-	query := strings.Replace(deleteSendToDeviceMessagesSQL, "($1)", sqlutil.QueryVariadic(len(nids)), 1)
-	params := make([]interface{}, 1+len(nids))
-	for k, v := range nids {
-		params[k] = v
+func (s *sendToDeviceStatements) DeleteOldestSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, keep int,
+) (count int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteOldestSendToDeviceMessagesStmt).ExecContext(ctx, userID, deviceID, keep)
+	if err != nil {
+		return 0, err
 	}
-	_, err = txn.ExecContext(ctx, query, params...)
-	return
+	return res.RowsAffected()
 }
@@ -61,10 +61,6 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 	if err = d.streamID.prepare(d.db); err != nil {
 		return err
 	}
-	accountData, err := NewSqliteAccountDataTable(d.db, &d.streamID)
-	if err != nil {
-		return err
-	}
 	events, err := NewSqliteEventsTable(d.db, &d.streamID)
 	if err != nil {
 		return err
@@ -101,11 +97,37 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 	if err != nil {
 		return err
 	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	lazyLoadedMembers, err := NewSqliteLazyLoadedMembersTable(d.db)
+	if err != nil {
+		return err
+	}
+	notifications, err := NewSqliteNotificationsTable(d.db)
+	if err != nil {
+		return err
+	}
+	userDirectory, err := NewSqliteUserDirectoryTable(d.db)
+	if err != nil {
+		return err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
+	deltas.LoadSearch(m)
+	deltas.LoadContainsURL(m)
+	deltas.LoadUserDirectory(m)
+	deltas.LoadAccountDataContent(m)
 	if err = m.RunDeltas(d.db, dbProperties); err != nil {
 		return err
 	}
+	// The account data table is created after the deltas have run, so that
+	// its statements can refer to columns which the deltas add.
+	accountData, err := NewSqliteAccountDataTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Writer:              d.writer,
@@ -119,6 +141,10 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
+		Search:              search,
+		LazyLoadedMembers:   lazyLoadedMembers,
+		Notifications:       notifications,
+		UserDirectory:       userDirectory,
 		EDUCache:            cache.New(),
 	}
 	return nil
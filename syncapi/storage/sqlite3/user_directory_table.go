@@ -0,0 +1,156 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const userDirectorySchema = `
+-- Stores the profile of each user in each room that they are joined to, as
+-- given by their membership event, so that users can find the other users
+-- that they share a room with.
+CREATE TABLE IF NOT EXISTS syncapi_user_directory (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	-- The ID of the join event that the profile came from.
+	event_id TEXT NOT NULL,
+	display_name TEXT NOT NULL DEFAULT '',
+	avatar_url TEXT NOT NULL DEFAULT '',
+	UNIQUE (user_id, room_id)
+);
+CREATE INDEX IF NOT EXISTS syncapi_user_directory_room_id_idx ON syncapi_user_directory(room_id);
+CREATE INDEX IF NOT EXISTS syncapi_user_directory_event_id_idx ON syncapi_user_directory(event_id);
+`
+
+const upsertUserDirectorySQL = "" +
+	"INSERT INTO syncapi_user_directory (user_id, room_id, event_id, display_name, avatar_url)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, room_id)" +
+	" DO UPDATE SET event_id = $3, display_name = $4, avatar_url = $5"
+
+const deleteUserDirectorySQL = "" +
+	"DELETE FROM syncapi_user_directory WHERE user_id = $1 AND room_id = $2"
+
+const deleteUserDirectoryByEventIDSQL = "" +
+	"DELETE FROM syncapi_user_directory WHERE event_id = $1"
+
+const deleteUserDirectoryForRoomSQL = "" +
+	"DELETE FROM syncapi_user_directory WHERE room_id = $1"
+
+// Users match if the search term appears anywhere in their user ID or display
+// name, but those which start with it, or have a word in their display name
+// which starts with it, are returned first.
+const selectUserDirectorySQL = "" +
+	"SELECT user_id, MAX(display_name), MAX(avatar_url) FROM syncapi_user_directory" +
+	" WHERE room_id IN (SELECT room_id FROM syncapi_user_directory WHERE user_id = $1)" +
+	" AND (LOWER(user_id) LIKE $2 ESCAPE '\\' OR LOWER(display_name) LIKE $2 ESCAPE '\\')" +
+	" GROUP BY user_id" +
+	" ORDER BY MIN(CASE WHEN LOWER(user_id) LIKE $3 ESCAPE '\\'" +
+	" OR LOWER(display_name) LIKE $4 ESCAPE '\\'" +
+	" OR LOWER(display_name) LIKE $5 ESCAPE '\\' THEN 0 ELSE 1 END), user_id" +
+	" LIMIT $6"
+
+type userDirectoryStatements struct {
+	upsertUserDirectoryStmt          *sql.Stmt
+	deleteUserDirectoryStmt          *sql.Stmt
+	deleteUserDirectoryByEventIDStmt *sql.Stmt
+	deleteUserDirectoryForRoomStmt   *sql.Stmt
+	selectUserDirectoryStmt          *sql.Stmt
+}
+
+func NewSqliteUserDirectoryTable(db *sql.DB) (tables.UserDirectory, error) {
+	s := &userDirectoryStatements{}
+	_, err := db.Exec(userDirectorySchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertUserDirectoryStmt, err = db.Prepare(upsertUserDirectorySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteUserDirectoryStmt, err = db.Prepare(deleteUserDirectorySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteUserDirectoryByEventIDStmt, err = db.Prepare(deleteUserDirectoryByEventIDSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteUserDirectoryForRoomStmt, err = db.Prepare(deleteUserDirectoryForRoomSQL); err != nil {
+		return nil, err
+	}
+	if s.selectUserDirectoryStmt, err = db.Prepare(selectUserDirectorySQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *userDirectoryStatements) UpsertUserDirectory(
+	ctx context.Context, txn *sql.Tx, userID, roomID, eventID, displayName, avatarURL string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertUserDirectoryStmt).ExecContext(
+		ctx, userID, roomID, eventID, displayName, avatarURL,
+	)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteUserDirectory(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteUserDirectoryStmt).ExecContext(ctx, userID, roomID)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteUserDirectoryByEventID(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteUserDirectoryByEventIDStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteUserDirectoryForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteUserDirectoryForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *userDirectoryStatements) SelectUserDirectory(
+	ctx context.Context, txn *sql.Tx, userID, searchTerm string, limit int,
+) ([]authtypes.FullyQualifiedProfile, error) {
+	contains, userIDPrefix, namePrefix, wordPrefix := types.UserDirectoryPatterns(searchTerm)
+	rows, err := sqlutil.TxStmt(txn, s.selectUserDirectoryStmt).QueryContext(
+		ctx, userID, contains, userIDPrefix, namePrefix, wordPrefix, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query user directory: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserDirectory: rows.close() failed")
+	var results []authtypes.FullyQualifiedProfile
+	for rows.Next() {
+		var result authtypes.FullyQualifiedProfile
+		if err = rows.Scan(&result.UserID, &result.DisplayName, &result.AvatarURL); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -5,7 +5,7 @@ import (
 	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
-	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -54,12 +54,7 @@ func MustCreateEvent(t *testing.T, roomID string, prevs []*gomatrixserverlib.Hea
 }
 
 func MustCreateDatabase(t *testing.T) storage.Database {
-	dbname := fmt.Sprintf("test_%s.db", t.Name())
-	if _, err := os.Stat(dbname); err == nil {
-		if err = os.Remove(dbname); err != nil {
-			t.Fatalf("tried to delete stale test database but failed: %s", err)
-		}
-	}
+	dbname := filepath.Join(t.TempDir(), "syncapi.db")
 	db, err := sqlite3.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(fmt.Sprintf("file:%s", dbname)),
 	})
@@ -169,7 +164,7 @@ func TestSyncResponse(t *testing.T) {
 					PDUPosition: positions[len(positions)-2],
 				}
 				res := types.NewResponse()
-				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, testFilter(5), false)
 			},
 			WantTimeline: events[len(events)-1:],
 		},
@@ -183,7 +178,7 @@ func TestSyncResponse(t *testing.T) {
 				}
 				res := types.NewResponse()
 				// limit is set to 5
-				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, testFilter(5), false)
 			},
 			// want the last 5 events, NOT the last 10.
 			WantTimeline: events[len(events)-5:],
@@ -195,7 +190,7 @@ func TestSyncResponse(t *testing.T) {
 			DoSync: func() (*types.Response, error) {
 				res := types.NewResponse()
 				// limit set to 5
-				return db.CompleteSync(ctx, res, testUserDeviceA, 5)
+				return db.CompleteSync(ctx, res, testUserDeviceA, testFilter(5))
 			},
 			// want the last 5 events
 			WantTimeline: events[len(events)-5:],
@@ -208,7 +203,7 @@ func TestSyncResponse(t *testing.T) {
 			Name: "CompleteSync",
 			DoSync: func() (*types.Response, error) {
 				res := types.NewResponse()
-				return db.CompleteSync(ctx, res, testUserDeviceA, len(events)+1)
+				return db.CompleteSync(ctx, res, testUserDeviceA, testFilter(len(events)+1))
 			},
 			WantTimeline: events,
 			// We want no state at all as that field in /sync is the delta between the token (beginning of time)
@@ -255,7 +250,7 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	}
 
 	res := types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, testFilter(5), false)
 	if err != nil {
 		t.Fatalf("failed to IncrementalSync with latest token")
 	}
@@ -426,6 +421,96 @@ func TestGetEventsInRangeWithEventsSameDepth(t *testing.T) {
 	}
 }
 
+// The purpose of this test is to make sure that paginating in chunks, in either direction, returns every event exactly
+// once when events have the same depth, even if new events arrive between requests. It uses the same DAG as
+// TestGetEventsInRangeWithEventsSameDepth.
+func TestGetEventsInRangePaginationIsStable(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+
+	var events []*gomatrixserverlib.HeaderedEvent
+	events = append(events, MustCreateEvent(t, testRoomID, nil, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testUserIDA)),
+		Type:     "m.room.create",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    1,
+	}))
+	events = append(events, MustCreateEvent(t, testRoomID, events[len(events)-1:], &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"join"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+		Depth:    2,
+	}))
+	parent := events[len(events)-1:]
+	for i := 0; i < 3; i++ {
+		events = append(events, MustCreateEvent(t, testRoomID, parent, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Message A %d"}`, i+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   3,
+		}))
+	}
+	events = append(events, MustCreateEvent(t, testRoomID, events[len(events)-3:], &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"body":"Message merge"}`),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   4,
+	}))
+	MustWriteEvents(t, db, events)
+
+	// arrive writes a new event, which shouldn't change what the pagination
+	// tokens that have already been handed out refer to.
+	var late []*gomatrixserverlib.HeaderedEvent
+	arrive := func(depth int64) {
+		ev := MustCreateEvent(t, testRoomID, events[len(events)-1:], &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Late message %d"}`, len(late)+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   depth,
+		})
+		MustWriteEvents(t, db, []*gomatrixserverlib.HeaderedEvent{ev})
+		late = append(late, ev)
+	}
+
+	paginate := func(from, to types.TopologyToken, backwards bool, arrivalDepth int64) []gomatrixserverlib.ClientEvent {
+		var gots []gomatrixserverlib.ClientEvent
+		for {
+			paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, testRoomID, 2, backwards)
+			if err != nil {
+				t.Fatalf("GetEventsInRange returned an error: %s", err)
+			}
+			if len(paginatedEvents) == 0 {
+				return gots
+			}
+			gots = append(gots, gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)...)
+			last := paginatedEvents[len(paginatedEvents)-1].EventID()
+			if backwards {
+				from = *topologyTokenBefore(t, db, last)
+			} else if from, err = db.EventPositionInTopology(ctx, last); err != nil {
+				t.Fatalf("failed to get EventPositionInTopology: %s", err)
+			}
+			arrive(arrivalDepth)
+		}
+	}
+
+	latest, err := db.MaxTopologicalPosition(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("failed to get MaxTopologicalPosition: %s", err)
+	}
+	// Events which arrive in the part of the room that we've already paginated
+	// through aren't returned.
+	assertEventsEqual(t, "Paginating backwards", true, paginate(latest, types.TopologyToken{}, true, 3), reversed(events))
+	// They come after the other events with the same depth, and the events
+	// which arrive after the end of the range aren't returned.
+	var wants []*gomatrixserverlib.HeaderedEvent
+	wants = append(wants, events[:len(events)-1]...)
+	wants = append(wants, late...)
+	wants = append(wants, events[len(events)-1])
+	assertEventsEqual(t, "Paginating forwards", true, paginate(types.TopologyToken{}, latest, false, 5), wants)
+}
+
 // The purpose of this test is to make sure that the query to pull out events is honouring the room ID correctly.
 // It works by creating two rooms with the same events in them, then selecting events by topological range.
 // Specifically, we know that events with the same depth but lower stream positions are selected, and it's possible
@@ -539,80 +624,125 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 
 	// At this point there should be no messages. We haven't sent anything
 	// yet.
-	_, events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{})
+	_, events, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{}, 100)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 0 || len(updates) != 0 || len(deletions) != 0 {
+	if len(events) != 0 {
 		t.Fatal("first call should have no updates")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{})
-	if err != nil {
-		return
-	}
 
 	// Try sending a message.
 	streamPos, err := db.StoreNewSendForDeviceMessage(ctx, "alice", "one", gomatrixserverlib.SendToDeviceEvent{
 		Sender:  "bob",
 		Type:    "m.type",
 		Content: json.RawMessage("{}"),
-	})
+	}, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// At this point we should get exactly one message. We're sending the sync position
-	// that we were given from the update and the send-to-device update will be updated
-	// in the database to reflect that this was the sync position we sent the message at.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos})
+	// from before the message was sent, so the message hasn't been acknowledged yet.
+	lastPos, events, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos - 1}, 100)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 1 || len(updates) != 1 || len(deletions) != 0 {
+	if len(events) != 1 || lastPos != streamPos {
 		t.Fatal("second call should have one update")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos})
-	if err != nil {
-		return
-	}
 
 	// At this point we should still have one message because we haven't progressed the
 	// sync position yet. This is equivalent to the client failing to /sync and retrying
 	// with the same position.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos})
+	_, events, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos - 1}, 100)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 1 || len(updates) != 0 || len(deletions) != 0 {
+	if len(events) != 1 {
 		t.Fatal("third call should have one update still")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos})
-	if err != nil {
-		return
-	}
 
 	// At this point we should now have no updates, because we've progressed the sync
-	// position. Therefore the update from before will not be sent again.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 1})
+	// position to the one that we were given. Therefore the update from before will
+	// not be sent again.
+	lastPos, events, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos}, 100)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 0 || len(updates) != 0 || len(deletions) != 1 {
+	if len(events) != 0 || lastPos != streamPos {
 		t.Fatal("fourth call should have no updates")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos + 1})
+
+	// The acknowledged update should have been deleted, so even going back to the old
+	// sync position shouldn't return it again.
+	_, events, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{}, 100)
 	if err != nil {
-		return
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatal("fifth call should have no updates")
 	}
+}
 
-	// At this point we should still have no updates, because no new updates have been
-	// sent.
-	_, events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 2})
+func TestSendToDeviceQueueLimits(t *testing.T) {
+	db := MustCreateDatabase(t)
+
+	// Fill up the queue for a device beyond the limit. The oldest messages should
+	// be thrown away first.
+	var positions []types.StreamPosition
+	for i := 0; i < 5; i++ {
+		streamPos, err := db.StoreNewSendForDeviceMessage(ctx, "bob", "two", gomatrixserverlib.SendToDeviceEvent{
+			Sender:  "alice",
+			Type:    "m.type",
+			Content: json.RawMessage(fmt.Sprintf(`{"i":%d}`, i)),
+		}, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, streamPos)
+	}
+	count, queued, err := db.SendToDeviceQueue(ctx, "bob", "two", 10)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(events) != 0 || len(updates) != 0 || len(deletions) != 0 {
-		t.Fatal("fifth call should have no updates")
+	if count != 3 || len(queued) != 3 {
+		t.Fatalf("expected 3 queued messages, got count %d with %d messages", count, len(queued))
+	}
+	if queued[0].ID != types.SendToDeviceNID(positions[2]) {
+		t.Fatalf("expected oldest message to be the third one sent, got ID %d", queued[0].ID)
+	}
+
+	// Only send as many messages as we were asked to in one go.
+	lastPos, events, err := db.SendToDeviceUpdatesForSync(ctx, "bob", "two", types.StreamingToken{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || lastPos != positions[3] {
+		t.Fatalf("expected 2 updates up to position %d, got %d up to position %d", positions[3], len(events), lastPos)
+	}
+	lastPos, events, err = db.SendToDeviceUpdatesForSync(ctx, "bob", "two", types.StreamingToken{SendToDevicePosition: lastPos}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || lastPos != positions[4] {
+		t.Fatalf("expected 1 update up to position %d, got %d up to position %d", positions[4], len(events), lastPos)
+	}
+
+	// Flushing the queue should remove whatever hasn't been acknowledged yet.
+	flushed, err := db.FlushSendToDeviceQueue(ctx, "bob", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 1 {
+		t.Fatalf("expected to flush 1 message, flushed %d", flushed)
+	}
+	waiting, err := db.SendToDeviceUpdatesWaiting(ctx, "bob", "two", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waiting {
+		t.Fatal("expected no messages to be waiting after flush")
 	}
 }
 
@@ -644,7 +774,7 @@ func TestInviteBehaviour(t *testing.T) {
 	}
 	// both invite events should appear in a new sync
 	beforeRetireRes := types.NewResponse()
-	beforeRetireRes, err = db.IncrementalSync(ctx, beforeRetireRes, testUserDeviceA, types.StreamingToken{}, latest, 0, false)
+	beforeRetireRes, err = db.IncrementalSync(ctx, beforeRetireRes, testUserDeviceA, types.StreamingToken{}, latest, testFilter(0), false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -659,7 +789,7 @@ func TestInviteBehaviour(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	res := types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.StreamingToken{}, latest, 0, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.StreamingToken{}, latest, testFilter(0), false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -667,7 +797,7 @@ func TestInviteBehaviour(t *testing.T) {
 
 	// a sync after we have received both invites should result in a leave for the retired room
 	res = types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, beforeRetireRes.NextBatch, latest, 0, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, beforeRetireRes.NextBatch, latest, testFilter(0), false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -677,6 +807,325 @@ func TestInviteBehaviour(t *testing.T) {
 	}
 }
 
+func TestSearchRoomEvents(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+
+	search := func(req types.SearchRequest) ([]types.SearchResult, int) {
+		t.Helper()
+		req.RoomIDs = []string{testRoomID}
+		req.Keys = []string{"content.body"}
+		if req.Limit == 0 {
+			req.Limit = 100
+		}
+		results, count, err := db.SearchRoomEvents(ctx, &req)
+		if err != nil {
+			t.Fatalf("SearchRoomEvents failed: %s", err)
+		}
+		return results, count
+	}
+
+	// All 20 messages say "message", and the most recent one should come first.
+	results, count := search(types.SearchRequest{Term: "message"})
+	if count != 20 || len(results) != 20 {
+		t.Fatalf("got %d results (count %d), want 20", len(results), count)
+	}
+	if results[0].EventID != events[len(events)-1].EventID() {
+		t.Fatalf("got first result %s, want most recent event %s", results[0].EventID, events[len(events)-1].EventID())
+	}
+
+	// Only user B's messages contain "B", and paginating should work through them.
+	results, count = search(types.SearchRequest{Term: "message b", Limit: 6})
+	if count != 10 || len(results) != 6 {
+		t.Fatalf("got %d results (count %d), want 6 (count 10)", len(results), count)
+	}
+	results, _ = search(types.SearchRequest{Term: "message b", Limit: 6, From: int64(results[5].StreamPos)})
+	if len(results) != 4 {
+		t.Fatalf("got %d results on the second page, want 4", len(results))
+	}
+	if results[3].StreamPos <= positions[len(positions)-11] {
+		t.Fatalf("second page returned an event from before user B's messages")
+	}
+
+	// Filtering by sender should exclude the other user's messages.
+	_, count = search(types.SearchRequest{Term: "message", NotSenders: []string{testUserIDB}})
+	if count != 10 {
+		t.Fatalf("got count %d with not_senders, want 10", count)
+	}
+
+	// Redacting an event should remove it from the index.
+	redaction := MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{}`),
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Sender:  testUserIDB,
+		Redacts: events[len(events)-1].EventID(),
+		Depth:   int64(len(events) + 1),
+	})
+	if err := db.RedactEvent(ctx, events[len(events)-1].EventID(), redaction); err != nil {
+		t.Fatalf("RedactEvent failed: %s", err)
+	}
+	_, count = search(types.SearchRequest{Term: "message"})
+	if count != 19 {
+		t.Fatalf("got count %d after redaction, want 19", count)
+	}
+}
+
+func TestEventsAroundPosition(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	middle := 10
+	pos, err := db.EventPositionInTopology(ctx, events[middle].EventID())
+	if err != nil {
+		t.Fatalf("EventPositionInTopology failed: %s", err)
+	}
+	before, err := db.EventsAroundPosition(ctx, testRoomID, pos, 3, false)
+	if err != nil {
+		t.Fatalf("EventsAroundPosition failed: %s", err)
+	}
+	assertEventsEqual(t, "before", true, gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(nil, before), gomatrixserverlib.FormatAll), reversed(events[middle-3:middle]))
+	after, err := db.EventsAroundPosition(ctx, testRoomID, pos, 3, true)
+	if err != nil {
+		t.Fatalf("EventsAroundPosition failed: %s", err)
+	}
+	assertEventsEqual(t, "after", true, gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(nil, after), gomatrixserverlib.FormatAll), events[middle+1:middle+4])
+
+	// There's nothing before the create event.
+	pos, err = db.EventPositionInTopology(ctx, events[0].EventID())
+	if err != nil {
+		t.Fatalf("EventPositionInTopology failed: %s", err)
+	}
+	before, err = db.EventsAroundPosition(ctx, testRoomID, pos, 3, false)
+	if err != nil {
+		t.Fatalf("EventsAroundPosition failed: %s", err)
+	}
+	if len(before) != 0 {
+		t.Fatalf("got %d events before the create event, want 0", len(before))
+	}
+}
+
+func TestLazyLoadMembers(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	filter := testFilter(5)
+	filter.Room.State.LazyLoadMembers = true
+
+	// Only user B has sent messages in the timeline, so user A's membership
+	// shouldn't be sent.
+	wantState := []*gomatrixserverlib.HeaderedEvent{state[0], state[2]}
+	res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	assertEventsEqual(t, "complete sync state", false, res.Rooms.Join[testRoomID].State.Events, wantState)
+
+	// An incremental sync shouldn't send user B's membership again.
+	from := types.StreamingToken{PDUPosition: positions[len(positions)-3]}
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, filter, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertEventsEqual(t, "incremental sync state", false, res.Rooms.Join[testRoomID].State.Events, nil)
+
+	// ... unless the client asks for redundant members.
+	filter.Room.State.IncludeRedundantMembers = true
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, filter, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertEventsEqual(t, "redundant incremental sync state", false, res.Rooms.Join[testRoomID].State.Events, state[2:])
+}
+
+func TestFilteredSync(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// The timeline limit should only count events which match the filter.
+	filter := testFilter(3)
+	filter.Room.Timeline.Senders = []string{testUserIDA}
+	filter.Room.State.NotTypes = []string{"m.room.member"}
+	res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	roomRes := res.Rooms.Join[testRoomID]
+	assertEventsEqual(t, "senders timeline", false, roomRes.Timeline.Events, events[9:12])
+	if !roomRes.Timeline.Limited {
+		t.Fatalf("expected the timeline to be limited")
+	}
+	assertEventsEqual(t, "not_types state", false, roomRes.State.Events, state[:1])
+
+	filter = testFilter(5)
+	filter.Room.Timeline.Types = []string{"m.room.mem*"}
+	res, err = db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	assertEventsEqual(t, "types timeline", false, res.Rooms.Join[testRoomID].Timeline.Events, []*gomatrixserverlib.HeaderedEvent{events[1], events[12]})
+
+	containsURL := true
+	filter = testFilter(5)
+	filter.Room.Timeline.ContainsURL = &containsURL
+	res, err = db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	assertEventsEqual(t, "contains_url timeline", false, res.Rooms.Join[testRoomID].Timeline.Events, nil)
+
+	filter = testFilter(5)
+	filter.Room.NotRooms = []string{testRoomID}
+	res, err = db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	if _, ok := res.Rooms.Join[testRoomID]; ok {
+		t.Fatalf("expected room %s to be filtered out", testRoomID)
+	}
+
+	// User B's join is in range but outside of the timeline, so it would
+	// normally be in the state, but not if the filter leaves out members.
+	from := types.StreamingToken{PDUPosition: positions[11]}
+	filter = testFilter(2)
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, filter, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertEventsEqual(t, "incremental state", false, res.Rooms.Join[testRoomID].State.Events, state[2:])
+	filter.Room.State.NotTypes = []string{"m.room.member"}
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, filter, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertEventsEqual(t, "filtered incremental state", false, res.Rooms.Join[testRoomID].State.Events, nil)
+}
+
+// When the timeline is limited, the state should be the state at the start of
+// the timeline rather than the changes across the whole range, so that state
+// changes in the gap aren't lost if they were changed again in the timeline.
+func TestIncrementalSyncLimitedStateDelta(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	from := types.StreamingToken{PDUPosition: positions[len(positions)-1]}
+
+	var gap []*gomatrixserverlib.HeaderedEvent
+	prev := events[len(events)-1]
+	gap = append(gap, MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"join","displayname":"Pale King"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDB,
+		Depth:    prev.Depth() + 1,
+	}))
+	for i := 0; i < 3; i++ {
+		gap = append(gap, MustCreateEvent(t, testRoomID, gap[len(gap)-1:], &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Gap %d"}`, i+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   gap[len(gap)-1].Depth() + 1,
+		}))
+	}
+	timeline := []*gomatrixserverlib.HeaderedEvent{
+		MustCreateEvent(t, testRoomID, gap[len(gap)-1:], &gomatrixserverlib.EventBuilder{
+			Content:  []byte(`{"membership":"leave"}`),
+			Type:     "m.room.member",
+			StateKey: &testUserIDB,
+			Sender:   testUserIDB,
+			Depth:    gap[len(gap)-1].Depth() + 1,
+		}),
+	}
+	timeline = append(timeline, MustCreateEvent(t, testRoomID, timeline, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"body":"After"}`),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   timeline[0].Depth() + 1,
+	}))
+	// Each membership event for user B replaces the one before it.
+	replaces := events[len(events)-11].EventID()
+	for _, ev := range append(gap, timeline...) {
+		var addState []*gomatrixserverlib.HeaderedEvent
+		var addStateIDs, removeStateIDs []string
+		if ev.StateKey() != nil {
+			addState, addStateIDs, removeStateIDs = []*gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, []string{replaces}
+			replaces = ev.EventID()
+		}
+		if _, err := db.WriteEvent(ctx, ev, addState, addStateIDs, removeStateIDs, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	res, err := db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, testFilter(2), false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	roomRes := res.Rooms.Join[testRoomID]
+	if !roomRes.Timeline.Limited {
+		t.Fatalf("expected the timeline to be limited")
+	}
+	assertEventsEqual(t, "limited timeline", false, roomRes.Timeline.Events, timeline)
+	assertEventsEqual(t, "limited state", false, roomRes.State.Events, gap[:1])
+
+	// Without a gap, the state changes are all in the timeline.
+	from = types.StreamingToken{PDUPosition: latest.PDUPosition - 2}
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, from, latest, testFilter(2), false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertEventsEqual(t, "unlimited state", false, res.Rooms.Join[testRoomID].State.Events, nil)
+}
+
+func TestReceiptsInSync(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	readEventID := events[len(events)-1].EventID()
+	ts := gomatrixserverlib.AsTimestamp(time.Unix(1600000000, 0))
+	if _, err := db.StoreReceipt(ctx, testRoomID, "m.read", testUserIDB, readEventID, ts); err != nil {
+		t.Fatalf("StoreReceipt failed: %s", err)
+	}
+
+	res, err := db.CompleteSync(ctx, types.NewResponse(), testUserDeviceA, testFilter(5))
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	ephemeral := res.Rooms.Join[testRoomID].Ephemeral.Events
+	if len(ephemeral) != 1 || ephemeral[0].Type != gomatrixserverlib.MReceipt {
+		t.Fatalf("expected a single m.receipt ephemeral event, got %+v", ephemeral)
+	}
+	want := fmt.Sprintf(`{"%s":{"m.read":{"%s":{"ts":%d}}}}`, readEventID, testUserIDB, ts)
+	if string(ephemeral[0].Content) != want {
+		t.Fatalf("got receipt content %s, want %s", ephemeral[0].Content, want)
+	}
+}
+
+func testFilter(timelineLimit int) *gomatrixserverlib.Filter {
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.Room.Timeline.Limit = timelineLimit
+	return &filter
+}
+
 func assertInvitedToRooms(t *testing.T, res *types.Response, roomIDs []string) {
 	t.Helper()
 	if len(res.Rooms.Invite) != len(roomIDs) {
@@ -689,6 +1138,134 @@ func assertInvitedToRooms(t *testing.T, res *types.Response, roomIDs []string) {
 	}
 }
 
+func TestNotificationCounts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+
+	// Notify user A about the last three messages from user B, highlighting one.
+	for i := len(events) - 3; i < len(events); i++ {
+		highlight := i == len(events)-1
+		if err := db.StoreNotification(ctx, testUserIDA, testRoomID, events[i].EventID(), positions[i], highlight); err != nil {
+			t.Fatalf("StoreNotification failed: %s", err)
+		}
+	}
+	assertNotificationCounts := func(wantNotifications, wantHighlights int) {
+		t.Helper()
+		notifications, highlights, err := db.NotificationCounts(ctx, testUserIDA, testRoomID)
+		if err != nil {
+			t.Fatalf("NotificationCounts failed: %s", err)
+		}
+		if notifications != wantNotifications || highlights != wantHighlights {
+			t.Fatalf("got %d notifications and %d highlights, want %d and %d", notifications, highlights, wantNotifications, wantHighlights)
+		}
+	}
+	assertNotificationCounts(3, 1)
+
+	// Reading the second to last message clears the notifications up to it.
+	if _, err := db.StoreReceipt(ctx, testRoomID, "m.read", testUserIDA, events[len(events)-2].EventID(), 0); err != nil {
+		t.Fatalf("StoreReceipt failed: %s", err)
+	}
+	assertNotificationCounts(1, 1)
+
+	if err := db.ClearNotifications(ctx, testUserIDA, testRoomID, positions[len(positions)-1]); err != nil {
+		t.Fatalf("ClearNotifications failed: %s", err)
+	}
+	assertNotificationCounts(0, 0)
+}
+
+func TestSearchUserDirectory(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	events = append(events, MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"join","displayname":"The Pale King"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDB,
+		Depth:    int64(len(events) + 1),
+	}))
+	MustWriteEvents(t, db, events)
+
+	assertSearch := func(userID, searchTerm string, wantUserIDs ...string) {
+		t.Helper()
+		results, err := db.SearchUserDirectory(ctx, userID, searchTerm, 10)
+		if err != nil {
+			t.Fatalf("SearchUserDirectory failed: %s", err)
+		}
+		var gotUserIDs []string
+		for _, result := range results {
+			gotUserIDs = append(gotUserIDs, result.UserID)
+		}
+		if fmt.Sprint(gotUserIDs) != fmt.Sprint(wantUserIDs) {
+			t.Fatalf("search for %q by %s got %v, want %v", searchTerm, userID, gotUserIDs, wantUserIDs)
+		}
+	}
+	assertSearch(testUserIDA, "PALE", testUserIDB)
+	assertSearch(testUserIDA, "king", testUserIDB)
+	assertSearch(testUserIDA, "o", testUserIDA, testUserIDB)
+	assertSearch(testUserIDA, "%")
+	assertSearch("@someone:else", "pale")
+
+	results, err := db.SearchUserDirectory(ctx, testUserIDA, "pale", 10)
+	if err != nil {
+		t.Fatalf("SearchUserDirectory failed: %s", err)
+	}
+	if len(results) != 1 || results[0].DisplayName != "The Pale King" {
+		t.Fatalf("got %+v, want the display name of %s", results, testUserIDB)
+	}
+
+	// Users who leave the room can no longer be found.
+	MustWriteEvents(t, db, []*gomatrixserverlib.HeaderedEvent{
+		MustCreateEvent(t, testRoomID, []*gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+			Content:  []byte(`{"membership":"leave"}`),
+			Type:     "m.room.member",
+			StateKey: &testUserIDB,
+			Sender:   testUserIDB,
+			Depth:    int64(len(events) + 1),
+		}),
+	})
+	assertSearch(testUserIDA, "pale")
+}
+
+func TestAccountDataContent(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	if _, err := db.UpsertAccountData(ctx, testUserIDA, testRoomID, "m.tag", json.RawMessage(`{"tags":{"u.work":{}}}`)); err != nil {
+		t.Fatalf("UpsertAccountData failed: %s", err)
+	}
+	// Updates without content, such as those from older client APIs, are
+	// returned without content, so that it can be requested instead.
+	pos, err := db.UpsertAccountData(ctx, testUserIDA, "", "m.push_rules", nil)
+	if err != nil {
+		t.Fatalf("UpsertAccountData failed: %s", err)
+	}
+	filter := gomatrixserverlib.DefaultEventFilter()
+	dataTypes, err := db.GetAccountDataInRange(ctx, testUserIDA, types.Range{From: 0, To: pos}, &filter)
+	if err != nil {
+		t.Fatalf("GetAccountDataInRange failed: %s", err)
+	}
+	if got := string(dataTypes[testRoomID]["m.tag"]); got != `{"tags":{"u.work":{}}}` {
+		t.Fatalf("got m.tag content %q, want the content that was saved", got)
+	}
+	if content, ok := dataTypes[""]["m.push_rules"]; !ok || content != nil {
+		t.Fatalf("got m.push_rules content %q (present: %v), want no content", content, ok)
+	}
+
+	// Later updates replace the content.
+	if pos, err = db.UpsertAccountData(ctx, testUserIDA, testRoomID, "m.tag", json.RawMessage(`{"tags":{}}`)); err != nil {
+		t.Fatalf("UpsertAccountData failed: %s", err)
+	}
+	dataTypes, err = db.GetAccountDataInRange(ctx, testUserIDA, types.Range{From: 0, To: pos}, &filter)
+	if err != nil {
+		t.Fatalf("GetAccountDataInRange failed: %s", err)
+	}
+	if got := string(dataTypes[testRoomID]["m.tag"]); got != `{"tags":{}}` {
+		t.Fatalf("got m.tag content %q, want the updated content", got)
+	}
+}
+
 func assertEventsEqual(t *testing.T, msg string, checkRoomID bool, gots []gomatrixserverlib.ClientEvent, wants []*gomatrixserverlib.HeaderedEvent) {
 	t.Helper()
 	if len(gots) != len(wants) {
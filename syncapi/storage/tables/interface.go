@@ -17,7 +17,9 @@ package tables
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -25,9 +27,10 @@ import (
 )
 
 type AccountData interface {
-	InsertAccountData(ctx context.Context, txn *sql.Tx, userID, roomID, dataType string) (pos types.StreamPosition, err error)
-	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`.
-	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter) (data map[string][]string, err error)
+	InsertAccountData(ctx context.Context, txn *sql.Tx, userID, roomID, dataType string, content json.RawMessage) (pos types.StreamPosition, err error)
+	// SelectAccountDataInRange returns a map of room ID to a map of `dataType` to its content. The content is nil if
+	// the client API didn't send it.
+	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter) (data map[string]map[string]json.RawMessage, err error)
 	SelectMaxAccountDataID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
@@ -50,15 +53,19 @@ type Peeks interface {
 }
 
 type Events interface {
-	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *gomatrixserverlib.StateFilter) (map[string]map[string]bool, map[string]types.StreamEvent, error)
+	// SelectStateInRange returns the state changes between the two stream positions which match the state filter,
+	// for the given room or for all rooms if the room ID is empty. Membership events are always returned, whether or
+	// not they match the filter, and the limit is not applied.
+	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, roomID string, stateFilter *gomatrixserverlib.StateFilter) (map[string]map[string]bool, map[string]types.StreamEvent, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 	InsertEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, addState, removeState []string, transactionID *api.TransactionID, excludeFromSync bool) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
 	// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude from sync.
-	// Returns up to `limit` events. Returns `limited=true` if there are more events in this range but we hit the `limit`.
-	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int, chronologicalOrder bool, onlySyncEvents bool) ([]types.StreamEvent, bool, error)
-	// SelectEarlyEvents returns the earliest events in the given room.
-	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
+	// Only returns events which match the filter, up to the filter's limit. Returns `limited=true` if there are more
+	// matching events in this range but we hit the limit.
+	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool) ([]types.StreamEvent, bool, error)
+	// SelectEarlyEvents returns the earliest events in the given room which match the filter.
+	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
 	UpdateEventJSON(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
 	// DeleteEventsForRoom removes all event information for a room. This should only be done when removing the room entirely.
@@ -71,11 +78,14 @@ type Topology interface {
 	// InsertEventInTopology inserts the given event in the room's topology, based on the event's depth.
 	// `pos` is the stream position of this event in the events table, and is used to order events which have the same depth.
 	InsertEventInTopology(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition) (err error)
-	// SelectEventIDsInRange selects the IDs of events whose depths are within a given range in a given room's topological order.
-	// Events with `minDepth` are *exclusive*, as is the event which has exactly `minDepth`,`maxStreamPos`.
-	// `maxStreamPos` is only used when events have the same depth as `maxDepth`, which results in events less than `maxStreamPos` being returned.
+	// SelectEventIDsInRange selects the IDs of events whose positions are within a given range in a given room's topological order.
+	// Positions are ordered by depth and then by stream position. The minimum position is *exclusive* and the maximum position is
+	// *inclusive*, so that paginating from the position of the last event returned never returns the same event twice.
 	// Returns an empty slice if no events match the given range.
-	SelectEventIDsInRange(ctx context.Context, txn *sql.Tx, roomID string, minDepth, maxDepth, maxStreamPos types.StreamPosition, limit int, chronologicalOrder bool) (eventIDs []string, err error)
+	SelectEventIDsInRange(ctx context.Context, txn *sql.Tx, roomID string, minDepth, minStreamPos, maxDepth, maxStreamPos types.StreamPosition, limit int, chronologicalOrder bool) (eventIDs []string, err error)
+	// SelectEventIDsAround selects the IDs of up to `limit` events either before or after the given depth and stream position
+	// in a given room's topological order. Events before are returned newest first, events after are returned oldest first.
+	SelectEventIDsAround(ctx context.Context, txn *sql.Tx, roomID string, depth, streamPos types.StreamPosition, limit int, after bool) (eventIDs []string, err error)
 	// SelectPositionInTopology returns the depth and stream position of a given event in the topology of the room it belongs to.
 	SelectPositionInTopology(ctx context.Context, txn *sql.Tx, eventID string) (depth, spos types.StreamPosition, err error)
 	// SelectMaxPositionInTopology returns the event which has the highest depth, and if there are multiple, the event with the highest stream position.
@@ -135,22 +145,22 @@ type BackwardsExtremities interface {
 // We're supposed to try and do our best to deliver send-to-device messages
 // once, but the only way that we can really guarantee that they have been
 // delivered is if the client successfully requests the next sync as given
-// in the next_batch. Each time the device syncs, we will request all of the
-// updates that either haven't been sent yet, along with all updates that we
-// *have* sent but we haven't confirmed to have been received yet. If it's the
-// first time we're sending a given update then we update the table to say
-// what the "since" parameter was when we tried to send it.
+// in the next_batch. The send-to-device position in the next_batch is the ID
+// of the last message that we included in the sync response, so when the
+// client syncs again with that "since" parameter, all messages up to and
+// including that ID are acknowledged and we drop them from the DB. If the
+// client repeats the same /sync instead then the messages are still there
+// and will be included in the sync response again.
 //
-// When the client syncs again, if their "since" parameter is *later* than
-// the recorded one, we drop the entry from the DB as it's "sent". If the
-// sync parameter isn't later then we will keep including the updates in the
-// sync response, as the client is seemingly trying to repeat the same /sync.
+// The number of messages that are queued for a single device can be limited,
+// in which case the oldest messages are dropped first to make room for new
+// ones. This stops a device that never syncs from growing the table forever.
 type SendToDevice interface {
 	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (pos types.StreamPosition, err error)
-	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error)
-	UpdateSentSendToDeviceMessages(ctx context.Context, txn *sql.Tx, token string, nids []types.SendToDeviceNID) (err error)
-	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID) (err error)
-	CountSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (count int, err error)
+	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition, limit int) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error)
+	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, upTo types.StreamPosition) (count int64, err error)
+	DeleteOldestSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, keep int) (count int64, err error)
+	CountSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from types.StreamPosition) (count int, err error)
 }
 
 type Filter interface {
@@ -163,3 +173,59 @@ type Receipts interface {
 	SelectRoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
+
+// Search is a full-text index of the searchable text of room events, as
+// returned by types.SearchableText.
+type Search interface {
+	// InsertSearchEvent adds the text of the event to the index. Events which are
+	// already in the index are ignored.
+	InsertSearchEvent(ctx context.Context, txn *sql.Tx, pos types.StreamPosition, event *gomatrixserverlib.HeaderedEvent, key, text string) error
+	// DeleteSearchEvent removes the event from the index, e.g. because it has been redacted.
+	DeleteSearchEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectSearch returns the events that match the search request.
+	SelectSearch(ctx context.Context, txn *sql.Tx, req *types.SearchRequest) ([]types.SearchResult, error)
+	// SelectSearchCount returns the total number of events that match the search
+	// request, ignoring From and Limit.
+	SelectSearchCount(ctx context.Context, txn *sql.Tx, req *types.SearchRequest) (int, error)
+}
+
+// LazyLoadedMembers remembers which membership events have been sent to
+// each device when the device is lazy-loading members, so that they don't
+// need to be sent again unless they change.
+type LazyLoadedMembers interface {
+	UpsertLazyLoadedMember(ctx context.Context, txn *sql.Tx, userID, deviceID, roomID, memberUserID, eventID string) error
+	// SelectLazyLoadedMembers returns a map of member user ID to the ID of the
+	// membership event that was sent to the device for the room.
+	SelectLazyLoadedMembers(ctx context.Context, txn *sql.Tx, userID, deviceID, roomID string) (map[string]string, error)
+	DeleteLazyLoadedMembers(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+}
+
+// Notifications are the events which local users have been notified about by
+// their push rules and haven't read yet.
+type Notifications interface {
+	InsertNotification(ctx context.Context, txn *sql.Tx, userID, roomID, eventID string, pos types.StreamPosition, highlight bool) error
+	// DeleteNotificationsUpTo removes the notifications of the user in the room
+	// for events up to and including the stream position, e.g. because the user
+	// has read them.
+	DeleteNotificationsUpTo(ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition) error
+	SelectNotificationCounts(ctx context.Context, txn *sql.Tx, userID, roomID string) (notificationCount, highlightCount int, err error)
+}
+
+// UserDirectory holds the profile of each user in each room that they are
+// joined to, so that users can search for the other users they share a room
+// with.
+type UserDirectory interface {
+	// UpsertUserDirectory sets the profile of the user in the room, as given by
+	// their join event.
+	UpsertUserDirectory(ctx context.Context, txn *sql.Tx, userID, roomID, eventID, displayName, avatarURL string) error
+	// DeleteUserDirectory removes the user from the room, e.g. because they have left it.
+	DeleteUserDirectory(ctx context.Context, txn *sql.Tx, userID, roomID string) error
+	// DeleteUserDirectoryByEventID removes the user whose profile came from the
+	// given join event, e.g. because it is no longer in the current room state.
+	DeleteUserDirectoryByEventID(ctx context.Context, txn *sql.Tx, eventID string) error
+	DeleteUserDirectoryForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectUserDirectory returns up to limit users who share a room with the
+	// given user and whose user ID or display name contains the search term,
+	// with those that start with it first.
+	SelectUserDirectory(ctx context.Context, txn *sql.Tx, userID, searchTerm string, limit int) ([]authtypes.FullyQualifiedProfile, error)
+}
@@ -193,6 +193,18 @@ func (n *Notifier) OnNewKeyChange(
 	n.wakeupUsers([]string{wakeUserID}, nil, n.currPos)
 }
 
+// OnNewOneTimeKeyChange wakes up the sync stream for the given device so that
+// it finds out about its new one-time key counts. There is no stream position
+// for key counts, so the current position is left alone.
+func (n *Notifier) OnNewOneTimeKeyChange(
+	userID, deviceID string,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.wakeupUserDevice(userID, []string{deviceID}, n.currPos)
+}
+
 func (n *Notifier) OnNewInvite(
 	posUpdate types.StreamingToken, wakeUserID string,
 ) {
@@ -32,22 +32,14 @@ import (
 const defaultSyncTimeout = time.Duration(0)
 const DefaultTimelineLimit = 20
 
-type filter struct {
-	Room struct {
-		Timeline struct {
-			Limit *int `json:"limit"`
-		} `json:"timeline"`
-	} `json:"room"`
-}
-
 // syncRequest represents a /sync request, with sensible defaults/sanity checks applied.
 type syncRequest struct {
 	ctx           context.Context
 	device        userapi.Device
-	limit         int
 	timeout       time.Duration
 	since         types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
+	filter        gomatrixserverlib.Filter
 	log           *log.Entry
 }
 
@@ -63,16 +55,14 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			return nil, err
 		}
 	}
-	timelineLimit := DefaultTimelineLimit
-	// TODO: read from stored filters too
+	filter := gomatrixserverlib.DefaultFilter()
 	filterQuery := req.URL.Query().Get("filter")
 	if filterQuery != "" {
 		if filterQuery[0] == '{' {
-			// attempt to parse the timeline limit at least
-			var f filter
-			err := json.Unmarshal([]byte(filterQuery), &f)
-			if err == nil && f.Room.Timeline.Limit != nil {
-				timelineLimit = *f.Room.Timeline.Limit
+			// Anything that the client leaves out of the filter keeps its
+			// default value.
+			if err := json.Unmarshal([]byte(filterQuery), &filter); err != nil {
+				return nil, err
 			}
 		} else {
 			// attempt to load the filter ID
@@ -83,7 +73,15 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			}
 			f, err := syncDB.GetFilter(req.Context(), localpart, filterQuery)
 			if err == nil {
-				timelineLimit = f.Room.Timeline.Limit
+				// Stored filters leave out any empty fields, so apply them on
+				// top of the default filter in the same way as above.
+				var filterJSON []byte
+				if filterJSON, err = json.Marshal(f); err != nil {
+					return nil, err
+				}
+				if err = json.Unmarshal(filterJSON, &filter); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -94,7 +92,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         timelineLimit,
+		filter:        filter,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
@@ -18,6 +18,7 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -39,6 +41,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The maximum number of send-to-device messages that will be included in a
+// single sync response. Any more will be sent in the following syncs.
+const maxSendToDeviceEventsPerSync = 100
+
 // RequestPool manages HTTP long-poll connections for /sync
 type RequestPool struct {
 	db       storage.Database
@@ -144,7 +150,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 		"device_id": device.ID,
 		"since":     syncReq.since,
 		"timeout":   syncReq.timeout,
-		"limit":     syncReq.limit,
+		"limit":     syncReq.filter.Room.Timeline.Limit,
 	})
 
 	activeSyncRequests.Inc()
@@ -179,6 +185,15 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	userStreamListener := rp.Notifier.GetListener(*syncReq)
 	defer userStreamListener.Close()
 
+	// One-time key counts don't have a stream position, so remember what they
+	// were when we started waiting. If someone claims keys from this device in
+	// the meantime then we'll respond early so that the device can upload more.
+	keyCounts := types.NewResponse()
+	if err = internal.DeviceOTKCounts(req.Context(), rp.keyAPI, device.UserID, device.ID, keyCounts); err != nil {
+		logger.WithError(err).Error("internal.DeviceOTKCounts failed")
+		return jsonerror.InternalServerError()
+	}
+
 	// We need the loop in case userStreamListener wakes up even if there isn't
 	// anything to send down. In this case, we'll jump out of the select but
 	// don't want to send anything back until we get some actual content to
@@ -214,7 +229,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			return jsonerror.InternalServerError()
 		}
 
-		if !syncData.IsEmpty() || hasTimedOut {
+		if !syncData.IsEmpty() || hasTimedOut || deviceKeyCountsChanged(keyCounts, syncData) {
 			logger.WithField("next", syncData.NextBatch).WithField("timed_out", hasTimedOut).Info("Responding")
 			return util.JSONResponse{
 				Code: http.StatusOK,
@@ -224,6 +239,32 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	}
 }
 
+// deviceKeyCountsChanged returns true if the one-time key counts or unused
+// fallback key types are different between the two responses.
+func deviceKeyCountsChanged(a, b *types.Response) bool {
+	if len(a.DeviceListsOTKCount) != len(b.DeviceListsOTKCount) {
+		return true
+	}
+	for algorithm, count := range a.DeviceListsOTKCount {
+		if b.DeviceListsOTKCount[algorithm] != count {
+			return true
+		}
+	}
+	if len(a.DeviceUnusedFallbackKeyTypes) != len(b.DeviceUnusedFallbackKeyTypes) {
+		return true
+	}
+	unused := make(map[string]bool, len(a.DeviceUnusedFallbackKeyTypes))
+	for _, algorithm := range a.DeviceUnusedFallbackKeyTypes {
+		unused[algorithm] = true
+	}
+	for _, algorithm := range b.DeviceUnusedFallbackKeyTypes {
+		if !unused[algorithm] {
+			return true
+		}
+	}
+	return false
+}
+
 func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	from := req.URL.Query().Get("from")
 	to := req.URL.Query().Get("to")
@@ -248,8 +289,10 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 		}
 	}
 	// work out room joins/leaves
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.Room.Timeline.Limit = 10
 	res, err := rp.db.IncrementalSync(
-		req.Context(), types.NewResponse(), *device, fromToken, toToken, 10, false,
+		req.Context(), types.NewResponse(), *device, fromToken, toToken, &filter, false,
 	)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("Failed to IncrementalSync")
@@ -278,29 +321,36 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 	res := types.NewResponse()
 
 	// See if we have any new tasks to do for the send-to-device messaging.
-	lastPos, events, updates, deletions, err := rp.db.SendToDeviceUpdatesForSync(req.ctx, req.device.UserID, req.device.ID, req.since)
+	lastPos, events, err := rp.db.SendToDeviceUpdatesForSync(req.ctx, req.device.UserID, req.device.ID, req.since, maxSendToDeviceEventsPerSync)
 	if err != nil {
 		return nil, fmt.Errorf("rp.db.SendToDeviceUpdatesForSync: %w", err)
 	}
 
-	// TODO: handle ignored users
 	if req.since.IsEmpty() {
-		res, err = rp.db.CompleteSync(req.ctx, res, req.device, req.limit)
+		res, err = rp.db.CompleteSync(req.ctx, res, req.device, &req.filter)
 		if err != nil {
 			return res, fmt.Errorf("rp.db.CompleteSync: %w", err)
 		}
 	} else {
-		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, req.since, latestPos, req.limit, req.wantFullState)
+		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, req.since, latestPos, &req.filter, req.wantFullState)
 		if err != nil {
 			return res, fmt.Errorf("rp.db.IncrementalSync: %w", err)
 		}
 	}
+	ignored, err := internal.IgnoredUsers(req.ctx, rp.userAPI, req.device.UserID)
+	if err != nil {
+		return res, fmt.Errorf("internal.IgnoredUsers: %w", err)
+	}
+	internal.RemoveIgnoredEvents(res, ignored)
 
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition, &accountDataFilter)
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition, &req.filter.AccountData)
 	if err != nil {
 		return res, fmt.Errorf("rp.appendAccountData: %w", err)
 	}
+	res, err = rp.appendNotificationCounts(res, req.device.UserID, req)
+	if err != nil {
+		return res, fmt.Errorf("rp.appendNotificationCounts: %w", err)
+	}
 	res, err = rp.appendDeviceLists(res, req.device.UserID, req.since, latestPos)
 	if err != nil {
 		return res, fmt.Errorf("rp.appendDeviceLists: %w", err)
@@ -310,27 +360,39 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 		return res, fmt.Errorf("internal.DeviceOTKCounts: %w", err)
 	}
 
-	// Before we return the sync response, make sure that we take action on
-	// any send-to-device database updates or deletions that we need to do.
-	// Then add the updates into the sync response.
-	if len(updates) > 0 || len(deletions) > 0 {
-		// Handle the updates and deletions in the database.
-		err = rp.db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, req.since)
-		if err != nil {
-			return res, fmt.Errorf("rp.db.CleanSendToDeviceUpdates: %w", err)
-		}
+	// Add the send-to-device updates into the sync response. They will be
+	// acknowledged when the client syncs again using this next_batch.
+	for _, event := range events {
+		res.ToDevice.Events = append(res.ToDevice.Events, event.SendToDeviceEvent)
 	}
-	if len(events) > 0 {
-		// Add the updates into the sync response.
-		for _, event := range events {
-			res.ToDevice.Events = append(res.ToDevice.Events, event.SendToDeviceEvent)
-		}
+	if len(events) < maxSendToDeviceEventsPerSync && latestPos.SendToDevicePosition > lastPos {
+		// There's nothing else waiting for this device, so skip ahead to the
+		// latest position so that the notifier doesn't keep waking us up for
+		// send-to-device messages that were sent to other devices.
+		lastPos = latestPos.SendToDevicePosition
 	}
 
 	res.NextBatch.SendToDevicePosition = lastPos
 	return res, err
 }
 
+// appendNotificationCounts adds the number of unread notifications to each
+// joined room in the response.
+func (rp *RequestPool) appendNotificationCounts(
+	data *types.Response, userID string, req syncRequest,
+) (*types.Response, error) {
+	for roomID, jr := range data.Rooms.Join {
+		notificationCount, highlightCount, err := rp.db.NotificationCounts(req.ctx, userID, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("rp.db.NotificationCounts: %w", err)
+		}
+		jr.UnreadNotifications.NotificationCount = notificationCount
+		jr.UnreadNotifications.HighlightCount = highlightCount
+		data.Rooms.Join[roomID] = jr
+	}
+	return data, nil
+}
+
 func (rp *RequestPool) appendDeviceLists(
 	data *types.Response, userID string, since, to types.StreamingToken,
 ) (*types.Response, error) {
@@ -362,6 +424,22 @@ func (rp *RequestPool) appendAccountData(
 		if err := rp.userAPI.QueryAccountData(req.ctx, dataReq, dataRes); err != nil {
 			return nil, err
 		}
+		if _, ok := dataRes.GlobalAccountData[pushrules.AccountDataType]; !ok {
+			// Users who haven't changed their push rules still need to see the
+			// default ones.
+			localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+			if err != nil {
+				return nil, err
+			}
+			defaults, err := json.Marshal(pushrules.DefaultAccountRuleSets(localpart, rp.cfg.Matrix.ServerName))
+			if err != nil {
+				return nil, err
+			}
+			if dataRes.GlobalAccountData == nil {
+				dataRes.GlobalAccountData = map[string]json.RawMessage{}
+			}
+			dataRes.GlobalAccountData[pushrules.AccountDataType] = defaults
+		}
 		for datatype, databody := range dataRes.GlobalAccountData {
 			data.AccountData.Events = append(
 				data.AccountData.Events,
@@ -407,45 +485,54 @@ func (rp *RequestPool) appendAccountData(
 
 	if len(dataTypes) == 0 {
 		// TODO: this fixes the sytest but is it the right thing to do?
-		dataTypes[""] = []string{"m.push_rules"}
+		dataTypes[""] = map[string]json.RawMessage{"m.push_rules": nil}
 	}
 
 	// Iterate over the rooms
 	for roomID, dataTypes := range dataTypes {
-		// Request the missing data from the database
-		for _, dataType := range dataTypes {
-			dataReq := userapi.QueryAccountDataRequest{
-				UserID:   userID,
-				RoomID:   roomID,
-				DataType: dataType,
-			}
-			dataRes := userapi.QueryAccountDataResponse{}
-			err = rp.userAPI.QueryAccountData(req.ctx, &dataReq, &dataRes)
-			if err != nil {
-				continue
+		for dataType, content := range dataTypes {
+			// The client API sends the content along with the update, but
+			// we need to request it from the user API if it didn't, e.g. if
+			// the update came from an older version.
+			if content == nil {
+				dataReq := userapi.QueryAccountDataRequest{
+					UserID:   userID,
+					RoomID:   roomID,
+					DataType: dataType,
+				}
+				dataRes := userapi.QueryAccountDataResponse{}
+				err = rp.userAPI.QueryAccountData(req.ctx, &dataReq, &dataRes)
+				if err != nil {
+					continue
+				}
+				var ok bool
+				if roomID == "" {
+					content, ok = dataRes.GlobalAccountData[dataType]
+				} else {
+					content, ok = dataRes.RoomAccountData[roomID][dataType]
+				}
+				if !ok {
+					continue
+				}
 			}
 			if roomID == "" {
-				if globalData, ok := dataRes.GlobalAccountData[dataType]; ok {
-					data.AccountData.Events = append(
-						data.AccountData.Events,
-						gomatrixserverlib.ClientEvent{
-							Type:    dataType,
-							Content: gomatrixserverlib.RawJSON(globalData),
-						},
-					)
-				}
+				data.AccountData.Events = append(
+					data.AccountData.Events,
+					gomatrixserverlib.ClientEvent{
+						Type:    dataType,
+						Content: gomatrixserverlib.RawJSON(content),
+					},
+				)
 			} else {
-				if roomData, ok := dataRes.RoomAccountData[roomID][dataType]; ok {
-					joinData := data.Rooms.Join[roomID]
-					joinData.AccountData.Events = append(
-						joinData.AccountData.Events,
-						gomatrixserverlib.ClientEvent{
-							Type:    dataType,
-							Content: gomatrixserverlib.RawJSON(roomData),
-						},
-					)
-					data.Rooms.Join[roomID] = joinData
-				}
+				joinData := data.Rooms.Join[roomID]
+				joinData.AccountData.Events = append(
+					joinData.AccountData.Events,
+					gomatrixserverlib.ClientEvent{
+						Type:    dataType,
+						Content: gomatrixserverlib.RawJSON(content),
+					},
+				)
+				data.Rooms.Join[roomID] = joinData
 			}
 		}
 	}
@@ -460,6 +547,6 @@ func (rp *RequestPool) shouldReturnImmediately(syncReq *syncRequest) bool {
 	if syncReq.since.IsEmpty() || syncReq.timeout == 0 || syncReq.wantFullState {
 		return true
 	}
-	waiting, werr := rp.db.SendToDeviceUpdatesWaiting(context.TODO(), syncReq.device.UserID, syncReq.device.ID)
+	waiting, werr := rp.db.SendToDeviceUpdatesWaiting(context.TODO(), syncReq.device.UserID, syncReq.device.ID, syncReq.since.SendToDevicePosition)
 	return werr == nil && waiting
 }
@@ -28,6 +28,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/syncapi/consumers"
+	"github.com/matrix-org/dendrite/syncapi/push"
 	"github.com/matrix-org/dendrite/syncapi/routing"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
@@ -37,6 +38,7 @@ import (
 // component.
 func AddPublicRoutes(
 	router *mux.Router,
+	dendriteAdminRouter *mux.Router,
 	userAPI userapi.UserInternalAPI,
 	rsAPI api.RoomserverInternalAPI,
 	keyAPI keyapi.KeyInternalAPI,
@@ -71,8 +73,17 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start key change consumer")
 	}
 
+	otkChangeConsumer := consumers.NewOutputOneTimeKeyChangeEventConsumer(
+		cfg, consumer, notifier, syncDB,
+	)
+	if err = otkChangeConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start one-time key change consumer")
+	}
+
+	pushSender := push.NewSender(cfg, syncDB, userAPI, rsAPI)
+
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
-		cfg, consumer, notifier, syncDB, rsAPI,
+		cfg, consumer, notifier, syncDB, rsAPI, pushSender,
 	)
 	if err = roomConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start room server consumer")
@@ -106,5 +117,5 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
-	routing.Setup(router, requestPool, syncDB, userAPI, federation, rsAPI, cfg)
+	routing.Setup(router, dendriteAdminRouter, requestPool, syncDB, userAPI, federation, rsAPI, cfg)
 }
@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+// SearchKeys maps the keys that can be searched, as given in the "keys" of a
+// search request, to the type of event that they belong to.
+var SearchKeys = map[string]string{
+	"content.body":  "m.room.message",
+	"content.name":  "m.room.name",
+	"content.topic": "m.room.topic",
+}
+
+// maxSearchableText is the most text that will be indexed for a single event.
+// Postgres refuses to build a tsvector bigger than 1MB, and no event content
+// should be anything like this big anyway.
+const maxSearchableText = 64 * 1024
+
+// SearchableText returns the search key and the text that should be indexed
+// for an event of the given type with the given content. Returns false if the
+// event doesn't contain anything that can be searched.
+func SearchableText(eventType string, stateKey *string, content []byte) (key, text string, ok bool) {
+	for k, t := range SearchKeys {
+		if t != eventType {
+			continue
+		}
+		if eventType != "m.room.message" && (stateKey == nil || *stateKey != "") {
+			return "", "", false
+		}
+		value := gjson.GetBytes(content, strings.TrimPrefix(k, "content."))
+		if value.Type != gjson.String || value.Str == "" {
+			return "", "", false
+		}
+		text = strings.Replace(value.Str, "\x00", "", -1)
+		if len(text) > maxSearchableText {
+			text = text[:maxSearchableText]
+			for !utf8.ValidString(text) {
+				text = text[:len(text)-1]
+			}
+		}
+		return k, text, true
+	}
+	return "", "", false
+}
+
+// SearchRequest describes a full-text search of room events.
+type SearchRequest struct {
+	// The words to search for. All of them must appear in the text.
+	Term string
+	// The rooms to search in.
+	RoomIDs []string
+	// The search keys to search in, from SearchKeys.
+	Keys []string
+	// If not nil, only events sent by these users will be returned.
+	Senders []string
+	// If not nil, events sent by these users won't be returned.
+	NotSenders []string
+	// Whether to return the best matches first rather than the most
+	// recent ones.
+	OrderByRank bool
+	// Where to start returning results from. When ordering by rank this is
+	// the number of results to skip, otherwise only results from before this
+	// stream position are returned. Zero means from the start.
+	From int64
+	// The maximum number of results to return.
+	Limit int
+}
+
+// SearchResult is a room event which matched a full-text search.
+type SearchResult struct {
+	EventID   string
+	StreamPos StreamPosition
+	// How well the event matched the search. Higher is better.
+	Rank float64
+}
+
+// UserDirectoryPatterns returns the LIKE patterns, with an escape character
+// of '\', which are used to search the user directory for the given term: one
+// which matches the term anywhere, one which matches user IDs starting with it,
+// one which matches display names starting with it, and one which matches
+// display names with a later word starting with it. The patterns should be
+// matched against lower-cased values.
+func UserDirectoryPatterns(term string) (contains, userIDPrefix, namePrefix, wordPrefix string) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(term))
+	return "%" + escaped + "%",
+		"@" + strings.TrimPrefix(escaped, "@") + "%",
+		escaped + "%",
+		"% " + escaped + "%"
+}
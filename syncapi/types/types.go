@@ -198,6 +198,11 @@ func (t *StreamingToken) ApplyUpdates(other StreamingToken) {
 	}
 }
 
+// TopologyToken is a position in a room's topological order, which orders
+// events by depth and then by stream position. The token sits just after the
+// event at that position, so paginating backwards from it includes that event
+// and paginating forwards from it doesn't. As stream positions never repeat,
+// this order is stable even as new events arrive or are backfilled.
 type TopologyToken struct {
 	Depth       StreamPosition
 	PDUPosition StreamPosition
@@ -224,26 +229,14 @@ func (t TopologyToken) String() string {
 	return fmt.Sprintf("t%d_%d", t.Depth, t.PDUPosition)
 }
 
-// Decrement the topology token to one event earlier.
+// Decrement moves the topology token to just before the event at its
+// position, so that paginating backwards from it no longer includes that
+// event. Other events at the same depth with lower stream positions are still
+// included.
 func (t *TopologyToken) Decrement() {
-	depth := t.Depth
-	pduPos := t.PDUPosition
-	if depth-1 <= 0 {
-		// nothing can be lower than this
-		depth = 1
-	} else {
-		// this assumes that we will never have 1000 events all with the same
-		// depth. TODO: work out what the right PDU position is to use, probably needs a db hit.
-		depth--
-		pduPos += 1000
+	if t.PDUPosition > 0 {
+		t.PDUPosition--
 	}
-	// The lowest token value is 1, therefore we need to manually set it to that
-	// value if we're below it.
-	if depth < 1 {
-		depth = 1
-	}
-	t.Depth = depth
-	t.PDUPosition = pduPos
 }
 
 func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
@@ -362,7 +355,8 @@ type Response struct {
 		Changed []string `json:"changed,omitempty"`
 		Left    []string `json:"left,omitempty"`
 	} `json:"device_lists,omitempty"`
-	DeviceListsOTKCount map[string]int `json:"device_one_time_keys_count"`
+	DeviceListsOTKCount          map[string]int `json:"device_one_time_keys_count"`
+	DeviceUnusedFallbackKeyTypes []string       `json:"device_unused_fallback_key_types"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -414,6 +408,10 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications struct {
+		HighlightCount    int `json:"highlight_count"`
+		NotificationCount int `json:"notification_count"`
+	} `json:"unread_notifications"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -480,10 +478,9 @@ type SendToDeviceNID int
 
 type SendToDeviceEvent struct {
 	gomatrixserverlib.SendToDeviceEvent
-	ID          SendToDeviceNID
-	UserID      string
-	DeviceID    string
-	SentByToken *StreamingToken
+	ID       SendToDeviceNID
+	UserID   string
+	DeviceID string
 }
 
 type PeekingDevice struct {
@@ -38,6 +38,9 @@ type UserInternalAPI interface {
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 	QuerySearchProfiles(ctx context.Context, req *QuerySearchProfilesRequest, res *QuerySearchProfilesResponse) error
+	QueryAccountPermissions(ctx context.Context, req *QueryAccountPermissionsRequest, res *QueryAccountPermissionsResponse) error
+	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *PerformPusherDeletionResponse) error
 }
 
 // InputAccountDataRequest is the request for InputAccountData
@@ -126,6 +129,45 @@ type QueryDevicesResponse struct {
 	Devices    []Device
 }
 
+// QueryAccountPermissionsRequest is the request for QueryAccountPermissions
+type QueryAccountPermissionsRequest struct {
+	// The local user ID to query
+	UserID string
+}
+
+// QueryAccountPermissionsResponse is the response for QueryAccountPermissions
+type QueryAccountPermissionsResponse struct {
+	// True if the user exists.
+	UserExists bool
+	// What the user is allowed to do. Only set if the user exists.
+	Permissions AccountPermissions
+	// Whether the account has been made a server administrator.
+	IsAdmin bool
+}
+
+// QueryPushersRequest is the request for QueryPushers
+type QueryPushersRequest struct {
+	// The local user ID to query
+	UserID string
+}
+
+// QueryPushersResponse is the response for QueryPushers
+type QueryPushersResponse struct {
+	Pushers []Pusher
+}
+
+// PerformPusherDeletionRequest is the request for PerformPusherDeletion
+type PerformPusherDeletionRequest struct {
+	// The local user ID who owns the pusher
+	UserID  string
+	AppID   string
+	PushKey string
+}
+
+// PerformPusherDeletionResponse is the response for PerformPusherDeletion
+type PerformPusherDeletionResponse struct {
+}
+
 // QueryProfileRequest is the request for QueryProfile
 type QueryProfileRequest struct {
 	// The user ID to query
@@ -219,6 +261,8 @@ type PerformDeviceCreationResponse struct {
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
 type PerformAccountDeactivationRequest struct {
 	Localpart string
+	// Whether to also erase the display name and avatar of the account.
+	EraseProfile bool
 }
 
 // PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
@@ -241,6 +285,9 @@ type Device struct {
 	LastSeenTS  int64
 	LastSeenIP  string
 	UserAgent   string
+	// The ID of the application service, if this is the dummy device that
+	// an application service uses to act as its users.
+	AppServiceID string
 }
 
 // Account represents a Matrix account on this home server.
@@ -249,10 +296,114 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	Suspended    bool
+	Deactivated  bool
+	Permissions  AccountPermissions
+	// Whether the user is a server administrator, as well as those listed in
+	// the config.
+	IsAdmin bool
+	// TODO: Other flags like IsGuest
 	// TODO: Associations (e.g. with application services)
 }
 
+// AccountPermissions are the things which server administrators can stop
+// an account from doing. All of them are allowed by default.
+type AccountPermissions struct {
+	CanCreateRooms bool `json:"can_create_rooms"`
+	CanInvite      bool `json:"can_invite"`
+	CanUploadMedia bool `json:"can_upload_media"`
+}
+
+// DefaultAccountPermissions returns the permissions that new accounts have.
+func DefaultAccountPermissions() AccountPermissions {
+	return AccountPermissions{
+		CanCreateRooms: true,
+		CanInvite:      true,
+		CanUploadMedia: true,
+	}
+}
+
+// RateLimitOverride replaces the client API rate limits for a user, so that
+// bots and bridges can send more than a person would. If both values are 0
+// then the user isn't rate limited at all.
+type RateLimitOverride struct {
+	MessagesPerSecond int64 `json:"messages_per_second"`
+	BurstCount        int64 `json:"burst_count"`
+}
+
+// RegistrationToken lets someone register when registration needs a token.
+// UsesAllowed is nil if the token can be used any number of times, and
+// ExpiryTime, in milliseconds since the epoch, is nil if it doesn't expire.
+type RegistrationToken struct {
+	Token       string                       `json:"token"`
+	UsesAllowed *int64                       `json:"uses_allowed"`
+	Completed   int64                        `json:"completed"`
+	ExpiryTime  *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+// IsValid returns true if the token hasn't expired or been used up.
+func (t *RegistrationToken) IsValid(now gomatrixserverlib.Timestamp) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || *t.ExpiryTime > now
+}
+
+// Pusher is a pusher which sends notifications about a user's events to a
+// push gateway. It is in the format used by the client-server API.
+type Pusher struct {
+	PushKey           string                 `json:"pushkey"`
+	Kind              string                 `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag,omitempty"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+	// When the push key was last updated.
+	PushKeyTS gomatrixserverlib.Timestamp `json:"pushkey_ts"`
+}
+
+// KeyBackupVersion is a version of a user's room key backup, along with
+// some information about the keys that are in it.
+type KeyBackupVersion struct {
+	Version   string
+	Algorithm string
+	AuthData  json.RawMessage
+	ETag      string
+	Count     int64
+}
+
+// KeyBackupSession is a single room key in a room key backup.
+type KeyBackupSession struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// ShouldReplaceRoomKey returns true if the new key should replace this one
+// in the backup, following the rules in the spec: verified keys win, then
+// keys with a lower first message index, then keys which have been
+// forwarded fewer times.
+func (a *KeyBackupSession) ShouldReplaceRoomKey(newKey *KeyBackupSession) bool {
+	if newKey.IsVerified != a.IsVerified {
+		return newKey.IsVerified
+	}
+	if newKey.FirstMessageIndex != a.FirstMessageIndex {
+		return newKey.FirstMessageIndex < a.FirstMessageIndex
+	}
+	return newKey.ForwardedCount < a.ForwardedCount
+}
+
+// InternalKeyBackupSession is a KeyBackupSession along with the room and
+// Megolm session that it belongs to.
+type InternalKeyBackupSession struct {
+	KeyBackupSession
+	RoomID    string
+	SessionID string
+}
+
 // ErrorForbidden is an error indicating that the supplied access token is forbidden
 type ErrorForbidden struct {
 	Message string
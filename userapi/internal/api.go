@@ -258,6 +258,50 @@ func (a *UserInternalAPI) QueryProfile(ctx context.Context, req *api.QueryProfil
 	return nil
 }
 
+func (a *UserInternalAPI) QueryAccountPermissions(ctx context.Context, req *api.QueryAccountPermissionsRequest, res *api.QueryAccountPermissionsResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query permissions of remote users: got %s want %s", domain, a.ServerName)
+	}
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, local)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	res.UserExists = true
+	res.Permissions = acc.Permissions
+	res.IsAdmin = acc.IsAdmin
+	return nil
+}
+
+func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	res.Pushers, err = a.AccountDB.GetPushers(ctx, local)
+	return err
+}
+
+func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot delete pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	return a.AccountDB.RemovePusher(ctx, local, req.AppID, req.PushKey)
+}
+
 func (a *UserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.QuerySearchProfilesRequest, res *api.QuerySearchProfilesResponse) error {
 	profiles, err := a.AccountDB.SearchProfiles(ctx, req.SearchString, req.Limit)
 	if err != nil {
@@ -355,21 +399,31 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	// The AS token is also the access token of the device of the AS's
+	// sender_localpart user.
+	if appService := a.appServiceForToken(req.AccessToken); appService != nil {
+		device.AppServiceID = appService.ID
+	}
 	res.Device = device
 	return nil
 }
 
+// appServiceForToken returns the application service with the given AS token,
+// or nil if there isn't one.
+func (a *UserInternalAPI) appServiceForToken(token string) *config.ApplicationService {
+	for i := range a.AppServices {
+		if a.AppServices[i].ASToken == token {
+			return &a.AppServices[i]
+		}
+	}
+	return nil
+}
+
 // Return the appservice 'device' or nil if the token is not an appservice. Returns an error if there was a problem
 // creating a 'device'.
 func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appServiceUserID string) (*api.Device, error) {
 	// Search for app service with given access_token
-	var appService *config.ApplicationService
-	for _, as := range a.AppServices {
-		if as.ASToken == token {
-			appService = &as
-			break
-		}
-	}
+	appService := a.appServiceForToken(token)
 	if appService == nil {
 		return nil, nil
 	}
@@ -379,7 +433,8 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 		// Use AS dummy device ID
 		ID: types.AppServiceDeviceID,
 		// AS dummy device has AS's token.
-		AccessToken: token,
+		AccessToken:  token,
+		AppServiceID: appService.ID,
 	}
 
 	localpart, err := userutil.ParseUsernameParam(appServiceUserID, &a.ServerName)
@@ -387,26 +442,65 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 		return nil, err
 	}
 
-	if localpart != "" { // AS is masquerading as another user
-		// Verify that the user is registered
+	if localpart != "" && localpart != appService.SenderLocalpart { // AS is masquerading as another user
+		userID := userutil.MakeUserID(localpart, a.ServerName)
+		if !appService.IsInterestedInUserID(userID) {
+			return nil, &api.ErrorForbidden{Message: "appservice cannot masquerade as this user"}
+		}
+		// Users in the namespace of the AS are created the first time that the
+		// AS masquerades as them, so that bridges don't have to register each
+		// of their ghost users before using them.
 		account, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
-		// Verify that account exists & appServiceID matches
-		if err == nil && account.AppServiceID == appService.ID {
-			// Set the userID of dummy device
-			dev.UserID = appServiceUserID
-			return &dev, nil
+		if err == sql.ErrNoRows {
+			if _, err = a.AccountDB.CreateAccount(ctx, localpart, "", appService.ID); err != nil && !errors.Is(err, sqlutil.ErrUserExists) {
+				return nil, err
+			}
+			account, err = a.AccountDB.GetAccountByLocalpart(ctx, localpart)
 		}
-		return nil, &api.ErrorForbidden{Message: "appservice has not registered this user"}
+		if err != nil {
+			return nil, err
+		}
+		// Verify that the account was registered by the AS
+		if account.AppServiceID != appService.ID {
+			return nil, &api.ErrorForbidden{Message: "appservice has not registered this user"}
+		}
+		// Set the userID of dummy device
+		dev.UserID = userID
+		return &dev, nil
 	}
 
 	// AS is not masquerading as any user, so use AS's sender_localpart
-	dev.UserID = appService.SenderLocalpart
+	dev.UserID = userutil.MakeUserID(appService.SenderLocalpart, a.ServerName)
 	return &dev, nil
 }
 
 // PerformAccountDeactivation deactivates the user's account, removing all ability for the user to login again.
 func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
-	err := a.AccountDB.DeactivateAccount(ctx, req.Localpart)
-	res.AccountDeactivated = err == nil
-	return err
+	if err := a.AccountDB.DeactivateAccount(ctx, req.Localpart); err != nil {
+		return err
+	}
+	res.AccountDeactivated = true
+
+	// The account can't be used any more, so stop sending push notifications
+	// for it and log out all of its devices.
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetPushers: %w", err)
+	}
+	for _, pusher := range pushers {
+		if err = a.AccountDB.RemovePusher(ctx, req.Localpart, pusher.AppID, pusher.PushKey); err != nil {
+			return fmt.Errorf("a.AccountDB.RemovePusher: %w", err)
+		}
+	}
+	if req.EraseProfile {
+		if err = a.AccountDB.SetDisplayName(ctx, req.Localpart, ""); err != nil {
+			return fmt.Errorf("a.AccountDB.SetDisplayName: %w", err)
+		}
+		if err = a.AccountDB.SetAvatarURL(ctx, req.Localpart, ""); err != nil {
+			return fmt.Errorf("a.AccountDB.SetAvatarURL: %w", err)
+		}
+	}
+	return a.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID: userutil.MakeUserID(req.Localpart, a.ServerName),
+	}, &api.PerformDeviceDeletionResponse{})
 }
@@ -35,13 +35,16 @@ const (
 	PerformLastSeenUpdatePath      = "/userapi/performLastSeenUpdate"
 	PerformDeviceUpdatePath        = "/userapi/performDeviceUpdate"
 	PerformAccountDeactivationPath = "/userapi/performAccountDeactivation"
-
-	QueryProfilePath        = "/userapi/queryProfile"
-	QueryAccessTokenPath    = "/userapi/queryAccessToken"
-	QueryDevicesPath        = "/userapi/queryDevices"
-	QueryAccountDataPath    = "/userapi/queryAccountData"
-	QueryDeviceInfosPath    = "/userapi/queryDeviceInfos"
-	QuerySearchProfilesPath = "/userapi/querySearchProfiles"
+	PerformPusherDeletionPath      = "/userapi/performPusherDeletion"
+
+	QueryProfilePath            = "/userapi/queryProfile"
+	QueryAccessTokenPath        = "/userapi/queryAccessToken"
+	QueryDevicesPath            = "/userapi/queryDevices"
+	QueryAccountDataPath        = "/userapi/queryAccountData"
+	QueryDeviceInfosPath        = "/userapi/queryDeviceInfos"
+	QuerySearchProfilesPath     = "/userapi/querySearchProfiles"
+	QueryAccountPermissionsPath = "/userapi/queryAccountPermissions"
+	QueryPushersPath            = "/userapi/queryPushers"
 )
 
 // NewUserAPIClient creates a UserInternalAPI implemented by talking to a HTTP POST API.
@@ -207,3 +210,27 @@ func (h *httpUserInternalAPI) QuerySearchProfiles(ctx context.Context, req *api.
 	apiURL := h.apiURL + QuerySearchProfilesPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
+
+func (h *httpUserInternalAPI) QueryAccountPermissions(ctx context.Context, req *api.QueryAccountPermissionsRequest, res *api.QueryAccountPermissionsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAccountPermissions")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryAccountPermissionsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPushers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPushersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
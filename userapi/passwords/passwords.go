@@ -0,0 +1,151 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package passwords hashes the passwords of local accounts with the
+// configured algorithm, and checks passwords against hashes made by any
+// of the supported algorithms.
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrMismatchedHashAndPassword is returned by Compare when the password
+// doesn't match the hash.
+var ErrMismatchedHashAndPassword = errors.New("passwords: hash is not the hash of the given password")
+
+const (
+	argon2idPrefix    = "$argon2id$"
+	argon2idSaltBytes = 16
+	argon2idKeyBytes  = 32
+)
+
+// Hasher hashes passwords using the configured algorithm.
+type Hasher struct {
+	cfg config.PasswordHashing
+}
+
+// NewHasher returns a hasher for the given configuration, which should
+// already have been verified.
+func NewHasher(cfg config.PasswordHashing) *Hasher {
+	return &Hasher{cfg: cfg}
+}
+
+// Hash returns the hash of the password, using the configured algorithm.
+func (h *Hasher) Hash(plaintext string) (string, error) {
+	switch h.cfg.Algorithm {
+	case config.PasswordHashingArgon2id:
+		salt := make([]byte, argon2idSaltBytes)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		return encodeArgon2id(h.cfg.Argon2id, salt, argon2idKey(plaintext, salt, h.cfg.Argon2id, argon2idKeyBytes)), nil
+	default:
+		hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), h.cfg.BcryptCost)
+		return string(hash), err
+	}
+}
+
+// Compare checks the password against the hash, which may have been made by
+// any supported algorithm. Returns ErrMismatchedHashAndPassword if the password
+// is wrong. If the password is right, also returns whether the hash should be
+// replaced with a new one because it wasn't made with the current configuration.
+func (h *Hasher) Compare(hash, plaintext string) (needsRehash bool, err error) {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare(key, argon2idKey(plaintext, salt, params, uint32(len(key)))) != 1 {
+			return false, ErrMismatchedHashAndPassword
+		}
+		return h.cfg.Algorithm != config.PasswordHashingArgon2id || params != h.cfg.Argon2id, nil
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, ErrMismatchedHashAndPassword
+		}
+		return false, err
+	}
+	if h.cfg.Algorithm != config.PasswordHashingBcrypt {
+		return true, nil
+	}
+	// Synapse writes bcrypt hashes with the "2b" version, whereas we write
+	// "2a", so they can be told apart after they have been imported.
+	if h.cfg.RehashSynapseHashes && strings.HasPrefix(hash, "$2b$") {
+		return true, nil
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, err
+	}
+	return cost != h.cfg.BcryptCost, nil
+}
+
+func argon2idKey(plaintext string, salt []byte, params config.Argon2idOptions, keyLen uint32) []byte {
+	return argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.MemoryKiB, params.Parallelism, keyLen)
+}
+
+// encodeArgon2id returns the hash in the PHC string format, which is also
+// used by the reference implementation and by other homeservers.
+func encodeArgon2id(params config.Argon2idOptions, salt, key []byte) string {
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.MemoryKiB, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func decodeArgon2id(hash string) (params config.Argon2idOptions, salt, key []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2idPrefix), "$")
+	if len(parts) != 4 {
+		return params, nil, nil, fmt.Errorf("passwords: malformed argon2id hash")
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[0], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("passwords: malformed argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("passwords: unsupported argon2id version %d", version)
+	}
+	if _, err = fmt.Sscanf(
+		parts[1], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Iterations, &params.Parallelism,
+	); err != nil {
+		return params, nil, nil, fmt.Errorf("passwords: malformed argon2id parameters: %w", err)
+	}
+	// argon2.IDKey panics if the iterations or parallelism are zero.
+	if params.MemoryKiB == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, fmt.Errorf("passwords: invalid argon2id parameters %q", parts[1])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return params, nil, nil, fmt.Errorf("passwords: malformed argon2id salt: %w", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return params, nil, nil, fmt.Errorf("passwords: malformed argon2id key: %w", err)
+	}
+	if len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("passwords: malformed argon2id hash")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Cheap parameters, so that the tests run quickly.
+func testConfig(algorithm config.PasswordHashingAlgorithm) config.PasswordHashing {
+	return config.PasswordHashing{
+		Algorithm:  algorithm,
+		BcryptCost: 4,
+		Argon2id: config.Argon2idOptions{
+			MemoryKiB:   64,
+			Iterations:  1,
+			Parallelism: 1,
+		},
+	}
+}
+
+func mustHash(t *testing.T, h *Hasher, plaintext string) string {
+	t.Helper()
+	hash, err := h.Hash(plaintext)
+	if err != nil {
+		t.Fatalf("Hash failed: %s", err)
+	}
+	return hash
+}
+
+func TestHashAndCompare(t *testing.T) {
+	for _, algorithm := range []config.PasswordHashingAlgorithm{config.PasswordHashingBcrypt, config.PasswordHashingArgon2id} {
+		h := NewHasher(testConfig(algorithm))
+		hash := mustHash(t, h, "hunter2")
+		if algorithm == config.PasswordHashingArgon2id && !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+			t.Errorf("unexpected argon2id hash %q", hash)
+		}
+		needsRehash, err := h.Compare(hash, "hunter2")
+		if err != nil {
+			t.Errorf("%s: Compare failed: %s", algorithm, err)
+		}
+		if needsRehash {
+			t.Errorf("%s: hash with the current configuration shouldn't need rehashing", algorithm)
+		}
+		if _, err = h.Compare(hash, "hunter3"); err != ErrMismatchedHashAndPassword {
+			t.Errorf("%s: expected ErrMismatchedHashAndPassword for the wrong password, got %v", algorithm, err)
+		}
+	}
+}
+
+func TestCompareNeedsRehash(t *testing.T) {
+	bcryptHash := mustHash(t, NewHasher(testConfig(config.PasswordHashingBcrypt)), "hunter2")
+	argon2idHash := mustHash(t, NewHasher(testConfig(config.PasswordHashingArgon2id)), "hunter2")
+
+	higherCost := testConfig(config.PasswordHashingBcrypt)
+	higherCost.BcryptCost = 5
+	moreMemory := testConfig(config.PasswordHashingArgon2id)
+	moreMemory.Argon2id.MemoryKiB = 128
+	rehashSynapse := testConfig(config.PasswordHashingBcrypt)
+	rehashSynapse.RehashSynapseHashes = true
+	// Synapse hashes are the same apart from the version.
+	synapseHash := "$2b$" + strings.TrimPrefix(bcryptHash, "$2a$")
+
+	tests := []struct {
+		name string
+		cfg  config.PasswordHashing
+		hash string
+		want bool
+	}{
+		{"bcrypt to argon2id", testConfig(config.PasswordHashingArgon2id), bcryptHash, true},
+		{"argon2id to bcrypt", testConfig(config.PasswordHashingBcrypt), argon2idHash, true},
+		{"bcrypt cost changed", higherCost, bcryptHash, true},
+		{"argon2id parameters changed", moreMemory, argon2idHash, true},
+		{"synapse hash", testConfig(config.PasswordHashingBcrypt), synapseHash, false},
+		{"synapse hash with rehashing required", rehashSynapse, synapseHash, true},
+		{"dendrite hash with synapse rehashing required", rehashSynapse, bcryptHash, false},
+	}
+	for _, tt := range tests {
+		needsRehash, err := NewHasher(tt.cfg).Compare(tt.hash, "hunter2")
+		if err != nil {
+			t.Errorf("%s: Compare failed: %s", tt.name, err)
+			continue
+		}
+		if needsRehash != tt.want {
+			t.Errorf("%s: got needsRehash %v, want %v", tt.name, needsRehash, tt.want)
+		}
+	}
+}
+
+func TestCompareMalformedArgon2id(t *testing.T) {
+	h := NewHasher(testConfig(config.PasswordHashingArgon2id))
+	hash := mustHash(t, h, "hunter2")
+	salt, key := strings.Split(hash, "$")[4], strings.Split(hash, "$")[5]
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"zero memory", "$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key},
+		{"zero iterations", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"zero parallelism", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+		{"wrong version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"missing parameters", "$argon2id$v=19$" + salt + "$" + key},
+	}
+	for _, tt := range tests {
+		if _, err := h.Compare(tt.hash, "hunter2"); err == nil || err == ErrMismatchedHashAndPassword {
+			t.Errorf("%s: expected a malformed hash error, got %v", tt.name, err)
+		}
+	}
+}
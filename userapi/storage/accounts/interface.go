@@ -52,6 +52,42 @@ type Database interface {
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
+	SetAccountSuspended(ctx context.Context, localpart string, suspended bool) error
+	SetAccountPermissions(ctx context.Context, localpart string, perms api.AccountPermissions) error
+	SetAccountAdmin(ctx context.Context, localpart string, admin bool) error
+	// GetAccounts returns up to limit accounts whose localparts come after from, in order of
+	// localpart, optionally only those whose localpart or display name contains search.
+	GetAccounts(ctx context.Context, from, search string, limit int) ([]api.Account, error)
+	CreateKeyBackup(ctx context.Context, userID, algorithm string, authData json.RawMessage) (version string, err error)
+	UpdateKeyBackupAuthData(ctx context.Context, userID, version string, authData json.RawMessage) error
+	DeleteKeyBackup(ctx context.Context, userID, version string) (exists bool, err error)
+	// GetKeyBackup returns the given backup version, or the latest one if the
+	// version is empty. Returns sql.ErrNoRows if there is no such version.
+	GetKeyBackup(ctx context.Context, userID, version string) (*api.KeyBackupVersion, error)
+	UpsertBackupKeys(ctx context.Context, userID, version string, uploads []api.InternalKeyBackupSession) (count int64, etag string, err error)
+	GetBackupKeys(ctx context.Context, userID, version, roomID, sessionID string) (map[string]map[string]api.KeyBackupSession, error)
+	DeleteBackupKeys(ctx context.Context, userID, version, roomID, sessionID string) (count int64, etag string, err error)
+	// UpsertPusher creates or replaces the user's pusher with the same app ID and push key. Unless
+	// appendPusher is set, any pushers with the same app ID and push key which belong to other users
+	// are deleted.
+	UpsertPusher(ctx context.Context, localpart, deviceID string, pusher api.Pusher, appendPusher bool) error
+	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
+	RemovePusher(ctx context.Context, localpart, appID, pushKey string) error
+	// GetRateLimitOverride returns the user's rate limit override, or nil if they don't have one.
+	GetRateLimitOverride(ctx context.Context, localpart string) (*api.RateLimitOverride, error)
+	SetRateLimitOverride(ctx context.Context, localpart string, override api.RateLimitOverride) error
+	RemoveRateLimitOverride(ctx context.Context, localpart string) error
+	// CreateRegistrationToken returns false if the token already exists.
+	CreateRegistrationToken(ctx context.Context, token api.RegistrationToken) (bool, error)
+	// GetRegistrationToken returns nil if the token doesn't exist.
+	GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error)
+	GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error)
+	RemoveRegistrationToken(ctx context.Context, token string) error
+	// UseRegistrationToken returns false if the token doesn't exist, has expired or has been used up.
+	UseRegistrationToken(ctx context.Context, token string) (bool, error)
+	// GetLocalpartForSSOIdentity returns an empty string if the identity isn't mapped to an account.
+	GetLocalpartForSSOIdentity(ctx context.Context, idpID, subject string) (string, error)
+	SaveSSOIdentity(ctx context.Context, idpID, subject, localpart string) error
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
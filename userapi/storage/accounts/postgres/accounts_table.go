@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -39,9 +40,17 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- Identifies which application service this account belongs to, if any.
     appservice_id TEXT,
     -- If the account is currently active
-    is_deactivated BOOLEAN DEFAULT FALSE
+    is_deactivated BOOLEAN DEFAULT FALSE,
+    -- If the account is currently suspended
+    is_suspended BOOLEAN DEFAULT FALSE,
+    -- Whether the user is allowed to create rooms, invite users and upload media
+    can_create_rooms BOOLEAN DEFAULT TRUE,
+    can_invite BOOLEAN DEFAULT TRUE,
+    can_upload_media BOOLEAN DEFAULT TRUE,
+    -- Whether the user is a server administrator
+    is_admin BOOLEAN DEFAULT FALSE
     -- TODO:
-    -- is_guest, is_admin, upgraded_ts, devices, any email reset stuff?
+    -- is_guest, upgraded_ts, devices, any email reset stuff?
 );
 -- Create sequence for autogenerated numeric usernames
 CREATE SEQUENCE IF NOT EXISTS numeric_username_seq START 1;
@@ -56,8 +65,27 @@ const updatePasswordSQL = "" +
 const deactivateAccountSQL = "" +
 	"UPDATE account_accounts SET is_deactivated = TRUE WHERE localpart = $1"
 
+const updateSuspendedSQL = "" +
+	"UPDATE account_accounts SET is_suspended = $1 WHERE localpart = $2"
+
+const updatePermissionsSQL = "" +
+	"UPDATE account_accounts SET can_create_rooms = $1, can_invite = $2, can_upload_media = $3 WHERE localpart = $4"
+
+const updateAdminSQL = "" +
+	"UPDATE account_accounts SET is_admin = $1 WHERE localpart = $2"
+
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, appservice_id, is_suspended, can_create_rooms, can_invite, can_upload_media, is_deactivated, is_admin" +
+	" FROM account_accounts WHERE localpart = $1"
+
+// Accounts are listed in order of localpart, so that the last localpart can
+// be used to fetch the next page. $2 is a LIKE pattern which is matched
+// against the localparts and display names of accounts.
+const selectAccountsSQL = "" +
+	"SELECT a.localpart, a.appservice_id, a.is_suspended, a.can_create_rooms, a.can_invite, a.can_upload_media, a.is_deactivated, a.is_admin" +
+	" FROM account_accounts a LEFT JOIN account_profiles p ON a.localpart = p.localpart" +
+	" WHERE a.localpart > $1 AND (a.localpart LIKE $2 OR p.display_name LIKE $2)" +
+	" ORDER BY a.localpart LIMIT $3"
 
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND is_deactivated = FALSE"
@@ -69,7 +97,11 @@ type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	updatePasswordStmt            *sql.Stmt
 	deactivateAccountStmt         *sql.Stmt
+	updateSuspendedStmt           *sql.Stmt
+	updatePermissionsStmt         *sql.Stmt
+	updateAdminStmt               *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
+	selectAccountsStmt            *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
@@ -90,9 +122,21 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.deactivateAccountStmt, err = db.Prepare(deactivateAccountSQL); err != nil {
 		return
 	}
+	if s.updateSuspendedStmt, err = db.Prepare(updateSuspendedSQL); err != nil {
+		return
+	}
+	if s.updatePermissionsStmt, err = db.Prepare(updatePermissionsSQL); err != nil {
+		return
+	}
+	if s.updateAdminStmt, err = db.Prepare(updateAdminSQL); err != nil {
+		return
+	}
 	if s.selectAccountByLocalpartStmt, err = db.Prepare(selectAccountByLocalpartSQL); err != nil {
 		return
 	}
+	if s.selectAccountsStmt, err = db.Prepare(selectAccountsSQL); err != nil {
+		return
+	}
 	if s.selectPasswordHashStmt, err = db.Prepare(selectPasswordHashSQL); err != nil {
 		return
 	}
@@ -127,6 +171,7 @@ func (s *accountsStatements) insertAccount(
 		UserID:       userutil.MakeUserID(localpart, s.serverName),
 		ServerName:   s.serverName,
 		AppServiceID: appserviceID,
+		Permissions:  api.DefaultAccountPermissions(),
 	}, nil
 }
 
@@ -144,6 +189,29 @@ func (s *accountsStatements) deactivateAccount(
 	return
 }
 
+func (s *accountsStatements) updateSuspended(
+	ctx context.Context, localpart string, suspended bool,
+) (err error) {
+	_, err = s.updateSuspendedStmt.ExecContext(ctx, suspended, localpart)
+	return
+}
+
+func (s *accountsStatements) updatePermissions(
+	ctx context.Context, localpart string, perms api.AccountPermissions,
+) (err error) {
+	_, err = s.updatePermissionsStmt.ExecContext(
+		ctx, perms.CanCreateRooms, perms.CanInvite, perms.CanUploadMedia, localpart,
+	)
+	return
+}
+
+func (s *accountsStatements) updateAdmin(
+	ctx context.Context, localpart string, admin bool,
+) (err error) {
+	_, err = s.updateAdminStmt.ExecContext(ctx, admin, localpart)
+	return
+}
+
 func (s *accountsStatements) selectPasswordHash(
 	ctx context.Context, localpart string,
 ) (hash string, err error) {
@@ -154,22 +222,61 @@ func (s *accountsStatements) selectPasswordHash(
 func (s *accountsStatements) selectAccountByLocalpart(
 	ctx context.Context, localpart string,
 ) (*api.Account, error) {
-	var appserviceIDPtr sql.NullString
-	var acc api.Account
-
-	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr)
+	acc, err := s.scanAccount(s.selectAccountByLocalpartStmt.QueryRowContext(ctx, localpart))
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
 		}
 		return nil, err
 	}
+	return acc, nil
+}
+
+func (s *accountsStatements) selectAccounts(
+	ctx context.Context, from, pattern string, limit int,
+) ([]api.Account, error) {
+	rows, err := s.selectAccountsStmt.QueryContext(ctx, from, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAccounts: rows.close() failed")
+	var accounts []api.Account
+	for rows.Next() {
+		var acc *api.Account
+		if acc, err = s.scanAccount(rows); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, *acc)
+	}
+	return accounts, rows.Err()
+}
+
+// scanAccount reads an account from a row with the columns of
+// selectAccountByLocalpartSQL.
+func (s *accountsStatements) scanAccount(row interface{ Scan(...interface{}) error }) (*api.Account, error) {
+	var appserviceIDPtr sql.NullString
+	var suspended, deactivated, admin sql.NullBool
+	var canCreateRooms, canInvite, canUploadMedia sql.NullBool
+	var acc api.Account
+	if err := row.Scan(
+		&acc.Localpart, &appserviceIDPtr, &suspended,
+		&canCreateRooms, &canInvite, &canUploadMedia, &deactivated, &admin,
+	); err != nil {
+		return nil, err
+	}
 	if appserviceIDPtr.Valid {
 		acc.AppServiceID = appserviceIDPtr.String
 	}
+	acc.Suspended = suspended.Valid && suspended.Bool
+	acc.Deactivated = deactivated.Valid && deactivated.Bool
+	acc.IsAdmin = admin.Valid && admin.Bool
+	acc.Permissions = api.AccountPermissions{
+		CanCreateRooms: !canCreateRooms.Valid || canCreateRooms.Bool,
+		CanInvite:      !canInvite.Valid || canInvite.Bool,
+		CanUploadMedia: !canUploadMedia.Valid || canUploadMedia.Bool,
+	}
 
-	acc.UserID = userutil.MakeUserID(localpart, s.serverName)
+	acc.UserID = userutil.MakeUserID(acc.Localpart, s.serverName)
 	acc.ServerName = s.serverName
 
 	return &acc, nil
@@ -0,0 +1,53 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGoosePermissions() {
+	goose.AddMigration(UpPermissions, DownPermissions)
+}
+
+func LoadPermissions(m *sqlutil.Migrations) {
+	m.AddMigration(UpPermissions, DownPermissions)
+}
+
+func UpPermissions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS can_create_rooms BOOLEAN DEFAULT TRUE;
+	ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS can_invite BOOLEAN DEFAULT TRUE;
+	ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS can_upload_media BOOLEAN DEFAULT TRUE;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownPermissions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE account_accounts DROP COLUMN can_create_rooms;
+	ALTER TABLE account_accounts DROP COLUMN can_invite;
+	ALTER TABLE account_accounts DROP COLUMN can_upload_media;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const keyBackupTableSchema = `
+-- The room keys in each version of a user's room key backup.
+CREATE TABLE IF NOT EXISTS account_e2e_room_keys (
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    version BIGINT NOT NULL,
+    first_message_index INTEGER NOT NULL,
+    forwarded_count INTEGER NOT NULL,
+    is_verified BOOLEAN NOT NULL,
+    -- The encrypted key, as JSON
+    session_data TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS account_e2e_room_keys_idx ON account_e2e_room_keys(user_id, room_id, session_id, version);
+CREATE INDEX IF NOT EXISTS account_e2e_room_keys_versions_user_idx ON account_e2e_room_keys(user_id, version);
+`
+
+const upsertBackupKeySQL = "" +
+	"INSERT INTO account_e2e_room_keys (user_id, room_id, session_id, version, first_message_index, forwarded_count, is_verified, session_data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (user_id, room_id, session_id, version) DO UPDATE SET" +
+	" first_message_index = $5, forwarded_count = $6, is_verified = $7, session_data = $8"
+
+const countKeysSQL = "" +
+	"SELECT COUNT(*) FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2"
+
+// An empty room or session ID matches all rooms or sessions.
+const selectKeysSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM account_e2e_room_keys" +
+	" WHERE user_id = $1 AND version = $2 AND ($3 = '' OR room_id = $3) AND ($4 = '' OR session_id = $4)"
+
+const deleteKeysSQL = "" +
+	"DELETE FROM account_e2e_room_keys" +
+	" WHERE user_id = $1 AND version = $2 AND ($3 = '' OR room_id = $3) AND ($4 = '' OR session_id = $4)"
+
+type keyBackupStatements struct {
+	upsertBackupKeyStmt *sql.Stmt
+	countKeysStmt       *sql.Stmt
+	selectKeysStmt      *sql.Stmt
+	deleteKeysStmt      *sql.Stmt
+}
+
+func (s *keyBackupStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(keyBackupTableSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertBackupKeyStmt, err = db.Prepare(upsertBackupKeySQL); err != nil {
+		return
+	}
+	if s.countKeysStmt, err = db.Prepare(countKeysSQL); err != nil {
+		return
+	}
+	if s.selectKeysStmt, err = db.Prepare(selectKeysSQL); err != nil {
+		return
+	}
+	if s.deleteKeysStmt, err = db.Prepare(deleteKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *keyBackupStatements) upsertBackupKey(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, key api.InternalKeyBackupSession,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertBackupKeyStmt).ExecContext(
+		ctx, userID, key.RoomID, key.SessionID, version, key.FirstMessageIndex,
+		key.ForwardedCount, key.IsVerified, string(key.SessionData),
+	)
+	return err
+}
+
+func (s *keyBackupStatements) countKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (count int64, err error) {
+	err = sqlutil.TxStmt(txn, s.countKeysStmt).QueryRowContext(ctx, userID, version).Scan(&count)
+	return
+}
+
+// selectKeys returns the keys in the backup as room ID -> session ID -> key.
+func (s *keyBackupStatements) selectKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectKeysStmt).QueryContext(ctx, userID, version, roomID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKeys: rows.close() failed")
+	result := make(map[string]map[string]api.KeyBackupSession)
+	for rows.Next() {
+		var key api.InternalKeyBackupSession
+		var sessionData string
+		if err = rows.Scan(
+			&key.RoomID, &key.SessionID, &key.FirstMessageIndex,
+			&key.ForwardedCount, &key.IsVerified, &sessionData,
+		); err != nil {
+			return nil, err
+		}
+		key.SessionData = json.RawMessage(sessionData)
+		if _, ok := result[key.RoomID]; !ok {
+			result[key.RoomID] = make(map[string]api.KeyBackupSession)
+		}
+		result[key.RoomID][key.SessionID] = key.KeyBackupSession
+	}
+	return result, rows.Err()
+}
+
+func (s *keyBackupStatements) deleteKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+) (int64, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeysStmt).ExecContext(ctx, userID, version, roomID, sessionID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const keyBackupVersionTableSchema = `
+CREATE SEQUENCE IF NOT EXISTS account_e2e_room_keys_versions_seq;
+
+-- The versions of each user's room key backup.
+CREATE TABLE IF NOT EXISTS account_e2e_room_keys_versions (
+    -- The Matrix user ID of the user who owns the backup
+    user_id TEXT NOT NULL,
+    -- The backup version, which is unique across all users
+    version BIGINT DEFAULT nextval('account_e2e_room_keys_versions_seq'),
+    -- The algorithm used to encrypt the keys in the backup
+    algorithm TEXT NOT NULL,
+    -- The algorithm-specific auth data, as JSON
+    auth_data TEXT NOT NULL,
+    -- Changes every time the keys in the backup change
+    etag BIGINT NOT NULL DEFAULT 0,
+    -- Whether or not the backup has been deleted
+    deleted BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS account_e2e_room_keys_versions_idx ON account_e2e_room_keys_versions(user_id, version);
+`
+
+const insertKeyBackupSQL = "" +
+	"INSERT INTO account_e2e_room_keys_versions (user_id, algorithm, auth_data) VALUES ($1, $2, $3) RETURNING version"
+
+const updateKeyBackupAuthDataSQL = "" +
+	"UPDATE account_e2e_room_keys_versions SET auth_data = $1 WHERE user_id = $2 AND version = $3"
+
+const updateKeyBackupETagSQL = "" +
+	"UPDATE account_e2e_room_keys_versions SET etag = etag + 1 WHERE user_id = $1 AND version = $2"
+
+const deleteKeyBackupSQL = "" +
+	"UPDATE account_e2e_room_keys_versions SET deleted = TRUE WHERE user_id = $1 AND version = $2 AND deleted = FALSE"
+
+const selectKeyBackupSQL = "" +
+	"SELECT algorithm, auth_data, etag FROM account_e2e_room_keys_versions WHERE user_id = $1 AND version = $2 AND deleted = FALSE"
+
+const selectLatestVersionSQL = "" +
+	"SELECT MAX(version) FROM account_e2e_room_keys_versions WHERE user_id = $1 AND deleted = FALSE"
+
+type keyBackupVersionStatements struct {
+	insertKeyBackupStmt         *sql.Stmt
+	updateKeyBackupAuthDataStmt *sql.Stmt
+	updateKeyBackupETagStmt     *sql.Stmt
+	deleteKeyBackupStmt         *sql.Stmt
+	selectKeyBackupStmt         *sql.Stmt
+	selectLatestVersionStmt     *sql.Stmt
+}
+
+func (s *keyBackupVersionStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(keyBackupVersionTableSchema)
+	if err != nil {
+		return
+	}
+	if s.insertKeyBackupStmt, err = db.Prepare(insertKeyBackupSQL); err != nil {
+		return
+	}
+	if s.updateKeyBackupAuthDataStmt, err = db.Prepare(updateKeyBackupAuthDataSQL); err != nil {
+		return
+	}
+	if s.updateKeyBackupETagStmt, err = db.Prepare(updateKeyBackupETagSQL); err != nil {
+		return
+	}
+	if s.deleteKeyBackupStmt, err = db.Prepare(deleteKeyBackupSQL); err != nil {
+		return
+	}
+	if s.selectKeyBackupStmt, err = db.Prepare(selectKeyBackupSQL); err != nil {
+		return
+	}
+	if s.selectLatestVersionStmt, err = db.Prepare(selectLatestVersionSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *keyBackupVersionStatements) insertKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID, algorithm string, authData json.RawMessage,
+) (version string, err error) {
+	var versionInt int64
+	err = sqlutil.TxStmt(txn, s.insertKeyBackupStmt).QueryRowContext(ctx, userID, algorithm, string(authData)).Scan(&versionInt)
+	return strconv.FormatInt(versionInt, 10), err
+}
+
+func (s *keyBackupVersionStatements) updateKeyBackupAuthData(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, authData json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateKeyBackupAuthDataStmt).ExecContext(ctx, string(authData), userID, version)
+	return err
+}
+
+func (s *keyBackupVersionStatements) updateKeyBackupETag(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateKeyBackupETagStmt).ExecContext(ctx, userID, version)
+	return err
+}
+
+func (s *keyBackupVersionStatements) deleteKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (bool, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeyBackupStmt).ExecContext(ctx, userID, version)
+	if err != nil {
+		return false, err
+	}
+	ra, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return ra == 1, nil
+}
+
+// selectKeyBackup returns the given backup version. Returns sql.ErrNoRows if
+// the version doesn't exist or has been deleted. The count of keys in the
+// backup isn't filled in.
+func (s *keyBackupVersionStatements) selectKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (*api.KeyBackupVersion, error) {
+	var authData string
+	var etag int64
+	res := api.KeyBackupVersion{
+		Version: strconv.FormatInt(version, 10),
+	}
+	err := sqlutil.TxStmt(txn, s.selectKeyBackupStmt).QueryRowContext(ctx, userID, version).Scan(
+		&res.Algorithm, &authData, &etag,
+	)
+	if err != nil {
+		return nil, err
+	}
+	res.AuthData = json.RawMessage(authData)
+	res.ETag = strconv.FormatInt(etag, 10)
+	return &res, nil
+}
+
+// selectLatestVersion returns the newest backup version which hasn't been
+// deleted. Returns sql.ErrNoRows if there isn't one.
+func (s *keyBackupVersionStatements) selectLatestVersion(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (int64, error) {
+	var version sql.NullInt64
+	err := sqlutil.TxStmt(txn, s.selectLatestVersionStmt).QueryRowContext(ctx, userID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if !version.Valid {
+		return 0, sql.ErrNoRows
+	}
+	return version.Int64, nil
+}
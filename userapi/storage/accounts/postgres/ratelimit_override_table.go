@@ -0,0 +1,102 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const rateLimitOverridesTableSchema = `
+-- The client API rate limits which server administrators have set for users.
+CREATE TABLE IF NOT EXISTS account_ratelimit_overrides (
+    -- The localpart of the user
+    localpart TEXT NOT NULL,
+    messages_per_second BIGINT NOT NULL,
+    burst_count BIGINT NOT NULL,
+    CONSTRAINT account_ratelimit_overrides_localpart_idx UNIQUE (localpart)
+);
+`
+
+const upsertRateLimitOverrideSQL = "" +
+	"INSERT INTO account_ratelimit_overrides (localpart, messages_per_second, burst_count)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT ON CONSTRAINT account_ratelimit_overrides_localpart_idx DO UPDATE SET" +
+	" messages_per_second = $2, burst_count = $3"
+
+const selectRateLimitOverrideSQL = "" +
+	"SELECT messages_per_second, burst_count FROM account_ratelimit_overrides WHERE localpart = $1"
+
+const deleteRateLimitOverrideSQL = "" +
+	"DELETE FROM account_ratelimit_overrides WHERE localpart = $1"
+
+type rateLimitOverridesStatements struct {
+	upsertRateLimitOverrideStmt *sql.Stmt
+	selectRateLimitOverrideStmt *sql.Stmt
+	deleteRateLimitOverrideStmt *sql.Stmt
+}
+
+func (s *rateLimitOverridesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(rateLimitOverridesTableSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertRateLimitOverrideStmt, err = db.Prepare(upsertRateLimitOverrideSQL); err != nil {
+		return
+	}
+	if s.selectRateLimitOverrideStmt, err = db.Prepare(selectRateLimitOverrideSQL); err != nil {
+		return
+	}
+	if s.deleteRateLimitOverrideStmt, err = db.Prepare(deleteRateLimitOverrideSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *rateLimitOverridesStatements) upsertRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string, override api.RateLimitOverride,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertRateLimitOverrideStmt).ExecContext(
+		ctx, localpart, override.MessagesPerSecond, override.BurstCount,
+	)
+	return err
+}
+
+// selectRateLimitOverride returns nil if the user doesn't have an override.
+func (s *rateLimitOverridesStatements) selectRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) (*api.RateLimitOverride, error) {
+	var override api.RateLimitOverride
+	err := sqlutil.TxStmt(txn, s.selectRateLimitOverrideStmt).QueryRowContext(ctx, localpart).Scan(
+		&override.MessagesPerSecond, &override.BurstCount,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+func (s *rateLimitOverridesStatements) deleteRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRateLimitOverrideStmt).ExecContext(ctx, localpart)
+	return err
+}
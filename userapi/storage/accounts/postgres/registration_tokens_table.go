@@ -0,0 +1,180 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const registrationTokensTableSchema = `
+-- The tokens which let people register when registration needs a token.
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+    token TEXT NOT NULL,
+    -- The number of times the token can be used, or NULL if there's no limit
+    uses_allowed BIGINT,
+    -- The number of registrations which have used the token
+    completed BIGINT NOT NULL DEFAULT 0,
+    -- When the token expires in milliseconds since the epoch, or NULL if it doesn't
+    expiry_time BIGINT,
+    CONSTRAINT account_registration_tokens_token_idx UNIQUE (token)
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens (token, uses_allowed, completed, expiry_time)" +
+	" VALUES ($1, $2, 0, $3)" +
+	" ON CONFLICT ON CONSTRAINT account_registration_tokens_token_idx DO NOTHING"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens ORDER BY token"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM account_registration_tokens WHERE token = $1"
+
+// Only tokens which haven't expired or been used up can be used.
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed + 1" +
+	" WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed)" +
+	" AND (expiry_time IS NULL OR expiry_time > $2)"
+
+type registrationTokensStatements struct {
+	insertRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokensStmt *sql.Stmt
+	deleteRegistrationTokenStmt  *sql.Stmt
+	useRegistrationTokenStmt     *sql.Stmt
+}
+
+func (s *registrationTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensTableSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRegistrationTokenStmt, err = db.Prepare(insertRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokenStmt, err = db.Prepare(selectRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokensStmt, err = db.Prepare(selectRegistrationTokensSQL); err != nil {
+		return
+	}
+	if s.deleteRegistrationTokenStmt, err = db.Prepare(deleteRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.useRegistrationTokenStmt, err = db.Prepare(useRegistrationTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertRegistrationToken returns false if the token already exists.
+func (s *registrationTokensStatements) insertRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token api.RegistrationToken,
+) (bool, error) {
+	var usesAllowed, expiryTime sql.NullInt64
+	if token.UsesAllowed != nil {
+		usesAllowed = sql.NullInt64{Int64: *token.UsesAllowed, Valid: true}
+	}
+	if token.ExpiryTime != nil {
+		expiryTime = sql.NullInt64{Int64: int64(*token.ExpiryTime), Valid: true}
+	}
+	res, err := sqlutil.TxStmt(txn, s.insertRegistrationTokenStmt).ExecContext(
+		ctx, token.Token, usesAllowed, expiryTime,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// selectRegistrationToken returns nil if the token doesn't exist.
+func (s *registrationTokensStatements) selectRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (*api.RegistrationToken, error) {
+	result, err := scanRegistrationToken(
+		sqlutil.TxStmt(txn, s.selectRegistrationTokenStmt).QueryRowContext(ctx, token),
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return result, err
+}
+
+func (s *registrationTokensStatements) selectRegistrationTokens(
+	ctx context.Context, txn *sql.Tx,
+) ([]api.RegistrationToken, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRegistrationTokensStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRegistrationTokens: rows.close() failed")
+	tokens := []api.RegistrationToken{}
+	for rows.Next() {
+		token, err := scanRegistrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *registrationTokensStatements) deleteRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRegistrationTokenStmt).ExecContext(ctx, token)
+	return err
+}
+
+// useRegistrationToken returns false if the token doesn't exist, has expired
+// or has been used up.
+func (s *registrationTokensStatements) useRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string, now gomatrixserverlib.Timestamp,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.useRegistrationTokenStmt).ExecContext(ctx, token, int64(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanRegistrationToken(row interface{ Scan(...interface{}) error }) (*api.RegistrationToken, error) {
+	var token api.RegistrationToken
+	var usesAllowed, expiryTime sql.NullInt64
+	if err := row.Scan(&token.Token, &usesAllowed, &token.Completed, &expiryTime); err != nil {
+		return nil, err
+	}
+	if usesAllowed.Valid {
+		token.UsesAllowed = &usesAllowed.Int64
+	}
+	if expiryTime.Valid {
+		ts := gomatrixserverlib.Timestamp(expiryTime.Int64)
+		token.ExpiryTime = &ts
+	}
+	return &token, nil
+}
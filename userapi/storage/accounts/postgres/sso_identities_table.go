@@ -0,0 +1,86 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const ssoIdentitiesTableSchema = `
+-- The accounts that people who logged in through single sign-on are mapped
+-- to, keyed by the identity provider and the subject that it gave them.
+CREATE TABLE IF NOT EXISTS account_sso_identities (
+    -- The ID of the identity provider in the config
+    idp_id TEXT NOT NULL,
+    -- The identifier of the user at the identity provider
+    subject TEXT NOT NULL,
+    -- The localpart of the account that the user logs in to
+    localpart TEXT NOT NULL,
+    CONSTRAINT account_sso_identities_idp_subject_idx UNIQUE (idp_id, subject)
+);
+
+CREATE INDEX IF NOT EXISTS account_sso_identities_localpart_idx ON account_sso_identities(localpart);
+`
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO account_sso_identities (idp_id, subject, localpart) VALUES ($1, $2, $3)" +
+	" ON CONFLICT ON CONSTRAINT account_sso_identities_idp_subject_idx DO NOTHING"
+
+const selectLocalpartForSSOIdentitySQL = "" +
+	"SELECT localpart FROM account_sso_identities WHERE idp_id = $1 AND subject = $2"
+
+type ssoIdentitiesStatements struct {
+	insertSSOIdentityStmt             *sql.Stmt
+	selectLocalpartForSSOIdentityStmt *sql.Stmt
+}
+
+func (s *ssoIdentitiesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(ssoIdentitiesTableSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSSOIdentityStmt, err = db.Prepare(insertSSOIdentitySQL); err != nil {
+		return
+	}
+	if s.selectLocalpartForSSOIdentityStmt, err = db.Prepare(selectLocalpartForSSOIdentitySQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertSSOIdentity maps the identity to the account. Identities which are
+// already mapped to an account aren't changed.
+func (s *ssoIdentitiesStatements) insertSSOIdentity(
+	ctx context.Context, txn *sql.Tx, idpID, subject, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSSOIdentityStmt).ExecContext(ctx, idpID, subject, localpart)
+	return err
+}
+
+// selectLocalpartForSSOIdentity returns an empty string if the identity isn't
+// mapped to an account.
+func (s *ssoIdentitiesStatements) selectLocalpartForSSOIdentity(
+	ctx context.Context, txn *sql.Tx, idpID, subject string,
+) (string, error) {
+	var localpart string
+	err := sqlutil.TxStmt(txn, s.selectLocalpartForSSOIdentityStmt).QueryRowContext(ctx, idpID, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return localpart, err
+}
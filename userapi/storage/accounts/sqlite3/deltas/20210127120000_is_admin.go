@@ -0,0 +1,92 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/pressly/goose"
+)
+
+func LoadFromGooseIsAdmin() {
+	goose.AddMigration(UpIsAdmin, DownIsAdmin)
+}
+
+func LoadIsAdmin(m *sqlutil.Migrations) {
+	m.AddMigration(UpIsAdmin, DownIsAdmin)
+}
+
+func UpIsAdmin(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE account_accounts RENAME TO account_accounts_tmp;
+CREATE TABLE account_accounts (
+    localpart TEXT NOT NULL PRIMARY KEY,
+    created_ts BIGINT NOT NULL,
+    password_hash TEXT,
+    appservice_id TEXT,
+    is_deactivated BOOLEAN DEFAULT 0,
+    is_suspended BOOLEAN DEFAULT 0,
+    can_create_rooms BOOLEAN DEFAULT 1,
+    can_invite BOOLEAN DEFAULT 1,
+    can_upload_media BOOLEAN DEFAULT 1,
+    is_admin BOOLEAN DEFAULT 0
+);
+INSERT
+    INTO account_accounts (
+      localpart, created_ts, password_hash, appservice_id, is_deactivated, is_suspended,
+      can_create_rooms, can_invite, can_upload_media
+    ) SELECT
+        localpart, created_ts, password_hash, appservice_id, is_deactivated, is_suspended,
+        can_create_rooms, can_invite, can_upload_media
+    FROM account_accounts_tmp
+;
+DROP TABLE account_accounts_tmp;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownIsAdmin(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE account_accounts RENAME TO account_accounts_tmp;
+CREATE TABLE account_accounts (
+    localpart TEXT NOT NULL PRIMARY KEY,
+    created_ts BIGINT NOT NULL,
+    password_hash TEXT,
+    appservice_id TEXT,
+    is_deactivated BOOLEAN DEFAULT 0,
+    is_suspended BOOLEAN DEFAULT 0,
+    can_create_rooms BOOLEAN DEFAULT 1,
+    can_invite BOOLEAN DEFAULT 1,
+    can_upload_media BOOLEAN DEFAULT 1
+);
+INSERT
+    INTO account_accounts (
+      localpart, created_ts, password_hash, appservice_id, is_deactivated, is_suspended,
+      can_create_rooms, can_invite, can_upload_media
+    ) SELECT
+        localpart, created_ts, password_hash, appservice_id, is_deactivated, is_suspended,
+        can_create_rooms, can_invite, can_upload_media
+    FROM account_accounts_tmp
+;
+DROP TABLE account_accounts_tmp;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
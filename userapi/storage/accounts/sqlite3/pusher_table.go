@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pushersTableSchema = `
+-- The pushers which send notifications about each user's events to a push gateway.
+CREATE TABLE IF NOT EXISTS account_pushers (
+    -- The localpart of the user who owns the pusher
+    localpart TEXT NOT NULL,
+    -- The ID of the device which created the pusher
+    device_id TEXT NOT NULL,
+    pushkey TEXT NOT NULL,
+    -- When the push key was last updated, in milliseconds
+    pushkey_ts_ms BIGINT NOT NULL,
+    kind TEXT NOT NULL,
+    app_id TEXT NOT NULL,
+    app_display_name TEXT NOT NULL,
+    device_display_name TEXT NOT NULL,
+    profile_tag TEXT NOT NULL,
+    lang TEXT NOT NULL,
+    -- The pusher data, as JSON
+    data TEXT NOT NULL,
+    UNIQUE (app_id, pushkey, localpart)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_localpart_idx ON account_pushers(localpart);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, device_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)" +
+	" ON CONFLICT (app_id, pushkey, localpart) DO UPDATE SET" +
+	" device_id = $2, pushkey_ts_ms = $4, kind = $5, app_display_name = $7, device_display_name = $8, profile_tag = $9, lang = $10, data = $11"
+
+const selectPushersSQL = "" +
+	"SELECT pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = $1"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePushersByAppIDAndPushKeySQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart != $3"
+
+type pushersStatements struct {
+	upsertPusherStmt                   *sql.Stmt
+	selectPushersStmt                  *sql.Stmt
+	deletePusherStmt                   *sql.Stmt
+	deletePushersByAppIDAndPushKeyStmt *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushersTableSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.selectPushersStmt, err = db.Prepare(selectPushersSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deletePushersByAppIDAndPushKeyStmt, err = db.Prepare(deletePushersByAppIDAndPushKeySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID string, pusher api.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.upsertPusherStmt).ExecContext(
+		ctx, localpart, deviceID, pusher.PushKey, pusher.PushKeyTS, pusher.Kind, pusher.AppID,
+		pusher.AppDisplayName, pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Language, string(data),
+	)
+	return err
+}
+
+func (s *pushersStatements) selectPushers(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) ([]api.Pusher, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectPushersStmt).QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPushers: rows.close() failed")
+	pushers := []api.Pusher{}
+	for rows.Next() {
+		var pusher api.Pusher
+		var pushKeyTS int64
+		var data string
+		if err = rows.Scan(
+			&pusher.PushKey, &pushKeyTS, &pusher.Kind, &pusher.AppID, &pusher.AppDisplayName,
+			&pusher.DeviceDisplayName, &pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		pusher.PushKeyTS = gomatrixserverlib.Timestamp(pushKeyTS)
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherStmt).ExecContext(ctx, localpart, appID, pushKey)
+	return err
+}
+
+// deletePushersByAppIDAndPushKey deletes the pushers with the given app ID and
+// push key which belong to users other than the given one.
+func (s *pushersStatements) deletePushersByAppIDAndPushKey(
+	ctx context.Context, txn *sql.Tx, appID, pushKey, exceptLocalpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePushersByAppIDAndPushKeyStmt).ExecContext(ctx, appID, pushKey, exceptLocalpart)
+	return err
+}
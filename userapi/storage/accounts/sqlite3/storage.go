@@ -21,14 +21,16 @@ import (
 	"errors"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/passwords"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts/sqlite3/deltas"
 	"github.com/matrix-org/gomatrixserverlib"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sirupsen/logrus"
 )
 
 // Database represents an account database
@@ -37,11 +39,18 @@ type Database struct {
 	writer sqlutil.Writer
 
 	sqlutil.PartitionOffsetStatements
-	accounts     accountsStatements
-	profiles     profilesStatements
-	accountDatas accountDataStatements
-	threepids    threepidStatements
-	serverName   gomatrixserverlib.ServerName
+	accounts           accountsStatements
+	profiles           profilesStatements
+	accountDatas       accountDataStatements
+	threepids          threepidStatements
+	keyBackupVersions  keyBackupVersionStatements
+	keyBackups         keyBackupStatements
+	pushers            pushersStatements
+	rateLimitOverrides rateLimitOverridesStatements
+	registrationTokens registrationTokensStatements
+	ssoIdentities      ssoIdentitiesStatements
+	serverName         gomatrixserverlib.ServerName
+	hasher             *passwords.Hasher
 
 	accountsMu     sync.Mutex
 	profilesMu     sync.Mutex
@@ -50,13 +59,14 @@ type Database struct {
 }
 
 // NewDatabase creates a new accounts and profiles database
-func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName) (*Database, error) {
+func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName, passwordHashing *config.PasswordHashing) (*Database, error) {
 	db, err := sqlutil.Open(dbProperties)
 	if err != nil {
 		return nil, err
 	}
 	d := &Database{
 		serverName: serverName,
+		hasher:     passwords.NewHasher(*passwordHashing),
 		db:         db,
 		writer:     sqlutil.NewExclusiveWriter(),
 	}
@@ -68,6 +78,9 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadIsActive(m)
+	deltas.LoadIsSuspended(m)
+	deltas.LoadPermissions(m)
+	deltas.LoadIsAdmin(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -76,10 +89,12 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = partitions.Prepare(db, d.writer, "account"); err != nil {
 		return nil, err
 	}
-	if err = d.accounts.prepare(db, serverName); err != nil {
+	// The accounts table joins on to the profiles table when listing accounts,
+	// so the profiles table has to exist first.
+	if err = d.profiles.prepare(db); err != nil {
 		return nil, err
 	}
-	if err = d.profiles.prepare(db); err != nil {
+	if err = d.accounts.prepare(db, serverName); err != nil {
 		return nil, err
 	}
 	if err = d.accountDatas.prepare(db); err != nil {
@@ -88,6 +103,24 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.threepids.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.keyBackupVersions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.keyBackups.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.pushers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.rateLimitOverrides.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.registrationTokens.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.ssoIdentities.prepare(db); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -101,9 +134,20 @@ func (d *Database) GetAccountByPassword(
 	if err != nil {
 		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
+	needsRehash, err := d.hasher.Compare(hash, plaintextPassword)
+	if err != nil {
 		return nil, err
 	}
+	if needsRehash {
+		// The password is right, so this is our chance to upgrade the hash to
+		// the configured algorithm. The user can still log in if this fails.
+		if hash, err = d.hasher.Hash(plaintextPassword); err == nil {
+			err = d.accounts.updatePassword(ctx, localpart, hash)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("localpart", localpart).Warn("Failed to rehash password")
+		}
+	}
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
@@ -143,7 +187,7 @@ func (d *Database) SetDisplayName(
 func (d *Database) SetPassword(
 	ctx context.Context, localpart, plaintextPassword string,
 ) error {
-	hash, err := hashPassword(plaintextPassword)
+	hash, err := d.hasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -207,7 +251,7 @@ func (d *Database) createAccount(
 	// Generate a password hash if this is not a password-less user
 	hash := ""
 	if plaintextPassword != "" {
-		hash, err = hashPassword(plaintextPassword)
+		hash, err = d.hasher.Hash(plaintextPassword)
 		if err != nil {
 			return nil, err
 		}
@@ -278,11 +322,6 @@ func (d *Database) GetNewNumericLocalpart(
 	return d.accounts.selectNewNumericLocalpart(ctx, nil)
 }
 
-func hashPassword(plaintext string) (hash string, err error) {
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
-	return string(hashBytes), err
-}
-
 // Err3PIDInUse is the error returned when trying to save an association involving
 // a third-party identifier which is already associated to a local user.
 var Err3PIDInUse = errors.New("This third-party identifier is already in use")
@@ -377,3 +416,311 @@ func (d *Database) SearchProfiles(ctx context.Context, searchString string, limi
 func (d *Database) DeactivateAccount(ctx context.Context, localpart string) (err error) {
 	return d.accounts.deactivateAccount(ctx, localpart)
 }
+
+// SetAccountSuspended suspends or unsuspends the user's account. Unlike
+// deactivation this can be undone, and the account is otherwise left as is.
+func (d *Database) SetAccountSuspended(ctx context.Context, localpart string, suspended bool) error {
+	return d.accounts.updateSuspended(ctx, localpart, suspended)
+}
+
+// SetAccountPermissions sets what the user's account is allowed to do.
+func (d *Database) SetAccountPermissions(ctx context.Context, localpart string, perms api.AccountPermissions) error {
+	return d.accounts.updatePermissions(ctx, localpart, perms)
+}
+
+// SetAccountAdmin sets whether the user is a server administrator.
+func (d *Database) SetAccountAdmin(ctx context.Context, localpart string, admin bool) error {
+	return d.accounts.updateAdmin(ctx, localpart, admin)
+}
+
+// GetAccounts returns up to limit accounts whose localparts come after from,
+// in order of localpart. If search isn't empty then only the accounts whose
+// localpart or display name contains it are returned.
+func (d *Database) GetAccounts(ctx context.Context, from, search string, limit int) ([]api.Account, error) {
+	return d.accounts.selectAccounts(ctx, from, "%"+search+"%", limit)
+}
+
+// CreateKeyBackup creates a new version of the user's room key backup and
+// returns the version.
+func (d *Database) CreateKeyBackup(
+	ctx context.Context, userID, algorithm string, authData json.RawMessage,
+) (version string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		version, err = d.keyBackupVersions.insertKeyBackup(ctx, txn, userID, algorithm, authData)
+		return err
+	})
+	return
+}
+
+// UpdateKeyBackupAuthData replaces the auth data of the given backup version.
+func (d *Database) UpdateKeyBackupAuthData(
+	ctx context.Context, userID, version string, authData json.RawMessage,
+) error {
+	versionInt, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return sql.ErrNoRows
+	}
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.keyBackupVersions.updateKeyBackupAuthData(ctx, txn, userID, versionInt, authData)
+	})
+}
+
+// DeleteKeyBackup deletes the given backup version. Returns false if the
+// version didn't exist or had already been deleted.
+func (d *Database) DeleteKeyBackup(
+	ctx context.Context, userID, version string,
+) (exists bool, err error) {
+	versionInt, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		exists, err = d.keyBackupVersions.deleteKeyBackup(ctx, txn, userID, versionInt)
+		return err
+	})
+	return
+}
+
+// GetKeyBackup returns the given backup version, or the latest one if the
+// version is empty. Returns sql.ErrNoRows if there is no such version.
+func (d *Database) GetKeyBackup(
+	ctx context.Context, userID, version string,
+) (*api.KeyBackupVersion, error) {
+	var versionInt int64
+	var err error
+	if version == "" {
+		versionInt, err = d.keyBackupVersions.selectLatestVersion(ctx, nil, userID)
+	} else {
+		versionInt, err = strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.getKeyBackup(ctx, nil, userID, versionInt)
+}
+
+func (d *Database) getKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (*api.KeyBackupVersion, error) {
+	backup, err := d.keyBackupVersions.selectKeyBackup(ctx, txn, userID, version)
+	if err != nil {
+		return nil, err
+	}
+	backup.Count, err = d.keyBackups.countKeys(ctx, txn, userID, version)
+	if err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// UpsertBackupKeys adds the keys to the given backup version. Keys which are
+// already in the backup are only replaced if the new key is better, as
+// decided by ShouldReplaceRoomKey. Returns the new key count and etag of the
+// backup.
+func (d *Database) UpsertBackupKeys(
+	ctx context.Context, userID, version string, uploads []api.InternalKeyBackupSession,
+) (count int64, etag string, err error) {
+	versionInt, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return 0, "", sql.ErrNoRows
+	}
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		changed := false
+		for _, upload := range uploads {
+			existing, err := d.keyBackups.selectKeys(ctx, txn, userID, versionInt, upload.RoomID, upload.SessionID)
+			if err != nil {
+				return err
+			}
+			if key, ok := existing[upload.RoomID][upload.SessionID]; ok && !key.ShouldReplaceRoomKey(&upload.KeyBackupSession) {
+				continue
+			}
+			if err = d.keyBackups.upsertBackupKey(ctx, txn, userID, versionInt, upload); err != nil {
+				return err
+			}
+			changed = true
+		}
+		return d.keyBackupResult(ctx, txn, userID, versionInt, changed, &count, &etag)
+	})
+	return
+}
+
+// GetBackupKeys returns the keys in the given backup version as room ID ->
+// session ID -> key. An empty room or session ID matches all of them.
+func (d *Database) GetBackupKeys(
+	ctx context.Context, userID, version, roomID, sessionID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	versionInt, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return d.keyBackups.selectKeys(ctx, nil, userID, versionInt, roomID, sessionID)
+}
+
+// DeleteBackupKeys deletes keys from the given backup version. An empty room
+// or session ID matches all of them. Returns the new key count and etag of
+// the backup.
+func (d *Database) DeleteBackupKeys(
+	ctx context.Context, userID, version, roomID, sessionID string,
+) (count int64, etag string, err error) {
+	versionInt, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return 0, "", sql.ErrNoRows
+	}
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		deleted, err := d.keyBackups.deleteKeys(ctx, txn, userID, versionInt, roomID, sessionID)
+		if err != nil {
+			return err
+		}
+		return d.keyBackupResult(ctx, txn, userID, versionInt, deleted > 0, &count, &etag)
+	})
+	return
+}
+
+// keyBackupResult updates the etag of the backup if the keys in it have
+// changed, and then looks up the key count and etag to return to the client.
+func (d *Database) keyBackupResult(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, changed bool,
+	count *int64, etag *string,
+) error {
+	if changed {
+		if err := d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, version); err != nil {
+			return err
+		}
+	}
+	backup, err := d.getKeyBackup(ctx, txn, userID, version)
+	if err != nil {
+		return err
+	}
+	*count, *etag = backup.Count, backup.ETag
+	return nil
+}
+
+// UpsertPusher creates or replaces the user's pusher with the same app ID and
+// push key. Unless appendPusher is set, any pushers with the same app ID and
+// push key which belong to other users are deleted.
+func (d *Database) UpsertPusher(
+	ctx context.Context, localpart, deviceID string, pusher api.Pusher, appendPusher bool,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if !appendPusher {
+			if err := d.pushers.deletePushersByAppIDAndPushKey(ctx, txn, pusher.AppID, pusher.PushKey, localpart); err != nil {
+				return err
+			}
+		}
+		return d.pushers.upsertPusher(ctx, txn, localpart, deviceID, pusher)
+	})
+}
+
+// GetPushers returns the user's pushers.
+func (d *Database) GetPushers(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	return d.pushers.selectPushers(ctx, nil, localpart)
+}
+
+// RemovePusher deletes the user's pusher with the given app ID and push key,
+// if there is one.
+func (d *Database) RemovePusher(
+	ctx context.Context, localpart, appID, pushKey string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.deletePusher(ctx, txn, localpart, appID, pushKey)
+	})
+}
+
+// GetRateLimitOverride returns the user's rate limit override, or nil if
+// they don't have one.
+func (d *Database) GetRateLimitOverride(
+	ctx context.Context, localpart string,
+) (*api.RateLimitOverride, error) {
+	return d.rateLimitOverrides.selectRateLimitOverride(ctx, nil, localpart)
+}
+
+// SetRateLimitOverride creates or replaces the user's rate limit override.
+func (d *Database) SetRateLimitOverride(
+	ctx context.Context, localpart string, override api.RateLimitOverride,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.rateLimitOverrides.upsertRateLimitOverride(ctx, txn, localpart, override)
+	})
+}
+
+// RemoveRateLimitOverride deletes the user's rate limit override, if there
+// is one.
+func (d *Database) RemoveRateLimitOverride(
+	ctx context.Context, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.rateLimitOverrides.deleteRateLimitOverride(ctx, txn, localpart)
+	})
+}
+
+// CreateRegistrationToken stores a new registration token. Returns false if
+// the token already exists.
+func (d *Database) CreateRegistrationToken(
+	ctx context.Context, token api.RegistrationToken,
+) (created bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		created, err = d.registrationTokens.insertRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// GetRegistrationToken returns the registration token, or nil if it doesn't
+// exist.
+func (d *Database) GetRegistrationToken(
+	ctx context.Context, token string,
+) (*api.RegistrationToken, error) {
+	return d.registrationTokens.selectRegistrationToken(ctx, nil, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(
+	ctx context.Context,
+) ([]api.RegistrationToken, error) {
+	return d.registrationTokens.selectRegistrationTokens(ctx, nil)
+}
+
+// RemoveRegistrationToken deletes the registration token, if it exists.
+func (d *Database) RemoveRegistrationToken(
+	ctx context.Context, token string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.registrationTokens.deleteRegistrationToken(ctx, txn, token)
+	})
+}
+
+// UseRegistrationToken counts a registration against the registration token.
+// Returns false if the token doesn't exist, has expired or has been used up.
+func (d *Database) UseRegistrationToken(
+	ctx context.Context, token string,
+) (used bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		used, err = d.registrationTokens.useRegistrationToken(ctx, txn, token, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
+// GetLocalpartForSSOIdentity returns the localpart of the account that the
+// single sign-on identity is mapped to, or an empty string if it isn't mapped
+// to an account.
+func (d *Database) GetLocalpartForSSOIdentity(
+	ctx context.Context, idpID, subject string,
+) (string, error) {
+	return d.ssoIdentities.selectLocalpartForSSOIdentity(ctx, nil, idpID, subject)
+}
+
+// SaveSSOIdentity maps the single sign-on identity to the account. Identities
+// which are already mapped to an account aren't changed.
+func (d *Database) SaveSSOIdentity(
+	ctx context.Context, idpID, subject, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.ssoIdentities.insertSSOIdentity(ctx, txn, idpID, subject, localpart)
+	})
+}
@@ -2,10 +2,13 @@ package userapi_test
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
@@ -23,9 +26,11 @@ const (
 )
 
 func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database) {
+	passwordHashing := &config.PasswordHashing{}
+	passwordHashing.Defaults()
 	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: "file::memory:",
-	}, serverName)
+	}, serverName, passwordHashing)
 	if err != nil {
 		t.Fatalf("failed to create account DB: %s", err)
 	}
@@ -118,3 +123,305 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+func TestAccountSuspension(t *testing.T) {
+	_, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	if _, err := accountDB.CreateAccount(ctx, "bob", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	for _, suspended := range []bool{true, false} {
+		if err := accountDB.SetAccountSuspended(ctx, "bob", suspended); err != nil {
+			t.Fatalf("failed to set suspended to %v: %s", suspended, err)
+		}
+		acc, err := accountDB.GetAccountByPassword(ctx, "bob", "foobar")
+		if err != nil {
+			t.Fatalf("failed to get account: %s", err)
+		}
+		if acc.Suspended != suspended {
+			t.Errorf("Suspended got %v want %v", acc.Suspended, suspended)
+		}
+	}
+}
+
+func TestAppServiceMasquerading(t *testing.T) {
+	ctx := context.TODO()
+	passwordHashing := &config.PasswordHashing{}
+	passwordHashing.Defaults()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, passwordHashing)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	appService := config.ApplicationService{
+		ID:              "bridge",
+		ASToken:         "as_token",
+		SenderLocalpart: "bridgebot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {{Exclusive: true, RegexpObject: regexp.MustCompile(`^@bridge_.*:example\.com$`)}},
+		},
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, &config.UserAPI{
+		DeviceDatabase: config.DatabaseOptions{
+			ConnectionString:   "file::memory:",
+			MaxOpenConnections: 1,
+			MaxIdleConnections: 1,
+		},
+		Matrix: &config.Global{ServerName: serverName},
+	}, []config.ApplicationService{appService}, nil)
+	if _, err = accountDB.CreateAccount(ctx, "bridge_taken", "", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+
+	query := func(userID string) *api.QueryAccessTokenResponse {
+		t.Helper()
+		var res api.QueryAccessTokenResponse
+		if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{
+			AccessToken:      "as_token",
+			AppServiceUserID: userID,
+		}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		return &res
+	}
+
+	// Users in the namespace are created the first time they're used.
+	res := query("@bridge_alice:example.com")
+	if res.Err != nil || res.Device == nil || res.Device.UserID != "@bridge_alice:example.com" || res.Device.AppServiceID != "bridge" {
+		t.Fatalf("expected to masquerade as a new user, got %+v (%v)", res.Device, res.Err)
+	}
+	acc, err := accountDB.GetAccountByLocalpart(ctx, "bridge_alice")
+	if err != nil || acc.AppServiceID != "bridge" {
+		t.Fatalf("expected the user to be created for the appservice, got %+v (%v)", acc, err)
+	}
+	if res = query("@bridge_alice:example.com"); res.Err != nil || res.Device == nil {
+		t.Fatalf("expected to masquerade as an existing user, got %+v (%v)", res.Device, res.Err)
+	}
+	if res = query("@bridgebot:example.com"); res.Err != nil || res.Device == nil || res.Device.UserID != "@bridgebot:example.com" {
+		t.Fatalf("expected to act as the sender, got %+v (%v)", res.Device, res.Err)
+	}
+
+	// Users outside of the namespace, or which the appservice didn't
+	// register, can't be used.
+	for _, userID := range []string{"@alice:example.com", "@bridge_taken:example.com"} {
+		if res = query(userID); res.Err == nil {
+			t.Errorf("expected not to be able to masquerade as %s, got %+v", userID, res.Device)
+		}
+	}
+	if _, err = accountDB.GetAccountByLocalpart(ctx, "alice"); err != sql.ErrNoRows {
+		t.Errorf("expected users outside of the namespace not to be created, got %v", err)
+	}
+}
+
+func TestQueryAccountPermissions(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	if _, err := accountDB.CreateAccount(ctx, "carol", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	query := func(t *testing.T) api.QueryAccountPermissionsResponse {
+		var res api.QueryAccountPermissionsResponse
+		if err := userAPI.QueryAccountPermissions(ctx, &api.QueryAccountPermissionsRequest{
+			UserID: "@carol:" + string(serverName),
+		}, &res); err != nil {
+			t.Fatalf("QueryAccountPermissions failed: %s", err)
+		}
+		return res
+	}
+
+	res := query(t)
+	if !res.UserExists {
+		t.Fatalf("QueryAccountPermissions says user doesn't exist")
+	}
+	if want := api.DefaultAccountPermissions(); res.Permissions != want {
+		t.Errorf("default permissions got %+v want %+v", res.Permissions, want)
+	}
+
+	want := api.AccountPermissions{CanCreateRooms: false, CanInvite: true, CanUploadMedia: false}
+	if err := accountDB.SetAccountPermissions(ctx, "carol", want); err != nil {
+		t.Fatalf("failed to set permissions: %s", err)
+	}
+	if res = query(t); res.Permissions != want {
+		t.Errorf("permissions got %+v want %+v", res.Permissions, want)
+	}
+}
+
+func TestAccountAdmin(t *testing.T) {
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	if _, err := accountDB.CreateAccount(ctx, "dave", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	for _, admin := range []bool{true, false} {
+		if err := accountDB.SetAccountAdmin(ctx, "dave", admin); err != nil {
+			t.Fatalf("failed to set admin to %v: %s", admin, err)
+		}
+		acc, err := accountDB.GetAccountByLocalpart(ctx, "dave")
+		if err != nil {
+			t.Fatalf("failed to get account: %s", err)
+		}
+		if acc.IsAdmin != admin {
+			t.Errorf("IsAdmin got %v want %v", acc.IsAdmin, admin)
+		}
+		var res api.QueryAccountPermissionsResponse
+		if err = userAPI.QueryAccountPermissions(ctx, &api.QueryAccountPermissionsRequest{
+			UserID: "@dave:" + string(serverName),
+		}, &res); err != nil {
+			t.Fatalf("QueryAccountPermissions failed: %s", err)
+		}
+		if res.IsAdmin != admin {
+			t.Errorf("QueryAccountPermissions IsAdmin got %v want %v", res.IsAdmin, admin)
+		}
+	}
+}
+
+func TestGetAccounts(t *testing.T) {
+	_, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	for _, localpart := range []string{"erin", "alice", "frank", "bob"} {
+		if _, err := accountDB.CreateAccount(ctx, localpart, "foobar", ""); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+	}
+	if err := accountDB.SetDisplayName(ctx, "frank", "Bobby Tables"); err != nil {
+		t.Fatalf("failed to set display name: %s", err)
+	}
+	localparts := func(accs []api.Account) []string {
+		res := []string{}
+		for _, acc := range accs {
+			res = append(res, acc.Localpart)
+		}
+		return res
+	}
+
+	testCases := []struct {
+		from, search string
+		limit        int
+		want         []string
+	}{
+		{"", "", 10, []string{"alice", "bob", "erin", "frank"}},
+		{"", "", 2, []string{"alice", "bob"}},
+		{"bob", "", 2, []string{"erin", "frank"}},
+		{"frank", "", 2, []string{}},
+		// Matches the localpart of bob and the display name of frank.
+		{"", "bob", 10, []string{"bob", "frank"}},
+		{"bob", "bob", 10, []string{"frank"}},
+	}
+	for _, tc := range testCases {
+		accs, err := accountDB.GetAccounts(ctx, tc.from, tc.search, tc.limit)
+		if err != nil {
+			t.Fatalf("GetAccounts failed: %s", err)
+		}
+		if got := localparts(accs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GetAccounts(%q, %q, %d) got %v want %v", tc.from, tc.search, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestKeyBackup(t *testing.T) {
+	_, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	userID := "@dave:" + string(serverName)
+
+	version, err := accountDB.CreateKeyBackup(ctx, userID, "m.megolm_backup.v1.curve25519-aes-sha2", []byte(`{"public_key":"abc"}`))
+	if err != nil {
+		t.Fatalf("failed to create key backup: %s", err)
+	}
+	backup, err := accountDB.GetKeyBackup(ctx, userID, "")
+	if err != nil {
+		t.Fatalf("failed to get latest key backup: %s", err)
+	}
+	if backup.Version != version || backup.Count != 0 {
+		t.Fatalf("latest backup got %+v want version %s with no keys", backup, version)
+	}
+
+	upload := func(key api.KeyBackupSession) (int64, string) {
+		count, etag, err := accountDB.UpsertBackupKeys(ctx, userID, version, []api.InternalKeyBackupSession{
+			{KeyBackupSession: key, RoomID: "!room:example.com", SessionID: "session"},
+		})
+		if err != nil {
+			t.Fatalf("failed to upload key: %s", err)
+		}
+		return count, etag
+	}
+	count, etag := upload(api.KeyBackupSession{FirstMessageIndex: 5, SessionData: []byte(`"a"`)})
+	if count != 1 || etag == backup.ETag {
+		t.Fatalf("first upload got count %d etag %q, want 1 key and a new etag", count, etag)
+	}
+
+	// A worse key mustn't replace the existing one, and doesn't change the etag.
+	if _, newETag := upload(api.KeyBackupSession{FirstMessageIndex: 10, SessionData: []byte(`"b"`)}); newETag != etag {
+		t.Errorf("etag changed to %q from %q when nothing was replaced", newETag, etag)
+	}
+	upload(api.KeyBackupSession{FirstMessageIndex: 5, IsVerified: true, SessionData: []byte(`"c"`)})
+	keys, err := accountDB.GetBackupKeys(ctx, userID, version, "", "")
+	if err != nil {
+		t.Fatalf("failed to get keys: %s", err)
+	}
+	if got := string(keys["!room:example.com"]["session"].SessionData); got != `"c"` {
+		t.Errorf("session data got %s want the verified key", got)
+	}
+
+	if count, _, err = accountDB.DeleteBackupKeys(ctx, userID, version, "!room:example.com", ""); err != nil {
+		t.Fatalf("failed to delete keys: %s", err)
+	}
+	if count != 0 {
+		t.Errorf("count after deleting keys got %d want 0", count)
+	}
+	if exists, err := accountDB.DeleteKeyBackup(ctx, userID, version); err != nil || !exists {
+		t.Fatalf("failed to delete key backup: exists=%v err=%v", exists, err)
+	}
+	if _, err = accountDB.GetKeyBackup(ctx, userID, version); err != sql.ErrNoRows {
+		t.Errorf("GetKeyBackup after delete got %v want sql.ErrNoRows", err)
+	}
+}
+
+func TestRegistrationTokens(t *testing.T) {
+	_, accountDB := MustMakeInternalAPI(t)
+	ctx := context.TODO()
+	usesAllowed := int64(1)
+	expired := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+	for _, token := range []api.RegistrationToken{
+		{Token: "once", UsesAllowed: &usesAllowed},
+		{Token: "expired", ExpiryTime: &expired},
+	} {
+		if created, err := accountDB.CreateRegistrationToken(ctx, token); err != nil || !created {
+			t.Fatalf("failed to create token %q: %v %s", token.Token, created, err)
+		}
+	}
+	if created, err := accountDB.CreateRegistrationToken(ctx, api.RegistrationToken{Token: "once"}); err != nil || created {
+		t.Fatalf("wanted duplicate token not to be created: %v %s", created, err)
+	}
+
+	for token, want := range map[string]bool{"once": true, "expired": false, "unknown": false} {
+		used, err := accountDB.UseRegistrationToken(ctx, token)
+		if err != nil {
+			t.Fatalf("failed to use token %q: %s", token, err)
+		}
+		if used != want {
+			t.Errorf("token %q used got %v want %v", token, used, want)
+		}
+	}
+	if used, err := accountDB.UseRegistrationToken(ctx, "once"); err != nil || used {
+		t.Errorf("wanted used up token not to be used again: %v %s", used, err)
+	}
+	token, err := accountDB.GetRegistrationToken(ctx, "once")
+	if err != nil || token == nil {
+		t.Fatalf("failed to get token: %s", err)
+	}
+	if token.Completed != 1 || token.IsValid(gomatrixserverlib.AsTimestamp(time.Now())) {
+		t.Errorf("wanted token to be used up, got %+v", token)
+	}
+
+	if err = accountDB.RemoveRegistrationToken(ctx, "once"); err != nil {
+		t.Fatalf("failed to remove token: %s", err)
+	}
+	tokens, err := accountDB.GetRegistrationTokens(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tokens: %s", err)
+	}
+	if len(tokens) != 1 || tokens[0].Token != "expired" {
+		t.Errorf("wanted only the expired token to be left, got %+v", tokens)
+	}
+}